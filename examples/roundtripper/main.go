@@ -22,9 +22,14 @@ func fullConfigRoundTripper(ctx context.Context) (*proxymw.RoundTripperEntry, er
 		return nil, err
 	}
 
-	mw := proxymw.NewRoundTripperFromConfig(cfg, http.DefaultTransport)
-	mw.Init(ctx)
-	return mw, err
+	mw, err := proxymw.NewRoundTripperFromConfigE(cfg, http.DefaultTransport)
+	if err != nil {
+		return nil, err
+	}
+	if err := mw.Init(ctx); err != nil {
+		return nil, err
+	}
+	return mw, nil
 }
 
 func main() {
@@ -50,4 +55,7 @@ func main() {
 	}
 
 	fmt.Println("Status", resp.StatusCode)
+	if err := rt.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,31 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/internal/util"
+)
+
+func TestLRU(t *testing.T) {
+	cache := util.NewLRU[string, int](2)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+
+	// reading a makes b the least recently used entry
+	v, ok := cache.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	cache.Add("c", 3)
+	require.Equal(t, 2, cache.Len())
+
+	_, ok = cache.Get("b")
+	require.False(t, ok)
+
+	cache.Add("a", 10)
+	v, ok = cache.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 10, v)
+}
@@ -31,6 +31,14 @@ func (m *SyncMap[K, V]) Store(key K, value V) {
 	m.items[key] = value
 }
 
+// Load returns the value for a key and whether it was present
+func (m *SyncMap[K, V]) Load(key K) (V, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.items[key]
+	return value, ok
+}
+
 // Range calls f sequentially for each key and value in the map.
 // If f returns false, range stops the iteration.
 func (m *SyncMap[K, V]) Range(f func(key K, value V) bool) {
@@ -42,3 +50,17 @@ func (m *SyncMap[K, V]) Range(f func(key K, value V) bool) {
 		}
 	}
 }
+
+// Delete removes the value for a key
+func (m *SyncMap[K, V]) Delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+}
+
+// Len returns the number of keys in the map
+func (m *SyncMap[K, V]) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.items)
+}
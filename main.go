@@ -4,8 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,22 +14,41 @@ import (
 
 	"github.com/metalmatze/signal/internalserver"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "go.uber.org/automaxprocs"
 
+	"github.com/kevindweb/throttle-proxy/proxymw"
 	"github.com/kevindweb/throttle-proxy/proxyutil"
 	"github.com/kevindweb/throttle-proxy/proxyutil/proxyhttp"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case proxyutil.LoadTestCommand:
+			runLoadTest(os.Args[2:])
+			return
+		case proxyutil.ReplayCommand:
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+
 	cfg, err := proxyutil.ParseConfigFlags()
 	if err != nil {
 		log.Fatalf("Failed to parse flags: %v", err)
 	}
+	if err := cfg.Server.Validate(); err != nil {
+		log.Fatalf("Invalid server config: %v", err)
+	}
+
+	report := proxyutil.NewRuntimeReport(cfg)
+	report.Log()
 
 	ctx := context.Background()
 	servers := make([]*http.Server, 0, 2)
-	insecureServer, err := setupInsecureServer(ctx, cfg)
+	insecureServer, chain, err := setupInsecureServer(ctx, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -37,7 +56,7 @@ func main() {
 		servers = append(servers, insecureServer)
 	}
 
-	internalServer, err := setupInternalServer(cfg)
+	internalServer, err := setupInternalServer(ctx, cfg, report)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -62,24 +81,83 @@ func main() {
 			}
 		}
 	}
+
+	if err := proxymw.SaveThrottleState(ctx); err != nil {
+		log.Printf("failed to save backpressure state: %v", err)
+	}
+
+	// the chain is closed once no request can reach it, so its pollers do not outlive the server
+	if err := chain.Close(); err != nil {
+		log.Printf("failed to close middleware chain: %v", err)
+	}
+}
+
+// runLoadTest sends traffic at a running proxy until interrupted and prints the outcome
+func runLoadTest(args []string) {
+	cfg, err := proxyutil.ParseLoadTestFlags(args)
+	if err != nil {
+		log.Fatalf("Failed to parse load test flags: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Load testing %s at %.1f qps with %d workers\n", cfg.Target, cfg.QPS, cfg.Concurrency)
+	report, err := proxyutil.RunLoadTest(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Load test failed: %v", err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatalf("Failed to write load test report: %v", err)
+	}
+}
+
+// runReplay re-sends a record file against another environment and prints the outcome
+func runReplay(args []string) {
+	cfg, err := proxyutil.ParseReplayFlags(args)
+	if err != nil {
+		log.Fatalf("Failed to parse replay flags: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Replaying %s against %s at %.1fx speed\n", cfg.File, cfg.Target, cfg.Speed)
+	report, err := proxyutil.RunReplay(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatalf("Failed to write replay report: %v", err)
+	}
 }
 
-func setupInsecureServer(ctx context.Context, cfg proxyutil.Config) (*http.Server, error) {
+// setupInsecureServer serves the proxy routes and returns the closer of their middleware chain
+func setupInsecureServer(
+	ctx context.Context, cfg proxyutil.Config,
+) (*http.Server, io.Closer, error) {
 	if cfg.ProxyConfig.ClientTimeout == 0 {
 		cfg.ProxyConfig.ClientTimeout = 2 * cfg.ReadTimeout
 	}
 
 	routes, err := proxyhttp.NewRoutes(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create proxymw Routes: %v", err)
+		return nil, nil, fmt.Errorf("failed to create proxymw Routes: %v", err)
+	}
+	chain, ok := routes.(io.Closer)
+	if !ok {
+		return nil, nil, errors.New("proxymw Routes cannot be closed")
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", routes)
 
-	l, err := net.Listen("tcp", cfg.InsecureListenAddress)
+	l, err := cfg.Server.Listen(ctx, cfg.InsecureListenAddress)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen on insecure address: %v", err)
+		return nil, nil, fmt.Errorf("failed to listen on insecure address: %v", err)
+	}
+	if cfg.ProxyProtocol {
+		l = proxyutil.NewProxyProtocolListener(l)
 	}
 
 	srv := &http.Server{
@@ -87,6 +165,7 @@ func setupInsecureServer(ctx context.Context, cfg proxyutil.Config) (*http.Serve
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
 	}
+	cfg.Server.Apply(srv)
 
 	go func() {
 		log.Printf("Listening on %s for routes\n", l.Addr().String())
@@ -95,10 +174,12 @@ func setupInsecureServer(ctx context.Context, cfg proxyutil.Config) (*http.Serve
 		}
 	}()
 
-	return srv, nil
+	return srv, chain, nil
 }
 
-func setupInternalServer(cfg proxyutil.Config) (*http.Server, error) {
+func setupInternalServer(
+	ctx context.Context, cfg proxyutil.Config, report proxyutil.RuntimeReport,
+) (*http.Server, error) {
 	if cfg.InternalListenAddress == "" {
 		return nil, nil
 	}
@@ -110,11 +191,70 @@ func setupInternalServer(cfg proxyutil.Config) (*http.Server, error) {
 
 	h := internalserver.NewHandler(
 		internalserver.WithName("Internal throttle-proxy API"),
-		internalserver.WithPrometheusRegistry(reg),
 		internalserver.WithPProf(),
 	)
+	// OpenMetrics is negotiated so exemplars on latency histograms are exposed
+	h.AddEndpoint(
+		"/metrics",
+		"Exposes Prometheus metrics",
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP,
+	)
+	h.AddEndpoint("/api/v1/runtime", "Runtime report of active protections", report.ServeHTTP)
+	h.AddEndpoint(
+		proxymw.MaintenancePath,
+		"Maintenance mode (GET), or switch it to off, block, or open (POST)",
+		proxymw.MaintenanceHandler,
+	)
+	h.AddEndpoint(
+		proxymw.ChainPath,
+		"Middlewares of the running chain in order with their config, secrets redacted",
+		proxymw.ChainHandler,
+	)
+	h.AddEndpoint(
+		proxymw.InflightPath,
+		"Proxied requests in flight with the stage they wait in, filtered by ?min_age= and ?stage=",
+		proxymw.InflightHandler,
+	)
+	h.AddEndpoint(
+		proxymw.EventsPath,
+		"Stream of throttle decisions as server-sent events, filtered by ?type=",
+		proxymw.EventsHandler,
+	)
+	if cfg.ProxyConfig.EnableTenantStats {
+		h.AddEndpoint(
+			"/api/v1/tenants",
+			"Per-tenant request summaries over a sliding window",
+			proxymw.TenantSummaryHandler,
+		)
+	}
+	if cfg.ProxyConfig.EnableBackpressure {
+		h.AddEndpoint(
+			proxymw.BackpressureQueriesPath,
+			"List (GET), add (POST), or remove (DELETE ?name=) backpressure queries at runtime",
+			proxymw.BackpressureQueriesHandler,
+		)
+		h.AddEndpoint(
+			proxymw.ThrottleStatePath,
+			"Backpressure watermark, allowance, and per-query values and throttles",
+			proxymw.ThrottleStateHandler,
+		)
+	}
+	if cfg.ProxyConfig.EnableAudit {
+		h.AddEndpoint(
+			proxymw.RecentBlocksPath,
+			"Recently blocked requests, filtered by ?blocked_by=, ?tenant=, and ?limit=",
+			proxymw.RecentBlocksHandler,
+		)
+	}
+	if cfg.ProxyConfig.EnableQuotas {
+		h.AddEndpoint(
+			proxymw.QuotasPath,
+			"Per-tenant quota usage, optionally filtered by ?tenant=",
+			proxymw.QuotasHandler,
+		)
+	}
 
-	l, err := net.Listen("tcp", cfg.InternalListenAddress)
+	l, err := cfg.Server.Listen(ctx, cfg.InternalListenAddress)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on internal address: %v", err)
 	}
@@ -124,6 +264,7 @@ func setupInternalServer(cfg proxyutil.Config) (*http.Server, error) {
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
 	}
+	cfg.Server.Apply(srv)
 
 	go func() {
 		log.Printf("Listening on %s for metrics and pprof", l.Addr().String())
@@ -0,0 +1,301 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kevindweb/throttle-proxy/internal/util"
+)
+
+const (
+	AccessLogProxyType = "access_log"
+
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatCombined = "combined"
+
+	DefaultAccessLogMaxSizeMB   = 100
+	DefaultAccessLogMaxBackups  = 5
+	accessLogCombinedTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+	// Access log decisions
+	DecisionAllowed = "allowed"
+	DecisionBlocked = "blocked"
+	DecisionError   = "error"
+)
+
+var (
+	ErrInvalidAccessLogFormat = errors.New("access log format must be json or combined")
+	ErrNegativeAccessLogSize  = errors.New("access log max size and backups cannot be negative")
+)
+
+// AccessLogConfig writes one line per proxied request, including requests rejected by the
+// throttling middlewares.
+type AccessLogConfig struct {
+	EnableAccessLog bool `yaml:"enable_access_log"`
+	// AccessLogFormat is "json" (default) or "combined", the Apache combined format followed by
+	// the latency in milliseconds, criticality, decision, tenant, and trace ID when traced.
+	AccessLogFormat string `yaml:"access_log_format"`
+	// AccessLogFile writes the log to a file rotated at AccessLogMaxSizeMB instead of the logger
+	AccessLogFile       string `yaml:"access_log_file"`
+	AccessLogMaxSizeMB  int    `yaml:"access_log_max_size_mb"`
+	AccessLogMaxBackups int    `yaml:"access_log_max_backups"`
+	// AccessLogTenantHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	AccessLogTenantHeader string `yaml:"access_log_tenant_header"`
+	// AccessLogger receives the log when no file is set. Defaults to the standard logger.
+	AccessLogger *log.Logger `yaml:"-"`
+}
+
+func (c AccessLogConfig) Validate() error {
+	if !c.EnableAccessLog {
+		return nil
+	}
+
+	switch c.AccessLogFormat {
+	case "", AccessLogFormatJSON, AccessLogFormatCombined:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidAccessLogFormat, c.AccessLogFormat)
+	}
+
+	if c.AccessLogMaxSizeMB < 0 || c.AccessLogMaxBackups < 0 {
+		return ErrNegativeAccessLogSize
+	}
+	return nil
+}
+
+func (c AccessLogConfig) format() string {
+	if c.AccessLogFormat == "" {
+		return AccessLogFormatJSON
+	}
+	return c.AccessLogFormat
+}
+
+func (c AccessLogConfig) header() string {
+	if c.AccessLogTenantHeader == "" {
+		return DefaultTenantHeader
+	}
+	return http.CanonicalHeaderKey(c.AccessLogTenantHeader)
+}
+
+// logger opens the rotated log file when one is configured
+func (c AccessLogConfig) logger() (*log.Logger, error) {
+	if c.AccessLogFile == "" {
+		if c.AccessLogger != nil {
+			return c.AccessLogger, nil
+		}
+		return log.Default(), nil
+	}
+
+	maxSize, backups := c.AccessLogMaxSizeMB, c.AccessLogMaxBackups
+	if maxSize == 0 {
+		maxSize = DefaultAccessLogMaxSizeMB
+	}
+	if backups == 0 {
+		backups = DefaultAccessLogMaxBackups
+	}
+
+	file, err := util.OpenRotatingFile(c.AccessLogFile, int64(maxSize)<<20, backups)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return log.New(file, "", 0), nil
+}
+
+// AccessLogEntry is one line of the access log
+type AccessLogEntry struct {
+	Time        time.Time `json:"time"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ClientIP    string    `json:"client_ip"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Proto       string    `json:"proto"`
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	LatencyMs   float64   `json:"latency_ms"`
+	Criticality string    `json:"criticality"`
+	Decision    string    `json:"decision"`
+	BlockedBy   string    `json:"blocked_by,omitempty"`
+	Tenant      string    `json:"tenant"`
+	Referer     string    `json:"referer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	TraceID     string    `json:"trace_id,omitempty"`
+}
+
+// AccessLog logs every request after the rest of the chain handled it
+type AccessLog struct {
+	client ProxyClient
+	logger *log.Logger
+	format string
+	header string
+	now    func() time.Time
+}
+
+var _ ProxyClient = &AccessLog{}
+
+func NewAccessLog(client ProxyClient, cfg AccessLogConfig) (*AccessLog, error) {
+	logger, err := cfg.logger()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessLog{
+		client: client,
+		logger: logger,
+		format: cfg.format(),
+		header: cfg.header(),
+		now:    time.Now,
+	}, nil
+}
+
+func (al *AccessLog) Init(ctx context.Context) error {
+	return al.client.Init(ctx)
+}
+
+func (al *AccessLog) Next(rr Request) error {
+	start := al.now()
+	req := rr.Request()
+
+	next, w := rr, (*statusWriter)(nil)
+	if rrw, ok := rr.(ResponseWriter); ok && rrw.ResponseWriter() != nil {
+		w = &statusWriter{ResponseWriter: rrw.ResponseWriter()}
+		next = &RequestResponseWrapper{req: req, w: w}
+	}
+
+	err := al.client.Next(next)
+	entry := al.entry(req, start)
+	switch {
+	case err != nil:
+		entry.Decision, entry.Status = DecisionError, http.StatusInternalServerError
+		var blocked *RequestBlockedError
+		if errors.As(err, &blocked) {
+			entry.Decision, entry.BlockedBy = DecisionBlocked, blocked.Type
+			entry.Status = blocked.HTTPStatus()
+		}
+	case w != nil:
+		entry.Status, entry.Bytes = w.code(), w.bytes
+	default:
+		if res, ok := rr.(Response); ok && res.Response() != nil {
+			entry.Status, entry.Bytes = res.Response().StatusCode, res.Response().ContentLength
+		}
+	}
+
+	al.write(entry)
+	return err
+}
+
+func (al *AccessLog) entry(req *http.Request, start time.Time) AccessLogEntry {
+	tenant := req.Header.Get(al.header)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	criticality := req.Header.Get(string(HeaderCriticality))
+	if criticality == "" {
+		criticality = CriticalityDefault
+	}
+
+	return AccessLogEntry{
+		Time:        start,
+		RemoteAddr:  req.RemoteAddr,
+		ClientIP:    ClientIP(req),
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Proto:       req.Proto,
+		LatencyMs:   float64(al.now().Sub(start).Microseconds()) / 1000,
+		Criticality: criticality,
+		Decision:    DecisionAllowed,
+		Tenant:      tenant,
+		Referer:     req.Referer(),
+		UserAgent:   req.UserAgent(),
+		TraceID:     traceID(req),
+	}
+}
+
+func (al *AccessLog) write(entry AccessLogEntry) {
+	if al.format == AccessLogFormatCombined {
+		al.logger.Print(combinedLine(entry))
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("error encoding access log entry: %v", err)
+		return
+	}
+	al.logger.Print(string(line))
+}
+
+// combinedLine formats the entry in the Apache combined format with the throttling fields appended
+func combinedLine(e AccessLogEntry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	host := e.ClientIP
+	if host == "" {
+		host = e.RemoteAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+
+	line := fmt.Sprintf(
+		"%s - - [%s] %q %d %s %q %q %.3f %s %s %s",
+		host, e.Time.Format(accessLogCombinedTimeLayout), e.Method+" "+e.Path+" "+e.Proto,
+		e.Status, bytes, e.Referer, e.UserAgent, e.LatencyMs, e.Criticality, e.decision(), e.Tenant,
+	)
+	if e.TraceID != "" {
+		line += " " + e.TraceID
+	}
+	return line
+}
+
+// decision joins the decision with the middleware that blocked the request
+func (e AccessLogEntry) decision() string {
+	if e.BlockedBy != "" {
+		return e.Decision + ":" + e.BlockedBy
+	}
+	return e.Decision
+}
+
+// statusWriter records the status and size of a response written by the upstream handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the original writer to http.ResponseController for flushing
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,136 @@
+package proxymw
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, AccessLogConfig{AccessLogFormat: "xml"}.Validate())
+	require.NoError(t, AccessLogConfig{EnableAccessLog: true}.Validate())
+	require.ErrorIs(t, AccessLogConfig{
+		EnableAccessLog: true,
+		AccessLogFormat: "xml",
+	}.Validate(), ErrInvalidAccessLogFormat)
+	require.ErrorIs(t, AccessLogConfig{
+		EnableAccessLog:    true,
+		AccessLogMaxSizeMB: -1,
+	}.Validate(), ErrNegativeAccessLogSize)
+}
+
+func newTestAccessLog(t *testing.T, cfg AccessLogConfig, next ProxyClient) (*AccessLog, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	cfg.AccessLogger = log.New(&buf, "", 0)
+	al, err := NewAccessLog(next, cfg)
+	require.NoError(t, err)
+	return al, &buf
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		next ProxyClient
+		want AccessLogEntry
+	}{
+		{
+			name: "allowed",
+			next: &ServeExit{next: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte("ok"))
+			}},
+			want: AccessLogEntry{Status: http.StatusAccepted, Bytes: 2, Decision: DecisionAllowed},
+		},
+		{
+			name: "blocked",
+			next: &Mocker{NextFunc: func(Request) error {
+				return BlockErr(RateLimitProxyType, "too many requests")
+			}},
+			want: AccessLogEntry{
+				Status:    http.StatusTooManyRequests,
+				Decision:  DecisionBlocked,
+				BlockedBy: RateLimitProxyType,
+			},
+		},
+		{
+			name: "error",
+			next: &Mocker{NextFunc: func(Request) error { return io.ErrUnexpectedEOF }},
+			want: AccessLogEntry{Status: http.StatusInternalServerError, Decision: DecisionError},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			al, buf := newTestAccessLog(t, AccessLogConfig{EnableAccessLog: true}, tt.next)
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", http.NoBody)
+			req.Header.Set(DefaultTenantHeader, "team-a")
+			req.Header.Set(string(HeaderCriticality), CriticalitySheddable)
+			_ = al.Next(&RequestResponseWrapper{req: req, w: httptest.NewRecorder()})
+
+			var got AccessLogEntry
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+			require.Equal(t, http.MethodGet, got.Method)
+			require.Equal(t, "/api/v1/query", got.Path)
+			require.Equal(t, "192.0.2.1", got.ClientIP)
+			require.Equal(t, "team-a", got.Tenant)
+			require.Equal(t, CriticalitySheddable, got.Criticality)
+			require.Equal(t, tt.want.Status, got.Status)
+			require.Equal(t, tt.want.Bytes, got.Bytes)
+			require.Equal(t, tt.want.Decision, got.Decision)
+			require.Equal(t, tt.want.BlockedBy, got.BlockedBy)
+		})
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	t.Parallel()
+	al, buf := newTestAccessLog(t, AccessLogConfig{
+		EnableAccessLog: true,
+		AccessLogFormat: AccessLogFormatCombined,
+	}, &Mocker{NextFunc: func(Request) error {
+		return BlockErr(BackpressureProxyType, "window closed")
+	}})
+	al.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/labels", http.NoBody)
+	req.Header.Set("User-Agent", "grafana")
+	require.Error(t, al.Next(&RequestResponseWrapper{req: req}))
+
+	req.Header.Set(HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Error(t, al.Next(&RequestResponseWrapper{req: req}))
+	line := `192.0.2.1 - - [02/Jan/2024:03:04:05 +0000] "GET /api/v1/labels HTTP/1.1" 429 - "" "grafana" ` +
+		"0.000 CRITICAL blocked:backpressure anonymous"
+	require.Equal(t,
+		line+"\n"+line+" 4bf92f3577b34da6a3ce929d0e0e4736\n",
+		buf.String(),
+	)
+}
+
+func TestAccessLogFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLog(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, AccessLogConfig{EnableAccessLog: true, AccessLogFile: path})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	require.NoError(t, al.Next(&RequestResponseWrapper{req: req}))
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(got), "{"))
+	require.Contains(t, string(got), `"decision":"allowed"`)
+}
@@ -0,0 +1,119 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Adapter runs requests through the middleware chain and returns rejections to the caller instead
+// of writing them, for web frameworks with their own error handling. A Gin middleware calls
+// Handle with c.Next as the handler and aborts with the rejection, and an Echo middleware returns
+// echo.NewHTTPError(StatusCode(err), err.Error()).
+type Adapter struct {
+	entry *ServeEntry
+}
+
+type nextHandlerKey struct{}
+
+// nextHandlerExit ends a chain shared by several handlers with the handler of each request
+func nextHandlerExit() *ServeExit {
+	return &ServeExit{next: func(w http.ResponseWriter, r *http.Request) {
+		next, _ := r.Context().Value(nextHandlerKey{}).(http.Handler)
+		next.ServeHTTP(w, r)
+	}}
+}
+
+// withNextHandler routes the request to next once it reaches the exit of a shared chain
+func withNextHandler(r *http.Request, next http.Handler) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), nextHandlerKey{}, next))
+}
+
+// NewAdapter builds and initializes one chain from the config shared by every request.
+// Panics if a registered middleware factory or its initialization fails.
+func NewAdapter(ctx context.Context, cfg Config) *Adapter {
+	exit := nextHandlerExit()
+	entry := newServeEntry(cfg, NewFromConfig(cfg, exit), exit)
+	if err := entry.Init(ctx); err != nil {
+		panic(err)
+	}
+	return &Adapter{entry: entry}
+}
+
+// Close stops the background pollers of the chain and waits for them to exit
+func (a *Adapter) Close() error {
+	return a.entry.Close()
+}
+
+// Handle calls next once every middleware admits the request. When the request is blocked the
+// Retry-After and X-Throttle-Reason headers are set on w and the *RequestBlockedError is
+// returned for the framework to write.
+func (a *Adapter) Handle(w http.ResponseWriter, r *http.Request, next http.Handler) error {
+	err := a.entry.next(w, withNextHandler(r, next))
+
+	var blocked *RequestBlockedError
+	if errors.As(err, &blocked) {
+		a.entry.writeBlockedHeaders(w, blocked)
+	}
+	return err
+}
+
+// HTTPMiddleware runs the handlers it wraps through one chain built from the config, so routers
+// stacking func(http.Handler) http.Handler middlewares, like chi, gorilla/mux, or the standard
+// library, share one set of limits and congestion window across every route. Rejections are
+// written the same way as ServeEntry.
+type HTTPMiddleware struct {
+	entry *ServeEntry
+}
+
+// NewHTTPMiddleware builds and initializes the chain of the config. The chain runs until ctx is
+// done or the middleware is closed.
+func NewHTTPMiddleware(ctx context.Context, cfg Config) (*HTTPMiddleware, error) {
+	exit := nextHandlerExit()
+	client, err := NewChainBuilder(cfg).Build(exit)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := newServeEntry(cfg, client, exit)
+	if err := entry.Init(ctx); err != nil {
+		return nil, err
+	}
+	return &HTTPMiddleware{entry: entry}, nil
+}
+
+// Wrap passes the requests of next through the chain, e.g. router.Use(m.Wrap)
+func (m *HTTPMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.entry.ServeHTTP(w, withNextHandler(r, next))
+	})
+}
+
+// Close stops the background pollers of the chain and waits for them to exit
+func (m *HTTPMiddleware) Close() error {
+	return m.entry.Close()
+}
+
+// Middleware wraps handlers in one chain built from the config, which runs for the life of the
+// process. Panics if a registered middleware factory, the middleware order, or initialization
+// fails. Use NewHTTPMiddleware to handle the error and close the chain.
+func Middleware(cfg Config) func(http.Handler) http.Handler {
+	m, err := NewHTTPMiddleware(context.Background(), cfg)
+	if err != nil {
+		panic(err)
+	}
+	return m.Wrap
+}
+
+// StatusCode maps an error returned by the chain to the status ServeEntry would respond with
+func StatusCode(err error) int {
+	var blocked *RequestBlockedError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.As(err, &blocked):
+		return blocked.HTTPStatus()
+	default:
+		return http.StatusInternalServerError
+	}
+}
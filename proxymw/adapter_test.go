@@ -0,0 +1,126 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdapter(t *testing.T) {
+	t.Parallel()
+	adapter := NewAdapter(context.Background(), Config{
+		RetryAfter: time.Second,
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-User-Agent=scraper.*"},
+		},
+	})
+
+	called := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		called++
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	w := httptest.NewRecorder()
+	err := adapter.Handle(w, httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody), next)
+	require.NoError(t, err)
+	require.Equal(t, 1, called)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	// the framework writes the rejection from the returned error
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	r.Header.Set("X-User-Agent", "scraper-v1")
+	w = httptest.NewRecorder()
+	err = adapter.Handle(w, r, next)
+
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, BlockerProxyType, blocked.Type)
+	require.Equal(t, 1, called)
+	require.Equal(t, BlockerProxyType, w.Header().Get(string(HeaderThrottleReason)))
+	require.Equal(t, "1", w.Header().Get(string(HeaderRetryAfter)))
+	require.Empty(t, w.Body.String())
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	t.Parallel()
+	mw, err := NewHTTPMiddleware(t.Context(), Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-User-Agent=scraper.*"},
+		},
+		RateLimitConfig: RateLimitConfig{
+			EnableRateLimit: true,
+			RateLimit:       2,
+			RateLimitWindow: time.Hour,
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, mw.Close()) })
+
+	var served []string
+	route := func(name string) http.Handler {
+		return mw.Wrap(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			served = append(served, name)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	query, labels := route("query"), route("labels")
+
+	serve := func(handler http.Handler, agent string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		r.Header.Set("X-User-Agent", agent)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(query, "scraper-v1")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, BlockerProxyType, w.Header().Get(string(HeaderThrottleReason)))
+	var resp APIErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Equal(t, "error", resp.Status)
+
+	// every route shares the rate limit of the one chain
+	require.Equal(t, http.StatusOK, serve(query, "grafana").Code)
+	require.Equal(t, http.StatusOK, serve(labels, "grafana").Code)
+	w = serve(labels, "grafana")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, RateLimitProxyType, w.Header().Get(string(HeaderThrottleReason)))
+	require.Equal(t, []string{"query", "labels"}, served)
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	_, err := NewHTTPMiddleware(t.Context(), Config{
+		EnableJitter:    true,
+		JitterDelay:     time.Millisecond,
+		EnableObserver:  true,
+		MiddlewareOrder: []string{JitterProxyType, ObserverProxyType},
+	})
+	require.ErrorIs(t, err, ErrInvalidMiddlewareOrder)
+
+	handler := Middleware(Config{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody))
+	require.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestStatusCode(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, http.StatusOK, StatusCode(nil))
+	require.Equal(t, http.StatusTooManyRequests, StatusCode(ErrBackpressureBackoff))
+	require.Equal(t, http.StatusServiceUnavailable, StatusCode(BlockErr(MaintenanceProxyType, "down")))
+	require.Equal(t, http.StatusBadRequest, StatusCode(BlockErr(GuardrailProxyType, "invalid query")))
+	require.Equal(t, http.StatusInternalServerError, StatusCode(errors.New("upstream down")))
+}
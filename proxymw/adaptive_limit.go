@@ -0,0 +1,240 @@
+package proxymw
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	AdaptiveLimitProxyType = "adaptive_limit"
+
+	DefaultAdaptiveLimitMin       = 1
+	DefaultAdaptiveLimitMax       = 1000
+	DefaultAdaptiveLimitWindow    = time.Second
+	DefaultAdaptiveLimitTolerance = 2.0
+
+	// noLoadLatencyDrift raises the no-load latency estimate each window so it follows the
+	// upstream when its baseline latency permanently increases
+	noLoadLatencyDrift = 1.01
+)
+
+var defaultAdaptiveLimitMetrics = newAdaptiveLimitMetrics(defaultMetricsFactory)
+
+// adaptiveLimitMetrics are the collectors of the AdaptiveLimiter of one middleware chain
+type adaptiveLimitMetrics struct {
+	limitGauge    prometheus.Gauge
+	inflightGauge prometheus.Gauge
+}
+
+func newAdaptiveLimitMetrics(factory promauto.Factory) *adaptiveLimitMetrics {
+	return &adaptiveLimitMetrics{
+		limitGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_adaptive_limit",
+			Help: "Concurrency limit derived from measured throughput and latency",
+		}),
+		inflightGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_adaptive_inflight",
+			Help: "Requests in flight through the adaptive concurrency limiter",
+		}),
+	}
+}
+
+// AdaptiveLimitConfig limits concurrency toward the upstream from its own measured throughput
+// and latency, so no external metrics are needed unlike Backpressure.
+type AdaptiveLimitConfig struct {
+	EnableAdaptiveLimit bool `yaml:"enable_adaptive_limit"`
+	// AdaptiveLimitMin and AdaptiveLimitMax bound the concurrency limit. The limit starts at max.
+	AdaptiveLimitMin int `yaml:"adaptive_limit_min"`
+	AdaptiveLimitMax int `yaml:"adaptive_limit_max"`
+	// AdaptiveLimitWindow is how often throughput and latency are measured to update the limit
+	AdaptiveLimitWindow time.Duration `yaml:"adaptive_limit_window"`
+	// AdaptiveLimitTolerance is how many times the no-load latency requests may take before the
+	// upstream is considered to be queueing. Defaults to 2.
+	AdaptiveLimitTolerance float64 `yaml:"adaptive_limit_tolerance"`
+}
+
+func (c AdaptiveLimitConfig) Validate() error {
+	if !c.EnableAdaptiveLimit {
+		return nil
+	}
+
+	if c.AdaptiveLimitMin < 0 || c.AdaptiveLimitMax < 0 || c.AdaptiveLimitWindow < 0 {
+		return ErrNegativeAdaptiveLimit
+	}
+
+	if c.max() < c.min() {
+		return ErrAdaptiveLimitMaxBelowMin
+	}
+
+	if c.AdaptiveLimitTolerance != 0 && c.AdaptiveLimitTolerance < 1 {
+		return ErrAdaptiveLimitTolerance
+	}
+	return nil
+}
+
+func (c AdaptiveLimitConfig) min() int {
+	if c.AdaptiveLimitMin == 0 {
+		return DefaultAdaptiveLimitMin
+	}
+	return c.AdaptiveLimitMin
+}
+
+func (c AdaptiveLimitConfig) max() int {
+	if c.AdaptiveLimitMax == 0 {
+		return DefaultAdaptiveLimitMax
+	}
+	return c.AdaptiveLimitMax
+}
+
+func (c AdaptiveLimitConfig) window() time.Duration {
+	if c.AdaptiveLimitWindow == 0 {
+		return DefaultAdaptiveLimitWindow
+	}
+	return c.AdaptiveLimitWindow
+}
+
+func (c AdaptiveLimitConfig) tolerance() float64 {
+	if c.AdaptiveLimitTolerance == 0 {
+		return DefaultAdaptiveLimitTolerance
+	}
+	return c.AdaptiveLimitTolerance
+}
+
+// AdaptiveLimiter rejects requests once the in-flight count reaches a limit derived from Little's
+// law (L = λW). Each window it measures throughput and latency. While latency stays within the
+// tolerance of the no-load latency and the limit is saturated, it probes upward by sqrt(limit).
+// Once latency shows queueing, it cuts the limit to the concurrency needed to sustain the
+// measured throughput at the no-load latency, dropping at most half the limit per window.
+type AdaptiveLimiter struct {
+	client    ProxyClient
+	min, max  int
+	window    time.Duration
+	tolerance float64
+	now       func() time.Time
+
+	mu          sync.Mutex
+	limit       int
+	inflight    int
+	maxInflight int
+	windowStart time.Time
+	completed   int
+	latencySum  time.Duration
+	minLatency  time.Duration
+	noLoad      time.Duration
+
+	limitGauge    prometheus.Gauge
+	inflightGauge prometheus.Gauge
+}
+
+var _ ProxyClient = &AdaptiveLimiter{}
+
+func NewAdaptiveLimiter(client ProxyClient, cfg AdaptiveLimitConfig) *AdaptiveLimiter {
+	return newAdaptiveLimiter(client, cfg, defaultAdaptiveLimitMetrics)
+}
+
+func newAdaptiveLimiter(
+	client ProxyClient, cfg AdaptiveLimitConfig, m *adaptiveLimitMetrics,
+) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		client:        client,
+		min:           cfg.min(),
+		max:           cfg.max(),
+		limit:         cfg.max(),
+		window:        cfg.window(),
+		tolerance:     cfg.tolerance(),
+		now:           time.Now,
+		limitGauge:    m.limitGauge,
+		inflightGauge: m.inflightGauge,
+	}
+}
+
+func (al *AdaptiveLimiter) Init(ctx context.Context) error {
+	al.limitGauge.Set(float64(al.limit))
+	al.windowStart = al.now()
+	return al.client.Init(ctx)
+}
+
+func (al *AdaptiveLimiter) Next(rr Request) error {
+	if err := al.acquire(); err != nil {
+		return err
+	}
+
+	start := al.now()
+	err := al.client.Next(rr)
+	al.release(al.now().Sub(start))
+	return err
+}
+
+func (al *AdaptiveLimiter) acquire() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.inflight >= al.limit {
+		return BlockErr(AdaptiveLimitProxyType, "concurrency limit %d reached", al.limit)
+	}
+
+	al.inflight++
+	al.maxInflight = max(al.maxInflight, al.inflight)
+	al.inflightGauge.Set(float64(al.inflight))
+	return nil
+}
+
+func (al *AdaptiveLimiter) release(latency time.Duration) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.inflight--
+	al.inflightGauge.Set(float64(al.inflight))
+
+	al.completed++
+	al.latencySum += latency
+	if al.minLatency == 0 || latency < al.minLatency {
+		al.minLatency = latency
+	}
+
+	if now := al.now(); now.Sub(al.windowStart) >= al.window {
+		al.updateLimit(now)
+	}
+}
+
+// updateLimit applies the measurements of the finished window to the limit.
+// Assumes the callsite already holds the lock.
+func (al *AdaptiveLimiter) updateLimit(now time.Time) {
+	elapsed := now.Sub(al.windowStart)
+	avgLatency := al.latencySum / time.Duration(al.completed)
+
+	if al.noLoad == 0 || al.minLatency < al.noLoad {
+		al.noLoad = al.minLatency
+	} else {
+		al.noLoad = time.Duration(float64(al.noLoad) * noLoadLatencyDrift)
+	}
+
+	switch {
+	case float64(avgLatency) > al.tolerance*float64(al.noLoad):
+		// L = λW with the no-load latency drains the queue while sustaining throughput
+		throughput := float64(al.completed) / elapsed.Seconds()
+		target := int(math.Ceil(throughput * al.noLoad.Seconds()))
+		al.limit = max(target, al.limit/2)
+	case al.maxInflight >= al.limit:
+		al.limit += int(math.Ceil(math.Sqrt(float64(al.limit))))
+	}
+
+	al.limit = min(max(al.limit, al.min), al.max)
+	al.limitGauge.Set(float64(al.limit))
+
+	al.windowStart = now
+	al.completed = 0
+	al.latencySum = 0
+	al.minLatency = 0
+	al.maxInflight = al.inflight
+}
+
+// Limit returns the current concurrency limit
+func (al *AdaptiveLimiter) Limit() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.limit
+}
@@ -0,0 +1,136 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveLimitConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  AdaptiveLimitConfig
+		want error
+	}{
+		{
+			name: "defaults",
+			cfg:  AdaptiveLimitConfig{EnableAdaptiveLimit: true},
+		},
+		{
+			name: "disabled ignores values",
+			cfg:  AdaptiveLimitConfig{AdaptiveLimitMin: -1},
+		},
+		{
+			name: "negative window",
+			cfg:  AdaptiveLimitConfig{EnableAdaptiveLimit: true, AdaptiveLimitWindow: -time.Second},
+			want: ErrNegativeAdaptiveLimit,
+		},
+		{
+			name: "max below min",
+			cfg: AdaptiveLimitConfig{
+				EnableAdaptiveLimit: true, AdaptiveLimitMin: 10, AdaptiveLimitMax: 5,
+			},
+			want: ErrAdaptiveLimitMaxBelowMin,
+		},
+		{
+			name: "tolerance below one",
+			cfg:  AdaptiveLimitConfig{EnableAdaptiveLimit: true, AdaptiveLimitTolerance: 0.5},
+			want: ErrAdaptiveLimitTolerance,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.want)
+		})
+	}
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1_700_000_000, 0)
+	al := NewAdaptiveLimiter(&Mocker{}, AdaptiveLimitConfig{
+		AdaptiveLimitMin:    2,
+		AdaptiveLimitMax:    100,
+		AdaptiveLimitWindow: time.Second,
+	})
+	al.now = func() time.Time { return now }
+	al.limitGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_adaptive_limit"})
+	al.inflightGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_adaptive_inflight"})
+	al.limit = 16
+	al.windowStart = now
+
+	// completes n requests at the given latency while inflight requests are held open, then
+	// closes the window
+	window := func(n, inflight int, latency time.Duration) {
+		for range inflight {
+			require.NoError(t, al.acquire())
+		}
+		for range n {
+			require.NoError(t, al.acquire())
+			al.release(latency)
+		}
+		for range inflight {
+			al.release(latency)
+		}
+
+		now = now.Add(time.Second)
+		al.mu.Lock()
+		al.updateLimit(now)
+		al.mu.Unlock()
+	}
+
+	window(100, 15, 10*time.Millisecond)
+	require.Equal(t, 20, al.Limit(), "a saturated limit at no-load latency probes up by sqrt")
+
+	window(100, 0, 10*time.Millisecond)
+	require.Equal(t, 20, al.Limit(), "an unsaturated limit holds")
+
+	// queueing: 1000 rps at the ~10ms no-load latency needs 11 concurrent requests
+	window(981, 19, 50*time.Millisecond)
+	require.Equal(t, 11, al.Limit())
+
+	window(10, 0, 500*time.Millisecond)
+	require.Equal(t, 5, al.Limit(), "the limit drops at most half per window")
+
+	window(10, 0, 500*time.Millisecond)
+	require.Equal(t, 2, al.Limit(), "the limit never drops below min")
+
+	require.NoError(t, al.acquire())
+	require.NoError(t, al.acquire())
+	err := al.acquire()
+	require.Equal(t, BlockErr(AdaptiveLimitProxyType, "concurrency limit 2 reached"), err)
+}
+
+func TestAdaptiveLimiterNext(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	al := NewAdaptiveLimiter(&Mocker{
+		InitFunc: func(context.Context) error { return nil },
+		NextFunc: func(Request) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+	}, AdaptiveLimitConfig{AdaptiveLimitMin: 1, AdaptiveLimitMax: 1})
+	al.limitGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_adaptive_limit_next"})
+	al.inflightGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_adaptive_inflight_next"})
+	require.NoError(t, al.Init(context.Background()))
+
+	req := &Mocker{RequestFunc: func() *http.Request { return &http.Request{} }}
+	done := make(chan error)
+	go func() { done <- al.Next(req) }()
+	<-started
+
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, al.Next(req), &blocked)
+	require.Equal(t, AdaptiveLimitProxyType, blocked.Type)
+
+	close(release)
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,72 @@
+package proxymw
+
+import "math"
+
+// validateAnomaly checks the stddev multipliers of queries deriving thresholds from their
+// own trailing samples
+func (q BackpressureQuery) validateAnomaly() error {
+	if q.AnomalyWindow == 0 {
+		return nil
+	}
+	if q.AnomalyWindow < 2 {
+		return ErrAnomalyWindowRange
+	}
+	if q.AnomalyWarningStddevs < 0 || q.AnomalyEmergencyStddevs <= q.AnomalyWarningStddevs {
+		return ErrAnomalyStddevs
+	}
+	if q.WarningThresholdQuery != "" || q.EmergencyThresholdQuery != "" {
+		return ErrAnomalyThresholdQuery
+	}
+	return nil
+}
+
+// anomalyThresholds returns a copy of the query with its thresholds the stddev multipliers away
+// from the mean, below the mean for below queries
+func (q BackpressureQuery) anomalyThresholds(mean, stddev float64) BackpressureQuery {
+	if q.Direction == DirectionBelow {
+		stddev = -stddev
+	}
+	q.WarningThreshold = mean + q.AnomalyWarningStddevs*stddev
+	q.EmergencyThreshold = mean + q.AnomalyEmergencyStddevs*stddev
+	return q
+}
+
+// anomalyWindow keeps the trailing samples of a signal as the baseline its thresholds derive from
+type anomalyWindow struct {
+	samples []float64
+	next    int
+	size    int
+}
+
+func newAnomalyWindow(size int) *anomalyWindow {
+	if size == 0 {
+		return nil
+	}
+	return &anomalyWindow{samples: make([]float64, 0, size), size: size}
+}
+
+// add returns the mean and population stddev of the trailing samples before recording the value,
+// so a spike is measured against the baseline before it joins it. The baseline is only known once
+// the window is full and the samples vary.
+func (w *anomalyWindow) add(value float64) (mean, stddev float64, ok bool) {
+	if len(w.samples) == w.size {
+		for _, s := range w.samples {
+			mean += s
+		}
+		mean /= float64(w.size)
+
+		for _, s := range w.samples {
+			stddev += (s - mean) * (s - mean)
+		}
+		stddev = math.Sqrt(stddev / float64(w.size))
+		ok = stddev > 0
+	}
+
+	if len(w.samples) < w.size {
+		w.samples = append(w.samples, value)
+	} else {
+		w.samples[w.next] = value
+	}
+	w.next = (w.next + 1) % w.size
+	return mean, stddev, ok
+}
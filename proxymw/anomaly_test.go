@@ -0,0 +1,109 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAnomaly(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{Query: "errors", AnomalyWindow: 10}
+	require.ErrorIs(t, q.Validate(), ErrAnomalyStddevs)
+
+	q.AnomalyWarningStddevs, q.AnomalyEmergencyStddevs = 2, 4
+	require.NoError(t, q.Validate(), "static thresholds are not checked")
+
+	q.AnomalyWindow = 1
+	require.ErrorIs(t, q.Validate(), ErrAnomalyWindowRange)
+
+	q.AnomalyWindow = 10
+	q.WarningThresholdQuery = "capacity * 0.5"
+	require.ErrorIs(t, q.Validate(), ErrAnomalyThresholdQuery)
+}
+
+func TestAnomalyWindow(t *testing.T) {
+	t.Parallel()
+	require.Nil(t, newAnomalyWindow(0))
+
+	w := newAnomalyWindow(4)
+	for _, v := range []float64{2, 4, 4, 4} {
+		_, _, ok := w.add(v)
+		require.False(t, ok, "the baseline is unknown until the window is full")
+	}
+
+	mean, stddev, ok := w.add(100)
+	require.True(t, ok)
+	require.InDelta(t, 3.5, mean, 1e-9)
+	require.InDelta(t, 0.8660254, stddev, 1e-6)
+
+	// the oldest sample was replaced by the spike
+	mean, _, ok = w.add(4)
+	require.True(t, ok)
+	require.InDelta(t, 28, mean, 1e-9)
+
+	flat := newAnomalyWindow(2)
+	flat.add(5)
+	flat.add(5)
+	_, _, ok = flat.add(5)
+	require.False(t, ok, "constant samples have no spread to measure anomalies against")
+}
+
+func TestAnomalyThresholds(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{AnomalyWarningStddevs: 2, AnomalyEmergencyStddevs: 4}
+	resolved := q.anomalyThresholds(10, 1)
+	require.Equal(t, 12.0, resolved.WarningThreshold)
+	require.Equal(t, 14.0, resolved.EmergencyThreshold)
+
+	q.Direction = DirectionBelow
+	resolved = q.anomalyThresholds(10, 1)
+	require.Equal(t, 8.0, resolved.WarningThreshold)
+	require.Equal(t, 6.0, resolved.EmergencyThreshold)
+	require.Equal(t, 1.0, resolved.throttlePercent(5))
+}
+
+func TestPollAnomaly(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{
+		Name:                    "latency",
+		Query:                   "latency",
+		AnomalyWindow:           4,
+		AnomalyWarningStddevs:   2,
+		AnomalyEmergencyStddevs: 4,
+	}
+	m := newBackpressureMetrics(promauto.With(prometheus.NewRegistry()))
+	bp := newBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin:       1,
+		CongestionWindowMax:       100,
+		BackpressureMonitoringURL: "http://prometheus",
+		BackpressureQueries:       []BackpressureQuery{q},
+	}, m)
+
+	value := 0.0
+	fetch := func(context.Context, *http.Client, string, string) (float64, error) {
+		return value, nil
+	}
+	s := &signal{query: q, fetch: fetch, smoothed: &ewma{}, baseline: newAnomalyWindow(4)}
+
+	for _, v := range []float64{9, 11, 9, 11} {
+		value = v
+		bp.poll(context.Background(), s)
+		require.Equal(t, 1.0, bp.Allowance())
+	}
+
+	// values within the warning stddevs of the baseline do not throttle
+	value = 11.5
+	bp.poll(context.Background(), s)
+	require.Equal(t, 1.0, bp.Allowance())
+	require.InDelta(t, 12, testutil.ToFloat64(m.warnGauge.WithLabelValues("latency")), 1e-9)
+
+	value = 20
+	bp.poll(context.Background(), s)
+	require.Equal(t, 0.0, bp.Allowance())
+}
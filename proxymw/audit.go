@@ -0,0 +1,231 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AuditProxyType = "audit"
+
+	// RecentBlocksPath is where the internal server lists the most recent blocked requests
+	RecentBlocksPath = "/api/v1/throttle/recent-blocks"
+
+	DefaultAuditSize = 1000
+)
+
+var (
+	ErrNegativeAuditSize = errors.New("audit size cannot be negative")
+	ErrAuditOff          = errors.New("audit trail is not enabled")
+
+	// activeAudit is the Audit built from config served by RecentBlocksHandler
+	activeAudit atomic.Pointer[Audit]
+)
+
+// AuditConfig records who was blocked and why so rejected clients can be supported without
+// reproducing their traffic.
+type AuditConfig struct {
+	EnableAudit bool `yaml:"enable_audit"`
+	// AuditSize is how many of the most recent blocks are kept in memory. Defaults to 1000.
+	AuditSize int `yaml:"audit_size"`
+	// AuditTenantHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	AuditTenantHeader string `yaml:"audit_tenant_header"`
+	// EnableAuditLog also writes each block as a JSON line to AuditLogger
+	EnableAuditLog bool `yaml:"enable_audit_log"`
+	// AuditLogger receives the audit log. Defaults to the standard logger.
+	AuditLogger *log.Logger `yaml:"-"`
+}
+
+func (c AuditConfig) Validate() error {
+	if c.EnableAudit && c.AuditSize < 0 {
+		return ErrNegativeAuditSize
+	}
+	return nil
+}
+
+func (c AuditConfig) size() int {
+	if c.AuditSize == 0 {
+		return DefaultAuditSize
+	}
+	return c.AuditSize
+}
+
+func (c AuditConfig) header() string {
+	if c.AuditTenantHeader == "" {
+		return DefaultTenantHeader
+	}
+	return http.CanonicalHeaderKey(c.AuditTenantHeader)
+}
+
+// AuditRecord describes a blocked request. Reason is the rejection message, which names the
+// matched header, pattern, or limit.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	BlockedBy   string    `json:"blocked_by"`
+	Reason      string    `json:"reason"`
+	Tenant      string    `json:"tenant"`
+	Criticality string    `json:"criticality"`
+	RemoteAddr  string    `json:"remote_addr"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+}
+
+// Audit keeps a ring of the most recent requests blocked by the middlewares it wraps
+type Audit struct {
+	client ProxyClient
+	header string
+	logger *log.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	records []AuditRecord
+	next    int
+	full    bool
+}
+
+var _ ProxyClient = &Audit{}
+
+func NewAudit(client ProxyClient, cfg AuditConfig) *Audit {
+	a := &Audit{
+		client:  client,
+		header:  cfg.header(),
+		now:     time.Now,
+		records: make([]AuditRecord, cfg.size()),
+	}
+	if cfg.EnableAuditLog {
+		a.logger = cfg.AuditLogger
+		if a.logger == nil {
+			a.logger = log.Default()
+		}
+	}
+	return a
+}
+
+func (a *Audit) Init(ctx context.Context) error {
+	return a.client.Init(ctx)
+}
+
+func (a *Audit) Next(rr Request) error {
+	err := a.client.Next(rr)
+	var blocked *RequestBlockedError
+	if errors.As(err, &blocked) {
+		a.record(a.newRecord(rr.Request(), blocked))
+	}
+	return err
+}
+
+func (a *Audit) newRecord(req *http.Request, blocked *RequestBlockedError) AuditRecord {
+	tenant := req.Header.Get(a.header)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	criticality := req.Header.Get(string(HeaderCriticality))
+	if criticality == "" {
+		criticality = CriticalityDefault
+	}
+
+	record := AuditRecord{
+		Time:        a.now(),
+		BlockedBy:   blocked.Type,
+		Reason:      blocked.Error(),
+		Tenant:      tenant,
+		Criticality: criticality,
+		RemoteAddr:  req.RemoteAddr,
+		UserAgent:   req.UserAgent(),
+		Method:      req.Method,
+		Path:        req.URL.Path,
+	}
+	if query := requestQuery(req); query != "" {
+		record.Fingerprint = Fingerprint(query)
+	}
+	return record
+}
+
+func (a *Audit) record(record AuditRecord) {
+	a.mu.Lock()
+	a.records[a.next] = record
+	a.next = (a.next + 1) % len(a.records)
+	a.full = a.full || a.next == 0
+	a.mu.Unlock()
+
+	if a.logger == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("error encoding audit record: %v", err)
+		return
+	}
+	a.logger.Print(string(line))
+}
+
+// Recent returns up to limit blocks matching the filter, newest first. A limit of zero returns
+// every match.
+func (a *Audit) Recent(limit int, match func(AuditRecord) bool) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := a.next
+	if a.full {
+		n = len(a.records)
+	}
+
+	recent := []AuditRecord{}
+	for i := range n {
+		record := a.records[(a.next-1-i+len(a.records))%len(a.records)]
+		if match != nil && !match(record) {
+			continue
+		}
+		recent = append(recent, record)
+		if limit > 0 && len(recent) == limit {
+			break
+		}
+	}
+	return recent
+}
+
+// ServeRecent lists recent blocks as JSON, filtered by the optional blocked_by and tenant
+// parameters and capped by limit.
+func (a *Audit) ServeRecent(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit := 0
+	if value := params.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	blockedBy, tenant := params.Get("blocked_by"), params.Get("tenant")
+	recent := a.Recent(limit, func(record AuditRecord) bool {
+		return (blockedBy == "" || record.BlockedBy == blockedBy) &&
+			(tenant == "" || record.Tenant == tenant)
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(recent); err != nil {
+		log.Printf("error writing recent blocks: %v", err)
+	}
+}
+
+// RecentBlocksHandler lists the recent blocks of the Audit built from config
+func RecentBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	a := activeAudit.Load()
+	if a == nil {
+		http.Error(w, ErrAuditOff.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	a.ServeRecent(w, r)
+}
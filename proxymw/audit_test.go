@@ -0,0 +1,109 @@
+package proxymw
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, AuditConfig{AuditSize: -1}.Validate())
+	require.NoError(t, AuditConfig{EnableAudit: true}.Validate())
+	require.ErrorIs(t, AuditConfig{EnableAudit: true, AuditSize: -1}.Validate(), ErrNegativeAuditSize)
+}
+
+func auditRequest(tenant string) Request {
+	req := httptest.NewRequest(http.MethodGet, `/api/v1/query?query=up{job="api"}`, http.NoBody)
+	req.Header.Set(DefaultTenantHeader, tenant)
+	return &RequestResponseWrapper{req: req}
+}
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	blockedBy := RateLimitProxyType
+	a := NewAudit(&Mocker{NextFunc: func(rr Request) error {
+		if rr.Request().Header.Get(DefaultTenantHeader) == "allowed" {
+			return nil
+		}
+		return BlockErr(blockedBy, "blocked %s", rr.Request().Header.Get(DefaultTenantHeader))
+	}}, AuditConfig{
+		EnableAudit:    true,
+		AuditSize:      2,
+		EnableAuditLog: true,
+		AuditLogger:    log.New(&buf, "", 0),
+	})
+
+	require.NoError(t, a.Next(auditRequest("allowed")))
+	require.Empty(t, a.Recent(0, nil))
+
+	require.Error(t, a.Next(auditRequest("team-a")))
+	blockedBy = BlockerProxyType
+	require.Error(t, a.Next(auditRequest("team-b")))
+	require.Error(t, a.Next(auditRequest("team-c")))
+
+	// the ring keeps the newest blocks first
+	recent := a.Recent(0, nil)
+	require.Len(t, recent, 2)
+	require.Equal(t, "team-c", recent[0].Tenant)
+	require.Equal(t, "team-b", recent[1].Tenant)
+	require.Equal(t, BlockerProxyType, recent[0].BlockedBy)
+	require.Equal(t, "blocked team-c", recent[0].Reason)
+	require.Equal(t, "/api/v1/query", recent[0].Path)
+	require.Equal(t, "up{job=?}", recent[0].Fingerprint)
+
+	// every block is logged even after it leaves the ring
+	require.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("\n")))
+}
+
+func TestRecentBlocksHandler(t *testing.T) {
+	a := NewAudit(&Mocker{NextFunc: func(rr Request) error {
+		return BlockErr(QuotaProxyType, "quota exhausted")
+	}}, AuditConfig{EnableAudit: true})
+	for _, tenant := range []string{"team-a", "team-b", "team-a"} {
+		require.Error(t, a.Next(auditRequest(tenant)))
+	}
+
+	activeAudit.Store(nil)
+	w := httptest.NewRecorder()
+	RecentBlocksHandler(w, httptest.NewRequest(http.MethodGet, RecentBlocksPath, http.NoBody))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	activeAudit.Store(a)
+	defer activeAudit.Store(nil)
+	for _, tt := range []struct {
+		name   string
+		target string
+		code   int
+		want   int
+	}{
+		{name: "all", target: RecentBlocksPath, code: http.StatusOK, want: 3},
+		{name: "tenant", target: RecentBlocksPath + "?tenant=team-a", code: http.StatusOK, want: 2},
+		{name: "limit", target: RecentBlocksPath + "?limit=1", code: http.StatusOK, want: 1},
+		{
+			name:   "other middleware",
+			target: RecentBlocksPath + "?blocked_by=backpressure",
+			code:   http.StatusOK,
+		},
+		{name: "invalid limit", target: RecentBlocksPath + "?limit=-1", code: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			RecentBlocksHandler(w, httptest.NewRequest(http.MethodGet, tt.target, http.NoBody))
+			require.Equal(t, tt.code, w.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var got []AuditRecord
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			require.Len(t, got, tt.want)
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -23,29 +24,94 @@ const (
 	BackpressureUpdateCadence = 30 * time.Second
 	MonitorQueryTimeout       = 15 * time.Second
 	DefaultThrottleCurve      = 4.0
+
+	// AllowanceModeWindow shrinks the congestion window in proportion to the allowance
+	AllowanceModeWindow = "window"
+	// AllowanceModeProbabilistic admits each request with probability equal to the allowance
+	AllowanceModeProbabilistic = "probabilistic"
+
+	// MonitorFailureKeepLast holds the last known allowance while every query is failing
+	MonitorFailureKeepLast = "keep_last"
+	// MonitorFailureOpen opens the window to its max while every query is failing
+	MonitorFailureOpen = "open"
+	// MonitorFailureClosed shrinks the window to its min while every query is failing
+	MonitorFailureClosed = "closed"
+
+	// DirectionAbove throttles as a query value rises above its thresholds
+	DirectionAbove = "above"
+	// DirectionBelow throttles as a query value drops below its thresholds
+	DirectionBelow = "below"
 )
 
 var (
-	bpMinGauge       = promauto.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_cwdn_min"})
-	bpMaxGauge       = promauto.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_cwdn_max"})
-	bpWatermarkGauge = promauto.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_watermark"})
-	bpAllowanceGauge = promauto.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_allowance"})
-
-	bpMetricLabels    = []string{"query_name"}
-	bpQueryErrCounter = promauto.NewCounterVec(
-		prometheus.CounterOpts{Name: "proxymw_bp_query_error_count"}, bpMetricLabels,
-	)
-	bpQueryWarnGauge = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{Name: "proxymw_bp_query_warn"}, bpMetricLabels,
-	)
-	bpQueryEmergencyGauge = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{Name: "proxymw_bp_query_emergency"}, bpMetricLabels,
-	)
-	bpQueryValGauge = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{Name: "proxymw_bp_query_value"}, bpMetricLabels,
-	)
+	bpMetricLabels = []string{"query_name"}
+
+	defaultBackpressureMetrics = newBackpressureMetrics(defaultMetricsFactory)
 )
 
+// backpressureMetrics are the collectors of the Backpressure of one middleware chain
+type backpressureMetrics struct {
+	minGauge         prometheus.Gauge
+	maxGauge         prometheus.Gauge
+	watermarkGauge   prometheus.Gauge
+	allowanceGauge   prometheus.Gauge
+	queryErrCount    *prometheus.CounterVec
+	warnGauge        *prometheus.GaugeVec
+	emergencyGauge   *prometheus.GaugeVec
+	queryValGauge    *prometheus.GaugeVec
+	smoothedValGauge *prometheus.GaugeVec
+	slopeGauge       *prometheus.GaugeVec
+	tierActiveGauge  *prometheus.GaugeVec
+	pollDuration     prometheus.Histogram
+	queryDuration    *prometheus.HistogramVec
+	peerActiveGauge  prometheus.Gauge
+	leaderGauge      prometheus.Gauge
+}
+
+func newBackpressureMetrics(factory promauto.Factory) *backpressureMetrics {
+	return &backpressureMetrics{
+		minGauge:       factory.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_cwdn_min"}),
+		maxGauge:       factory.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_cwdn_max"}),
+		watermarkGauge: factory.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_watermark"}),
+		allowanceGauge: factory.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_allowance"}),
+		queryErrCount: factory.NewCounterVec(
+			prometheus.CounterOpts{Name: "proxymw_bp_query_error_count"}, bpMetricLabels,
+		),
+		warnGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "proxymw_bp_query_warn"}, bpMetricLabels,
+		),
+		emergencyGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "proxymw_bp_query_emergency"}, bpMetricLabels,
+		),
+		queryValGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "proxymw_bp_query_value"}, bpMetricLabels,
+		),
+		smoothedValGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "proxymw_bp_query_smoothed_value"}, bpMetricLabels,
+		),
+		slopeGauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxymw_bp_query_slope",
+			Help: "Rate of change per second of backpressure queries throttling on their slope",
+		}, bpMetricLabels),
+		tierActiveGauge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "proxymw_bp_tier_active"}, []string{"tier"},
+		),
+		pollDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name: "proxymw_bp_poll_duration_seconds",
+			Help: "Duration of a poll cycle evaluating every backpressure query",
+		}),
+		queryDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "proxymw_bp_query_duration_seconds",
+			Help: "Duration of evaluating a backpressure query and its dynamic thresholds",
+		}, bpMetricLabels),
+		peerActiveGauge: factory.NewGauge(prometheus.GaugeOpts{Name: "proxymw_bp_peer_active"}),
+		leaderGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_bp_leader",
+			Help: "Set to 1 while this replica leads the fleet and polls the backpressure queries",
+		}),
+	}
+}
+
 type PrometheusResponse struct {
 	Data struct {
 		Result model.Vector `json:"result"`
@@ -65,6 +131,65 @@ type BackpressureQuery struct {
 	EmergencyThreshold float64 `yaml:"emergency_threshold"`
 	// ThrottlingCurve is a constant controlling the aggressiveness of throttling (e.g., default 4.0 for steep growth)
 	ThrottlingCurve float64 `yaml:"throttling_curve"`
+	// Backend is the TSDB the query targets: prometheus (default), victoriametrics, graphite,
+	// or influxdb. Graphite queries are render targets and InfluxDB queries are Flux.
+	Backend string `yaml:"backend,omitempty"`
+	// Weight scales how much this query throttles within (0, 1]. A weight of 0.5 means the
+	// emergency threshold only cuts the window in half. Defaults to 1.
+	Weight float64 `yaml:"weight,omitempty"`
+	// MaxThrottle caps the share of the window this query may close within (0, 1] so a noisy
+	// low-importance signal can never take the window to the floor. Defaults to 1.
+	MaxThrottle float64 `yaml:"max_throttle,omitempty"`
+	// SmoothingAlpha applies an exponentially weighted moving average with this alpha within
+	// (0, 1] to fetched values before throttling so a single spiky sample does not collapse the
+	// window. Lower values smooth more. Disabled when unset.
+	SmoothingAlpha float64 `yaml:"smoothing_alpha,omitempty"`
+	// Aggregation reduces a query returning multiple series with max, min, avg, or sum.
+	// Queries must return exactly one series when unset.
+	Aggregation string `yaml:"aggregation,omitempty"`
+	// Direction is "above" (default) to throttle as the value rises past the warning threshold
+	// or "below" for signals where low values are bad (e.g. free memory, healthy replicas). Below
+	// queries throttle as the value drops from warning toward a lower emergency threshold.
+	Direction string `yaml:"direction,omitempty"`
+	// WarningThresholdQuery and EmergencyThresholdQuery are optional expressions evaluated on
+	// the monitoring endpoints every poll (e.g. `0.8 * sum(capacity)`) that replace the static
+	// thresholds so they scale with cluster size.
+	WarningThresholdQuery   string `yaml:"warning_threshold_query,omitempty"`
+	EmergencyThresholdQuery string `yaml:"emergency_threshold_query,omitempty"`
+	// SlopeSamples throttles on how fast the value rises, estimated over this many polls, so the
+	// window closes before a fast-rising signal reaches its emergency threshold. The query
+	// throttles by the larger of its value and slope throttles. Disabled when unset.
+	SlopeSamples int `yaml:"slope_samples,omitempty"`
+	// SlopeWarningThreshold and SlopeEmergencyThreshold are rates of change per second toward
+	// the emergency threshold between which the slope throttle follows the throttling curve
+	SlopeWarningThreshold   float64 `yaml:"slope_warning_threshold,omitempty"`
+	SlopeEmergencyThreshold float64 `yaml:"slope_emergency_threshold,omitempty"`
+	// AnomalyWindow replaces the static thresholds with ones derived from the mean and stddev of
+	// this many trailing polls, for signals without obvious static thresholds. The query does not
+	// throttle until the window fills. A sustained change becomes the new baseline once it fills
+	// the window. Disabled when unset.
+	AnomalyWindow int `yaml:"anomaly_window,omitempty"`
+	// AnomalyWarningStddevs and AnomalyEmergencyStddevs are how many stddevs from the mean the
+	// warning and emergency thresholds are, below the mean for below queries
+	AnomalyWarningStddevs   float64 `yaml:"anomaly_warning_stddevs,omitempty"`
+	AnomalyEmergencyStddevs float64 `yaml:"anomaly_emergency_stddevs,omitempty"`
+}
+
+// ewma exponentially smooths a series of values. An alpha of 0 disables smoothing.
+type ewma struct {
+	alpha  float64
+	value  float64
+	primed bool
+}
+
+func (e *ewma) add(val float64) float64 {
+	if e.alpha == 0 || !e.primed {
+		e.value, e.primed = val, true
+		return val
+	}
+
+	e.value = e.alpha*val + (1-e.alpha)*e.value
+	return e.value
 }
 
 func (q BackpressureQuery) Validate() error {
@@ -77,15 +202,85 @@ func (q BackpressureQuery) Validate() error {
 	if q.ThrottlingCurve < 0 {
 		return ErrNegativeThrottleCurve
 	}
+	if q.Direction != "" && q.Direction != DirectionAbove && q.Direction != DirectionBelow {
+		return fmt.Errorf("%w: %q", ErrInvalidDirection, q.Direction)
+	}
+	if wrappedInQuotes(q.WarningThresholdQuery) || wrappedInQuotes(q.EmergencyThresholdQuery) {
+		return ErrExtraQueryQuotes
+	}
+	// anomaly thresholds replace the static ones and are only known once evaluated
+	if q.AnomalyWindow == 0 {
+		if err := q.validateStaticThresholds(); err != nil {
+			return err
+		}
+	}
+	if q.Weight < 0 || q.Weight > 1 || q.MaxThrottle < 0 || q.MaxThrottle > 1 {
+		return ErrQueryWeightRange
+	}
+	if q.SmoothingAlpha < 0 || q.SmoothingAlpha > 1 {
+		return ErrSmoothingAlphaRange
+	}
+	if _, ok := SignalFetchers[q.backend()]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownBackend, q.Backend)
+	}
+	if q.Aggregation != "" && !validAggregation(q.Aggregation) {
+		return fmt.Errorf("%w: %q", ErrUnknownAggregation, q.Aggregation)
+	}
+	if err := q.validateSlope(); err != nil {
+		return err
+	}
+	return q.validateAnomaly()
+}
+
+// validateStaticThresholds checks the thresholds which are not evaluated from a query. A static
+// threshold next to a dynamic one must leave room for the other on its side of the direction,
+// their order is checked again once the dynamic one is evaluated.
+func (q BackpressureQuery) validateStaticThresholds() error {
+	staticWarning, staticEmergency := q.WarningThresholdQuery == "", q.EmergencyThresholdQuery == ""
+	switch {
+	case staticWarning && staticEmergency:
+		return q.validateThresholds()
+	case staticWarning && q.WarningThreshold < 0, staticEmergency && q.EmergencyThreshold < 0:
+		return ErrNegativeQueryThresholds
+	case q.Direction == DirectionBelow && staticWarning && q.WarningThreshold == 0:
+		// no emergency threshold can be below a warning of 0
+		return ErrEmergencyAboveWarnThreshold
+	case q.Direction != DirectionBelow && staticEmergency && q.EmergencyThreshold == 0:
+		// no warning threshold can be below an emergency of 0
+		return ErrEmergencyBelowWarnThreshold
+	}
+	return nil
+}
+
+func (q BackpressureQuery) validateThresholds() error {
 	if q.WarningThreshold < 0 || q.EmergencyThreshold < 0 {
 		return ErrNegativeQueryThresholds
 	}
-	if q.EmergencyThreshold <= q.WarningThreshold {
+	if q.Direction == DirectionBelow {
+		if q.EmergencyThreshold >= q.WarningThreshold {
+			return ErrEmergencyAboveWarnThreshold
+		}
+	} else if q.EmergencyThreshold <= q.WarningThreshold {
 		return ErrEmergencyBelowWarnThreshold
 	}
 	return nil
 }
 
+func (q BackpressureQuery) backend() string {
+	if q.Backend == "" {
+		return BackendPrometheus
+	}
+	return q.Backend
+}
+
+// fetcher returns the function fetching the query value, aggregating series when configured
+func (q BackpressureQuery) fetcher() SignalFetcher {
+	if q.Aggregation == "" {
+		return SignalFetchers[q.backend()]
+	}
+	return AggregatedFetcher(SignalSamplers[q.backend()], q.Aggregation)
+}
+
 func wrappedInQuotes(query string) bool {
 	if len(query) < 2 {
 		return false
@@ -97,7 +292,25 @@ func wrappedInQuotes(query string) bool {
 		(firstChar == '"' && lastChar == '"')
 }
 
+// throttlePercent is the share of the window this query closes at the current value after
+// applying its weight and max throttle.
 func (q BackpressureQuery) throttlePercent(curr float64) float64 {
+	weight, maxThrottle := q.Weight, q.MaxThrottle
+	if weight == 0 {
+		weight = 1
+	}
+	if maxThrottle == 0 {
+		maxThrottle = 1
+	}
+	return min(weight*q.rawThrottlePercent(curr), maxThrottle)
+}
+
+func (q BackpressureQuery) rawThrottlePercent(curr float64) float64 {
+	// below queries mirror the thresholds so the same curve applies as the value drops
+	if q.Direction == DirectionBelow {
+		curr, q.WarningThreshold, q.EmergencyThreshold = -curr, -q.WarningThreshold, -q.EmergencyThreshold
+	}
+
 	if curr <= q.WarningThreshold {
 		return 0.0
 	}
@@ -117,15 +330,72 @@ func (q BackpressureQuery) throttlePercent(curr float64) float64 {
 }
 
 type BackpressureConfig struct {
-	EnableBackpressure        bool                `yaml:"enable_backpressure"`
-	BackpressureMonitoringURL string              `yaml:"backpressure_monitoring_url"`
-	BackpressureQueries       []BackpressureQuery `yaml:"backpressure_queries"`
-	CongestionWindowMin       int                 `yaml:"congestion_window_min"`
-	CongestionWindowMax       int                 `yaml:"congestion_window_max"`
-	// EnableLowCostBypass assumes proxy requests are Prometheus queries.
+	EnableBackpressure        bool   `yaml:"enable_backpressure"`
+	BackpressureMonitoringURL string `yaml:"backpressure_monitoring_url"`
+	// BackpressureMonitoringURLs are additional monitoring endpoints queried after
+	// BackpressureMonitoringURL so a single down Prometheus does not blind the controller.
+	// Monitoring URLs prefixed with dnssrv+ expand to every target of their SRV records, with
+	// the failover strategy starting at the next target on each poll to spread queries.
+	BackpressureMonitoringURLs []string `yaml:"backpressure_monitoring_urls"`
+	// MonitorStrategy is "failover" (default) to try endpoints in order or "max" to query them
+	// in parallel and use the highest value.
+	MonitorStrategy string `yaml:"monitor_strategy"`
+	// MonitorFailurePolicy decides the allowance once every backpressure query is erroring:
+	// "keep_last" (default) holds the last known allowance, "open" fails open to the max window,
+	// and "closed" fails closed to the min window. Normal throttling resumes with the next
+	// successful query.
+	MonitorFailurePolicy string `yaml:"monitor_failure_policy"`
+	// MonitorClient adds auth, headers, and proxy settings to the signal fetching client
+	MonitorClient       MonitorClientConfig `yaml:"monitor_client"`
+	BackpressureQueries []BackpressureQuery `yaml:"backpressure_queries"`
+	CongestionWindowMin int                 `yaml:"congestion_window_min"`
+	CongestionWindowMax int                 `yaml:"congestion_window_max"`
+	// EnableCostWeightedWindow assumes proxy requests are Prometheus or Loki queries and counts
+	// the QueryCost of each request against the congestion window instead of one per request, so
+	// CongestionWindowMin and CongestionWindowMax are in cost units. Requests cost at least 1 and
+	// a request costing more than the whole window is only admitted while nothing else is active.
+	EnableCostWeightedWindow bool `yaml:"enable_cost_weighted_window"`
+	// EnableLowCostBypass assumes proxy requests are Prometheus or Loki queries.
 	// If the promQL will query data more than 2 hours ago, the query is considered high cost.
 	// When enabled, low cost queries bypass the backpressure congestion control queue.
 	EnableLowCostBypass bool `yaml:"enable_low_cost_bypass"`
+	// CostTiers assumes proxy requests are Prometheus queries and gives cheap, moderate, and
+	// expensive queries their own share of the congestion window.
+	CostTiers CostTierConfig `yaml:"cost_tiers"`
+	// AllowanceMode controls how throttling is applied. The default "window" mode shrinks the
+	// congestion window by the allowance. The "probabilistic" mode leaves the window at its max
+	// and admits each request with probability equal to the allowance, which behaves better for
+	// low QPS services where a window of 1-2 requests is too coarse. CRITICAL_PLUS requests are
+	// always admitted in probabilistic mode.
+	AllowanceMode string `yaml:"allowance_mode"`
+	// EnableCriticalityShedding sheds requests by X-Request-Criticality as the window shrinks.
+	// SHEDDABLE requests are rejected first, then SHEDDABLE_PLUS, then CRITICAL.
+	EnableCriticalityShedding bool `yaml:"enable_criticality_shedding"`
+	// CriticalPlusReserve is the portion of CongestionWindowMin only CRITICAL_PLUS requests may use
+	CriticalPlusReserve int `yaml:"critical_plus_reserve"`
+	// AllowanceRecoveryStep limits how fast the allowance recovers once signals clear to at most
+	// this much per BackpressureUpdateCadence (e.g. 0.05 for +5%). Throttling still applies
+	// immediately. Recovery is instant when unset.
+	AllowanceRecoveryStep float64 `yaml:"allowance_recovery_step"`
+	// AllowanceRecoveryCooldown holds the allowance after it was last cut before any recovery
+	AllowanceRecoveryCooldown time.Duration `yaml:"allowance_recovery_cooldown"`
+	// SharedWindow counts the active requests of every replica against the congestion window
+	SharedWindow SharedWindowConfig `yaml:"shared_window"`
+	// LeaderElection lets one replica poll the queries and share its allowance with the fleet
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+	// Persistence saves the watermark and allowance so restarts resume the congestion window
+	Persistence PersistenceConfig `yaml:"persistence"`
+	// TenantFairness shares the congestion window across tenants by their weight
+	TenantFairness TenantFairnessConfig `yaml:"tenant_fairness"`
+	// UnreadyAfterEmergency fails /readyz once the allowance has been fully closed for this
+	// long so a saturated replica is pulled from its Service. Always ready when unset.
+	UnreadyAfterEmergency time.Duration `yaml:"unready_after_emergency"`
+	// Schedules swap in different window bounds and query thresholds at recurring times of day
+	Schedules []ThresholdSchedule `yaml:"schedules"`
+	// IdleDecayAfter halves the distance of the watermark to CongestionWindowMin for every
+	// period this long without requests, so a window grown under a previous traffic pattern
+	// does not let a burst slam a cold upstream. The watermark never decays when unset.
+	IdleDecayAfter time.Duration `yaml:"idle_decay_after"`
 }
 
 func ParseBackpressureQueries(
@@ -177,8 +447,23 @@ func (c BackpressureConfig) Validate() error {
 		}
 	}
 
-	if _, err := url.Parse(c.BackpressureMonitoringURL); err != nil {
-		return fmt.Errorf("invalid monitoring URL: %w", err)
+	for _, u := range c.monitorURLs() {
+		if IsDNSSRV(u) {
+			if _, err := NewDiscoveredURL(u); err != nil {
+				return fmt.Errorf("invalid monitoring URL: %w", err)
+			}
+			continue
+		}
+
+		if _, err := url.Parse(u); err != nil {
+			return fmt.Errorf("invalid monitoring URL: %w", err)
+		}
+	}
+
+	switch c.MonitorStrategy {
+	case "", MonitorStrategyFailover, MonitorStrategyMax:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidMonitorStrategy, c.MonitorStrategy)
 	}
 
 	if c.CongestionWindowMin < 1 {
@@ -189,9 +474,82 @@ func (c BackpressureConfig) Validate() error {
 		return ErrCongestionWindowMaxBelowMin
 	}
 
+	if c.CriticalPlusReserve < 0 || c.CriticalPlusReserve >= c.CongestionWindowMin {
+		return ErrCriticalPlusReserveRange
+	}
+
+	switch c.MonitorFailurePolicy {
+	case "", MonitorFailureKeepLast, MonitorFailureOpen, MonitorFailureClosed:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidMonitorFailurePolicy, c.MonitorFailurePolicy)
+	}
+
+	switch c.AllowanceMode {
+	case "", AllowanceModeWindow, AllowanceModeProbabilistic:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidAllowanceMode, c.AllowanceMode)
+	}
+
+	costModel := c.EnableLowCostBypass || c.CostTiers.EnableCostTiers || c.EnableCostWeightedWindow
+	if costModel && !promQLSupported {
+		return ErrPromQLUnsupported
+	}
+
+	if err := c.CostTiers.Validate(); err != nil {
+		return fmt.Errorf("cost tiers: %w", err)
+	}
+
+	if c.AllowanceRecoveryStep < 0 || c.AllowanceRecoveryStep > 1 ||
+		c.AllowanceRecoveryCooldown < 0 {
+		return ErrAllowanceRecoveryRange
+	}
+
+	if err := c.TenantFairness.Validate(); err != nil {
+		return fmt.Errorf("tenant fairness: %w", err)
+	}
+
+	if c.UnreadyAfterEmergency < 0 {
+		return ErrNegativeUnreadyAfterEmergency
+	}
+
+	if c.IdleDecayAfter < 0 {
+		return ErrNegativeIdleDecay
+	}
+
+	if err := c.SharedWindow.Validate(); err != nil {
+		return fmt.Errorf("shared window: %w", err)
+	}
+
+	if err := c.LeaderElection.Validate(); err != nil {
+		return fmt.Errorf("leader election: %w", err)
+	}
+
+	if err := c.Persistence.Validate(); err != nil {
+		return fmt.Errorf("persistence: %w", err)
+	}
+
+	if err := c.MonitorClient.Validate(); err != nil {
+		return fmt.Errorf("monitor client: %w", err)
+	}
+
+	for _, s := range c.Schedules {
+		if err := s.Validate(c); err != nil {
+			return fmt.Errorf("schedule %q: %w", s.Name, err)
+		}
+	}
+
 	return nil
 }
 
+// monitorURLs lists every configured monitoring endpoint in the order they are tried
+func (c BackpressureConfig) monitorURLs() []string {
+	urls := make([]string, 0, len(c.BackpressureMonitoringURLs)+1)
+	if c.BackpressureMonitoringURL != "" || len(c.BackpressureMonitoringURLs) == 0 {
+		urls = append(urls, c.BackpressureMonitoringURL)
+	}
+	return append(urls, c.BackpressureMonitoringURLs...)
+}
+
 // Backpressure uses Additive Increase Multiplicative Decrease which
 // is a congestion control algorithm to back off of expensive queries and is modeled after TCP's
 // https://en.wikipedia.org/wiki/Additive_increase/multiplicative_decrease. Backpressure signals
@@ -217,14 +575,90 @@ type Backpressure struct {
 	warnGauge      *prometheus.GaugeVec
 	emergencyGauge *prometheus.GaugeVec
 	queryValGauge  *prometheus.GaugeVec
+	// smoothedValGauge reports query values after smoothing when SmoothingAlpha is set
+	smoothedValGauge *prometheus.GaugeVec
+	// slopeGauge reports the rate of change of queries with SlopeSamples set
+	slopeGauge    *prometheus.GaugeVec
+	pollDuration  prometheus.Observer
+	queryDuration *prometheus.HistogramVec
 
-	monitorClient *http.Client
-	monitorURL    string
+	monitorClient   *http.Client
+	monitorURLs     []string
+	monitorStrategy string
+	// discovered resolves the dnssrv+ monitorURLs, keyed by the configured URL
+	discovered map[string]*DiscoveredURL
+	// queries and signals may change at runtime and are guarded by mu
 	queries       []BackpressureQuery
+	signals       []*signal
 	throttleFlags *util.SyncMap[BackpressureQuery, float64]
 	allowance     float64
+	// values are the last polled value of each query, guarded by mu
+	values map[BackpressureQuery]float64
+
+	// failing tracks the queries whose last poll errored. Once every query is failing the
+	// failurePolicy decides the allowance.
+	failing       *util.SyncMap[BackpressureQuery, bool]
+	failurePolicy string
+
+	// recoveryStep and recoveryCooldown add hysteresis to allowance recovery. lastThrottled is
+	// when the allowance was last cut and lastRecovered is when it last increased.
+	recoveryStep     float64
+	recoveryCooldown time.Duration
+	lastThrottled    time.Time
+	lastRecovered    time.Time
+
+	// emergencySince is when the allowance closed fully, zero while it is open
+	emergencySince        time.Time
+	unreadyAfterEmergency time.Duration
+
+	// lastActive is when a request was last admitted or released, the watermark decays once
+	// nothing is in flight for idleDecayAfter
+	lastActive     time.Time
+	idleDecayAfter time.Duration
 
 	lowCostBypass bool
+	probabilistic bool
+	// costWeighted counts active requests by their QueryCost rather than one each
+	costWeighted bool
+
+	criticalityShedding bool
+	criticalPlusReserve int
+
+	costTiers       CostTierConfig
+	tierActive      map[CostTier]int
+	tierActiveGauge *prometheus.GaugeVec
+
+	tenantFairness TenantFairnessConfig
+	tenantActive   map[string]int
+
+	// peers and peerActive track the active requests of other replicas for the shared window
+	peers           WindowPeers
+	peerActive      int
+	peerSync        time.Duration
+	peerActiveGauge prometheus.Gauge
+
+	// leader elects the replica polling the queries, the others adopt its allowance until it is
+	// older than leaderStale
+	leader      LeaderElector
+	leaderStale time.Duration
+	leaderGauge prometheus.Gauge
+
+	// stateStore persists the window after every poll, state older than stateMaxAge is not restored
+	stateStore  StateStore
+	stateMaxAge time.Duration
+
+	// schedules swap the window bounds and the thresholds in scheduled while one is active.
+	// configuredMin and configuredMax are restored once no schedule is.
+	schedules      []schedule
+	activeSchedule int
+	configuredMin  int
+	configuredMax  int
+	scheduled      map[string]ScheduledThresholds
+
+	// clock drives the pollers and hysteresis, rand the probabilistic admission. Both default to
+	// the system sources when nil.
+	clock Clock
+	rand  Rand
 
 	client ProxyClient
 }
@@ -232,35 +666,94 @@ type Backpressure struct {
 var _ ProxyClient = &Backpressure{}
 
 func NewBackpressure(client ProxyClient, cfg BackpressureConfig) *Backpressure {
+	return newBackpressure(client, cfg, defaultBackpressureMetrics)
+}
+
+func newBackpressure(
+	client ProxyClient, cfg BackpressureConfig, m *backpressureMetrics,
+) *Backpressure {
 	return &Backpressure{
 		watermark:      cfg.CongestionWindowMin,
 		min:            cfg.CongestionWindowMin,
 		max:            cfg.CongestionWindowMax,
 		allowance:      1,
-		minGauge:       bpMinGauge,
-		maxGauge:       bpMaxGauge,
-		watermarkGauge: bpWatermarkGauge,
-		allowanceGauge: bpAllowanceGauge,
+		minGauge:       m.minGauge,
+		maxGauge:       m.maxGauge,
+		watermarkGauge: m.watermarkGauge,
+		allowanceGauge: m.allowanceGauge,
+
+		queryErrCount:    m.queryErrCount,
+		warnGauge:        m.warnGauge,
+		emergencyGauge:   m.emergencyGauge,
+		queryValGauge:    m.queryValGauge,
+		smoothedValGauge: m.smoothedValGauge,
+		slopeGauge:       m.slopeGauge,
+		pollDuration:     m.pollDuration,
+		queryDuration:    m.queryDuration,
+		throttleFlags:    util.NewSyncMap[BackpressureQuery, float64](),
+		failing:          util.NewSyncMap[BackpressureQuery, bool](),
+		failurePolicy:    cfg.MonitorFailurePolicy,
+
+		recoveryStep:     cfg.AllowanceRecoveryStep,
+		recoveryCooldown: cfg.AllowanceRecoveryCooldown,
 
-		queryErrCount:  bpQueryErrCounter,
-		warnGauge:      bpQueryWarnGauge,
-		emergencyGauge: bpQueryEmergencyGauge,
-		queryValGauge:  bpQueryValGauge,
-		throttleFlags:  util.NewSyncMap[BackpressureQuery, float64](),
+		unreadyAfterEmergency: cfg.UnreadyAfterEmergency,
+
+		lastActive:     time.Now(),
+		idleDecayAfter: cfg.IdleDecayAfter,
 
 		lowCostBypass: cfg.EnableLowCostBypass,
+		probabilistic: cfg.AllowanceMode == AllowanceModeProbabilistic,
+		costWeighted:  cfg.EnableCostWeightedWindow,
+
+		criticalityShedding: cfg.EnableCriticalityShedding,
+		criticalPlusReserve: cfg.CriticalPlusReserve,
+
+		costTiers:       cfg.CostTiers,
+		tierActive:      map[CostTier]int{},
+		tierActiveGauge: m.tierActiveGauge,
+
+		tenantFairness: cfg.TenantFairness,
+		tenantActive:   map[string]int{},
+
+		peers:           cfg.SharedWindow.peers(),
+		peerSync:        cfg.SharedWindow.interval(),
+		peerActiveGauge: m.peerActiveGauge,
+
+		leader:      cfg.LeaderElection.elector(),
+		leaderStale: cfg.LeaderElection.leaseDuration(),
+		leaderGauge: m.leaderGauge,
+
+		stateStore:  cfg.Persistence.store(),
+		stateMaxAge: cfg.Persistence.maxAge(),
 
-		monitorClient: &http.Client{
-			Timeout:   MonitorQueryTimeout,
-			Transport: http.DefaultTransport,
-		},
-		monitorURL: cfg.BackpressureMonitoringURL,
-		queries:    cfg.BackpressureQueries,
-		client:     client,
+		schedules:      compileSchedules(cfg.Schedules),
+		activeSchedule: -1,
+		configuredMin:  cfg.CongestionWindowMin,
+		configuredMax:  cfg.CongestionWindowMax,
+
+		monitorClient:   cfg.MonitorClient.client(),
+		monitorURLs:     cfg.monitorURLs(),
+		monitorStrategy: cfg.MonitorStrategy,
+		discovered:      discoverURLs(cfg.monitorURLs()),
+		queries:         cfg.BackpressureQueries,
+		client:          client,
 	}
 }
 
-func (bp *Backpressure) Init(ctx context.Context) {
+// useClock swaps the time and random sources, restarting the idle period on the new clock
+func (bp *Backpressure) useClock(clock Clock, random Rand) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.clock, bp.rand = clock, random
+	bp.lastActive = bp.now()
+}
+
+func (bp *Backpressure) now() time.Time {
+	return orSystemClock(bp.clock).Now()
+}
+
+func (bp *Backpressure) Init(ctx context.Context) error {
 	bp.minGauge.Set(float64(bp.min))
 	bp.maxGauge.Set(float64(bp.max))
 	bp.allowanceGauge.Set(bp.allowance)
@@ -273,11 +766,57 @@ func (bp *Backpressure) Init(ctx context.Context) {
 		}
 	}
 
+	for _, d := range bp.discovered {
+		if err := d.Resolve(ctx); err != nil {
+			log.Printf("failed to discover monitoring endpoints of %s: %v", d, err)
+		}
+		goUntilDone(ctx, func() { d.Run(ctx, DNSRefreshInterval) })
+	}
+
+	bp.applySchedule(bp.now())
+	bp.restoreState(ctx, bp.now())
 	bp.metricsLoop(ctx)
-	bp.client.Init(ctx)
+	bp.sharedWindowLoop(ctx)
+	return bp.client.Init(ctx)
+}
+
+// discoverURLs parses the dnssrv+ URLs among the validated monitoring URLs
+func discoverURLs(urls []string) map[string]*DiscoveredURL {
+	discovered := map[string]*DiscoveredURL{}
+	for _, u := range urls {
+		if !IsDNSSRV(u) {
+			continue
+		}
+		if d, err := NewDiscoveredURL(u); err == nil {
+			discovered[u] = d
+		}
+	}
+	return discovered
+}
+
+// monitorEndpoints expands the discovered monitoring URLs to their current targets
+func (bp *Backpressure) monitorEndpoints() []string {
+	if len(bp.discovered) == 0 {
+		return bp.monitorURLs
+	}
+
+	endpoints := make([]string, 0, len(bp.monitorURLs))
+	for _, u := range bp.monitorURLs {
+		d, ok := bp.discovered[u]
+		if !ok {
+			endpoints = append(endpoints, u)
+			continue
+		}
+
+		for _, target := range d.Targets() {
+			endpoints = append(endpoints, target.String())
+		}
+	}
+	return endpoints
 }
 
 func (bp *Backpressure) Next(rr Request) error {
+	start := time.Now()
 	if bp.lowCostBypass {
 		if lowCost, err := LowCostRequest(rr); err != nil {
 			return err
@@ -286,92 +825,578 @@ func (bp *Backpressure) Next(rr Request) error {
 		}
 	}
 
-	if err := bp.check(); err != nil {
+	bp.annotate(rr)
+	if err := bp.admit(rr); err != nil {
+		return err
+	}
+
+	tier, err := bp.costTiers.tierFor(rr)
+	if err != nil {
 		return err
 	}
 
-	defer bp.release()
+	if err := bp.checkTier(tier); err != nil {
+		return err
+	}
+	defer bp.releaseTier(tier)
+
+	tenant := bp.tenantFairness.tenantFor(rr)
+	if err := bp.checkTenant(tenant); err != nil {
+		return err
+	}
+	defer bp.releaseTenant(tenant)
+
+	criticality := ""
+	if bp.criticalityShedding {
+		if criticality, err = ParseCriticality(rr); err != nil {
+			return err
+		}
+	}
+
+	units := bp.units(rr)
+	if err := bp.check(criticality, units); err != nil {
+		return err
+	}
+
+	defer bp.release(units)
+	addServerTiming(rr, BackpressureProxyType, time.Since(start))
+	defer enterStage(rr, BackpressureProxyType, "holding a window slot")()
 	return bp.client.Next(rr)
 }
 
-// metricsLoop creates a goroutine for each backpressure signal to avoid one slow query from
-// preventing the other signals from actioning the congestion window.
+// annotate reports the allowance and watermark the request was admitted against
+func (bp *Backpressure) annotate(rr Request) {
+	if !decisionHeadersEnabled(rr) {
+		return
+	}
+
+	bp.mu.Lock()
+	allowance, watermark := bp.allowance, bp.watermark
+	bp.mu.Unlock()
+	setDecisionHeader(rr, HeaderThrottleAllowance, strconv.FormatFloat(allowance, 'f', 2, 64))
+	setDecisionHeader(rr, HeaderThrottleWatermark, strconv.Itoa(watermark))
+}
+
+// units is how much of the congestion window the request occupies while in flight
+func (bp *Backpressure) units(rr Request) int {
+	if !bp.costWeighted {
+		return 1
+	}
+
+	// requests which are not queries, e.g. label lookups, cost the minimum
+	cost, err := QueryCost(rr)
+	if err != nil {
+		return 1
+	}
+	return max(1, cost)
+}
+
+// signal is the polling state of a backpressure query
+type signal struct {
+	query    BackpressureQuery
+	fetch    SignalFetcher
+	smoothed *ewma
+	// history is nil unless the query throttles on its slope
+	history *slopeWindow
+	// baseline is nil unless the query derives its thresholds from its trailing samples
+	baseline *anomalyWindow
+}
+
+func newSignal(q BackpressureQuery) *signal {
+	return &signal{
+		query:    q,
+		fetch:    q.fetcher(),
+		smoothed: &ewma{alpha: q.SmoothingAlpha},
+		history:  newSlopeWindow(q.SlopeSamples),
+		baseline: newAnomalyWindow(q.AnomalyWindow),
+	}
+}
+
+// metricsLoop evaluates every backpressure signal once per BackpressureUpdateCadence. Signals are
+// fetched in parallel over the shared monitor client so one slow query does not prevent the
+// other signals from actioning the congestion window.
 func (bp *Backpressure) metricsLoop(ctx context.Context) {
+	bp.mu.Lock()
+	bp.signals = make([]*signal, 0, len(bp.queries))
 	for _, q := range bp.queries {
-		go func(q BackpressureQuery) {
-			ticker := time.NewTicker(BackpressureUpdateCadence)
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
-					curr, err := ValueFromPromQL(ctx, bp.monitorClient, bp.monitorURL, q.Query)
-					if err != nil {
-						bp.queryErrCount.WithLabelValues(q.Name).Inc()
-						log.Printf("querying metric '%s' returned error: %v", q.Query, err)
-						continue
-					}
-
-					bp.queryValGauge.WithLabelValues(q.Name).Set(curr)
-					bp.updateThrottle(q, curr)
+		bp.signals = append(bp.signals, newSignal(q))
+	}
+	bp.mu.Unlock()
+
+	goUntilDone(ctx, func() {
+		ticker := orSystemClock(bp.clock).NewTicker(BackpressureUpdateCadence)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				bp.applySchedule(bp.now())
+				bp.evaluate(ctx)
+				if err := bp.SaveState(ctx); err != nil {
+					log.Printf("error saving backpressure state: %v", err)
 				}
 			}
-		}(q)
+		}
+	})
+}
+
+// pollSignals runs a single poll cycle across every signal and records how long it took
+func (bp *Backpressure) pollSignals(ctx context.Context, signals []*signal) {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, s := range signals {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queryStart := time.Now()
+			bp.poll(ctx, s)
+			bp.queryDuration.WithLabelValues(s.query.Name).Observe(time.Since(queryStart).Seconds())
+		}()
+	}
+	wg.Wait()
+	bp.pollDuration.Observe(time.Since(start).Seconds())
+}
+
+// poll fetches the current query value and thresholds and updates the throttle
+func (bp *Backpressure) poll(ctx context.Context, s *signal) {
+	q := s.query
+	bp.mu.Lock()
+	scheduled := bp.scheduledThresholds(q)
+	bp.mu.Unlock()
+
+	resolved, err := bp.resolveThresholds(ctx, scheduled, s.fetch)
+	curr := 0.0
+	if err == nil {
+		curr, err = bp.fetchValue(ctx, s.fetch, q.Query)
+	}
+	if err != nil {
+		bp.queryErrCount.WithLabelValues(q.Name).Inc()
+		log.Printf("querying metric '%s' returned error: %v", q.Query, err)
+		bp.queryFailed(q)
+		return
+	}
+
+	bp.queryValGauge.WithLabelValues(q.Name).Set(curr)
+	if q.SmoothingAlpha != 0 {
+		curr = s.smoothed.add(curr)
+		bp.smoothedValGauge.WithLabelValues(q.Name).Set(curr)
+	}
+
+	throttle := resolved.throttlePercent(curr)
+	if s.baseline != nil {
+		throttle = 0
+		if mean, stddev, ok := s.baseline.add(curr); ok {
+			resolved = q.anomalyThresholds(mean, stddev)
+			throttle = resolved.throttlePercent(curr)
+			if q.Name != "" {
+				bp.warnGauge.WithLabelValues(q.Name).Set(resolved.WarningThreshold)
+				bp.emergencyGauge.WithLabelValues(q.Name).Set(resolved.EmergencyThreshold)
+			}
+		}
+	}
+	if s.history != nil {
+		if slope, ok := s.history.add(bp.now(), curr); ok {
+			bp.slopeGauge.WithLabelValues(q.Name).Set(slope)
+			throttle = max(throttle, q.slopeThrottlePercent(slope))
+		}
 	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	// the query may have been removed while it was being fetched
+	if !bp.registered(q) {
+		return
+	}
+	bp.failing.Delete(q)
+	if bp.values == nil {
+		bp.values = map[BackpressureQuery]float64{}
+	}
+	bp.values[q] = curr
+	bp.throttleFlags.Store(q, throttle)
+	bp.applyThrottle()
+}
+
+func (bp *Backpressure) fetchValue(
+	ctx context.Context, fetch SignalFetcher, query string,
+) (float64, error) {
+	endpoints := bp.monitorEndpoints()
+	if len(endpoints) == 0 {
+		return 0, ErrNoSRVTargets
+	}
+	return ValueFromMonitors(ctx, bp.monitorClient, fetch, endpoints, bp.monitorStrategy, query)
+}
+
+// resolveThresholds returns a copy of the query with its dynamic thresholds evaluated
+func (bp *Backpressure) resolveThresholds(
+	ctx context.Context, q BackpressureQuery, fetch SignalFetcher,
+) (BackpressureQuery, error) {
+	if q.WarningThresholdQuery == "" && q.EmergencyThresholdQuery == "" {
+		return q, nil
+	}
+
+	for _, threshold := range []struct {
+		query string
+		val   *float64
+	}{
+		{query: q.WarningThresholdQuery, val: &q.WarningThreshold},
+		{query: q.EmergencyThresholdQuery, val: &q.EmergencyThreshold},
+	} {
+		if threshold.query == "" {
+			continue
+		}
+
+		val, err := bp.fetchValue(ctx, fetch, threshold.query)
+		if err != nil {
+			return q, fmt.Errorf("threshold query '%s': %w", threshold.query, err)
+		}
+		*threshold.val = val
+	}
+
+	if err := q.validateThresholds(); err != nil {
+		return q, fmt.Errorf("dynamic thresholds %f and %f: %w",
+			q.WarningThreshold, q.EmergencyThreshold, err)
+	}
+
+	if q.Name != "" {
+		bp.warnGauge.WithLabelValues(q.Name).Set(q.WarningThreshold)
+		bp.emergencyGauge.WithLabelValues(q.Name).Set(q.EmergencyThreshold)
+	}
+	return q, nil
+}
+
+// sharedWindowLoop publishes the local active count and refreshes the active count of other
+// replicas. When the peers are unreachable the window falls back to local enforcement.
+func (bp *Backpressure) sharedWindowLoop(ctx context.Context) {
+	if bp.peers == nil {
+		return
+	}
+
+	goUntilDone(ctx, func() {
+		ticker := orSystemClock(bp.clock).NewTicker(bp.peerSync)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				bp.syncPeers(ctx)
+			}
+		}
+	})
+}
+
+func (bp *Backpressure) syncPeers(ctx context.Context) {
+	bp.mu.Lock()
+	active := bp.active
+	bp.mu.Unlock()
+
+	syncCtx, cancel := context.WithTimeout(ctx, bp.peerSync)
+	defer cancel()
+	peerActive, err := bp.peers.Sync(syncCtx, active, bp.now())
+	if err != nil {
+		log.Printf("error syncing shared window, enforcing window locally: %v", err)
+		peerActive = 0
+	}
+
+	bp.mu.Lock()
+	bp.peerActive = peerActive
+	bp.mu.Unlock()
+	bp.peerActiveGauge.Set(float64(peerActive))
 }
 
 func (bp *Backpressure) updateThrottle(q BackpressureQuery, curr float64) {
-	bp.throttleFlags.Store(q, q.throttlePercent(curr))
+	bp.setThrottle(q, q.throttlePercent(curr))
+}
+
+// setThrottle records the throttle percent of the query and applies the most restrictive one
+func (bp *Backpressure) setThrottle(q BackpressureQuery, percent float64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.throttleFlags.Store(q, percent)
+	bp.applyThrottle()
+}
+
+// applyThrottle sets the allowance from the most restrictive query.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) applyThrottle() {
 	throttlePercent := 0.0
 	bp.throttleFlags.Range(func(_ BackpressureQuery, value float64) bool {
 		throttlePercent = max(throttlePercent, value)
 		return true
 	})
 
+	now := bp.now()
+	previous := bp.allowance
+	bp.allowance = bp.nextAllowance(1-throttlePercent, now)
+	bp.publishShrunk(previous)
+	bp.allowanceGauge.Set(bp.allowance)
+	bp.trackEmergency(now)
+	bp.constrainWatermark()
+}
+
+// queryFailed records a failed poll and applies the failure policy once every query is failing
+func (bp *Backpressure) queryFailed(q BackpressureQuery) {
 	bp.mu.Lock()
-	bp.allowance = 1 - throttlePercent
+	defer bp.mu.Unlock()
+	if !bp.registered(q) {
+		return
+	}
+
+	if _, stale := bp.failing.Load(q); !stale {
+		publishEvent(func() Event {
+			return Event{
+				Type:    EventQueryStale,
+				Source:  BackpressureProxyType,
+				Message: fmt.Sprintf("query %q is failing, its last value is stale", q.Query),
+				Fields:  map[string]any{"query": q.Name},
+			}
+		})
+	}
+	bp.failing.Store(q, true)
+	if bp.failing.Len() < len(bp.queries) {
+		return
+	}
+
+	previous := bp.allowance
+	switch bp.failurePolicy {
+	case MonitorFailureOpen:
+		bp.allowance = 1
+	case MonitorFailureClosed:
+		bp.allowance = 0
+		bp.lastThrottled = bp.now()
+	default:
+		return
+	}
+	bp.publishShrunk(previous)
+
+	log.Printf("all backpressure queries failing, failing %s", bp.failurePolicy)
 	bp.allowanceGauge.Set(bp.allowance)
+	bp.trackEmergency(bp.now())
+	bp.constrainWatermark()
+}
+
+// nextAllowance moves the allowance toward the target. Cuts apply immediately while recovery
+// waits out the cooldown and then grows by at most recoveryStep per BackpressureUpdateCadence so
+// the fleet does not reopen to a thundering herd after one good sample.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) nextAllowance(target float64, now time.Time) float64 {
+	if bp.recoveryStep == 0 && bp.recoveryCooldown == 0 {
+		return target
+	}
+
+	// the cooldown starts once signals stop asking for a smaller allowance
+	if target <= bp.allowance {
+		bp.lastThrottled = now
+		return target
+	}
+
+	recoverFrom := bp.lastThrottled.Add(bp.recoveryCooldown)
+	if now.Before(recoverFrom) {
+		return bp.allowance
+	}
+
+	if bp.recoveryStep == 0 {
+		return target
+	}
+
+	if bp.lastRecovered.After(recoverFrom) {
+		recoverFrom = bp.lastRecovered
+	}
+
+	intervals := float64(now.Sub(recoverFrom)) / float64(BackpressureUpdateCadence)
+	bp.lastRecovered = now
+	return min(target, bp.allowance+bp.recoveryStep*intervals)
+}
+
+// check ensures the units of concurrent active requests stay within the allowed window.
+// If the request would exceed the window for its criticality, the request is denied. A request
+// larger than the whole window is still admitted when nothing else is active.
+func (bp *Backpressure) check(criticality string, units int) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if bp.idleDecayAfter > 0 {
+		bp.decayIdle(bp.now())
+	}
+	used, window := bp.active+bp.peerActive, bp.criticalityWindow(criticality)
+	if window <= 0 || (used > 0 && used+units > window) {
+		return bp.backoff(ErrBackpressureBackoff)
+	}
+
+	bp.active += units
+	bp.markActive()
+	return nil
+}
+
+// markActive records request activity when the watermark decays while idle.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) markActive() {
+	if bp.idleDecayAfter > 0 {
+		bp.lastActive = bp.now()
+	}
+}
+
+// decayIdle halves the distance of the watermark to the min for every idleDecayAfter without
+// requests. Partial periods carry over to the next check.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) decayIdle(now time.Time) {
+	if bp.idleDecayAfter == 0 || bp.active > 0 {
+		return
+	}
+
+	periods := now.Sub(bp.lastActive) / bp.idleDecayAfter
+	if periods < 1 {
+		return
+	}
+
+	bp.lastActive = bp.lastActive.Add(periods * bp.idleDecayAfter)
+	bp.watermark = bp.min + (bp.watermark-bp.min)>>min(periods, 62)
 	bp.constrainWatermark()
-	bp.mu.Unlock()
 }
 
-// check ensures the number of concurrent active requests stays within the allowed window.
-// If the active count exceeds the current watermark, the request is denied.
-func (bp *Backpressure) check() error {
+// admit drops requests with probability 1 - allowance when running in probabilistic mode.
+// CRITICAL_PLUS requests are never dropped.
+func (bp *Backpressure) admit(rr Request) error {
+	if !bp.probabilistic || ParseHeaderKey(rr, HeaderCriticality) == CriticalityCriticalPlus {
+		return nil
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if orSystemRand(bp.rand).Float64() >= bp.allowance {
+		return bp.backoff(ErrBackpressureDropped)
+	}
+	return nil
+}
+
+// backoff rejects the request with the Retry-After the window is expected to admit it in.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) backoff(err error) error {
+	return &RequestBlockedError{Err: err, Type: BackpressureProxyType, RetryAfter: bp.retryAfter()}
+}
+
+// retryAfter estimates when a rejected request is admitted from how far the allowance and
+// watermark have closed the window. A fully open window only waits a second for a slot to free
+// up, a closed one waits the BackpressureUpdateCadence until the queries may reopen it.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) retryAfter() time.Duration {
+	openness := bp.allowance
+	if bp.max > 0 {
+		openness = min(openness, float64(bp.watermark)/float64(bp.max))
+	}
+	return max(time.Second, time.Duration((1-openness)*float64(BackpressureUpdateCadence)))
+}
+
+// checkTier ensures a cost tier stays within its share of the current watermark.
+func (bp *Backpressure) checkTier(tier CostTier) error {
+	if tier == CostTierNone {
+		return nil
+	}
+
 	bp.mu.Lock()
 	defer bp.mu.Unlock()
 
-	if bp.active >= bp.watermark {
-		return ErrBackpressureBackoff
+	if bp.tierActive[tier] >= bp.costTiers.tierWindow(tier, bp.watermark) {
+		return bp.backoff(fmt.Errorf("%s cost tier window closed, backoff from backpressure", tier))
 	}
 
-	bp.active++
+	bp.tierActive[tier]++
+	bp.tierActiveGauge.WithLabelValues(string(tier)).Set(float64(bp.tierActive[tier]))
 	return nil
 }
 
+// releaseTier frees the slot taken by checkTier.
+func (bp *Backpressure) releaseTier(tier CostTier) {
+	if tier == CostTierNone {
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.tierActive[tier] = max(0, bp.tierActive[tier]-1)
+	bp.tierActiveGauge.WithLabelValues(string(tier)).Set(float64(bp.tierActive[tier]))
+}
+
+// criticalityWindow is the share of the watermark a request of the given criticality may fill.
+// CRITICAL_PLUS may use the whole watermark while every other criticality leaves the reserve
+// open. Sheddable requests only get a share of the window proportional to how open it is
+// compared to the max, so they are rejected first as the window shrinks.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) criticalityWindow(criticality string) int {
+	if !bp.criticalityShedding {
+		return bp.watermark
+	}
+
+	shared := float64(max(0, bp.watermark-bp.criticalPlusReserve))
+	openness := 1.0
+	if bp.max > 0 {
+		openness = min(1, float64(bp.watermark)/float64(bp.max))
+	}
+
+	switch criticality {
+	case CriticalityCriticalPlus:
+		return bp.watermark
+	case CriticalitySheddablePlus:
+		return int(shared * openness)
+	case CriticalitySheddable:
+		return int(shared * openness * openness)
+	default:
+		return int(shared)
+	}
+}
+
 // release adjusts the watermark and active request count:
-// 1. Decrements the active request count, ensuring it doesn't go below zero.
+// 1. Decrements the active count by the units of the request, ensuring it doesn't go below zero.
 //
 // 2. Increases the watermark by one, unless throttling (allowance < 1) reduces it.
 //
 //   - Throttling can significantly lower the watermark, but watermark won't exceed max.
 //
 // 3. Ensures the watermark never falls below the configured minimum.
-func (bp *Backpressure) release() {
+func (bp *Backpressure) release(units int) {
 	bp.mu.Lock()
 	defer bp.mu.Unlock()
 
-	bp.active = max(0, bp.active-1)
+	bp.active = max(0, bp.active-units)
+	bp.markActive()
 	bp.watermark++
 	bp.constrainWatermark()
 }
 
+// publishShrunk publishes a window_shrunk event when the allowance dropped below previous.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) publishShrunk(previous float64) {
+	if bp.allowance >= previous {
+		return
+	}
+
+	publishEvent(func() Event {
+		return Event{
+			Type:   EventWindowShrunk,
+			Source: BackpressureProxyType,
+			Fields: map[string]any{
+				"allowance":          bp.allowance,
+				"previous_allowance": previous,
+				"watermark":          bp.watermark,
+			},
+		}
+	})
+}
+
 // constrainWatermark ensures that watermark never goes above the allowed max or below the min.
 // Assumes the callsite already holds the lock and updates the metric gauge.
+// In probabilistic mode the allowance is applied per request so the window is only bound by max.
 func (bp *Backpressure) constrainWatermark() {
-	bp.watermark = min(bp.watermark, int(float64(bp.max)*bp.allowance))
+	ceiling := bp.max
+	if !bp.probabilistic {
+		ceiling = int(float64(bp.max) * bp.allowance)
+	}
+	bp.watermark = min(bp.watermark, ceiling)
 	bp.watermark = max(bp.watermark, bp.min)
 	bp.watermarkGauge.Set(float64(bp.watermark))
 }
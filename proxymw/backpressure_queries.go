@@ -0,0 +1,143 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BackpressureQueriesPath is where the internal server manages backpressure queries at runtime
+const BackpressureQueriesPath = "/api/v1/backpressure/queries"
+
+var (
+	ErrQueryNameRequired  = errors.New("runtime backpressure queries require a name")
+	ErrDuplicateQueryName = errors.New("backpressure query name already registered")
+	ErrQueryNotFound      = errors.New("backpressure query not found")
+	ErrBackpressureOff    = errors.New("backpressure is not enabled")
+
+	// activeBackpressure is the Backpressure built from config served by BackpressureQueriesHandler
+	activeBackpressure atomic.Pointer[Backpressure]
+)
+
+// Queries returns the backpressure queries currently polled
+func (bp *Backpressure) Queries() []BackpressureQuery {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return slices.Clone(bp.queries)
+}
+
+// AddQuery registers a named backpressure query which is polled from the next update cycle
+func (bp *Backpressure) AddQuery(q BackpressureQuery) error {
+	if q.Name == "" {
+		return ErrQueryNameRequired
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.indexOf(q.Name) >= 0 {
+		return fmt.Errorf("%w: %s", ErrDuplicateQueryName, q.Name)
+	}
+
+	bp.queries = append(bp.queries, q)
+	bp.signals = append(bp.signals, newSignal(q))
+	bp.warnGauge.WithLabelValues(q.Name).Set(q.WarningThreshold)
+	bp.emergencyGauge.WithLabelValues(q.Name).Set(q.EmergencyThreshold)
+	return nil
+}
+
+// RemoveQuery stops polling the named backpressure query and drops its throttle
+func (bp *Backpressure) RemoveQuery(name string) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	i := bp.indexOf(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrQueryNotFound, name)
+	}
+
+	q := bp.queries[i]
+	bp.queries = slices.Delete(bp.queries, i, i+1)
+	bp.signals = slices.DeleteFunc(bp.signals, func(s *signal) bool { return s.query == q })
+	bp.throttleFlags.Delete(q)
+	bp.failing.Delete(q)
+	delete(bp.values, q)
+	bp.applyThrottle()
+	return nil
+}
+
+// indexOf returns the position of the named query or -1.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) indexOf(name string) int {
+	return slices.IndexFunc(bp.queries, func(q BackpressureQuery) bool { return q.Name == name })
+}
+
+// registered reports whether the query is still polled.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) registered(q BackpressureQuery) bool {
+	return slices.Contains(bp.queries, q)
+}
+
+func (bp *Backpressure) currentSignals() []*signal {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return slices.Clone(bp.signals)
+}
+
+// ServeQueries lists the polled queries on GET, adds the YAML or JSON encoded query in the body
+// on POST, and removes the query named by the name parameter on DELETE.
+func (bp *Backpressure) ServeQueries(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body []byte
+		var q BackpressureQuery
+		if body, err = io.ReadAll(r.Body); err == nil {
+			if err = yaml.Unmarshal(body, &q); err == nil {
+				err = bp.AddQuery(q)
+			}
+		}
+	case http.MethodDelete:
+		err = bp.RemoveQuery(r.URL.Query().Get("name"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, ErrQueryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	signals := []SignalDescription{}
+	for _, q := range bp.Queries() {
+		signals = append(signals, describeSignal(q))
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(signals); err != nil {
+		log.Printf("error writing backpressure queries: %v", err)
+	}
+}
+
+// BackpressureQueriesHandler manages the queries of the Backpressure middleware built from config
+func BackpressureQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	bp := activeBackpressure.Load()
+	if bp == nil {
+		http.Error(w, ErrBackpressureOff.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	bp.ServeQueries(w, r)
+}
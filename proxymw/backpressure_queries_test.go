@@ -0,0 +1,105 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeQueries(t *testing.T) {
+	t.Parallel()
+	testGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_gauge_runtime_queries"})
+	testGaugeVec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "fake_gauge_vec_runtime_queries"}, bpMetricLabels,
+	)
+	static := BackpressureQuery{
+		Name: "errors", Query: "errors", WarningThreshold: 10, EmergencyThreshold: 50,
+	}
+	bp := NewBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin: 1,
+		CongestionWindowMax: 10,
+		BackpressureQueries: []BackpressureQuery{static},
+	})
+	bp.warnGauge, bp.emergencyGauge = testGaugeVec, testGaugeVec
+	bp.watermarkGauge, bp.allowanceGauge = testGauge, testGauge
+
+	latency := BackpressureQuery{
+		Name: "latency", Query: "latency", WarningThreshold: 1, EmergencyThreshold: 2,
+	}
+	require.NoError(t, bp.AddQuery(latency))
+	require.ErrorIs(t, bp.AddQuery(latency), ErrDuplicateQueryName)
+	require.ErrorIs(t, bp.AddQuery(BackpressureQuery{Query: "up"}), ErrQueryNameRequired)
+	require.Equal(t, []BackpressureQuery{static, latency}, bp.Queries())
+	require.Len(t, bp.currentSignals(), 1, "config queries get their signals once polling starts")
+
+	bp.setThrottle(latency, 1)
+	require.Equal(t, 0.0, bp.allowance)
+	require.NoError(t, bp.RemoveQuery("latency"))
+	require.Equal(t, 1.0, bp.allowance, "removing a query drops its throttle")
+	require.ErrorIs(t, bp.RemoveQuery("latency"), ErrQueryNotFound)
+	require.Equal(t, []BackpressureQuery{static}, bp.Queries())
+
+	// a poll finishing after removal must not reinstate the throttle
+	bp.queryFailed(latency)
+	require.Zero(t, bp.failing.Len())
+}
+
+func TestServeQueries(t *testing.T) {
+	t.Parallel()
+	testGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_gauge_serve_queries"})
+	testGaugeVec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "fake_gauge_vec_serve_queries"}, bpMetricLabels,
+	)
+	bp := NewBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin: 1,
+		CongestionWindowMax: 10,
+	})
+	bp.warnGauge, bp.emergencyGauge = testGaugeVec, testGaugeVec
+	bp.watermarkGauge, bp.allowanceGauge = testGauge, testGauge
+
+	serve := func(method, target, body string) (int, []SignalDescription) {
+		rec := httptest.NewRecorder()
+		bp.ServeQueries(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		signals := []SignalDescription{}
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&signals))
+		}
+		return rec.Code, signals
+	}
+
+	code, signals := serve(
+		http.MethodPost,
+		BackpressureQueriesPath,
+		`{"name": "latency", "query": "p99_latency", "warning_threshold": 1, "emergency_threshold": 2}`,
+	)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []SignalDescription{{
+		Name:               "latency",
+		Query:              "p99_latency",
+		Backend:            BackendPrometheus,
+		WarningThreshold:   1,
+		EmergencyThreshold: 2,
+	}}, signals)
+
+	code, _ = serve(http.MethodPost, BackpressureQueriesPath, `{"name": "bad", "query": "up"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, signals = serve(http.MethodGet, BackpressureQueriesPath, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, signals, 1)
+
+	code, _ = serve(http.MethodDelete, BackpressureQueriesPath+"?name=missing", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, signals = serve(http.MethodDelete, BackpressureQueriesPath+"?name=latency", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, signals)
+
+	code, _ = serve(http.MethodPut, BackpressureQueriesPath, "")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -1,9 +1,17 @@
 package proxymw
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	"github.com/kevindweb/throttle-proxy/internal/util"
@@ -83,7 +91,7 @@ func TestBackpressureRelease(t *testing.T) {
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.bp.release()
+			tt.bp.release(1)
 			require.Equal(t, tt.expect, tt.bp)
 		})
 	}
@@ -171,3 +179,482 @@ func TestUpdateThrottle(t *testing.T) {
 		})
 	}
 }
+
+func TestProbabilisticAdmit(t *testing.T) {
+	testGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "fake_gauge_probabilistic"},
+	)
+	request := func(criticality string) Request {
+		return &Mocker{
+			RequestFunc: func() *http.Request {
+				return &http.Request{
+					Header: http.Header{string(HeaderCriticality): []string{criticality}},
+				}
+			},
+		}
+	}
+
+	bp := &Backpressure{
+		min:            1,
+		watermark:      1,
+		max:            10,
+		allowance:      0,
+		probabilistic:  true,
+		watermarkGauge: testGauge,
+	}
+
+	require.ErrorIs(t, bp.admit(request(CriticalityCritical)), ErrBackpressureDropped)
+	require.NoError(t, bp.admit(request(CriticalityCriticalPlus)))
+
+	// the window is not shrunk by the allowance in probabilistic mode
+	bp.watermark = 10
+	bp.constrainWatermark()
+	require.Equal(t, 10, bp.watermark)
+
+	bp.allowance = 1
+	require.NoError(t, bp.admit(request(CriticalityCritical)))
+
+	bp.probabilistic = false
+	bp.allowance = 0
+	require.NoError(t, bp.admit(request(CriticalityCritical)))
+	bp.constrainWatermark()
+	require.Equal(t, 1, bp.watermark)
+}
+
+func TestCriticalityWindow(t *testing.T) {
+	bp := &Backpressure{
+		min:                 4,
+		max:                 100,
+		watermark:           100,
+		criticalityShedding: true,
+		criticalPlusReserve: 2,
+	}
+
+	// a fully open window only holds back the reserve
+	require.Equal(t, 100, bp.criticalityWindow(CriticalityCriticalPlus))
+	require.Equal(t, 98, bp.criticalityWindow(CriticalityCritical))
+	require.Equal(t, 98, bp.criticalityWindow(CriticalitySheddablePlus))
+	require.Equal(t, 98, bp.criticalityWindow(CriticalitySheddable))
+
+	// sheddable traffic gives up its share first as the window shrinks
+	bp.watermark = 50
+	require.Equal(t, 50, bp.criticalityWindow(CriticalityCriticalPlus))
+	require.Equal(t, 48, bp.criticalityWindow(CriticalityCritical))
+	require.Equal(t, 24, bp.criticalityWindow(CriticalitySheddablePlus))
+	require.Equal(t, 12, bp.criticalityWindow(CriticalitySheddable))
+
+	// critical plus dips into the reserved portion of the min window
+	bp.watermark = 4
+	bp.active = 2
+	require.ErrorIs(t, bp.check(CriticalityCritical, 1), ErrBackpressureBackoff)
+	require.ErrorIs(t, bp.check(CriticalitySheddable, 1), ErrBackpressureBackoff)
+	require.NoError(t, bp.check(CriticalityCriticalPlus, 1))
+	require.NoError(t, bp.check(CriticalityCriticalPlus, 1))
+	require.ErrorIs(t, bp.check(CriticalityCriticalPlus, 1), ErrBackpressureBackoff)
+
+	bp.criticalityShedding = false
+	require.Equal(t, 4, bp.criticalityWindow(CriticalitySheddable))
+}
+
+func TestBackpressureRetryAfter(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name       string
+		allowance  float64
+		watermark  int
+		retryAfter time.Duration
+	}{
+		{name: "open window waits for a slot", allowance: 1, watermark: 100, retryAfter: time.Second},
+		{name: "half open", allowance: 1, watermark: 50, retryAfter: BackpressureUpdateCadence / 2},
+		{name: "low allowance", allowance: 0.25, watermark: 100, retryAfter: BackpressureUpdateCadence * 3 / 4},
+		{name: "closed waits for the next poll", allowance: 0, watermark: 0, retryAfter: BackpressureUpdateCadence},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			bp := &Backpressure{max: 100, watermark: tt.watermark, allowance: tt.allowance, active: 1}
+			err := bp.check("", 100)
+			var blocked *RequestBlockedError
+			require.ErrorAs(t, err, &blocked)
+			require.ErrorIs(t, err, ErrBackpressureBackoff)
+			require.Equal(t, BackpressureProxyType, blocked.Type)
+			require.Equal(t, tt.retryAfter, blocked.RetryAfter)
+		})
+	}
+}
+
+func TestCostWeightedWindow(t *testing.T) {
+	bp := &Backpressure{
+		min:            10,
+		max:            100,
+		watermark:      10,
+		allowance:      1,
+		costWeighted:   true,
+		watermarkGauge: prometheus.NewGauge(prometheus.GaugeOpts{}),
+	}
+
+	// a query larger than the whole window runs alone
+	require.NoError(t, bp.check("", ObjectStorageThreshold))
+	require.ErrorIs(t, bp.check("", 1), ErrBackpressureBackoff)
+	bp.release(ObjectStorageThreshold)
+	require.Equal(t, 0, bp.active)
+
+	// cheap queries fill the window one unit at a time
+	bp.watermark = 10
+	for range 10 {
+		require.NoError(t, bp.check("", 1))
+	}
+	require.ErrorIs(t, bp.check("", 1), ErrBackpressureBackoff)
+	require.Equal(t, 10, bp.active)
+
+	// requests without a cost such as status pages take one unit
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/status/buildinfo", http.NoBody)
+	require.Equal(t, 1, bp.units(&RequestResponseWrapper{req: req}))
+}
+
+func TestWeightedThrottlePercent(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{Query: "errors", WarningThreshold: 10, EmergencyThreshold: 20}
+	require.Equal(t, 0.0, q.throttlePercent(5))
+	require.Equal(t, 1.0, q.throttlePercent(25))
+
+	q.Weight = 0.5
+	require.Equal(t, 0.5, q.throttlePercent(25))
+	require.InDelta(t, 0.5*q.rawThrottlePercent(15), q.throttlePercent(15), 1e-9)
+
+	q.Weight = 0
+	q.MaxThrottle = 0.3
+	require.Equal(t, 0.3, q.throttlePercent(25))
+	require.Equal(t, 0.0, q.throttlePercent(5))
+	require.NoError(t, q.Validate())
+
+	q.MaxThrottle = 1.5
+	require.ErrorIs(t, q.Validate(), ErrQueryWeightRange)
+}
+
+func TestAllowanceRecovery(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1_700_000_000, 0)
+	at := func(intervals float64) time.Time {
+		return start.Add(time.Duration(intervals * float64(BackpressureUpdateCadence)))
+	}
+
+	bp := &Backpressure{allowance: 1}
+	require.Equal(t, 0.2, bp.nextAllowance(0.2, start))
+	bp.allowance = 0.2
+	require.Equal(t, 1.0, bp.nextAllowance(1, at(1)), "recovery is instant without hysteresis")
+
+	bp = &Backpressure{
+		allowance:        1,
+		recoveryStep:     0.05,
+		recoveryCooldown: 2 * BackpressureUpdateCadence,
+	}
+	bp.allowance = bp.nextAllowance(0.2, start)
+	require.Equal(t, 0.2, bp.allowance)
+
+	// an emergency that holds restarts the cooldown
+	bp.allowance = bp.nextAllowance(0.2, at(1))
+	require.Equal(t, 0.2, bp.allowance)
+
+	bp.allowance = bp.nextAllowance(1, at(2))
+	require.Equal(t, 0.2, bp.allowance, "still cooling down")
+
+	bp.allowance = bp.nextAllowance(1, at(4))
+	require.InDelta(t, 0.25, bp.allowance, 1e-9)
+
+	bp.allowance = bp.nextAllowance(1, at(5))
+	require.InDelta(t, 0.3, bp.allowance, 1e-9)
+
+	bp.allowance = bp.nextAllowance(0.32, at(7))
+	require.InDelta(t, 0.32, bp.allowance, 1e-9, "recovery never overshoots the target")
+
+	// cuts always apply immediately
+	bp.allowance = bp.nextAllowance(0.1, at(8))
+	require.Equal(t, 0.1, bp.allowance)
+}
+
+func TestIdleDecay(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1_700_000_000, 0)
+	bp := &Backpressure{
+		watermark:      81,
+		min:            1,
+		max:            100,
+		allowance:      1,
+		lastActive:     start,
+		idleDecayAfter: time.Minute,
+		watermarkGauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_idle_decay"}),
+	}
+
+	bp.decayIdle(start.Add(59 * time.Second))
+	require.Equal(t, 81, bp.watermark, "not idle long enough")
+
+	bp.decayIdle(start.Add(90 * time.Second))
+	require.Equal(t, 41, bp.watermark)
+
+	// the partial period carries over
+	bp.decayIdle(start.Add(2 * time.Minute))
+	require.Equal(t, 21, bp.watermark)
+
+	bp.decayIdle(start.Add(time.Hour))
+	require.Equal(t, 1, bp.watermark)
+
+	// nothing decays while requests are in flight
+	bp.watermark, bp.active = 50, 1
+	bp.decayIdle(start.Add(2 * time.Hour))
+	require.Equal(t, 50, bp.watermark)
+
+	bp.idleDecayAfter, bp.active = 0, 0
+	bp.decayIdle(start.Add(3 * time.Hour))
+	require.Equal(t, 50, bp.watermark, "decay is disabled")
+}
+
+func TestEWMA(t *testing.T) {
+	t.Parallel()
+	disabled := &ewma{}
+	require.Equal(t, 10.0, disabled.add(10))
+	require.Equal(t, 100.0, disabled.add(100))
+
+	smoothed := &ewma{alpha: 0.25}
+	require.Equal(t, 10.0, smoothed.add(10), "first sample primes the average")
+	require.Equal(t, 32.5, smoothed.add(100), "a single spike only moves the average by alpha")
+	require.Equal(t, 26.875, smoothed.add(10))
+
+	q := BackpressureQuery{Query: "errors", WarningThreshold: 1, EmergencyThreshold: 2}
+	q.SmoothingAlpha = 1.5
+	require.ErrorIs(t, q.Validate(), ErrSmoothingAlphaRange)
+}
+
+func TestMonitorFailurePolicy(t *testing.T) {
+	t.Parallel()
+	testGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "fake_gauge_monitor_failure"},
+	)
+	first := BackpressureQuery{Query: "first", WarningThreshold: 10, EmergencyThreshold: 20}
+	second := BackpressureQuery{Query: "second", WarningThreshold: 10, EmergencyThreshold: 20}
+	newBackpressure := func(policy string) *Backpressure {
+		return &Backpressure{
+			min:            10,
+			max:            100,
+			watermark:      50,
+			allowance:      0.5,
+			queries:        []BackpressureQuery{first, second},
+			throttleFlags:  util.NewSyncMap[BackpressureQuery, float64](),
+			failing:        util.NewSyncMap[BackpressureQuery, bool](),
+			failurePolicy:  policy,
+			watermarkGauge: testGauge,
+			allowanceGauge: testGauge,
+		}
+	}
+
+	for _, tt := range []struct {
+		policy    string
+		allowance float64
+		watermark int
+	}{
+		{policy: "", allowance: 0.5, watermark: 50},
+		{policy: MonitorFailureKeepLast, allowance: 0.5, watermark: 50},
+		{policy: MonitorFailureOpen, allowance: 1, watermark: 50},
+		{policy: MonitorFailureClosed, allowance: 0, watermark: 10},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			t.Parallel()
+			bp := newBackpressure(tt.policy)
+			bp.queryFailed(first)
+			require.Equal(t, 0.5, bp.allowance, "policy waits until every query fails")
+
+			bp.queryFailed(second)
+			require.Equal(t, tt.allowance, bp.allowance)
+			require.Equal(t, tt.watermark, bp.watermark)
+
+			bp.failing.Delete(first)
+			bp.updateThrottle(first, 0)
+			require.Equal(t, 1.0, bp.allowance, "a successful query resumes throttling")
+		})
+	}
+
+	cfg := BackpressureConfig{
+		EnableBackpressure:   true,
+		BackpressureQueries:  []BackpressureQuery{first},
+		CongestionWindowMin:  1,
+		CongestionWindowMax:  10,
+		MonitorFailurePolicy: "sometimes",
+	}
+	require.ErrorIs(t, cfg.Validate(), ErrInvalidMonitorFailurePolicy)
+}
+
+func TestBelowDirection(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{
+		Query:              "free_memory_bytes",
+		WarningThreshold:   100,
+		EmergencyThreshold: 20,
+		Direction:          DirectionBelow,
+	}
+	require.NoError(t, q.Validate())
+	require.Equal(t, 0.0, q.throttlePercent(150))
+	require.Equal(t, 0.0, q.throttlePercent(100))
+	require.Equal(t, 1.0, q.throttlePercent(20))
+	require.Equal(t, 1.0, q.throttlePercent(0))
+
+	above := BackpressureQuery{Query: "used", WarningThreshold: 20, EmergencyThreshold: 100}
+	require.InDelta(t, above.throttlePercent(40), q.throttlePercent(80), 1e-9,
+		"below queries throttle along the same curve as they drop")
+
+	q.EmergencyThreshold = 200
+	require.ErrorIs(t, q.Validate(), ErrEmergencyAboveWarnThreshold)
+
+	q.Direction = "sideways"
+	require.ErrorIs(t, q.Validate(), ErrInvalidDirection)
+}
+
+func TestDynamicThresholds(t *testing.T) {
+	t.Parallel()
+	values := map[string]float64{"load": 60, "capacity * 0.5": 50, "capacity": 100}
+	fetch := func(_ context.Context, _ *http.Client, _, query string) (float64, error) {
+		val, ok := values[query]
+		if !ok {
+			return 0, errors.New("unknown query")
+		}
+		return val, nil
+	}
+	testGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "fake_gauge_dynamic_thresholds"}, bpMetricLabels,
+	)
+	bp := &Backpressure{
+		monitorURLs:    []string{"http://prometheus"},
+		warnGauge:      testGauge,
+		emergencyGauge: testGauge,
+	}
+
+	q := BackpressureQuery{
+		Name:                    "load",
+		Query:                   "load",
+		WarningThresholdQuery:   "capacity * 0.5",
+		EmergencyThresholdQuery: "capacity",
+	}
+	require.NoError(t, q.Validate(), "static thresholds are not checked when dynamic")
+
+	resolved, err := bp.resolveThresholds(context.Background(), q, fetch)
+	require.NoError(t, err)
+	require.Equal(t, 50.0, resolved.WarningThreshold)
+	require.Equal(t, 100.0, resolved.EmergencyThreshold)
+	require.Greater(t, resolved.throttlePercent(60), 0.0)
+
+	values["capacity"] = 40
+	_, err = bp.resolveThresholds(context.Background(), q, fetch)
+	require.ErrorIs(t, err, ErrEmergencyBelowWarnThreshold)
+
+	q.EmergencyThresholdQuery = "missing"
+	_, err = bp.resolveThresholds(context.Background(), q, fetch)
+	require.Error(t, err)
+}
+
+func TestMixedThresholdsValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name  string
+		query BackpressureQuery
+		want  error
+	}{
+		{
+			name:  "dynamic warning",
+			query: BackpressureQuery{WarningThresholdQuery: "slo * 0.5", EmergencyThreshold: 1},
+		},
+		{
+			name:  "dynamic emergency",
+			query: BackpressureQuery{WarningThreshold: 1, EmergencyThresholdQuery: "slo"},
+		},
+		{
+			name:  "negative static emergency",
+			query: BackpressureQuery{WarningThresholdQuery: "slo * 0.5", EmergencyThreshold: -1},
+			want:  ErrNegativeQueryThresholds,
+		},
+		{
+			name:  "negative static warning",
+			query: BackpressureQuery{WarningThreshold: -1, EmergencyThresholdQuery: "slo"},
+			want:  ErrNegativeQueryThresholds,
+		},
+		{
+			name:  "no warning fits below a static emergency of 0",
+			query: BackpressureQuery{WarningThresholdQuery: "slo * 0.5"},
+			want:  ErrEmergencyBelowWarnThreshold,
+		},
+		{
+			name: "dynamic emergency below a static warning",
+			query: BackpressureQuery{
+				WarningThreshold: 100, EmergencyThresholdQuery: "reserve", Direction: DirectionBelow,
+			},
+		},
+		{
+			name: "no emergency fits below a static warning of 0",
+			query: BackpressureQuery{
+				EmergencyThresholdQuery: "reserve", Direction: DirectionBelow,
+			},
+			want: ErrEmergencyAboveWarnThreshold,
+		},
+		{
+			name: "static emergency of 0 below a dynamic warning",
+			query: BackpressureQuery{
+				WarningThresholdQuery: "capacity * 0.2", Direction: DirectionBelow,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			q := tt.query
+			q.Query = "load"
+			require.ErrorIs(t, q.Validate(), tt.want)
+		})
+	}
+}
+
+func TestPollSignals(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		val := "5"
+		if r.FormValue("query") == "errors" {
+			val = "100"
+		}
+		_, _ = io.WriteString(w, `{"status": "success", "data": {"resultType": "vector", "result": [`+
+			`{"metric": {}, "value": [0, "`+val+`"]}]}}`)
+	}))
+	defer srv.Close()
+
+	testGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_gauge_poll_signals"})
+	testGaugeVec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "fake_gauge_vec_poll_signals"}, bpMetricLabels,
+	)
+	pollDuration := prometheus.NewHistogram(
+		prometheus.HistogramOpts{Name: "fake_poll_duration"},
+	)
+	errorsQuery := BackpressureQuery{
+		Name: "errors", Query: "errors", WarningThreshold: 10, EmergencyThreshold: 50,
+	}
+	latencyQuery := BackpressureQuery{
+		Name: "latency", Query: "latency", WarningThreshold: 10, EmergencyThreshold: 50,
+	}
+	bp := &Backpressure{
+		min:            1,
+		max:            10,
+		allowance:      1,
+		monitorClient:  srv.Client(),
+		monitorURLs:    []string{srv.URL},
+		queries:        []BackpressureQuery{errorsQuery, latencyQuery},
+		throttleFlags:  util.NewSyncMap[BackpressureQuery, float64](),
+		failing:        util.NewSyncMap[BackpressureQuery, bool](),
+		queryValGauge:  testGaugeVec,
+		watermarkGauge: testGauge,
+		allowanceGauge: testGauge,
+		pollDuration:   pollDuration,
+		queryDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{Name: "fake_query_duration"}, bpMetricLabels,
+		),
+	}
+
+	bp.pollSignals(context.Background(), []*signal{newSignal(errorsQuery), newSignal(latencyQuery)})
+	require.Equal(t, int32(2), requests.Load())
+	require.Equal(t, 0.0, bp.allowance, "the most restrictive signal wins")
+	require.Equal(t, 1, testutil.CollectAndCount(pollDuration))
+}
@@ -2,29 +2,184 @@ package proxymw
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"regexp"
+	"slices"
 	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kevindweb/throttle-proxy/internal/util"
 )
 
 const (
 	BlockerProxyType = "blocker"
 )
 
+var defaultBlockerMetrics = newBlockerMetrics(defaultMetricsFactory)
+
+// blockerMetrics are the collectors of the Blocker of one middleware chain
+type blockerMetrics struct {
+	patternBlocks *prometheus.CounterVec
+}
+
+func newBlockerMetrics(factory promauto.Factory) *blockerMetrics {
+	return &blockerMetrics{
+		patternBlocks: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_blocker_pattern_blocks_total",
+			Help: "Requests blocked by each block pattern",
+		}, []string{"target", "pattern"}),
+	}
+}
+
+const (
+	// BlockPathTarget matches block patterns against the request path. Ex. `:path=^/api/v1/series`
+	BlockPathTarget = ":path"
+	// BlockParamPrefix matches block patterns against a query or form parameter.
+	// Ex. `param:query=.*label_replace.*`
+	BlockParamPrefix = "param:"
+)
+
+type blockTargetKind int
+
+const (
+	blockHeader blockTargetKind = iota
+	blockParam
+	blockPath
+)
+
+// blockTarget is the part of the request a block pattern is evaluated against
+type blockTarget struct {
+	kind blockTargetKind
+	name string
+}
+
+func parseBlockTarget(key string) (blockTarget, error) {
+	switch {
+	case key == BlockPathTarget:
+		return blockTarget{kind: blockPath}, nil
+	case strings.HasPrefix(key, BlockParamPrefix):
+		name := strings.TrimPrefix(key, BlockParamPrefix)
+		if name == "" {
+			return blockTarget{}, fmt.Errorf("param is empty for target %q", key)
+		}
+		return blockTarget{kind: blockParam, name: name}, nil
+	case key == "":
+		return blockTarget{}, errors.New("header is empty")
+	default:
+		return blockTarget{kind: blockHeader, name: http.CanonicalHeaderKey(key)}, nil
+	}
+}
+
+func (t blockTarget) String() string {
+	switch t.kind {
+	case blockParam:
+		return "param " + t.name
+	case blockPath:
+		return "path"
+	default:
+		return "header " + t.name
+	}
+}
+
+// values returns the request values the target matches against. Form values are parsed from a
+// duplicate request so the upstream still receives the original body.
+func (t blockTarget) values(req *http.Request, form func() url.Values) []string {
+	switch t.kind {
+	case blockParam:
+		return form()[t.name]
+	case blockPath:
+		return []string{req.URL.Path}
+	default:
+		return req.Header[t.name]
+	}
+}
+
 type BlockerConfig struct {
 	EnableBlocker bool `yaml:"enable_blocker"`
-	// BlockPatterns is a list of header values to block and looks like `<header>=<pattern>`.
-	// Ex. `X-user-agent=service-to-block.*`
+	// BlockPatterns is a list of request values to block and looks like `<target>=<pattern>`.
+	// The target is a header name, `param:<name>` for query or form parameters, or `:path`.
+	// Ex. `X-user-agent=service-to-block.*` or `param:query=.*label_replace.*`
 	BlockPatterns []string `yaml:"block_patterns"`
+	// DenyQueryPatterns are regexes matched against the raw PromQL of the query parameter, e.g.
+	// `label_replace\(` or `__name__=~"\.[*+]"`. Shorthand for `param:query=<regex>` patterns.
+	DenyQueryPatterns []string `yaml:"deny_query_patterns"`
+	// DecisionCacheSize caches the block decision for that many target values so repeated
+	// values skip regex evaluation. Disabled when 0.
+	DecisionCacheSize int `yaml:"decision_cache_size"`
+	// BlockCIDRs rejects requests from clients within these IPs or CIDRs
+	BlockCIDRs []string `yaml:"block_cidrs"`
+	// AllowCIDRs exempts clients within these IPs or CIDRs from every block rule
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	// TrustedProxies are the IPs or CIDRs of load balancers whose X-Forwarded-For is trusted
+	// when resolving the client IP. The resolved IP is also used by the RateLimiter and AccessLog
+	// whether or not the Blocker is enabled.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 func (q BlockerConfig) Validate() error {
-	return ValidateBlockPatterns(q.BlockPatterns)
+	if q.DecisionCacheSize < 0 {
+		return fmt.Errorf("decision cache size cannot be negative: %d", q.DecisionCacheSize)
+	}
+
+	for _, cidrs := range [][]string{q.BlockCIDRs, q.AllowCIDRs, q.TrustedProxies} {
+		if _, err := ParsePrefixes(cidrs); err != nil {
+			return err
+		}
+	}
+	return ValidateBlockPatterns(q.patterns())
+}
+
+// patterns returns the block patterns including the query denylist
+func (q BlockerConfig) patterns() []string {
+	patterns := slices.Clone(q.BlockPatterns)
+	for _, pattern := range q.DenyQueryPatterns {
+		patterns = append(patterns, BlockParamPrefix+"query="+pattern)
+	}
+	return patterns
+}
+
+// targetPatterns groups every pattern for a target behind one combined regex so a value that
+// matches nothing is rejected with a single evaluation.
+type targetPatterns struct {
+	target   blockTarget
+	combined *regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// match returns the first pattern matching the value or nil
+func (tp targetPatterns) match(val string) *regexp.Regexp {
+	if !tp.combined.MatchString(val) {
+		return nil
+	}
+
+	for _, regex := range tp.patterns {
+		if regex.MatchString(val) {
+			return regex
+		}
+	}
+	return nil
+}
+
+type blockDecision struct {
+	target blockTarget
+	value  string
 }
 
 type Blocker struct {
-	patterns map[string]*regexp.Regexp
-	client   ProxyClient
+	blockCIDRs     []netip.Prefix
+	allowCIDRs     []netip.Prefix
+	trustedProxies []netip.Prefix
+	patterns       []targetPatterns
+	// decisions maps a target value to the pattern that blocked it, or nil when allowed
+	decisions     *util.LRU[blockDecision, *regexp.Regexp]
+	patternBlocks *prometheus.CounterVec
+	client        ProxyClient
 }
 
 var _ ProxyClient = &Blocker{}
@@ -33,7 +188,7 @@ func ValidateBlockPatterns(patterns []string) error {
 	for _, pattern := range patterns {
 		patternParts := strings.SplitN(pattern, "=", 2)
 		if len(patternParts) != 2 {
-			return fmt.Errorf("pattern %q did not match `<header>=<regex>`", pattern)
+			return fmt.Errorf("pattern %q did not match `<target>=<regex>`", pattern)
 		}
 
 		_, err := regexp.Compile(patternParts[1])
@@ -41,38 +196,112 @@ func ValidateBlockPatterns(patterns []string) error {
 			return err
 		}
 
-		if patternParts[0] == "" {
-			return fmt.Errorf("header is empty for pattern %q", pattern)
+		if _, err := parseBlockTarget(patternParts[0]); err != nil {
+			return fmt.Errorf("%s for pattern %q", err.Error(), pattern)
 		}
 	}
 	return nil
 }
 
 func NewBlocker(client ProxyClient, cfg BlockerConfig) *Blocker {
-	blockPatterns := map[string]*regexp.Regexp{}
-	for _, pattern := range cfg.BlockPatterns {
+	return newBlocker(client, cfg, defaultBlockerMetrics)
+}
+
+func newBlocker(client ProxyClient, cfg BlockerConfig, m *blockerMetrics) *Blocker {
+	grouped := map[blockTarget][]string{}
+	targets := []blockTarget{}
+	for _, pattern := range cfg.patterns() {
 		patternParts := strings.SplitN(pattern, "=", 2)
-		blockPatterns[patternParts[0]] = regexp.MustCompile(patternParts[1])
+		target, _ := parseBlockTarget(patternParts[0])
+		if _, ok := grouped[target]; !ok {
+			targets = append(targets, target)
+		}
+		grouped[target] = append(grouped[target], patternParts[1])
 	}
+
+	patterns := make([]targetPatterns, 0, len(targets))
+	for _, target := range targets {
+		tp := targetPatterns{target: target}
+		alternatives := make([]string, 0, len(grouped[target]))
+		for _, pattern := range grouped[target] {
+			tp.patterns = append(tp.patterns, regexp.MustCompile(pattern))
+			alternatives = append(alternatives, "(?:"+pattern+")")
+			// export zeros so alerts on a pattern work before it first blocks
+			m.patternBlocks.WithLabelValues(target.String(), pattern)
+		}
+		tp.combined = regexp.MustCompile(strings.Join(alternatives, "|"))
+		patterns = append(patterns, tp)
+	}
+
+	var decisions *util.LRU[blockDecision, *regexp.Regexp]
+	if cfg.DecisionCacheSize > 0 {
+		decisions = util.NewLRU[blockDecision, *regexp.Regexp](cfg.DecisionCacheSize)
+	}
+
+	blockCIDRs, _ := ParsePrefixes(cfg.BlockCIDRs)
+	allowCIDRs, _ := ParsePrefixes(cfg.AllowCIDRs)
+	trustedProxies, _ := ParsePrefixes(cfg.TrustedProxies)
 	return &Blocker{
-		patterns: blockPatterns,
-		client:   client,
+		blockCIDRs:     blockCIDRs,
+		allowCIDRs:     allowCIDRs,
+		trustedProxies: trustedProxies,
+		patterns:       patterns,
+		decisions:      decisions,
+		patternBlocks:  m.patternBlocks,
+		client:         client,
 	}
 }
 
-func (b *Blocker) Init(ctx context.Context) {
-	b.client.Init(ctx)
+func (b *Blocker) Init(ctx context.Context) error {
+	return b.client.Init(ctx)
 }
 
 func (b *Blocker) Next(rr Request) error {
-	headers := rr.Request().Header
-	for header, regex := range b.patterns {
-		for _, val := range headers[header] {
-			if regex.MatchString(val) {
-				msg := "header %s, value %s blocked by regex %s"
-				return BlockErr(BlockerProxyType, msg, header, val, regex.String())
+	req := rr.Request()
+	if len(b.blockCIDRs) > 0 || len(b.allowCIDRs) > 0 {
+		if ip, ok := requestClientIP(req, b.trustedProxies); ok {
+			if _, allowed := matchPrefix(b.allowCIDRs, ip); allowed {
+				return b.client.Next(rr)
+			}
+
+			if prefix, blocked := matchPrefix(b.blockCIDRs, ip); blocked {
+				return BlockErr(BlockerProxyType, "client ip %s blocked by cidr %s", ip, prefix)
+			}
+		}
+	}
+
+	var form url.Values
+	parseForm := func() url.Values {
+		if form == nil {
+			form = requestForm(req)
+		}
+		return form
+	}
+
+	for _, tp := range b.patterns {
+		for _, val := range tp.target.values(req, parseForm) {
+			if regex := b.decide(tp, val); regex != nil {
+				b.patternBlocks.WithLabelValues(tp.target.String(), regex.String()).Inc()
+				msg := "%s, value %s blocked by regex %s"
+				return BlockErr(BlockerProxyType, msg, tp.target, val, regex.String())
 			}
 		}
 	}
 	return b.client.Next(rr)
 }
+
+// decide returns the pattern blocking the target value, consulting the decision cache first
+func (b *Blocker) decide(tp targetPatterns, val string) *regexp.Regexp {
+	if b.decisions == nil {
+		return tp.match(val)
+	}
+
+	key := blockDecision{target: tp.target, value: val}
+	if regex, ok := b.decisions.Get(key); ok {
+		return regex
+	}
+
+	regex := tp.match(val)
+	b.decisions.Add(key, regex)
+	return regex
+}
@@ -3,9 +3,14 @@ package proxymw_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	"github.com/kevindweb/throttle-proxy/proxymw"
@@ -40,6 +45,20 @@ func TestBlockPatternValidation(t *testing.T) {
 			},
 			want: errors.New(`header is empty for pattern "=value.*here"`),
 		},
+		{
+			name: "path and param targets",
+			patterns: []string{
+				`:path=^/api/v1/series`,
+				`param:query=.*label_replace.*`,
+			},
+		},
+		{
+			name: "no param name",
+			patterns: []string{
+				`param:=.*`,
+			},
+			want: errors.New(`param is empty for target "param:" for pattern "param:=.*"`),
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
@@ -100,6 +119,106 @@ func TestBlocker(t *testing.T) {
 				"header X-User-Agent, value service1 blocked by regex service.*",
 			),
 		},
+		{
+			name: "multiple patterns per header with cache",
+			req: &proxymw.Mocker{
+				RequestFunc: func() *http.Request {
+					ctx := context.Background()
+					r, err := http.NewRequestWithContext(
+						ctx, http.MethodGet, "http://google.com", http.NoBody,
+					)
+					require.NoError(t, err)
+					r.Header.Add("X-User-Agent", "batch-job")
+					return r
+				},
+			},
+			cfg: proxymw.BlockerConfig{
+				EnableBlocker: true,
+				BlockPatterns: []string{
+					`x-user-agent=service.*`,
+					`X-User-Agent=batch-.*`,
+				},
+				DecisionCacheSize: 10,
+			},
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType,
+				"header X-User-Agent, value batch-job blocked by regex batch-.*",
+			),
+		},
+		{
+			name: "query param blocked",
+			req: &proxymw.Mocker{
+				RequestFunc: func() *http.Request {
+					r, err := http.NewRequestWithContext(
+						context.Background(),
+						http.MethodGet,
+						"http://google.com/api/v1/query?query="+
+							url.QueryEscape(`label_replace(up, "a", "$1", "b", "(.*)")`),
+						http.NoBody,
+					)
+					require.NoError(t, err)
+					return r
+				},
+			},
+			cfg: proxymw.BlockerConfig{
+				EnableBlocker: true,
+				BlockPatterns: []string{
+					`param:query=.*label_replace.*`,
+				},
+			},
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType,
+				`param query, value label_replace(up, "a", "$1", "b", "(.*)") blocked by regex .*label_replace.*`,
+			),
+		},
+		{
+			name: "form body param blocked",
+			req: &proxymw.Mocker{
+				RequestFunc: func() *http.Request {
+					r, err := http.NewRequestWithContext(
+						context.Background(),
+						http.MethodPost,
+						"http://google.com/api/v1/query",
+						strings.NewReader(url.Values{"query": []string{`{__name__=~".*"}`}}.Encode()),
+					)
+					require.NoError(t, err)
+					r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					return r
+				},
+			},
+			cfg: proxymw.BlockerConfig{
+				EnableBlocker: true,
+				BlockPatterns: []string{
+					`param:query=__name__=~"\.\*"`,
+				},
+			},
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType,
+				`param query, value {__name__=~".*"} blocked by regex __name__=~"\.\*"`,
+			),
+		},
+		{
+			name: "path blocked",
+			req: &proxymw.Mocker{
+				RequestFunc: func() *http.Request {
+					r, err := http.NewRequestWithContext(
+						context.Background(), http.MethodGet, "http://google.com/api/v1/series", http.NoBody,
+					)
+					require.NoError(t, err)
+					return r
+				},
+			},
+			cfg: proxymw.BlockerConfig{
+				EnableBlocker: true,
+				BlockPatterns: []string{
+					`:path=^/api/v1/series$`,
+				},
+			},
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType,
+				"path, value /api/v1/series blocked by regex ^/api/v1/series$",
+			),
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
@@ -108,6 +227,167 @@ func TestBlocker(t *testing.T) {
 			}
 			blocker := proxymw.NewBlocker(client, tt.cfg)
 			require.Equal(t, tt.want, blocker.Next(tt.req))
+			// cached decisions must match the uncached result
+			require.Equal(t, tt.want, blocker.Next(tt.req))
+		})
+	}
+}
+
+func TestBlockerCIDRs(t *testing.T) {
+	t.Parallel()
+	cfg := proxymw.BlockerConfig{
+		EnableBlocker:  true,
+		BlockPatterns:  []string{`X-User-Agent=bad-.*`},
+		BlockCIDRs:     []string{"10.1.0.0/16"},
+		AllowCIDRs:     []string{"10.1.2.3", "10.2.0.0/16"},
+		TrustedProxies: []string{"192.168.0.1"},
+	}
+	require.NoError(t, cfg.Validate())
+
+	invalid := cfg
+	invalid.BlockCIDRs = []string{"10.1.0.0/99"}
+	require.Error(t, invalid.Validate())
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		userAgent  string
+		want       error
+	}{
+		{
+			name:       "unlisted client",
+			remoteAddr: "10.3.0.1:1234",
+		},
+		{
+			name:       "blocked client",
+			remoteAddr: "10.1.9.9:1234",
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType, "client ip 10.1.9.9 blocked by cidr 10.1.0.0/16",
+			),
+		},
+		{
+			name:       "allowlisted client within blocked cidr",
+			remoteAddr: "10.1.2.3:1234",
+		},
+		{
+			name:       "allowlisted client skips header patterns",
+			remoteAddr: "10.2.0.5:1234",
+			userAgent:  "bad-service",
+		},
+		{
+			name:       "blocked client behind trusted proxy",
+			remoteAddr: "192.168.0.1:80",
+			forwarded:  "10.1.9.9",
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType, "client ip 10.1.9.9 blocked by cidr 10.1.0.0/16",
+			),
+		},
+		{
+			name:       "forwarded for ignored from untrusted peer",
+			remoteAddr: "10.3.0.1:1234",
+			forwarded:  "10.1.2.3",
+			userAgent:  "bad-service",
+			want: proxymw.BlockErr(
+				proxymw.BlockerProxyType,
+				"header X-User-Agent, value bad-service blocked by regex bad-.*",
+			),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := &proxymw.Mocker{
+				RequestFunc: func() *http.Request {
+					r, err := http.NewRequestWithContext(
+						context.Background(), http.MethodGet, "http://google.com", http.NoBody,
+					)
+					require.NoError(t, err)
+					r.RemoteAddr = tt.remoteAddr
+					if tt.forwarded != "" {
+						r.Header.Set(proxymw.HeaderForwardedFor, tt.forwarded)
+					}
+					if tt.userAgent != "" {
+						r.Header.Set("X-User-Agent", tt.userAgent)
+					}
+					return r
+				},
+			}
+			client := &proxymw.Mocker{
+				NextFunc: func(_ proxymw.Request) error { return nil },
+			}
+			require.Equal(t, tt.want, proxymw.NewBlocker(client, cfg).Next(req))
+		})
+	}
+}
+
+func TestDenyQueryPatterns(t *testing.T) {
+	t.Parallel()
+	reg := prometheus.NewRegistry()
+	cfg := proxymw.Config{
+		BlockerConfig: proxymw.BlockerConfig{
+			EnableBlocker:     true,
+			DenyQueryPatterns: []string{`label_replace\(`, `__name__=~"\.[*+]"`},
+		},
+		MetricsConfig: proxymw.MetricsConfig{MetricsRegistry: reg},
+	}
+	require.NoError(t, cfg.Validate())
+	require.Error(t, proxymw.BlockerConfig{DenyQueryPatterns: []string{"("}}.Validate())
+
+	client, err := proxymw.NewChainBuilder(cfg).Build(&proxymw.Mocker{
+		NextFunc: func(proxymw.Request) error { return nil },
+	})
+	require.NoError(t, err)
+
+	request := func(query string) proxymw.Request {
+		u := "http://prometheus/api/v1/query?" + url.Values{"query": {query}}.Encode()
+		r, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u, http.NoBody)
+		require.NoError(t, err)
+		return &proxymw.Mocker{RequestFunc: func() *http.Request { return r }}
+	}
+
+	require.NoError(t, client.Next(request(`sum(rate(http_requests_total[5m]))`)))
+	require.EqualError(t,
+		client.Next(request(`count({__name__=~".+"})`)),
+		`param query, value count({__name__=~".+"}) blocked by regex __name__=~"\.[*+]"`,
+	)
+	require.Error(t, client.Next(request(`label_replace(up, "a", "$1", "b", "(.*)")`)))
+	require.Error(t, client.Next(request(`label_replace(up, "a", "$1", "b", "(.*)")`)))
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxymw_blocker_pattern_blocks_total Requests blocked by each block pattern
+# TYPE proxymw_blocker_pattern_blocks_total counter
+proxymw_blocker_pattern_blocks_total{pattern="__name__=~\"\\.[*+]\"",target="param query"} 1
+proxymw_blocker_pattern_blocks_total{pattern="label_replace\\(",target="param query"} 2
+`), "proxymw_blocker_pattern_blocks_total"))
+}
+
+func BenchmarkBlocker(b *testing.B) {
+	patterns := make([]string, 0, 500)
+	for i := range 500 {
+		patterns = append(patterns, fmt.Sprintf("X-User-Agent=bad-service-%d-.*", i))
+	}
+
+	r, err := http.NewRequestWithContext(
+		context.Background(), http.MethodGet, "http://google.com", http.NoBody,
+	)
+	require.NoError(b, err)
+	r.Header.Add("X-User-Agent", "grafana-dashboard")
+	rr := &proxymw.Mocker{RequestFunc: func() *http.Request { return r }}
+	client := &proxymw.Mocker{NextFunc: func(_ proxymw.Request) error { return nil }}
+
+	for _, cacheSize := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("cache_size_%d", cacheSize), func(b *testing.B) {
+			blocker := proxymw.NewBlocker(client, proxymw.BlockerConfig{
+				EnableBlocker:     true,
+				BlockPatterns:     patterns,
+				DecisionCacheSize: cacheSize,
+			})
+			b.ResetTimer()
+			for range b.N {
+				if err := blocker.Next(rr); err != nil {
+					b.Fatal(err)
+				}
+			}
 		})
 	}
 }
@@ -0,0 +1,52 @@
+package proxymw
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// MaxPooledBodySize caps the buffers returned to the pool so one large request body does not
+// pin its memory for the life of the process
+const MaxPooledBodySize = 1 << 20
+
+var bodyBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// bufferedBody holds a request body read into a pooled buffer. Duplicates of the request read
+// the same bytes instead of copying the body again. The buffer returns to the pool once the
+// upstream closes the body, so duplicates must be read before the request is forwarded.
+type bufferedBody struct {
+	*bytes.Reader
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+func newBufferedBody(body io.Reader) (*bufferedBody, error) {
+	buf, _ := bodyBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.ReadFrom(body); err != nil {
+		releaseBodyBuffer(buf)
+		return nil, err
+	}
+
+	return &bufferedBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}, nil
+}
+
+// reader returns a new reader over the whole body
+func (b *bufferedBody) reader() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(b.buf.Bytes()))
+}
+
+func (b *bufferedBody) Close() error {
+	b.once.Do(func() { releaseBodyBuffer(b.buf) })
+	return nil
+}
+
+func releaseBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > MaxPooledBodySize {
+		return
+	}
+	bodyBufferPool.Put(buf)
+}
@@ -0,0 +1,49 @@
+package proxymw
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDupRequestSharesBody(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("query=up"))
+
+	for range 3 {
+		dup, err := DupRequest(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(dup.Body)
+		require.NoError(t, err)
+		require.Equal(t, "query=up", string(body))
+	}
+
+	// the body is buffered once and the upstream still reads all of it
+	buffered, ok := req.Body.(*bufferedBody)
+	require.True(t, ok)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, "query=up", string(body))
+	require.NoError(t, buffered.Close())
+	require.NoError(t, buffered.Close())
+
+	dup, err := DupRequest(httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody))
+	require.NoError(t, err)
+	require.Equal(t, http.NoBody, dup.Body)
+}
+
+func TestReleaseBodyBuffer(t *testing.T) {
+	t.Parallel()
+	large := bytes.NewBuffer(make([]byte, 0, MaxPooledBodySize+1))
+	releaseBodyBuffer(large)
+
+	for range 10 {
+		buf, _ := bodyBufferPool.Get().(*bytes.Buffer)
+		require.NotSame(t, large, buf)
+	}
+}
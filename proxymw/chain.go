@@ -0,0 +1,537 @@
+package proxymw
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+)
+
+// MiddlewareFunc wraps the next ProxyClient of a chain
+type MiddlewareFunc func(next ProxyClient) ProxyClient
+
+// stage is a named MiddlewareFunc of a ChainBuilder
+type stage struct {
+	name  string
+	build func(next ProxyClient) (ProxyClient, error)
+}
+
+// chainOrderRules lists the stages each built-in must wrap when both are in a chain.
+// The Observer, AccessLog, Recorder, Audit, and TenantStats record blocked requests so they wrap
+// every stage that blocks.
+var chainOrderRules = map[string][]string{
+	AuditProxyType: {
+		TimeoutProxyType,
+		BlockerProxyType,
+		GuardrailProxyType,
+		RateLimitProxyType,
+		FingerprintLimitProxyType,
+		TenantConcurrencyProxyType,
+		QuotaProxyType,
+		RemoteWriteProxyType,
+		JitterProxyType,
+		WarmupProxyType,
+		AdaptiveLimitProxyType,
+		BackpressureProxyType,
+	},
+	AccessLogProxyType: {
+		TimeoutProxyType,
+		BlockerProxyType,
+		GuardrailProxyType,
+		RateLimitProxyType,
+		FingerprintLimitProxyType,
+		TenantConcurrencyProxyType,
+		QuotaProxyType,
+		RemoteWriteProxyType,
+		JitterProxyType,
+		WarmupProxyType,
+		AdaptiveLimitProxyType,
+		BackpressureProxyType,
+	},
+	RecorderProxyType: {
+		TimeoutProxyType,
+		BlockerProxyType,
+		GuardrailProxyType,
+		RateLimitProxyType,
+		FingerprintLimitProxyType,
+		TenantConcurrencyProxyType,
+		QuotaProxyType,
+		RemoteWriteProxyType,
+		JitterProxyType,
+		WarmupProxyType,
+		AdaptiveLimitProxyType,
+		BackpressureProxyType,
+	},
+	TenantStatsProxyType: {
+		BlockerProxyType,
+		GuardrailProxyType,
+		RateLimitProxyType,
+		FingerprintLimitProxyType,
+		TenantConcurrencyProxyType,
+		QuotaProxyType,
+		RemoteWriteProxyType,
+		JitterProxyType,
+		WarmupProxyType,
+		AdaptiveLimitProxyType,
+		BackpressureProxyType,
+	},
+}
+
+// ChainBuilder assembles a middleware chain from the built-ins enabled in Config and custom
+// middlewares. Stages are ordered outermost first: the first stage receives every request and
+// the last wraps the exit. Errors from positioning calls are reported by Build.
+type ChainBuilder struct {
+	stages []stage
+	errs   []error
+	// trustedProxies resolve the client IP at the entry of the built chain
+	trustedProxies []netip.Prefix
+	// maintenance is the mode the entry of the built chain switches to on Init
+	maintenance MaintenanceConfig
+	// tenantHeader identifies the tenant of requests listed in flight by the entry
+	tenantHeader string
+	// cfg describes the stages of the built chain
+	cfg Config
+	// costs estimate the query cost of requests in the built chain
+	costs chainCosts
+	// private keeps the built chain out of the process-wide handlers, like introspection,
+	// readiness, quotas, and audits, which serve the main chain of the process
+	private bool
+}
+
+// NewChainBuilder starts from the enabled built-ins in the order used by NewFromConfig
+func NewChainBuilder(cfg Config) *ChainBuilder {
+	metrics := cfg.metrics()
+	trustedProxies, _ := ParsePrefixes(cfg.TrustedProxies)
+	cb := &ChainBuilder{
+		trustedProxies: trustedProxies,
+		maintenance:    cfg.MaintenanceConfig,
+		tenantHeader:   cfg.TenantStatsConfig.header(),
+		cfg:            cfg,
+	}
+	// bp is the Backpressure of this chain, which the remote-write limiter scales its rate by
+	var bp *Backpressure
+
+	if cfg.EnableQueryCostCache {
+		cb.costs.cache = newQueryCostCache(cfg.QueryCostCacheConfig, metrics.costCache)
+	}
+
+	if cfg.EnableObserver {
+		cb.Use(ObserverProxyType, func(next ProxyClient) ProxyClient {
+			observer := newObserver(next, metrics.observer)
+			if cfg.EnableObserverPathLabels {
+				observer = newObserverWithPathLabels(
+					next, cfg.observerPathTemplates(), metrics.observer,
+				)
+			}
+			observer.exemplars = cfg.EnableExemplars
+			return observer
+		})
+	}
+
+	if cfg.EnableAccessLog {
+		cb.add(len(cb.stages), AccessLogProxyType, func(next ProxyClient) (ProxyClient, error) {
+			return NewAccessLog(next, cfg.AccessLogConfig)
+		})
+	}
+
+	if cfg.EnableRecording {
+		cb.add(len(cb.stages), RecorderProxyType, func(next ProxyClient) (ProxyClient, error) {
+			r, err := NewRecorder(next, cfg.RecordConfig)
+			if err != nil {
+				return nil, err
+			}
+			r.clock, r.rand = cfg.Clock, cfg.Rand
+			return r, nil
+		})
+	}
+
+	if cfg.EnableAudit {
+		cb.Use(AuditProxyType, func(next ProxyClient) ProxyClient {
+			a := NewAudit(next, cfg.AuditConfig)
+			publish(cb, &activeAudit, a)
+			return a
+		})
+	}
+
+	if cfg.EnableTimeouts || cfg.EnableDeadlineHeaders {
+		cb.Use(TimeoutProxyType, func(next ProxyClient) ProxyClient {
+			return NewTimeout(next, cfg.TimeoutConfig, cfg.ClientTimeout)
+		})
+	}
+
+	if cfg.EnableTenantStats {
+		cb.Use(TenantStatsProxyType, func(next ProxyClient) ProxyClient {
+			// private chains aggregate their own tenants instead of the ones TenantSummaryHandler serves
+			aggregator := tenantAggregator
+			if cb.private {
+				aggregator = NewTenantAggregator(cfg.TenantStatsConfig.window(), cfg.topFingerprints())
+			} else {
+				aggregator.Resize(cfg.TenantStatsConfig.window(), cfg.topFingerprints())
+			}
+			return NewTenantStats(next, cfg.TenantStatsConfig, aggregator)
+		})
+	}
+
+	if cfg.EnableBlocker {
+		cb.Use(BlockerProxyType, func(next ProxyClient) ProxyClient {
+			return newBlocker(next, cfg.BlockerConfig, metrics.blocker)
+		})
+	}
+
+	if cfg.EnableGuardrails {
+		cb.Use(GuardrailProxyType, func(next ProxyClient) ProxyClient {
+			return NewGuardrail(next, cfg.GuardrailConfig)
+		})
+	}
+
+	if cfg.EnableRateLimit {
+		cb.Use(RateLimitProxyType, func(next ProxyClient) ProxyClient {
+			return NewRateLimiterWithStore(
+				next, cfg.RateLimitConfig, cfg.RateLimitConfig.store(metrics.rateLimit),
+			)
+		})
+	}
+
+	if cfg.EnableFingerprintLimit {
+		cb.Use(FingerprintLimitProxyType, func(next ProxyClient) ProxyClient {
+			return NewFingerprintLimiter(next, cfg.FingerprintLimitConfig)
+		})
+	}
+
+	if cfg.EnableTenantConcurrency {
+		cb.Use(TenantConcurrencyProxyType, func(next ProxyClient) ProxyClient {
+			return NewTenantConcurrencyLimiter(next, cfg.TenantConcurrencyConfig)
+		})
+	}
+
+	if cfg.EnableQuotas {
+		cb.Use(QuotaProxyType, func(next ProxyClient) ProxyClient {
+			q := newQuota(next, cfg.QuotaConfig, metrics.quota)
+			publish(cb, &activeQuota, q)
+			return q
+		})
+	}
+
+	if cfg.EnableRemoteWriteLimit {
+		cb.Use(RemoteWriteProxyType, func(next ProxyClient) ProxyClient {
+			rw := newRemoteWriteLimiter(next, cfg.RemoteWriteConfig, metrics.remoteWrite)
+			if cfg.EnableBackpressure {
+				rw.allowance = func() float64 { return chainAllowance(bp) }
+			}
+			return rw
+		})
+	}
+
+	if cfg.EnableJitter {
+		cb.Use(JitterProxyType, func(next ProxyClient) ProxyClient {
+			j := NewJittererWithStrategy(
+				next, cfg.JitterDelay, cfg.EnableCriticality, cfg.JitterStrategy, cfg.JitterStddev,
+			)
+			j.clock, j.rand = cfg.Clock, cfg.Rand
+			return j
+		})
+	}
+
+	if cfg.EnableWarmup {
+		cb.Use(WarmupProxyType, func(next ProxyClient) ProxyClient {
+			wl := newWarmupLimiter(next, cfg.WarmupConfig, metrics.warmup)
+			wl.now = orSystemClock(cfg.Clock).Now
+			return wl
+		})
+	}
+
+	if cfg.EnableAdaptiveLimit {
+		cb.Use(AdaptiveLimitProxyType, func(next ProxyClient) ProxyClient {
+			al := newAdaptiveLimiter(next, cfg.AdaptiveLimitConfig, metrics.adaptiveLimit)
+			al.now = orSystemClock(cfg.Clock).Now
+			return al
+		})
+	}
+
+	if cfg.EnableBackpressure {
+		cb.Use(BackpressureProxyType, func(next ProxyClient) ProxyClient {
+			bp = newBackpressure(next, cfg.BackpressureConfig, metrics.backpressure)
+			bp.useClock(cfg.Clock, cfg.Rand)
+			publish(cb, &activeBackpressure, bp)
+			return bp
+		})
+	}
+
+	if cfg.EnableCostFeedback {
+		cb.Use(CostFeedbackProxyType, func(next ProxyClient) ProxyClient {
+			cb.costs.model = NewCostModel(cfg.CostFeedbackConfig)
+			return NewCostFeedback(next, cb.costs.model)
+		})
+	}
+
+	if cfg.EnableLabelInjection {
+		cb.Use(LabelInjectorProxyType, func(next ProxyClient) ProxyClient {
+			return NewLabelInjector(next, cfg.LabelInjectorConfig)
+		})
+	}
+
+	if cfg.EnableStepAlignment {
+		cb.Use(StepAlignProxyType, func(next ProxyClient) ProxyClient {
+			return newStepAligner(next, metrics.stepAlign)
+		})
+	}
+
+	if cfg.EnableMirror {
+		cb.Use(MirrorProxyType, func(next ProxyClient) ProxyClient {
+			mr := newMirror(next, cfg.MirrorConfig, metrics.mirror)
+			mr.rand = cfg.Rand
+			return mr
+		})
+	}
+
+	if cfg.EnableSharding {
+		cb.Use(ShardProxyType, func(next ProxyClient) ProxyClient {
+			return NewSharder(next, cfg.ShardConfig)
+		})
+	}
+
+	if cfg.EnableRetry {
+		cb.Use(RetryProxyType, func(next ProxyClient) ProxyClient {
+			r := newRetrier(next, cfg.RetryConfig, metrics.retry)
+			r.clock, r.rand = cfg.Clock, cfg.Rand
+			return r
+		})
+	}
+
+	if cfg.EnableChaos {
+		cb.Use(ChaosProxyType, func(next ProxyClient) ProxyClient {
+			ci := newChaosInjector(next, cfg.ChaosConfig, metrics.chaos)
+			ci.clock, ci.rand = cfg.Clock, cfg.Rand
+			return ci
+		})
+	}
+
+	for _, mw := range cfg.Middlewares {
+		cb.add(len(cb.stages), mw.Type, mw.stageBuilder())
+	}
+
+	if len(cfg.MiddlewareOrder) > 0 {
+		if err := validateMiddlewareOrder(cfg.MiddlewareOrder); err != nil {
+			return cb.fail(err)
+		}
+		reorder(cb.stages, func(s stage) string { return s.name }, cfg.MiddlewareOrder)
+	}
+	return cb
+}
+
+// Names returns the stage names outermost first
+func (cb *ChainBuilder) Names() []string {
+	names := make([]string, len(cb.stages))
+	for i, s := range cb.stages {
+		names[i] = s.name
+	}
+	return names
+}
+
+// Use appends the middleware as the innermost stage
+func (cb *ChainBuilder) Use(name string, mw MiddlewareFunc) *ChainBuilder {
+	return cb.insert(len(cb.stages), name, mw)
+}
+
+// InsertBefore adds the middleware as the stage wrapping the target stage
+func (cb *ChainBuilder) InsertBefore(target, name string, mw MiddlewareFunc) *ChainBuilder {
+	if i := cb.indexOf(target); i >= 0 {
+		return cb.insert(i, name, mw)
+	}
+	return cb.fail(fmt.Errorf("%w: %s", ErrUnknownMiddleware, target))
+}
+
+// InsertAfter adds the middleware as the stage wrapped by the target stage
+func (cb *ChainBuilder) InsertAfter(target, name string, mw MiddlewareFunc) *ChainBuilder {
+	if i := cb.indexOf(target); i >= 0 {
+		return cb.insert(i+1, name, mw)
+	}
+	return cb.fail(fmt.Errorf("%w: %s", ErrUnknownMiddleware, target))
+}
+
+// Remove drops the named stage
+func (cb *ChainBuilder) Remove(name string) *ChainBuilder {
+	if i := cb.indexOf(name); i >= 0 {
+		cb.stages = slices.Delete(cb.stages, i, i+1)
+		return cb
+	}
+	return cb.fail(fmt.Errorf("%w: %s", ErrUnknownMiddleware, name))
+}
+
+// Order reorders the stages outermost first. Every stage must be named exactly once.
+func (cb *ChainBuilder) Order(names ...string) *ChainBuilder {
+	if len(names) != len(cb.stages) {
+		return cb.fail(fmt.Errorf(
+			"%w: order names %d of %d stages", ErrInvalidMiddlewareOrder, len(names), len(cb.stages),
+		))
+	}
+
+	ordered := make([]stage, 0, len(names))
+	for _, name := range names {
+		i := cb.indexOf(name)
+		if i < 0 {
+			return cb.fail(fmt.Errorf("%w: %s", ErrUnknownMiddleware, name))
+		}
+		if slices.ContainsFunc(ordered, func(s stage) bool { return s.name == name }) {
+			return cb.fail(fmt.Errorf("%w: %s", ErrDuplicateMiddleware, name))
+		}
+		ordered = append(ordered, cb.stages[i])
+	}
+	cb.stages = ordered
+	return cb
+}
+
+// Validate reports positioning errors and orders which break the built-in middlewares
+func (cb *ChainBuilder) Validate() error {
+	if len(cb.errs) > 0 {
+		return cb.errs[0]
+	}
+	return validateOrder(cb.Names())
+}
+
+// validateOrder reports stage orders, outermost first, which break the built-in middlewares
+func validateOrder(names []string) error {
+	if i := slices.Index(names, ObserverProxyType); i > 0 {
+		return fmt.Errorf(
+			"%w: %s must be the outermost stage", ErrInvalidMiddlewareOrder, ObserverProxyType,
+		)
+	}
+
+	for outer, inners := range chainOrderRules {
+		i := slices.Index(names, outer)
+		if i < 0 {
+			continue
+		}
+		for _, inner := range inners {
+			if j := slices.Index(names, inner); j >= 0 && j < i {
+				return fmt.Errorf("%w: %s must wrap %s", ErrInvalidMiddlewareOrder, outer, inner)
+			}
+		}
+	}
+	return nil
+}
+
+// validateMiddlewareOrder ensures the configured order names built-in or registered middlewares
+// at most once
+func validateMiddlewareOrder(order []string) error {
+	for i, name := range order {
+		if _, ok := lookupPlugin(name); !ok && !isBuiltinMiddleware(name) {
+			return fmt.Errorf("middleware order: %w: %q", ErrUnknownMiddleware, name)
+		}
+		if slices.Contains(order[:i], name) {
+			return fmt.Errorf("middleware order: %w: %q", ErrDuplicateMiddleware, name)
+		}
+	}
+	return nil
+}
+
+// reorder moves the stages named in the order into the positions those stages occupy, outermost
+// first, leaving the other stages in place. Names of stages missing from the chain are skipped.
+func reorder[S any](stages []S, name func(S) string, order []string) {
+	var (
+		slots   []int
+		ordered []S
+	)
+	for _, n := range order {
+		i := slices.IndexFunc(stages, func(s S) bool { return name(s) == n })
+		if i < 0 || slices.Contains(slots, i) {
+			continue
+		}
+		slots = append(slots, i)
+		ordered = append(ordered, stages[i])
+	}
+
+	slices.Sort(slots)
+	for k, i := range slots {
+		stages[i] = ordered[k]
+	}
+}
+
+// Build validates the stages and wraps the exit client with them.
+// Throws an error if a registered middleware factory fails.
+func (cb *ChainBuilder) Build(client ProxyClient) (ProxyClient, error) {
+	if err := cb.Validate(); err != nil {
+		return nil, err
+	}
+	return cb.build(client)
+}
+
+func (cb *ChainBuilder) build(client ProxyClient) (ProxyClient, error) {
+	var err error
+	for _, s := range slices.Backward(cb.stages) {
+		if client, err = s.build(client); err != nil {
+			return nil, err
+		}
+	}
+
+	stages := cb.Stages()
+	publish(cb, &activeChain, &stages)
+	if cb.costs.cache != nil || cb.costs.model != nil {
+		client = &costsClient{ProxyClient: client, costs: &cb.costs}
+	}
+	return client, nil
+}
+
+// publish hands the state of the built chain to the process-wide handlers unless it is private
+func publish[T any](cb *ChainBuilder, active *atomic.Pointer[T], state *T) {
+	if !cb.private {
+		active.Store(state)
+	}
+}
+
+// chainCosts are the query cost cache and the cost model calibrated by CostFeedback of a chain
+type chainCosts struct {
+	cache *queryCostCache
+	model *CostModel
+}
+
+func (c *chainCosts) queryCostCache() *queryCostCache {
+	if c == nil {
+		return nil
+	}
+	return c.cache
+}
+
+func (c *chainCosts) costModel() *CostModel {
+	if c == nil {
+		return nil
+	}
+	return c.model
+}
+
+// costsClient hands the costs of its chain to the requests entering it through the form cache,
+// so QueryCost uses the cache and calibration of the chain the request passes through
+type costsClient struct {
+	ProxyClient
+	costs *chainCosts
+}
+
+func (c *costsClient) Next(rr Request) error {
+	formCacheFrom(rr.Request().Context()).storeChainCosts(c.costs)
+	return c.ProxyClient.Next(rr)
+}
+
+func (cb *ChainBuilder) insert(i int, name string, mw MiddlewareFunc) *ChainBuilder {
+	return cb.add(i, name, func(next ProxyClient) (ProxyClient, error) {
+		return mw(next), nil
+	})
+}
+
+func (cb *ChainBuilder) add(
+	i int, name string, build func(next ProxyClient) (ProxyClient, error),
+) *ChainBuilder {
+	if cb.indexOf(name) >= 0 {
+		return cb.fail(fmt.Errorf("%w: %s", ErrDuplicateMiddleware, name))
+	}
+	cb.stages = slices.Insert(cb.stages, i, stage{name: name, build: build})
+	return cb
+}
+
+func (cb *ChainBuilder) indexOf(name string) int {
+	return slices.IndexFunc(cb.stages, func(s stage) bool { return s.name == name })
+}
+
+func (cb *ChainBuilder) fail(err error) *ChainBuilder {
+	cb.errs = append(cb.errs, err)
+	return cb
+}
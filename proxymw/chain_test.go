@@ -0,0 +1,256 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingMiddleware struct {
+	client ProxyClient
+	name   string
+	calls  *[]string
+}
+
+func (rm *recordingMiddleware) Init(ctx context.Context) error {
+	return rm.client.Init(ctx)
+}
+
+func (rm *recordingMiddleware) Next(rr Request) error {
+	*rm.calls = append(*rm.calls, rm.name)
+	return rm.client.Next(rr)
+}
+
+func TestChainBuilder(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-block=user"},
+		},
+		EnableJitter:   true,
+		JitterDelay:    time.Millisecond,
+		EnableObserver: true,
+	}
+	require.Equal(t, []string{ObserverProxyType, BlockerProxyType, JitterProxyType},
+		NewChainBuilder(cfg).Names())
+
+	calls := []string{}
+	record := func(name string) MiddlewareFunc {
+		return func(next ProxyClient) ProxyClient {
+			return &recordingMiddleware{client: next, name: name, calls: &calls}
+		}
+	}
+
+	cb := NewChainBuilder(cfg).
+		Order(ObserverProxyType, JitterProxyType, BlockerProxyType).
+		InsertAfter(ObserverProxyType, "auth", record("auth")).
+		InsertBefore(BlockerProxyType, "trace", record("trace")).
+		Use("last", record("last"))
+	require.Equal(t, []string{
+		ObserverProxyType, "auth", JitterProxyType, "trace", BlockerProxyType, "last",
+	}, cb.Names())
+
+	client, err := cb.Build(&Mocker{
+		InitFunc: func(context.Context) error { return nil },
+		NextFunc: func(Request) error { return nil },
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.Init(context.Background()))
+
+	observer := client.(*Observer)
+	auth := observer.client.(*recordingMiddleware)
+	jitterer := auth.client.(*Jitterer)
+	trace := jitterer.client.(*recordingMiddleware)
+	blocker := trace.client.(*Blocker)
+	require.IsType(t, &recordingMiddleware{}, blocker.client)
+
+	req, err := http.NewRequestWithContext(
+		context.Background(), http.MethodGet, "http://prometheus", http.NoBody,
+	)
+	require.NoError(t, err)
+	req.Header.Set("X-block", "user")
+	rr := &Mocker{RequestFunc: func() *http.Request { return req }}
+	require.Error(t, client.Next(rr))
+	require.Equal(t, []string{"auth", "trace"}, calls)
+}
+
+func TestChainBuilderValidate(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		EnableObserver: true,
+		TenantStatsConfig: TenantStatsConfig{
+			EnableTenantStats: true,
+		},
+		RateLimitConfig: RateLimitConfig{
+			EnableRateLimit: true,
+			RateLimit:       10,
+		},
+	}
+	noop := func(next ProxyClient) ProxyClient { return next }
+
+	for _, tt := range []struct {
+		name string
+		cb   *ChainBuilder
+		err  error
+	}{
+		{
+			name: "default order",
+			cb:   NewChainBuilder(cfg),
+		},
+		{
+			name: "observer not outermost",
+			cb:   NewChainBuilder(cfg).InsertBefore(ObserverProxyType, "custom", noop),
+			err:  ErrInvalidMiddlewareOrder,
+		},
+		{
+			name: "tenant stats inside rate limit",
+			cb: NewChainBuilder(cfg).
+				Order(ObserverProxyType, RateLimitProxyType, TenantStatsProxyType),
+			err: ErrInvalidMiddlewareOrder,
+		},
+		{
+			name: "order missing a stage",
+			cb:   NewChainBuilder(cfg).Order(ObserverProxyType, TenantStatsProxyType),
+			err:  ErrInvalidMiddlewareOrder,
+		},
+		{
+			name: "order repeats a stage",
+			cb: NewChainBuilder(cfg).
+				Order(ObserverProxyType, ObserverProxyType, RateLimitProxyType),
+			err: ErrDuplicateMiddleware,
+		},
+		{
+			name: "duplicate name",
+			cb:   NewChainBuilder(cfg).Use(RateLimitProxyType, noop),
+			err:  ErrDuplicateMiddleware,
+		},
+		{
+			name: "unknown target",
+			cb:   NewChainBuilder(cfg).InsertAfter(BackpressureProxyType, "custom", noop),
+			err:  ErrUnknownMiddleware,
+		},
+		{
+			name: "remove unknown",
+			cb:   NewChainBuilder(cfg).Remove(JitterProxyType),
+			err:  ErrUnknownMiddleware,
+		},
+		{
+			name: "observer removed",
+			cb:   NewChainBuilder(cfg).Remove(ObserverProxyType).Use("custom", noop),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := tt.cb.Build(&Mocker{})
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestConfigMiddlewareOrder(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		EnableObserver: true,
+		TenantStatsConfig: TenantStatsConfig{
+			EnableTenantStats: true,
+		},
+		RateLimitConfig: RateLimitConfig{
+			EnableRateLimit: true,
+			RateLimit:       10,
+		},
+		EnableJitter: true,
+		JitterDelay:  time.Millisecond,
+	}
+
+	for _, tt := range []struct {
+		name  string
+		order []string
+		names []string
+		err   error
+	}{
+		{
+			name:  "default order",
+			names: []string{ObserverProxyType, TenantStatsProxyType, RateLimitProxyType, JitterProxyType},
+		},
+		{
+			name:  "jitter after admission",
+			order: []string{JitterProxyType, RateLimitProxyType},
+			names: []string{ObserverProxyType, TenantStatsProxyType, JitterProxyType, RateLimitProxyType},
+		},
+		{
+			name:  "disabled middlewares are skipped",
+			order: []string{ObserverProxyType, BackpressureProxyType, JitterProxyType, RateLimitProxyType},
+			names: []string{ObserverProxyType, TenantStatsProxyType, JitterProxyType, RateLimitProxyType},
+		},
+		{
+			name:  "tenant stats inside rate limit",
+			order: []string{RateLimitProxyType, TenantStatsProxyType},
+			names: []string{ObserverProxyType, RateLimitProxyType, TenantStatsProxyType, JitterProxyType},
+			err:   ErrInvalidMiddlewareOrder,
+		},
+		{
+			name:  "unknown type",
+			order: []string{JitterProxyType, "jiter"},
+			names: []string{ObserverProxyType, TenantStatsProxyType, RateLimitProxyType, JitterProxyType},
+			err:   ErrUnknownMiddleware,
+		},
+		{
+			name:  "repeated type",
+			order: []string{RateLimitProxyType, JitterProxyType, RateLimitProxyType},
+			names: []string{ObserverProxyType, TenantStatsProxyType, RateLimitProxyType, JitterProxyType},
+			err:   ErrDuplicateMiddleware,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := cfg
+			cfg.MiddlewareOrder = tt.order
+			require.ErrorIs(t, cfg.Validate(), tt.err)
+
+			cb := NewChainBuilder(cfg)
+			require.Equal(t, tt.names, cb.Names())
+			require.Equal(t, tt.names, cfg.middlewareTypes())
+			_, err := cb.Build(&Mocker{})
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestPrivateChain(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		BackpressureConfig: BackpressureConfig{
+			EnableBackpressure:  true,
+			CongestionWindowMin: 1,
+			CongestionWindowMax: 10,
+		},
+		QuotaConfig:       QuotaConfig{EnableQuotas: true},
+		AuditConfig:       AuditConfig{EnableAudit: true},
+		TenantStatsConfig: TenantStatsConfig{EnableTenantStats: true, TenantStatsWindow: time.Hour},
+		MetricsConfig:     MetricsConfig{MetricsRegistry: prometheus.NewRegistry()},
+	}
+	cb := NewChainBuilder(cfg)
+	cb.private = true
+	client, err := cb.Build(&Mocker{})
+	require.NoError(t, err)
+
+	// the handlers keep serving the state of the main chain
+	a, ok := client.(*Audit)
+	require.True(t, ok)
+	require.NotSame(t, a, activeAudit.Load())
+	ts, ok := a.client.(*TenantStats)
+	require.True(t, ok)
+	require.NotSame(t, tenantAggregator, ts.aggregator)
+	require.Equal(t, time.Hour, ts.aggregator.window)
+	q, ok := ts.client.(*Quota)
+	require.True(t, ok)
+	require.NotSame(t, q, activeQuota.Load())
+	bp, ok := q.client.(*Backpressure)
+	require.True(t, ok)
+	require.NotSame(t, bp, activeBackpressure.Load())
+}
@@ -0,0 +1,198 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	ChaosProxyType = "chaos"
+
+	DefaultChaosErrorStatus = http.StatusServiceUnavailable
+
+	chaosFaultLatency = "latency"
+	chaosFaultError   = "error"
+	chaosFaultDrop    = "drop"
+)
+
+var (
+	ErrChaosPercent         = errors.New("chaos percents must be between 0 and 100 and errors plus drops at most 100")
+	ErrChaosLatencyRequired = errors.New("chaos latency percent requires a positive chaos latency")
+	ErrChaosErrorStatus     = errors.New("chaos error status must be a 4xx or 5xx status code")
+	ErrChaosNoFaults        = errors.New("chaos requires a latency, error, or drop percent")
+	ErrChaosDropped         = errors.New("chaos dropped the connection")
+
+	defaultChaosMetrics = newChaosMetrics(defaultMetricsFactory)
+)
+
+// chaosMetrics are the collectors of the ChaosInjector of one middleware chain
+type chaosMetrics struct {
+	injected *prometheus.CounterVec
+}
+
+func newChaosMetrics(factory promauto.Factory) *chaosMetrics {
+	return &chaosMetrics{
+		injected: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_chaos_injected_total",
+			Help: "Faults injected into requests by type: latency, error, or drop",
+		}, []string{"fault"}),
+	}
+}
+
+// ChaosConfig injects upstream faults into a sample of requests to test how clients retry and
+// back off through the proxy. Faults apply after every throttling middleware admitted the request.
+type ChaosConfig struct {
+	EnableChaos bool `yaml:"enable_chaos"`
+	// ChaosHeader limits faults to requests carrying the header, so test clients opt in without
+	// disturbing other traffic. Every request is eligible when empty.
+	ChaosHeader string `yaml:"chaos_header"`
+	// ChaosLatency is added to ChaosLatencyPercent of requests before they are forwarded
+	ChaosLatency        time.Duration `yaml:"chaos_latency"`
+	ChaosLatencyPercent float64       `yaml:"chaos_latency_percent"`
+	// ChaosErrorPercent of requests are answered with ChaosErrorStatus instead of reaching the
+	// upstream. The status defaults to 503.
+	ChaosErrorPercent float64 `yaml:"chaos_error_percent"`
+	ChaosErrorStatus  int     `yaml:"chaos_error_status"`
+	// ChaosDropPercent of requests have their connection closed without a response
+	ChaosDropPercent float64 `yaml:"chaos_drop_percent"`
+}
+
+func (c ChaosConfig) Validate() error {
+	if !c.EnableChaos {
+		return nil
+	}
+
+	for _, percent := range []float64{c.ChaosLatencyPercent, c.ChaosErrorPercent, c.ChaosDropPercent} {
+		if percent < 0 || percent > 100 {
+			return ErrChaosPercent
+		}
+	}
+	if c.ChaosErrorPercent+c.ChaosDropPercent > 100 {
+		return ErrChaosPercent
+	}
+
+	if c.ChaosLatencyPercent > 0 && c.ChaosLatency <= 0 {
+		return ErrChaosLatencyRequired
+	}
+	if c.ChaosErrorStatus != 0 && (c.ChaosErrorStatus < 400 || c.ChaosErrorStatus > 599) {
+		return ErrChaosErrorStatus
+	}
+	if c.ChaosLatencyPercent == 0 && c.ChaosErrorPercent == 0 && c.ChaosDropPercent == 0 {
+		return ErrChaosNoFaults
+	}
+	return nil
+}
+
+func (c ChaosConfig) errorStatus() int {
+	if c.ChaosErrorStatus == 0 {
+		return DefaultChaosErrorStatus
+	}
+	return c.ChaosErrorStatus
+}
+
+// ChaosInjector delays, fails, or drops a sample of requests like a misbehaving upstream would
+type ChaosInjector struct {
+	client         ProxyClient
+	header         string
+	latency        time.Duration
+	latencyPercent float64
+	errorPercent   float64
+	errorStatus    int
+	dropPercent    float64
+	// clock and rand default to the system sources when nil
+	clock    Clock
+	rand     Rand
+	injected *prometheus.CounterVec
+}
+
+var _ ProxyClient = &ChaosInjector{}
+
+// NewChaosInjector creates a ChaosInjector from a validated config
+func NewChaosInjector(client ProxyClient, cfg ChaosConfig) *ChaosInjector {
+	return newChaosInjector(client, cfg, defaultChaosMetrics)
+}
+
+func newChaosInjector(client ProxyClient, cfg ChaosConfig, m *chaosMetrics) *ChaosInjector {
+	return &ChaosInjector{
+		client:         client,
+		header:         cfg.ChaosHeader,
+		latency:        cfg.ChaosLatency,
+		latencyPercent: cfg.ChaosLatencyPercent,
+		errorPercent:   cfg.ChaosErrorPercent,
+		errorStatus:    cfg.errorStatus(),
+		dropPercent:    cfg.ChaosDropPercent,
+		injected:       m.injected,
+	}
+}
+
+func (ci *ChaosInjector) Init(ctx context.Context) error {
+	return ci.client.Init(ctx)
+}
+
+func (ci *ChaosInjector) Next(rr Request) error {
+	if ci.header != "" && rr.Request().Header.Get(ci.header) == "" {
+		return ci.client.Next(rr)
+	}
+
+	random := orSystemRand(ci.rand)
+	if random.Float64()*100 < ci.latencyPercent {
+		ci.injected.WithLabelValues(chaosFaultLatency).Inc()
+		leave := enterStage(rr, ChaosProxyType, "delaying")
+		start := time.Now()
+		err := ci.delay(rr.Request().Context())
+		addServerTiming(rr, ChaosProxyType, time.Since(start))
+		leave()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch sample := random.Float64() * 100; {
+	case sample < ci.dropPercent:
+		ci.injected.WithLabelValues(chaosFaultDrop).Inc()
+		return ci.drop(rr)
+	case sample < ci.dropPercent+ci.errorPercent:
+		ci.injected.WithLabelValues(chaosFaultError).Inc()
+		body := fmt.Sprintf("chaos injected a %d response\n", ci.errorStatus)
+		return writeShardResult(rr, shardResult{
+			status: ci.errorStatus,
+			header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			body:   []byte(body),
+		})
+	default:
+		return ci.client.Next(rr)
+	}
+}
+
+// delay waits out the injected latency unless the client gives up first
+func (ci *ChaosInjector) delay(ctx context.Context) error {
+	timer := orSystemClock(ci.clock).NewTimer(ci.latency)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// drop closes the client connection without a response. Round trips and connections that cannot
+// be hijacked, like HTTP/2 streams, fail with ErrChaosDropped instead.
+func (ci *ChaosInjector) drop(rr Request) error {
+	rrw, ok := rr.(ResponseWriter)
+	if !ok || rrw.ResponseWriter() == nil {
+		return ErrChaosDropped
+	}
+
+	conn, _, err := http.NewResponseController(rrw.ResponseWriter()).Hijack()
+	if err != nil {
+		return ErrChaosDropped
+	}
+	return conn.Close()
+}
@@ -0,0 +1,223 @@
+package proxymw
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  ChaosConfig
+		want error
+	}{
+		{name: "disabled", cfg: ChaosConfig{ChaosErrorPercent: 200}},
+		{
+			name: "every fault",
+			cfg: ChaosConfig{
+				EnableChaos:         true,
+				ChaosLatency:        time.Second,
+				ChaosLatencyPercent: 100,
+				ChaosErrorPercent:   50,
+				ChaosErrorStatus:    http.StatusTooManyRequests,
+				ChaosDropPercent:    50,
+			},
+		},
+		{
+			name: "percent above 100",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosDropPercent: 101},
+			want: ErrChaosPercent,
+		},
+		{
+			name: "negative percent",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosErrorPercent: -1},
+			want: ErrChaosPercent,
+		},
+		{
+			name: "errors and drops above 100",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosErrorPercent: 60, ChaosDropPercent: 60},
+			want: ErrChaosPercent,
+		},
+		{
+			name: "latency percent without latency",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosLatencyPercent: 10},
+			want: ErrChaosLatencyRequired,
+		},
+		{
+			name: "success status",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosErrorPercent: 10, ChaosErrorStatus: http.StatusOK},
+			want: ErrChaosErrorStatus,
+		},
+		{
+			name: "no faults",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosHeader: "X-Chaos"},
+			want: ErrChaosNoFaults,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := Config{ChaosConfig: tt.cfg}.Validate()
+			if tt.want == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tt.want)
+		})
+	}
+}
+
+func TestChaosInjectorServe(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name    string
+		cfg     ChaosConfig
+		sample  float64
+		header  bool
+		status  int
+		dropped bool
+	}{
+		{
+			name:   "error",
+			cfg:    ChaosConfig{ChaosErrorPercent: 50, ChaosErrorStatus: http.StatusBadGateway},
+			sample: 0.4,
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "not sampled",
+			cfg:    ChaosConfig{ChaosErrorPercent: 50},
+			sample: 0.6,
+			status: http.StatusOK,
+		},
+		{
+			name:   "header gated",
+			cfg:    ChaosConfig{ChaosHeader: "X-Chaos", ChaosErrorPercent: 100},
+			status: http.StatusOK,
+		},
+		{
+			name:   "header opts in",
+			cfg:    ChaosConfig{ChaosHeader: "X-Chaos", ChaosErrorPercent: 100},
+			header: true,
+			status: DefaultChaosErrorStatus,
+		},
+		{
+			name:    "drop",
+			cfg:     ChaosConfig{ChaosDropPercent: 10, ChaosErrorPercent: 90},
+			sample:  0.05,
+			dropped: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := Config{ChaosConfig: tt.cfg, Rand: fixedRand(tt.sample)}
+			cfg.EnableChaos = true
+			require.NoError(t, cfg.Validate())
+
+			entry := NewServeFromConfig(cfg, func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			require.NoError(t, entry.Init(t.Context()))
+			srv := httptest.NewServer(entry)
+			t.Cleanup(srv.Close)
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/query?query=up", http.NoBody)
+			require.NoError(t, err)
+			if tt.header {
+				req.Header.Set("X-Chaos", "1")
+			}
+
+			res, err := srv.Client().Do(req)
+			if tt.dropped {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, tt.status, res.StatusCode)
+		})
+	}
+}
+
+func TestChaosInjectorRoundTripper(t *testing.T) {
+	t.Parallel()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	for _, tt := range []struct {
+		name   string
+		cfg    ChaosConfig
+		status int
+		want   error
+	}{
+		{
+			name:   "error",
+			cfg:    ChaosConfig{EnableChaos: true, ChaosErrorPercent: 100},
+			status: DefaultChaosErrorStatus,
+		},
+		{
+			name: "drop",
+			cfg:  ChaosConfig{EnableChaos: true, ChaosDropPercent: 100},
+			want: ErrChaosDropped,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			rt := NewRoundTripperFromConfig(Config{ChaosConfig: tt.cfg}, http.DefaultTransport)
+			req, err := http.NewRequest(http.MethodGet, upstream.URL+"/api/v1/query?query=up", http.NoBody)
+			require.NoError(t, err)
+
+			res, err := rt.RoundTrip(req)
+			if tt.want != nil {
+				require.ErrorIs(t, err, tt.want)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, tt.status, res.StatusCode)
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, "chaos injected a 503 response\n", string(body))
+		})
+	}
+}
+
+func TestChaosInjectorLatency(t *testing.T) {
+	t.Parallel()
+	m := newChaosMetrics(promauto.With(prometheus.NewRegistry()))
+	forwarded := 0
+	next := &Mocker{NextFunc: func(Request) error {
+		forwarded++
+		return nil
+	}}
+	ci := newChaosInjector(next, ChaosConfig{
+		ChaosLatency:        time.Millisecond,
+		ChaosLatencyPercent: 50,
+	}, m)
+	ci.rand = fixedRand(0.2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rr := &Mocker{RequestFunc: func() *http.Request {
+		return httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/v1/query", http.NoBody)
+	}}
+
+	require.NoError(t, ci.Next(rr))
+	require.Equal(t, 1, forwarded)
+	require.InDelta(t, 1, testutil.ToFloat64(m.injected.WithLabelValues(chaosFaultLatency)), 0)
+
+	// clients giving up during the delay are not forwarded
+	ci.latency = time.Hour
+	cancel()
+	require.ErrorIs(t, ci.Next(rr), context.Canceled)
+	require.Equal(t, 1, forwarded)
+}
@@ -0,0 +1,124 @@
+package proxymw
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const HeaderForwardedFor = "X-Forwarded-For"
+
+// ParsePrefixes parses CIDRs into prefixes. Bare IP addresses are treated as single host
+// prefixes.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func matchPrefix(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// clientIP returns the address of the client that sent the request. X-Forwarded-For is only
+// trusted when the direct peer is a trusted proxy, in which case the rightmost untrusted hop is
+// the client since every entry left of it could have been forged.
+func clientIP(req *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	addr, ok := parseAddr(req.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	if _, ok := matchPrefix(trusted, addr); !ok {
+		return addr, true
+	}
+
+	hops := []string{}
+	for _, header := range req.Header.Values(HeaderForwardedFor) {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(strings.TrimSpace(hops[i]))
+		if !ok {
+			// a malformed hop cannot be attributed so stop at the last valid address
+			break
+		}
+
+		addr = hop
+		if _, ok := matchPrefix(trusted, hop); !ok {
+			break
+		}
+	}
+	return addr, true
+}
+
+type clientIPKey struct{}
+
+// withClientIP resolves the client IP once as the request enters the chain so every middleware
+// attributes the request to the same address. Without trusted proxies the direct peer is the
+// client and ClientIP reads it from the request.
+func withClientIP(ctx context.Context, req *http.Request, trusted []netip.Prefix) context.Context {
+	if len(trusted) == 0 {
+		return ctx
+	}
+
+	if ip, ok := clientIP(req, trusted); ok {
+		return context.WithValue(ctx, clientIPKey{}, ip)
+	}
+	return ctx
+}
+
+// ClientIP returns the address of the client that sent the request, resolved through the
+// X-Forwarded-For header of trusted proxies when the request passed through an entry
+func ClientIP(req *http.Request) string {
+	if ip, ok := requestClientIP(req, nil); ok {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+// requestClientIP prefers the client IP resolved by the entry and otherwise resolves it with the
+// trusted proxies of the caller
+func requestClientIP(req *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	if ip, ok := req.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return ip, true
+	}
+	return clientIP(req, trusted)
+}
+
+// parseAddr parses an address with or without a port
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,131 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	t.Parallel()
+	prefixes, err := ParsePrefixes([]string{"10.1.2.3", "10.0.0.1/8", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.1.2.3/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, prefixes)
+
+	_, err = ParsePrefixes([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = ParsePrefixes([]string{"example.com"})
+	require.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+	trusted, err := ParsePrefixes([]string{"192.168.0.0/24", "10.0.0.1"})
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+		wantOK     bool
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "1.2.3.4:5678",
+			want:       "1.2.3.4",
+			wantOK:     true,
+		},
+		{
+			name:       "untrusted peer cannot spoof forwarded for",
+			remoteAddr: "1.2.3.4:5678",
+			forwarded:  []string{"5.6.7.8"},
+			want:       "1.2.3.4",
+			wantOK:     true,
+		},
+		{
+			name:       "trusted proxy chain",
+			remoteAddr: "192.168.0.10:80",
+			forwarded:  []string{"9.9.9.9, 5.6.7.8", "10.0.0.1"},
+			want:       "5.6.7.8",
+			wantOK:     true,
+		},
+		{
+			name:       "every hop trusted",
+			remoteAddr: "192.168.0.10:80",
+			forwarded:  []string{"10.0.0.1"},
+			want:       "10.0.0.1",
+			wantOK:     true,
+		},
+		{
+			name:       "malformed hop",
+			remoteAddr: "192.168.0.10:80",
+			forwarded:  []string{"5.6.7.8, unknown"},
+			want:       "192.168.0.10",
+			wantOK:     true,
+		},
+		{
+			name:       "ipv4 mapped ipv6",
+			remoteAddr: "[::ffff:1.2.3.4]:80",
+			want:       "1.2.3.4",
+			wantOK:     true,
+		},
+		{
+			name:       "unparseable remote addr",
+			remoteAddr: "pipe",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			for _, hop := range tt.forwarded {
+				req.Header.Add(HeaderForwardedFor, hop)
+			}
+
+			addr, ok := clientIP(req, trusted)
+			require.Equal(t, tt.wantOK, ok)
+			if tt.wantOK {
+				require.Equal(t, tt.want, addr.String())
+			}
+		})
+	}
+}
+
+func TestServeEntryClientIP(t *testing.T) {
+	t.Parallel()
+	var got string
+	entry := NewServeFromConfig(Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker:  true,
+			BlockCIDRs:     []string{"203.0.113.0/24"},
+			TrustedProxies: []string{"10.0.0.0/8"},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	req.RemoteAddr = "10.1.2.3:4567"
+	req.Header.Set(HeaderForwardedFor, "198.51.100.9")
+	rec := httptest.NewRecorder()
+	entry.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "198.51.100.9", got)
+
+	req.Header.Set(HeaderForwardedFor, "203.0.113.5")
+	rec = httptest.NewRecorder()
+	entry.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	// without an entry the direct peer is the client
+	require.Equal(t, "10.1.2.3", ClientIP(req))
+}
@@ -0,0 +1,105 @@
+package proxymw
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Clock is the time source of the middlewares with timers and pollers, so tests and embedders
+// can run them deterministically or accelerate time. See proxymwtest.FakeClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer delivers the time on C once its duration elapses, like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker delivers the time on C every period, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Rand is the random source of jitter and probabilistic admission. Implementations must be safe
+// for concurrent use; *rand.Rand is not without a lock.
+type Rand interface {
+	Float64() float64
+	ExpFloat64() float64
+	NormFloat64() float64
+	Int63n(n int64) int64
+}
+
+var (
+	// SystemClock is the wall clock
+	SystemClock Clock = systemClock{}
+	// SystemRand is the shared math/rand source
+	SystemRand Rand = systemRand{}
+)
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// nolint:gosec // rand not used for security purposes
+type systemRand struct{}
+
+func (systemRand) Float64() float64 {
+	return rand.Float64()
+}
+
+func (systemRand) ExpFloat64() float64 {
+	return rand.ExpFloat64()
+}
+
+func (systemRand) NormFloat64() float64 {
+	return rand.NormFloat64()
+}
+
+func (systemRand) Int63n(n int64) int64 {
+	return rand.Int63n(n)
+}
+
+func orSystemClock(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+func orSystemRand(random Rand) Rand {
+	if random == nil {
+		return SystemRand
+	}
+	return random
+}
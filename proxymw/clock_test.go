@@ -0,0 +1,85 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemClock(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, SystemClock, orSystemClock(nil))
+	require.Equal(t, SystemRand, orSystemRand(nil))
+
+	timer := SystemClock.NewTimer(time.Millisecond)
+	require.WithinDuration(t, time.Now(), <-timer.C(), time.Second)
+	require.False(t, timer.Stop())
+
+	ticker := SystemClock.NewTicker(time.Millisecond)
+	<-ticker.C()
+	ticker.Stop()
+
+	for range 100 {
+		require.Less(t, SystemRand.Int63n(10), int64(10))
+	}
+}
+
+func TestBackpressureClock(t *testing.T) {
+	t.Parallel()
+	bp := newBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin: 1,
+		CongestionWindowMax: 100,
+	}, defaultBackpressureMetrics)
+	bp.probabilistic = true
+
+	past := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	bp.useClock(fixedClock{past}, fixedRand(0.5))
+	require.Equal(t, past, bp.now())
+	require.Equal(t, past, bp.lastActive)
+
+	rr := &Mocker{RequestFunc: func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	}}
+	bp.allowance = 0.6
+	require.NoError(t, bp.admit(rr))
+	bp.allowance = 0.4
+	require.ErrorIs(t, bp.admit(rr), ErrBackpressureDropped)
+}
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func (c fixedClock) NewTimer(d time.Duration) Timer {
+	return SystemClock.NewTimer(d)
+}
+
+func (c fixedClock) NewTicker(d time.Duration) Ticker {
+	return SystemClock.NewTicker(d)
+}
+
+// fixedRand always samples the same value
+type fixedRand float64
+
+func (r fixedRand) Float64() float64 {
+	return float64(r)
+}
+
+func (r fixedRand) ExpFloat64() float64 {
+	return float64(r)
+}
+
+func (r fixedRand) NormFloat64() float64 {
+	return float64(r)
+}
+
+func (r fixedRand) Int63n(n int64) int64 {
+	return int64(float64(r) * float64(n))
+}
@@ -0,0 +1,295 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/kevindweb/throttle-proxy/internal/util"
+)
+
+const (
+	CostFeedbackProxyType = "cost_feedback"
+
+	// DefaultSamplesPerCostUnit prices a query reading 10M samples at ObjectStorageThreshold
+	DefaultSamplesPerCostUnit = 100_000
+	DefaultCostFeedbackAlpha  = 0.3
+	DefaultCostFeedbackSize   = 10_000
+
+	// statsTailSize is how much of the end of a response is kept to find the sample stats, which
+	// Prometheus writes last in the response data
+	statsTailSize = 1024
+)
+
+var (
+	ErrCostFeedbackRange = errors.New(
+		"cost feedback samples per unit and size cannot be negative and alpha must be within [0, 1]",
+	)
+
+	totalSamplesPattern = regexp.MustCompile(`"totalQueryableSamples":\s*([0-9]+)`)
+	peakSamplesPattern  = regexp.MustCompile(`"peakSamples":\s*([0-9]+)`)
+)
+
+// CostFeedbackConfig calibrates the static QueryCost model with the samples Prometheus reports
+// reading for each query fingerprint. Queries are sent with stats=all so responses include the
+// stats object, which Prometheus API clients ignore.
+type CostFeedbackConfig struct {
+	EnableCostFeedback bool `yaml:"enable_cost_feedback"`
+	// SamplesPerCostUnit converts observed samples to cost units. Defaults to 100000 so a query
+	// reading 10M samples costs as much as a statically expensive query.
+	SamplesPerCostUnit int64 `yaml:"samples_per_cost_unit"`
+	// CostFeedbackAlpha is the weight of each new observation of a fingerprint. Defaults to 0.3.
+	CostFeedbackAlpha float64 `yaml:"cost_feedback_alpha"`
+	// CostFeedbackSize is how many fingerprints are calibrated at once. Defaults to 10000.
+	CostFeedbackSize int `yaml:"cost_feedback_size"`
+}
+
+func (c CostFeedbackConfig) Validate() error {
+	if !c.EnableCostFeedback {
+		return nil
+	}
+
+	if c.SamplesPerCostUnit < 0 || c.CostFeedbackSize < 0 ||
+		c.CostFeedbackAlpha < 0 || c.CostFeedbackAlpha > 1 {
+		return ErrCostFeedbackRange
+	}
+
+	if !promQLSupported {
+		return ErrPromQLUnsupported
+	}
+	return nil
+}
+
+func (c CostFeedbackConfig) samplesPerUnit() int64 {
+	if c.SamplesPerCostUnit == 0 {
+		return DefaultSamplesPerCostUnit
+	}
+	return c.SamplesPerCostUnit
+}
+
+func (c CostFeedbackConfig) alpha() float64 {
+	if c.CostFeedbackAlpha == 0 {
+		return DefaultCostFeedbackAlpha
+	}
+	return c.CostFeedbackAlpha
+}
+
+func (c CostFeedbackConfig) size() int {
+	if c.CostFeedbackSize == 0 {
+		return DefaultCostFeedbackSize
+	}
+	return c.CostFeedbackSize
+}
+
+// CostModel holds the smoothed observed cost of recently seen query fingerprints
+type CostModel struct {
+	mu             sync.Mutex
+	samplesPerUnit int64
+	alpha          float64
+	costs          *util.LRU[string, *ewma]
+}
+
+func NewCostModel(cfg CostFeedbackConfig) *CostModel {
+	return &CostModel{
+		samplesPerUnit: cfg.samplesPerUnit(),
+		alpha:          cfg.alpha(),
+		costs:          util.NewLRU[string, *ewma](cfg.size()),
+	}
+}
+
+// Observe records the samples a query with the fingerprint read
+func (m *CostModel) Observe(fingerprint string, samples int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cost, ok := m.costs.Get(fingerprint)
+	if !ok {
+		cost = &ewma{alpha: m.alpha}
+		m.costs.Add(fingerprint, cost)
+	}
+	cost.add(float64(samples) / float64(m.samplesPerUnit))
+}
+
+// Cost returns the calibrated cost of the fingerprint if it has been observed
+func (m *CostModel) Cost(fingerprint string) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cost, ok := m.costs.Get(fingerprint)
+	if !ok {
+		return 0, false
+	}
+	return int(math.Ceil(cost.value)), true
+}
+
+// calibratedCost looks up the observed cost of the query in the request in the cost model of the
+// chain it passes through
+func calibratedCost(rr Request) (int, bool) {
+	req := rr.Request()
+	if req == nil {
+		return 0, false
+	}
+
+	model := formCacheFrom(req.Context()).chainCosts().costModel()
+	if model == nil {
+		return 0, false
+	}
+
+	query := requestQuery(req)
+	if query == "" {
+		return 0, false
+	}
+	return model.Cost(Fingerprint(query))
+}
+
+// CostFeedback asks Prometheus for query stats and feeds the samples read by each query into
+// the CostModel. It runs inside the throttling middlewares so the fingerprint is taken from the
+// query as clients sent it, before any label injection.
+type CostFeedback struct {
+	client ProxyClient
+	model  *CostModel
+}
+
+var _ ProxyClient = &CostFeedback{}
+
+func NewCostFeedback(client ProxyClient, model *CostModel) *CostFeedback {
+	return &CostFeedback{client: client, model: model}
+}
+
+func (cf *CostFeedback) Init(ctx context.Context) error {
+	return cf.client.Init(ctx)
+}
+
+func (cf *CostFeedback) Next(rr Request) error {
+	req := rr.Request()
+	if req.URL == nil || !isPromQLQueryPath(req.URL.Path) {
+		return cf.client.Next(rr)
+	}
+
+	query := requestQuery(req)
+	if query == "" {
+		return cf.client.Next(rr)
+	}
+
+	if err := rewriteForm(req, func(form url.Values) error {
+		if form.Get("stats") == "" {
+			form.Set("stats", "all")
+		}
+		return nil
+	}); err != nil {
+		return cf.client.Next(rr)
+	}
+	// the stats cannot be read from a compressed body. Without the client preference the
+	// transport negotiates compression itself and transparently decompresses the response.
+	req.Header.Del("Accept-Encoding")
+
+	fingerprint := Fingerprint(query)
+	record := func(tail []byte) {
+		if samples, ok := parseSamples(tail); ok {
+			cf.model.Observe(fingerprint, samples)
+		}
+	}
+
+	if rrw, ok := rr.(ResponseWriter); ok && rrw.ResponseWriter() != nil {
+		w := &statsWriter{ResponseWriter: rrw.ResponseWriter(), status: http.StatusOK}
+		err := cf.client.Next(&RequestResponseWrapper{req: req, w: w})
+		if err == nil && w.status == http.StatusOK {
+			record(w.tail.bytes())
+		}
+		return err
+	}
+
+	err := cf.client.Next(rr)
+	if res, ok := rr.(Response); ok && err == nil && res.Response() != nil {
+		if r := res.Response(); r.StatusCode == http.StatusOK && r.Body != nil {
+			r.Body = &statsBody{ReadCloser: r.Body, record: record}
+		}
+	}
+	return err
+}
+
+// parseSamples finds the samples a query read in the end of a Prometheus response
+func parseSamples(tail []byte) (int64, bool) {
+	samples, found := int64(0), false
+	for _, pattern := range []*regexp.Regexp{totalSamplesPattern, peakSamplesPattern} {
+		match := pattern.FindSubmatch(tail)
+		if match == nil {
+			continue
+		}
+		if n, err := strconv.ParseInt(string(match[1]), 10, 64); err == nil {
+			samples, found = max(samples, n), true
+		}
+	}
+	return samples, found
+}
+
+// tailBuffer keeps the last statsTailSize bytes written to it
+type tailBuffer struct {
+	buf []byte
+}
+
+func (t *tailBuffer) write(p []byte) {
+	if len(p) >= statsTailSize {
+		t.buf = append(t.buf[:0], p[len(p)-statsTailSize:]...)
+		return
+	}
+
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - statsTailSize; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+}
+
+func (t *tailBuffer) bytes() []byte {
+	return t.buf
+}
+
+// statsWriter records the status and tail of a response written by the upstream handler
+type statsWriter struct {
+	http.ResponseWriter
+	status int
+	tail   tailBuffer
+}
+
+func (w *statsWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	w.tail.write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the original writer to http.ResponseController for flushing
+func (w *statsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statsBody records the tail of a response body once it is fully read by the client
+type statsBody struct {
+	io.ReadCloser
+	tail   tailBuffer
+	record func([]byte)
+	done   bool
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tail.write(p[:n])
+	if errors.Is(err, io.EOF) && !b.done {
+		b.done = true
+		b.record(b.tail.bytes())
+	}
+	return n, err
+}
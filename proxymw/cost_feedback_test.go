@@ -0,0 +1,104 @@
+package proxymw
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const statsResponse = `{"status":"success","data":{"resultType":"vector","result":[],` +
+	`"stats":{"timings":{"evalTotalTime":0.1},"samples":{"totalQueryableSamplesPerStep":[[1,5]],` +
+	`"totalQueryableSamples":2500000,"peakSamples":4000}}}}`
+
+func TestCostFeedbackConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, CostFeedbackConfig{CostFeedbackAlpha: 5}.Validate())
+	require.ErrorIs(t, CostFeedbackConfig{
+		EnableCostFeedback: true,
+		CostFeedbackAlpha:  1.5,
+	}.Validate(), ErrCostFeedbackRange)
+}
+
+func TestParseSamples(t *testing.T) {
+	t.Parallel()
+	samples, ok := parseSamples([]byte(statsResponse))
+	require.True(t, ok)
+	require.Equal(t, int64(2_500_000), samples)
+
+	_, ok = parseSamples([]byte(`{"status":"success","data":{"result":[]}}`))
+	require.False(t, ok)
+
+	// only the tail of large responses is kept
+	var tail tailBuffer
+	tail.write(bytes.Repeat([]byte("x"), 3*statsTailSize))
+	tail.write([]byte(statsResponse))
+	require.Len(t, tail.bytes(), statsTailSize)
+	samples, ok = parseSamples(tail.bytes())
+	require.True(t, ok)
+	require.Equal(t, int64(2_500_000), samples)
+}
+
+func TestCostFeedbackServe(t *testing.T) {
+	t.Parallel()
+	model := NewCostModel(CostFeedbackConfig{EnableCostFeedback: true})
+	cf := NewCostFeedback(&ServeExit{next: func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "all", r.URL.Query().Get("stats"))
+		require.Empty(t, r.Header.Get("Accept-Encoding"))
+		_, err := w.Write([]byte(statsResponse))
+		require.NoError(t, err)
+	}}, model)
+
+	req := httptest.NewRequest(http.MethodGet, `/api/v1/query?query=up{job="api"}`, http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	require.NoError(t, cf.Next(&RequestResponseWrapper{req: req, w: w}))
+	require.Equal(t, statsResponse, w.Body.String())
+
+	// the observation applies to every query with the same fingerprint
+	cost, ok := model.Cost(Fingerprint(`up{job="web"}`))
+	require.True(t, ok)
+	require.Equal(t, 25, cost)
+}
+
+func TestCostFeedbackRoundTrip(t *testing.T) {
+	model := NewCostModel(CostFeedbackConfig{EnableCostFeedback: true, CostFeedbackAlpha: 1})
+	cf := NewCostFeedback(&RoundTripperExit{transport: &Mocker{
+		RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			require.Equal(t, "all", r.URL.Query().Get("stats"))
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(statsResponse)),
+			}, nil
+		},
+	}}, model)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=sum(up)", http.NoBody)
+	rr := &RequestResponseWrapper{req: req}
+	require.NoError(t, cf.Next(rr))
+
+	// the observation is recorded once the client reads the body
+	_, ok := model.Cost("sum(up)")
+	require.False(t, ok)
+	body, err := io.ReadAll(rr.Response().Body)
+	require.NoError(t, err)
+	require.Equal(t, statsResponse, string(body))
+
+	// only requests passing through the chain of the model are calibrated
+	_, ok = calibratedCost(&RequestResponseWrapper{req: req})
+	require.False(t, ok)
+	req = req.WithContext(withFormCache(req.Context()))
+	formCacheFrom(req.Context()).storeChainCosts(&chainCosts{model: model})
+	cost, ok := calibratedCost(&RequestResponseWrapper{req: req})
+	require.True(t, ok)
+	require.Equal(t, 25, cost)
+
+	// requests without a query are never calibrated
+	labels := httptest.NewRequest(http.MethodGet, "/api/v1/labels", http.NoBody)
+	_, ok = calibratedCost(&RequestResponseWrapper{req: labels})
+	require.False(t, ok)
+}
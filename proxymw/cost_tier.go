@@ -0,0 +1,117 @@
+package proxymw
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+type CostTier string
+
+const (
+	// CostTierNone is used when cost tiers are disabled and the request is not tracked per tier
+	CostTierNone      CostTier = ""
+	CostTierCheap     CostTier = "cheap"
+	CostTierModerate  CostTier = "moderate"
+	CostTierExpensive CostTier = "expensive"
+
+	DefaultExpensiveLookback = 24 * time.Hour
+)
+
+var (
+	ErrCostTierShareRange        = errors.New("cost tier shares must be within (0, 1]")
+	ErrCostTierShareSum          = errors.New("cost tier shares cannot sum to more than 1")
+	ErrExpensiveLookbackTooShort = fmt.Errorf(
+		"expensive lookback must be greater than the head block lookback %s", HeadBlockLookback,
+	)
+)
+
+// CostTierConfig splits the congestion window into lanes derived from QueryCost.
+// Cheap queries only touch the head block, moderate queries reach object storage, and expensive
+// queries reach further back than ExpensiveLookback. Each tier may occupy at most its share of
+// the current watermark so expensive queries are squeezed while cheap queries keep a lane open.
+type CostTierConfig struct {
+	EnableCostTiers bool    `yaml:"enable_cost_tiers"`
+	CheapShare      float64 `yaml:"cheap_share"`
+	ModerateShare   float64 `yaml:"moderate_share"`
+	ExpensiveShare  float64 `yaml:"expensive_share"`
+	// ExpensiveLookback is the lookback past which an object storage query is expensive.
+	// Defaults to DefaultExpensiveLookback when unset.
+	ExpensiveLookback time.Duration `yaml:"expensive_lookback"`
+}
+
+func (c CostTierConfig) Validate() error {
+	if !c.EnableCostTiers {
+		return nil
+	}
+
+	sum := 0.0
+	for _, share := range []float64{c.CheapShare, c.ModerateShare, c.ExpensiveShare} {
+		if share <= 0 || share > 1 {
+			return ErrCostTierShareRange
+		}
+		sum += share
+	}
+
+	// allow for floating point error when shares such as 0.7 + 0.2 + 0.1 are configured
+	if sum > 1+1e-9 {
+		return ErrCostTierShareSum
+	}
+
+	if c.ExpensiveLookback != 0 && c.ExpensiveLookback <= HeadBlockLookback {
+		return ErrExpensiveLookbackTooShort
+	}
+	return nil
+}
+
+func (c CostTierConfig) share(tier CostTier) float64 {
+	switch tier {
+	case CostTierCheap:
+		return c.CheapShare
+	case CostTierModerate:
+		return c.ModerateShare
+	case CostTierExpensive:
+		return c.ExpensiveShare
+	default:
+		return 1
+	}
+}
+
+func (c CostTierConfig) expensiveLookback() time.Duration {
+	if c.ExpensiveLookback == 0 {
+		return DefaultExpensiveLookback
+	}
+	return c.ExpensiveLookback
+}
+
+// tierFor classifies the request into a cost tier. Returns CostTierNone when tiers are disabled.
+func (c CostTierConfig) tierFor(rr Request) (CostTier, error) {
+	if !c.EnableCostTiers {
+		return CostTierNone, nil
+	}
+
+	lookback, err := QueryLookback(rr)
+	if err != nil {
+		return CostTierNone, err
+	}
+
+	return c.tierForLookback(lookback), nil
+}
+
+func (c CostTierConfig) tierForLookback(lookback time.Duration) CostTier {
+	switch {
+	case lookback <= HeadBlockLookback:
+		return CostTierCheap
+	case lookback <= c.expensiveLookback():
+		return CostTierModerate
+	default:
+		return CostTierExpensive
+	}
+}
+
+// tierWindow is the number of concurrent requests a tier may have in flight for a watermark.
+// Every tier is always allowed at least one request.
+func (c CostTierConfig) tierWindow(tier CostTier, watermark int) int {
+	return max(1, int(math.Floor(c.share(tier)*float64(watermark))))
+}
@@ -0,0 +1,121 @@
+package proxymw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCostTierConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  CostTierConfig
+		err  error
+	}{
+		{
+			name: "disabled skips validation",
+			cfg:  CostTierConfig{CheapShare: 5},
+		},
+		{
+			name: "valid shares",
+			cfg: CostTierConfig{
+				EnableCostTiers: true,
+				CheapShare:      0.7,
+				ModerateShare:   0.2,
+				ExpensiveShare:  0.1,
+			},
+		},
+		{
+			name: "zero share",
+			cfg: CostTierConfig{
+				EnableCostTiers: true,
+				CheapShare:      0.5,
+				ModerateShare:   0.5,
+			},
+			err: ErrCostTierShareRange,
+		},
+		{
+			name: "shares over one",
+			cfg: CostTierConfig{
+				EnableCostTiers: true,
+				CheapShare:      0.5,
+				ModerateShare:   0.5,
+				ExpensiveShare:  0.5,
+			},
+			err: ErrCostTierShareSum,
+		},
+		{
+			name: "expensive lookback within head block",
+			cfg: CostTierConfig{
+				EnableCostTiers:   true,
+				CheapShare:        0.5,
+				ModerateShare:     0.3,
+				ExpensiveShare:    0.2,
+				ExpensiveLookback: time.Hour,
+			},
+			err: ErrExpensiveLookbackTooShort,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.err)
+		})
+	}
+}
+
+func TestCostTierForLookback(t *testing.T) {
+	t.Parallel()
+	cfg := CostTierConfig{EnableCostTiers: true}
+	require.Equal(t, CostTierCheap, cfg.tierForLookback(time.Hour))
+	require.Equal(t, CostTierModerate, cfg.tierForLookback(10*time.Hour))
+	require.Equal(t, CostTierExpensive, cfg.tierForLookback(30*24*time.Hour))
+}
+
+func TestCheckTier(t *testing.T) {
+	bp := &Backpressure{
+		watermark: 10,
+		max:       10,
+		allowance: 1,
+		costTiers: CostTierConfig{
+			EnableCostTiers: true,
+			CheapShare:      0.5,
+			ModerateShare:   0.3,
+			ExpensiveShare:  0.2,
+		},
+		tierActive: map[CostTier]int{},
+		tierActiveGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "fake_tier_active"}, []string{"tier"},
+		),
+	}
+
+	for range 2 {
+		require.NoError(t, bp.checkTier(CostTierExpensive))
+	}
+	require.Error(t, bp.checkTier(CostTierExpensive))
+
+	// expensive queries cannot eat into the cheap lane
+	for range 5 {
+		require.NoError(t, bp.checkTier(CostTierCheap))
+	}
+	require.Error(t, bp.checkTier(CostTierCheap))
+
+	bp.releaseTier(CostTierExpensive)
+	require.NoError(t, bp.checkTier(CostTierExpensive))
+
+	// a squeezed watermark still lets one request through per tier
+	bp.watermark = 1
+	bp.tierActive = map[CostTier]int{}
+	require.NoError(t, bp.checkTier(CostTierExpensive))
+	err := bp.checkTier(CostTierExpensive)
+
+	// tier rejections estimate the Retry-After from the window like the others
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, BackpressureProxyType, blocked.Type)
+	require.Equal(t, 27*time.Second, blocked.RetryAfter)
+
+	require.NoError(t, bp.checkTier(CostTierNone))
+}
@@ -0,0 +1,130 @@
+package proxymw
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CounterStore counts events per key within fixed time windows
+type CounterStore interface {
+	// Incr increments the counter for the key in the window containing now and returns the
+	// new count.
+	Incr(ctx context.Context, key string, window time.Duration, now time.Time) (int64, error)
+	// IncrBy adds delta to the counter for the key in the window containing now and returns the
+	// new count. A delta of 0 reads the current count.
+	IncrBy(
+		ctx context.Context, key string, delta int64, window time.Duration, now time.Time,
+	) (int64, error)
+}
+
+func windowStart(window time.Duration, now time.Time) time.Time {
+	return now.Truncate(window)
+}
+
+type localCounter struct {
+	start time.Time
+	count int64
+}
+
+// LocalCounterStore keeps counters in memory so limits are enforced per replica.
+type LocalCounterStore struct {
+	mu       sync.Mutex
+	counters map[string]localCounter
+}
+
+var _ CounterStore = &LocalCounterStore{}
+
+func NewLocalCounterStore() *LocalCounterStore {
+	return &LocalCounterStore{counters: map[string]localCounter{}}
+}
+
+func (s *LocalCounterStore) Incr(
+	ctx context.Context, key string, window time.Duration, now time.Time,
+) (int64, error) {
+	return s.IncrBy(ctx, key, 1, window, now)
+}
+
+func (s *LocalCounterStore) IncrBy(
+	_ context.Context, key string, delta int64, window time.Duration, now time.Time,
+) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := windowStart(window, now)
+	counter := s.counters[key]
+	if !counter.start.Equal(start) {
+		s.evict(start)
+		counter = localCounter{start: start}
+	}
+	counter.count += delta
+	s.counters[key] = counter
+	return counter.count, nil
+}
+
+// evict drops counters from previous windows whenever a window rolls over
+func (s *LocalCounterStore) evict(start time.Time) {
+	for key, counter := range s.counters {
+		if counter.start.Before(start) {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// FallbackCounterStore uses the primary store and degrades to the fallback store while the
+// primary is failing, so limits are still enforced locally when Redis is unreachable.
+type FallbackCounterStore struct {
+	primary  CounterStore
+	fallback CounterStore
+	timeout  time.Duration
+	degraded atomic.Bool
+	gauge    prometheus.Gauge
+}
+
+var _ CounterStore = &FallbackCounterStore{}
+
+func NewFallbackCounterStore(
+	primary, fallback CounterStore, timeout time.Duration, gauge prometheus.Gauge,
+) *FallbackCounterStore {
+	return &FallbackCounterStore{
+		primary:  primary,
+		fallback: fallback,
+		timeout:  timeout,
+		gauge:    gauge,
+	}
+}
+
+func (s *FallbackCounterStore) Incr(
+	ctx context.Context, key string, window time.Duration, now time.Time,
+) (int64, error) {
+	return s.IncrBy(ctx, key, 1, window, now)
+}
+
+func (s *FallbackCounterStore) IncrBy(
+	ctx context.Context, key string, delta int64, window time.Duration, now time.Time,
+) (int64, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	count, err := s.primary.IncrBy(ctx, key, delta, window, now)
+	if err == nil {
+		if s.degraded.CompareAndSwap(true, false) {
+			log.Println("counter store recovered, enforcing limits globally")
+			s.gauge.Set(0)
+		}
+		return count, nil
+	}
+
+	if s.degraded.CompareAndSwap(false, true) {
+		log.Printf("counter store unavailable, enforcing limits locally: %v", err)
+		s.gauge.Set(1)
+	}
+	return s.fallback.IncrBy(ctx, key, delta, window, now)
+}
@@ -0,0 +1,56 @@
+package proxymw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalCounterStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewLocalCounterStore()
+	now := time.Unix(1_700_000_000, 0)
+
+	for i := range 3 {
+		count, err := store.Incr(ctx, "a", time.Minute, now)
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), count)
+	}
+
+	count, err := store.Incr(ctx, "b", time.Minute, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// the next window starts over and evicts stale counters
+	count, err = store.Incr(ctx, "a", time.Minute, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+	require.Len(t, store.counters, 1)
+}
+
+func TestCounterStoreIncrBy(t *testing.T) {
+	t.Parallel()
+	testCounterStoreIncrBy(t, NewLocalCounterStore())
+}
+
+// testCounterStoreIncrBy checks IncrBy of a store, shared by the tests of every CounterStore
+func testCounterStoreIncrBy(t *testing.T, store CounterStore) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	count, err := store.IncrBy(ctx, "tenant", 5, time.Hour, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), count)
+
+	// a zero delta reads the counter
+	count, err = store.IncrBy(ctx, "tenant", 0, time.Hour, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), count)
+
+	count, err = store.IncrBy(ctx, "tenant", -2, time.Hour, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), count)
+}
@@ -1,9 +1,40 @@
 package proxymw
 
+import "fmt"
+
 const (
 	// https://sre.google/sre-book/handling-overload/
-	CriticalityCriticalPlus = "CRITICAL_PLUS"
-	CriticalityCritical     = "CRITICAL"
+	CriticalityCriticalPlus  = "CRITICAL_PLUS"
+	CriticalityCritical      = "CRITICAL"
+	CriticalitySheddablePlus = "SHEDDABLE_PLUS"
+	CriticalitySheddable     = "SHEDDABLE"
 	// CriticalityDefault is used when the client does not set the X-Request-Criticality header.
 	CriticalityDefault = CriticalityCritical
 )
+
+// CriticalityUnknown labels metrics for requests with an invalid X-Request-Criticality header
+const CriticalityUnknown = "UNKNOWN"
+
+// CriticalityProxyType is the type of rejections for an invalid X-Request-Criticality header
+const CriticalityProxyType = "criticality"
+
+var criticalities = map[string]bool{
+	CriticalityCriticalPlus:  true,
+	CriticalityCritical:      true,
+	CriticalitySheddablePlus: true,
+	CriticalitySheddable:     true,
+}
+
+// ParseCriticality reads the X-Request-Criticality header, falling back to CriticalityDefault.
+// Rejects the request with ErrUnknownCriticality, answered with a 400, if the header is not one
+// of the known criticalities.
+func ParseCriticality(rr Request) (string, error) {
+	criticality := ParseHeaderKey(rr, HeaderCriticality)
+	if !criticalities[criticality] {
+		return "", &RequestBlockedError{
+			Err:  fmt.Errorf("%w: %q", ErrUnknownCriticality, criticality),
+			Type: CriticalityProxyType,
+		}
+	}
+	return criticality, nil
+}
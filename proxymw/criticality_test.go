@@ -0,0 +1,85 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCriticality(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name   string
+		header string
+		want   string
+		err    error
+	}{
+		{name: "unset uses default", want: CriticalityDefault},
+		{name: "sheddable", header: CriticalitySheddable, want: CriticalitySheddable},
+		{name: "sheddable plus", header: CriticalitySheddablePlus, want: CriticalitySheddablePlus},
+		{name: "critical plus", header: CriticalityCriticalPlus, want: CriticalityCriticalPlus},
+		{name: "unknown", header: "URGENT", err: ErrUnknownCriticality},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			rr := &Mocker{
+				RequestFunc: func() *http.Request {
+					return &http.Request{
+						Header: http.Header{string(HeaderCriticality): []string{tt.header}},
+					}
+				},
+			}
+			got, err := ParseCriticality(rr)
+			require.ErrorIs(t, err, tt.err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestInvalidCriticalityResponse(t *testing.T) {
+	t.Parallel()
+	upstream := 0
+	entry := NewServeFromConfig(Config{
+		EnableJitter:      true,
+		JitterDelay:       time.Millisecond,
+		EnableCriticality: true,
+	}, func(w http.ResponseWriter, _ *http.Request) {
+		upstream++
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, entry.Init(context.Background()))
+
+	for _, tt := range []struct {
+		name        string
+		criticality string
+		status      int
+	}{
+		{name: "known", criticality: CriticalityCriticalPlus, status: http.StatusOK},
+		{name: "unset", status: http.StatusOK},
+		{name: "unknown", criticality: "URGENT", status: http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		if tt.criticality != "" {
+			r.Header.Set(string(HeaderCriticality), tt.criticality)
+		}
+		w := httptest.NewRecorder()
+		entry.ServeHTTP(w, r)
+		require.Equal(t, tt.status, w.Code, tt.name)
+	}
+	require.Equal(t, 2, upstream)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	r.Header.Set(string(HeaderCriticality), "URGENT")
+	w := httptest.NewRecorder()
+	entry.ServeHTTP(w, r)
+	require.Equal(t, CriticalityProxyType, w.Header().Get(string(HeaderThrottleReason)))
+	var body APIErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, "bad_data", body.ErrorType)
+	require.Equal(t, `unknown request criticality: "URGENT"`, body.Error)
+}
@@ -0,0 +1,95 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type decisionHeadersKey struct{}
+
+// decisionHeaders collects the state middlewares based their decision on, like the backpressure
+// allowance, so clients and caches in front of the proxy can adapt to it
+type decisionHeaders struct {
+	mu     sync.Mutex
+	header http.Header
+}
+
+// setDecisionHeader reports the value on the response when decision headers are enabled
+func setDecisionHeader(rr Request, key HeaderKey, value string) {
+	if d, ok := rr.Request().Context().Value(decisionHeadersKey{}).(*decisionHeaders); ok {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.header.Set(string(key), value)
+	}
+}
+
+// decisionHeadersEnabled reports whether the response of the request carries decision headers,
+// so middlewares can skip gathering state nobody reads
+func decisionHeadersEnabled(rr Request) bool {
+	_, ok := rr.Request().Context().Value(decisionHeadersKey{}).(*decisionHeaders)
+	return ok
+}
+
+func (d *decisionHeaders) add(header http.Header) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, values := range d.header {
+		header[name] = values
+	}
+}
+
+// withAnnotations tracks the enabled Server-Timing and decision headers of a request, returning
+// a function adding them to its response. The function is nil when both are disabled.
+func withAnnotations(
+	ctx context.Context, serverTiming, decisions bool,
+) (context.Context, func(http.Header)) {
+	var annotations []func(http.Header)
+	if serverTiming {
+		var timings *serverTimings
+		ctx, timings = withServerTimings(ctx)
+		annotations = append(annotations, timings.add)
+	}
+	if decisions {
+		d := &decisionHeaders{header: http.Header{}}
+		ctx = context.WithValue(ctx, decisionHeadersKey{}, d)
+		annotations = append(annotations, d.add)
+	}
+	if len(annotations) == 0 {
+		return ctx, nil
+	}
+
+	return ctx, func(header http.Header) {
+		for _, annotate := range annotations {
+			annotate(header)
+		}
+	}
+}
+
+// annotatingWriter adds the Server-Timing and decision headers when the response header is
+// written, after the middlewares and upstream had their say
+type annotatingWriter struct {
+	http.ResponseWriter
+	annotate    func(http.Header)
+	wroteHeader bool
+}
+
+func (w *annotatingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.annotate(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *annotatingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the original writer to http.ResponseController for flushing and hijacking
+func (w *annotatingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,72 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecisionHeaders(t *testing.T) {
+	t.Parallel()
+	upstream := func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		cfg    Config
+		header http.Header
+	}{
+		{
+			name:   "disabled",
+			cfg:    Config{},
+			header: http.Header{"Content-Type": {"application/json"}},
+		},
+		{
+			name: "enabled",
+			cfg:  Config{EnableDecisionHeaders: true},
+			header: http.Header{
+				"Content-Type":                  {"application/json"},
+				string(HeaderThrottleAllowance): {"1.00"},
+				string(HeaderThrottleWatermark): {"5"},
+				string(HeaderJitterAppliedMs):   {"0"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			exit := &ServeExit{upstream}
+			bp := NewBackpressure(exit, BackpressureConfig{CongestionWindowMin: 5, CongestionWindowMax: 10})
+			entry := newServeEntry(tt.cfg, NewJitterer(bp, NoJitter, false), exit)
+
+			w := httptest.NewRecorder()
+			entry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.header, w.Header())
+		})
+	}
+}
+
+func TestDecisionHeadersRoundTrip(t *testing.T) {
+	t.Parallel()
+	rt := &Mocker{
+		RoundTripFunc: func(_ *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, nil
+		},
+	}
+	cfg := Config{EnableDecisionHeaders: true, EnableServerTiming: true}
+	entry, err := NewRoundTripperFromChain(
+		NewChainBuilder(cfg).Use(JitterProxyType, func(next ProxyClient) ProxyClient {
+			return NewJitterer(next, NoJitter, false)
+		}), rt,
+	)
+	require.NoError(t, err)
+
+	res, err := entry.RoundTrip(httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody))
+	require.NoError(t, err)
+	require.Equal(t, "0", res.Header.Get(string(HeaderJitterAppliedMs)))
+	require.NotEmpty(t, res.Header.Get(HeaderServerTiming))
+}
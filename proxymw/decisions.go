@@ -0,0 +1,80 @@
+package proxymw
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// requestDecisions are what the middlewares decided about a request, kept for the handler or
+// reverse proxy Director the chain wraps
+type requestDecisions struct {
+	jitter    atomic.Pointer[time.Duration]
+	queryCost atomic.Pointer[int]
+}
+
+func inflightFrom(ctx context.Context) (*inflightRequest, bool) {
+	ir, ok := ctx.Value(inflightKey{}).(*inflightRequest)
+	return ir, ok
+}
+
+// recordJitter keeps the jitter the request was delayed by
+func recordJitter(rr Request, jitter time.Duration) {
+	if ir, ok := inflightFrom(rr.Request().Context()); ok {
+		ir.decisions.jitter.Store(&jitter)
+	}
+}
+
+// recordQueryCost keeps the first cost estimated for the request. Sub-requests like shards share
+// its context and estimate their own.
+func recordQueryCost(rr Request, cost int) {
+	if ir, ok := inflightFrom(rr.Request().Context()); ok {
+		ir.decisions.queryCost.CompareAndSwap(nil, &cost)
+	}
+}
+
+// TenantFromContext returns the tenant of a request passing through an entry point, DefaultTenant
+// when it did not name one. False outside the chain.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	ir, ok := inflightFrom(ctx)
+	if !ok {
+		return "", false
+	}
+	return ir.tenant, true
+}
+
+// CriticalityFromContext returns the criticality of a request passing through an entry point,
+// CriticalityDefault when it did not set one. False outside the chain.
+func CriticalityFromContext(ctx context.Context) (string, bool) {
+	ir, ok := inflightFrom(ctx)
+	if !ok {
+		return "", false
+	}
+	return ir.criticality, true
+}
+
+// JitterFromContext returns the delay the jitter middleware applied to the request. False when
+// jitter did not run.
+func JitterFromContext(ctx context.Context) (time.Duration, bool) {
+	ir, ok := inflightFrom(ctx)
+	if !ok {
+		return 0, false
+	}
+	if jitter := ir.decisions.jitter.Load(); jitter != nil {
+		return *jitter, true
+	}
+	return 0, false
+}
+
+// QueryCostFromContext returns the query cost a middleware like backpressure estimated for the
+// request. False when none did.
+func QueryCostFromContext(ctx context.Context) (int, bool) {
+	ir, ok := inflightFrom(ctx)
+	if !ok {
+		return 0, false
+	}
+	if cost := ir.decisions.queryCost.Load(); cost != nil {
+		return *cost, true
+	}
+	return 0, false
+}
@@ -0,0 +1,84 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextDecisions(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		EnableJitter: true,
+		JitterDelay:  10 * time.Millisecond,
+		Rand:         fixedRand(0.5),
+	}
+
+	type decisions struct {
+		tenant, criticality string
+		jitter              time.Duration
+		cost                int
+		costOK              bool
+	}
+	var got decisions
+	cb := NewChainBuilder(cfg).Use("cost", func(next ProxyClient) ProxyClient {
+		return &Mocker{NextFunc: func(rr Request) error {
+			recordQueryCost(rr, 7)
+			return next.Next(rr)
+		}}
+	})
+	entry, err := NewServeFromChain(cfg, cb, func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		got.tenant, _ = TenantFromContext(ctx)
+		got.criticality, _ = CriticalityFromContext(ctx)
+		got.jitter, _ = JitterFromContext(ctx)
+		got.cost, got.costOK = QueryCostFromContext(ctx)
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody)
+	req.Header.Set(DefaultTenantHeader, "team-a")
+	req.Header.Set(string(HeaderCriticality), CriticalityCritical)
+	w := httptest.NewRecorder()
+	entry.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, decisions{
+		tenant:      "team-a",
+		criticality: CriticalityCritical,
+		jitter:      5 * time.Millisecond,
+		cost:        7,
+		costOK:      true,
+	}, got)
+
+	// requests outside the chain have no decisions
+	ctx := context.Background()
+	_, ok := TenantFromContext(ctx)
+	require.False(t, ok)
+	_, ok = CriticalityFromContext(ctx)
+	require.False(t, ok)
+	_, ok = JitterFromContext(ctx)
+	require.False(t, ok)
+	_, ok = QueryCostFromContext(ctx)
+	require.False(t, ok)
+}
+
+func TestRecordQueryCost(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody)
+	ctx, done := activeInflight.track(req.Context(), req, DefaultTenantHeader)
+	defer done()
+	rr := &RequestResponseWrapper{req: req.WithContext(ctx)}
+
+	_, ok := JitterFromContext(ctx)
+	require.False(t, ok, "jitter did not run")
+	recordQueryCost(rr, 3)
+	recordQueryCost(rr, 1)
+	cost, ok := QueryCostFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, 3, cost, "the first estimate is kept over those of sub-requests")
+}
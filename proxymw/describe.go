@@ -0,0 +1,362 @@
+package proxymw
+
+// MiddlewareDescription summarizes an enabled middleware and its key parameters
+type MiddlewareDescription struct {
+	Type   string         `json:"type"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// SignalDescription summarizes a backpressure query the proxy is monitoring
+type SignalDescription struct {
+	Name               string  `json:"name,omitempty"`
+	Query              string  `json:"query"`
+	Backend            string  `json:"backend"`
+	Weight             float64 `json:"weight,omitempty"`
+	MaxThrottle        float64 `json:"max_throttle,omitempty"`
+	SmoothingAlpha     float64 `json:"smoothing_alpha,omitempty"`
+	Aggregation        string  `json:"aggregation,omitempty"`
+	Direction          string  `json:"direction,omitempty"`
+	WarningQuery       string  `json:"warning_threshold_query,omitempty"`
+	EmergencyQuery     string  `json:"emergency_threshold_query,omitempty"`
+	SlopeSamples       int     `json:"slope_samples,omitempty"`
+	SlopeWarning       float64 `json:"slope_warning_threshold,omitempty"`
+	SlopeEmergency     float64 `json:"slope_emergency_threshold,omitempty"`
+	AnomalyWindow      int     `json:"anomaly_window,omitempty"`
+	AnomalyWarning     float64 `json:"anomaly_warning_stddevs,omitempty"`
+	AnomalyEmergency   float64 `json:"anomaly_emergency_stddevs,omitempty"`
+	WarningThreshold   float64 `json:"warning_threshold"`
+	EmergencyThreshold float64 `json:"emergency_threshold"`
+}
+
+// Describe lists the enabled middlewares in the order requests pass through them.
+func (c Config) Describe() []MiddlewareDescription {
+	middlewares := []MiddlewareDescription{}
+	if c.EnableObserver {
+		observer := MiddlewareDescription{Type: ObserverProxyType}
+		if c.EnableObserverPathLabels {
+			observer.Params = map[string]any{"path_templates": len(c.observerPathTemplates())}
+		}
+		middlewares = append(middlewares, observer)
+	}
+
+	if c.EnableAccessLog {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: AccessLogProxyType,
+			Params: map[string]any{
+				"access_log_format": c.AccessLogConfig.format(),
+				"access_log_file":   c.AccessLogFile,
+			},
+		})
+	}
+
+	if c.EnableRecording {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: RecorderProxyType,
+			Params: map[string]any{
+				"record_file":    c.RecordFile,
+				"record_percent": c.RecordConfig.percent(),
+				"record_headers": c.RecordConfig.headers(),
+			},
+		})
+	}
+
+	if c.EnableAudit {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: AuditProxyType,
+			Params: map[string]any{
+				"audit_size": c.AuditConfig.size(),
+				"audit_log":  c.EnableAuditLog,
+			},
+		})
+	}
+
+	if c.EnableTimeouts || c.EnableDeadlineHeaders {
+		timeouts := map[string]any{}
+		for criticality, timeout := range c.CriticalityTimeouts {
+			timeouts[criticality] = timeout.String()
+		}
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: TimeoutProxyType,
+			Params: map[string]any{
+				"client_timeout":       c.ClientTimeout.String(),
+				"criticality_timeouts": timeouts,
+				"deadline_headers":     c.EnableDeadlineHeaders,
+			},
+		})
+	}
+
+	if c.EnableTenantStats {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: TenantStatsProxyType,
+			Params: map[string]any{
+				"tenant_header":       c.TenantStatsConfig.header(),
+				"tenant_stats_window": c.TenantStatsConfig.window().String(),
+			},
+		})
+	}
+
+	if c.EnableBlocker {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: BlockerProxyType,
+			Params: map[string]any{
+				"block_patterns":      len(c.BlockPatterns),
+				"deny_query_patterns": len(c.DenyQueryPatterns),
+				"decision_cache_size": c.DecisionCacheSize,
+				"block_cidrs":         len(c.BlockCIDRs),
+				"allow_cidrs":         len(c.AllowCIDRs),
+			},
+		})
+	}
+
+	if c.EnableGuardrails {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: GuardrailProxyType,
+			Params: map[string]any{
+				"max_query_range":       c.MaxQueryRange.String(),
+				"min_query_step":        c.MinQueryStep.String(),
+				"max_points_per_series": c.GuardrailConfig.maxPoints(),
+				"validate_query_syntax": c.ValidateQuerySyntax,
+			},
+		})
+	}
+
+	if c.EnableRateLimit {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: RateLimitProxyType,
+			Params: map[string]any{
+				"rate_limit":        c.RateLimit,
+				"rate_limit_window": c.RateLimitConfig.window().String(),
+				"by_client_ip":      c.RateLimitByClientIP,
+				"distributed":       c.RedisAddr != "",
+			},
+		})
+	}
+
+	if c.EnableFingerprintLimit {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: FingerprintLimitProxyType,
+			Params: map[string]any{
+				"fingerprint_qps":    c.FingerprintQPS,
+				"fingerprint_limits": len(c.FingerprintLimits),
+			},
+		})
+	}
+
+	if c.EnableTenantConcurrency {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: TenantConcurrencyProxyType,
+			Params: map[string]any{
+				"tenant_concurrency_header": c.TenantConcurrencyConfig.header(),
+				"max_tenant_concurrency":    c.MaxTenantConcurrency,
+				"tenant_concurrency_limits": len(c.TenantConcurrencyLimits),
+			},
+		})
+	}
+
+	if c.EnableQuotas {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: QuotaProxyType,
+			Params: map[string]any{
+				"quota_header":  c.QuotaConfig.header(),
+				"tenant_quotas": len(c.TenantQuotas),
+				"persistent":    c.QuotaRedisAddr != "",
+			},
+		})
+	}
+
+	if c.EnableRemoteWriteLimit {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: RemoteWriteProxyType,
+			Params: map[string]any{
+				"remote_write_path":      c.RemoteWriteConfig.path(),
+				"max_samples_per_second": c.MaxSamplesPerSecond,
+				"backpressure_scaled":    c.EnableBackpressure,
+			},
+		})
+	}
+
+	if c.EnableJitter {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: JitterProxyType,
+			Params: map[string]any{
+				"jitter_delay":       c.JitterDelay.String(),
+				"jitter_strategy":    c.JitterStrategy,
+				"enable_criticality": c.EnableCriticality,
+			},
+		})
+	}
+
+	if c.EnableWarmup {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: WarmupProxyType,
+			Params: map[string]any{
+				"warmup_duration":        c.WarmupDuration.String(),
+				"warmup_min_concurrency": c.WarmupConfig.min(),
+				"warmup_max_concurrency": c.WarmupConfig.max(),
+				"warmup_after_failures":  c.WarmupAfterFailures,
+			},
+		})
+	}
+
+	if c.EnableAdaptiveLimit {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: AdaptiveLimitProxyType,
+			Params: map[string]any{
+				"adaptive_limit_min":       c.AdaptiveLimitConfig.min(),
+				"adaptive_limit_max":       c.AdaptiveLimitConfig.max(),
+				"adaptive_limit_window":    c.AdaptiveLimitConfig.window().String(),
+				"adaptive_limit_tolerance": c.AdaptiveLimitConfig.tolerance(),
+			},
+		})
+	}
+
+	if c.EnableBackpressure {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: BackpressureProxyType,
+			Params: map[string]any{
+				"congestion_window_min":  c.CongestionWindowMin,
+				"congestion_window_max":  c.CongestionWindowMax,
+				"enable_low_cost_bypass": c.EnableLowCostBypass,
+				"cost_weighted_window":   c.EnableCostWeightedWindow,
+				"enable_cost_tiers":      c.CostTiers.EnableCostTiers,
+				"tenant_fairness":        c.TenantFairness.EnableTenantFairness,
+				"allowance_mode":         c.AllowanceMode,
+				"criticality_shedding":   c.EnableCriticalityShedding,
+				"shared_window":          c.SharedWindow.EnableSharedWindow,
+				"leader_election":        c.LeaderElection.EnableLeaderElection,
+				"persistence":            c.Persistence.EnablePersistence,
+				"queries":                len(c.BackpressureQueries),
+				"schedules":              len(c.Schedules),
+				"monitoring_urls":        len(c.monitorURLs()),
+				"monitor_failure_policy": c.MonitorFailurePolicy,
+			},
+		})
+	}
+
+	if c.EnableCostFeedback {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: CostFeedbackProxyType,
+			Params: map[string]any{
+				"samples_per_cost_unit": c.CostFeedbackConfig.samplesPerUnit(),
+				"cost_feedback_alpha":   c.CostFeedbackConfig.alpha(),
+				"cost_feedback_size":    c.CostFeedbackConfig.size(),
+			},
+		})
+	}
+
+	if c.EnableLabelInjection {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type:   LabelInjectorProxyType,
+			Params: map[string]any{"inject_labels": c.InjectLabels},
+		})
+	}
+
+	if c.EnableStepAlignment {
+		middlewares = append(middlewares, MiddlewareDescription{Type: StepAlignProxyType})
+	}
+
+	if c.EnableMirror {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: MirrorProxyType,
+			Params: map[string]any{
+				"mirror_upstream":    RedactURL(c.MirrorUpstream),
+				"mirror_percent":     c.MirrorConfig.percent(),
+				"mirror_concurrency": c.MirrorConfig.concurrency(),
+			},
+		})
+	}
+
+	if c.EnableSharding {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: ShardProxyType,
+			Params: map[string]any{
+				"shard_interval":    c.ShardConfig.interval().String(),
+				"shard_concurrency": c.ShardConfig.concurrency(),
+			},
+		})
+	}
+
+	if c.EnableRetry {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: RetryProxyType,
+			Params: map[string]any{
+				"retry_max_attempts": c.RetryConfig.maxAttempts(),
+				"retry_budget_ratio": c.RetryConfig.budgetRatio(),
+				"retry_budget_max":   c.RetryConfig.budgetMax(),
+				"retry_backoff":      c.RetryConfig.backoff().String(),
+				"retry_max_wait":     c.RetryConfig.maxWait().String(),
+			},
+		})
+	}
+
+	if c.EnableChaos {
+		middlewares = append(middlewares, MiddlewareDescription{
+			Type: ChaosProxyType,
+			Params: map[string]any{
+				"chaos_header":          c.ChaosHeader,
+				"chaos_latency":         c.ChaosLatency.String(),
+				"chaos_latency_percent": c.ChaosLatencyPercent,
+				"chaos_error_percent":   c.ChaosErrorPercent,
+				"chaos_error_status":    c.ChaosConfig.errorStatus(),
+				"chaos_drop_percent":    c.ChaosDropPercent,
+			},
+		})
+	}
+
+	for _, mw := range c.Middlewares {
+		var params map[string]any
+		if len(mw.Options) > 0 {
+			params = redactedSection(mw.Type, mw.Options)
+		}
+		middlewares = append(middlewares, MiddlewareDescription{Type: mw.Type, Params: params})
+	}
+
+	reorder(middlewares, func(d MiddlewareDescription) string { return d.Type }, c.MiddlewareOrder)
+	return middlewares
+}
+
+// middlewareTypes lists the types of the enabled middlewares in chain order
+func (c Config) middlewareTypes() []string {
+	middlewares := c.Describe()
+	types := make([]string, len(middlewares))
+	for i, mw := range middlewares {
+		types[i] = mw.Type
+	}
+	return types
+}
+
+// Signals lists the backpressure queries monitored when backpressure is enabled.
+func (c Config) Signals() []SignalDescription {
+	signals := []SignalDescription{}
+	if !c.EnableBackpressure {
+		return signals
+	}
+
+	for _, q := range c.BackpressureQueries {
+		signals = append(signals, describeSignal(q))
+	}
+	return signals
+}
+
+func describeSignal(q BackpressureQuery) SignalDescription {
+	return SignalDescription{
+		Name:               q.Name,
+		Query:              q.Query,
+		Backend:            q.backend(),
+		Weight:             q.Weight,
+		MaxThrottle:        q.MaxThrottle,
+		SmoothingAlpha:     q.SmoothingAlpha,
+		Aggregation:        q.Aggregation,
+		Direction:          q.Direction,
+		WarningQuery:       q.WarningThresholdQuery,
+		EmergencyQuery:     q.EmergencyThresholdQuery,
+		SlopeSamples:       q.SlopeSamples,
+		SlopeWarning:       q.SlopeWarningThreshold,
+		SlopeEmergency:     q.SlopeEmergencyThreshold,
+		AnomalyWindow:      q.AnomalyWindow,
+		AnomalyWarning:     q.AnomalyWarningStddevs,
+		AnomalyEmergency:   q.AnomalyEmergencyStddevs,
+		WarningThreshold:   q.WarningThreshold,
+		EmergencyThreshold: q.EmergencyThreshold,
+	}
+}
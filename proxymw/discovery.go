@@ -0,0 +1,141 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DNSSRVPrefix marks URLs whose host is an SRV record, like Thanos addresses, e.g.
+	// dnssrv+http://_web._tcp.prometheus.monitoring.svc.cluster.local resolves to the target
+	// host and port of every SRV record with the scheme and path of the URL
+	DNSSRVPrefix = "dnssrv+"
+
+	// DNSRefreshInterval is how often SRV records are resolved again
+	DNSRefreshInterval = 30 * time.Second
+	// dnsLookupTimeout bounds each resolution of the SRV records
+	dnsLookupTimeout = 5 * time.Second
+)
+
+var (
+	ErrInvalidDNSSRVURL = errors.New(
+		"dnssrv+ URLs must be http or https with an SRV record name as the host and no port",
+	)
+	ErrNoSRVTargets = errors.New("no SRV records found")
+)
+
+// srvLookup matches net.Resolver.LookupSRV
+type srvLookup func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+// IsDNSSRV reports whether the URL is discovered through SRV records
+func IsDNSSRV(raw string) bool {
+	return strings.HasPrefix(raw, DNSSRVPrefix)
+}
+
+// DiscoveredURL resolves a dnssrv+ URL to one URL per SRV target. Targets are re-resolved by Run
+// and the last successful resolution is kept while lookups fail.
+type DiscoveredURL struct {
+	base   *url.URL
+	lookup srvLookup
+
+	mu      sync.RWMutex
+	targets []*url.URL
+	next    atomic.Uint64
+}
+
+// NewDiscoveredURL parses a dnssrv+ URL with an http or https scheme
+func NewDiscoveredURL(raw string) (*DiscoveredURL, error) {
+	base, err := url.Parse(strings.TrimPrefix(raw, DNSSRVPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Hostname() == "" || base.Port() != "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDNSSRVURL, raw)
+	}
+	return &DiscoveredURL{base: base, lookup: net.DefaultResolver.LookupSRV}, nil
+}
+
+// Resolve looks up the SRV records and replaces the targets when any are found
+func (d *DiscoveredURL) Resolve(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	_, records, err := d.lookup(ctx, "", "", d.base.Hostname())
+	if err != nil {
+		return fmt.Errorf("lookup %s: %w", d.base.Hostname(), err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSRVTargets, d.base.Hostname())
+	}
+
+	targets := make([]*url.URL, 0, len(records))
+	for _, srv := range records {
+		target := *d.base
+		host := strings.TrimSuffix(srv.Target, ".")
+		target.Host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		targets = append(targets, &target)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.targets = targets
+	return nil
+}
+
+// Run resolves the records every interval until the context is done
+func (d *DiscoveredURL) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Resolve(ctx); err != nil {
+				log.Printf("keeping previous targets of %s: %v", d, err)
+			}
+		}
+	}
+}
+
+// Targets returns the resolved URLs, rotated by one on every call so callers trying them in
+// order spread their requests across the targets
+func (d *DiscoveredURL) Targets() []*url.URL {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.targets) == 0 {
+		return nil
+	}
+
+	offset := int((d.next.Add(1) - 1) % uint64(len(d.targets)))
+	return slices.Concat(d.targets[offset:], d.targets[:offset])
+}
+
+// Next returns the targets round-robin, or nil before the first successful resolution
+func (d *DiscoveredURL) Next() *url.URL {
+	if targets := d.Targets(); len(targets) > 0 {
+		return targets[0]
+	}
+	return nil
+}
+
+// URL returns a copy of the URL with the SRV record name as its host
+func (d *DiscoveredURL) URL() *url.URL {
+	u := *d.base
+	return &u
+}
+
+func (d *DiscoveredURL) String() string {
+	return DNSSRVPrefix + d.base.String()
+}
@@ -0,0 +1,122 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDiscoveredURL(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		raw string
+		err bool
+	}{
+		{raw: "dnssrv+http://_web._tcp.prometheus.svc"},
+		{raw: "dnssrv+https://_web._tcp.prometheus.svc/prometheus"},
+		{raw: "dnssrv+tcp://_web._tcp.prometheus.svc", err: true},
+		{raw: "dnssrv+http://_web._tcp.prometheus.svc:9090", err: true},
+		{raw: "dnssrv+http://", err: true},
+	} {
+		t.Run(tt.raw, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewDiscoveredURL(tt.raw)
+			if tt.err {
+				require.ErrorIs(t, err, ErrInvalidDNSSRVURL)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// fakeSRV answers lookups with the records until err is set
+type fakeSRV struct {
+	records []*net.SRV
+	err     error
+}
+
+func (f *fakeSRV) lookup(context.Context, string, string, string) (string, []*net.SRV, error) {
+	return "", f.records, f.err
+}
+
+func urlStrings(urls []*url.URL) []string {
+	out := make([]string, 0, len(urls))
+	for _, u := range urls {
+		out = append(out, u.String())
+	}
+	return out
+}
+
+func TestDiscoveredURLResolve(t *testing.T) {
+	t.Parallel()
+	d, err := NewDiscoveredURL("dnssrv+https://_web._tcp.prometheus.svc/prometheus")
+	require.NoError(t, err)
+	fake := &fakeSRV{records: []*net.SRV{
+		{Target: "prometheus-0.prometheus.svc.", Port: 9090},
+		{Target: "prometheus-1.prometheus.svc.", Port: 9091},
+	}}
+	d.lookup = fake.lookup
+
+	require.Nil(t, d.Next())
+	require.NoError(t, d.Resolve(context.Background()))
+
+	require.Equal(t, []string{
+		"https://prometheus-0.prometheus.svc:9090/prometheus",
+		"https://prometheus-1.prometheus.svc:9091/prometheus",
+	}, urlStrings(d.Targets()))
+	require.Equal(t, []string{
+		"https://prometheus-1.prometheus.svc:9091/prometheus",
+		"https://prometheus-0.prometheus.svc:9090/prometheus",
+	}, urlStrings(d.Targets()))
+	require.Equal(t, "prometheus-0.prometheus.svc:9090", d.Next().Host)
+	require.Equal(t, "prometheus-1.prometheus.svc:9091", d.Next().Host)
+
+	// failed and empty lookups keep the previous targets
+	fake.err = errors.New("no such host")
+	require.Error(t, d.Resolve(context.Background()))
+	fake.err, fake.records = nil, nil
+	require.ErrorIs(t, d.Resolve(context.Background()), ErrNoSRVTargets)
+	require.Len(t, d.Targets(), 2)
+
+	require.Equal(t, "_web._tcp.prometheus.svc", d.URL().Host)
+	require.Equal(t, "dnssrv+https://_web._tcp.prometheus.svc/prometheus", d.String())
+}
+
+func TestMonitorEndpoints(t *testing.T) {
+	t.Parallel()
+	static := "http://thanos:9090"
+	srv := "dnssrv+http://_web._tcp.prometheus.svc"
+	bp := &Backpressure{
+		monitorURLs: []string{srv, static},
+		discovered:  discoverURLs([]string{srv, static}),
+	}
+	require.Len(t, bp.discovered, 1)
+	require.Equal(t, []string{static}, bp.monitorEndpoints())
+
+	bp.discovered[srv].lookup = (&fakeSRV{records: []*net.SRV{
+		{Target: "prometheus-0.", Port: 9090},
+		{Target: "prometheus-1.", Port: 9090},
+	}}).lookup
+	require.NoError(t, bp.discovered[srv].Resolve(context.Background()))
+	require.Equal(t, []string{
+		"http://prometheus-0:9090", "http://prometheus-1:9090", static,
+	}, bp.monitorEndpoints())
+	require.Equal(t, []string{
+		"http://prometheus-1:9090", "http://prometheus-0:9090", static,
+	}, bp.monitorEndpoints())
+
+	require.ErrorIs(t, BackpressureConfig{
+		EnableBackpressure:        true,
+		BackpressureMonitoringURL: "dnssrv+http://prometheus:9090",
+		BackpressureQueries: []BackpressureQuery{
+			{Name: "errors", Query: "sum(errors)", WarningThreshold: 1, EmergencyThreshold: 2},
+		},
+		CongestionWindowMin: 1,
+		CongestionWindowMax: 10,
+	}.Validate(), ErrInvalidDNSSRVURL)
+}
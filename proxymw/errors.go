@@ -3,33 +3,139 @@ package proxymw
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"time"
 )
 
 var (
 	ErrJitterDelayRequired       = errors.New("delay must be non-empty when jitter is enabled")
+	ErrUnknownJitterStrategy     = errors.New("jitter strategy must be full, equal, exponential, or normal")
+	ErrNegativeJitterStddev      = errors.New("jitter stddev cannot be negative")
+	ErrNegativeTenantStatsWindow = errors.New("tenant stats window cannot be negative")
+	ErrNegativeTopFingerprints   = errors.New("top fingerprints cannot be negative")
+	ErrRateLimitRequired         = errors.New("rate limit must be > 0 when rate limiting is enabled")
+	ErrInvalidPathTemplate       = errors.New("observer path templates must start with /")
+	ErrNegativeAdaptiveLimit     = errors.New("adaptive limit bounds and window cannot be negative")
+	ErrAdaptiveLimitMaxBelowMin  = errors.New("adaptive limit max must be >= min")
+	ErrAdaptiveLimitTolerance    = errors.New("adaptive limit tolerance must be at least 1")
+	ErrWarmupDurationRequired    = errors.New("warm-up duration must be > 0 when warm-up is enabled")
+	ErrNegativeWarmup            = errors.New("warm-up concurrency and failures cannot be negative")
+	ErrWarmupMaxBelowMin         = errors.New("warm-up max concurrency must be >= min")
+	ErrNegativeRateLimitDuration = errors.New("rate limit window and redis timeout cannot be negative")
 	ErrBackpressureQueryRequired = errors.New(
 		"must provide at least one backpressure query when backpressure is enabled",
 	)
-	ErrCongestionWindowMinBelowOne = errors.New("backpressure min window < 1")
-	ErrCongestionWindowMaxBelowMin = errors.New("backpressure max window <= min window")
-	ErrNegativeThrottleCurve       = errors.New("throttle curve cannot be negative")
-	ErrNegativeQueryThresholds     = errors.New("backpressure query thresholds cannot be negative")
-	ErrEmergencyBelowWarnThreshold = errors.New("emergency threshold must be > warn threshold")
-	ErrExtraQueryQuotes            = errors.New("backpressure PromQL cannot be wrapped in quotes")
+	ErrInvalidMonitorFailurePolicy = errors.New(
+		"backpressure monitor failure policy must be keep_last, open, or closed",
+	)
+	ErrCongestionWindowMinBelowOne   = errors.New("backpressure min window < 1")
+	ErrCongestionWindowMaxBelowMin   = errors.New("backpressure max window <= min window")
+	ErrNegativeThrottleCurve         = errors.New("throttle curve cannot be negative")
+	ErrNegativeQueryThresholds       = errors.New("backpressure query thresholds cannot be negative")
+	ErrEmergencyBelowWarnThreshold   = errors.New("emergency threshold must be > warn threshold")
+	ErrEmergencyAboveWarnThreshold   = errors.New("emergency threshold must be < warn threshold for below queries")
+	ErrInvalidDirection              = errors.New("backpressure query direction must be above or below")
+	ErrExtraQueryQuotes              = errors.New("backpressure PromQL cannot be wrapped in quotes")
+	ErrCriticalPlusReserveRange      = errors.New("critical plus reserve must be >= 0 and < min window")
+	ErrInvalidAllowanceMode          = errors.New("backpressure allowance mode must be window or probabilistic")
+	ErrInvalidMonitorStrategy        = errors.New("backpressure monitor strategy must be failover or max")
+	ErrUnknownBackend                = errors.New("unknown backpressure query backend")
+	ErrUnknownAggregation            = errors.New("backpressure query aggregation must be max, min, avg, or sum")
+	ErrQueryWeightRange              = errors.New("backpressure query weight and max throttle must be within [0, 1]")
+	ErrSmoothingAlphaRange           = errors.New("backpressure query smoothing alpha must be within [0, 1]")
+	ErrSlopeSamplesRange             = errors.New("backpressure query slope samples must be 0 or at least 2")
+	ErrSlopeThresholds               = errors.New("backpressure query slope emergency must be > warning >= 0")
+	ErrAnomalyWindowRange            = errors.New("backpressure query anomaly window must be 0 or at least 2")
+	ErrAnomalyStddevs                = errors.New("backpressure query anomaly emergency stddevs must be > warning >= 0")
+	ErrAnomalyThresholdQuery         = errors.New("backpressure query anomaly window excludes threshold queries")
+	ErrAllowanceRecoveryRange        = errors.New("allowance recovery step must be within [0, 1] and cooldown >= 0")
+	ErrNegativeUnreadyAfterEmergency = errors.New("unready after emergency duration cannot be negative")
+	ErrNegativeIdleDecay             = errors.New("idle decay duration cannot be negative")
+	ErrUnknownMiddleware             = errors.New("unknown middleware stage")
+	ErrDuplicateMiddleware           = errors.New("middleware stage name already used")
+	ErrInvalidMiddlewareOrder        = errors.New("invalid middleware order")
+	ErrPromQLUnsupported             = errors.New("PromQL features are unavailable in builds with the nopromql tag")
+	ErrRedisUnsupported              = errors.New("Redis features are unavailable in builds with the nopromql tag")
+	ErrRemoteWriteUnsupported        = errors.New("remote-write limits are unavailable in builds with the nopromql tag")
 
 	ErrBackpressureBackoff = BlockErr(
 		BackpressureProxyType,
 		"congestion window closed, backoff from backpressure",
 	)
+	ErrBackpressureDropped = BlockErr(
+		BackpressureProxyType,
+		"request dropped by probabilistic backpressure",
+	)
 
 	ErrNilRequest        = errors.New("nil *http.Request")
 	ErrNilResponseWriter = errors.New("nil http.ResponseWriter")
 	ErrNilResponse       = errors.New("nil *http.Response")
+
+	// ErrThrottled rejects requests over a rate, concurrency, or congestion limit. Retrying after
+	// the Retry-After may succeed.
+	ErrThrottled = &RejectionReason{reason: "request throttled", status: http.StatusTooManyRequests}
+	// ErrQuotaExceeded rejects requests of a tenant which spent its hourly or daily budget
+	ErrQuotaExceeded = &RejectionReason{reason: "quota exceeded", status: http.StatusTooManyRequests}
+	// ErrBlockedByPattern rejects requests matching a blocker pattern or CIDR
+	ErrBlockedByPattern = &RejectionReason{
+		reason: "request blocked by pattern",
+		status: http.StatusTooManyRequests,
+	}
+	// ErrQueryRejected rejects queries which are invalid or exceed a guardrail, retrying cannot help
+	ErrQueryRejected = &RejectionReason{reason: "query rejected", status: http.StatusBadRequest}
+	// ErrDeadlinePassed rejects requests whose client deadline passed before they were sent. The
+	// upstream could not answer in time, so it is a gateway timeout rather than a throttle.
+	ErrDeadlinePassed = &RejectionReason{
+		reason: "request deadline passed",
+		status: http.StatusGatewayTimeout,
+	}
+	// ErrUnknownCriticality rejects requests whose X-Request-Criticality header is not a known
+	// criticality, retrying cannot help
+	ErrUnknownCriticality = &RejectionReason{
+		reason: "unknown request criticality",
+		status: http.StatusBadRequest,
+	}
+	// ErrMaintenance rejects requests while the proxy is in closed maintenance mode
+	ErrMaintenance = &RejectionReason{
+		reason: "proxy in maintenance",
+		status: http.StatusServiceUnavailable,
+	}
+
+	// rejectionReasons are the reasons of middleware types blocking for something besides load
+	rejectionReasons = map[string]*RejectionReason{
+		QuotaProxyType:       ErrQuotaExceeded,
+		BlockerProxyType:     ErrBlockedByPattern,
+		GuardrailProxyType:   ErrQueryRejected,
+		TimeoutProxyType:     ErrDeadlinePassed,
+		CriticalityProxyType: ErrUnknownCriticality,
+		MaintenanceProxyType: ErrMaintenance,
+	}
 )
 
+// RejectionReason is why a request was rejected. A RequestBlockedError matches its reason with
+// errors.Is, so embedders of the RoundTripper branch on it without knowing every middleware type,
+// e.g. errors.Is(err, ErrQuotaExceeded).
+type RejectionReason struct {
+	reason string
+	status int
+}
+
+func (r *RejectionReason) Error() string {
+	return r.reason
+}
+
+// HTTPStatus is the status ServeEntry answers rejections for the reason with by default
+func (r *RejectionReason) HTTPStatus() int {
+	return r.status
+}
+
 type RequestBlockedError struct {
 	Err  error
 	Type string
+	// RetryAfter overrides the configured Retry-After response header when set
+	RetryAfter time.Duration
+	// Headers are added to the rejection response, e.g. the remaining quota
+	Headers map[string]string
 }
 
 func (e *RequestBlockedError) Error() string {
@@ -39,6 +145,32 @@ func (e *RequestBlockedError) Error() string {
 	return e.Err.Error()
 }
 
+// Unwrap returns the error the request was blocked with, e.g. ErrBackpressureBackoff
+func (e *RequestBlockedError) Unwrap() error {
+	return e.Err
+}
+
+// Reason is why the request was rejected. Middlewares which block on load, including registered
+// ones, reject with ErrThrottled.
+func (e *RequestBlockedError) Reason() *RejectionReason {
+	if reason, ok := rejectionReasons[e.Type]; ok {
+		return reason
+	}
+	return ErrThrottled
+}
+
+// Is matches the reason of the rejection
+func (e *RequestBlockedError) Is(target error) bool {
+	reason, ok := target.(*RejectionReason)
+	return ok && reason == e.Reason()
+}
+
+// HTTPStatus is the status ServeEntry answers the rejection with unless the rejections config
+// overrides it
+func (e *RequestBlockedError) HTTPStatus() int {
+	return e.Reason().HTTPStatus()
+}
+
 func BlockErr(t string, format string, a ...any) error {
 	return &RequestBlockedError{
 		Err:  fmt.Errorf(format, a...),
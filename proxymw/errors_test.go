@@ -0,0 +1,109 @@
+package proxymw
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectionReason(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name   string
+		err    error
+		reason *RejectionReason
+		status int
+	}{
+		{name: "backpressure", err: ErrBackpressureBackoff, reason: ErrThrottled, status: http.StatusTooManyRequests},
+		{
+			name:   "rate limit",
+			err:    &RequestBlockedError{Type: RateLimitProxyType, Err: errors.New("over")},
+			reason: ErrThrottled,
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "registered middleware",
+			err:    BlockErr("mycorp_auth", "denied"),
+			reason: ErrThrottled,
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "quota",
+			err:    &RequestBlockedError{Type: QuotaProxyType, Err: errors.New("spent")},
+			reason: ErrQuotaExceeded,
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "blocker",
+			err:    BlockErr(BlockerProxyType, "blocked"),
+			reason: ErrBlockedByPattern,
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "guardrail",
+			err:    BlockErr(GuardrailProxyType, "invalid query"),
+			reason: ErrQueryRejected,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "timeout",
+			err:    BlockErr(TimeoutProxyType, "deadline passed"),
+			reason: ErrDeadlinePassed,
+			status: http.StatusGatewayTimeout,
+		},
+		{
+			name: "criticality",
+			err: &RequestBlockedError{
+				Err:  fmt.Errorf("%w: %q", ErrUnknownCriticality, "URGENT"),
+				Type: CriticalityProxyType,
+			},
+			reason: ErrUnknownCriticality,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "wrapped maintenance",
+			err:    fmt.Errorf("round trip: %w", BlockErr(MaintenanceProxyType, "upgrading")),
+			reason: ErrMaintenance,
+			status: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.err, tt.reason)
+			for _, other := range []error{ErrThrottled, ErrQuotaExceeded, ErrBlockedByPattern, ErrQueryRejected} {
+				if other != tt.reason {
+					require.NotErrorIs(t, tt.err, other)
+				}
+			}
+
+			var blocked *RequestBlockedError
+			require.ErrorAs(t, tt.err, &blocked)
+			require.Equal(t, tt.status, blocked.HTTPStatus())
+			require.Equal(t, tt.status, tt.reason.HTTPStatus())
+		})
+	}
+
+	require.ErrorIs(t, ErrBackpressureBackoff, ErrBackpressureBackoff, "sentinel rejections still match")
+	require.NotErrorIs(t, ErrBackpressureDropped, ErrBackpressureBackoff)
+}
+
+func TestRejectionReasonRoundTrip(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-block=user"},
+		},
+	}
+	entry := NewRoundTripperFromConfig(cfg, &Mocker{})
+	req := httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody)
+	req.Header.Set("X-block", "user")
+
+	_, err := entry.RoundTrip(req)
+	require.ErrorIs(t, err, ErrBlockedByPattern)
+	require.NotErrorIs(t, err, ErrThrottled)
+}
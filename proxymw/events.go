@@ -0,0 +1,202 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// EventsPath is where the internal server streams throttle decisions as server-sent events
+	EventsPath = "/api/v1/events"
+
+	// EventRequestBlocked is published when a middleware rejects a request at an entry point
+	EventRequestBlocked = "request_blocked"
+	// EventWindowShrunk is published when backpressure lowers the allowance of the window
+	EventWindowShrunk = "window_shrunk"
+	// EventQueryStale is published when a backpressure query starts failing and its last value
+	// goes stale
+	EventQueryStale = "query_stale"
+
+	// DefaultEventBuffer is how many events a subscriber can fall behind before events are
+	// dropped for it
+	DefaultEventBuffer = 256
+)
+
+var (
+	eventsDroppedCount = defaultMetricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxymw_events_dropped_total",
+		Help: "Events dropped because a subscriber fell behind, by event type",
+	}, []string{"type"})
+
+	// activeEvents delivers the events of every chain in the process
+	activeEvents = &eventBus{}
+)
+
+// Event is a throttle decision delivered to subscribers
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Source is the proxy type publishing the event, or that blocked the request
+	Source  string `json:"source"`
+	Message string `json:"message,omitempty"`
+	// Fields are the event specific values, e.g. the allowance of a shrunk window or the path of
+	// a blocked request
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+type subscriber struct {
+	events chan Event
+	done   chan struct{}
+}
+
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []*subscriber
+}
+
+// subscribe delivers every event to fn on its own goroutine until unsubscribed. Events are
+// dropped rather than blocking the publisher when fn falls more than buffer events behind.
+func (b *eventBus) subscribe(fn func(Event), buffer int) func() {
+	s := &subscriber{events: make(chan Event, buffer), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for e := range s.events {
+			fn(e)
+		}
+	}()
+
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, s)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.subscribers = slices.DeleteFunc(b.subscribers, func(other *subscriber) bool {
+				return other == s
+			})
+			b.mu.Unlock()
+			close(s.events)
+			<-s.done
+		})
+	}
+}
+
+func (b *eventBus) active() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subscribers) > 0
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range b.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			eventsDroppedCount.WithLabelValues(e.Type).Inc()
+		}
+	}
+}
+
+// Subscribe calls fn with every throttle decision published in the process until the returned
+// function is called. fn runs on its own goroutine, one event at a time; events are dropped
+// while it is more than DefaultEventBuffer events behind so slow subscribers never stall
+// requests. Unsubscribing waits for fn to finish the events already delivered, so fn must not
+// unsubscribe itself.
+func Subscribe(fn func(Event)) (unsubscribe func()) {
+	return activeEvents.subscribe(fn, DefaultEventBuffer)
+}
+
+// publishEvent builds the event only when someone is listening, keeping the hot path free of
+// allocations otherwise
+func publishEvent(build func() Event) {
+	if activeEvents.active() {
+		activeEvents.publish(build())
+	}
+}
+
+// publishBlocked publishes a request_blocked event when err is a block
+func publishBlocked(rr Request, err error) {
+	var blocked *RequestBlockedError
+	if !errors.As(err, &blocked) {
+		return
+	}
+
+	publishEvent(func() Event {
+		req := rr.Request()
+		return Event{
+			Type:    EventRequestBlocked,
+			Source:  blocked.Type,
+			Message: blocked.Error(),
+			Fields: map[string]any{
+				"method": req.Method,
+				"path":   req.URL.Path,
+			},
+		}
+	})
+}
+
+// EventsHandler streams events as server-sent events until the client disconnects. Repeated
+// ?type= parameters only stream the given event types.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// the stream outlives the write timeout of the internal server
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	types := r.URL.Query()["type"]
+	events := make(chan Event, DefaultEventBuffer)
+	unsubscribe := activeEvents.subscribe(func(e Event) {
+		if len(types) == 0 || slices.Contains(types, e.Type) {
+			select {
+			case events <- e:
+			default:
+				eventsDroppedCount.WithLabelValues(e.Type).Inc()
+			}
+		}
+	}, DefaultEventBuffer)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("error streaming events: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("error encoding event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package proxymw
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBus(t *testing.T) {
+	t.Parallel()
+	b := &eventBus{}
+	require.False(t, b.active())
+
+	received := make(chan Event, 1)
+	unsubscribe := b.subscribe(func(e Event) { received <- e }, 1)
+	require.True(t, b.active())
+
+	b.publish(Event{Type: EventWindowShrunk})
+	e := <-received
+	require.Equal(t, EventWindowShrunk, e.Type)
+	require.False(t, e.Time.IsZero())
+
+	unsubscribe()
+	unsubscribe()
+	require.False(t, b.active())
+
+	// a stuck subscriber drops events instead of blocking the publisher
+	release := make(chan struct{})
+	unsubscribe = b.subscribe(func(Event) { <-release }, 1)
+	dropped := eventsDroppedCount.WithLabelValues(EventQueryStale)
+	before := testutil.ToFloat64(dropped)
+	for range 3 {
+		b.publish(Event{Type: EventQueryStale})
+	}
+	require.Greater(t, testutil.ToFloat64(dropped), before)
+	close(release)
+	unsubscribe()
+}
+
+// TestEvents subscribes to the process wide events, so it does not run in parallel with the
+// tests publishing them
+func TestEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	unsubscribe := Subscribe(func(e Event) { events <- e })
+	defer unsubscribe()
+
+	entry := NewServeFromConfig(Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-User-Agent=scraper.*"},
+		},
+	}, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, entry.Init(context.Background()))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	r.Header.Set("X-User-Agent", "scraper-v1")
+	entry.ServeHTTP(httptest.NewRecorder(), r)
+
+	e := <-events
+	require.Equal(t, EventRequestBlocked, e.Type)
+	require.Equal(t, BlockerProxyType, e.Source)
+	require.Equal(t, "/api/v1/query", e.Fields["path"])
+
+	q := BackpressureQuery{Name: "load", Query: "load", WarningThreshold: 80, EmergencyThreshold: 100}
+	bp := newBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin:       1,
+		CongestionWindowMax:       100,
+		BackpressureMonitoringURL: "http://prometheus",
+		BackpressureQueries:       []BackpressureQuery{q},
+	}, newBackpressureMetrics(promauto.With(prometheus.NewRegistry())))
+
+	bp.queryFailed(q)
+	bp.queryFailed(q)
+	e = <-events
+	require.Equal(t, EventQueryStale, e.Type)
+	require.Equal(t, "load", e.Fields["query"])
+
+	bp.updateThrottle(q, 90)
+	e = <-events
+	require.Equal(t, EventWindowShrunk, e.Type)
+	require.Equal(t, BackpressureProxyType, e.Source)
+	require.Equal(t, 1.0, e.Fields["previous_allowance"])
+	require.Equal(t, bp.Allowance(), e.Fields["allowance"])
+	require.Less(t, bp.Allowance(), 1.0)
+
+	// recovering does not publish
+	bp.updateThrottle(q, 50)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(EventsHandler))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?type="+EventQueryStale, http.NoBody)
+	require.NoError(t, err)
+	res, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// the stream is subscribed once the headers arrive
+	publishEvent(func() Event { return Event{Type: EventWindowShrunk} })
+	publishEvent(func() Event {
+		return Event{Type: EventQueryStale, Source: BackpressureProxyType, Message: "stream-test"}
+	})
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			require.Equal(t, "event: "+EventQueryStale, line)
+			continue
+		}
+
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(data), &e))
+		if e.Message == "stream-test" {
+			require.Equal(t, BackpressureProxyType, e.Source)
+			return
+		}
+	}
+	t.Fatal("stream ended before the event arrived")
+}
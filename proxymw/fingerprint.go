@@ -0,0 +1,26 @@
+package proxymw
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	fingerprintStrings = regexp.MustCompile("\"(?:[^\"\\\\]|\\\\.)*\"|'(?:[^'\\\\]|\\\\.)*'|`[^`]*`")
+	fingerprintNumbers = regexp.MustCompile(`\b[0-9]+(?:\.[0-9]+)?(?:e[+-]?[0-9]+)?(?:ms|[smhdwy])?\b`)
+	fingerprintSpaces  = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint normalizes a query by replacing string literals, numbers, and durations with a
+// placeholder so queries that only differ by label values or time ranges group together.
+func Fingerprint(query string) string {
+	query = fingerprintStrings.ReplaceAllString(query, "?")
+	query = fingerprintNumbers.ReplaceAllString(query, "?")
+	return strings.TrimSpace(fingerprintSpaces.ReplaceAllString(query, " "))
+}
+
+// requestQuery returns the query form value without consuming the original request body.
+func requestQuery(req *http.Request) string {
+	return requestForm(req).Get("query")
+}
@@ -0,0 +1,169 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const FingerprintLimitProxyType = "fingerprint_limit"
+
+var ErrFingerprintLimitRequired = errors.New(
+	"fingerprint limiting requires fingerprint qps > 0 or fingerprint limits with a query and qps > 0",
+)
+
+// FingerprintLimit caps the QPS of every query with the same fingerprint as Query
+type FingerprintLimit struct {
+	Query string  `yaml:"query"`
+	QPS   float64 `yaml:"qps"`
+}
+
+// FingerprintLimitConfig rate limits queries by their Fingerprint so a single runaway query shape,
+// like a dashboard refreshing far too often, is throttled without affecting other traffic.
+type FingerprintLimitConfig struct {
+	EnableFingerprintLimit bool `yaml:"enable_fingerprint_limit"`
+	// FingerprintQPS limits every fingerprint. Zero only limits the FingerprintLimits.
+	FingerprintQPS float64 `yaml:"fingerprint_qps"`
+	// FingerprintLimits override FingerprintQPS for the fingerprints of specific queries
+	FingerprintLimits []FingerprintLimit `yaml:"fingerprint_limits"`
+}
+
+func (c FingerprintLimitConfig) Validate() error {
+	if !c.EnableFingerprintLimit {
+		return nil
+	}
+
+	if c.FingerprintQPS < 0 || (c.FingerprintQPS == 0 && len(c.FingerprintLimits) == 0) {
+		return ErrFingerprintLimitRequired
+	}
+
+	for _, l := range c.FingerprintLimits {
+		if l.Query == "" || l.QPS <= 0 {
+			return ErrFingerprintLimitRequired
+		}
+	}
+	return nil
+}
+
+// limits maps normalized fingerprints to their configured QPS
+func (c FingerprintLimitConfig) limits() map[string]float64 {
+	limits := make(map[string]float64, len(c.FingerprintLimits))
+	for _, l := range c.FingerprintLimits {
+		limits[Fingerprint(l.Query)] = l.QPS
+	}
+	return limits
+}
+
+// tokenBucket refills at qps tokens per second up to a burst of one second of tokens
+type tokenBucket struct {
+	qps    float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(qps float64, now time.Time) *tokenBucket {
+	return &tokenBucket{qps: qps, tokens: burst(qps), last: now}
+}
+
+func burst(qps float64) float64 {
+	return max(1, math.Ceil(qps))
+}
+
+func (b *tokenBucket) refill(now time.Time) float64 {
+	return min(burst(b.qps), b.tokens+now.Sub(b.last).Seconds()*b.qps)
+}
+
+// FingerprintLimiter blocks queries whose fingerprint exceeds its QPS with a token bucket per
+// fingerprint. Requests without a query, like label lookups, are not limited.
+type FingerprintLimiter struct {
+	client     ProxyClient
+	defaultQPS float64
+	limits     map[string]float64
+	now        func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+var _ ProxyClient = &FingerprintLimiter{}
+
+func NewFingerprintLimiter(client ProxyClient, cfg FingerprintLimitConfig) *FingerprintLimiter {
+	return &FingerprintLimiter{
+		client:     client,
+		defaultQPS: cfg.FingerprintQPS,
+		limits:     cfg.limits(),
+		now:        time.Now,
+		buckets:    map[string]*tokenBucket{},
+	}
+}
+
+func (fl *FingerprintLimiter) Init(ctx context.Context) error {
+	return fl.client.Init(ctx)
+}
+
+func (fl *FingerprintLimiter) Next(rr Request) error {
+	query := requestQuery(rr.Request())
+	if query == "" {
+		return fl.client.Next(rr)
+	}
+
+	fingerprint := Fingerprint(query)
+	qps, ok := fl.limits[fingerprint]
+	if !ok {
+		qps = fl.defaultQPS
+	}
+
+	if qps > 0 {
+		if wait := fl.take(fingerprint, qps); wait > 0 {
+			return &RequestBlockedError{
+				Err:        fmt.Errorf("query fingerprint exceeded %g qps: %s", qps, fingerprint),
+				Type:       FingerprintLimitProxyType,
+				RetryAfter: wait,
+			}
+		}
+	}
+	return fl.client.Next(rr)
+}
+
+// take consumes a token of the fingerprint and returns how long until one is available when the
+// bucket is empty
+func (fl *FingerprintLimiter) take(fingerprint string, qps float64) time.Duration {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	now := fl.now()
+	fl.sweep(now)
+
+	b, ok := fl.buckets[fingerprint]
+	if !ok {
+		b = newTokenBucket(qps, now)
+		fl.buckets[fingerprint] = b
+	}
+
+	b.tokens = b.refill(now)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / qps * float64(time.Second))
+	}
+
+	b.tokens--
+	return 0
+}
+
+// sweep drops buckets that refilled since their last request, which behave the same as a new
+// bucket, so one-off fingerprints do not pile up. Assumes the callsite already holds the lock.
+func (fl *FingerprintLimiter) sweep(now time.Time) {
+	if now.Sub(fl.swept) < time.Minute {
+		return
+	}
+
+	fl.swept = now
+	for fingerprint, b := range fl.buckets {
+		if b.refill(now) >= burst(b.qps) {
+			delete(fl.buckets, fingerprint)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package proxymw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintLimitConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name    string
+		cfg     FingerprintLimitConfig
+		wantErr bool
+	}{
+		{name: "disabled", cfg: FingerprintLimitConfig{}},
+		{
+			name: "default qps",
+			cfg:  FingerprintLimitConfig{EnableFingerprintLimit: true, FingerprintQPS: 1},
+		},
+		{
+			name: "specific limits",
+			cfg: FingerprintLimitConfig{
+				EnableFingerprintLimit: true,
+				FingerprintLimits:      []FingerprintLimit{{Query: "up", QPS: 0.1}},
+			},
+		},
+		{
+			name:    "no limits",
+			cfg:     FingerprintLimitConfig{EnableFingerprintLimit: true},
+			wantErr: true,
+		},
+		{
+			name: "missing query",
+			cfg: FingerprintLimitConfig{
+				EnableFingerprintLimit: true,
+				FingerprintLimits:      []FingerprintLimit{{QPS: 1}},
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.wantErr {
+				require.ErrorIs(t, err, ErrFingerprintLimitRequired)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestFingerprintLimiter(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1_700_000_000, 0)
+	fl := NewFingerprintLimiter(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, FingerprintLimitConfig{
+		EnableFingerprintLimit: true,
+		FingerprintQPS:         2,
+		FingerprintLimits: []FingerprintLimit{
+			{Query: `sum(rate(http_requests_total{job="api"}[5m]))`, QPS: 0.5},
+		},
+	})
+	fl.now = func() time.Time { return now }
+
+	// the same dashboard query with a different label value shares a fingerprint
+	runaway := `sum(rate(http_requests_total{job="web"}[1h]))`
+	require.NoError(t, fl.Next(quotaRequest("", runaway)))
+
+	err := fl.Next(quotaRequest("", runaway))
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, FingerprintLimitProxyType, blocked.Type)
+	require.Equal(t, 2*time.Second, blocked.RetryAfter)
+	require.EqualError(
+		t, err, "query fingerprint exceeded 0.5 qps: sum(rate(http_requests_total{job=?}[?]))",
+	)
+
+	// other fingerprints are limited by the default qps
+	require.NoError(t, fl.Next(quotaRequest("", "up")))
+	require.NoError(t, fl.Next(quotaRequest("", "up")))
+	require.ErrorAs(t, fl.Next(quotaRequest("", "up")), &blocked)
+
+	now = now.Add(2 * time.Second)
+	require.NoError(t, fl.Next(quotaRequest("", runaway)))
+
+	// refilled buckets are swept
+	now = now.Add(time.Hour)
+	require.NoError(t, fl.Next(quotaRequest("", "up")))
+	require.Len(t, fl.buckets, 1)
+}
@@ -0,0 +1,30 @@
+package proxymw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{
+			query: `sum(rate(http_requests_total{job="api"}[5m]))`,
+			want:  `sum(rate(http_requests_total{job=?}[?]))`,
+		},
+		{
+			query: "histogram_quantile(0.99,\n  rate(http_2xx_bucket{env='prod'}[1h] offset 1d))",
+			want:  `histogram_quantile(?, rate(http_2xx_bucket{env=?}[?] offset ?))`,
+		},
+		{
+			query: "{app=`web`} |= \"timeout \\\" quoted\" > 10",
+			want:  `{app=?} |= ? > ?`,
+		},
+	} {
+		require.Equal(t, tt.want, Fingerprint(tt.query))
+	}
+}
@@ -0,0 +1,196 @@
+package proxymw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// rewriteForm applies fn to the URL query parameters and the url-encoded POST body of the
+// request, updating the request in place so the upstream receives the rewritten parameters.
+func rewriteForm(req *http.Request, fn func(url.Values) error) error {
+	defer formCacheFrom(req.Context()).store(nil)
+
+	q := req.URL.Query()
+	if err := fn(q); err != nil {
+		return err
+	}
+	req.URL.RawQuery = q.Encode()
+
+	if req.Form != nil {
+		if err := fn(req.Form); err != nil {
+			return err
+		}
+	}
+
+	if req.Body == nil || req.Body == http.NoBody || !isFormEncoded(req) {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+
+	if err := fn(form); err != nil {
+		return err
+	}
+
+	encoded := []byte(form.Encode())
+	req.Body = io.NopCloser(bytes.NewReader(encoded))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(encoded)), nil
+	}
+	req.ContentLength = int64(len(encoded))
+	req.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+	req.PostForm = nil
+	return nil
+}
+
+func isFormEncoded(req *http.Request) bool {
+	return req.Header.Get("Content-Type") == "application/x-www-form-urlencoded"
+}
+
+// requestForm parses the URL query and form body of a duplicate request so the original body is
+// left for the upstream. Returns empty values when the request cannot be parsed.
+func requestForm(req *http.Request) url.Values {
+	form, err := parsedForm(req)
+	if err != nil {
+		return url.Values{}
+	}
+	return form
+}
+
+// parsedForm parses the form of a duplicate request once per request and shares the values with
+// every middleware through the form cache of the request context. Callers must not modify the
+// returned values.
+func parsedForm(req *http.Request) (url.Values, error) {
+	cache := formCacheFrom(req.Context())
+	if form, ok := cache.load(); ok {
+		return form, nil
+	}
+
+	dup, err := DupRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dup.ParseForm(); err != nil {
+		return nil, err
+	}
+	cache.store(dup.Form)
+	return dup.Form, nil
+}
+
+type formCacheKey struct{}
+
+// formCache holds the parsed form of a request until rewriteForm changes it
+type formCache struct {
+	mu   sync.Mutex
+	form url.Values
+	// costs estimate the query cost of the request in the chain it passes through
+	costs *chainCosts
+}
+
+// withFormCache adds an empty form cache to the context of a request entering the chain.
+// Sub-requests keep the query cost cache of their parent.
+func withFormCache(ctx context.Context) context.Context {
+	cache := &formCache{}
+	if parent := formCacheFrom(ctx); parent != nil {
+		cache.costs = parent.chainCosts()
+	}
+	return context.WithValue(ctx, formCacheKey{}, cache)
+}
+
+// formCacheFrom returns the form cache of the request or nil outside of a chain
+func formCacheFrom(ctx context.Context) *formCache {
+	cache, _ := ctx.Value(formCacheKey{}).(*formCache)
+	return cache
+}
+
+func (c *formCache) load() (url.Values, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.form, c.form != nil
+}
+
+func (c *formCache) store(form url.Values) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.form = form
+}
+
+func (c *formCache) chainCosts() *chainCosts {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.costs
+}
+
+func (c *formCache) storeChainCosts(costs *chainCosts) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.costs = costs
+}
+
+// parseTime parses a Prometheus API timestamp given as unix seconds or RFC 3339
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// formatTime formats a timestamp as unix seconds with the millisecond precision of Prometheus
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1e3, 'f', -1, 64)
+}
+
+// parseDuration parses a Prometheus API duration given as seconds or like 5m
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
@@ -0,0 +1,42 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsedFormCache(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query?time=1", strings.NewReader("query=up"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(withFormCache(req.Context()))
+
+	form, err := parsedForm(req)
+	require.NoError(t, err)
+	require.Equal(t, "up", form.Get("query"))
+	require.Equal(t, "1", form.Get("time"))
+
+	// later middlewares share the parsed values
+	cached, ok := formCacheFrom(req.Context()).load()
+	require.True(t, ok)
+	require.Equal(t, form, cached)
+
+	// rewriting the form invalidates the cache
+	require.NoError(t, rewriteForm(req, func(form url.Values) error {
+		form.Set("query", "sum(up)")
+		return nil
+	}))
+	_, ok = formCacheFrom(req.Context()).load()
+	require.False(t, ok)
+	require.Equal(t, "sum(up)", requestQuery(req))
+
+	// requests outside of a chain parse their form every time
+	plain := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", http.NoBody)
+	require.Equal(t, "up", requestQuery(plain))
+	require.Nil(t, formCacheFrom(plain.Context()))
+}
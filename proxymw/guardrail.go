@@ -0,0 +1,156 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	GuardrailProxyType = "guardrail"
+
+	// DefaultMaxPointsPerSeries matches the resolution limit of the Prometheus range query API
+	DefaultMaxPointsPerSeries = 11000
+
+	// QueryPath and QueryRangePath are the Prometheus query APIs the guardrails apply to
+	QueryPath      = "/api/v1/query"
+	QueryRangePath = "/api/v1/query_range"
+)
+
+var ErrNegativeGuardrail = errors.New("guardrail range, step, and points cannot be negative")
+
+// GuardrailConfig rejects invalid queries and range queries too expensive to be worth sending
+// upstream, like the limits Grafana enforces on its own data source queries. Rejected queries get a 400 bad_data
+// response unless overridden in Rejections, since retrying the same query cannot succeed.
+type GuardrailConfig struct {
+	EnableGuardrails bool `yaml:"enable_guardrails"`
+	// MaxQueryRange rejects queries whose end is further than this from their start, e.g. 744h
+	// for 31 days. Disabled when 0.
+	MaxQueryRange time.Duration `yaml:"max_query_range"`
+	// MinQueryStep rejects queries with a finer resolution. Disabled when 0.
+	MinQueryStep time.Duration `yaml:"min_query_step"`
+	// MaxPointsPerSeries rejects queries returning more samples per series, estimated as the range
+	// divided by the step. Defaults to 11000.
+	MaxPointsPerSeries int `yaml:"max_points_per_series"`
+	// ValidateQuerySyntax parses instant and range queries up front and rejects invalid PromQL
+	// with the parse error before it takes a congestion window slot or upstream capacity
+	ValidateQuerySyntax bool `yaml:"validate_query_syntax"`
+}
+
+func (c GuardrailConfig) Validate() error {
+	if !c.EnableGuardrails {
+		return nil
+	}
+
+	if c.MaxQueryRange < 0 || c.MinQueryStep < 0 || c.MaxPointsPerSeries < 0 {
+		return ErrNegativeGuardrail
+	}
+
+	if c.ValidateQuerySyntax && !promQLSupported {
+		return ErrPromQLUnsupported
+	}
+	return nil
+}
+
+func (c GuardrailConfig) maxPoints() int {
+	if c.MaxPointsPerSeries == 0 {
+		return DefaultMaxPointsPerSeries
+	}
+	return c.MaxPointsPerSeries
+}
+
+// Guardrail rejects range queries exceeding the configured range, resolution, or points per
+// series, and optionally queries which are not valid PromQL. Queries with unparseable time
+// parameters are passed on for the upstream to reject.
+type Guardrail struct {
+	client         ProxyClient
+	maxRange       time.Duration
+	minStep        time.Duration
+	maxPoints      int
+	validateSyntax bool
+}
+
+var _ ProxyClient = &Guardrail{}
+
+func NewGuardrail(client ProxyClient, cfg GuardrailConfig) *Guardrail {
+	return &Guardrail{
+		client:         client,
+		maxRange:       cfg.MaxQueryRange,
+		minStep:        cfg.MinQueryStep,
+		maxPoints:      cfg.maxPoints(),
+		validateSyntax: cfg.ValidateQuerySyntax,
+	}
+}
+
+func (g *Guardrail) Init(ctx context.Context) error {
+	return g.client.Init(ctx)
+}
+
+func (g *Guardrail) Next(rr Request) error {
+	if err := g.check(rr.Request()); err != nil {
+		return err
+	}
+	return g.client.Next(rr)
+}
+
+func (g *Guardrail) check(req *http.Request) error {
+	if req.URL.Path != QueryPath && req.URL.Path != QueryRangePath {
+		return nil
+	}
+
+	form, err := parsedForm(req)
+	if err != nil {
+		return nil
+	}
+
+	if g.validateSyntax {
+		if err := validatePromQL(form.Get("query")); err != nil {
+			return BlockErr(GuardrailProxyType, "invalid query: %v", err)
+		}
+	}
+
+	if req.URL.Path != QueryRangePath {
+		return nil
+	}
+	return g.checkRange(form)
+}
+
+// checkRange applies the range, step, and points per series limits to a range query
+func (g *Guardrail) checkRange(form url.Values) error {
+	start, err := parseTime(form.Get("start"))
+	if err != nil {
+		return nil
+	}
+	end, err := parseTime(form.Get("end"))
+	if err != nil {
+		return nil
+	}
+	step, err := parseDuration(form.Get("step"))
+	if err != nil || step <= 0 {
+		return nil
+	}
+
+	span := end.Sub(start)
+	if g.maxRange > 0 && span > g.maxRange {
+		return BlockErr(
+			GuardrailProxyType, "query range %s exceeds the maximum of %s", span, g.maxRange,
+		)
+	}
+
+	if step < g.minStep {
+		return BlockErr(
+			GuardrailProxyType, "query step %s is below the minimum of %s", step, g.minStep,
+		)
+	}
+
+	if points := int64(span/step) + 1; points > int64(g.maxPoints) {
+		return BlockErr(
+			GuardrailProxyType,
+			"query would return %d points per series, exceeding the maximum of %d",
+			points, g.maxPoints,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardrailSyntax(t *testing.T) {
+	t.Parallel()
+	var forwarded int
+	g := NewGuardrail(&Mocker{NextFunc: func(Request) error {
+		forwarded++
+		return nil
+	}}, GuardrailConfig{EnableGuardrails: true, ValidateQuerySyntax: true})
+
+	request := func(path, query string) Request {
+		form := url.Values{"query": {query}, "start": {"0"}, "end": {"60"}, "step": {"15"}}
+		req := httptest.NewRequest(http.MethodGet, path+"?"+form.Encode(), http.NoBody)
+		return &RequestResponseWrapper{req: req}
+	}
+
+	require.NoError(t, g.Next(request(QueryPath, `sum by (job) (rate(http_requests_total[5m]))`)))
+	require.NoError(t, g.Next(request(QueryRangePath, `up{job="api"}`)))
+
+	err := g.Next(request(QueryPath, `sum(rate(http_requests_total[5m])`))
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, GuardrailProxyType, blocked.Type)
+	require.ErrorContains(t, err, "invalid query: 1:")
+
+	require.Error(t, g.Next(request(QueryRangePath, "")))
+	// other APIs have no query to validate
+	require.NoError(t, g.Next(request("/api/v1/labels", "")))
+	require.Equal(t, 3, forwarded)
+}
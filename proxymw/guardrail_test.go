@@ -0,0 +1,103 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardrailConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, GuardrailConfig{}.Validate())
+	require.NoError(t, GuardrailConfig{EnableGuardrails: true}.Validate())
+	require.ErrorIs(t, GuardrailConfig{
+		EnableGuardrails: true,
+		MinQueryStep:     -time.Second,
+	}.Validate(), ErrNegativeGuardrail)
+	require.ErrorIs(t, Config{GuardrailConfig: GuardrailConfig{
+		EnableGuardrails:   true,
+		MaxPointsPerSeries: -1,
+	}}.Validate(), ErrNegativeGuardrail)
+}
+
+func TestGuardrail(t *testing.T) {
+	t.Parallel()
+	g := NewGuardrail(&Mocker{NextFunc: func(Request) error { return nil }}, GuardrailConfig{
+		EnableGuardrails: true,
+		MaxQueryRange:    31 * 24 * time.Hour,
+		MinQueryStep:     15 * time.Second,
+	})
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		form   url.Values
+		post   bool
+		errMsg string
+	}{
+		{
+			name: "within limits",
+			path: QueryRangePath,
+			form: url.Values{"query": {"up"}, "start": {"0"}, "end": {"86400"}, "step": {"60"}},
+		},
+		{
+			name:   "range too long",
+			path:   QueryRangePath,
+			form:   url.Values{"query": {"up"}, "start": {"0"}, "end": {"2764800"}, "step": {"1h"}},
+			errMsg: "query range 768h0m0s exceeds the maximum of 744h0m0s",
+		},
+		{
+			name: "step too fine",
+			path: QueryRangePath,
+			form: url.Values{
+				"query": {"up"},
+				"start": {"2024-01-01T00:00:00Z"},
+				"end":   {"2024-01-01T01:00:00Z"},
+				"step":  {"5s"},
+			},
+			errMsg: "query step 5s is below the minimum of 15s",
+		},
+		{
+			name:   "too many points in a post body",
+			path:   QueryRangePath,
+			form:   url.Values{"query": {"up"}, "start": {"0"}, "end": {"604800"}, "step": {"15"}},
+			post:   true,
+			errMsg: "query would return 40321 points per series, exceeding the maximum of 11000",
+		},
+		{
+			name: "unparseable parameters are left to the upstream",
+			path: QueryRangePath,
+			form: url.Values{"query": {"up"}, "start": {"yesterday"}, "end": {"0"}, "step": {"1"}},
+		},
+		{
+			name: "instant queries are not limited",
+			path: "/api/v1/query",
+			form: url.Values{"query": {"up[90d]"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.form.Encode(), http.NoBody)
+			if tt.post {
+				req = httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			err := g.Next(&RequestResponseWrapper{req: req})
+			if tt.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			var blocked *RequestBlockedError
+			require.ErrorAs(t, err, &blocked)
+			require.Equal(t, GuardrailProxyType, blocked.Type)
+			require.EqualError(t, err, tt.errMsg)
+		})
+	}
+}
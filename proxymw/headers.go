@@ -5,6 +5,28 @@ type HeaderKey string
 const (
 	HeaderCriticality HeaderKey = "X-Request-Criticality"
 	HeaderCanWait     HeaderKey = "X-Can-Wait"
+	// HeaderGlobalQuery set to true skips label injection for intentionally global queries
+	HeaderGlobalQuery HeaderKey = "X-Global-Query"
+	// HeaderRequestDeadline is the absolute deadline of the client as RFC 3339 or unix milliseconds
+	HeaderRequestDeadline HeaderKey = "X-Request-Deadline"
+	// HeaderTimeoutMs is the remaining time budget of the client in milliseconds
+	HeaderTimeoutMs HeaderKey = "X-Timeout-Ms"
+
+	// HeaderRetryAfter tells blocked clients how long to wait before retrying
+	HeaderRetryAfter HeaderKey = "Retry-After"
+	// HeaderThrottleReason names the middleware type that rejected the request
+	HeaderThrottleReason HeaderKey = "X-Throttle-Reason"
+	// HeaderQuotaLimit, HeaderQuotaRemaining, and HeaderQuotaReset describe the exhausted quota
+	// of a tenant. Reset is the number of seconds until the quota window rolls over.
+	HeaderQuotaLimit     HeaderKey = "X-Quota-Limit"
+	HeaderQuotaRemaining HeaderKey = "X-Quota-Remaining"
+	HeaderQuotaReset     HeaderKey = "X-Quota-Reset"
+	// HeaderThrottleAllowance is the share of traffic backpressure admits, from 0 to 1, and
+	// HeaderThrottleWatermark the congestion window it admits into
+	HeaderThrottleAllowance HeaderKey = "X-Throttle-Allowance"
+	HeaderThrottleWatermark HeaderKey = "X-Throttle-Watermark"
+	// HeaderJitterAppliedMs is the jitter the request was delayed by in milliseconds
+	HeaderJitterAppliedMs HeaderKey = "X-Jitter-Applied-Ms"
 )
 
 var (
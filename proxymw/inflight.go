@@ -0,0 +1,191 @@
+package proxymw
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/pprof"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// InflightPath is where the internal server lists the proxied requests in flight
+	InflightPath = "/debug/inflight"
+
+	// InflightStageEntry is the stage of requests not yet waiting in any middleware
+	InflightStageEntry = "entry"
+	// InflightStageUpstream is the stage of requests waiting on the upstream response
+	InflightStageUpstream = "upstream"
+
+	// pprof labels of goroutines handling proxied requests, so profiles of the internal server
+	// can be sliced by traffic class
+	profileLabelPath   = "path"
+	profileLabelTenant = "tenant"
+	profileLabelStage  = "stage"
+)
+
+// activeInflight tracks the requests in flight through every entry point in the process
+var activeInflight = &inflightRegistry{requests: map[uint64]*inflightRequest{}}
+
+// InflightRequest is a proxied request in flight
+type InflightRequest struct {
+	ID          uint64    `json:"id"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Tenant      string    `json:"tenant"`
+	Criticality string    `json:"criticality"`
+	Start       time.Time `json:"start"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	// Stage is the middleware the request is waiting in, e.g. jitter or backpressure, and State
+	// what it waits for there, e.g. sleeping or holding a window slot
+	Stage string `json:"stage"`
+	State string `json:"state,omitempty"`
+}
+
+type inflightStage struct {
+	stage, state string
+}
+
+type inflightRequest struct {
+	id          uint64
+	method      string
+	path        string
+	tenant      string
+	criticality string
+	start       time.Time
+	stage       atomic.Pointer[inflightStage]
+	decisions   requestDecisions
+}
+
+type inflightRegistry struct {
+	mu       sync.Mutex
+	lastID   uint64
+	requests map[uint64]*inflightRequest
+}
+
+type inflightKey struct{}
+
+// track registers the request and labels the calling goroutine with its path, tenant, and stage
+// until the returned function is called
+func (r *inflightRegistry) track(
+	ctx context.Context, req *http.Request, tenantHeader string,
+) (context.Context, func()) {
+	tenant := req.Header.Get(tenantHeader)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	criticality := req.Header.Get(string(HeaderCriticality))
+	if criticality == "" {
+		criticality = CriticalityDefault
+	}
+
+	ir := &inflightRequest{
+		method:      req.Method,
+		path:        req.URL.Path,
+		tenant:      tenant,
+		criticality: criticality,
+		start:       time.Now(),
+	}
+	ir.stage.Store(&inflightStage{stage: InflightStageEntry})
+
+	r.mu.Lock()
+	r.lastID++
+	ir.id = r.lastID
+	r.requests[ir.id] = ir
+	r.mu.Unlock()
+
+	parent := ctx
+	ctx = pprof.WithLabels(context.WithValue(ctx, inflightKey{}, ir), pprof.Labels(
+		profileLabelPath, ir.path,
+		profileLabelTenant, ir.tenant,
+		profileLabelStage, InflightStageEntry,
+	))
+	pprof.SetGoroutineLabels(ctx)
+	return ctx, func() {
+		pprof.SetGoroutineLabels(parent)
+		r.mu.Lock()
+		delete(r.requests, ir.id)
+		r.mu.Unlock()
+	}
+}
+
+// list returns the requests in flight, oldest first
+func (r *inflightRegistry) list(now time.Time) []InflightRequest {
+	r.mu.Lock()
+	requests := make([]InflightRequest, 0, len(r.requests))
+	for _, ir := range r.requests {
+		stage := ir.stage.Load()
+		requests = append(requests, InflightRequest{
+			ID:          ir.id,
+			Method:      ir.method,
+			Path:        ir.path,
+			Tenant:      ir.tenant,
+			Criticality: ir.criticality,
+			Start:       ir.start,
+			AgeSeconds:  now.Sub(ir.start).Seconds(),
+			Stage:       stage.stage,
+			State:       stage.state,
+		})
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(requests, func(a, b InflightRequest) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return requests
+}
+
+// enterStage marks the request, and the stage label of the calling goroutine, as waiting in the
+// stage until the returned function restores the previous stage. Requests not tracked by an entry
+// point are left alone.
+func enterStage(rr Request, stage, state string) func() {
+	ctx := rr.Request().Context()
+	ir, ok := inflightFrom(ctx)
+	if !ok {
+		return func() {}
+	}
+
+	previous := ir.stage.Swap(&inflightStage{stage: stage, state: state})
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(profileLabelStage, stage)))
+	return func() {
+		ir.stage.Store(previous)
+		pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(profileLabelStage, previous.stage)))
+	}
+}
+
+// InflightRequests returns the proxied requests in flight, oldest first
+func InflightRequests() []InflightRequest {
+	return activeInflight.list(time.Now())
+}
+
+// InflightHandler lists the proxied requests in flight, oldest first. ?min_age= only lists
+// requests older than the duration and ?stage= those waiting in the given stage.
+func InflightHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var minAge time.Duration
+	if value := params.Get("min_age"); value != "" {
+		var err error
+		if minAge, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "min_age must be a duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stage := params.Get("stage")
+	requests := slices.DeleteFunc(InflightRequests(), func(ir InflightRequest) bool {
+		return ir.AgeSeconds < minAge.Seconds() || (stage != "" && ir.Stage != stage)
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(requests); err != nil {
+		log.Printf("error writing in-flight requests: %v", err)
+	}
+}
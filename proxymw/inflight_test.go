@@ -0,0 +1,104 @@
+package proxymw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightRegistry(t *testing.T) {
+	t.Parallel()
+	r := &inflightRegistry{requests: map[uint64]*inflightRequest{}}
+	req := httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody)
+	req.Header.Set("X-Tenant", "team-a")
+	req.Header.Set(string(HeaderCriticality), CriticalityCritical)
+
+	ctx, done := r.track(context.Background(), req, "X-Tenant")
+	tenant, _ := pprof.Label(ctx, profileLabelTenant)
+	require.Equal(t, "team-a", tenant)
+	other := httptest.NewRequest(http.MethodPost, "/other", http.NoBody)
+	_, doneOther := r.track(context.Background(), other, "X-Tenant")
+	rr := &RequestResponseWrapper{req: req.WithContext(ctx)}
+
+	leaveJitter := enterStage(rr, JitterProxyType, "sleeping")
+	requests := r.list(time.Now())
+	require.Len(t, requests, 2)
+	require.Equal(t, QueryPath, requests[0].Path)
+	require.Equal(t, "team-a", requests[0].Tenant)
+	require.Equal(t, CriticalityCritical, requests[0].Criticality)
+	require.Equal(t, JitterProxyType, requests[0].Stage)
+	require.Equal(t, "sleeping", requests[0].State)
+	require.Equal(t, DefaultTenant, requests[1].Tenant)
+	require.Equal(t, CriticalityDefault, requests[1].Criticality)
+	require.Equal(t, InflightStageEntry, requests[1].Stage)
+
+	leaveJitter()
+	require.Equal(t, InflightStageEntry, r.list(time.Now())[0].Stage)
+
+	done()
+	doneOther()
+	require.Empty(t, r.list(time.Now()))
+
+	// untracked requests are left alone
+	enterStage(&RequestResponseWrapper{req: req}, JitterProxyType, "sleeping")()
+}
+
+func TestInflightHandler(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	proxying := make(chan struct{})
+	entry := NewServeFromConfig(Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		close(proxying)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, entry.Init(t.Context()))
+
+	path := "/api/v1/query/inflight-test"
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Set(DefaultTenantHeader, "team-b")
+		entry.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-proxying
+
+	list := func(query string) []InflightRequest {
+		w := httptest.NewRecorder()
+		InflightHandler(w, httptest.NewRequest(http.MethodGet, InflightPath+query, http.NoBody))
+		require.Equal(t, http.StatusOK, w.Code)
+		var requests []InflightRequest
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &requests))
+		return slices.DeleteFunc(requests, func(ir InflightRequest) bool { return ir.Path != path })
+	}
+
+	requests := list("?stage=" + InflightStageUpstream)
+	require.Len(t, requests, 1)
+	require.Equal(t, "team-b", requests[0].Tenant)
+	require.Equal(t, "proxying", requests[0].State)
+	require.Empty(t, list("?min_age=1h"))
+	require.Empty(t, list("?stage="+JitterProxyType))
+
+	// the goroutine serving the request is labeled for profiles
+	var profile bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&profile, 1))
+	require.Contains(t, profile.String(), `"path":"`+path+`"`)
+	require.Contains(t, profile.String(), `"stage":"upstream", "tenant":"team-b"`)
+
+	close(release)
+	<-served
+	require.Empty(t, list(""))
+
+	w := httptest.NewRecorder()
+	InflightHandler(w, httptest.NewRequest(http.MethodGet, InflightPath+"?min_age=soon", http.NoBody))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
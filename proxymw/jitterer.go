@@ -2,14 +2,43 @@ package proxymw
 
 import (
 	"context"
-	"math/rand"
+	"fmt"
+	"strconv"
 	"time"
 )
 
 const (
-	NoJitter time.Duration = 0
+	JitterProxyType               = "jitter"
+	NoJitter        time.Duration = 0
+
+	// JitterTailFactor caps heavy tailed strategies at this multiple of the delay
+	JitterTailFactor = 4
+)
+
+// JitterStrategy is the distribution jitter is sampled from
+type JitterStrategy string
+
+const (
+	// JitterStrategyFull sleeps uniformly between 0 and the delay
+	JitterStrategyFull JitterStrategy = "full"
+	// JitterStrategyEqual always sleeps half the delay plus up to another half at random
+	JitterStrategyEqual JitterStrategy = "equal"
+	// JitterStrategyExponential has a mean of half the delay with a heavier tail
+	JitterStrategyExponential JitterStrategy = "exponential"
+	// JitterStrategyNormal has a mean of half the delay and a configurable standard deviation
+	JitterStrategyNormal JitterStrategy = "normal"
 )
 
+func (s JitterStrategy) Validate() error {
+	switch s {
+	case "", JitterStrategyFull, JitterStrategyEqual, JitterStrategyExponential,
+		JitterStrategyNormal:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownJitterStrategy, s)
+	}
+}
+
 // Jitterer sleeps for a random amount of jitter before passing the request through.
 // When EnableCriticality is set
 //
@@ -20,20 +49,39 @@ type Jitterer struct {
 	delay       time.Duration
 	client      ProxyClient
 	criticality bool
+	strategy    JitterStrategy
+	stddev      time.Duration
+	// clock and rand default to the system sources when nil
+	clock Clock
+	rand  Rand
 }
 
 var _ ProxyClient = &Jitterer{}
 
 func NewJitterer(client ProxyClient, delay time.Duration, criticality bool) *Jitterer {
+	return NewJittererWithStrategy(client, delay, criticality, JitterStrategyFull, 0)
+}
+
+// NewJittererWithStrategy creates a Jitterer sampling from the given distribution.
+// The stddev is only used by JitterStrategyNormal and defaults to a quarter of the delay.
+func NewJittererWithStrategy(
+	client ProxyClient,
+	delay time.Duration,
+	criticality bool,
+	strategy JitterStrategy,
+	stddev time.Duration,
+) *Jitterer {
 	return &Jitterer{
 		delay:       delay,
 		client:      client,
 		criticality: criticality,
+		strategy:    strategy,
+		stddev:      stddev,
 	}
 }
 
-func (j *Jitterer) Init(ctx context.Context) {
-	j.client.Init(ctx)
+func (j *Jitterer) Init(ctx context.Context) error {
+	return j.client.Init(ctx)
 }
 
 func (j *Jitterer) Next(rr Request) error {
@@ -42,27 +90,69 @@ func (j *Jitterer) Next(rr Request) error {
 		return err
 	}
 
-	j.sleep(rr, delay)
+	// spend a small remaining deadline budget on the request rather than waiting
+	if deadline, ok := rr.Request().Context().Deadline(); ok && time.Until(deadline) < delay {
+		delay = NoJitter
+	}
+
+	j.sleep(rr, j.sample(delay))
 	return j.client.Next(rr)
 }
 
-func (j *Jitterer) sleep(rr Request, delay time.Duration) {
-	if delay == 0 {
+func (j *Jitterer) sleep(rr Request, jitter time.Duration) {
+	recordJitter(rr, jitter)
+	setDecisionHeader(rr, HeaderJitterAppliedMs, strconv.FormatInt(jitter.Milliseconds(), 10))
+	if jitter <= 0 {
 		return
 	}
 
-	// nolint:gosec // rand not used for security purposes
-	jitter := time.Duration(rand.Intn(int(delay.Nanoseconds())))
+	defer enterStage(rr, JitterProxyType, "sleeping")()
+	start := time.Now()
+	defer func() { addServerTiming(rr, JitterProxyType, time.Since(start)) }()
+	timer := orSystemClock(j.clock).NewTimer(jitter)
+	defer timer.Stop()
 	select {
 	case <-rr.Request().Context().Done():
-	case <-time.After(jitter):
+	case <-timer.C():
+	}
+}
+
+// sample picks a jitter duration for the delay from the configured distribution
+func (j *Jitterer) sample(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return NoJitter
+	}
+
+	random := orSystemRand(j.rand)
+	half := float64(delay) / 2
+	limit := float64(delay * JitterTailFactor)
+	switch j.strategy {
+	case JitterStrategyEqual:
+		return time.Duration(half + random.Float64()*half)
+	case JitterStrategyExponential:
+		return time.Duration(min(random.ExpFloat64()*half, limit))
+	case JitterStrategyNormal:
+		stddev := float64(j.stddev)
+		if stddev == 0 {
+			stddev = float64(delay) / 4
+		}
+		return time.Duration(min(max(random.NormFloat64()*stddev+half, 0), limit))
+	default:
+		return time.Duration(random.Int63n(int64(delay)))
 	}
 }
 
 func (j *Jitterer) getDelay(rr Request) (time.Duration, error) {
-	if j.criticality && ParseHeaderKey(rr, HeaderCriticality) == CriticalityCriticalPlus {
-		// do not jitter if request is critical
-		return NoJitter, nil
+	if j.criticality {
+		criticality, err := ParseCriticality(rr)
+		if err != nil {
+			return 0, err
+		}
+
+		if criticality == CriticalityCriticalPlus {
+			// do not jitter if request is critical
+			return NoJitter, nil
+		}
 	}
 
 	delay := j.delay
@@ -2,7 +2,9 @@ package proxymw
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -105,6 +107,26 @@ func TestJitterGetDelay(t *testing.T) {
 			},
 			wantErr: parseErr,
 		},
+		{
+			name: "unknown criticality",
+			jitter: &Jitterer{
+				criticality: true,
+				delay:       time.Second,
+			},
+			req: &Mocker{
+				RequestFunc: func() *http.Request {
+					return &http.Request{
+						Header: http.Header{
+							string(HeaderCriticality): []string{"URGENT"},
+						},
+					}
+				},
+			},
+			wantErr: &RequestBlockedError{
+				Err:  fmt.Errorf("%w: %q", ErrUnknownCriticality, "URGENT"),
+				Type: CriticalityProxyType,
+			},
+		},
 		{
 			name: "no can wait set",
 			jitter: &Jitterer{
@@ -137,7 +159,6 @@ func TestJitterSleep(t *testing.T) {
 		name    string
 		req     Request
 		delay   time.Duration
-		jitter  *Jitterer
 		cleanup func()
 	}{
 		{
@@ -177,8 +198,53 @@ func TestJitterSleep(t *testing.T) {
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			tt.jitter.sleep(tt.req, tt.delay)
+			(&Jitterer{}).sleep(tt.req, tt.delay)
 			tt.cleanup()
 		})
 	}
 }
+
+func TestJitterSample(t *testing.T) {
+	t.Parallel()
+	delay := time.Second
+	for _, tt := range []struct {
+		strategy JitterStrategy
+		min, max time.Duration
+	}{
+		{strategy: JitterStrategyFull, min: 0, max: delay},
+		{strategy: JitterStrategyEqual, min: delay / 2, max: delay},
+		{strategy: JitterStrategyExponential, min: 0, max: delay * JitterTailFactor},
+		{strategy: JitterStrategyNormal, min: 0, max: delay * JitterTailFactor},
+	} {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			t.Parallel()
+			j := NewJittererWithStrategy(nil, delay, false, tt.strategy, 0)
+			require.Equal(t, NoJitter, j.sample(0))
+			for range 1000 {
+				jitter := j.sample(delay)
+				require.GreaterOrEqual(t, jitter, tt.min)
+				require.LessOrEqual(t, jitter, tt.max)
+			}
+		})
+	}
+
+	require.ErrorIs(t, JitterStrategy("pareto").Validate(), ErrUnknownJitterStrategy)
+}
+
+func TestJitterSmallDeadlineBudget(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	called := false
+	j := NewJitterer(&Mocker{NextFunc: func(Request) error {
+		called = true
+		return nil
+	}}, time.Hour, false)
+
+	// an hour of jitter would outlast the deadline so the request is sent right away
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody).WithContext(ctx)
+	require.NoError(t, j.Next(&RequestResponseWrapper{req: req}))
+	require.True(t, called)
+	require.NoError(t, ctx.Err())
+}
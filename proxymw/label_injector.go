@@ -0,0 +1,91 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+)
+
+const (
+	LabelInjectorProxyType = "label_injector"
+)
+
+type LabelInjectorConfig struct {
+	// EnableLabelInjection adds InjectLabels to every selector in proxied PromQL so a shared
+	// global querier isn't fanned out to every cluster by unscoped dashboard queries.
+	// Requests with the X-Global-Query header set to true are passed through unchanged.
+	EnableLabelInjection bool `yaml:"enable_label_injection"`
+	// InjectLabels are the label matchers to add, e.g. cluster: us-east-1
+	InjectLabels map[string]string `yaml:"inject_labels"`
+}
+
+func (c LabelInjectorConfig) Validate() error {
+	if !c.EnableLabelInjection {
+		return nil
+	}
+
+	if !promQLSupported {
+		return ErrPromQLUnsupported
+	}
+
+	if len(c.InjectLabels) == 0 {
+		return errors.New("must provide at least one label when label injection is enabled")
+	}
+	return nil
+}
+
+// LabelInjector rewrites instant and range PromQL queries to scope them to the configured labels.
+// Queries that fail to parse are forwarded untouched for the upstream to reject.
+type LabelInjector struct {
+	labels map[string]string
+	client ProxyClient
+}
+
+var _ ProxyClient = &LabelInjector{}
+
+func NewLabelInjector(client ProxyClient, cfg LabelInjectorConfig) *LabelInjector {
+	return &LabelInjector{
+		labels: cfg.InjectLabels,
+		client: client,
+	}
+}
+
+func (li *LabelInjector) Init(ctx context.Context) error {
+	return li.client.Init(ctx)
+}
+
+func (li *LabelInjector) Next(rr Request) error {
+	req := rr.Request()
+	if req.URL == nil || !isPromQLQueryPath(req.URL.Path) {
+		return li.client.Next(rr)
+	}
+
+	if global, _ := strconv.ParseBool(ParseHeaderKey(rr, HeaderGlobalQuery)); global {
+		return li.client.Next(rr)
+	}
+
+	err := rewriteForm(req, func(form url.Values) error {
+		query := form.Get("query")
+		if query == "" {
+			return nil
+		}
+
+		injected, err := injectLabelMatchers(query, li.labels)
+		if err != nil {
+			return err
+		}
+		form.Set("query", injected)
+		return nil
+	})
+	if err != nil {
+		log.Printf("forwarding query without label injection: %v", err)
+	}
+
+	return li.client.Next(rr)
+}
+
+func isPromQLQueryPath(path string) bool {
+	return path == "/api/v1/query" || path == "/api/v1/query_range"
+}
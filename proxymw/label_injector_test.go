@@ -0,0 +1,131 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectLabelMatchers(t *testing.T) {
+	t.Parallel()
+	inject := map[string]string{"cluster": "us-east-1"}
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  string
+		err   bool
+	}{
+		{
+			name:  "unscoped selector",
+			query: `sum(rate(http_requests_total[5m]))`,
+			want:  `sum(rate(http_requests_total{cluster="us-east-1"}[5m]))`,
+		},
+		{
+			name:  "every selector in a binary expression",
+			query: `up / on(job) group_left kube_pod_info{namespace="a"}`,
+			want:  `up{cluster="us-east-1"} / on (job) group_left () kube_pod_info{cluster="us-east-1",namespace="a"}`,
+		},
+		{
+			name:  "explicit cluster kept",
+			query: `up{cluster="eu-west-1"}`,
+			want:  `up{cluster="eu-west-1"}`,
+		},
+		{
+			name:  "invalid promql",
+			query: `sum(`,
+			err:   true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := injectLabelMatchers(tt.query, inject)
+			require.Equal(t, tt.err, err != nil, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLabelInjector(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name      string
+		req       func() *http.Request
+		wantQuery string
+	}{
+		{
+			name: "GET query rewritten",
+			req: func() *http.Request {
+				r, _ := http.NewRequestWithContext(
+					ctx, http.MethodGet, "http://localhost/api/v1/query?query=up", http.NoBody,
+				)
+				return r
+			},
+			wantQuery: `up{cluster="us-east-1"}`,
+		},
+		{
+			name: "POST form rewritten",
+			req: func() *http.Request {
+				form := url.Values{"query": []string{"up"}, "start": []string{"1"}}
+				r, _ := http.NewRequestWithContext(
+					ctx, http.MethodPost, "http://localhost/api/v1/query_range",
+					strings.NewReader(form.Encode()),
+				)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			},
+			wantQuery: `up{cluster="us-east-1"}`,
+		},
+		{
+			name: "global query escape hatch",
+			req: func() *http.Request {
+				r, _ := http.NewRequestWithContext(
+					ctx, http.MethodGet, "http://localhost/api/v1/query?query=up", http.NoBody,
+				)
+				r.Header.Set(string(HeaderGlobalQuery), "true")
+				return r
+			},
+			wantQuery: "up",
+		},
+		{
+			name: "other paths untouched",
+			req: func() *http.Request {
+				r, _ := http.NewRequestWithContext(
+					ctx, http.MethodGet, "http://localhost/api/v1/labels?query=up", http.NoBody,
+				)
+				return r
+			},
+			wantQuery: "up",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			li := NewLabelInjector(&Mocker{
+				NextFunc: func(rr Request) error {
+					r := rr.Request()
+					if r.Body != nil && r.Body != http.NoBody {
+						body, err := io.ReadAll(r.Body)
+						require.NoError(t, err)
+						require.Equal(t, int64(len(body)), r.ContentLength)
+						r.Body = io.NopCloser(strings.NewReader(string(body)))
+					}
+					require.NoError(t, r.ParseForm())
+					got = r.Form.Get("query")
+					return nil
+				},
+			}, LabelInjectorConfig{
+				EnableLabelInjection: true,
+				InjectLabels:         map[string]string{"cluster": "us-east-1"},
+			})
+
+			require.NoError(t, li.Next(&RequestResponseWrapper{req: tt.req()}))
+			require.Equal(t, tt.wantQuery, got)
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package proxymw
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// LeaderElectionRedis holds the leader lock as a Redis key with a TTL
+	LeaderElectionRedis = "redis"
+	// LeaderElectionKubernetes holds the leader lock as a coordination.k8s.io/v1 Lease
+	LeaderElectionKubernetes = "kubernetes"
+
+	DefaultLeaderRedisKey  = "throttle-proxy:bp:leader"
+	DefaultLeaderLeaseName = "throttle-proxy-bp-leader"
+	// DefaultLeaderLeaseDuration lets the leader miss two polls before another replica takes over
+	DefaultLeaderLeaseDuration = 3 * BackpressureUpdateCadence
+
+	// leaderAllowanceAnnotation is the Lease annotation holding the published allowance
+	leaderAllowanceAnnotation = "throttle-proxy.kevindweb.github.io/allowance"
+
+	// kubeMicroTime is the format of the MicroTime fields of a Lease
+	kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+var (
+	ErrLeaderElectionRedisRequired  = errors.New("redis leader election requires a redis address")
+	ErrInvalidLeaderElectionBackend = errors.New("leader election backend must be redis or kubernetes")
+	ErrLeaderLeaseTooShort          = fmt.Errorf(
+		"leader lease duration must be longer than the %s backpressure update cadence",
+		BackpressureUpdateCadence,
+	)
+	ErrNoPublishedAllowance = errors.New("the leader has not published an allowance")
+
+	errLeaseNotFound = errors.New("lease not found")
+	errLeaseConflict = errors.New("lease was modified by another replica")
+)
+
+// LeaderElectionConfig lets one replica of a fleet poll the backpressure queries and share the
+// allowance it computes, so N replicas with identical queries send one set of queries to the
+// monitoring endpoints instead of N. Followers adopt the published allowance and poll the
+// queries themselves whenever the election fails or the leader stops publishing.
+type LeaderElectionConfig struct {
+	EnableLeaderElection bool `yaml:"enable_leader_election"`
+	// Backend is "redis" (default) or "kubernetes". The kubernetes backend uses the in-cluster
+	// service account, which needs get, create, update, and patch on leases.
+	Backend   string `yaml:"backend"`
+	RedisAddr string `yaml:"redis_addr"`
+	// RedisKey holds the leader lock and RedisKey:allowance the published allowance
+	RedisKey string `yaml:"redis_key"`
+	// LeaseName is the Lease holding the leader lock and the published allowance
+	LeaseName string `yaml:"lease_name"`
+	// LeaseNamespace defaults to the namespace of the service account
+	LeaseNamespace string `yaml:"lease_namespace"`
+	// LeaseDuration is how long leadership and a published allowance last without a renewal.
+	// Defaults to three times the backpressure update cadence.
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	// ReplicaID identifies this replica as the leader. Defaults to the hostname.
+	ReplicaID string `yaml:"replica_id"`
+}
+
+func (c LeaderElectionConfig) Validate() error {
+	if !c.EnableLeaderElection {
+		return nil
+	}
+
+	switch c.Backend {
+	case "", LeaderElectionRedis:
+		if c.RedisAddr == "" {
+			return ErrLeaderElectionRedisRequired
+		}
+	case LeaderElectionKubernetes:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidLeaderElectionBackend, c.Backend)
+	}
+
+	if c.LeaseDuration != 0 && c.LeaseDuration <= BackpressureUpdateCadence {
+		return ErrLeaderLeaseTooShort
+	}
+
+	if c.Backend != LeaderElectionKubernetes && !redisSupported {
+		return ErrRedisUnsupported
+	}
+	return nil
+}
+
+func (c LeaderElectionConfig) leaseDuration() time.Duration {
+	if c.LeaseDuration == 0 {
+		return DefaultLeaderLeaseDuration
+	}
+	return c.LeaseDuration
+}
+
+// elector builds the LeaderElector of the backend. Replicas which cannot reach the Kubernetes
+// API from inside the cluster poll the queries themselves.
+func (c LeaderElectionConfig) elector() LeaderElector {
+	if !c.EnableLeaderElection {
+		return nil
+	}
+
+	replica := replicaID(c.ReplicaID)
+	var (
+		elector LeaderElector
+		err     error
+	)
+	if c.Backend != LeaderElectionKubernetes {
+		key := c.RedisKey
+		if key == "" {
+			key = DefaultLeaderRedisKey
+		}
+		elector, err = newRedisLeaderElector(c.RedisAddr, key, replica, c.leaseDuration())
+	} else {
+		elector, err = c.inClusterElector(replica)
+	}
+	if err != nil {
+		log.Printf("leader election disabled, polling backpressure queries locally: %v", err)
+		return nil
+	}
+	return elector
+}
+
+func (c LeaderElectionConfig) inClusterElector(replica string) (*KubernetesLeaderElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	ca, err := os.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA has no certificates")
+	}
+
+	namespace := c.LeaseNamespace
+	if namespace == "" {
+		ns, err := os.ReadFile(kubeServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	name := c.LeaseName
+	if name == "" {
+		name = DefaultLeaderLeaseName
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return NewKubernetesLeaderElector(
+		&http.Client{Transport: transport, Timeout: MonitorQueryTimeout},
+		"https://"+net.JoinHostPort(host, port),
+		kubeServiceAccountDir+"/token",
+		namespace, name, replica, c.leaseDuration(),
+	), nil
+}
+
+// LeaderElector elects the replica polling the backpressure queries for the fleet and shares the
+// allowance it computes with the followers
+type LeaderElector interface {
+	// Elect acquires or renews leadership and reports whether this replica is the leader
+	Elect(ctx context.Context, now time.Time) (bool, error)
+	// Publish shares the allowance of the leader with the followers
+	Publish(ctx context.Context, allowance float64, now time.Time) error
+	// Allowance returns the allowance last published by the leader and when it was published
+	Allowance(ctx context.Context) (float64, time.Time, error)
+}
+
+func formatPublishedAllowance(allowance float64, now time.Time) string {
+	return strconv.FormatFloat(allowance, 'f', -1, 64) + ":" + strconv.FormatInt(now.UnixMilli(), 10)
+}
+
+func parsePublishedAllowance(value string) (float64, time.Time, error) {
+	allowanceStr, millisStr, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("malformed published allowance %q", value)
+	}
+
+	allowance, err := strconv.ParseFloat(allowanceStr, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	millis, err := strconv.ParseInt(millisStr, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return allowance, time.UnixMilli(millis), nil
+}
+
+// lease is the subset of a coordination.k8s.io/v1 Lease used for leader election
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+}
+
+// expired reports whether the holder stopped renewing the lease. Leases without a parseable
+// renew time are free to take.
+func (l lease) expired(now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// KubernetesLeaderElector holds a Lease through the Kubernetes API, relying on the resource
+// version of the Lease so only one replica wins a race to take it, and publishes the allowance
+// as an annotation of the Lease
+type KubernetesLeaderElector struct {
+	client *http.Client
+	// leases is the URL of the Lease collection of the namespace
+	leases string
+	// tokenFile is re-read on every request since projected service account tokens rotate
+	tokenFile string
+	name      string
+	replica   string
+	duration  time.Duration
+}
+
+var _ LeaderElector = &KubernetesLeaderElector{}
+
+// NewKubernetesLeaderElector elects through the Lease of the namespace on the API server.
+// Requests are unauthenticated when the token file is empty.
+func NewKubernetesLeaderElector(
+	client *http.Client, apiServer, tokenFile, namespace, name, replica string, duration time.Duration,
+) *KubernetesLeaderElector {
+	return &KubernetesLeaderElector{
+		client: client,
+		leases: fmt.Sprintf(
+			"%s/apis/coordination.k8s.io/v1/namespaces/%s/leases",
+			strings.TrimSuffix(apiServer, "/"), namespace,
+		),
+		tokenFile: tokenFile,
+		name:      name,
+		replica:   replica,
+		duration:  duration,
+	}
+}
+
+func (e *KubernetesLeaderElector) Elect(ctx context.Context, now time.Time) (bool, error) {
+	l, err := e.get(ctx)
+	switch {
+	case errors.Is(err, errLeaseNotFound):
+		l = &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: e.name},
+		}
+		e.hold(l, now)
+		err = e.do(ctx, http.MethodPost, e.leases, "application/json", l, nil)
+	case err != nil:
+		return false, err
+	case l.Spec.HolderIdentity != e.replica && !l.expired(now):
+		return false, nil
+	default:
+		e.hold(l, now)
+		err = e.do(ctx, http.MethodPut, e.leases+"/"+e.name, "application/json", l, nil)
+	}
+
+	// another replica created or took the lease since it was read
+	if errors.Is(err, errLeaseConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hold makes the replica the holder of the lease as of now
+func (e *KubernetesLeaderElector) hold(l *lease, now time.Time) {
+	if l.Spec.HolderIdentity != e.replica || l.Spec.AcquireTime == "" {
+		l.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+	}
+	l.Spec.HolderIdentity = e.replica
+	l.Spec.LeaseDurationSeconds = int(e.duration.Seconds())
+	l.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+}
+
+func (e *KubernetesLeaderElector) Publish(ctx context.Context, allowance float64, now time.Time) error {
+	patch := map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				leaderAllowanceAnnotation: formatPublishedAllowance(allowance, now),
+			},
+		},
+	}
+	return e.do(
+		ctx, http.MethodPatch, e.leases+"/"+e.name, "application/merge-patch+json", patch, nil,
+	)
+}
+
+func (e *KubernetesLeaderElector) Allowance(ctx context.Context) (float64, time.Time, error) {
+	l, err := e.get(ctx)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	value, ok := l.Metadata.Annotations[leaderAllowanceAnnotation]
+	if !ok {
+		return 0, time.Time{}, ErrNoPublishedAllowance
+	}
+	return parsePublishedAllowance(value)
+}
+
+func (e *KubernetesLeaderElector) get(ctx context.Context) (*lease, error) {
+	l := &lease{}
+	if err := e.do(ctx, http.MethodGet, e.leases+"/"+e.name, "", nil, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// do sends the body as JSON and decodes the response into out when set
+func (e *KubernetesLeaderElector) do(
+	ctx context.Context, method, u, contentType string, body, out any,
+) error {
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encode lease: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if e.tokenFile != "" {
+		token, err := os.ReadFile(e.tokenFile)
+		if err != nil {
+			return fmt.Errorf("read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute request: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // ignore body close
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errLeaseNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return errLeaseConflict
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s lease: unexpected status code: %d", method, resp.StatusCode)
+	case out == nil:
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode lease: %w", err)
+	}
+	return nil
+}
+
+// evaluate polls the backpressure queries unless another replica leads the fleet and recently
+// published its allowance, in which case the allowance of the leader is adopted
+func (bp *Backpressure) evaluate(ctx context.Context) {
+	if bp.leader == nil {
+		bp.pollSignals(ctx, bp.currentSignals())
+		return
+	}
+
+	now := bp.now()
+	leading, err := bp.leader.Elect(ctx, now)
+	if err != nil {
+		log.Printf("leader election failed, polling backpressure queries locally: %v", err)
+	}
+
+	if leading {
+		bp.leaderGauge.Set(1)
+	} else {
+		bp.leaderGauge.Set(0)
+	}
+
+	if err == nil && !leading {
+		allowance, published, err := bp.leader.Allowance(ctx)
+		if err == nil && now.Sub(published) > bp.leaderStale {
+			err = fmt.Errorf("allowance was last published at %s", published.Format(time.RFC3339))
+		}
+		if err == nil {
+			bp.follow(allowance, now)
+			return
+		}
+		log.Printf("leader allowance unavailable, polling backpressure queries locally: %v", err)
+	}
+
+	bp.pollSignals(ctx, bp.currentSignals())
+	if leading {
+		if err := bp.leader.Publish(ctx, bp.Allowance(), bp.now()); err != nil {
+			log.Printf("error publishing backpressure allowance: %v", err)
+		}
+	}
+}
+
+// follow adopts the allowance of the leader, which already applied the recovery hysteresis
+func (bp *Backpressure) follow(allowance float64, now time.Time) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.allowance = max(0, min(1, allowance))
+	bp.allowanceGauge.Set(bp.allowance)
+	bp.trackEmergency(now)
+	bp.constrainWatermark()
+}
@@ -0,0 +1,203 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderElectionConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, LeaderElectionConfig{}.Validate())
+	require.NoError(t, LeaderElectionConfig{
+		EnableLeaderElection: true,
+		Backend:              LeaderElectionKubernetes,
+	}.Validate())
+	require.ErrorIs(t, LeaderElectionConfig{
+		EnableLeaderElection: true,
+	}.Validate(), ErrLeaderElectionRedisRequired)
+	require.ErrorIs(t, LeaderElectionConfig{
+		EnableLeaderElection: true,
+		Backend:              "zookeeper",
+	}.Validate(), ErrInvalidLeaderElectionBackend)
+	require.ErrorIs(t, LeaderElectionConfig{
+		EnableLeaderElection: true,
+		RedisAddr:            "localhost:6379",
+		LeaseDuration:        BackpressureUpdateCadence,
+	}.Validate(), ErrLeaderLeaseTooShort)
+}
+
+// fakeLeaseServer serves a single Lease of the Kubernetes API, rejecting updates of stale
+// resource versions like the API server
+type fakeLeaseServer struct {
+	mu      sync.Mutex
+	lease   *lease
+	version int
+}
+
+func (f *fakeLeaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	const leases = "/apis/coordination.k8s.io/v1/namespaces/monitoring/leases"
+	if r.URL.Path != leases && r.URL.Path != leases+"/bp" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case http.MethodPost, http.MethodPut:
+		var l lease
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if (r.Method == http.MethodPost) != (f.lease == nil) ||
+			(f.lease != nil && l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.lease = &l
+	case http.MethodPatch:
+		var patch lease
+		if f.lease == nil || json.NewDecoder(r.Body).Decode(&patch) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.lease.Metadata.Annotations == nil {
+			f.lease.Metadata.Annotations = map[string]string{}
+		}
+		for k, v := range patch.Metadata.Annotations {
+			f.lease.Metadata.Annotations[k] = v
+		}
+	}
+
+	if r.Method != http.MethodGet {
+		f.version++
+		f.lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	}
+	_ = json.NewEncoder(w).Encode(f.lease)
+}
+
+func TestKubernetesLeaderElector(t *testing.T) {
+	t.Parallel()
+	fake := &fakeLeaseServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	a := NewKubernetesLeaderElector(srv.Client(), srv.URL, "", "monitoring", "bp", "a", time.Minute)
+	b := NewKubernetesLeaderElector(srv.Client(), srv.URL, "", "monitoring", "bp", "b", time.Minute)
+
+	_, _, err := b.Allowance(ctx)
+	require.ErrorIs(t, err, errLeaseNotFound)
+
+	leading, err := a.Elect(ctx, now)
+	require.NoError(t, err)
+	require.True(t, leading)
+	require.Equal(t, "a", fake.lease.Spec.HolderIdentity)
+	require.Equal(t, 60, fake.lease.Spec.LeaseDurationSeconds)
+
+	leading, err = b.Elect(ctx, now.Add(30*time.Second))
+	require.NoError(t, err)
+	require.False(t, leading)
+
+	require.NoError(t, a.Publish(ctx, 0.5, now))
+	allowance, published, err := b.Allowance(ctx)
+	require.NoError(t, err)
+	require.InDelta(t, 0.5, allowance, 0)
+	require.True(t, now.Equal(published))
+
+	// renewals keep the acquire time and the published allowance
+	acquired := fake.lease.Spec.AcquireTime
+	leading, err = a.Elect(ctx, now.Add(45*time.Second))
+	require.NoError(t, err)
+	require.True(t, leading)
+	require.Equal(t, acquired, fake.lease.Spec.AcquireTime)
+	_, _, err = b.Allowance(ctx)
+	require.NoError(t, err)
+
+	// another replica takes over an expired lease
+	leading, err = b.Elect(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.True(t, leading)
+	require.Equal(t, "b", fake.lease.Spec.HolderIdentity)
+	leading, err = a.Elect(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.False(t, leading)
+}
+
+type fakeElector struct {
+	leading   bool
+	err       error
+	allowance float64
+	published time.Time
+}
+
+func (f *fakeElector) Elect(context.Context, time.Time) (bool, error) {
+	return f.leading, f.err
+}
+
+func (f *fakeElector) Publish(_ context.Context, allowance float64, now time.Time) error {
+	f.allowance, f.published = allowance, now
+	return nil
+}
+
+func (f *fakeElector) Allowance(context.Context) (float64, time.Time, error) {
+	if f.published.IsZero() {
+		return 0, time.Time{}, ErrNoPublishedAllowance
+	}
+	return f.allowance, f.published, nil
+}
+
+func TestBackpressureLeaderElection(t *testing.T) {
+	t.Parallel()
+	m := newBackpressureMetrics(promauto.With(prometheus.NewRegistry()))
+	bp := newBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin: 1,
+		CongestionWindowMax: 100,
+	}, m)
+	elector := &fakeElector{allowance: 0.4, published: time.Now()}
+	bp.leader = elector
+	bp.leaderStale = time.Minute
+
+	// followers adopt the allowance of the leader
+	bp.evaluate(context.Background())
+	require.InDelta(t, 0.4, bp.Allowance(), 0)
+	require.InDelta(t, 0, testutil.ToFloat64(m.leaderGauge), 0)
+
+	// the leader publishes the allowance it computes
+	elector.leading = true
+	bp.evaluate(context.Background())
+	require.InDelta(t, 0.4, elector.allowance, 0)
+	require.InDelta(t, 1, testutil.ToFloat64(m.leaderGauge), 0)
+
+	// stale allowances and failed elections fall back to polling locally, which leaves the
+	// allowance of the queries untouched
+	elector.leading = false
+	elector.allowance, elector.published = 0.1, time.Now().Add(-2*time.Minute)
+	bp.evaluate(context.Background())
+	require.InDelta(t, 0.4, bp.Allowance(), 0)
+
+	elector.err = errors.New("redis unavailable")
+	elector.published = time.Now()
+	bp.evaluate(context.Background())
+	require.InDelta(t, 0.4, bp.Allowance(), 0)
+}
@@ -0,0 +1,120 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrChainInitialized = errors.New("middleware chain is already initialized")
+	ErrChainClosed      = errors.New("middleware chain is closed")
+)
+
+// LegacyProxyClient is a middleware written against the Init signature before it returned an
+// error. Build it with WrapLegacy to use it in a chain.
+type LegacyProxyClient interface {
+	Init(context.Context)
+	Next(Request) error
+}
+
+// WrapLegacy adapts the constructor of a middleware whose Init cannot fail. The legacy Init drops
+// the error of the stages after it, so the wrapper records and returns it instead.
+func WrapLegacy(build func(next ProxyClient) LegacyProxyClient) MiddlewareFunc {
+	return func(next ProxyClient) ProxyClient {
+		rest := &initRecorder{ProxyClient: next}
+		return &legacyClient{client: build(rest), rest: rest}
+	}
+}
+
+type legacyClient struct {
+	client LegacyProxyClient
+	rest   *initRecorder
+}
+
+func (lc *legacyClient) Init(ctx context.Context) error {
+	lc.client.Init(ctx)
+	return lc.rest.err
+}
+
+func (lc *legacyClient) Next(rr Request) error {
+	return lc.client.Next(rr)
+}
+
+// initRecorder keeps the Init error of the rest of the chain for the legacy middleware before it
+type initRecorder struct {
+	ProxyClient
+	err error
+}
+
+func (ir *initRecorder) Init(ctx context.Context) error {
+	ir.err = ir.ProxyClient.Init(ctx)
+	return ir.err
+}
+
+type lifecycleKey struct{}
+
+// lifecycle scopes the background work of a chain to the entry point that initialized it, so
+// Close stops the pollers of a discarded chain even when the Init context is never cancelled
+type lifecycle struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	closed  bool
+	running sync.WaitGroup
+}
+
+// start derives the context the chain is initialized with
+func (l *lifecycle) start(ctx context.Context) (context.Context, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrChainClosed
+	}
+	if l.cancel != nil {
+		return nil, ErrChainInitialized
+	}
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	return context.WithValue(ctx, lifecycleKey{}, l), nil
+}
+
+// close cancels the chain context and waits for the goroutines started with goUntilDone to exit
+func (l *lifecycle) close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrChainClosed
+	}
+	l.closed = true
+	if l.cancel != nil {
+		l.cancel()
+	}
+	l.mu.Unlock()
+
+	l.running.Wait()
+	return nil
+}
+
+// goUntilDone runs a background loop bound to ctx. Closing the entry point the chain was
+// initialized by waits for the loop to return. Returns false without running the loop once the
+// entry point is closed.
+func goUntilDone(ctx context.Context, loop func()) bool {
+	l, ok := ctx.Value(lifecycleKey{}).(*lifecycle)
+	if !ok {
+		go loop()
+		return true
+	}
+
+	// closed is set before close waits, so the loop is either waited for or never started
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.running.Add(1)
+	go func() {
+		defer l.running.Done()
+		loop()
+	}()
+	return true
+}
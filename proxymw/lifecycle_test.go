@@ -0,0 +1,87 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type legacyMiddleware struct {
+	client      ProxyClient
+	initialized bool
+}
+
+func (lm *legacyMiddleware) Init(ctx context.Context) {
+	lm.initialized = true
+	_ = lm.client.Init(ctx)
+}
+
+func (lm *legacyMiddleware) Next(rr Request) error {
+	return lm.client.Next(rr)
+}
+
+func TestEntryLifecycle(t *testing.T) {
+	t.Parallel()
+	errInit := errors.New("connect to license server")
+	legacy := &legacyMiddleware{}
+	cb := NewChainBuilder(Config{}).
+		Use("legacy", WrapLegacy(func(next ProxyClient) LegacyProxyClient {
+			legacy.client = next
+			return legacy
+		})).
+		Use("license", func(next ProxyClient) ProxyClient {
+			return &Mocker{
+				InitFunc: func(ctx context.Context) error {
+					if err := next.Init(ctx); err != nil {
+						return err
+					}
+					return errInit
+				},
+			}
+		})
+
+	entry, err := NewServeFromChain(Config{}, cb, func(http.ResponseWriter, *http.Request) {})
+	require.NoError(t, err)
+	require.ErrorIs(t, entry.Init(context.Background()), errInit)
+	require.True(t, legacy.initialized)
+	require.ErrorIs(t, entry.Init(context.Background()), ErrChainInitialized)
+
+	require.NoError(t, entry.Close())
+	require.ErrorIs(t, entry.Close(), ErrChainClosed)
+
+	rt, err := NewRoundTripperFromChain(NewChainBuilder(Config{}), &Mocker{})
+	require.NoError(t, err)
+	require.NoError(t, rt.Close())
+	require.ErrorIs(t, rt.Init(context.Background()), ErrChainClosed)
+}
+
+func TestCloseStopsPollers(t *testing.T) {
+	t.Parallel()
+	l := &lifecycle{}
+	ctx, err := l.start(context.Background())
+	require.NoError(t, err)
+
+	stopped := false
+	goUntilDone(ctx, func() {
+		<-ctx.Done()
+		stopped = true
+	})
+	require.NoError(t, l.close())
+	require.True(t, stopped, "close waits for the loop to return")
+
+	// the entry point owns every poller of the chain
+	entry := NewRoundTripperFromConfig(Config{
+		BackpressureConfig: BackpressureConfig{
+			EnableBackpressure:        true,
+			BackpressureMonitoringURL: "http://prometheus",
+			BackpressureQueries:       []BackpressureQuery{{Query: "up", WarningThreshold: 1, EmergencyThreshold: 2}},
+			CongestionWindowMin:       1,
+			CongestionWindowMax:       10,
+		},
+	}, &Mocker{})
+	require.NoError(t, entry.Init(context.Background()))
+	require.NoError(t, entry.Close())
+}
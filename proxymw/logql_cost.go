@@ -0,0 +1,167 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	LokiQueryEndpoint      = "/loki/api/v1/query"
+	LokiQueryRangeEndpoint = "/loki/api/v1/query_range"
+
+	// LokiDefaultSince is the range Loki queries when start is not provided
+	LokiDefaultSince = time.Hour
+	// LogQLRegexFilterCost is the cost of each regex line filter which must run against every
+	// log line in the selected streams
+	LogQLRegexFilterCost = 25
+)
+
+var (
+	logQLStreamSelector = regexp.MustCompile(`\{[^}]*\}`)
+	logQLRegexFilter    = regexp.MustCompile("(?:^|[^\\w])(?:\\|~|!~)\\s*[\"`]")
+	logQLRangeSelector  = regexp.MustCompile(`\[([0-9a-z]+)\]`)
+	logQLOffset         = regexp.MustCompile(`offset\s+([0-9a-z]+)`)
+)
+
+type logQLQuery struct {
+	query string
+	start time.Time
+}
+
+func isLokiRequest(req *http.Request) bool {
+	if req == nil || req.URL == nil {
+		return false
+	}
+	return req.URL.Path == LokiQueryEndpoint || req.URL.Path == LokiQueryRangeEndpoint
+}
+
+// logQLCost scores a LogQL request the same way as PromQL with an additional cost for each
+// regex line filter. Recent queries with several regex filters are not considered low cost.
+func logQLCost(req *http.Request) (int, error) {
+	q, err := logQLFromRequest(req)
+	if err != nil {
+		return 0, err
+	}
+
+	cost := len(logQLRegexFilter.FindAllString(stripStreamSelectors(q.query), -1)) *
+		LogQLRegexFilterCost
+	lookback, err := q.lookback()
+	if err != nil {
+		return 0, err
+	}
+
+	if lookback > HeadBlockLookback {
+		cost += ObjectStorageThreshold
+	}
+	return cost, nil
+}
+
+func logQLLookback(req *http.Request) (time.Duration, error) {
+	q, err := logQLFromRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	return q.lookback()
+}
+
+// lookback extends the query start by the widest range selector and offset in the LogQL.
+func (q logQLQuery) lookback() (time.Duration, error) {
+	query := stripStreamSelectors(q.query)
+	extra := time.Duration(0)
+	for _, re := range []*regexp.Regexp{logQLRangeSelector, logQLOffset} {
+		widest := time.Duration(0)
+		for _, match := range re.FindAllStringSubmatch(query, -1) {
+			d, err := model.ParseDuration(match[1])
+			if err != nil {
+				return 0, fmt.Errorf("error parsing LogQL duration %q: %w", match[1], err)
+			}
+			widest = max(widest, time.Duration(d))
+		}
+		extra += widest
+	}
+
+	return time.Since(q.start) + extra, nil
+}
+
+func stripStreamSelectors(query string) string {
+	return logQLStreamSelector.ReplaceAllString(query, "{}")
+}
+
+func logQLFromRequest(req *http.Request) (logQLQuery, error) {
+	form, err := parsedForm(req)
+	if err != nil {
+		return logQLQuery{}, fmt.Errorf("bad request in LogQL query %v", err)
+	}
+
+	query := form.Get("query")
+	if query == "" {
+		return logQLQuery{}, errors.New("empty LogQL query")
+	}
+
+	now := time.Now()
+	if req.URL.Path == LokiQueryEndpoint {
+		ts, err := parseLokiTime(form.Get("time"), now)
+		if err != nil {
+			return logQLQuery{}, fmt.Errorf("error parsing time %v", err)
+		}
+		return logQLQuery{query: query, start: ts}, nil
+	}
+
+	end, err := parseLokiTime(form.Get("end"), now)
+	if err != nil {
+		return logQLQuery{}, fmt.Errorf("error parsing end time %v", err)
+	}
+
+	since := LokiDefaultSince
+	if s := form.Get("since"); s != "" {
+		d, err := model.ParseDuration(s)
+		if err != nil {
+			return logQLQuery{}, fmt.Errorf("error parsing since %v", err)
+		}
+		since = time.Duration(d)
+	}
+
+	start, err := parseLokiTime(form.Get("start"), end.Add(-since))
+	if err != nil {
+		return logQLQuery{}, fmt.Errorf("error parsing start time %v", err)
+	}
+	return logQLQuery{query: query, start: start}, nil
+}
+
+// parseLokiTime follows Loki's timestamp parsing where integers longer than 10 digits are
+// nanosecond epochs, decimals are second epochs, and anything else must be RFC3339.
+func parseLokiTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if strings.Contains(value, ".") {
+		if t, err := strconv.ParseFloat(value, 64); err == nil {
+			s, ns := math.Modf(t)
+			return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+		}
+	}
+
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		if ts, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return ts, nil
+		}
+		return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", value)
+	}
+
+	if len(value) <= 10 {
+		return time.Unix(nanos, 0), nil
+	}
+	return time.Unix(0, nanos), nil
+}
@@ -0,0 +1,132 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func lokiRequest(t *testing.T, path string, params url.Values) Request {
+	return &Mocker{
+		RequestFunc: func() *http.Request {
+			return &http.Request{
+				URL:    parseURL(t, "http://localhost"+path+"?"+params.Encode()),
+				Method: http.MethodGet,
+			}
+		},
+	}
+}
+
+func TestLogQLQueryCost(t *testing.T) {
+	t.Parallel()
+	nanosAgo := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(-d).UnixNano(), 10)
+	}
+	for _, tt := range []struct {
+		name     string
+		path     string
+		params   url.Values
+		wantCost int
+		wantErr  bool
+	}{
+		{
+			name:    "empty query",
+			path:    LokiQueryRangeEndpoint,
+			params:  url.Values{},
+			wantErr: true,
+		},
+		{
+			name: "default range is recent",
+			path: LokiQueryRangeEndpoint,
+			params: url.Values{
+				"query": []string{`{app="api"} |= "error"`},
+			},
+			wantCost: 0,
+		},
+		{
+			name: "nanosecond range over a day",
+			path: LokiQueryRangeEndpoint,
+			params: url.Values{
+				"query": []string{`{app="api"} |= "error"`},
+				"start": []string{nanosAgo(24 * time.Hour)},
+				"end":   []string{nanosAgo(0)},
+			},
+			wantCost: ObjectStorageThreshold,
+		},
+		{
+			name: "since parameter",
+			path: LokiQueryRangeEndpoint,
+			params: url.Values{
+				"query": []string{`{app="api"}`},
+				"since": []string{"6h"},
+			},
+			wantCost: ObjectStorageThreshold,
+		},
+		{
+			name: "regex filters add cost but label matchers do not",
+			path: LokiQueryRangeEndpoint,
+			params: url.Values{
+				"query": []string{"{app=~\"api|web\", env!~\"dev\"} |~ \"err.*\" !~ `debug`"},
+			},
+			wantCost: 2 * LogQLRegexFilterCost,
+		},
+		{
+			name: "instant metric query range selector",
+			path: LokiQueryEndpoint,
+			params: url.Values{
+				"query": []string{`sum(rate({app="api"} |= "error" [4h]))`},
+			},
+			wantCost: ObjectStorageThreshold,
+		},
+		{
+			name: "instant metric query within head",
+			path: LokiQueryEndpoint,
+			params: url.Values{
+				"query": []string{`sum(count_over_time({app="api"}[5m]))`},
+				"time":  []string{strconv.FormatInt(time.Now().Unix(), 10)},
+			},
+			wantCost: 0,
+		},
+		{
+			name: "invalid start",
+			path: LokiQueryRangeEndpoint,
+			params: url.Values{
+				"query": []string{`{app="api"}`},
+				"start": []string{"yesterday"},
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cost, err := QueryCost(lokiRequest(t, tt.path, tt.params))
+			require.Equal(t, tt.wantErr, err != nil, err)
+			require.Equal(t, tt.wantCost, cost)
+		})
+	}
+}
+
+func TestParseLokiTime(t *testing.T) {
+	t.Parallel()
+	def := time.Unix(5, 0)
+	for _, tt := range []struct {
+		value string
+		want  time.Time
+	}{
+		{value: "", want: def},
+		{value: "1700000000", want: time.Unix(1700000000, 0)},
+		{value: "1700000000000000000", want: time.Unix(0, 1700000000000000000)},
+		{value: "1700000000.5", want: time.Unix(1700000000, int64(time.Second/2))},
+		{value: "2024-07-16T12:47:00Z", want: time.Date(2024, 7, 16, 12, 47, 0, 0, time.UTC)},
+	} {
+		got, err := parseLokiTime(tt.value, def)
+		require.NoError(t, err)
+		require.True(t, tt.want.Equal(got), tt.value)
+	}
+}
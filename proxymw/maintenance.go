@@ -0,0 +1,170 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MaintenanceProxyType is the rejection key and blocked-by type of maintenance blocks
+	MaintenanceProxyType = "maintenance"
+	// MaintenancePath is where the internal server reports and switches the maintenance mode
+	MaintenancePath = "/api/v1/maintenance"
+
+	// MaintenanceOff passes requests through the middleware chain
+	MaintenanceOff = "off"
+	// MaintenanceBlock rejects every proxied request with a 503
+	MaintenanceBlock = "block"
+	// MaintenanceOpen sends every proxied request straight upstream, bypassing all middleware
+	MaintenanceOpen = "open"
+
+	DefaultMaintenanceMessage = "the proxy is down for maintenance"
+)
+
+var (
+	ErrInvalidMaintenanceMode = errors.New("maintenance mode must be off, block, or open")
+
+	maintenanceModeGauge = defaultMetricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxymw_maintenance_mode",
+		Help: "Set to 1 for the current maintenance mode: off, block, or open",
+	}, []string{"mode"})
+
+	// activeMaintenance is the maintenance mode of every entry point in the process
+	activeMaintenance = &maintenance{mode: MaintenanceOff}
+)
+
+func init() {
+	activeMaintenance.setGauge()
+}
+
+// MaintenanceConfig forces the proxy into a maintenance mode from startup. The mode can be
+// switched at runtime through the MaintenancePath endpoint of the internal server.
+type MaintenanceConfig struct {
+	// MaintenanceMode is "off" (default), "block" to reject proxied requests with a 503, or
+	// "open" to bypass every middleware, e.g. while the throttling itself misbehaves
+	MaintenanceMode string `yaml:"maintenance_mode" json:"maintenance_mode"`
+	// MaintenanceMessage is the error of blocked requests
+	MaintenanceMessage string `yaml:"maintenance_message" json:"maintenance_message"`
+}
+
+func (c MaintenanceConfig) Validate() error {
+	switch c.MaintenanceMode {
+	case "", MaintenanceOff, MaintenanceBlock, MaintenanceOpen:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidMaintenanceMode, c.MaintenanceMode)
+	}
+}
+
+func (c MaintenanceConfig) mode() string {
+	if c.MaintenanceMode == "" {
+		return MaintenanceOff
+	}
+	return c.MaintenanceMode
+}
+
+func (c MaintenanceConfig) message() string {
+	if c.MaintenanceMessage == "" {
+		return DefaultMaintenanceMessage
+	}
+	return c.MaintenanceMessage
+}
+
+type maintenance struct {
+	mu      sync.RWMutex
+	mode    string
+	message string
+}
+
+func (m *maintenance) set(cfg MaintenanceConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mode != cfg.mode() {
+		log.Printf("maintenance mode switched from %s to %s", m.mode, cfg.mode())
+	}
+	m.mode, m.message = cfg.mode(), cfg.message()
+	m.setGauge()
+}
+
+func (m *maintenance) get() MaintenanceConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return MaintenanceConfig{MaintenanceMode: m.mode, MaintenanceMessage: m.message}
+}
+
+// setGauge marks the current mode.
+// Assumes the callsite already holds the lock.
+func (m *maintenance) setGauge() {
+	for _, mode := range []string{MaintenanceOff, MaintenanceBlock, MaintenanceOpen} {
+		value := 0.0
+		if mode == m.mode {
+			value = 1
+		}
+		maintenanceModeGauge.WithLabelValues(mode).Set(value)
+	}
+}
+
+// SetMaintenance switches the maintenance mode of every entry point in the process
+func SetMaintenance(cfg MaintenanceConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	activeMaintenance.set(cfg)
+	return nil
+}
+
+// Maintenance returns the current maintenance mode and message
+func Maintenance() MaintenanceConfig {
+	return activeMaintenance.get()
+}
+
+// nextInMaintenance passes the request through the chain unless maintenance blocks it or sends
+// it straight to the exit
+func nextInMaintenance(chain, exit ProxyClient, rr Request) error {
+	switch m := activeMaintenance.get(); m.MaintenanceMode {
+	case MaintenanceBlock:
+		return BlockErr(MaintenanceProxyType, "%s", m.MaintenanceMessage)
+	case MaintenanceOpen:
+		if exit != nil {
+			return exit.Next(rr)
+		}
+	}
+	return chain.Next(rr)
+}
+
+// MaintenanceHandler reports the maintenance mode on GET and switches it to the YAML or JSON
+// encoded MaintenanceConfig in the body on POST
+func MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var cfg MaintenanceConfig
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = yaml.Unmarshal(body, &cfg)
+		}
+		if err == nil {
+			err = SetMaintenance(cfg)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(Maintenance()); err != nil {
+		log.Printf("error writing maintenance mode: %v", err)
+	}
+}
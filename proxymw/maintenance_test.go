@@ -0,0 +1,89 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, MaintenanceConfig{}.Validate())
+	require.NoError(t, MaintenanceConfig{MaintenanceMode: MaintenanceBlock}.Validate())
+	require.ErrorIs(t, MaintenanceConfig{MaintenanceMode: "closed"}.Validate(), ErrInvalidMaintenanceMode)
+}
+
+// TestMaintenance switches the process wide mode, so it does not run in parallel and restores
+// the mode before the parallel tests resume
+func TestMaintenance(t *testing.T) {
+	t.Cleanup(func() { require.NoError(t, SetMaintenance(MaintenanceConfig{})) })
+
+	upstream := 0
+	entry := NewServeFromConfig(Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-User-Agent=scraper.*"},
+		},
+		MaintenanceConfig: MaintenanceConfig{
+			MaintenanceMode:    MaintenanceBlock,
+			MaintenanceMessage: "upgrading prometheus",
+		},
+	}, func(w http.ResponseWriter, _ *http.Request) {
+		upstream++
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, entry.Init(context.Background()))
+
+	serve := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		r.Header.Set("X-User-Agent", "scraper-v1")
+		w := httptest.NewRecorder()
+		entry.ServeHTTP(w, r)
+		return w
+	}
+
+	// the configured mode applies from Init
+	w := serve()
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, MaintenanceProxyType, w.Header().Get(string(HeaderThrottleReason)))
+	require.Contains(t, w.Body.String(), "upgrading prometheus")
+	require.Zero(t, upstream)
+	require.InDelta(t, 1, testutil.ToFloat64(maintenanceModeGauge.WithLabelValues(MaintenanceBlock)), 0)
+
+	switchMode := func(body string) MaintenanceConfig {
+		w := httptest.NewRecorder()
+		MaintenanceHandler(w, httptest.NewRequest(http.MethodPost, MaintenancePath, strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var cfg MaintenanceConfig
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&cfg))
+		return cfg
+	}
+
+	// open mode bypasses the blocker
+	require.Equal(t, MaintenanceConfig{
+		MaintenanceMode:    MaintenanceOpen,
+		MaintenanceMessage: DefaultMaintenanceMessage,
+	}, switchMode(`{"maintenance_mode": "open"}`))
+	require.Equal(t, http.StatusOK, serve().Code)
+	require.Equal(t, 1, upstream)
+	require.InDelta(t, 0, testutil.ToFloat64(maintenanceModeGauge.WithLabelValues(MaintenanceBlock)), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(maintenanceModeGauge.WithLabelValues(MaintenanceOpen)), 0)
+
+	require.Equal(t, MaintenanceOff, switchMode("maintenance_mode: off").MaintenanceMode)
+	require.Equal(t, http.StatusTooManyRequests, serve().Code)
+	require.Equal(t, 1, upstream)
+
+	w = httptest.NewRecorder()
+	MaintenanceHandler(w, httptest.NewRequest(
+		http.MethodPost, MaintenancePath, strings.NewReader(`{"maintenance_mode": "closed"}`),
+	))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, MaintenanceOff, Maintenance().MaintenanceMode)
+}
@@ -0,0 +1,69 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SeriesEndpoint = "/api/v1/series"
+	LabelsEndpoint = "/api/v1/labels"
+
+	labelValuesPrefix = "/api/v1/label/"
+	labelValuesSuffix = "/values"
+
+	// metadataUnboundedLookback is the lookback of metadata requests without a start, which
+	// Prometheus answers from every block it stores
+	metadataUnboundedLookback = time.Duration(math.MaxInt64)
+)
+
+var ErrMetadataEndBeforeStart = errors.New("metadata request end is before start")
+
+func isMetadataRequest(req *http.Request) bool {
+	if req == nil || req.URL == nil {
+		return false
+	}
+
+	path := req.URL.Path
+	return path == SeriesEndpoint || path == LabelsEndpoint ||
+		(strings.HasPrefix(path, labelValuesPrefix) && strings.HasSuffix(path, labelValuesSuffix))
+}
+
+// metadataLookback returns how far back the series, labels, or label values request reads from
+// its start parameter. Metadata is indexed per block so the selectors do not change the lookback.
+func metadataLookback(req *http.Request) (time.Duration, error) {
+	form, err := parsedForm(req)
+	if err != nil {
+		return 0, fmt.Errorf("bad request in metadata query %v", err)
+	}
+
+	start := form.Get("start")
+	end := form.Get("end")
+	var startTime, endTime time.Time
+	if start != "" {
+		if startTime, err = parseTime(start); err != nil {
+			return 0, fmt.Errorf("error parsing start time %v", err)
+		}
+	}
+
+	if end != "" {
+		if endTime, err = parseTime(end); err != nil {
+			return 0, fmt.Errorf("error parsing end time %v", err)
+		}
+	}
+
+	if start == "" {
+		return metadataUnboundedLookback, nil
+	}
+
+	if end != "" && endTime.Before(startTime) {
+		return 0, ErrMetadataEndBeforeStart
+	}
+	return time.Since(startTime), nil
+}
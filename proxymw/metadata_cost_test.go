@@ -0,0 +1,90 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataQueryCost(t *testing.T) {
+	t.Parallel()
+	secondsAgo := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(-d).Unix(), 10)
+	}
+	for _, tt := range []struct {
+		name     string
+		path     string
+		params   url.Values
+		wantCost int
+		wantErr  bool
+	}{
+		{
+			name: "recent series",
+			path: SeriesEndpoint,
+			params: url.Values{
+				"match[]": []string{`up{job="api"}`},
+				"start":   []string{secondsAgo(time.Hour)},
+				"end":     []string{secondsAgo(0)},
+			},
+			wantCost: 0,
+		},
+		{
+			name: "labels over a week",
+			path: LabelsEndpoint,
+			params: url.Values{
+				"start": []string{time.Now().Add(-7 * 24 * time.Hour).Format(time.RFC3339)},
+			},
+			wantCost: ObjectStorageThreshold,
+		},
+		{
+			name:     "label values without start read every block",
+			path:     "/api/v1/label/job/values",
+			params:   url.Values{},
+			wantCost: ObjectStorageThreshold,
+		},
+		{
+			name: "recent label values",
+			path: "/api/v1/label/__name__/values",
+			params: url.Values{
+				"start": []string{secondsAgo(30 * time.Minute)},
+			},
+			wantCost: 0,
+		},
+		{
+			name: "invalid end",
+			path: SeriesEndpoint,
+			params: url.Values{
+				"start": []string{secondsAgo(time.Hour)},
+				"end":   []string{"now"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "end before start",
+			path: LabelsEndpoint,
+			params: url.Values{
+				"start": []string{secondsAgo(time.Hour)},
+				"end":   []string{secondsAgo(2 * time.Hour)},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "other label endpoints are not metadata",
+			path:    "/api/v1/label/job",
+			params:  url.Values{},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cost, err := QueryCost(lokiRequest(t, tt.path, tt.params))
+			require.Equal(t, tt.wantErr, err != nil, err)
+			require.Equal(t, tt.wantCost, cost)
+		})
+	}
+}
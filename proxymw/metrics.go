@@ -0,0 +1,119 @@
+package proxymw
+
+import (
+	"maps"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMetricsFactory registers the metrics shared by every chain without a MetricsConfig
+var defaultMetricsFactory = promauto.With(prometheus.DefaultRegisterer)
+
+// MetricsConfig scopes the metrics of a middleware chain so several chains can run in one
+// process. Chains which set none of the options share the package metrics registered with the
+// default registerer.
+type MetricsConfig struct {
+	// MetricsNamespace prefixes every metric name of the chain,
+	// e.g. "tenant_a" registers tenant_a_proxymw_request_count
+	MetricsNamespace string `yaml:"metrics_namespace"`
+	// MetricsConstLabels are attached to every metric of the chain
+	MetricsConstLabels map[string]string `yaml:"metrics_const_labels"`
+	// MetricsRegistry registers the metrics of the chain. Defaults to the default registerer.
+	MetricsRegistry prometheus.Registerer `yaml:"-"`
+}
+
+// scoped reports whether the chain registers its own metrics
+func (c MetricsConfig) scoped() bool {
+	return c.MetricsNamespace != "" || len(c.MetricsConstLabels) > 0 || c.MetricsRegistry != nil
+}
+
+// host scopes the metrics of the chain of a destination host with a namespace named after it,
+// since labeling them instead would clash with the unlabeled metrics of the same registry
+func (c MetricsConfig) host(host string) MetricsConfig {
+	namespace := "host_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, host)
+	if c.MetricsNamespace != "" {
+		namespace = c.MetricsNamespace + "_" + namespace
+	}
+	return MetricsConfig{
+		MetricsNamespace:   namespace,
+		MetricsConstLabels: c.MetricsConstLabels,
+		MetricsRegistry:    c.MetricsRegistry,
+	}
+}
+
+func (c MetricsConfig) factory() promauto.Factory {
+	reg := c.MetricsRegistry
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	if len(c.MetricsConstLabels) > 0 {
+		reg = prometheus.WrapRegistererWith(maps.Clone(c.MetricsConstLabels), reg)
+	}
+	if c.MetricsNamespace != "" {
+		reg = prometheus.WrapRegistererWithPrefix(c.MetricsNamespace+"_", reg)
+	}
+	return promauto.With(reg)
+}
+
+// chainMetrics are the collectors of every middleware in one chain
+type chainMetrics struct {
+	observer      *observerMetrics
+	backpressure  *backpressureMetrics
+	adaptiveLimit *adaptiveLimitMetrics
+	warmup        *warmupMetrics
+	blocker       *blockerMetrics
+	rateLimit     *rateLimitMetrics
+	quota         *quotaMetrics
+	costCache     *queryCostCacheMetrics
+	mirror        *mirrorMetrics
+	retry         *retryMetrics
+	chaos         *chaosMetrics
+	stepAlign     *stepAlignMetrics
+	remoteWrite   *remoteWriteMetrics
+}
+
+// metrics registers the collectors of a scoped chain. Registration panics if another chain
+// already registered the same metric names and labels with the registry.
+func (c MetricsConfig) metrics() chainMetrics {
+	if !c.scoped() {
+		return chainMetrics{
+			observer:      defaultObserverMetrics,
+			backpressure:  defaultBackpressureMetrics,
+			adaptiveLimit: defaultAdaptiveLimitMetrics,
+			warmup:        defaultWarmupMetrics,
+			blocker:       defaultBlockerMetrics,
+			rateLimit:     defaultRateLimitMetrics,
+			quota:         defaultQuotaMetrics,
+			costCache:     defaultQueryCostCacheMetrics,
+			mirror:        defaultMirrorMetrics,
+			retry:         defaultRetryMetrics,
+			chaos:         defaultChaosMetrics,
+			stepAlign:     defaultStepAlignMetrics,
+			remoteWrite:   defaultRemoteWriteMetrics,
+		}
+	}
+
+	factory := c.factory()
+	return chainMetrics{
+		observer:      newObserverMetrics(factory),
+		backpressure:  newBackpressureMetrics(factory),
+		adaptiveLimit: newAdaptiveLimitMetrics(factory),
+		warmup:        newWarmupMetrics(factory),
+		blocker:       newBlockerMetrics(factory),
+		rateLimit:     newRateLimitMetrics(factory),
+		quota:         newQuotaMetrics(factory),
+		costCache:     newQueryCostCacheMetrics(factory),
+		mirror:        newMirrorMetrics(factory),
+		retry:         newRetryMetrics(factory),
+		chaos:         newChaosMetrics(factory),
+		stepAlign:     newStepAlignMetrics(factory),
+		remoteWrite:   newRemoteWriteMetrics(factory),
+	}
+}
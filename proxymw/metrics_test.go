@@ -0,0 +1,74 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopedMetrics(t *testing.T) {
+	t.Parallel()
+	reg := prometheus.NewRegistry()
+	newChain := func(shard string) ProxyClient {
+		return NewFromConfig(Config{
+			EnableObserver: true,
+			AdaptiveLimitConfig: AdaptiveLimitConfig{
+				EnableAdaptiveLimit: true,
+			},
+			MetricsConfig: MetricsConfig{
+				MetricsNamespace:   "replica",
+				MetricsConstLabels: map[string]string{"shard": shard},
+				MetricsRegistry:    reg,
+			},
+		}, &Mocker{
+			InitFunc: func(context.Context) error { return nil },
+			NextFunc: func(Request) error { return nil },
+		})
+	}
+
+	// both chains register the same metric names in one registry without colliding
+	a, b := newChain("a"), newChain("b")
+	require.NoError(t, a.Init(context.Background()))
+	require.NoError(t, b.Init(context.Background()))
+
+	req, err := http.NewRequestWithContext(
+		context.Background(), http.MethodGet, "http://prometheus/api/v1/query", http.NoBody,
+	)
+	require.NoError(t, err)
+	rr := &Mocker{RequestFunc: func() *http.Request { return req }}
+	require.NoError(t, a.Next(rr))
+	require.NoError(t, a.Next(rr))
+	require.NoError(t, b.Next(rr))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	counts := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "replica_proxymw_request_count" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, map[string]float64{"a": 2, "b": 1}, counts)
+
+	require.Equal(t, 2, testutil.CollectAndCount(reg, "replica_proxymw_adaptive_limit"))
+	require.Panics(t, func() { newChain("a") })
+}
+
+func TestDefaultMetrics(t *testing.T) {
+	t.Parallel()
+	require.False(t, MetricsConfig{}.scoped())
+	require.True(t, MetricsConfig{MetricsNamespace: "replica"}.scoped())
+
+	m := MetricsConfig{}.metrics()
+	require.Same(t, defaultObserverMetrics, m.observer)
+	require.Same(t, defaultBackpressureMetrics, m.backpressure)
+	require.Same(t, defaultAdaptiveLimitMetrics, m.adaptiveLimit)
+	require.Same(t, defaultRateLimitMetrics, m.rateLimit)
+}
@@ -2,23 +2,27 @@
 package proxymw
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // ProxyClient defines the interface for middleware components in the chain.
 // Each middleware component must implement Init for setup and Next for request processing.
+// Middlewares written before Init returned an error can be adapted with WrapLegacy.
 type ProxyClient interface {
-	// Init initializes the middleware component with a context.
-	// It should be called before the middleware starts processing requests.
-	Init(context.Context)
+	// Init initializes the middleware component with a context and the rest of the chain after it.
+	// It should be called before the middleware starts processing requests. Background work must
+	// stop once the context is done.
+	Init(context.Context) error
 
 	// Next processes the incoming request through the middleware chain.
 	// It returns an error if the request cannot be processed.
@@ -80,13 +84,74 @@ func (c *RequestResponseWrapper) ResponseWriter() http.ResponseWriter {
 
 // Config holds all middleware configuration options
 type Config struct {
-	BackpressureConfig `yaml:"backpressure_config"`
-	BlockerConfig      `yaml:"blocker_config"`
-	EnableJitter       bool          `yaml:"enable_jitter"`
-	JitterDelay        time.Duration `yaml:"jitter_delay"`
-	EnableObserver     bool          `yaml:"enable_observer"`
-	ClientTimeout      time.Duration `yaml:"client_timeout"`
-	EnableCriticality  bool          `yaml:"enable_criticality"`
+	BackpressureConfig      `yaml:"backpressure_config"`
+	BlockerConfig           `yaml:"blocker_config"`
+	LabelInjectorConfig     `yaml:"label_injector_config"`
+	GuardrailConfig         `yaml:"guardrail_config"`
+	TenantStatsConfig       `yaml:"tenant_stats_config"`
+	RateLimitConfig         `yaml:"rate_limit_config"`
+	FingerprintLimitConfig  `yaml:"fingerprint_limit_config"`
+	TenantConcurrencyConfig `yaml:"tenant_concurrency_config"`
+	QuotaConfig             `yaml:"quota_config"`
+	RemoteWriteConfig       `yaml:"remote_write_config"`
+	AdaptiveLimitConfig     `yaml:"adaptive_limit_config"`
+	WarmupConfig            `yaml:"warmup_config"`
+	CostFeedbackConfig      `yaml:"cost_feedback_config"`
+	TimeoutConfig           `yaml:"timeout_config"`
+	AccessLogConfig         `yaml:"access_log_config"`
+	RecordConfig            `yaml:"record_config"`
+	AuditConfig             `yaml:"audit_config"`
+	QueryCostCacheConfig    `yaml:"query_cost_cache_config"`
+	MaintenanceConfig       `yaml:"maintenance_config"`
+	StepAlignConfig         `yaml:"step_align_config"`
+	MirrorConfig            `yaml:"mirror_config"`
+	ShardConfig             `yaml:"shard_config"`
+	RetryConfig             `yaml:"retry_config"`
+	ChaosConfig             `yaml:"chaos_config"`
+	MetricsConfig           `yaml:"metrics_config"`
+	EnableJitter            bool          `yaml:"enable_jitter"`
+	JitterDelay             time.Duration `yaml:"jitter_delay"`
+	// JitterStrategy is the distribution jitter is sampled from. Defaults to full jitter.
+	JitterStrategy JitterStrategy `yaml:"jitter_strategy"`
+	// JitterStddev is the standard deviation for the normal jitter strategy
+	JitterStddev   time.Duration `yaml:"jitter_stddev"`
+	EnableObserver bool          `yaml:"enable_observer"`
+	// EnableObserverPathLabels adds path and method labeled request metrics to the Observer.
+	// Paths are labeled by the matching ObserverPathTemplates entry, or "other", to bound
+	// cardinality. Templates default to the Prometheus and Loki read APIs.
+	EnableObserverPathLabels bool     `yaml:"enable_observer_path_labels"`
+	ObserverPathTemplates    []string `yaml:"observer_path_templates"`
+	// EnableExemplars attaches the trace ID of traced requests, from an OpenTelemetry span or
+	// the traceparent or B3 headers, as exemplars on Observer latency histograms
+	EnableExemplars bool `yaml:"enable_exemplars"`
+	// EnableServerTiming adds a Server-Timing header to responses breaking down the time spent in
+	// jitter, backpressure admission, injected chaos latency, and the upstream, in milliseconds
+	EnableServerTiming bool `yaml:"enable_server_timing"`
+	// EnableDecisionHeaders adds the X-Throttle-Allowance and X-Throttle-Watermark of backpressure
+	// and the X-Jitter-Applied-Ms of jitter to responses
+	EnableDecisionHeaders bool          `yaml:"enable_decision_headers"`
+	ClientTimeout         time.Duration `yaml:"client_timeout"`
+	EnableCriticality     bool          `yaml:"enable_criticality"`
+	// RetryAfter is sent as the Retry-After header on blocked responses of middlewares which do
+	// not estimate their own, like backpressure and rate limits do. Omitted when unset.
+	RetryAfter time.Duration `yaml:"retry_after"`
+	// Rejections overrides the response written when a request is rejected, keyed by the
+	// middleware type that blocked it (e.g. backpressure) or "error" for unexpected errors.
+	Rejections map[string]RejectionConfig `yaml:"rejections"`
+	// Middlewares enables registered third-party middlewares, innermost after the built-ins
+	Middlewares []MiddlewareConfig `yaml:"middlewares"`
+	// MiddlewareOrder reorders the enabled middlewares it names, outermost first, e.g.
+	// [observer, blocker, backpressure, jitter] jitters requests only once they are admitted.
+	// Unnamed middlewares keep their default position and named ones which are disabled are
+	// skipped.
+	MiddlewareOrder []string `yaml:"middleware_order"`
+	// Clock is the time source of the recorder, jitter, warm-up, adaptive limit, backpressure,
+	// retry, and chaos middlewares.
+	// Defaults to SystemClock.
+	Clock Clock `yaml:"-"`
+	// Rand samples recorded requests, jitter, probabilistic backpressure admission, retry
+	// backoff, and chaos faults. Defaults to SystemRand.
+	Rand Rand `yaml:"-"`
 }
 
 // APIErrorResponse represents the standard error response format
@@ -94,6 +159,8 @@ type APIErrorResponse struct {
 	Status    string `json:"status"`
 	ErrorType string `json:"errorType"`
 	Error     string `json:"error"`
+	// TraceID correlates rejections with the trace of the request when it was traced
+	TraceID string `json:"traceId,omitempty"`
 }
 
 // Validate ensures all enabled features have proper configuration
@@ -112,30 +179,231 @@ func (c Config) Validate() error {
 		}
 	}
 
+	if err := c.GuardrailConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("guardrail config: %w", err))
+	}
+
+	if err := c.LabelInjectorConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("label injector config: %w", err))
+	}
+
+	if err := c.RateLimitConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("rate limit config: %w", err))
+	}
+
+	if err := c.FingerprintLimitConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("fingerprint limit config: %w", err))
+	}
+
+	if err := c.TenantConcurrencyConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tenant concurrency config: %w", err))
+	}
+
+	if err := c.QuotaConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("quota config: %w", err))
+	}
+
+	if err := c.RemoteWriteConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("remote write config: %w", err))
+	}
+
+	if err := c.AccessLogConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("access log config: %w", err))
+	}
+
+	if err := c.RecordConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("record config: %w", err))
+	}
+
+	if err := c.MirrorConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("mirror config: %w", err))
+	}
+
+	if err := c.ShardConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("shard config: %w", err))
+	}
+
+	if err := c.RetryConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("retry config: %w", err))
+	}
+
+	if err := c.ChaosConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("chaos config: %w", err))
+	}
+
+	if err := c.QueryCostCacheConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("query cost cache config: %w", err))
+	}
+
+	if err := c.AuditConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("audit config: %w", err))
+	}
+
+	if err := c.TimeoutConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("timeout config: %w", err))
+	}
+
+	if err := c.CostFeedbackConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("cost feedback config: %w", err))
+	}
+
+	if err := c.AdaptiveLimitConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("adaptive limit config: %w", err))
+	}
+
+	if err := c.WarmupConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("warmup config: %w", err))
+	}
+
+	if err := c.MaintenanceConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("maintenance config: %w", err))
+	}
+
+	if err := c.TenantStatsConfig.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tenant stats config: %w", err))
+	}
+
 	if c.EnableJitter && c.JitterDelay == 0 {
 		errs = append(errs, ErrJitterDelayRequired)
 	}
 
+	if err := c.JitterStrategy.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.JitterStddev < 0 {
+		errs = append(errs, ErrNegativeJitterStddev)
+	}
+
+	for _, template := range c.ObserverPathTemplates {
+		if !strings.HasPrefix(template, "/") {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrInvalidPathTemplate, template))
+		}
+	}
+
+	for _, mw := range c.Middlewares {
+		if err := mw.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(c.MiddlewareOrder) > 0 {
+		if err := validateMiddlewareOrder(c.MiddlewareOrder); err != nil {
+			errs = append(errs, err)
+		} else if err := validateOrder(c.middlewareTypes()); err != nil {
+			errs = append(errs, fmt.Errorf("middleware order: %w", err))
+		}
+	}
+
+	for key, rejection := range c.Rejections {
+		if err := rejection.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rejection %s: %w", key, err))
+		}
+	}
+
 	return errors.Join(errs...)
 }
 
+func (c Config) observerPathTemplates() []string {
+	if len(c.ObserverPathTemplates) == 0 {
+		return DefaultObserverPathTemplates
+	}
+	return c.ObserverPathTemplates
+}
+
 // ServeEntry represents the entry point of the middleware chain
 type ServeEntry struct {
-	client  ProxyClient
-	timeout time.Duration
+	client ProxyClient
+	// exit is the end of the chain, requests skip straight to it in open maintenance mode
+	exit           ProxyClient
+	maintenance    MaintenanceConfig
+	timeout        time.Duration
+	retryAfter     time.Duration
+	rejections     map[string]rejection
+	trustedProxies []netip.Prefix
+	// tenantHeader identifies the tenant of requests listed in flight
+	tenantHeader string
+	// serverTiming and decisionHeaders annotate responses with the Server-Timing and decision headers
+	serverTiming    bool
+	decisionHeaders bool
+	lifecycle       lifecycle
 }
 
 // NewServeFromConfig constructs a middleware chain based on configuration.
 // The middleware chain is constructed in the following order:
 // 1. Request wrapping (Entry)
 // 2. Metrics collection (Observer)
-// 3. Request spreading (Jitter)
-// 4. Adaptive rate limiting (Backpressure)
-// 6. Final handler (Exit)
+// 3. Request logging (AccessLog)
+// 4. Traffic recording for replays (Recorder)
+// 5. Recent blocked requests (Audit)
+// 6. Per-criticality deadlines (Timeout)
+// 7. Per-tenant aggregates (TenantStats)
+// 8. Request blocking (Blocker)
+// 9. Query syntax, range, and resolution limits (Guardrail)
+// 10. Per-tenant rate limiting (RateLimiter)
+// 11. Per-query-shape rate limiting (FingerprintLimiter)
+// 12. Per-tenant in-flight limits (TenantConcurrencyLimiter)
+// 13. Per-tenant hourly and daily budgets (Quota)
+// 14. Remote-write samples per second limiting (RemoteWriteLimiter)
+// 15. Request spreading (Jitter)
+// 16. Slow-start concurrency ramp (WarmupLimiter)
+// 17. Latency-driven concurrency limiting (AdaptiveLimiter)
+// 18. Adaptive rate limiting (Backpressure)
+// 19. Query cost calibration from Prometheus stats (CostFeedback)
+// 20. PromQL label scoping (LabelInjector)
+// 21. Range query alignment to step boundaries (StepAligner)
+// 22. Shadow traffic to a secondary upstream (Mirror)
+// 23. Range query splitting (Sharder)
+// 24. Retries of throttled round trips within a budget (Retrier)
+// 25. Upstream fault injection (ChaosInjector)
+// 26. Final handler (Exit)
+//
+// Panics if a registered middleware factory fails or the order breaks the built-ins, use
+// NewServeFromConfigE to handle the error.
 func NewServeFromConfig(cfg Config, next http.HandlerFunc) *ServeEntry {
+	entry, err := NewServeFromConfigE(cfg, next)
+	if err != nil {
+		panic(err)
+	}
+	return entry
+}
+
+// NewServeFromConfigE constructs the middleware chain of NewServeFromConfig, returning an error
+// if a registered middleware factory fails or the order breaks the built-ins
+func NewServeFromConfigE(cfg Config, next http.HandlerFunc) (*ServeEntry, error) {
+	return NewServeFromChain(cfg, NewChainBuilder(cfg), next)
+}
+
+// NewServeFromChain constructs the entry point around the chain assembled by the builder.
+// The config supplies the client timeout and rejection settings.
+func NewServeFromChain(cfg Config, cb *ChainBuilder, next http.HandlerFunc) (*ServeEntry, error) {
+	exit := &ServeExit{next}
+	client, err := cb.Build(exit)
+	if err != nil {
+		return nil, err
+	}
+	return newServeEntry(cfg, client, exit), nil
+}
+
+func newServeEntry(cfg Config, client, exit ProxyClient) *ServeEntry {
+	timeout := cfg.ClientTimeout
+	if cfg.EnableTimeouts {
+		// the Timeout middleware applies ClientTimeout so criticalities may extend past it
+		timeout = 0
+	}
+
+	trustedProxies, _ := ParsePrefixes(cfg.TrustedProxies)
 	return &ServeEntry{
-		client:  NewFromConfig(cfg, &ServeExit{next}),
-		timeout: cfg.ClientTimeout,
+		client:          client,
+		exit:            exit,
+		maintenance:     cfg.MaintenanceConfig,
+		timeout:         timeout,
+		retryAfter:      cfg.RetryAfter,
+		rejections:      newRejections(cfg.Rejections),
+		trustedProxies:  trustedProxies,
+		tenantHeader:    cfg.TenantStatsConfig.header(),
+		serverTiming:    cfg.EnableServerTiming,
+		decisionHeaders: cfg.EnableDecisionHeaders,
 	}
 }
 
@@ -143,28 +411,55 @@ func NewServeFuncFromConfig(cfg Config, next http.HandlerFunc) http.HandlerFunc
 	return NewServeFromConfig(cfg, next).ServeHTTP
 }
 
+// NewFromConfig wraps the client with the middlewares enabled in the config, reordered by its
+// MiddlewareOrder. Use a ChainBuilder to add custom middlewares. Panics if a registered
+// middleware factory fails or the order breaks the built-ins, use NewFromConfigE to handle the
+// error.
 func NewFromConfig(cfg Config, client ProxyClient) ProxyClient {
-	if cfg.EnableBackpressure {
-		client = NewBackpressure(client, cfg.BackpressureConfig)
+	client, err := NewFromConfigE(cfg, client)
+	if err != nil {
+		panic(err)
 	}
+	return client
+}
+
+// NewFromConfigE wraps the client like NewFromConfig, returning an error if a registered
+// middleware factory fails or the order breaks the built-ins
+func NewFromConfigE(cfg Config, client ProxyClient) (ProxyClient, error) {
+	return NewChainBuilder(cfg).Build(client)
+}
 
-	if cfg.EnableJitter {
-		client = NewJitterer(client, cfg.JitterDelay, cfg.EnableCriticality)
+// ServeHTTP processes requests through the middleware chain
+func (se *ServeEntry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// rejections are annotated too, e.g. with the jitter before a rate limit
+	if ctx, annotate := withAnnotations(r.Context(), se.serverTiming, se.decisionHeaders); annotate != nil {
+		r = r.WithContext(ctx)
+		w = &annotatingWriter{ResponseWriter: w, annotate: annotate}
 	}
 
-	if cfg.EnableBlocker {
-		client = NewBlocker(client, cfg.BlockerConfig)
+	err := se.next(w, r)
+	if err == nil {
+		return
 	}
 
-	if cfg.EnableObserver {
-		client = NewObserver(client)
+	var blocked *RequestBlockedError
+	if errors.As(err, &blocked) {
+		se.writeBlockedHeaders(w, blocked)
+		data := rejectionData{Type: blocked.Type, Error: blocked.Error(), TraceID: traceID(r)}
+		se.rejections[blocked.Type].write(w, data, blocked.HTTPStatus())
+		return
 	}
 
-	return client
+	data := rejectionData{
+		Type:    RejectionKeyError,
+		Error:   fmt.Sprintf("proxy error: %v", err),
+		TraceID: traceID(r),
+	}
+	se.rejections[RejectionKeyError].write(w, data, http.StatusInternalServerError)
 }
 
-// ServeHTTP processes requests through the middleware chain
-func (se *ServeEntry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// next passes the request through the middleware chain within the client timeout
+func (se *ServeEntry) next(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	if se.timeout > 0 {
 		var cancel func()
@@ -172,26 +467,53 @@ func (se *ServeEntry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		defer cancel()
 	}
 
+	ctx = withClientIP(ctx, r, se.trustedProxies)
+	ctx, done := activeInflight.track(ctx, r, se.tenantHeader)
+	defer done()
 	rr := &RequestResponseWrapper{
 		w:   w,
-		req: r.WithContext(ctx),
+		req: r.WithContext(withFormCache(ctx)),
 	}
-	err := se.client.Next(rr)
-	if err == nil {
-		return
+	err := nextInMaintenance(se.client, se.exit, rr)
+	publishBlocked(rr, err)
+	return err
+}
+
+// writeBlockedHeaders tells the client which middleware rejected the request and when to retry
+func (se *ServeEntry) writeBlockedHeaders(w http.ResponseWriter, blocked *RequestBlockedError) {
+	w.Header().Set(string(HeaderThrottleReason), blocked.Type)
+	for name, value := range blocked.Headers {
+		w.Header().Set(name, value)
 	}
 
-	var blocked *RequestBlockedError
-	if errors.As(err, &blocked) {
-		writeAPIError(w, blocked.Error(), http.StatusTooManyRequests)
-		return
+	retryAfter := se.retryAfter
+	if blocked.RetryAfter > 0 {
+		retryAfter = blocked.RetryAfter
+	}
+	if retryAfter > 0 {
+		seconds := int64(math.Ceil(retryAfter.Seconds()))
+		w.Header().Set(string(HeaderRetryAfter), strconv.FormatInt(seconds, 10))
 	}
-	writeAPIError(w, fmt.Sprintf("proxy error: %v", err), http.StatusInternalServerError)
 }
 
-// Init initializes the middleware chain
-func (se *ServeEntry) Init(ctx context.Context) {
-	se.client.Init(ctx)
+// Init initializes the middleware chain and switches to the configured maintenance mode. A chain
+// can only be initialized once.
+func (se *ServeEntry) Init(ctx context.Context) error {
+	ctx, err := se.lifecycle.start(ctx)
+	if err != nil {
+		return err
+	}
+	if se.maintenance.MaintenanceMode != "" {
+		activeMaintenance.set(se.maintenance)
+	}
+	return se.client.Init(ctx)
+}
+
+// Close stops the background pollers of the middleware chain, like the backpressure queries,
+// and waits for them to exit. Requests served after Close are no longer throttled by fresh
+// signals, so close the entry point once it stops receiving traffic.
+func (se *ServeEntry) Close() error {
+	return se.lifecycle.close()
 }
 
 // ServeExit represents the final handler in the middleware chain for http.HandlerFunc
@@ -199,7 +521,9 @@ type ServeExit struct {
 	next http.HandlerFunc
 }
 
-func (se *ServeExit) Init(_ context.Context) {}
+func (se *ServeExit) Init(_ context.Context) error {
+	return nil
+}
 
 func (se *ServeExit) Next(rr Request) error {
 	rrw, ok := rr.(ResponseWriter)
@@ -217,25 +541,135 @@ func (se *ServeExit) Next(rr Request) error {
 		return ErrNilRequest
 	}
 
+	defer enterStage(rr, InflightStageUpstream, "proxying")()
+	defer startUpstream(rr)()
 	se.next.ServeHTTP(w, r)
 	return nil
 }
 
 type RoundTripperEntry struct {
 	client ProxyClient
+	// exit is the end of the chain, requests skip straight to it in open maintenance mode
+	exit ProxyClient
+	// transport sends the requests of the exit
+	transport      http.RoundTripper
+	maintenance    MaintenanceConfig
+	trustedProxies []netip.Prefix
+	// tenantHeader identifies the tenant of requests listed in flight
+	tenantHeader    string
+	serverTiming    bool
+	decisionHeaders bool
+	// hosts are the entries of destination hosts with their own chain
+	hosts     map[string]*RoundTripperEntry
+	lifecycle lifecycle
 }
 
+// NewRoundTripperFromConfig constructs the entry point around the middlewares enabled in the
+// config. Panics if a registered middleware factory fails or the order breaks the built-ins, use
+// NewRoundTripperFromConfigE to handle the error.
 func NewRoundTripperFromConfig(cfg Config, rt http.RoundTripper) *RoundTripperEntry {
-	client := NewFromConfig(cfg, &RoundTripperExit{rt})
-	return &RoundTripperEntry{client}
+	entry, err := NewRoundTripperFromConfigE(cfg, rt)
+	if err != nil {
+		panic(err)
+	}
+	return entry
+}
+
+// NewRoundTripperFromConfigE constructs the entry point of NewRoundTripperFromConfig, returning
+// an error if a registered middleware factory fails or the order breaks the built-ins
+func NewRoundTripperFromConfigE(cfg Config, rt http.RoundTripper) (*RoundTripperEntry, error) {
+	return NewRoundTripperFromChain(NewChainBuilder(cfg), rt)
+}
+
+// NewRoundTripperFromChain constructs the entry point around the chain assembled by the builder
+func NewRoundTripperFromChain(cb *ChainBuilder, rt http.RoundTripper) (*RoundTripperEntry, error) {
+	exit := &RoundTripperExit{rt}
+	client, err := cb.Build(exit)
+	if err != nil {
+		return nil, err
+	}
+	return &RoundTripperEntry{
+		client:          client,
+		exit:            exit,
+		transport:       rt,
+		maintenance:     cb.maintenance,
+		trustedProxies:  cb.trustedProxies,
+		tenantHeader:    cb.tenantHeader,
+		serverTiming:    cb.cfg.EnableServerTiming,
+		decisionHeaders: cb.cfg.EnableDecisionHeaders,
+	}, nil
+}
+
+// NewRoundTripperFromHosts constructs the entry point with a separate chain per destination host,
+// so one http.Client calls several backends with independent limits and congestion windows.
+// Requests match hosts by the host and port of their URL, then the host alone, and fall back to
+// the chain of cfg. Hosts without a MetricsConfig prefix their metrics with the host in the
+// registry of cfg, e.g. host_thanos_9090_proxymw_bp_allowance. The chain of cfg is the one served
+// by the introspection, readiness, quota, tenant summary, and audit handlers and its maintenance
+// mode applies to every host. Panics if a registered middleware factory fails or an order breaks the built-ins,
+// use NewRoundTripperFromHostsE to handle the error.
+func NewRoundTripperFromHosts(
+	cfg Config, hosts map[string]Config, rt http.RoundTripper,
+) *RoundTripperEntry {
+	entry, err := NewRoundTripperFromHostsE(cfg, hosts, rt)
+	if err != nil {
+		panic(err)
+	}
+	return entry
+}
+
+// NewRoundTripperFromHostsE constructs the entry point of NewRoundTripperFromHosts, returning an
+// error naming the host if a registered middleware factory fails or an order breaks the built-ins
+func NewRoundTripperFromHostsE(
+	cfg Config, hosts map[string]Config, rt http.RoundTripper,
+) (*RoundTripperEntry, error) {
+	entry, err := NewRoundTripperFromConfigE(cfg, rt)
+	if err != nil {
+		return nil, err
+	}
+	entry.hosts = make(map[string]*RoundTripperEntry, len(hosts))
+	for host, hostCfg := range hosts {
+		if !hostCfg.scoped() {
+			hostCfg.MetricsConfig = cfg.MetricsConfig.host(host)
+		}
+		cb := NewChainBuilder(hostCfg)
+		cb.private = true
+		hostEntry, err := NewRoundTripperFromChain(cb, rt)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", host, err)
+		}
+		hostEntry.maintenance = MaintenanceConfig{}
+		entry.hosts[host] = hostEntry
+	}
+	return entry, nil
+}
+
+// host returns the entry of the destination host of the request, nil without a host chain
+func (rte *RoundTripperEntry) host(req *http.Request) *RoundTripperEntry {
+	if len(rte.hosts) == 0 || req.URL == nil {
+		return nil
+	}
+	if entry, ok := rte.hosts[req.URL.Host]; ok {
+		return entry
+	}
+	return rte.hosts[req.URL.Hostname()]
 }
 
 func (rte *RoundTripperEntry) RoundTrip(req *http.Request) (*http.Response, error) {
+	if host := rte.host(req); host != nil {
+		return host.RoundTrip(req)
+	}
+
+	ctx := withClientIP(req.Context(), req, rte.trustedProxies)
+	ctx, done := activeInflight.track(ctx, req, rte.tenantHeader)
+	defer done()
+	ctx, annotate := withAnnotations(ctx, rte.serverTiming, rte.decisionHeaders)
 	rr := &RequestResponseWrapper{
-		req: req,
+		req: req.WithContext(withFormCache(ctx)),
 	}
 
-	if err := rte.client.Next(rr); err != nil {
+	if err := nextInMaintenance(rte.client, rte.exit, rr); err != nil {
+		publishBlocked(rr, err)
 		return nil, err
 	}
 
@@ -244,11 +678,55 @@ func (rte *RoundTripperEntry) RoundTrip(req *http.Request) (*http.Response, erro
 		return nil, ErrNilResponse
 	}
 
+	if annotate != nil {
+		annotate(res.Header)
+	}
 	return res, nil
 }
 
-func (rte *RoundTripperEntry) Init(ctx context.Context) {
-	rte.client.Init(ctx)
+// Init initializes the middleware chain and switches to the configured maintenance mode. A chain
+// can only be initialized once.
+func (rte *RoundTripperEntry) Init(ctx context.Context) error {
+	ctx, err := rte.lifecycle.start(ctx)
+	if err != nil {
+		return err
+	}
+	if rte.maintenance.MaintenanceMode != "" {
+		activeMaintenance.set(rte.maintenance)
+	}
+	for host, entry := range rte.hosts {
+		if err := entry.Init(ctx); err != nil {
+			return fmt.Errorf("host %s: %w", host, err)
+		}
+	}
+	return rte.client.Init(ctx)
+}
+
+// Close stops the background pollers of the middleware chains and waits for them to exit
+func (rte *RoundTripperEntry) Close() error {
+	errs := []error{rte.lifecycle.close()}
+	for host, entry := range rte.hosts {
+		if err := entry.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("host %s: %w", host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport when it keeps any,
+// so http.Client.CloseIdleConnections reaches through the entry
+func (rte *RoundTripperEntry) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if transport, ok := rte.transport.(closeIdler); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// Unwrap returns the transport wrapped by the entry
+func (rte *RoundTripperEntry) Unwrap() http.RoundTripper {
+	return rte.transport
 }
 
 // RoundTripperExit represents the final handler in the middleware chain for http.RoundTripper
@@ -256,7 +734,9 @@ type RoundTripperExit struct {
 	transport http.RoundTripper
 }
 
-func (rte *RoundTripperExit) Init(_ context.Context) {}
+func (rte *RoundTripperExit) Init(_ context.Context) error {
+	return nil
+}
 
 func (rte *RoundTripperExit) Next(r Request) error {
 	rr, ok := r.(Response)
@@ -269,40 +749,43 @@ func (rte *RoundTripperExit) Next(r Request) error {
 		return ErrNilRequest
 	}
 
+	leave := enterStage(r, InflightStageUpstream, "waiting for response headers")
+	answered := startUpstream(r)
 	res, err := rte.transport.RoundTrip(req) // nolint:bodyclose // passthrough
+	answered()
+	leave()
 	rr.SetResponse(res)
 	return err
 }
 
 // writeAPIError writes a standardized error response
-func writeAPIError(w http.ResponseWriter, errorMessage string, code int) {
+func writeAPIError(w http.ResponseWriter, response APIErrorResponse, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
 
-	response := APIErrorResponse{
-		Status:    "error",
-		ErrorType: "throttle-proxy",
-		Error:     errorMessage,
-	}
-
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("error: Failed to encode error response: %v", err)
 	}
 }
 
+// DupRequest clones the request with a body that can be read without consuming the original.
+// The body is buffered once and shared by every duplicate of the request.
 func DupRequest(req *http.Request) (*http.Request, error) {
 	clone := req.Clone(req.Context())
-	if req.Body == nil {
+	if req.Body == nil || req.Body == http.NoBody {
 		return clone, nil
 	}
 
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		return nil, err
+	body, ok := req.Body.(*bufferedBody)
+	if !ok {
+		var err error
+		if body, err = newBufferedBody(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body = body
 	}
 
-	req.Body = io.NopCloser(bytes.NewReader(body))
-	clone.Body = io.NopCloser(bytes.NewBuffer(body))
+	clone.Body = body.reader()
 	return clone, nil
 }
@@ -59,7 +59,7 @@ func TestMiddlewareOrder(t *testing.T) {
 	}
 
 	serve := NewServeFromConfig(config, mock.ServeHTTP)
-	serve.Init(ctx)
+	require.NoError(t, serve.Init(ctx))
 
 	c := serve.client
 	observer := c.(*Observer)
@@ -84,7 +84,7 @@ func TestMiddlewareOrder(t *testing.T) {
 	require.Equal(t, *r.Clone(ctx), *r)
 
 	rt := NewRoundTripperFromConfig(config, mock)
-	rt.Init(ctx)
+	require.NoError(t, rt.Init(ctx))
 
 	rtc := rt.client
 	observer = rtc.(*Observer)
@@ -143,7 +143,7 @@ func TestHangingClient(t *testing.T) {
 	activeRequests := prometheus.NewGauge(prometheus.GaugeOpts{Name: "hanging_requests"})
 	observer.activeGauge = activeRequests
 
-	serve.Init(ctx)
+	require.NoError(t, serve.Init(ctx))
 	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://thanos.io", http.NoBody)
 	require.NoError(t, err)
 
@@ -226,9 +226,163 @@ func TestConfig(t *testing.T) {
 			},
 			err: ErrCongestionWindowMaxBelowMin,
 		},
+		{
+			name: "unknown allowance mode",
+			cfg: Config{
+				BackpressureConfig: BackpressureConfig{
+					EnableBackpressure: true,
+					BackpressureQueries: []BackpressureQuery{
+						{
+							Query:              "up",
+							WarningThreshold:   80,
+							EmergencyThreshold: 100,
+						},
+					},
+					BackpressureMonitoringURL: "https://thanos.io",
+					CongestionWindowMin:       1,
+					CongestionWindowMax:       5,
+					AllowanceMode:             "random",
+				},
+			},
+			err: ErrInvalidAllowanceMode,
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			require.ErrorIs(t, tt.cfg.Validate(), tt.err)
 		})
 	}
 }
+
+func TestBlockedResponseHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		retryAfter time.Duration
+		err        error
+		wantRetry  string
+	}{
+		{
+			name: "no retry after configured",
+			err:  ErrBackpressureBackoff,
+		},
+		{
+			name:       "configured retry after rounds up",
+			retryAfter: 1500 * time.Millisecond,
+			err:        ErrBackpressureBackoff,
+			wantRetry:  "2",
+		},
+		{
+			name:       "error retry after overrides config",
+			retryAfter: time.Second,
+			err: &RequestBlockedError{
+				Err:        ErrBackpressureBackoff,
+				Type:       BlockerProxyType,
+				RetryAfter: time.Minute,
+			},
+			wantRetry: "60",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			serve := &ServeEntry{
+				client: &Mocker{
+					NextFunc: func(_ Request) error { return tt.err },
+				},
+				retryAfter: tt.retryAfter,
+			}
+
+			r, err := http.NewRequestWithContext(
+				context.Background(), http.MethodGet, "https://thanos.io", http.NoBody,
+			)
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			serve.ServeHTTP(w, r)
+
+			var blocked *RequestBlockedError
+			require.ErrorAs(t, tt.err, &blocked)
+			require.Equal(t, http.StatusTooManyRequests, w.Code)
+			require.Equal(t, blocked.Type, w.Header().Get(string(HeaderThrottleReason)))
+			require.Equal(t, tt.wantRetry, w.Header().Get(string(HeaderRetryAfter)))
+		})
+	}
+}
+
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestRoundTripperEntryTransport(t *testing.T) {
+	t.Parallel()
+	transport := &idleClosingTransport{RoundTripper: &Mocker{}}
+	entry := NewRoundTripperFromConfig(Config{}, transport)
+	require.Same(t, transport, entry.Unwrap())
+
+	client := &http.Client{Transport: entry}
+	client.CloseIdleConnections()
+	require.Equal(t, 1, transport.closed)
+
+	chained, err := NewRoundTripperFromChain(NewChainBuilder(Config{}), &Mocker{})
+	require.NoError(t, err)
+	require.NotPanics(t, chained.CloseIdleConnections, "transports without idle connections are skipped")
+}
+
+func TestRoundTripperFromHosts(t *testing.T) {
+	t.Parallel()
+	blocking := Config{
+		BlockerConfig: BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-block=user"},
+		},
+	}
+	rt := &Mocker{
+		RoundTripFunc: func(_ *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	}
+	reg := prometheus.NewRegistry()
+	entry := NewRoundTripperFromHosts(Config{MetricsConfig: MetricsConfig{MetricsRegistry: reg}}, map[string]Config{
+		"thanos.example":     blocking,
+		"loki.example:3100":  {},
+		"prometheus.example": blocking,
+	}, rt)
+	require.NoError(t, entry.Init(t.Context()))
+	t.Cleanup(func() { require.NoError(t, entry.Close()) })
+
+	for _, tt := range []struct {
+		url     string
+		blocked bool
+	}{
+		{url: "http://thanos.example/api/v1/query", blocked: true},
+		{url: "http://thanos.example:9090/api/v1/query", blocked: true},
+		{url: "http://loki.example:3100/loki/api/v1/query", blocked: false},
+		{url: "http://other.example/api/v1/query", blocked: false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.url, http.NoBody)
+		req.Header.Set("X-block", "user")
+		res, err := entry.RoundTrip(req)
+		if tt.blocked {
+			var blocked *RequestBlockedError
+			require.ErrorAs(t, err, &blocked, tt.url)
+			require.Equal(t, BlockerProxyType, blocked.Type)
+			continue
+		}
+		require.NoError(t, err, tt.url)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	// hosts count their blocks apart in the registry of the entry
+	blocks := map[string]float64{}
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			blocks[family.GetName()] += m.GetCounter().GetValue()
+		}
+	}
+	require.InDelta(t, 2, blocks["host_thanos_example_proxymw_blocker_pattern_blocks_total"], 0)
+	require.Contains(t, blocks, "host_prometheus_example_proxymw_blocker_pattern_blocks_total")
+	require.InDelta(t, 0, blocks["host_prometheus_example_proxymw_blocker_pattern_blocks_total"], 0)
+}
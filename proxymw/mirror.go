@@ -0,0 +1,227 @@
+package proxymw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	MirrorProxyType = "mirror"
+
+	DefaultMirrorPercent     = 100.0
+	DefaultMirrorConcurrency = 10
+	DefaultMirrorTimeout     = 30 * time.Second
+
+	mirrorResultSent    = "sent"
+	mirrorResultSkipped = "skipped"
+	mirrorResultFailed  = "failed"
+)
+
+var (
+	ErrMirrorUpstreamRequired = errors.New("mirroring requires an http or https mirror upstream")
+	ErrMirrorPercent          = errors.New("mirror percent must be between 0 and 100")
+	ErrNegativeMirror         = errors.New("mirror concurrency and timeout cannot be negative")
+
+	defaultMirrorMetrics = newMirrorMetrics(defaultMetricsFactory)
+)
+
+// mirrorMetrics are the collectors of the Mirror of one middleware chain
+type mirrorMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+func newMirrorMetrics(factory promauto.Factory) *mirrorMetrics {
+	return &mirrorMetrics{
+		requests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_mirror_requests_total",
+			Help: "Sampled requests by whether their mirror was sent, skipped at the concurrency cap, or failed",
+		}, []string{"result"}),
+	}
+}
+
+// MirrorConfig copies a sample of admitted requests to a secondary upstream, e.g. to load test a
+// new Thanos deployment with real traffic. Mirrored responses are discarded.
+type MirrorConfig struct {
+	EnableMirror   bool   `yaml:"enable_mirror"`
+	MirrorUpstream string `yaml:"mirror_upstream"`
+	// MirrorPercent of requests are mirrored. Defaults to 100 when unset, 0 mirrors none.
+	MirrorPercent *float64 `yaml:"mirror_percent"`
+	// MirrorConcurrency caps the mirrored requests in flight. Requests sampled while the cap is
+	// reached are not mirrored so a slow mirror never holds back production traffic.
+	MirrorConcurrency int           `yaml:"mirror_concurrency"`
+	MirrorTimeout     time.Duration `yaml:"mirror_timeout"`
+}
+
+func (c MirrorConfig) Validate() error {
+	if !c.EnableMirror {
+		return nil
+	}
+
+	if _, err := c.upstream(); err != nil {
+		return err
+	}
+
+	if p := c.MirrorPercent; p != nil && (*p < 0 || *p > 100) {
+		return ErrMirrorPercent
+	}
+
+	if c.MirrorConcurrency < 0 || c.MirrorTimeout < 0 {
+		return ErrNegativeMirror
+	}
+	return nil
+}
+
+func (c MirrorConfig) upstream() (*url.URL, error) {
+	u, err := url.Parse(c.MirrorUpstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrMirrorUpstreamRequired
+	}
+	return u, nil
+}
+
+func (c MirrorConfig) percent() float64 {
+	if c.MirrorPercent == nil {
+		return DefaultMirrorPercent
+	}
+	return *c.MirrorPercent
+}
+
+func (c MirrorConfig) concurrency() int {
+	if c.MirrorConcurrency == 0 {
+		return DefaultMirrorConcurrency
+	}
+	return c.MirrorConcurrency
+}
+
+func (c MirrorConfig) timeout() time.Duration {
+	if c.MirrorTimeout == 0 {
+		return DefaultMirrorTimeout
+	}
+	return c.MirrorTimeout
+}
+
+// Mirror sends a copy of sampled requests to the mirror upstream in the background before
+// forwarding the original. Mirrored requests outlive the client request, closing the chain
+// cancels them and waits for them to return.
+type Mirror struct {
+	client    ProxyClient
+	upstream  *url.URL
+	percent   float64
+	timeout   time.Duration
+	inflight  chan struct{}
+	transport http.RoundTripper
+	// rand defaults to the system source when nil
+	rand Rand
+
+	ctx      context.Context
+	requests *prometheus.CounterVec
+}
+
+var _ ProxyClient = &Mirror{}
+
+// NewMirror creates a Mirror from a validated config
+func NewMirror(client ProxyClient, cfg MirrorConfig) *Mirror {
+	return newMirror(client, cfg, defaultMirrorMetrics)
+}
+
+func newMirror(client ProxyClient, cfg MirrorConfig, m *mirrorMetrics) *Mirror {
+	upstream, _ := cfg.upstream()
+	return &Mirror{
+		client:    client,
+		upstream:  upstream,
+		percent:   cfg.percent(),
+		timeout:   cfg.timeout(),
+		inflight:  make(chan struct{}, cfg.concurrency()),
+		transport: http.DefaultTransport,
+		ctx:       context.Background(),
+		requests:  m.requests,
+	}
+}
+
+func (m *Mirror) Init(ctx context.Context) error {
+	m.ctx = ctx
+	return m.client.Init(ctx)
+}
+
+func (m *Mirror) Next(rr Request) error {
+	if req := rr.Request(); req != nil && orSystemRand(m.rand).Float64()*100 < m.percent {
+		m.mirror(req)
+	}
+	return m.client.Next(rr)
+}
+
+// mirror copies the request while its body is still unread and sends the copy in the background
+func (m *Mirror) mirror(req *http.Request) {
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		m.requests.WithLabelValues(mirrorResultSkipped).Inc()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, m.timeout)
+	mirrored, err := m.mirrorRequest(ctx, req)
+	if err != nil {
+		cancel()
+		<-m.inflight
+		m.requests.WithLabelValues(mirrorResultFailed).Inc()
+		return
+	}
+
+	release := func() {
+		cancel()
+		<-m.inflight
+	}
+	if !goUntilDone(m.ctx, func() {
+		defer release()
+		m.requests.WithLabelValues(m.send(mirrored)).Inc()
+	}) {
+		release()
+		m.requests.WithLabelValues(mirrorResultSkipped).Inc()
+	}
+}
+
+func (m *Mirror) mirrorRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		dup, err := DupRequest(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// the pooled body of the original is released once the upstream reads it
+		if body, err = io.ReadAll(dup.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	target := m.upstream.JoinPath(req.URL.Path)
+	target.RawQuery = req.URL.RawQuery
+	mirrored, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	mirrored.Header = req.Header.Clone()
+	return mirrored, nil
+}
+
+func (m *Mirror) send(req *http.Request) string {
+	resp, err := m.transport.RoundTrip(req)
+	if err != nil {
+		return mirrorResultFailed
+	}
+	defer resp.Body.Close() //nolint:errcheck // mirrored responses are discarded
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return mirrorResultFailed
+	}
+	return mirrorResultSent
+}
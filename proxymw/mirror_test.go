@@ -0,0 +1,194 @@
+package proxymw
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestMirrorConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  MirrorConfig
+		want error
+	}{
+		{name: "disabled", cfg: MirrorConfig{MirrorPercent: ptr(200.0)}},
+		{
+			name: "valid",
+			cfg:  MirrorConfig{EnableMirror: true, MirrorUpstream: "http://thanos:9090"},
+		},
+		{
+			name: "mirroring paused",
+			cfg: MirrorConfig{
+				EnableMirror: true, MirrorUpstream: "http://thanos:9090", MirrorPercent: ptr(0.0),
+			},
+		},
+		{
+			name: "missing upstream",
+			cfg:  MirrorConfig{EnableMirror: true},
+			want: ErrMirrorUpstreamRequired,
+		},
+		{
+			name: "unsupported scheme",
+			cfg:  MirrorConfig{EnableMirror: true, MirrorUpstream: "ftp://thanos"},
+			want: ErrMirrorUpstreamRequired,
+		},
+		{
+			name: "percent over 100",
+			cfg: MirrorConfig{
+				EnableMirror: true, MirrorUpstream: "http://thanos:9090", MirrorPercent: ptr(101.0),
+			},
+			want: ErrMirrorPercent,
+		},
+		{
+			name: "negative concurrency",
+			cfg: MirrorConfig{
+				EnableMirror: true, MirrorUpstream: "http://thanos:9090", MirrorConcurrency: -1,
+			},
+			want: ErrNegativeMirror,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.want)
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+	type mirrored struct {
+		method, uri, body, header string
+	}
+	received := make(chan mirrored, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirrored{r.Method, r.RequestURI, string(body), r.Header.Get("X-Scope-OrgID")}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	var forwarded string
+	next := &Mocker{NextFunc: func(rr Request) error {
+		body, err := io.ReadAll(rr.Request().Body)
+		forwarded = string(body)
+		return err
+	}}
+	m := newMirrorMetrics(promauto.With(prometheus.NewRegistry()))
+	mirror := newMirror(next, MirrorConfig{
+		EnableMirror:   true,
+		MirrorUpstream: shadow.URL + "/thanos",
+	}, m)
+
+	req := httptest.NewRequest(
+		http.MethodPost, "/api/v1/query?dedup=true", strings.NewReader("query=up"),
+	)
+	req.Header.Set("X-Scope-OrgID", "team-a")
+	require.NoError(t, mirror.Next(&RequestResponseWrapper{req: req}))
+	require.Equal(t, "query=up", forwarded)
+
+	select {
+	case got := <-received:
+		require.Equal(t, mirrored{
+			method: http.MethodPost,
+			uri:    "/thanos/api/v1/query?dedup=true",
+			body:   "query=up",
+			header: "team-a",
+		}, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// mirror responses are discarded regardless of status
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.requests.WithLabelValues(mirrorResultSent)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMirrorSampling(t *testing.T) {
+	t.Parallel()
+	m := newMirrorMetrics(promauto.With(prometheus.NewRegistry()))
+	mirror := newMirror(&Mocker{NextFunc: func(Request) error { return nil }}, MirrorConfig{
+		EnableMirror:      true,
+		MirrorUpstream:    "http://127.0.0.1:1",
+		MirrorPercent:     ptr(50.0),
+		MirrorConcurrency: 1,
+	}, m)
+
+	// unsampled requests are only forwarded
+	mirror.rand = fixedRand(0.6)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	require.NoError(t, mirror.Next(&RequestResponseWrapper{req: req}))
+	require.Empty(t, mirror.inflight)
+
+	// sampled requests over the concurrency cap are skipped
+	mirror.rand = fixedRand(0.1)
+	mirror.inflight <- struct{}{}
+	require.NoError(t, mirror.Next(&RequestResponseWrapper{req: req}))
+	require.InDelta(t, 1, testutil.ToFloat64(m.requests.WithLabelValues(mirrorResultSkipped)), 0)
+}
+
+func TestMirrorPercentZero(t *testing.T) {
+	t.Parallel()
+	m := newMirrorMetrics(promauto.With(prometheus.NewRegistry()))
+	mirror := newMirror(&Mocker{NextFunc: func(Request) error { return nil }}, MirrorConfig{
+		EnableMirror:   true,
+		MirrorUpstream: "http://127.0.0.1:1",
+		MirrorPercent:  ptr(0.0),
+	}, m)
+	mirror.rand = fixedRand(0)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+	require.NoError(t, mirror.Next(&RequestResponseWrapper{req: req}))
+	require.Empty(t, mirror.inflight)
+	require.Zero(t, testutil.CollectAndCount(m.requests))
+}
+
+func TestMirrorClose(t *testing.T) {
+	t.Parallel()
+	started := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer shadow.Close()
+
+	var cfg Config
+	cfg.MirrorConfig = MirrorConfig{EnableMirror: true, MirrorUpstream: shadow.URL}
+	cfg.MetricsConfig = MetricsConfig{MetricsRegistry: prometheus.NewRegistry()}
+	entry, err := NewServeFromConfigE(cfg, func(http.ResponseWriter, *http.Request) {})
+	require.NoError(t, err)
+	require.NoError(t, entry.Init(context.Background()))
+
+	entry.ServeHTTP(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody),
+	)
+	<-started
+
+	// Close cancels the mirrored request and waits for it
+	require.NoError(t, entry.Close())
+	mirror, ok := entry.client.(*Mirror)
+	require.True(t, ok)
+	require.Empty(t, mirror.inflight)
+	require.InDelta(t, 1, testutil.ToFloat64(mirror.requests.WithLabelValues(mirrorResultFailed)), 0)
+
+	// requests served after Close are not mirrored
+	entry.ServeHTTP(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody),
+	)
+	require.Empty(t, mirror.inflight)
+}
@@ -9,7 +9,7 @@ import (
 type Mocker struct {
 	ServeHTTPFunc func(w http.ResponseWriter, r *http.Request)
 	RoundTripFunc func(r *http.Request) (*http.Response, error)
-	InitFunc      func(context.Context)
+	InitFunc      func(context.Context) error
 	NextFunc      func(Request) error
 	RequestFunc   func() *http.Request
 }
@@ -27,8 +27,8 @@ func (m *Mocker) RoundTrip(r *http.Request) (*http.Response, error) {
 	return m.RoundTripFunc(r)
 }
 
-func (m *Mocker) Init(ctx context.Context) {
-	m.InitFunc(ctx)
+func (m *Mocker) Init(ctx context.Context) error {
+	return m.InitFunc(ctx)
 }
 
 func (m *Mocker) Next(rr Request) error {
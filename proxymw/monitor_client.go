@@ -0,0 +1,90 @@
+package proxymw
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// MonitorMaxIdleConnsPerHost keeps connections to each monitoring endpoint open between poll
+// cycles since every backpressure query is fetched in parallel
+const MonitorMaxIdleConnsPerHost = 32
+
+var ErrMonitorAuthConflict = errors.New("monitor client accepts one of bearer token or basic auth")
+
+// MonitorClientConfig configures the HTTP client fetching backpressure signals so the proxy can
+// query secured Prometheus, Thanos, or multi-tenant Mimir endpoints.
+type MonitorClientConfig struct {
+	// BearerToken is sent as the Authorization header of every signal fetch
+	BearerToken string `yaml:"bearer_token"`
+	// BearerTokenFile is read on every signal fetch so rotated tokens are picked up
+	BearerTokenFile   string `yaml:"bearer_token_file"`
+	BasicAuthUsername string `yaml:"basic_auth_username"`
+	BasicAuthPassword string `yaml:"basic_auth_password"`
+	// Headers are added to every signal fetch (e.g. X-Scope-OrgID)
+	Headers map[string]string `yaml:"headers"`
+	// ProxyURL routes signal fetches through an HTTP proxy. Defaults to the environment proxy.
+	ProxyURL string `yaml:"proxy_url"`
+}
+
+func (c MonitorClientConfig) Validate() error {
+	bearer := c.BearerToken != "" || c.BearerTokenFile != ""
+	if c.BearerToken != "" && c.BearerTokenFile != "" ||
+		bearer && (c.BasicAuthUsername != "" || c.BasicAuthPassword != "") {
+		return ErrMonitorAuthConflict
+	}
+
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+	}
+	return nil
+}
+
+// client builds the signal fetching client. Assumes the config was validated.
+func (c MonitorClientConfig) client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = MonitorMaxIdleConnsPerHost
+	if proxyURL, err := url.Parse(c.ProxyURL); c.ProxyURL != "" && err == nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout:   MonitorQueryTimeout,
+		Transport: &monitorTransport{cfg: c, base: transport},
+	}
+}
+
+// monitorTransport decorates signal fetches with the configured auth and headers
+type monitorTransport struct {
+	cfg  MonitorClientConfig
+	base http.RoundTripper
+}
+
+func (t *monitorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	token := t.cfg.BearerToken
+	if t.cfg.BearerTokenFile != "" {
+		contents, err := os.ReadFile(t.cfg.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read bearer token file: %w", err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case t.cfg.BasicAuthUsername != "" || t.cfg.BasicAuthPassword != "":
+		req.SetBasicAuth(t.cfg.BasicAuthUsername, t.cfg.BasicAuthPassword)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,101 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorClientConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  MonitorClientConfig
+		want error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "bearer token with headers",
+			cfg: MonitorClientConfig{
+				BearerToken: "secret",
+				Headers:     map[string]string{"X-Scope-OrgID": "team-a"},
+			},
+		},
+		{
+			name: "bearer token and basic auth",
+			cfg:  MonitorClientConfig{BearerTokenFile: "/token", BasicAuthUsername: "admin"},
+			want: ErrMonitorAuthConflict,
+		},
+		{
+			name: "bearer token and token file",
+			cfg:  MonitorClientConfig{BearerToken: "secret", BearerTokenFile: "/token"},
+			want: ErrMonitorAuthConflict,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.want)
+		})
+	}
+}
+
+func TestMonitorClient(t *testing.T) {
+	t.Parallel()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rotated\n"), 0o600))
+
+	for _, tt := range []struct {
+		name       string
+		cfg        MonitorClientConfig
+		wantAuth   string
+		wantTenant string
+	}{
+		{
+			name: "no auth",
+		},
+		{
+			name: "bearer token with tenant header",
+			cfg: MonitorClientConfig{
+				BearerToken: "secret",
+				Headers:     map[string]string{"X-Scope-OrgID": "team-a"},
+			},
+			wantAuth:   "Bearer secret",
+			wantTenant: "team-a",
+		},
+		{
+			name:     "bearer token file",
+			cfg:      MonitorClientConfig{BearerTokenFile: tokenFile},
+			wantAuth: "Bearer rotated",
+		},
+		{
+			name:     "basic auth",
+			cfg:      MonitorClientConfig{BasicAuthUsername: "admin", BasicAuthPassword: "pass"},
+			wantAuth: "Basic YWRtaW46cGFzcw==",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, tt.wantAuth, r.Header.Get("Authorization"))
+				require.Equal(t, tt.wantTenant, r.Header.Get("X-Scope-OrgID"))
+			}))
+			defer srv.Close()
+
+			req, err := http.NewRequestWithContext(
+				context.Background(), http.MethodGet, srv.URL, http.NoBody,
+			)
+			require.NoError(t, err)
+			resp, err := tt.cfg.client().Do(req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Empty(t, req.Header.Get("Authorization"), "the original request is untouched")
+		})
+	}
+}
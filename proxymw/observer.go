@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"runtime/debug"
 	"time"
 
@@ -11,32 +12,80 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	ObserverProxyType = "observer"
+)
+
 var (
-	errCounter = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "proxymw_error_count",
-	})
-	blockCounter = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "proxymw_block_count",
-		},
-		[]string{"mw_type"},
-	)
-	reqCounter = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "proxymw_request_count",
-	})
-
-	ms          = float64(time.Millisecond.Milliseconds())
-	minute      = float64(time.Minute.Milliseconds())
-	latencyHist = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "proxymw_request_latency_ms",
-		Buckets: prometheus.ExponentialBucketsRange(ms, 10*minute, 12),
-	})
-
-	activeGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "proxymw_active_requests",
-	})
+	ms             = float64(time.Millisecond.Milliseconds())
+	minute         = float64(time.Minute.Milliseconds())
+	latencyBuckets = prometheus.ExponentialBucketsRange(ms, 10*minute, 12)
+
+	pathLabels = []string{"path", "method"}
+
+	defaultObserverMetrics = newObserverMetrics(defaultMetricsFactory)
 )
 
+// observerMetrics are the collectors shared by the Observers of one middleware chain
+type observerMetrics struct {
+	errCounter              prometheus.Counter
+	blockCounter            *prometheus.CounterVec
+	reqCounter              prometheus.Counter
+	latencyHist             prometheus.Histogram
+	activeGauge             prometheus.Gauge
+	criticalityReqCounter   *prometheus.CounterVec
+	criticalityBlockCounter *prometheus.CounterVec
+	pathReqCounter          *prometheus.CounterVec
+	pathErrCounter          *prometheus.CounterVec
+	pathLatencyHist         *prometheus.HistogramVec
+}
+
+func newObserverMetrics(factory promauto.Factory) *observerMetrics {
+	return &observerMetrics{
+		errCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "proxymw_error_count",
+		}),
+		blockCounter: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxymw_block_count",
+			},
+			[]string{"mw_type"},
+		),
+		reqCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "proxymw_request_count",
+		}),
+		latencyHist: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proxymw_request_latency_ms",
+			Buckets: latencyBuckets,
+		}),
+		activeGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_active_requests",
+		}),
+		criticalityReqCounter: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxymw_criticality_request_count",
+			},
+			[]string{"criticality"},
+		),
+		criticalityBlockCounter: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxymw_criticality_block_count",
+			},
+			[]string{"criticality", "mw_type"},
+		),
+		pathReqCounter: factory.NewCounterVec(
+			prometheus.CounterOpts{Name: "proxymw_path_request_count"}, pathLabels,
+		),
+		pathErrCounter: factory.NewCounterVec(
+			prometheus.CounterOpts{Name: "proxymw_path_error_count"}, pathLabels,
+		),
+		pathLatencyHist: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxymw_path_request_latency_ms",
+			Buckets: latencyBuckets,
+		}, pathLabels),
+	}
+}
+
 // Observer wraps a ProxyClient to emit metrics such as error rate and blocked requests.
 // Each client that blocks requests should tag their errors with a client type to filter metrics.
 type Observer struct {
@@ -44,27 +93,63 @@ type Observer struct {
 	errCounter   prometheus.Counter
 	blockCounter *prometheus.CounterVec
 	reqCounter   prometheus.Counter
-	latencyHist  prometheus.Histogram
+	latencyHist  prometheus.Observer
 	activeGauge  prometheus.Gauge
+
+	criticalityReqCounter   *prometheus.CounterVec
+	criticalityBlockCounter *prometheus.CounterVec
+
+	// exemplars attaches the trace ID of traced requests to latency observations
+	exemplars bool
+
+	// paths labels the path metrics, which are only emitted when set
+	paths           pathTemplates
+	pathReqCounter  *prometheus.CounterVec
+	pathErrCounter  *prometheus.CounterVec
+	pathLatencyHist *prometheus.HistogramVec
 }
 
 var _ ProxyClient = &Observer{}
 
 // NewObserver creates a new Observer wrapping the provided ProxyClient.
 func NewObserver(client ProxyClient) *Observer {
+	return newObserver(client, defaultObserverMetrics)
+}
+
+// NewObserverWithPathLabels creates an Observer which also emits request, latency, and error
+// metrics labeled by method and the matching path template so routes can be analyzed separately.
+func NewObserverWithPathLabels(client ProxyClient, templates []string) *Observer {
+	return newObserverWithPathLabels(client, templates, defaultObserverMetrics)
+}
+
+func newObserver(client ProxyClient, m *observerMetrics) *Observer {
 	return &Observer{
 		client:       client,
-		errCounter:   errCounter,
-		blockCounter: blockCounter,
-		reqCounter:   reqCounter,
-		latencyHist:  latencyHist,
-		activeGauge:  activeGauge,
+		errCounter:   m.errCounter,
+		blockCounter: m.blockCounter,
+		reqCounter:   m.reqCounter,
+		latencyHist:  m.latencyHist,
+		activeGauge:  m.activeGauge,
+
+		criticalityReqCounter:   m.criticalityReqCounter,
+		criticalityBlockCounter: m.criticalityBlockCounter,
 	}
 }
 
+func newObserverWithPathLabels(
+	client ProxyClient, templates []string, m *observerMetrics,
+) *Observer {
+	o := newObserver(client, m)
+	o.paths = newPathTemplates(templates)
+	o.pathReqCounter = m.pathReqCounter
+	o.pathErrCounter = m.pathErrCounter
+	o.pathLatencyHist = m.pathLatencyHist
+	return o
+}
+
 // Init initializes the underlying ProxyClient.
-func (o *Observer) Init(ctx context.Context) {
-	o.client.Init(ctx)
+func (o *Observer) Init(ctx context.Context) error {
+	return o.client.Init(ctx)
 }
 
 // Next processes the request and records relevant metrics.
@@ -75,13 +160,25 @@ func (o *Observer) Next(rr Request) error {
 	start := time.Now()
 	err := o.executeNext(rr)
 
+	latency := float64(time.Since(start).Milliseconds())
+	exemplar := o.exemplar(rr.Request())
 	o.reqCounter.Inc()
-	o.latencyHist.Observe(float64(time.Since(start).Milliseconds()))
+	observe(o.latencyHist, latency, exemplar)
+	if o.paths != nil {
+		o.observePath(rr.Request(), latency, exemplar, err)
+	}
+
+	criticality, critErr := ParseCriticality(rr)
+	if critErr != nil {
+		criticality = CriticalityUnknown
+	}
+	o.criticalityReqCounter.WithLabelValues(criticality).Inc()
 
 	if err != nil {
 		var blocked *RequestBlockedError
 		if errors.As(err, &blocked) {
 			o.blockCounter.WithLabelValues(blocked.Type).Inc()
+			o.criticalityBlockCounter.WithLabelValues(criticality, blocked.Type).Inc()
 		} else {
 			o.errCounter.Inc()
 		}
@@ -90,6 +187,40 @@ func (o *Observer) Next(rr Request) error {
 	return err
 }
 
+// observePath records the request under its path template and method labels
+func (o *Observer) observePath(
+	req *http.Request, latency float64, exemplar prometheus.Labels, err error,
+) {
+	labels := prometheus.Labels{"path": o.paths.label(req.URL.Path), "method": methodLabel(req.Method)}
+	o.pathReqCounter.With(labels).Inc()
+	observe(o.pathLatencyHist.With(labels), latency, exemplar)
+
+	var blocked *RequestBlockedError
+	if err != nil && !errors.As(err, &blocked) {
+		o.pathErrCounter.With(labels).Inc()
+	}
+}
+
+// exemplar returns the trace exemplar of the request, or nil when disabled or untraced
+func (o *Observer) exemplar(req *http.Request) prometheus.Labels {
+	if !o.exemplars {
+		return nil
+	}
+
+	if id := traceID(req); id != "" {
+		return prometheus.Labels{ExemplarTraceIDLabel: id}
+	}
+	return nil
+}
+
+func observe(obs prometheus.Observer, val float64, exemplar prometheus.Labels) {
+	if eo, ok := obs.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(val, exemplar)
+		return
+	}
+	obs.Observe(val)
+}
+
 // executeNext runs the underlying client's Next method in a goroutine to handle potential hangs.
 func (o *Observer) executeNext(rr Request) error {
 	errc := make(chan error, 1)
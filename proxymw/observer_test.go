@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
@@ -39,12 +40,21 @@ func TestObserverNextError(t *testing.T) {
 				activeGauge: prometheus.NewGauge(
 					prometheus.GaugeOpts{Name: "block_test_active_requests"},
 				),
+				criticalityReqCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "block_test_criticality_request_count"},
+					[]string{"criticality"},
+				),
+				criticalityBlockCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "block_test_criticality_block_count"},
+					[]string{"criticality", "mw_type"},
+				),
 				client: &Mocker{
 					NextFunc: func(_ Request) error {
 						return ErrBackpressureBackoff
 					},
-					InitFunc: func(_ context.Context) {
+					InitFunc: func(_ context.Context) error {
 						blockErrInitCalls++
+						return nil
 					},
 				},
 			},
@@ -56,6 +66,12 @@ func TestObserverNextError(t *testing.T) {
 				metric.Write(&metricWriter)
 				value := metricWriter.Counter.GetValue()
 				require.Equal(t, float64(1), value)
+
+				metric = obs.criticalityBlockCounter.WithLabelValues(
+					CriticalityDefault, BackpressureProxyType,
+				)
+				metric.Write(&metricWriter)
+				require.Equal(t, float64(1), metricWriter.Counter.GetValue())
 			},
 		},
 		{
@@ -76,11 +92,19 @@ func TestObserverNextError(t *testing.T) {
 				activeGauge: prometheus.NewGauge(
 					prometheus.GaugeOpts{Name: "block_test_active_requests"},
 				),
+				criticalityReqCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "block_test_criticality_request_count"},
+					[]string{"criticality"},
+				),
+				criticalityBlockCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "block_test_criticality_block_count"},
+					[]string{"criticality", "mw_type"},
+				),
 				client: &Mocker{
 					NextFunc: func(_ Request) error {
 						panic("here")
 					},
-					InitFunc: func(_ context.Context) {},
+					InitFunc: func(_ context.Context) error { return nil },
 				},
 			},
 			err:   "panic calling Next: here",
@@ -104,12 +128,21 @@ func TestObserverNextError(t *testing.T) {
 				activeGauge: prometheus.NewGauge(
 					prometheus.GaugeOpts{Name: "normal_err_test_active_requests"},
 				),
+				criticalityReqCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "normal_err_test_criticality_request_count"},
+					[]string{"criticality"},
+				),
+				criticalityBlockCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "normal_err_test_criticality_block_count"},
+					[]string{"criticality", "mw_type"},
+				),
 				client: &Mocker{
 					NextFunc: func(r Request) error {
 						return errors.New("fail")
 					},
-					InitFunc: func(_ context.Context) {
+					InitFunc: func(_ context.Context) error {
 						normalErrInitCalls++
+						return nil
 					},
 				},
 			},
@@ -141,12 +174,21 @@ func TestObserverNextError(t *testing.T) {
 				activeGauge: prometheus.NewGauge(
 					prometheus.GaugeOpts{Name: "no_err_test_active_requests"},
 				),
+				criticalityReqCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "no_err_test_criticality_request_count"},
+					[]string{"criticality"},
+				),
+				criticalityBlockCounter: prometheus.NewCounterVec(
+					prometheus.CounterOpts{Name: "no_err_test_criticality_block_count"},
+					[]string{"criticality", "mw_type"},
+				),
 				client: &Mocker{
 					NextFunc: func(r Request) error {
 						return nil
 					},
-					InitFunc: func(_ context.Context) {
+					InitFunc: func(_ context.Context) error {
 						noErrInitCalls++
+						return nil
 					},
 				},
 			},
@@ -170,7 +212,7 @@ func TestObserverNextError(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			ctx := context.Background()
-			tt.observer.Init(ctx)
+			require.NoError(t, tt.observer.Init(ctx))
 			rr := &Mocker{
 				RequestFunc: func() *http.Request {
 					return (&http.Request{}).WithContext(ctx)
@@ -186,3 +228,97 @@ func TestObserverNextError(t *testing.T) {
 		})
 	}
 }
+
+func TestObserverPathLabels(t *testing.T) {
+	t.Parallel()
+	paths := newPathTemplates(DefaultObserverPathTemplates)
+	require.Equal(t, "/api/v1/query_range", paths.label("/api/v1/query_range"))
+	require.Equal(t, "/api/v1/label/{name}/values", paths.label("/api/v1/label/job/values"))
+	require.Equal(t, OtherPathLabel, paths.label("/api/v1/label//values"))
+	require.Equal(t, OtherPathLabel, paths.label("/api/v1/query_range/extra"))
+	require.Equal(t, OtherPathLabel, paths.label("/"))
+	require.Equal(t, http.MethodPost, methodLabel(http.MethodPost))
+	require.Equal(t, OtherMethodLabel, methodLabel("PROPFIND"))
+
+	nextErr := errors.New("upstream down")
+	o := NewObserverWithPathLabels(&Mocker{
+		NextFunc: func(rr Request) error {
+			if rr.Request().URL.Path == "/api/v1/series" {
+				return nextErr
+			}
+			return nil
+		},
+	}, DefaultObserverPathTemplates)
+	o.errCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "path_test_error_count"})
+	o.reqCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "path_test_request_count"})
+	o.latencyHist = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "path_test_latency"})
+	o.activeGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "path_test_active"})
+	o.criticalityReqCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "path_test_criticality_request_count"}, []string{"criticality"},
+	)
+	o.pathReqCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "path_test_path_request_count"}, pathLabels,
+	)
+	o.pathErrCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "path_test_path_error_count"}, pathLabels,
+	)
+	o.pathLatencyHist = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "path_test_path_latency"}, pathLabels,
+	)
+
+	for _, target := range []string{"/api/v1/query_range", "/api/v1/query_range", "/api/v1/series"} {
+		req, err := http.NewRequestWithContext(
+			context.Background(), http.MethodGet, "http://prometheus"+target, http.NoBody,
+		)
+		require.NoError(t, err)
+		_ = o.Next(&Mocker{RequestFunc: func() *http.Request { return req }})
+	}
+
+	require.Equal(t, 2.0, testutil.ToFloat64(
+		o.pathReqCounter.WithLabelValues("/api/v1/query_range", http.MethodGet),
+	))
+	require.Equal(t, 1.0, testutil.ToFloat64(
+		o.pathErrCounter.WithLabelValues("/api/v1/series", http.MethodGet),
+	))
+	require.Equal(t, 0.0, testutil.ToFloat64(
+		o.pathErrCounter.WithLabelValues("/api/v1/query_range", http.MethodGet),
+	))
+}
+
+func TestObserverExemplars(t *testing.T) {
+	t.Parallel()
+	o := NewObserver(&Mocker{NextFunc: func(Request) error { return nil }})
+	o.exemplars = true
+	o.reqCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "exemplar_test_request_count"})
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "exemplar_test_latency"})
+	o.latencyHist = hist
+	o.activeGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "exemplar_test_active"})
+	o.criticalityReqCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "exemplar_test_criticality_request_count"}, []string{"criticality"},
+	)
+
+	for _, traceparent := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		req, err := http.NewRequestWithContext(
+			context.Background(), http.MethodGet, "http://prometheus/api/v1/query", http.NoBody,
+		)
+		require.NoError(t, err)
+		if traceparent != "" {
+			req.Header.Set(HeaderTraceparent, traceparent)
+		}
+		require.NoError(t, o.Next(&Mocker{RequestFunc: func() *http.Request { return req }}))
+	}
+
+	m := &dto.Metric{}
+	require.NoError(t, hist.Write(m))
+	require.Equal(t, uint64(2), m.GetHistogram().GetSampleCount())
+
+	exemplars := []*dto.Exemplar{}
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		if bucket.GetExemplar() != nil {
+			exemplars = append(exemplars, bucket.GetExemplar())
+		}
+	}
+	require.Len(t, exemplars, 1)
+	require.Equal(t, ExemplarTraceIDLabel, exemplars[0].GetLabel()[0].GetName())
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", exemplars[0].GetLabel()[0].GetValue())
+}
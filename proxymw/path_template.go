@@ -0,0 +1,77 @@
+package proxymw
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// OtherPathLabel is the path label for requests matching no template
+	OtherPathLabel = "other"
+	// OtherMethodLabel is the method label for non-standard HTTP methods
+	OtherMethodLabel = "OTHER"
+)
+
+// DefaultObserverPathTemplates are the Prometheus and Loki read APIs labeled by the Observer
+var DefaultObserverPathTemplates = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/api/v1/label/{name}/values",
+	"/api/v1/metadata",
+	"/loki/api/v1/query",
+	"/loki/api/v1/query_range",
+	"/loki/api/v1/series",
+	"/loki/api/v1/labels",
+	"/loki/api/v1/label/{name}/values",
+}
+
+// pathTemplates maps request paths to a bounded set of labels. A `{name}` segment matches any
+// single path segment so label values never carry user input.
+type pathTemplates [][]string
+
+func newPathTemplates(templates []string) pathTemplates {
+	parsed := make(pathTemplates, 0, len(templates))
+	for _, template := range templates {
+		parsed = append(parsed, strings.Split(template, "/"))
+	}
+	return parsed
+}
+
+// label returns the template matching the path or OtherPathLabel
+func (p pathTemplates) label(path string) string {
+	segments := strings.Split(path, "/")
+	for _, template := range p {
+		if matchSegments(template, segments) {
+			return strings.Join(template, "/")
+		}
+	}
+	return OtherPathLabel
+}
+
+func matchSegments(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+
+	for i, segment := range template {
+		wildcard := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if wildcard && segments[i] == "" || !wildcard && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// methodLabel bounds the method label to the standard HTTP methods
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return OtherMethodLabel
+	}
+}
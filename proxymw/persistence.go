@@ -0,0 +1,203 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultStateRedisKey = "throttle-proxy:bp:state"
+	// DefaultStateMaxAge ignores state saved long enough ago that the signals have likely changed
+	DefaultStateMaxAge = 10 * time.Minute
+)
+
+var (
+	ErrPersistenceStoreRequired = errors.New("persistence requires exactly one of a state file or redis address")
+	ErrNegativeStateMaxAge      = errors.New("persisted state max age cannot be negative")
+	ErrNoPersistedState         = errors.New("no persisted state")
+)
+
+// PersistenceConfig saves the watermark and allowance after every poll and on shutdown, and
+// restores them on startup, so a replica restarted during an incident keeps throttling instead
+// of reopening to the full allowance and re-learning the window from CongestionWindowMin.
+type PersistenceConfig struct {
+	EnablePersistence bool `yaml:"enable_persistence"`
+	// StateFile is the JSON file the state is written to, e.g. on a persistent volume
+	StateFile string `yaml:"state_file"`
+	// RedisAddr stores the state in Redis instead of a file, for replicas without volumes
+	RedisAddr string `yaml:"redis_addr"`
+	// RedisKey is the key holding the state. Replicas sharing the key restore the state saved
+	// by whichever replica saved last.
+	RedisKey string `yaml:"redis_key"`
+	// MaxAge is how old saved state may be and still be restored. Defaults to 10m.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c PersistenceConfig) Validate() error {
+	if !c.EnablePersistence {
+		return nil
+	}
+
+	if (c.StateFile == "") == (c.RedisAddr == "") {
+		return ErrPersistenceStoreRequired
+	}
+
+	if c.RedisAddr != "" && !redisSupported {
+		return ErrRedisUnsupported
+	}
+
+	if c.MaxAge < 0 {
+		return ErrNegativeStateMaxAge
+	}
+	return nil
+}
+
+func (c PersistenceConfig) maxAge() time.Duration {
+	if c.MaxAge == 0 {
+		return DefaultStateMaxAge
+	}
+	return c.MaxAge
+}
+
+func (c PersistenceConfig) store() StateStore {
+	if !c.EnablePersistence {
+		return nil
+	}
+
+	if c.StateFile != "" {
+		return NewFileStateStore(c.StateFile)
+	}
+
+	key := c.RedisKey
+	if key == "" {
+		key = DefaultStateRedisKey
+	}
+	store, err := newRedisStateStore(c.RedisAddr, key)
+	if err != nil {
+		log.Printf("backpressure state persistence disabled: %v", err)
+		return nil
+	}
+	return store
+}
+
+// PersistedState is the congestion window of a Backpressure at the time it was saved
+type PersistedState struct {
+	Watermark int       `json:"watermark"`
+	Allowance float64   `json:"allowance"`
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+// StateStore saves the congestion window across restarts
+type StateStore interface {
+	Save(ctx context.Context, state PersistedState) error
+	// Load returns ErrNoPersistedState when nothing was saved
+	Load(ctx context.Context) (PersistedState, error)
+}
+
+// FileStateStore writes the state as JSON, replacing the file atomically so a crash mid-write
+// never leaves a truncated file behind
+type FileStateStore struct {
+	path string
+}
+
+var _ StateStore = &FileStateStore{}
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+func (s *FileStateStore) Save(_ context.Context, state PersistedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // already renamed on success
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck,gosec // the write error is returned
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileStateStore) Load(_ context.Context) (PersistedState, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return PersistedState{}, ErrNoPersistedState
+	} else if err != nil {
+		return PersistedState{}, err
+	}
+
+	var state PersistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return PersistedState{}, fmt.Errorf("decode %s: %w", s.path, err)
+	}
+	return state, nil
+}
+
+// SaveState persists the current watermark and allowance when persistence is enabled
+func (bp *Backpressure) SaveState(ctx context.Context) error {
+	if bp.stateStore == nil {
+		return nil
+	}
+
+	bp.mu.Lock()
+	state := PersistedState{Watermark: bp.watermark, Allowance: bp.allowance, SavedAt: bp.now()}
+	bp.mu.Unlock()
+	return bp.stateStore.Save(ctx, state)
+}
+
+// restoreState resumes from state saved within the max age. A restored cut to the allowance
+// counts as throttling just now so recovery waits out the cooldown again.
+func (bp *Backpressure) restoreState(ctx context.Context, now time.Time) {
+	if bp.stateStore == nil {
+		return
+	}
+
+	state, err := bp.stateStore.Load(ctx)
+	if errors.Is(err, ErrNoPersistedState) {
+		return
+	} else if err != nil {
+		log.Printf("error restoring backpressure state: %v", err)
+		return
+	}
+
+	if age := now.Sub(state.SavedAt); age > bp.stateMaxAge {
+		log.Printf("ignoring backpressure state saved %s ago", age.Round(time.Second))
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.allowance = max(0, min(1, state.Allowance))
+	if bp.allowance < 1 {
+		bp.lastThrottled = now
+	}
+	bp.watermark = state.Watermark
+	bp.allowanceGauge.Set(bp.allowance)
+	bp.trackEmergency(now)
+	bp.constrainWatermark()
+	log.Printf("restored backpressure watermark %d and allowance %g", bp.watermark, bp.allowance)
+}
+
+// SaveThrottleState persists the state of the Backpressure built from config, e.g. on shutdown
+func SaveThrottleState(ctx context.Context) error {
+	if bp := activeBackpressure.Load(); bp != nil {
+		return bp.SaveState(ctx)
+	}
+	return nil
+}
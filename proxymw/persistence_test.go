@@ -0,0 +1,112 @@
+package proxymw
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistenceConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, PersistenceConfig{}.Validate())
+	require.NoError(t, PersistenceConfig{EnablePersistence: true, StateFile: "state.json"}.Validate())
+	require.ErrorIs(t, PersistenceConfig{EnablePersistence: true}.Validate(), ErrPersistenceStoreRequired)
+	require.ErrorIs(t, PersistenceConfig{
+		EnablePersistence: true,
+		StateFile:         "state.json",
+		RedisAddr:         "localhost:6379",
+	}.Validate(), ErrPersistenceStoreRequired)
+	require.ErrorIs(t, PersistenceConfig{
+		EnablePersistence: true,
+		StateFile:         "state.json",
+		MaxAge:            -time.Minute,
+	}.Validate(), ErrNegativeStateMaxAge)
+}
+
+func TestFileStateStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	testStateStore(t, NewFileStateStore(filepath.Join(dir, "state.json")))
+
+	// temporary files are renamed over the state file
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+// testStateStore saves and loads state with a store, shared by the tests of every StateStore
+func testStateStore(t *testing.T, store StateStore) {
+	t.Helper()
+	ctx := context.Background()
+	_, err := store.Load(ctx)
+	require.ErrorIs(t, err, ErrNoPersistedState)
+
+	state := PersistedState{Watermark: 7, Allowance: 0.5, SavedAt: time.Unix(1_700_000_000, 0).UTC()}
+	require.NoError(t, store.Save(ctx, state))
+	state.Watermark = 8
+	require.NoError(t, store.Save(ctx, state))
+
+	loaded, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, state, loaded)
+}
+
+func TestRestoreState(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for _, tt := range []struct {
+		name      string
+		state     PersistedState
+		watermark int
+		allowance float64
+	}{
+		{
+			name:      "restored",
+			state:     PersistedState{Watermark: 30, Allowance: 0.5, SavedAt: now.Add(-time.Minute)},
+			watermark: 30,
+			allowance: 0.5,
+		},
+		{
+			name:      "watermark bound by the restored allowance",
+			state:     PersistedState{Watermark: 90, Allowance: 0.25, SavedAt: now.Add(-time.Minute)},
+			watermark: 25,
+			allowance: 0.25,
+		},
+		{
+			name:      "stale state is ignored",
+			state:     PersistedState{Watermark: 30, Allowance: 0.5, SavedAt: now.Add(-time.Hour)},
+			watermark: 1,
+			allowance: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+			require.NoError(t, store.Save(context.Background(), tt.state))
+
+			bp := newBackpressure(&Mocker{}, BackpressureConfig{
+				CongestionWindowMin:       1,
+				CongestionWindowMax:       100,
+				AllowanceRecoveryCooldown: time.Minute,
+			}, newBackpressureMetrics(promauto.With(prometheus.NewRegistry())))
+			bp.stateStore = store
+
+			bp.restoreState(context.Background(), now)
+			state := bp.State()
+			require.Equal(t, tt.watermark, state.Watermark)
+			require.InDelta(t, tt.allowance, state.Allowance, 0)
+
+			// the restored window is what the next save persists
+			require.NoError(t, bp.SaveState(context.Background()))
+			saved, err := store.Load(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, tt.watermark, saved.Watermark)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package proxymw
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MiddlewareFactory builds a third-party middleware wrapping next from its YAML options
+type MiddlewareFactory func(cfg map[string]any, next ProxyClient) (ProxyClient, error)
+
+// MiddlewareConfig enables a registered middleware. Every key besides type is passed to the
+// factory, e.g. `middlewares: [{type: mycorp_auth, audience: metrics}]`.
+type MiddlewareConfig struct {
+	Type    string         `yaml:"type"`
+	Options map[string]any `yaml:",inline"`
+}
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = map[string]MiddlewareFactory{}
+
+	builtinMiddlewares = []string{
+		ObserverProxyType,
+		AccessLogProxyType,
+		RecorderProxyType,
+		AuditProxyType,
+		TimeoutProxyType,
+		TenantStatsProxyType,
+		BlockerProxyType,
+		GuardrailProxyType,
+		RateLimitProxyType,
+		FingerprintLimitProxyType,
+		TenantConcurrencyProxyType,
+		QuotaProxyType,
+		RemoteWriteProxyType,
+		JitterProxyType,
+		WarmupProxyType,
+		AdaptiveLimitProxyType,
+		BackpressureProxyType,
+		CostFeedbackProxyType,
+		LabelInjectorProxyType,
+		StepAlignProxyType,
+		MirrorProxyType,
+		ShardProxyType,
+		RetryProxyType,
+		ChaosProxyType,
+	}
+)
+
+// Register makes a middleware available to the middlewares config by type name. It is meant to
+// be called from init functions and panics if the name is empty, built-in, or already registered.
+func Register(name string, factory MiddlewareFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if name == "" || factory == nil {
+		panic("proxymw: Register requires a name and factory")
+	}
+	if isBuiltinMiddleware(name) {
+		panic("proxymw: Register called with built-in middleware " + name)
+	}
+	if _, dup := plugins[name]; dup {
+		panic("proxymw: Register called twice for middleware " + name)
+	}
+	plugins[name] = factory
+}
+
+// Plugins returns the sorted type names of the registered middlewares
+func Plugins() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPlugin(name string) (MiddlewareFactory, bool) {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	factory, ok := plugins[name]
+	return factory, ok
+}
+
+func isBuiltinMiddleware(name string) bool {
+	for _, builtin := range builtinMiddlewares {
+		if builtin == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c MiddlewareConfig) Validate() error {
+	if _, ok := lookupPlugin(c.Type); !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownMiddleware, c.Type)
+	}
+	return nil
+}
+
+// stageBuilder wraps next with the registered middleware
+func (c MiddlewareConfig) stageBuilder() func(next ProxyClient) (ProxyClient, error) {
+	return func(next ProxyClient) (ProxyClient, error) {
+		factory, ok := lookupPlugin(c.Type)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownMiddleware, c.Type)
+		}
+
+		client, err := factory(c.Options, next)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", c.Type, err)
+		}
+		return client, nil
+	}
+}
@@ -0,0 +1,120 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+type headerMiddleware struct {
+	client ProxyClient
+	name   string
+	value  string
+}
+
+func (hm *headerMiddleware) Init(ctx context.Context) error {
+	return hm.client.Init(ctx)
+}
+
+func (hm *headerMiddleware) Next(rr Request) error {
+	rr.Request().Header.Set(hm.name, hm.value)
+	return hm.client.Next(rr)
+}
+
+var errMissingHeader = errors.New("header option is required")
+
+func init() {
+	Register("test_set_header", func(cfg map[string]any, next ProxyClient) (ProxyClient, error) {
+		name, _ := cfg["header"].(string)
+		if name == "" {
+			return nil, errMissingHeader
+		}
+		value, _ := cfg["value"].(string)
+		return &headerMiddleware{client: next, name: name, value: value}, nil
+	})
+}
+
+func TestPluginMiddleware(t *testing.T) {
+	t.Parallel()
+	var cfg Config
+	require.NoError(t, yaml.Unmarshal([]byte(`
+enable_observer: true
+middlewares:
+  - type: test_set_header
+    header: X-Scope-OrgID
+    value: team-a
+`), &cfg))
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []MiddlewareConfig{{
+		Type:    "test_set_header",
+		Options: map[string]any{"header": "X-Scope-OrgID", "value": "team-a"},
+	}}, cfg.Middlewares)
+	require.Equal(t, []string{ObserverProxyType, "test_set_header"}, NewChainBuilder(cfg).Names())
+	require.Contains(t, Plugins(), "test_set_header")
+
+	var got string
+	client, err := NewChainBuilder(cfg).Build(&Mocker{
+		InitFunc: func(context.Context) error { return nil },
+		NextFunc: func(rr Request) error {
+			got = rr.Request().Header.Get("X-Scope-OrgID")
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.Init(context.Background()))
+
+	req, err := http.NewRequestWithContext(
+		context.Background(), http.MethodGet, "http://prometheus", http.NoBody,
+	)
+	require.NoError(t, err)
+	require.NoError(t, client.Next(&Mocker{RequestFunc: func() *http.Request { return req }}))
+	require.Equal(t, "team-a", got)
+}
+
+func TestPluginErrors(t *testing.T) {
+	t.Parallel()
+	unknown := Config{Middlewares: []MiddlewareConfig{{Type: "test_missing"}}}
+	require.ErrorIs(t, unknown.Validate(), ErrUnknownMiddleware)
+
+	invalid := Config{Middlewares: []MiddlewareConfig{{Type: "test_set_header"}}}
+	require.NoError(t, invalid.Validate())
+	_, err := NewChainBuilder(invalid).Build(&Mocker{})
+	require.ErrorIs(t, err, errMissingHeader)
+	require.Panics(t, func() { NewFromConfig(invalid, &Mocker{}) })
+
+	// the E constructors return the error instead of crashing the embedding program
+	_, err = NewFromConfigE(invalid, &Mocker{})
+	require.ErrorIs(t, err, errMissingHeader)
+	_, err = NewServeFromConfigE(invalid, func(http.ResponseWriter, *http.Request) {})
+	require.ErrorIs(t, err, errMissingHeader)
+	_, err = NewRoundTripperFromConfigE(invalid, http.DefaultTransport)
+	require.ErrorIs(t, err, errMissingHeader)
+	_, err = NewRoundTripperFromHostsE(Config{}, map[string]Config{
+		"thanos": {
+			Middlewares:   invalid.Middlewares,
+			MetricsConfig: MetricsConfig{MetricsRegistry: prometheus.NewRegistry()},
+		},
+	}, http.DefaultTransport)
+	require.ErrorIs(t, err, errMissingHeader)
+	require.ErrorContains(t, err, "host thanos")
+
+	misordered := Config{
+		RateLimitConfig:   RateLimitConfig{EnableRateLimit: true, RateLimit: 1},
+		TenantStatsConfig: TenantStatsConfig{EnableTenantStats: true},
+		MiddlewareOrder:   []string{RateLimitProxyType, TenantStatsProxyType},
+		MetricsConfig:     MetricsConfig{MetricsRegistry: prometheus.NewRegistry()},
+	}
+	require.ErrorIs(t, misordered.Validate(), ErrInvalidMiddlewareOrder)
+	_, err = NewRoundTripperFromConfigE(misordered, http.DefaultTransport)
+	require.ErrorIs(t, err, ErrInvalidMiddlewareOrder)
+
+	factory := func(_ map[string]any, next ProxyClient) (ProxyClient, error) { return next, nil }
+	require.Panics(t, func() { Register("test_set_header", factory) })
+	require.Panics(t, func() { Register(BackpressureProxyType, factory) })
+	require.Panics(t, func() { Register("", factory) })
+}
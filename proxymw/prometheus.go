@@ -2,59 +2,131 @@ package proxymw
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
 )
 
 const (
 	InstantQueryEndpoint = "/api/v1/query"
+
+	// MonitorStrategyFailover queries monitoring endpoints in order until one succeeds
+	MonitorStrategyFailover = "failover"
+	// MonitorStrategyMax queries every monitoring endpoint in parallel and uses the highest value
+	MonitorStrategyMax = "max"
 )
 
-// ValueFromPromQL queries the prometheus instant API for the prometheus query.
-// Throws an error if the response is not a single value.
-func ValueFromPromQL(
-	ctx context.Context, client *http.Client, endpoint, query string,
+// ValueFromMonitors fetches the query from the monitoring endpoints with the given strategy.
+// An error is only returned when every endpoint fails.
+func ValueFromMonitors(
+	ctx context.Context,
+	client *http.Client,
+	fetch SignalFetcher,
+	endpoints []string,
+	strategy, query string,
 ) (float64, error) {
-	u, err := url.Parse(endpoint + InstantQueryEndpoint)
-	if err != nil {
-		return 0, fmt.Errorf("parse monitor URL: %w", err)
+	if strategy == MonitorStrategyMax {
+		return maxValueFromMonitors(ctx, client, fetch, endpoints, query)
 	}
 
-	q := u.Query()
-	q.Set("query", query)
-	u.RawQuery = q.Encode()
+	errs := make([]error, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		val, err := fetch(ctx, client, endpoint, query)
+		if err == nil {
+			return val, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint, err))
+	}
+	return 0, errors.Join(errs...)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
-	if err != nil {
-		return 0, fmt.Errorf("create request: %w", err)
+func maxValueFromMonitors(
+	ctx context.Context, client *http.Client, fetch SignalFetcher, endpoints []string, query string,
+) (float64, error) {
+	var (
+		wg   sync.WaitGroup
+		vals = make([]float64, len(endpoints))
+		errs = make([]error, len(endpoints))
+	)
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vals[i], errs[i] = fetch(ctx, client, endpoint, query)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", endpoint, errs[i])
+			}
+		}()
 	}
+	wg.Wait()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("execute request: %w", err)
+	res, ok := 0.0, false
+	for i, err := range errs {
+		if err == nil {
+			res, ok = max(res, vals[i]), true
+		}
 	}
 
-	defer resp.Body.Close() //nolint:errcheck // ignore body close
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if !ok {
+		return 0, errors.Join(errs...)
 	}
+	return res, nil
+}
 
-	var prometheusResp PrometheusResponse
-	if err := json.NewDecoder(resp.Body).Decode(&prometheusResp); err != nil {
-		return 0, fmt.Errorf("decode response: %w", err)
+// ValueFromPromQL queries the prometheus instant API for the prometheus query.
+// Throws an error if the response is not a single value.
+func ValueFromPromQL(
+	ctx context.Context, client *http.Client, endpoint, query string,
+) (float64, error) {
+	return singleValue(query)(SamplesFromPromQL(ctx, client, endpoint, query))
+}
+
+// SamplesFromPromQL queries the prometheus instant API and returns the value of every series of a
+// vector, or the value of a scalar. Queries are POSTed so long queries fit, falling back to GET
+// for servers answering 405. API errors are returned as *promv1.Error and warnings are logged.
+func SamplesFromPromQL(
+	ctx context.Context, client *http.Client, endpoint, query string,
+) ([]float64, error) {
+	apiClient, err := api.NewClient(api.Config{Address: endpoint, Client: client})
+	if err != nil {
+		return nil, fmt.Errorf("parse monitor URL: %w", err)
 	}
 
-	results := prometheusResp.Data.Result
-	if len(results) != 1 {
-		return 0, fmt.Errorf("backpressure query must return exactly one value: %s", query)
+	result, warnings, err := promv1.NewAPI(apiClient).Query(ctx, query, time.Time{})
+	if len(warnings) > 0 {
+		log.Printf("warnings querying %s for %s: %s", endpoint, query, strings.Join(warnings, "; "))
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	res := float64(results[0].Value)
-	if res < 0 {
-		return 0, fmt.Errorf("backpressure query (%s) must have non-negative value: %f", query, res)
+	var values []model.SampleValue
+	switch result := result.(type) {
+	case model.Vector:
+		for _, sample := range result {
+			values = append(values, sample.Value)
+		}
+	case *model.Scalar:
+		values = append(values, result.Value)
+	default:
+		return nil, fmt.Errorf("backpressure query (%s) returned unsupported type %s", query, result.Type())
 	}
 
-	return res, nil
+	samples := make([]float64, 0, len(values))
+	for _, value := range values {
+		val, err := nonNegative(query, float64(value))
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, val)
+	}
+	return samples, nil
 }
@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/stretchr/testify/require"
 
 	"github.com/kevindweb/throttle-proxy/proxymw"
@@ -86,7 +89,7 @@ func TestMetricFired(t *testing.T) {
 		},
 		{
 			name:     "bad status code throws error",
-			err:      fmt.Errorf("unexpected status code: %d", http.StatusBadGateway),
+			err:      &promv1.Error{Type: promv1.ErrServer, Msg: "server error: 502"},
 			endpoint: u,
 			client: &http.Client{
 				Transport: &proxymw.Mocker{
@@ -106,8 +109,11 @@ func TestMetricFired(t *testing.T) {
 			client: &http.Client{
 				Transport: &proxymw.Mocker{
 					RoundTripFunc: func(r *http.Request) (*http.Response, error) {
-						url := u + proxymw.InstantQueryEndpoint + "?query=sum%28throughput%29"
-						require.Equal(t, url, r.URL.String())
+						require.Equal(t, http.MethodPost, r.Method)
+						require.Equal(t, u+proxymw.InstantQueryEndpoint, r.URL.String())
+						body, err := io.ReadAll(r.Body)
+						require.NoError(t, err)
+						require.Equal(t, "query=sum%28throughput%29", string(body))
 						return &http.Response{
 							Body: io.NopCloser(bytes.NewBufferString(
 								`{
@@ -137,3 +143,127 @@ func TestMetricFired(t *testing.T) {
 		})
 	}
 }
+
+func TestSamplesFromPromQL(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		samples []float64
+		err     error
+	}{
+		{
+			name: "get fallback for servers without post",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				require.Equal(t, "sum(up)", r.URL.Query().Get("query"))
+				fmt.Fprint(w, `{"status": "success", "data": {"resultType": "vector", "result": [
+					{"metric": {"job": "a"}, "value": [1731988543.752, "1"]},
+					{"metric": {"job": "b"}, "value": [1731988543.752, "2"]}
+				]}}`)
+			},
+			samples: []float64{1, 2},
+		},
+		{
+			name: "scalar with warnings",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, `{"status": "success", "warnings": ["partial response"],
+					"data": {"resultType": "scalar", "result": [1731988543.752, "3"]}}`)
+			},
+			samples: []float64{3},
+		},
+		{
+			name: "api error",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprint(w, `{"status": "error", "errorType": "execution", "error": "too many samples"}`)
+			},
+			err: &promv1.Error{Type: promv1.ErrExec, Msg: "too many samples"},
+		},
+		{
+			name: "matrix is unsupported",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, `{"status": "success", "data": {"resultType": "matrix", "result": []}}`)
+			},
+			err: errors.New("backpressure query (sum(up)) returned unsupported type matrix"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			samples, err := proxymw.SamplesFromPromQL(context.Background(), server.Client(), server.URL, "sum(up)")
+			require.Equal(t, tt.err, err)
+			require.Equal(t, tt.samples, samples)
+		})
+	}
+
+	_, err := proxymw.SamplesFromPromQL(context.Background(), http.DefaultClient, "http://[::1", "sum(up)")
+	var urlErr *url.Error
+	require.ErrorAs(t, err, &urlErr)
+}
+
+func TestValueFromMonitors(t *testing.T) {
+	monitor := func(status int, val string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": [
+				{"metric": {}, "value": [1731988543.752, %q]}
+			]}}`, val)
+		}))
+	}
+	down := monitor(http.StatusServiceUnavailable, "0")
+	defer down.Close()
+	low := monitor(http.StatusOK, "10")
+	defer low.Close()
+	high := monitor(http.StatusOK, "20")
+	defer high.Close()
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name      string
+		endpoints []string
+		strategy  string
+		val       float64
+		wantErr   bool
+	}{
+		{
+			name:      "failover skips down endpoint",
+			endpoints: []string{down.URL, low.URL, high.URL},
+			strategy:  proxymw.MonitorStrategyFailover,
+			val:       10,
+		},
+		{
+			name:      "default strategy is failover",
+			endpoints: []string{high.URL, low.URL},
+			val:       20,
+		},
+		{
+			name:      "max across endpoints",
+			endpoints: []string{low.URL, down.URL, high.URL},
+			strategy:  proxymw.MonitorStrategyMax,
+			val:       20,
+		},
+		{
+			name:      "every endpoint down",
+			endpoints: []string{down.URL, down.URL},
+			strategy:  proxymw.MonitorStrategyMax,
+			wantErr:   true,
+		},
+		{
+			name:      "every endpoint down with failover",
+			endpoints: []string{down.URL},
+			wantErr:   true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			val, err := proxymw.ValueFromMonitors(
+				ctx, http.DefaultClient, proxymw.ValueFromPromQL, tt.endpoints, tt.strategy, "sum(up)",
+			)
+			require.Equal(t, tt.wantErr, err != nil, err)
+			require.Equal(t, tt.val, val)
+		})
+	}
+}
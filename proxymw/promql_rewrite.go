@@ -0,0 +1,59 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// validatePromQL returns the parse error of an invalid query, which includes its position
+func validatePromQL(query string) error {
+	_, err := parser.NewParser(query).ParseExpr()
+	return err
+}
+
+// injectLabelMatchers adds an equality matcher for each label to every selector in the PromQL.
+// Selectors that already match on a label keep their matcher so explicitly scoped queries work.
+func injectLabelMatchers(query string, inject map[string]string) (string, error) {
+	expr, err := parser.NewParser(query).ParseExpr()
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(inject))
+	for name := range inject {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		for _, name := range names {
+			if hasMatcher(vs.LabelMatchers, name) {
+				continue
+			}
+			vs.LabelMatchers = append(
+				vs.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, name, inject[name]),
+			)
+		}
+		return nil
+	})
+
+	return expr.String(), nil
+}
+
+func hasMatcher(matchers []*labels.Matcher, name string) bool {
+	for _, m := range matchers {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+//go:build nopromql
+
+package proxymw
+
+import "time"
+
+// promQLSupported is false when built with the nopromql tag, which drops the PromQL parser and
+// Thanos engine dependencies for embedders that only need jitter, blocker, or observer middleware.
+const promQLSupported = false
+
+const ObjectStorageThreshold = 100
+
+const HeadBlockLookback = 2 * time.Hour
+
+func LowCostRequest(rr Request) (bool, error) {
+	cost, err := QueryCost(rr)
+	return cost < ObjectStorageThreshold, err
+}
+
+func QueryCost(_ Request) (int, error) {
+	return 0, ErrPromQLUnsupported
+}
+
+func QueryLookback(_ Request) (time.Duration, error) {
+	return 0, ErrPromQLUnsupported
+}
+
+func validatePromQL(_ string) error {
+	return ErrPromQLUnsupported
+}
+
+func injectLabelMatchers(_ string, _ map[string]string) (string, error) {
+	return "", ErrPromQLUnsupported
+}
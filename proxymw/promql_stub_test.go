@@ -0,0 +1,47 @@
+//go:build nopromql
+
+package proxymw
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromQLUnsupported(t *testing.T) {
+	_, err := QueryCost(&Mocker{})
+	require.ErrorIs(t, err, ErrPromQLUnsupported)
+
+	cfg := BackpressureConfig{
+		EnableBackpressure: true,
+		BackpressureQueries: []BackpressureQuery{
+			{Query: "up", WarningThreshold: 1, EmergencyThreshold: 2},
+		},
+		CongestionWindowMin: 1,
+		CongestionWindowMax: 2,
+		EnableLowCostBypass: true,
+	}
+	require.ErrorIs(t, cfg.Validate(), ErrPromQLUnsupported)
+
+	guardrails := GuardrailConfig{EnableGuardrails: true, ValidateQuerySyntax: true}
+	require.ErrorIs(t, guardrails.Validate(), ErrPromQLUnsupported)
+}
+
+func TestRedisUnsupported(t *testing.T) {
+	for _, cfg := range []interface{ Validate() error }{
+		RateLimitConfig{EnableRateLimit: true, RateLimit: 1, RedisAddr: "localhost:6379"},
+		QuotaConfig{EnableQuotas: true, QuotaRedisAddr: "localhost:6379"},
+		LeaderElectionConfig{EnableLeaderElection: true, RedisAddr: "localhost:6379"},
+		PersistenceConfig{EnablePersistence: true, RedisAddr: "localhost:6379"},
+		SharedWindowConfig{EnableSharedWindow: true, RedisAddr: "localhost:6379"},
+	} {
+		require.ErrorIs(t, cfg.Validate(), ErrRedisUnsupported)
+	}
+	require.NoError(t, LeaderElectionConfig{
+		EnableLeaderElection: true,
+		Backend:              LeaderElectionKubernetes,
+	}.Validate())
+
+	remoteWrite := RemoteWriteConfig{EnableRemoteWriteLimit: true, MaxSamplesPerSecond: 1}
+	require.ErrorIs(t, remoteWrite.Validate(), ErrRemoteWriteUnsupported)
+}
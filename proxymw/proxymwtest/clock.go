@@ -0,0 +1,202 @@
+// Package proxymwtest provides utilities for testing code built on proxymw
+package proxymwtest
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+)
+
+// FakeClock is a proxymw.Clock that only moves when advanced, firing the timers and tickers
+// that came due along the way. Set it as proxymw.Config.Clock to run jitter and backpressure
+// polls without waiting on the wall clock.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+var _ proxymw.Clock = &FakeClock{}
+
+// NewFakeClock returns a clock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+type waiter struct {
+	clock *FakeClock
+	at    time.Time
+	// period re-arms tickers, timers have none
+	period time.Duration
+	c      chan time.Time
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) proxymw.Timer {
+	return &fakeTimer{c.add(d, 0)}
+}
+
+// NewTicker panics on a non-positive period like time.NewTicker
+func (c *FakeClock) NewTicker(d time.Duration) proxymw.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return &fakeTicker{c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *waiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{clock: c, at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w
+	}
+
+	c.waiters = append(c.waiters, w)
+	c.cond.Broadcast()
+	return w
+}
+
+// Advance moves the clock forward, firing due timers and tickers in the order they came due.
+// Like time.Ticker, a ticker whose last tick was not received drops the ticks in between.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		i := c.next()
+		if i < 0 || c.waiters[i].at.After(end) {
+			break
+		}
+
+		w := c.waiters[i]
+		c.now = w.at
+		select {
+		case w.c <- c.now:
+		default:
+		}
+
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = slices.Delete(c.waiters, i, i+1)
+		}
+	}
+	c.now = end
+	c.cond.Broadcast()
+}
+
+// next returns the index of the earliest waiter, or -1 when there are none.
+// Assumes the callsite already holds the lock.
+func (c *FakeClock) next() int {
+	earliest := -1
+	for i, w := range c.waiters {
+		if earliest < 0 || w.at.Before(c.waiters[earliest].at) {
+			earliest = i
+		}
+	}
+	return earliest
+}
+
+// Waiters is the number of pending timers and running tickers
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil waits for at least n pending timers and running tickers, so a test advances the
+// clock only once the code under test is waiting on it
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+// stop removes the waiter and reports whether it was still pending
+func (c *FakeClock) stop(w *waiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.Index(c.waiters, w)
+	if i < 0 {
+		return false
+	}
+	c.waiters = slices.Delete(c.waiters, i, i+1)
+	c.cond.Broadcast()
+	return true
+}
+
+type fakeTimer struct {
+	*waiter
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.stop(t.waiter)
+}
+
+type fakeTicker struct {
+	*waiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.stop(t.waiter)
+}
+
+// NewRand returns a proxymw.Rand producing the same sequence for the same seed, for
+// reproducible jitter and probabilistic admission
+func NewRand(seed int64) proxymw.Rand {
+	// nolint:gosec // rand not used for security purposes
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// lockedRand guards a *rand.Rand, which is not safe for concurrent use
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) ExpFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.ExpFloat64()
+}
+
+func (l *lockedRand) NormFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.NormFloat64()
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
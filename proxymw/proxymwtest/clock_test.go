@@ -0,0 +1,86 @@
+package proxymwtest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+	"github.com/kevindweb/throttle-proxy/proxymw/proxymwtest"
+)
+
+func TestFakeClock(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := proxymwtest.NewFakeClock(start)
+
+	timer := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(20 * time.Second)
+	require.Equal(t, 2, clock.Waiters())
+
+	clock.Advance(30 * time.Second)
+	require.Equal(t, start.Add(30*time.Second), clock.Now())
+	require.Equal(t, start.Add(20*time.Second), <-ticker.C())
+	require.Empty(t, timer.C())
+
+	// the unreceived tick at 60s is dropped like time.Ticker
+	clock.Advance(time.Minute)
+	require.Equal(t, start.Add(time.Minute), <-timer.C())
+	require.Equal(t, start.Add(40*time.Second), <-ticker.C())
+	require.Equal(t, 1, clock.Waiters())
+	require.False(t, timer.Stop())
+
+	ticker.Stop()
+	require.Zero(t, clock.Waiters())
+	require.Equal(t, start.Add(90*time.Second), <-clock.NewTimer(0).C())
+}
+
+func TestFakeClockJitter(t *testing.T) {
+	t.Parallel()
+	clock := proxymwtest.NewFakeClock(time.Now())
+	rt := proxymw.NewRoundTripperFromConfig(proxymw.Config{
+		EnableJitter: true,
+		JitterDelay:  time.Hour,
+		Clock:        clock,
+		Rand:         proxymwtest.NewRand(1),
+	}, roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+	require.NoError(t, rt.Init(context.Background()))
+	t.Cleanup(func() { require.NoError(t, rt.Close()) })
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://prometheus", http.NoBody)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := rt.RoundTrip(req)
+		if err == nil {
+			err = res.Body.Close()
+		}
+		done <- err
+	}()
+
+	// the request waits out up to an hour of jitter on the fake clock
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	require.NoError(t, <-done)
+}
+
+func TestNewRand(t *testing.T) {
+	t.Parallel()
+	a, b := proxymwtest.NewRand(7), proxymwtest.NewRand(7)
+	for range 10 {
+		require.Equal(t, a.Float64(), b.Float64())
+		require.Equal(t, a.Int63n(100), b.Int63n(100))
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
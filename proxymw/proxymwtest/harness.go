@@ -0,0 +1,65 @@
+package proxymwtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+)
+
+// NewServe validates the config and builds the entry point in front of next, initialized until
+// the test ends
+func NewServe(t testing.TB, cfg proxymw.Config, next http.Handler) *proxymw.ServeEntry {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	entry, err := proxymw.NewServeFromChain(cfg, proxymw.NewChainBuilder(cfg), next.ServeHTTP)
+	if err != nil {
+		t.Fatalf("build chain: %v", err)
+	}
+	if err := entry.Init(t.Context()); err != nil {
+		t.Fatalf("init chain: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := entry.Close(); err != nil {
+			t.Errorf("close chain: %v", err)
+		}
+	})
+	return entry
+}
+
+// Serve sends the request through the handler
+func Serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// RequireAllowed fails the test unless the request makes it through the chain
+func RequireAllowed(t testing.TB, h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	w := Serve(h, r)
+	if blockedBy := w.Header().Get(string(proxymw.HeaderThrottleReason)); blockedBy != "" {
+		t.Fatalf("%s %s blocked by %s: %s", r.Method, r.URL, blockedBy, w.Body.String())
+	}
+	return w
+}
+
+// RequireBlocked fails the test unless the middleware of the blockedBy type rejects the request
+func RequireBlocked(
+	t testing.TB, h http.Handler, r *http.Request, blockedBy string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	w := Serve(h, r)
+	switch got := w.Header().Get(string(proxymw.HeaderThrottleReason)); got {
+	case blockedBy:
+	case "":
+		t.Fatalf("%s %s was allowed with status %d, want blocked by %s", r.Method, r.URL, w.Code, blockedBy)
+	default:
+		t.Fatalf("%s %s blocked by %s, want %s", r.Method, r.URL, got, blockedBy)
+	}
+	return w
+}
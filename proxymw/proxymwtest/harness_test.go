@@ -0,0 +1,66 @@
+package proxymwtest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+	"github.com/kevindweb/throttle-proxy/proxymw/proxymwtest"
+)
+
+func TestHarness(t *testing.T) {
+	t.Parallel()
+	monitor := proxymwtest.NewMonitor(t)
+	monitor.Set("sum(load)", 10, 500)
+	upstream := proxymwtest.NewUpstream(t)
+	clock := proxymwtest.NewFakeClock(time.Now())
+
+	entry := proxymwtest.NewServe(t, proxymw.Config{
+		BlockerConfig: proxymw.BlockerConfig{
+			EnableBlocker: true,
+			BlockPatterns: []string{"X-User-Agent=scraper.*"},
+		},
+		BackpressureConfig: proxymw.BackpressureConfig{
+			EnableBackpressure:        true,
+			BackpressureMonitoringURL: monitor.URL,
+			BackpressureQueries: []proxymw.BackpressureQuery{{
+				Query:              "sum(load)",
+				WarningThreshold:   100,
+				EmergencyThreshold: 200,
+			}},
+			CongestionWindowMin: 1,
+			CongestionWindowMax: 100,
+			AllowanceMode:       proxymw.AllowanceModeProbabilistic,
+		},
+		Clock: clock,
+		Rand:  proxymwtest.NewRand(1),
+	}, upstream)
+
+	query := func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", http.NoBody)
+	}
+	proxymwtest.RequireAllowed(t, entry, query())
+	require.Len(t, upstream.Requests(), 1)
+
+	scraper := query()
+	scraper.Header.Set("X-User-Agent", "scraper-v1")
+	proxymwtest.RequireBlocked(t, entry, scraper, proxymw.BlockerProxyType)
+
+	// the second poll reports an overloaded upstream and every request is dropped
+	for poll := 1; poll <= 2; poll++ {
+		clock.BlockUntil(1)
+		clock.Advance(proxymw.BackpressureUpdateCadence)
+		require.Eventually(t, func() bool {
+			return monitor.Calls("sum(load)") == poll
+		}, time.Second, time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		w := proxymwtest.Serve(entry, query())
+		return w.Header().Get(string(proxymw.HeaderThrottleReason)) == proxymw.BackpressureProxyType
+	}, time.Second, time.Millisecond)
+	proxymwtest.RequireBlocked(t, entry, query(), proxymw.BackpressureProxyType)
+}
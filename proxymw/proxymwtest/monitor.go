@@ -0,0 +1,108 @@
+package proxymwtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Monitor is a fake Prometheus answering instant queries with scripted values. Point
+// BackpressureConfig.BackpressureMonitoringURL at its URL. Queries without a script answer with a
+// bad_data error like an invalid PromQL expression would.
+type Monitor struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	scripts map[string][]float64
+	failing map[string]int
+	calls   map[string]int
+}
+
+// NewMonitor starts a monitor server that is closed when the test ends
+func NewMonitor(t testing.TB) *Monitor {
+	t.Helper()
+	m := &Monitor{
+		scripts: map[string][]float64{},
+		failing: map[string]int{},
+		calls:   map[string]int{},
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serveQuery))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// Set scripts the values returned for the query, one per poll. The last value repeats once the
+// others are used up.
+func (m *Monitor) Set(query string, values ...float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failing, query)
+	m.scripts[query] = values
+}
+
+// Fail answers the query with an API error and the status code until it is Set again
+func (m *Monitor) Fail(query string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failing[query] = status
+}
+
+// Calls is how many times the query was polled
+func (m *Monitor) Calls(query string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[query]
+}
+
+// next pops the scripted value of the query
+func (m *Monitor) next(query string) (float64, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[query]++
+	if status, ok := m.failing[query]; ok {
+		return 0, status
+	}
+
+	script, ok := m.scripts[query]
+	if !ok || len(script) == 0 {
+		return 0, http.StatusBadRequest
+	}
+	if len(script) > 1 {
+		m.scripts[query] = script[1:]
+	}
+	return script[0], http.StatusOK
+}
+
+func (m *Monitor) serveQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	value, status := m.next(query)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	var body any
+	if status == http.StatusOK {
+		body = map[string]any{
+			"status": "success",
+			"data": map[string]any{
+				"resultType": "vector",
+				"result": []any{map[string]any{
+					"metric": map[string]string{},
+					"value":  []any{float64(time.Now().Unix()), strconv.FormatFloat(value, 'f', -1, 64)},
+				}},
+			},
+		}
+	} else {
+		body = map[string]string{
+			"status":    "error",
+			"errorType": "bad_data",
+			"error":     fmt.Sprintf("scripted failure of %q", query),
+		}
+	}
+	// the client sees a truncated response if encoding fails
+	_ = json.NewEncoder(w).Encode(body)
+}
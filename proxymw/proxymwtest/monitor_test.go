@@ -0,0 +1,33 @@
+package proxymwtest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+	"github.com/kevindweb/throttle-proxy/proxymw/proxymwtest"
+)
+
+func TestMonitor(t *testing.T) {
+	t.Parallel()
+	m := proxymwtest.NewMonitor(t)
+	m.Set("sum(load)", 10, 20)
+
+	ctx := context.Background()
+	for _, want := range []float64{10, 20, 20} {
+		got, err := proxymw.ValueFromPromQL(ctx, m.Client(), m.URL, "sum(load)")
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	require.Equal(t, 3, m.Calls("sum(load)"))
+
+	m.Fail("sum(load)", http.StatusServiceUnavailable)
+	_, err := proxymw.ValueFromPromQL(ctx, m.Client(), m.URL, "sum(load)")
+	require.Error(t, err)
+
+	_, err = proxymw.ValueFromPromQL(ctx, m.Client(), m.URL, "unscripted")
+	require.ErrorContains(t, err, "unscripted")
+}
@@ -0,0 +1,55 @@
+package proxymwtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Upstream is a fake upstream recording the requests that made it through the chain. It serves
+// them directly as the next handler of a ServeEntry, or over HTTP at its URL for round trippers
+// and reverse proxies.
+type Upstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	body     string
+	requests []*http.Request
+}
+
+// NewUpstream starts an upstream answering 200 OK that is closed when the test ends
+func NewUpstream(t testing.TB) *Upstream {
+	t.Helper()
+	u := &Upstream{status: http.StatusOK}
+	u.Server = httptest.NewServer(u)
+	t.Cleanup(u.Close)
+	return u
+}
+
+// Respond sets the status and body of every following response
+func (u *Upstream) Respond(status int, body string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status, u.body = status, body
+}
+
+// Requests returns the requests received so far
+func (u *Upstream) Requests() []*http.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]*http.Request(nil), u.requests...)
+}
+
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests = append(u.requests, r.Clone(context.Background()))
+	status, body := u.status, u.body
+	u.mu.Unlock()
+
+	w.WriteHeader(status)
+	// the client sees a truncated response if writing fails
+	_, _ = w.Write([]byte(body))
+}
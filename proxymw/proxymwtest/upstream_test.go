@@ -0,0 +1,31 @@
+package proxymwtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxymw/proxymwtest"
+)
+
+func TestUpstream(t *testing.T) {
+	t.Parallel()
+	u := proxymwtest.NewUpstream(t)
+	u.Respond(http.StatusTeapot, "short and stout")
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u.URL+"/api/v1/query", http.NoBody)
+	require.NoError(t, err)
+	res, err := u.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTeapot, res.StatusCode)
+	require.Equal(t, "short and stout", string(body))
+	require.Len(t, u.Requests(), 1)
+	require.Equal(t, "/api/v1/query", u.Requests()[0].URL.Path)
+}
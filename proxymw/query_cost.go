@@ -1,19 +1,23 @@
+//go:build !nopromql
+
 package proxymw
 
 import (
 	"errors"
 	"fmt"
-	"math"
-	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
 )
 
+// promQLSupported reports whether PromQL can be parsed in this build.
+// Build with the nopromql tag to drop the PromQL parser and Thanos engine dependencies.
+const promQLSupported = true
+
 const ObjectStorageThreshold = 100
 const DefaultRangeStep = time.Second * 30
 
@@ -31,12 +35,68 @@ func LowCostRequest(rr Request) (bool, error) {
 
 const ThanosLookbackDelta = 5 * time.Minute
 
+// HeadBlockLookback is how far back data is served from the head block before reaching object storage
+const HeadBlockLookback = 2 * time.Hour
+
+// QueryCost estimates the cost of the query in the request. Queries calibrated by CostFeedback
+// cost what they were observed to read, other queries are expensive when they reach past the
+// head block.
 func QueryCost(rr Request) (int, error) {
+	cost, err := queryCost(rr)
+	if err == nil {
+		recordQueryCost(rr, cost)
+	}
+	return cost, err
+}
+
+func queryCost(rr Request) (int, error) {
+	if cost, ok := calibratedCost(rr); ok {
+		return cost, nil
+	}
+
+	if isLokiRequest(rr.Request()) {
+		return logQLCost(rr.Request())
+	}
+
+	lookback, err := QueryLookback(rr)
+	if err != nil {
+		return 0, err
+	}
+
+	if lookback > HeadBlockLookback {
+		return ObjectStorageThreshold, nil
+	}
+	return 0, nil
+}
+
+// QueryLookback returns how far back from now the PromQL or LogQL in the request will read data.
+// Series, labels, and label values requests read back to their start parameter.
+func QueryLookback(rr Request) (time.Duration, error) {
+	if isLokiRequest(rr.Request()) {
+		return logQLLookback(rr.Request())
+	}
+
+	if isMetadataRequest(rr.Request()) {
+		return metadataLookback(rr.Request())
+	}
+
 	q, err := queryFromRequest(rr)
 	if err != nil {
 		return 0, err
 	}
 
+	costs := formCacheFrom(rr.Request().Context()).chainCosts()
+	reach, err := costs.queryCostCache().reach(
+		q.query, q.start, q.end, q.step, func() (time.Duration, error) { return queryReach(q) },
+	)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(q.start) + reach, nil
+}
+
+// queryReach parses and plans the query to find how far before its start time it reads data
+func queryReach(q intermediateQuery) (time.Duration, error) {
 	expr, err := parser.NewParser(q.query).ParseExpr()
 	if err != nil {
 		return 0, err
@@ -60,11 +120,7 @@ func QueryCost(rr Request) (int, error) {
 	}
 
 	min, _ := plan.MinMaxTime(qOpts)
-	twoHoursAgo := time.Now().UTC().Add(-time.Hour * 2).UnixMilli()
-	if min < twoHoursAgo {
-		return ObjectStorageThreshold, nil
-	}
-	return 0, nil
+	return q.start.Sub(time.UnixMilli(min)), nil
 }
 
 func queryFromRequest(rr Request) (intermediateQuery, error) {
@@ -73,35 +129,30 @@ func queryFromRequest(rr Request) (intermediateQuery, error) {
 		return intermediateQuery{}, errors.New("nil HTTP request when parsing promql")
 	}
 
-	req, err := DupRequest(req)
-	if err != nil {
-		return intermediateQuery{}, fmt.Errorf("error duplicating request for parsing: %w", err)
-	}
-
 	if req.URL == nil {
 		return intermediateQuery{}, errors.New("nil URL when parsing promql")
 	}
 
-	switch req.URL.Path {
-	case "/api/v1/query":
-		return queryFromInstant(req)
-	case "/api/v1/query_range":
-		return queryFromRange(req)
-	default:
+	if req.URL.Path != "/api/v1/query" && req.URL.Path != "/api/v1/query_range" {
 		return intermediateQuery{}, fmt.Errorf(
 			"can only handle instant or range query, found %s", req.URL.Path,
 		)
 	}
-}
 
-func queryFromInstant(req *http.Request) (intermediateQuery, error) {
-	err := req.ParseForm()
+	form, err := parsedForm(req)
 	if err != nil {
-		return intermediateQuery{}, fmt.Errorf("bad request in instant query %v", err)
+		return intermediateQuery{}, fmt.Errorf("bad request in query %v", err)
+	}
+
+	if req.URL.Path == "/api/v1/query" {
+		return queryFromInstant(form)
 	}
+	return queryFromRange(form)
+}
 
-	query := req.Form.Get("query")
-	ts := req.Form.Get("time")
+func queryFromInstant(form url.Values) (intermediateQuery, error) {
+	query := form.Get("query")
+	ts := form.Get("time")
 	if ts == "" {
 		ts = strconv.FormatInt(time.Now().UTC().Unix(), 10)
 	}
@@ -109,16 +160,11 @@ func queryFromInstant(req *http.Request) (intermediateQuery, error) {
 	return parseRequestArguments(query, ts, ts, "0")
 }
 
-func queryFromRange(req *http.Request) (intermediateQuery, error) {
-	err := req.ParseForm()
-	if err != nil {
-		return intermediateQuery{}, fmt.Errorf("bad request in range query %v", err)
-	}
-
-	query := req.Form.Get("query")
-	start := req.Form.Get("start")
-	end := req.Form.Get("end")
-	step := req.Form.Get("step")
+func queryFromRange(form url.Values) (intermediateQuery, error) {
+	query := form.Get("query")
+	start := form.Get("start")
+	end := form.Get("end")
+	step := form.Get("step")
 	return parseRequestArguments(query, start, end, step)
 }
 
@@ -145,29 +191,3 @@ func parseRequestArguments(query string, start string, end string, step string)
 		step:  stepDuration,
 	}, nil
 }
-
-func parseTime(s string) (time.Time, error) {
-	if t, err := strconv.ParseFloat(s, 64); err == nil {
-		s, ns := math.Modf(t)
-		ns = math.Round(ns*1000) / 1000
-		return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
-	}
-	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
-		return t, nil
-	}
-	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
-}
-
-func parseDuration(s string) (time.Duration, error) {
-	if d, err := strconv.ParseFloat(s, 64); err == nil {
-		ts := d * float64(time.Second)
-		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
-			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
-		}
-		return time.Duration(ts), nil
-	}
-	if d, err := model.ParseDuration(s); err == nil {
-		return time.Duration(d), nil
-	}
-	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
-}
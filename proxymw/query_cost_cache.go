@@ -0,0 +1,118 @@
+package proxymw
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kevindweb/throttle-proxy/internal/util"
+)
+
+const (
+	DefaultQueryCostCacheSize = 10_000
+
+	// queryCostCacheBucket rounds query time ranges so dashboards refreshing a relative range
+	// share cache entries
+	queryCostCacheBucket = time.Minute
+)
+
+var (
+	ErrNegativeQueryCostCacheSize = errors.New("query cost cache size cannot be negative")
+
+	defaultQueryCostCacheMetrics = newQueryCostCacheMetrics(defaultMetricsFactory)
+)
+
+// queryCostCacheMetrics are the collectors of the query cost cache of one middleware chain
+type queryCostCacheMetrics struct {
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+func newQueryCostCacheMetrics(factory promauto.Factory) *queryCostCacheMetrics {
+	return &queryCostCacheMetrics{
+		hits: factory.NewCounter(prometheus.CounterOpts{
+			Name: "proxymw_query_cost_cache_hits_total",
+			Help: "Query cost estimates served from the parse cache",
+		}),
+		misses: factory.NewCounter(prometheus.CounterOpts{
+			Name: "proxymw_query_cost_cache_misses_total",
+			Help: "Query cost estimates which parsed and planned the query",
+		}),
+	}
+}
+
+// QueryCostCacheConfig caches how far back each query reads so repeated dashboard queries skip
+// the PromQL parser and logical planner when estimating their cost.
+type QueryCostCacheConfig struct {
+	EnableQueryCostCache bool `yaml:"enable_query_cost_cache"`
+	// QueryCostCacheSize is how many queries are cached. Defaults to 10000.
+	QueryCostCacheSize int `yaml:"query_cost_cache_size"`
+}
+
+func (c QueryCostCacheConfig) Validate() error {
+	if c.EnableQueryCostCache && c.QueryCostCacheSize < 0 {
+		return ErrNegativeQueryCostCacheSize
+	}
+	return nil
+}
+
+func (c QueryCostCacheConfig) size() int {
+	if c.QueryCostCacheSize == 0 {
+		return DefaultQueryCostCacheSize
+	}
+	return c.QueryCostCacheSize
+}
+
+// queryCostCacheKey identifies a query by its text, bucketed time range, and step
+type queryCostCacheKey struct {
+	query string
+	span  time.Duration
+	step  time.Duration
+}
+
+// queryCostCache maps queries to how far before their start time they read data, which does not
+// change as the range slides forward
+type queryCostCache struct {
+	reaches *util.LRU[queryCostCacheKey, time.Duration]
+	hits    prometheus.Counter
+	misses  prometheus.Counter
+}
+
+func newQueryCostCache(cfg QueryCostCacheConfig, m *queryCostCacheMetrics) *queryCostCache {
+	return &queryCostCache{
+		reaches: util.NewLRU[queryCostCacheKey, time.Duration](cfg.size()),
+		hits:    m.hits,
+		misses:  m.misses,
+	}
+}
+
+// reach returns how far before its start the query reads, computing and caching it on a miss.
+// Queries with @ modifiers pin absolute times so they are always computed.
+func (c *queryCostCache) reach(
+	query string, start, end time.Time, step time.Duration, compute func() (time.Duration, error),
+) (time.Duration, error) {
+	if c == nil || strings.Contains(query, "@") {
+		return compute()
+	}
+
+	key := queryCostCacheKey{
+		query: query,
+		span:  end.Sub(start).Round(queryCostCacheBucket),
+		step:  step,
+	}
+	if reach, ok := c.reaches.Get(key); ok {
+		c.hits.Inc()
+		return reach, nil
+	}
+
+	c.misses.Inc()
+	reach, err := compute()
+	if err != nil {
+		return 0, err
+	}
+	c.reaches.Add(key, reach)
+	return reach, nil
+}
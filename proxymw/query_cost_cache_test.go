@@ -0,0 +1,76 @@
+package proxymw
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCostCacheConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, QueryCostCacheConfig{QueryCostCacheSize: -1}.Validate())
+	require.NoError(t, QueryCostCacheConfig{EnableQueryCostCache: true}.Validate())
+	require.ErrorIs(
+		t,
+		QueryCostCacheConfig{EnableQueryCostCache: true, QueryCostCacheSize: -1}.Validate(),
+		ErrNegativeQueryCostCacheSize,
+	)
+}
+
+func TestQueryCostCacheReach(t *testing.T) {
+	t.Parallel()
+	m := newQueryCostCacheMetrics(promauto.With(prometheus.NewRegistry()))
+	cache := newQueryCostCache(QueryCostCacheConfig{EnableQueryCostCache: true}, m)
+
+	computed := 0
+	compute := func() (time.Duration, error) {
+		computed++
+		return 5 * time.Minute, nil
+	}
+	fail := func() (time.Duration, error) {
+		computed++
+		return 0, errors.New("parse error")
+	}
+
+	query := "rate(up[5m])"
+	end := time.Now()
+	start := end.Add(-time.Hour)
+	for range 3 {
+		reach, err := cache.reach(query, start, end, time.Minute, compute)
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Minute, reach)
+	}
+	require.Equal(t, 1, computed)
+
+	// a refreshed dashboard slides its range forward within the same bucket
+	_, err := cache.reach(query, start.Add(15*time.Second), end.Add(20*time.Second), time.Minute, compute)
+	require.NoError(t, err)
+	require.Equal(t, 1, computed)
+
+	// a wider range is a different entry
+	_, err = cache.reach(query, start.Add(-time.Hour), end, time.Minute, compute)
+	require.NoError(t, err)
+	require.Equal(t, 2, computed)
+
+	// @ modifiers pin absolute times and errors are not cached
+	for range 2 {
+		_, err = cache.reach("up @ 1700000000", start, end, time.Minute, compute)
+		require.NoError(t, err)
+		_, err = cache.reach("bad(", start, end, time.Minute, fail)
+		require.Error(t, err)
+	}
+	require.Equal(t, 6, computed)
+
+	require.InDelta(t, 3, testutil.ToFloat64(m.hits), 0)
+	require.InDelta(t, 4, testutil.ToFloat64(m.misses), 0)
+
+	var disabled *queryCostCache
+	_, err = disabled.reach(query, start, end, time.Minute, compute)
+	require.NoError(t, err)
+	require.Equal(t, 7, computed)
+}
@@ -1,14 +1,19 @@
+//go:build !nopromql
+
 package proxymw
 
 import (
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -295,3 +300,50 @@ func timeAgo(duration time.Duration) string {
 	ago := time.Now().UTC().Add(-duration).Unix()
 	return strconv.FormatInt(ago, 10)
 }
+
+func TestQueryCostRecorded(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", http.NoBody)
+	ctx, done := activeInflight.track(req.Context(), req, DefaultTenantHeader)
+	defer done()
+	rr := &RequestResponseWrapper{req: req.WithContext(ctx)}
+
+	cost, err := QueryCost(rr)
+	require.NoError(t, err)
+	recorded, ok := QueryCostFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, cost, recorded)
+}
+
+func TestQueryCostCachePerChain(t *testing.T) {
+	t.Parallel()
+	chain := func(cfg Config) (*ChainBuilder, *ServeEntry) {
+		cfg.MetricsConfig = MetricsConfig{MetricsRegistry: prometheus.NewRegistry()}
+		cb := NewChainBuilder(cfg).Use("cost", func(next ProxyClient) ProxyClient {
+			return &Mocker{NextFunc: func(rr Request) error {
+				if _, err := QueryCost(rr); err != nil {
+					return err
+				}
+				return next.Next(rr)
+			}}
+		})
+		entry, err := NewServeFromChain(cfg, cb, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		require.NoError(t, err)
+		return cb, entry
+	}
+
+	cached, cachedEntry := chain(Config{QueryCostCacheConfig: QueryCostCacheConfig{EnableQueryCostCache: true}})
+	uncached, uncachedEntry := chain(Config{})
+	require.Nil(t, uncached.costs.cache)
+	for _, entry := range []*ServeEntry{cachedEntry, uncachedEntry, cachedEntry, uncachedEntry} {
+		w := httptest.NewRecorder()
+		entry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", http.NoBody))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// only the requests of the chain which enabled the cache use it
+	require.InDelta(t, 1, testutil.ToFloat64(cached.costs.cache.misses), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(cached.costs.cache.hits), 0)
+}
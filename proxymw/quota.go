@@ -0,0 +1,319 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	QuotaProxyType = "quota"
+
+	// QuotasPath is where the internal server reports tenant quota usage
+	QuotasPath = "/api/v1/quotas"
+
+	QuotaHour = time.Hour
+	QuotaDay  = 24 * time.Hour
+)
+
+var (
+	ErrNegativeQuota = errors.New("tenant quotas and quota redis timeout cannot be negative")
+	ErrQuotasOff     = errors.New("quotas are not enabled")
+
+	// activeQuota is the Quota built from config served by QuotasHandler
+	activeQuota atomic.Pointer[Quota]
+
+	defaultQuotaMetrics = newQuotaMetrics(defaultMetricsFactory)
+)
+
+// quotaMetrics are the collectors of the Quota of one middleware chain
+type quotaMetrics struct {
+	degradedGauge prometheus.Gauge
+}
+
+func newQuotaMetrics(factory promauto.Factory) *quotaMetrics {
+	return &quotaMetrics{
+		degradedGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_quota_store_degraded",
+			Help: "Set to 1 while the quota store is unreachable and usage is counted per replica",
+		}),
+	}
+}
+
+// TenantQuota limits the requests and query cost of a tenant per hour and per UTC day.
+// Zero disables a limit. Cost is measured by QueryCost.
+type TenantQuota struct {
+	RequestsPerHour int64 `yaml:"requests_per_hour" json:"requests_per_hour,omitempty"`
+	RequestsPerDay  int64 `yaml:"requests_per_day" json:"requests_per_day,omitempty"`
+	CostPerHour     int64 `yaml:"cost_per_hour" json:"cost_per_hour,omitempty"`
+	CostPerDay      int64 `yaml:"cost_per_day" json:"cost_per_day,omitempty"`
+}
+
+// QuotaConfig limits each tenant to a long running budget of requests and query cost. Unlike
+// RateLimitConfig, quotas span hours or days so QuotaRedisAddr persists usage across restarts.
+type QuotaConfig struct {
+	EnableQuotas bool `yaml:"enable_quotas"`
+	// QuotaHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	QuotaHeader string `yaml:"quota_header"`
+	// DefaultQuota applies to tenants without an entry in TenantQuotas
+	DefaultQuota TenantQuota            `yaml:"default_quota"`
+	TenantQuotas map[string]TenantQuota `yaml:"tenant_quotas"`
+	// QuotaRedisAddr persists usage in Redis and shares it across replicas. Usage is counted in
+	// memory while Redis is unreachable.
+	QuotaRedisAddr      string        `yaml:"quota_redis_addr"`
+	QuotaRedisKeyPrefix string        `yaml:"quota_redis_key_prefix"`
+	QuotaRedisTimeout   time.Duration `yaml:"quota_redis_timeout"`
+}
+
+func (c QuotaConfig) Validate() error {
+	if !c.EnableQuotas {
+		return nil
+	}
+
+	if c.QuotaRedisTimeout < 0 || c.DefaultQuota.negative() {
+		return ErrNegativeQuota
+	}
+	for _, quota := range c.TenantQuotas {
+		if quota.negative() {
+			return ErrNegativeQuota
+		}
+	}
+
+	if c.QuotaRedisAddr != "" && !redisSupported {
+		return ErrRedisUnsupported
+	}
+	return nil
+}
+
+func (q TenantQuota) negative() bool {
+	return q.RequestsPerHour < 0 || q.RequestsPerDay < 0 || q.CostPerHour < 0 || q.CostPerDay < 0
+}
+
+func (c QuotaConfig) header() string {
+	if c.QuotaHeader == "" {
+		return DefaultTenantHeader
+	}
+	return http.CanonicalHeaderKey(c.QuotaHeader)
+}
+
+func (c QuotaConfig) quota(tenant string) TenantQuota {
+	if quota, ok := c.TenantQuotas[tenant]; ok {
+		return quota
+	}
+	return c.DefaultQuota
+}
+
+// quotaLimit is one budget of a tenant quota
+type quotaLimit struct {
+	name   string
+	window time.Duration
+	cost   bool
+	limit  int64
+}
+
+func (q TenantQuota) limits() []quotaLimit {
+	limits := []quotaLimit{
+		{name: "requests_per_hour", window: QuotaHour, limit: q.RequestsPerHour},
+		{name: "requests_per_day", window: QuotaDay, limit: q.RequestsPerDay},
+		{name: "cost_per_hour", window: QuotaHour, cost: true, limit: q.CostPerHour},
+		{name: "cost_per_day", window: QuotaDay, cost: true, limit: q.CostPerDay},
+	}
+	return slices.DeleteFunc(limits, func(l quotaLimit) bool { return l.limit == 0 })
+}
+
+func (l quotaLimit) key(tenant string) string {
+	return l.name + ":" + tenant
+}
+
+// QuotaUsage is the consumption of one quota limit in its current window
+type QuotaUsage struct {
+	Limit     string    `json:"limit"`
+	Max       int64     `json:"max"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Quota blocks tenants which exhausted their hourly or daily request or query cost budget.
+// Blocked requests are refunded so they do not consume quota.
+type Quota struct {
+	client ProxyClient
+	cfg    QuotaConfig
+	// stores are keyed by window so rolling over the hourly counters keeps the daily counters
+	stores map[time.Duration]CounterStore
+	now    func() time.Time
+}
+
+var _ ProxyClient = &Quota{}
+
+func NewQuota(client ProxyClient, cfg QuotaConfig) *Quota {
+	return newQuota(client, cfg, defaultQuotaMetrics)
+}
+
+func newQuota(client ProxyClient, cfg QuotaConfig, m *quotaMetrics) *Quota {
+	store := func() CounterStore {
+		return newCounterStore(
+			cfg.QuotaRedisAddr, cfg.QuotaRedisKeyPrefix, cfg.QuotaRedisTimeout, m.degradedGauge,
+		)
+	}
+	return NewQuotaWithStores(client, cfg, store(), store())
+}
+
+// NewQuotaWithStores creates a Quota counting hourly and daily usage in the provided stores
+func NewQuotaWithStores(client ProxyClient, cfg QuotaConfig, hourly, daily CounterStore) *Quota {
+	return &Quota{
+		client: client,
+		cfg:    cfg,
+		stores: map[time.Duration]CounterStore{QuotaHour: hourly, QuotaDay: daily},
+		now:    time.Now,
+	}
+}
+
+func (q *Quota) Init(ctx context.Context) error {
+	return q.client.Init(ctx)
+}
+
+func (q *Quota) Next(rr Request) error {
+	req := rr.Request()
+	tenant := q.tenant(req)
+	limits := q.cfg.quota(tenant).limits()
+	if len(limits) == 0 {
+		return q.client.Next(rr)
+	}
+
+	cost := int64(0)
+	if slices.ContainsFunc(limits, func(l quotaLimit) bool { return l.cost }) {
+		// requests which are not queries, e.g. label lookups, are free
+		if queryCost, err := QueryCost(rr); err == nil {
+			cost = int64(queryCost)
+		}
+	}
+
+	now := q.now()
+	charged := make([]quotaLimit, 0, len(limits))
+	for _, l := range limits {
+		delta := l.delta(cost)
+		used, err := q.stores[l.window].IncrBy(req.Context(), l.key(tenant), delta, l.window, now)
+		if err != nil {
+			// the local fallback cannot fail so only a custom store can reach here
+			log.Printf("error counting %s quota for tenant %s: %v", l.name, tenant, err)
+			continue
+		}
+		charged = append(charged, l)
+
+		if used > l.limit {
+			q.refund(req.Context(), tenant, charged, cost, now)
+			return quotaExceeded(tenant, l, used-delta, now)
+		}
+	}
+	return q.client.Next(rr)
+}
+
+func (l quotaLimit) delta(cost int64) int64 {
+	if l.cost {
+		return cost
+	}
+	return 1
+}
+
+func (q *Quota) tenant(req *http.Request) string {
+	if tenant := req.Header.Get(q.cfg.header()); tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// refund returns the usage charged to a blocked request
+func (q *Quota) refund(
+	ctx context.Context, tenant string, charged []quotaLimit, cost int64, now time.Time,
+) {
+	for _, l := range charged {
+		if _, err := q.stores[l.window].IncrBy(
+			ctx, l.key(tenant), -l.delta(cost), l.window, now,
+		); err != nil {
+			log.Printf("error refunding %s quota for tenant %s: %v", l.name, tenant, err)
+		}
+	}
+}
+
+func quotaExceeded(tenant string, l quotaLimit, used int64, now time.Time) error {
+	reset := windowStart(l.window, now).Add(l.window).Sub(now)
+	return &RequestBlockedError{
+		Err:        fmt.Errorf("tenant %s exhausted its %s quota of %d", tenant, l.name, l.limit),
+		Type:       QuotaProxyType,
+		RetryAfter: reset,
+		Headers: map[string]string{
+			string(HeaderQuotaLimit):     strconv.FormatInt(l.limit, 10),
+			string(HeaderQuotaRemaining): strconv.FormatInt(max(0, l.limit-used), 10),
+			string(HeaderQuotaReset):     strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10),
+		},
+	}
+}
+
+// Usage returns the consumption of every quota limit of the tenant
+func (q *Quota) Usage(ctx context.Context, tenant string) ([]QuotaUsage, error) {
+	now := q.now()
+	usage := []QuotaUsage{}
+	for _, l := range q.cfg.quota(tenant).limits() {
+		used, err := q.stores[l.window].IncrBy(ctx, l.key(tenant), 0, l.window, now)
+		if err != nil {
+			return nil, fmt.Errorf("read %s quota: %w", l.name, err)
+		}
+		usage = append(usage, QuotaUsage{
+			Limit:     l.name,
+			Max:       l.limit,
+			Used:      used,
+			Remaining: max(0, l.limit-used),
+			ResetsAt:  windowStart(l.window, now).Add(l.window),
+		})
+	}
+	return usage, nil
+}
+
+// ServeUsage reports the quota usage of the tenant named by the tenant parameter, or of every
+// tenant with a configured quota when it is omitted.
+func (q *Quota) ServeUsage(w http.ResponseWriter, r *http.Request) {
+	tenants := []string{r.URL.Query().Get("tenant")}
+	if tenants[0] == "" {
+		tenants = make([]string, 0, len(q.cfg.TenantQuotas))
+		for tenant := range q.cfg.TenantQuotas {
+			tenants = append(tenants, tenant)
+		}
+		slices.Sort(tenants)
+	}
+
+	usage := map[string][]QuotaUsage{}
+	for _, tenant := range tenants {
+		var err error
+		if usage[tenant], err = q.Usage(r.Context(), tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		log.Printf("error writing quota usage: %v", err)
+	}
+}
+
+// QuotasHandler reports tenant usage of the Quota middleware built from config
+func QuotasHandler(w http.ResponseWriter, r *http.Request) {
+	q := activeQuota.Load()
+	if q == nil {
+		http.Error(w, ErrQuotasOff.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	q.ServeUsage(w, r)
+}
@@ -0,0 +1,170 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, QuotaConfig{}.Validate())
+	require.NoError(t, QuotaConfig{
+		EnableQuotas: true,
+		DefaultQuota: TenantQuota{RequestsPerHour: 10},
+	}.Validate())
+	require.ErrorIs(t, QuotaConfig{
+		EnableQuotas: true,
+		TenantQuotas: map[string]TenantQuota{"team-a": {CostPerDay: -1}},
+	}.Validate(), ErrNegativeQuota)
+	require.ErrorIs(t, QuotaConfig{
+		EnableQuotas:      true,
+		QuotaRedisTimeout: -time.Second,
+	}.Validate(), ErrNegativeQuota)
+}
+
+func quotaRequest(tenant, query string) Request {
+	req := httptest.NewRequest(
+		http.MethodGet, "/api/v1/query?query="+url.QueryEscape(query), http.NoBody,
+	)
+	if tenant != "" {
+		req.Header.Set(DefaultTenantHeader, tenant)
+	}
+	return &RequestResponseWrapper{req: req}
+}
+
+func TestQuota(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC)
+	q := NewQuotaWithStores(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, QuotaConfig{
+		EnableQuotas: true,
+		DefaultQuota: TenantQuota{RequestsPerHour: 2, RequestsPerDay: 3},
+		TenantQuotas: map[string]TenantQuota{"unlimited": {}},
+	}, NewLocalCounterStore(), NewLocalCounterStore())
+	q.now = func() time.Time { return now }
+
+	require.NoError(t, q.Next(quotaRequest("team-a", "up")))
+	require.NoError(t, q.Next(quotaRequest("team-a", "up")))
+
+	err := q.Next(quotaRequest("team-a", "up"))
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, QuotaProxyType, blocked.Type)
+	require.Equal(t, 30*time.Minute, blocked.RetryAfter)
+	require.Equal(t, map[string]string{
+		string(HeaderQuotaLimit):     "2",
+		string(HeaderQuotaRemaining): "0",
+		string(HeaderQuotaReset):     "1800",
+	}, blocked.Headers)
+	require.EqualError(t, err, "tenant team-a exhausted its requests_per_hour quota of 2")
+
+	// blocked requests are refunded so the daily quota still has room
+	usage, err := q.Usage(context.Background(), "team-a")
+	require.NoError(t, err)
+	require.Equal(t, []QuotaUsage{
+		{
+			Limit: "requests_per_hour", Max: 2, Used: 2, Remaining: 0,
+			ResetsAt: now.Add(30 * time.Minute),
+		},
+		{
+			Limit: "requests_per_day", Max: 3, Used: 2, Remaining: 1,
+			ResetsAt: now.Add(30 * time.Minute),
+		},
+	}, usage)
+
+	// tenants with an empty quota are never limited
+	for range 5 {
+		require.NoError(t, q.Next(quotaRequest("unlimited", "up")))
+	}
+
+	now = now.Add(time.Hour)
+	require.NoError(t, q.Next(quotaRequest("team-a", "up")))
+}
+
+func TestQuotaCost(t *testing.T) {
+	t.Parallel()
+	const query = "rate(http_requests_total[7d])"
+	cost, err := QueryCost(quotaRequest("", query))
+	if err != nil {
+		t.Skip("query cost requires PromQL support")
+	}
+
+	q := NewQuotaWithStores(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, QuotaConfig{
+		EnableQuotas: true,
+		DefaultQuota: TenantQuota{RequestsPerDay: 100, CostPerDay: int64(cost)},
+	}, NewLocalCounterStore(), NewLocalCounterStore())
+
+	require.NoError(t, q.Next(quotaRequest("team-a", query)))
+	// cheap queries do not consume the cost quota
+	require.NoError(t, q.Next(quotaRequest("team-a", "up")))
+
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, q.Next(quotaRequest("team-a", query)), &blocked)
+	require.Equal(t, "0", blocked.Headers[string(HeaderQuotaRemaining)])
+
+	// the refund keeps the rejected request out of the request quota
+	usage, err := q.Usage(context.Background(), "team-a")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), usage[0].Used)
+}
+
+func TestQuotasHandler(t *testing.T) {
+	q := NewQuotaWithStores(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, QuotaConfig{
+		EnableQuotas: true,
+		DefaultQuota: TenantQuota{RequestsPerHour: 10},
+		TenantQuotas: map[string]TenantQuota{"team-a": {RequestsPerDay: 5}},
+	}, NewLocalCounterStore(), NewLocalCounterStore())
+	require.NoError(t, q.Next(quotaRequest("team-a", "up")))
+
+	activeQuota.Store(nil)
+	w := httptest.NewRecorder()
+	QuotasHandler(w, httptest.NewRequest(http.MethodGet, QuotasPath, http.NoBody))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	activeQuota.Store(q)
+	defer activeQuota.Store(nil)
+	for _, tc := range []struct {
+		name   string
+		target string
+		want   map[string][]string
+	}{
+		{
+			name:   "configured tenants",
+			target: QuotasPath,
+			want:   map[string][]string{"team-a": {"requests_per_day"}},
+		},
+		{
+			name:   "default quota",
+			target: QuotasPath + "?tenant=team-b",
+			want:   map[string][]string{"team-b": {"requests_per_hour"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			QuotasHandler(w, httptest.NewRequest(http.MethodGet, tc.target, http.NoBody))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var got map[string][]QuotaUsage
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			limits := map[string][]string{}
+			for tenant, usage := range got {
+				for _, u := range usage {
+					limits[tenant] = append(limits[tenant], u.Limit)
+				}
+			}
+			require.Equal(t, tc.want, limits)
+		})
+	}
+}
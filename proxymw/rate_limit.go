@@ -0,0 +1,189 @@
+package proxymw
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	RateLimitProxyType = "rate_limit"
+
+	DefaultRateLimitWindow = time.Second
+	DefaultRedisKeyPrefix  = "throttle-proxy"
+	DefaultRedisTimeout    = 50 * time.Millisecond
+)
+
+var defaultRateLimitMetrics = newRateLimitMetrics(defaultMetricsFactory)
+
+// rateLimitMetrics are the collectors of the RateLimiter of one middleware chain
+type rateLimitMetrics struct {
+	degradedGauge prometheus.Gauge
+}
+
+func newRateLimitMetrics(factory promauto.Factory) *rateLimitMetrics {
+	return &rateLimitMetrics{
+		degradedGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_rate_limit_store_degraded",
+			Help: "Set to 1 while the shared counter store is unreachable and limits are per replica",
+		}),
+	}
+}
+
+// RateLimitConfig limits the number of requests each tenant may send per window. When RedisAddr
+// is set the limit is shared by every replica, otherwise it is enforced per replica.
+type RateLimitConfig struct {
+	EnableRateLimit bool `yaml:"enable_rate_limit"`
+	// RateLimitHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	RateLimitHeader string `yaml:"rate_limit_header"`
+	// RateLimitByClientIP limits each client IP instead of each tenant. The client IP is resolved
+	// through the X-Forwarded-For header of TrustedProxies.
+	RateLimitByClientIP bool `yaml:"rate_limit_by_client_ip"`
+	// RateLimit is the number of requests a tenant may send per RateLimitWindow
+	RateLimit       int           `yaml:"rate_limit"`
+	RateLimitWindow time.Duration `yaml:"rate_limit_window"`
+	// RedisAddr enables global enforcement through a Redis counter store
+	RedisAddr      string        `yaml:"redis_addr"`
+	RedisKeyPrefix string        `yaml:"redis_key_prefix"`
+	RedisTimeout   time.Duration `yaml:"redis_timeout"`
+}
+
+func (c RateLimitConfig) Validate() error {
+	if !c.EnableRateLimit {
+		return nil
+	}
+
+	if c.RateLimit <= 0 {
+		return ErrRateLimitRequired
+	}
+
+	if c.RateLimitWindow < 0 || c.RedisTimeout < 0 {
+		return ErrNegativeRateLimitDuration
+	}
+
+	if c.RedisAddr != "" && !redisSupported {
+		return ErrRedisUnsupported
+	}
+	return nil
+}
+
+func (c RateLimitConfig) header() string {
+	if c.RateLimitHeader == "" {
+		return DefaultTenantHeader
+	}
+	return http.CanonicalHeaderKey(c.RateLimitHeader)
+}
+
+func (c RateLimitConfig) window() time.Duration {
+	if c.RateLimitWindow == 0 {
+		return DefaultRateLimitWindow
+	}
+	return c.RateLimitWindow
+}
+
+func (c RateLimitConfig) store(m *rateLimitMetrics) CounterStore {
+	return newCounterStore(c.RedisAddr, c.RedisKeyPrefix, c.RedisTimeout, m.degradedGauge)
+}
+
+// newCounterStore counts in memory, or in Redis with an in memory fallback when addr is set
+func newCounterStore(
+	addr, prefix string, timeout time.Duration, degraded prometheus.Gauge,
+) CounterStore {
+	local := NewLocalCounterStore()
+	if addr == "" {
+		return local
+	}
+
+	if prefix == "" {
+		prefix = DefaultRedisKeyPrefix
+	}
+
+	if timeout == 0 {
+		timeout = DefaultRedisTimeout
+	}
+
+	store, err := newRedisCounterStore(addr, prefix, timeout, local, degraded)
+	if err != nil {
+		log.Printf("counting in memory: %v", err)
+		return local
+	}
+	return store
+}
+
+// RateLimiter blocks tenants which exceed their request rate within a fixed window.
+type RateLimiter struct {
+	client     ProxyClient
+	header     string
+	byClientIP bool
+	limit      int64
+	window     time.Duration
+	store      CounterStore
+	now        func() time.Time
+}
+
+var _ ProxyClient = &RateLimiter{}
+
+func NewRateLimiter(client ProxyClient, cfg RateLimitConfig) *RateLimiter {
+	return NewRateLimiterWithStore(client, cfg, cfg.store(defaultRateLimitMetrics))
+}
+
+// NewRateLimiterWithStore creates a RateLimiter counting requests in the provided store.
+func NewRateLimiterWithStore(
+	client ProxyClient, cfg RateLimitConfig, store CounterStore,
+) *RateLimiter {
+	return &RateLimiter{
+		client:     client,
+		header:     cfg.header(),
+		byClientIP: cfg.RateLimitByClientIP,
+		limit:      int64(cfg.RateLimit),
+		window:     cfg.window(),
+		store:      store,
+		now:        time.Now,
+	}
+}
+
+func (rl *RateLimiter) Init(ctx context.Context) error {
+	return rl.client.Init(ctx)
+}
+
+func (rl *RateLimiter) Next(rr Request) error {
+	req := rr.Request()
+	kind, key := rl.key(req)
+
+	now := rl.now()
+	count, err := rl.store.Incr(req.Context(), key, rl.window, now)
+	if err != nil {
+		// the local fallback cannot fail so only a custom store can reach here
+		log.Printf("error counting request for %s %s: %v", kind, key, err)
+		return rl.client.Next(rr)
+	}
+
+	if count > rl.limit {
+		return &RequestBlockedError{
+			Err: fmt.Errorf(
+				"%s %s exceeded %d requests per %s", kind, key, rl.limit, rl.window,
+			),
+			Type:       RateLimitProxyType,
+			RetryAfter: windowStart(rl.window, now).Add(rl.window).Sub(now),
+		}
+	}
+	return rl.client.Next(rr)
+}
+
+// key returns what the limit is counted by and its value for the request
+func (rl *RateLimiter) key(req *http.Request) (kind, key string) {
+	if rl.byClientIP {
+		return "client", ClientIP(req)
+	}
+
+	tenant := req.Header.Get(rl.header)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	return "tenant", tenant
+}
@@ -0,0 +1,86 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, RateLimitConfig{}.Validate())
+	require.NoError(t, RateLimitConfig{EnableRateLimit: true, RateLimit: 10}.Validate())
+	require.ErrorIs(t, RateLimitConfig{EnableRateLimit: true}.Validate(), ErrRateLimitRequired)
+	require.ErrorIs(t, RateLimitConfig{
+		EnableRateLimit: true,
+		RateLimit:       10,
+		RateLimitWindow: -time.Second,
+	}.Validate(), ErrNegativeRateLimitDuration)
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1_699_999_980, 0).Add(15 * time.Second)
+	rl := NewRateLimiterWithStore(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, RateLimitConfig{
+		EnableRateLimit: true,
+		RateLimit:       2,
+		RateLimitWindow: time.Minute,
+	}, NewLocalCounterStore())
+	rl.now = func() time.Time { return now }
+
+	request := func(tenant string) Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		if tenant != "" {
+			req.Header.Set(DefaultTenantHeader, tenant)
+		}
+		return &RequestResponseWrapper{req: req}
+	}
+
+	require.NoError(t, rl.Next(request("team-a")))
+	require.NoError(t, rl.Next(request("team-a")))
+
+	err := rl.Next(request("team-a"))
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, RateLimitProxyType, blocked.Type)
+	require.Equal(t, 45*time.Second, blocked.RetryAfter)
+	require.EqualError(t, err, "tenant team-a exceeded 2 requests per 1m0s")
+
+	// other tenants have their own limit
+	require.NoError(t, rl.Next(request("team-b")))
+	require.NoError(t, rl.Next(request("")))
+
+	now = now.Add(time.Minute)
+	require.NoError(t, rl.Next(request("team-a")))
+}
+
+func TestRateLimiterByClientIP(t *testing.T) {
+	t.Parallel()
+	rl := NewRateLimiterWithStore(&Mocker{
+		NextFunc: func(Request) error { return nil },
+	}, RateLimitConfig{
+		EnableRateLimit:     true,
+		RateLimitByClientIP: true,
+		RateLimit:           1,
+		RateLimitWindow:     time.Minute,
+	}, NewLocalCounterStore())
+
+	request := func(remoteAddr string) Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(DefaultTenantHeader, "team-a")
+		return &RequestResponseWrapper{req: req}
+	}
+
+	require.NoError(t, rl.Next(request("192.0.2.1:1234")))
+	// the port differs between connections of the same client
+	require.EqualError(
+		t, rl.Next(request("192.0.2.1:5678")), "client 192.0.2.1 exceeded 1 requests per 1m0s",
+	)
+	require.NoError(t, rl.Next(request("192.0.2.2:1234")))
+}
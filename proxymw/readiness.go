@@ -0,0 +1,42 @@
+package proxymw
+
+import (
+	"net/http"
+	"time"
+)
+
+// ReadinessPath is where the proxy reports whether it should receive traffic
+const ReadinessPath = "/readyz"
+
+// trackEmergency records when the allowance fully closed if readiness depends on it.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) trackEmergency(now time.Time) {
+	switch {
+	case bp.unreadyAfterEmergency == 0:
+		return
+	case bp.allowance > 0:
+		bp.emergencySince = time.Time{}
+	case bp.emergencySince.IsZero():
+		bp.emergencySince = now
+	}
+}
+
+// Ready reports false once the allowance has been fully closed for UnreadyAfterEmergency
+func (bp *Backpressure) Ready(now time.Time) bool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.unreadyAfterEmergency == 0 || bp.emergencySince.IsZero() {
+		return true
+	}
+	return now.Sub(bp.emergencySince) < bp.unreadyAfterEmergency
+}
+
+// ReadinessHandler responds 503 while the Backpressure built from config is in sustained
+// emergency throttling so load balancers shift traffic to other replicas
+func ReadinessHandler(w http.ResponseWriter, _ *http.Request) {
+	if bp := activeBackpressure.Load(); bp != nil && !bp.Ready(bp.now()) {
+		http.Error(w, "sustained emergency throttling", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,46 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{Name: "load", Query: "load", WarningThreshold: 10, EmergencyThreshold: 20}
+	newBP := func(unreadyAfter time.Duration) *Backpressure {
+		return newBackpressure(&Mocker{}, BackpressureConfig{
+			CongestionWindowMin:   1,
+			CongestionWindowMax:   10,
+			BackpressureQueries:   []BackpressureQuery{q},
+			UnreadyAfterEmergency: unreadyAfter,
+		}, newBackpressureMetrics(promauto.With(prometheus.NewRegistry())))
+	}
+
+	bp := newBP(time.Minute)
+	now := time.Now()
+	require.True(t, bp.Ready(now))
+
+	bp.setThrottle(q, 1)
+	require.True(t, bp.Ready(time.Now()), "emergency has not been sustained")
+	require.False(t, bp.Ready(time.Now().Add(2*time.Minute)))
+
+	bp.setThrottle(q, 0.5)
+	require.True(t, bp.Ready(time.Now().Add(2*time.Minute)), "partial throttling is ready")
+
+	disabled := newBP(0)
+	disabled.setThrottle(q, 1)
+	require.True(t, disabled.Ready(time.Now().Add(time.Hour)))
+}
+
+func TestReadinessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	ReadinessHandler(w, httptest.NewRequest(http.MethodGet, ReadinessPath, http.NoBody))
+	require.Equal(t, http.StatusOK, w.Code)
+}
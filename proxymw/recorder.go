@@ -0,0 +1,181 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kevindweb/throttle-proxy/internal/util"
+)
+
+const (
+	RecorderProxyType = "recorder"
+
+	DefaultRecordPercent = 100.0
+)
+
+var (
+	ErrRecordFileRequired = errors.New("recording requires a record file")
+	ErrRecordPercent      = errors.New("record percent must be between 0 and 100")
+	ErrNegativeRecordSize = errors.New("record max size and backups cannot be negative")
+
+	// DefaultRecordHeaders are recorded when no headers are configured. Credentials are never
+	// recorded unless listed explicitly.
+	DefaultRecordHeaders = []string{string(HeaderCriticality), DefaultTenantHeader}
+)
+
+// RecordConfig writes a sample of proxied requests to a file so the traffic can be replayed
+// against another environment with the replay command
+type RecordConfig struct {
+	EnableRecording bool `yaml:"enable_recording"`
+	// RecordFile receives one JSON RecordedRequest per line, rotated at RecordMaxSizeMB
+	RecordFile       string `yaml:"record_file"`
+	RecordMaxSizeMB  int    `yaml:"record_max_size_mb"`
+	RecordMaxBackups int    `yaml:"record_max_backups"`
+	// RecordPercent of requests are recorded. Defaults to 100.
+	RecordPercent float64 `yaml:"record_percent"`
+	// RecordHeaders are the request headers recorded. Defaults to DefaultRecordHeaders.
+	RecordHeaders []string `yaml:"record_headers"`
+}
+
+func (c RecordConfig) Validate() error {
+	if !c.EnableRecording {
+		return nil
+	}
+
+	if c.RecordFile == "" {
+		return ErrRecordFileRequired
+	}
+	if c.RecordPercent < 0 || c.RecordPercent > 100 {
+		return ErrRecordPercent
+	}
+	if c.RecordMaxSizeMB < 0 || c.RecordMaxBackups < 0 {
+		return ErrNegativeRecordSize
+	}
+	return nil
+}
+
+func (c RecordConfig) percent() float64 {
+	if c.RecordPercent == 0 {
+		return DefaultRecordPercent
+	}
+	return c.RecordPercent
+}
+
+func (c RecordConfig) headers() []string {
+	if len(c.RecordHeaders) == 0 {
+		return DefaultRecordHeaders
+	}
+	return c.RecordHeaders
+}
+
+// writer opens the rotated record file
+func (c RecordConfig) writer() (io.Writer, error) {
+	maxSize, backups := c.RecordMaxSizeMB, c.RecordMaxBackups
+	if maxSize == 0 {
+		maxSize = DefaultAccessLogMaxSizeMB
+	}
+	if backups == 0 {
+		backups = DefaultAccessLogMaxBackups
+	}
+
+	file, err := util.OpenRotatingFile(c.RecordFile, int64(maxSize)<<20, backups)
+	if err != nil {
+		return nil, fmt.Errorf("open record file: %w", err)
+	}
+	return file, nil
+}
+
+// RecordedRequest is one line of the record file
+type RecordedRequest struct {
+	// Time is when the request arrived. Replays preserve the time between requests.
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// Params are the URL query and form body parameters
+	Params    url.Values  `json:"params"`
+	Header    http.Header `json:"header,omitempty"`
+	LatencyMs float64     `json:"latency_ms"`
+}
+
+// Recorder writes a sample of requests to the record file after the rest of the chain handled
+// them. Blocked requests are recorded too so a replay reproduces the original traffic.
+type Recorder struct {
+	client  ProxyClient
+	out     io.Writer
+	percent float64
+	headers []string
+	// clock and rand default to the system sources when nil
+	clock Clock
+	rand  Rand
+}
+
+var _ ProxyClient = &Recorder{}
+
+func NewRecorder(client ProxyClient, cfg RecordConfig) (*Recorder, error) {
+	out, err := cfg.writer()
+	if err != nil {
+		return nil, err
+	}
+	return newRecorder(client, cfg, out), nil
+}
+
+func newRecorder(client ProxyClient, cfg RecordConfig, out io.Writer) *Recorder {
+	return &Recorder{
+		client:  client,
+		out:     out,
+		percent: cfg.percent(),
+		headers: cfg.headers(),
+	}
+}
+
+func (r *Recorder) Init(ctx context.Context) error {
+	return r.client.Init(ctx)
+}
+
+func (r *Recorder) Next(rr Request) error {
+	if orSystemRand(r.rand).Float64()*100 >= r.percent {
+		return r.client.Next(rr)
+	}
+
+	clock := orSystemClock(r.clock)
+	start := clock.Now()
+	req := rr.Request()
+	record := RecordedRequest{
+		Time:   start,
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Params: requestForm(req),
+	}
+	for _, name := range r.headers {
+		if values := req.Header.Values(name); len(values) > 0 {
+			if record.Header == nil {
+				record.Header = http.Header{}
+			}
+			record.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	err := r.client.Next(rr)
+	record.LatencyMs = float64(clock.Now().Sub(start).Microseconds()) / 1000
+	r.write(record)
+	return err
+}
+
+func (r *Recorder) write(record RecordedRequest) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("error encoding recorded request: %v", err)
+		return
+	}
+	// a single write keeps lines of concurrent requests whole
+	if _, err := r.out.Write(append(line, '\n')); err != nil {
+		log.Printf("error writing recorded request: %v", err)
+	}
+}
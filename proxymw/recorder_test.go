@@ -0,0 +1,123 @@
+package proxymw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, RecordConfig{RecordPercent: 200}.Validate())
+	require.ErrorIs(t, RecordConfig{EnableRecording: true}.Validate(), ErrRecordFileRequired)
+	require.ErrorIs(t, Config{RecordConfig: RecordConfig{
+		EnableRecording: true,
+		RecordFile:      "traffic.jsonl",
+		RecordPercent:   101,
+	}}.Validate(), ErrRecordPercent)
+	require.ErrorIs(t, RecordConfig{
+		EnableRecording:  true,
+		RecordFile:       "traffic.jsonl",
+		RecordMaxBackups: -1,
+	}.Validate(), ErrNegativeRecordSize)
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	upstream := ""
+	blocked := false
+	next := &Mocker{NextFunc: func(rr Request) error {
+		body, err := io.ReadAll(rr.Request().Body)
+		require.NoError(t, err)
+		upstream = string(body)
+		if blocked {
+			return BlockErr(BackpressureProxyType, "over the window")
+		}
+		return nil
+	}}
+
+	r := newRecorder(next, RecordConfig{RecordPercent: 50}, &out)
+	start := time.Date(2024, time.January, 5, 9, 0, 0, 0, time.UTC)
+	r.clock, r.rand = fixedClock{start}, fixedRand(0.3)
+
+	form := url.Values{"query": {"sum(up)"}, "time": {"1704445200"}}
+	newRequest := func() Request {
+		req := httptest.NewRequest(
+			http.MethodPost, QueryPath+"?dedup=true", strings.NewReader(form.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(DefaultTenantHeader, "team-a")
+		req.Header.Set("Authorization", "Bearer secret")
+		return &RequestResponseWrapper{req: req}
+	}
+
+	require.NoError(t, r.Next(newRequest()))
+	require.Equal(t, form.Encode(), upstream, "the upstream still reads the body")
+
+	blocked = true
+	var blockedErr *RequestBlockedError
+	require.ErrorAs(t, r.Next(newRequest()), &blockedErr)
+
+	// unsampled requests are not recorded
+	blocked = false
+	r.rand = fixedRand(0.6)
+	require.NoError(t, r.Next(newRequest()))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		var record RecordedRequest
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		require.Equal(t, RecordedRequest{
+			Time:   start,
+			Method: http.MethodPost,
+			Path:   QueryPath,
+			Params: url.Values{"query": {"sum(up)"}, "time": {"1704445200"}, "dedup": {"true"}},
+			Header: http.Header{http.CanonicalHeaderKey(DefaultTenantHeader): {"team-a"}},
+		}, record)
+	}
+}
+
+func TestRecorderFromConfig(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "traffic.jsonl")
+	cfg := Config{RecordConfig: RecordConfig{
+		EnableRecording: true,
+		RecordFile:      file,
+		RecordHeaders:   []string{"x-dashboard"},
+	}}
+	require.NoError(t, cfg.Validate())
+
+	entry := NewServeFromConfig(cfg, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, entry.Init(t.Context()))
+	t.Cleanup(func() { require.NoError(t, entry.Close()) })
+
+	req := httptest.NewRequest(http.MethodGet, QueryRangePath+"?query=up&step=60", http.NoBody)
+	req.Header.Set("X-Dashboard", "overview")
+	entry.ServeHTTP(httptest.NewRecorder(), req)
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	require.True(t, scanner.Scan())
+	var record RecordedRequest
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+	require.Equal(t, QueryRangePath, record.Path)
+	require.Equal(t, url.Values{"query": {"up"}, "step": {"60"}}, record.Params)
+	require.Equal(t, http.Header{"X-Dashboard": {"overview"}}, record.Header)
+}
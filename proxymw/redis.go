@@ -0,0 +1,232 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSupported reports whether the Redis backed stores are in this build. Build with the
+// nopromql tag to drop the Redis client along with the PromQL dependencies.
+const redisSupported = true
+
+// newRedisCounterStore counts in Redis, degrading to counting in memory while it is unreachable
+func newRedisCounterStore(
+	addr, prefix string, timeout time.Duration, local CounterStore, degraded prometheus.Gauge,
+) (CounterStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:         addr,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		MaxRetries:   -1,
+	})
+	return NewFallbackCounterStore(
+		NewRedisCounterStore(client, prefix), local, timeout, degraded,
+	), nil
+}
+
+func newRedisLeaderElector(
+	addr, key, replica string, duration time.Duration,
+) (LeaderElector, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	return NewRedisLeaderElector(client, key, replica, duration), nil
+}
+
+func newRedisStateStore(addr, key string) (StateStore, error) {
+	return NewRedisStateStore(redis.NewClient(&redis.Options{Addr: addr}), key), nil
+}
+
+func newRedisWindowPeers(addr, key, replica string, stale time.Duration) (WindowPeers, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	return NewRedisWindowPeers(client, key, replica, stale), nil
+}
+
+// RedisCounterStore shares counters across replicas. Keys are suffixed with the window start so
+// every replica increments the same counter regardless of when it first saw the key.
+type RedisCounterStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+var _ CounterStore = &RedisCounterStore{}
+
+func NewRedisCounterStore(client redis.UniversalClient, prefix string) *RedisCounterStore {
+	return &RedisCounterStore{client: client, prefix: prefix}
+}
+
+func (s *RedisCounterStore) Incr(
+	ctx context.Context, key string, window time.Duration, now time.Time,
+) (int64, error) {
+	return s.IncrBy(ctx, key, 1, window, now)
+}
+
+func (s *RedisCounterStore) IncrBy(
+	ctx context.Context, key string, delta int64, window time.Duration, now time.Time,
+) (int64, error) {
+	start := windowStart(window, now)
+	redisKey := s.prefix + ":" + key + ":" + strconv.FormatInt(start.UnixMilli(), 10)
+
+	pipe := s.client.TxPipeline()
+	incr := pipe.IncrBy(ctx, redisKey, delta)
+	// keep the key around for an extra window to tolerate clock skew between replicas
+	pipe.PExpire(ctx, redisKey, 2*window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// redisElectScript renews the lock held by the replica or takes it when nobody holds it
+var redisElectScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+// RedisLeaderElector holds the leader lock as a key expiring after the lease duration and
+// stores `<allowance>:<unix millis>` next to it
+type RedisLeaderElector struct {
+	client   redis.UniversalClient
+	key      string
+	replica  string
+	duration time.Duration
+}
+
+var _ LeaderElector = &RedisLeaderElector{}
+
+func NewRedisLeaderElector(
+	client redis.UniversalClient, key, replica string, duration time.Duration,
+) *RedisLeaderElector {
+	return &RedisLeaderElector{
+		client:   client,
+		key:      key,
+		replica:  replica,
+		duration: duration,
+	}
+}
+
+func (e *RedisLeaderElector) Elect(ctx context.Context, _ time.Time) (bool, error) {
+	leading, err := redisElectScript.Run(
+		ctx, e.client, []string{e.key}, e.replica, e.duration.Milliseconds(),
+	).Int()
+	return leading == 1, err
+}
+
+func (e *RedisLeaderElector) Publish(ctx context.Context, allowance float64, now time.Time) error {
+	return e.client.Set(
+		ctx, e.key+":allowance", formatPublishedAllowance(allowance, now), e.duration,
+	).Err()
+}
+
+func (e *RedisLeaderElector) Allowance(ctx context.Context) (float64, time.Time, error) {
+	value, err := e.client.Get(ctx, e.key+":allowance").Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, time.Time{}, ErrNoPublishedAllowance
+	} else if err != nil {
+		return 0, time.Time{}, err
+	}
+	return parsePublishedAllowance(value)
+}
+
+// RedisStateStore keeps the state as JSON in a Redis key
+type RedisStateStore struct {
+	client redis.UniversalClient
+	key    string
+}
+
+var _ StateStore = &RedisStateStore{}
+
+func NewRedisStateStore(client redis.UniversalClient, key string) *RedisStateStore {
+	return &RedisStateStore{client: client, key: key}
+}
+
+func (s *RedisStateStore) Save(ctx context.Context, state PersistedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key, data, 0).Err()
+}
+
+func (s *RedisStateStore) Load(ctx context.Context) (PersistedState, error) {
+	data, err := s.client.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return PersistedState{}, ErrNoPersistedState
+	} else if err != nil {
+		return PersistedState{}, err
+	}
+
+	var state PersistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return PersistedState{}, fmt.Errorf("decode %s: %w", s.key, err)
+	}
+	return state, nil
+}
+
+// RedisWindowPeers stores `<active>:<unix millis>` per replica in a Redis hash
+type RedisWindowPeers struct {
+	client  redis.UniversalClient
+	key     string
+	replica string
+	stale   time.Duration
+}
+
+var _ WindowPeers = &RedisWindowPeers{}
+
+func NewRedisWindowPeers(
+	client redis.UniversalClient, key, replica string, stale time.Duration,
+) *RedisWindowPeers {
+	return &RedisWindowPeers{
+		client:  client,
+		key:     key,
+		replica: replica,
+		stale:   stale,
+	}
+}
+
+func (p *RedisWindowPeers) Sync(ctx context.Context, active int, now time.Time) (int, error) {
+	value := strconv.Itoa(active) + ":" + strconv.FormatInt(now.UnixMilli(), 10)
+	pipe := p.client.TxPipeline()
+	pipe.HSet(ctx, p.key, p.replica, value)
+	all := pipe.HGetAll(ctx, p.key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	peerActive := 0
+	stale := []string{}
+	for replica, value := range all.Val() {
+		if replica == p.replica {
+			continue
+		}
+
+		count, updated, err := parsePeerActive(value)
+		if err != nil || now.Sub(updated) > p.stale {
+			stale = append(stale, replica)
+			continue
+		}
+		peerActive += count
+	}
+
+	if len(stale) > 0 {
+		// replicas which stopped publishing are removed so scale downs free their share
+		if err := p.client.HDel(ctx, p.key, stale...).Err(); err != nil {
+			log.Printf("error removing stale shared window replicas: %v", err)
+		}
+	}
+	return peerActive, nil
+}
@@ -0,0 +1,31 @@
+//go:build nopromql
+
+package proxymw
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// redisSupported is false when built with the nopromql tag, which drops the Redis client for
+// embedders that only count, elect, and persist in process.
+const redisSupported = false
+
+func newRedisCounterStore(
+	_, _ string, _ time.Duration, _ CounterStore, _ prometheus.Gauge,
+) (CounterStore, error) {
+	return nil, ErrRedisUnsupported
+}
+
+func newRedisLeaderElector(_, _, _ string, _ time.Duration) (LeaderElector, error) {
+	return nil, ErrRedisUnsupported
+}
+
+func newRedisStateStore(_, _ string) (StateStore, error) {
+	return nil, ErrRedisUnsupported
+}
+
+func newRedisWindowPeers(_, _, _ string, _ time.Duration) (WindowPeers, error) {
+	return nil, ErrRedisUnsupported
+}
@@ -0,0 +1,160 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisCounterStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	replicaA := NewRedisCounterStore(client, "test")
+	replicaB := NewRedisCounterStore(client, "test")
+
+	count, err := replicaA.Incr(ctx, "tenant", time.Minute, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// counters are shared by every replica
+	count, err = replicaB.Incr(ctx, "tenant", time.Minute, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+
+	key := "test:tenant:" + "1699999980000"
+	require.True(t, mr.Exists(key))
+	require.Equal(t, 2*time.Minute, mr.TTL(key))
+}
+
+func TestFallbackCounterStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_degraded"})
+	local := NewLocalCounterStore()
+	store := NewFallbackCounterStore(NewRedisCounterStore(client, "test"), local, time.Second, gauge)
+
+	count, err := store.Incr(ctx, "tenant", time.Minute, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+	require.Zero(t, testutil.ToFloat64(gauge))
+
+	mr.SetError("server down")
+	count, err = store.Incr(ctx, "tenant", time.Minute, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count, "local store starts counting when redis is down")
+	require.Equal(t, 1.0, testutil.ToFloat64(gauge))
+
+	mr.SetError("")
+	count, err = store.Incr(ctx, "tenant", time.Minute, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+	require.Zero(t, testutil.ToFloat64(gauge))
+}
+
+func TestRedisLeaderElector(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	a := NewRedisLeaderElector(client, "leader", "a", time.Minute)
+	b := NewRedisLeaderElector(client, "leader", "b", time.Minute)
+
+	_, _, err := b.Allowance(ctx)
+	require.ErrorIs(t, err, ErrNoPublishedAllowance)
+
+	leading, err := a.Elect(ctx, now)
+	require.NoError(t, err)
+	require.True(t, leading)
+	leading, err = b.Elect(ctx, now)
+	require.NoError(t, err)
+	require.False(t, leading)
+
+	require.NoError(t, a.Publish(ctx, 0.25, now))
+	allowance, published, err := b.Allowance(ctx)
+	require.NoError(t, err)
+	require.InDelta(t, 0.25, allowance, 0)
+	require.True(t, now.Equal(published))
+
+	// renewals keep the lock past its first expiry
+	mr.FastForward(40 * time.Second)
+	leading, err = a.Elect(ctx, now)
+	require.NoError(t, err)
+	require.True(t, leading)
+	mr.FastForward(40 * time.Second)
+	leading, err = b.Elect(ctx, now)
+	require.NoError(t, err)
+	require.False(t, leading)
+
+	// another replica takes over once the leader stops renewing
+	mr.FastForward(time.Minute)
+	leading, err = b.Elect(ctx, now)
+	require.NoError(t, err)
+	require.True(t, leading)
+}
+
+func TestRedisWindowPeers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	a := NewRedisWindowPeers(client, "bp", "a", 3*time.Second)
+	b := NewRedisWindowPeers(client, "bp", "b", 3*time.Second)
+	c := NewRedisWindowPeers(client, "bp", "c", 3*time.Second)
+
+	peerActive, err := a.Sync(ctx, 4, now)
+	require.NoError(t, err)
+	require.Zero(t, peerActive)
+
+	peerActive, err = b.Sync(ctx, 2, now)
+	require.NoError(t, err)
+	require.Equal(t, 4, peerActive)
+
+	peerActive, err = c.Sync(ctx, 1, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 6, peerActive)
+
+	// a replica that stops publishing is dropped from the fleet count
+	now = now.Add(5 * time.Second)
+	_, err = b.Sync(ctx, 3, now)
+	require.NoError(t, err)
+	peerActive, err = c.Sync(ctx, 1, now)
+	require.NoError(t, err)
+	require.Equal(t, 3, peerActive)
+	replicas, err := mr.HKeys("bp")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c"}, replicas)
+}
+
+func TestRedisCounterStoreIncrBy(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	testCounterStoreIncrBy(t, NewRedisCounterStore(client, "test"))
+}
+
+func TestRedisStateStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	testStateStore(t, NewRedisStateStore(client, DefaultStateRedisKey))
+}
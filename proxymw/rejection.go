@@ -0,0 +1,118 @@
+package proxymw
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"text/template"
+)
+
+const (
+	// RejectionKeyError configures the response for requests that failed with an unexpected error
+	RejectionKeyError = "error"
+	// DefaultErrorType is the errorType field in rejection responses unless overridden
+	DefaultErrorType = "throttle-proxy"
+)
+
+// defaultRejections answer rejections that retrying cannot resolve like Prometheus answers
+// invalid queries. Unset fields of a configured rejection fall back to these.
+var defaultRejections = map[string]RejectionConfig{
+	GuardrailProxyType:   {StatusCode: http.StatusBadRequest, ErrorType: "bad_data"},
+	CriticalityProxyType: {StatusCode: http.StatusBadRequest, ErrorType: "bad_data"},
+	MaintenanceProxyType: {StatusCode: http.StatusServiceUnavailable, ErrorType: "unavailable"},
+}
+
+// RejectionConfig controls the response written when a middleware rejects a request.
+// Some callers such as Grafana datasources behave better with a 503 or a Prometheus-native
+// errorType like "unavailable".
+type RejectionConfig struct {
+	// StatusCode defaults to 429 for blocked requests and 500 for errors
+	StatusCode int `yaml:"status_code"`
+	// ErrorType is the errorType field of the JSON response body
+	ErrorType string `yaml:"error_type"`
+	// Message is a text/template for the error field. It can reference {{.Type}}, {{.Error}}, and
+	// {{.TraceID}}.
+	Message string `yaml:"message"`
+}
+
+func (c RejectionConfig) Validate() error {
+	if c.StatusCode != 0 && (c.StatusCode < 400 || c.StatusCode > 599) {
+		return fmt.Errorf("rejection status code %d is not a 4xx or 5xx code", c.StatusCode)
+	}
+
+	if _, err := template.New("rejection").Parse(c.Message); err != nil {
+		return fmt.Errorf("rejection message template: %w", err)
+	}
+	return nil
+}
+
+// rejection is the parsed form of a RejectionConfig
+type rejection struct {
+	status    int
+	errorType string
+	message   *template.Template
+}
+
+type rejectionData struct {
+	Type    string
+	Error   string
+	TraceID string
+}
+
+func newRejections(cfgs map[string]RejectionConfig) map[string]rejection {
+	merged := maps.Clone(defaultRejections)
+	for key, cfg := range cfgs {
+		if cfg.StatusCode == 0 {
+			cfg.StatusCode = merged[key].StatusCode
+		}
+		if cfg.ErrorType == "" {
+			cfg.ErrorType = merged[key].ErrorType
+		}
+		merged[key] = cfg
+	}
+
+	rejections := map[string]rejection{}
+	for key, cfg := range merged {
+		r := rejection{
+			status:    cfg.StatusCode,
+			errorType: cfg.ErrorType,
+		}
+		if cfg.Message != "" {
+			r.message = template.Must(template.New(key).Parse(cfg.Message))
+		}
+		rejections[key] = r
+	}
+	return rejections
+}
+
+// write renders the rejection using the defaults for any unset fields
+func (r rejection) write(w http.ResponseWriter, data rejectionData, defaultStatus int) {
+	status := defaultStatus
+	if r.status != 0 {
+		status = r.status
+	}
+
+	errorType := DefaultErrorType
+	if r.errorType != "" {
+		errorType = r.errorType
+	}
+
+	message := data.Error
+	if r.message != nil {
+		var buf bytes.Buffer
+		if err := r.message.Execute(&buf, data); err != nil {
+			log.Printf("error rendering rejection message: %v", err)
+		} else {
+			message = buf.String()
+		}
+	}
+
+	writeAPIError(w, APIErrorResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     message,
+		TraceID:   data.TraceID,
+	}, status)
+}
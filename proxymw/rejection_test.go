@@ -0,0 +1,149 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectionConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, RejectionConfig{}.Validate())
+	require.NoError(t, RejectionConfig{StatusCode: 503, Message: "{{.Type}}: {{.Error}}"}.Validate())
+	require.Error(t, RejectionConfig{StatusCode: 200}.Validate())
+	require.Error(t, RejectionConfig{Message: "{{.Type"}.Validate())
+
+	cfg := Config{
+		Rejections: map[string]RejectionConfig{BackpressureProxyType: {StatusCode: 302}},
+	}
+	require.Error(t, cfg.Validate())
+}
+
+func TestRejectionResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		rejections map[string]RejectionConfig
+		err        error
+		header     http.Header
+		wantStatus int
+		wantBody   APIErrorResponse
+	}{
+		{
+			name:       "default blocked response",
+			err:        ErrBackpressureBackoff,
+			wantStatus: http.StatusTooManyRequests,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: DefaultErrorType,
+				Error:     ErrBackpressureBackoff.Error(),
+			},
+		},
+		{
+			name: "prometheus native unavailable for backpressure",
+			rejections: map[string]RejectionConfig{
+				BackpressureProxyType: {
+					StatusCode: http.StatusServiceUnavailable,
+					ErrorType:  "unavailable",
+					Message:    "throttled by {{.Type}}",
+				},
+			},
+			err:        ErrBackpressureBackoff,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: "unavailable",
+				Error:     "throttled by backpressure",
+			},
+		},
+		{
+			name: "other middleware keeps defaults",
+			rejections: map[string]RejectionConfig{
+				BackpressureProxyType: {StatusCode: http.StatusServiceUnavailable},
+			},
+			err:        BlockErr(BlockerProxyType, "blocked"),
+			wantStatus: http.StatusTooManyRequests,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: DefaultErrorType,
+				Error:     "blocked",
+			},
+		},
+		{
+			name:       "guardrails answer like invalid queries",
+			err:        BlockErr(GuardrailProxyType, "query step 1s is below the minimum of 15s"),
+			wantStatus: http.StatusBadRequest,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: "bad_data",
+				Error:     "query step 1s is below the minimum of 15s",
+			},
+		},
+		{
+			name: "configured message keeps the guardrail status",
+			rejections: map[string]RejectionConfig{
+				GuardrailProxyType: {Message: "rejected by {{.Type}}"},
+			},
+			err:        BlockErr(GuardrailProxyType, "query step 1s is below the minimum of 15s"),
+			wantStatus: http.StatusBadRequest,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: "bad_data",
+				Error:     "rejected by guardrail",
+			},
+		},
+		{
+			name:       "traced request",
+			err:        BlockErr(RateLimitProxyType, "too many requests"),
+			header:     http.Header{HeaderB3: {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1"}},
+			wantStatus: http.StatusTooManyRequests,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: DefaultErrorType,
+				Error:     "too many requests",
+				TraceID:   "80f198ee56343ba864fe8b2a57d3eff7",
+			},
+		},
+		{
+			name: "unexpected error",
+			rejections: map[string]RejectionConfig{
+				RejectionKeyError: {StatusCode: http.StatusBadGateway, ErrorType: "internal"},
+			},
+			err:        errors.New("fail"),
+			wantStatus: http.StatusBadGateway,
+			wantBody: APIErrorResponse{
+				Status:    "error",
+				ErrorType: "internal",
+				Error:     "proxy error: fail",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			serve := &ServeEntry{
+				client: &Mocker{
+					NextFunc: func(_ Request) error { return tt.err },
+				},
+				rejections: newRejections(tt.rejections),
+			}
+
+			r, err := http.NewRequestWithContext(
+				context.Background(), http.MethodGet, "https://thanos.io", http.NoBody,
+			)
+			require.NoError(t, err)
+			if tt.header != nil {
+				r.Header = tt.header
+			}
+			w := httptest.NewRecorder()
+			serve.ServeHTTP(w, r)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			var body APIErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			require.Equal(t, tt.wantBody, body)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	RemoteWriteProxyType = "remote_write"
+
+	// DefaultRemoteWritePath is the Prometheus remote-write receiver endpoint
+	DefaultRemoteWritePath = "/api/v1/write"
+
+	// remoteWriteV2Proto is the proto parameter of the Content-Type of remote-write 2.0 requests
+	remoteWriteV2Proto = "io.prometheus.write.v2.Request"
+
+	remoteWriteResultAdmitted = "admitted"
+	remoteWriteResultBlocked  = "blocked"
+)
+
+var (
+	ErrRemoteWriteSamplesRequired = errors.New(
+		"max samples per second must be > 0 when remote-write limiting is enabled",
+	)
+
+	defaultRemoteWriteMetrics = newRemoteWriteMetrics(defaultMetricsFactory)
+)
+
+// remoteWriteMetrics are the collectors of the RemoteWriteLimiter of one middleware chain
+type remoteWriteMetrics struct {
+	samples *prometheus.CounterVec
+	series  *prometheus.CounterVec
+}
+
+func newRemoteWriteMetrics(factory promauto.Factory) *remoteWriteMetrics {
+	return &remoteWriteMetrics{
+		samples: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_remote_write_samples_total",
+			Help: "Samples and histograms in remote-write requests by whether the request was admitted",
+		}, []string{"result"}),
+		series: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_remote_write_series_total",
+			Help: "Series in remote-write requests by whether the request was admitted",
+		}, []string{"result"}),
+	}
+}
+
+// RemoteWriteConfig throttles the ingest path by the samples written rather than the number of
+// requests, since one remote-write request may carry a handful or tens of thousands of samples.
+// Blocked writes get a 429 which Prometheus retries with backoff.
+type RemoteWriteConfig struct {
+	EnableRemoteWriteLimit bool `yaml:"enable_remote_write_limit"`
+	// RemoteWritePath is the path of remote-write requests. Defaults to /api/v1/write.
+	RemoteWritePath string `yaml:"remote_write_path"`
+	// MaxSamplesPerSecond is the rate of samples admitted with a burst of one second of samples.
+	// With backpressure enabled the rate shrinks with the backpressure allowance so ingesters are
+	// protected by the same signals as queriers.
+	MaxSamplesPerSecond float64 `yaml:"max_samples_per_second"`
+}
+
+func (c RemoteWriteConfig) Validate() error {
+	if !c.EnableRemoteWriteLimit {
+		return nil
+	}
+
+	if c.MaxSamplesPerSecond <= 0 {
+		return ErrRemoteWriteSamplesRequired
+	}
+
+	if !remoteWriteSupported {
+		return ErrRemoteWriteUnsupported
+	}
+	return nil
+}
+
+func (c RemoteWriteConfig) path() string {
+	if c.RemoteWritePath == "" {
+		return DefaultRemoteWritePath
+	}
+	return c.RemoteWritePath
+}
+
+// RemoteWriteLimiter decodes remote-write 1.0 and 2.0 requests to count their samples and series
+// and blocks writes once the samples per second are exceeded. Requests which cannot be decoded
+// are passed on for the upstream to reject.
+type RemoteWriteLimiter struct {
+	client     ProxyClient
+	path       string
+	maxSamples float64
+	// allowance scales the sample rate, the backpressure allowance when backpressure is enabled
+	allowance func() float64
+	now       func() time.Time
+
+	mu     sync.Mutex
+	bucket *tokenBucket
+
+	samples *prometheus.CounterVec
+	series  *prometheus.CounterVec
+}
+
+var _ ProxyClient = &RemoteWriteLimiter{}
+
+func NewRemoteWriteLimiter(client ProxyClient, cfg RemoteWriteConfig) *RemoteWriteLimiter {
+	return newRemoteWriteLimiter(client, cfg, defaultRemoteWriteMetrics)
+}
+
+func newRemoteWriteLimiter(
+	client ProxyClient, cfg RemoteWriteConfig, m *remoteWriteMetrics,
+) *RemoteWriteLimiter {
+	now := time.Now
+	return &RemoteWriteLimiter{
+		client:     client,
+		path:       cfg.path(),
+		maxSamples: cfg.MaxSamplesPerSecond,
+		allowance:  func() float64 { return 1 },
+		now:        now,
+		bucket:     newTokenBucket(cfg.MaxSamplesPerSecond, now()),
+		samples:    m.samples,
+		series:     m.series,
+	}
+}
+
+// chainAllowance reads the allowance of the Backpressure of the chain, 1 when it was removed
+func chainAllowance(bp *Backpressure) float64 {
+	if bp != nil {
+		return bp.Allowance()
+	}
+	return 1
+}
+
+func (rw *RemoteWriteLimiter) Init(ctx context.Context) error {
+	return rw.client.Init(ctx)
+}
+
+func (rw *RemoteWriteLimiter) Next(rr Request) error {
+	req := rr.Request()
+	if req.URL == nil || req.URL.Path != rw.path || req.Method != http.MethodPost {
+		return rw.client.Next(rr)
+	}
+
+	samples, series, err := countRemoteWrite(req)
+	if err != nil {
+		return rw.client.Next(rr)
+	}
+
+	if wait := rw.take(samples); wait > 0 {
+		rw.samples.WithLabelValues(remoteWriteResultBlocked).Add(float64(samples))
+		rw.series.WithLabelValues(remoteWriteResultBlocked).Add(float64(series))
+		return &RequestBlockedError{
+			Err: fmt.Errorf(
+				"remote write of %d samples exceeded %g samples per second",
+				samples, rw.maxSamples*rw.allowance(),
+			),
+			Type:       RemoteWriteProxyType,
+			RetryAfter: wait,
+		}
+	}
+
+	rw.samples.WithLabelValues(remoteWriteResultAdmitted).Add(float64(samples))
+	rw.series.WithLabelValues(remoteWriteResultAdmitted).Add(float64(series))
+	return rw.client.Next(rr)
+}
+
+// take consumes the samples from the bucket and returns how long until they are available when
+// it holds too few. Writes larger than the burst are admitted once the bucket is full and leave
+// it in debt.
+func (rw *RemoteWriteLimiter) take(samples int) time.Duration {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	now := rw.now()
+
+	b := rw.bucket
+	b.tokens = b.refill(now)
+	b.last = now
+	// the refill above used the previous rate, later refills use the current allowance
+	b.qps = rw.maxSamples * rw.allowance()
+	if b.qps <= 0 {
+		return BackpressureUpdateCadence
+	}
+
+	need := min(float64(samples), burst(b.qps))
+	if b.tokens < need {
+		return time.Duration(math.Ceil((need - b.tokens) / b.qps * float64(time.Second)))
+	}
+
+	b.tokens -= float64(samples)
+	return 0
+}
@@ -0,0 +1,57 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// remoteWriteSupported reports whether remote-write requests can be decoded in this build.
+// Build with the nopromql tag to drop the snappy and Prometheus protobuf dependencies.
+const remoteWriteSupported = true
+
+// countRemoteWrite decodes a copy of the snappy compressed protobuf body and counts the samples
+// and histograms, and the series they belong to
+func countRemoteWrite(req *http.Request) (int, int, error) {
+	dup, err := DupRequest(req)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	compressed, err := io.ReadAll(dup.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	samples := 0
+	if strings.Contains(req.Header.Get("Content-Type"), remoteWriteV2Proto) {
+		var wr writev2.Request
+		if err := wr.Unmarshal(body); err != nil {
+			return 0, 0, err
+		}
+		for _, ts := range wr.Timeseries {
+			samples += len(ts.Samples) + len(ts.Histograms)
+		}
+		return samples, len(wr.Timeseries), nil
+	}
+
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(body); err != nil {
+		return 0, 0, err
+	}
+	for _, ts := range wr.Timeseries {
+		samples += len(ts.Samples) + len(ts.Histograms)
+	}
+	return samples, len(wr.Timeseries), nil
+}
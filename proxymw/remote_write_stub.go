@@ -0,0 +1,13 @@
+//go:build nopromql
+
+package proxymw
+
+import "net/http"
+
+// remoteWriteSupported is false when built with the nopromql tag, which drops the snappy and
+// Prometheus protobuf dependencies remote-write requests are decoded with.
+const remoteWriteSupported = false
+
+func countRemoteWrite(_ *http.Request) (int, int, error) {
+	return 0, 0, ErrRemoteWriteUnsupported
+}
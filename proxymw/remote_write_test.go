@@ -0,0 +1,185 @@
+//go:build !nopromql
+
+package proxymw
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteWriteConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, RemoteWriteConfig{}.Validate())
+	require.NoError(t, RemoteWriteConfig{
+		EnableRemoteWriteLimit: true,
+		MaxSamplesPerSecond:    100,
+	}.Validate())
+	require.ErrorIs(t, Config{RemoteWriteConfig: RemoteWriteConfig{
+		EnableRemoteWriteLimit: true,
+	}}.Validate(), ErrRemoteWriteSamplesRequired)
+}
+
+// writeRequestV1 encodes a remote-write 1.0 request with the samples spread over two series
+func writeRequestV1(t *testing.T, samples int) *http.Request {
+	t.Helper()
+	wr := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "down"}}},
+	}}
+	for i := range samples {
+		ts := &wr.Timeseries[i%2]
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: 1, Timestamp: int64(i)})
+	}
+
+	body, err := wr.Marshal()
+	require.NoError(t, err)
+	req := httptest.NewRequest(
+		http.MethodPost, DefaultRemoteWritePath, bytes.NewReader(snappy.Encode(nil, body)),
+	)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	return req
+}
+
+func TestRemoteWriteLimiter(t *testing.T) {
+	t.Parallel()
+	m := newRemoteWriteMetrics(promauto.With(prometheus.NewRegistry()))
+	rw := newRemoteWriteLimiter(&Mocker{NextFunc: func(Request) error { return nil }}, RemoteWriteConfig{
+		EnableRemoteWriteLimit: true,
+		MaxSamplesPerSecond:    100,
+	}, m)
+	now := time.Unix(0, 0)
+	rw.now = func() time.Time { return now }
+	rw.bucket.last = now
+
+	next := func(req *http.Request) error {
+		return rw.Next(&RequestResponseWrapper{req: req})
+	}
+
+	require.NoError(t, next(writeRequestV1(t, 60)))
+	require.NoError(t, next(writeRequestV1(t, 40)))
+
+	err := next(writeRequestV1(t, 10))
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, RemoteWriteProxyType, blocked.Type)
+	require.Equal(t, 100*time.Millisecond, blocked.RetryAfter)
+	require.EqualError(t, err, "remote write of 10 samples exceeded 100 samples per second")
+
+	// writes larger than the burst wait for a full bucket
+	now = now.Add(500 * time.Millisecond)
+	err = next(writeRequestV1(t, 500))
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, 500*time.Millisecond, blocked.RetryAfter)
+	now = now.Add(500 * time.Millisecond)
+	require.NoError(t, next(writeRequestV1(t, 500)))
+
+	require.InDelta(t, 600, testutil.ToFloat64(m.samples.WithLabelValues(remoteWriteResultAdmitted)), 0)
+	require.InDelta(t, 510, testutil.ToFloat64(m.samples.WithLabelValues(remoteWriteResultBlocked)), 0)
+	require.InDelta(t, 6, testutil.ToFloat64(m.series.WithLabelValues(remoteWriteResultAdmitted)), 0)
+
+	// queries and undecodable writes are not limited
+	require.NoError(t, next(httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", http.NoBody)))
+	require.NoError(t, next(httptest.NewRequest(
+		http.MethodPost, DefaultRemoteWritePath, strings.NewReader("not snappy"),
+	)))
+}
+
+func TestRemoteWriteLimiterAllowance(t *testing.T) {
+	t.Parallel()
+	m := newRemoteWriteMetrics(promauto.With(prometheus.NewRegistry()))
+	rw := newRemoteWriteLimiter(&Mocker{NextFunc: func(Request) error { return nil }}, RemoteWriteConfig{
+		EnableRemoteWriteLimit: true,
+		MaxSamplesPerSecond:    100,
+	}, m)
+	now := time.Unix(0, 0)
+	rw.now = func() time.Time { return now }
+	rw.bucket.last = now
+	rw.bucket.tokens = 0
+
+	allowance := 0.5
+	rw.allowance = func() float64 { return allowance }
+	require.NoError(t, rw.Next(&RequestResponseWrapper{req: writeRequestV1(t, 0)}))
+
+	// half the allowance halves the rate the bucket refills at
+	now = now.Add(time.Second)
+	require.NoError(t, rw.Next(&RequestResponseWrapper{req: writeRequestV1(t, 50)}))
+	err := rw.Next(&RequestResponseWrapper{req: writeRequestV1(t, 50)})
+	var blocked *RequestBlockedError
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, time.Second, blocked.RetryAfter)
+	require.EqualError(t, err, "remote write of 50 samples exceeded 50 samples per second")
+
+	allowance = 0
+	err = rw.Next(&RequestResponseWrapper{req: writeRequestV1(t, 1)})
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, BackpressureUpdateCadence, blocked.RetryAfter)
+}
+
+func TestRemoteWriteLimiterChainAllowance(t *testing.T) {
+	t.Parallel()
+	build := func() (*RemoteWriteLimiter, *Backpressure) {
+		cfg := Config{
+			BackpressureConfig: BackpressureConfig{
+				EnableBackpressure:  true,
+				CongestionWindowMin: 1,
+				CongestionWindowMax: 10,
+			},
+			RemoteWriteConfig: RemoteWriteConfig{
+				EnableRemoteWriteLimit: true,
+				MaxSamplesPerSecond:    100,
+			},
+			MetricsConfig: MetricsConfig{MetricsRegistry: prometheus.NewRegistry()},
+		}
+		client, err := NewChainBuilder(cfg).Build(&Mocker{})
+		require.NoError(t, err)
+		rw, ok := client.(*RemoteWriteLimiter)
+		require.True(t, ok)
+		bp, ok := rw.client.(*Backpressure)
+		require.True(t, ok)
+		return rw, bp
+	}
+
+	rwA, bpA := build()
+	rwB, bpB := build()
+	bpA.allowance = 0.25
+	bpB.allowance = 0.75
+	require.InDelta(t, 0.25, rwA.allowance(), 0, "each limiter follows the backpressure of its chain")
+	require.InDelta(t, 0.75, rwB.allowance(), 0)
+}
+
+func TestCountRemoteWriteV2(t *testing.T) {
+	t.Parallel()
+	wr := writev2.Request{
+		Symbols: []string{"", "__name__", "up"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2},
+				Samples:    []writev2.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}},
+				Histograms: []writev2.Histogram{{Timestamp: 3}},
+			},
+		},
+	}
+	body, err := wr.Marshal()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(
+		http.MethodPost, DefaultRemoteWritePath, bytes.NewReader(snappy.Encode(nil, body)),
+	)
+	req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	samples, series, err := countRemoteWrite(req)
+	require.NoError(t, err)
+	require.Equal(t, 3, samples)
+	require.Equal(t, 1, series)
+}
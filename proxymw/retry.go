@@ -0,0 +1,309 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	RetryProxyType = "retry"
+
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBudgetRatio = 0.1
+	DefaultRetryBudgetMax   = 10
+	DefaultRetryBackoff     = 100 * time.Millisecond
+	DefaultRetryMaxWait     = 10 * time.Second
+
+	retryOutcomeRetried           = "retried"
+	retryOutcomeAttemptsExhausted = "attempts_exhausted"
+	retryOutcomeBudgetExhausted   = "budget_exhausted"
+	retryOutcomeWaitExceeded      = "wait_exceeded"
+)
+
+var (
+	ErrRetryMaxAttempts    = errors.New("retry max attempts cannot be negative")
+	ErrRetryBudget         = errors.New("retry budget ratio and max cannot be negative")
+	ErrNegativeRetryPeriod = errors.New("retry backoff and max wait cannot be negative")
+
+	defaultRetryMetrics = newRetryMetrics(defaultMetricsFactory)
+)
+
+// retryMetrics are the collectors of the Retrier of one middleware chain
+type retryMetrics struct {
+	throttled *prometheus.CounterVec
+	retries   *prometheus.CounterVec
+	tokens    prometheus.Gauge
+}
+
+func newRetryMetrics(factory promauto.Factory) *retryMetrics {
+	return &retryMetrics{
+		throttled: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_retry_throttled_responses_total",
+			Help: "Round trips answered with 429 or 503 by status",
+		}, []string{"status"}),
+		retries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxymw_retry_total",
+			Help: "Throttled round trips by outcome: retried, attempts_exhausted, budget_exhausted, or wait_exceeded",
+		}, []string{"outcome"}),
+		tokens: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_retry_budget_tokens",
+			Help: "Retries the budget currently allows",
+		}),
+	}
+}
+
+// RetryConfig retries round trips throttled by a downstream throttle-proxy or upstream, answered
+// with 429 or 503, once the Retry-After they ask for passes. Retries draw from a budget refilled
+// by every request, so a struggling downstream is not hit by a retry storm. Only the RoundTripper
+// entry point retries, served requests pass through.
+type RetryConfig struct {
+	EnableRetry bool `yaml:"enable_retry"`
+	// RetryMaxAttempts is the most times a request is sent, including the first. Defaults to 3.
+	RetryMaxAttempts int `yaml:"retry_max_attempts"`
+	// RetryBudgetRatio is the retries each request adds to the budget, e.g. 0.1 allows one retry
+	// per ten requests. RetryBudgetMax caps the saved retries to bound bursts. Default to 0.1
+	// and 10.
+	RetryBudgetRatio float64 `yaml:"retry_budget_ratio"`
+	RetryBudgetMax   float64 `yaml:"retry_budget_max"`
+	// RetryBackoff is the first wait when a response has no Retry-After, doubled every attempt
+	// with full jitter. Defaults to 100ms.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// RetryMaxWait is the longest wait before a retry. Responses asking for longer are returned to
+	// the client. Defaults to 10s.
+	RetryMaxWait time.Duration `yaml:"retry_max_wait"`
+}
+
+func (c RetryConfig) Validate() error {
+	if !c.EnableRetry {
+		return nil
+	}
+
+	if c.RetryMaxAttempts < 0 {
+		return ErrRetryMaxAttempts
+	}
+	if c.RetryBudgetRatio < 0 || c.RetryBudgetMax < 0 {
+		return ErrRetryBudget
+	}
+	if c.RetryBackoff < 0 || c.RetryMaxWait < 0 {
+		return ErrNegativeRetryPeriod
+	}
+	return nil
+}
+
+func (c RetryConfig) maxAttempts() int {
+	if c.RetryMaxAttempts == 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return c.RetryMaxAttempts
+}
+
+func (c RetryConfig) budgetRatio() float64 {
+	if c.RetryBudgetRatio == 0 {
+		return DefaultRetryBudgetRatio
+	}
+	return c.RetryBudgetRatio
+}
+
+func (c RetryConfig) budgetMax() float64 {
+	if c.RetryBudgetMax == 0 {
+		return DefaultRetryBudgetMax
+	}
+	return c.RetryBudgetMax
+}
+
+func (c RetryConfig) backoff() time.Duration {
+	if c.RetryBackoff == 0 {
+		return DefaultRetryBackoff
+	}
+	return c.RetryBackoff
+}
+
+func (c RetryConfig) maxWait() time.Duration {
+	if c.RetryMaxWait == 0 {
+		return DefaultRetryMaxWait
+	}
+	return c.RetryMaxWait
+}
+
+// retryBudget is a token bucket every request deposits a fraction of a retry into
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	max    float64
+	gauge  prometheus.Gauge
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.max)
+	b.gauge.Set(b.tokens)
+}
+
+// withdraw takes a retry from the budget, false when it has none left
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	b.gauge.Set(b.tokens)
+	return true
+}
+
+// Retrier resends round trips throttled downstream after the wait they ask for, within a budget,
+// so clients cooperate with the throttle-proxies in front of their backends
+type Retrier struct {
+	client      ProxyClient
+	maxAttempts int
+	backoff     time.Duration
+	maxWait     time.Duration
+	budget      *retryBudget
+	// clock and rand default to the system sources when nil
+	clock     Clock
+	rand      Rand
+	throttled *prometheus.CounterVec
+	retries   *prometheus.CounterVec
+}
+
+var _ ProxyClient = &Retrier{}
+
+// NewRetrier creates a Retrier from a validated config
+func NewRetrier(client ProxyClient, cfg RetryConfig) *Retrier {
+	return newRetrier(client, cfg, defaultRetryMetrics)
+}
+
+func newRetrier(client ProxyClient, cfg RetryConfig, m *retryMetrics) *Retrier {
+	return &Retrier{
+		client:      client,
+		maxAttempts: cfg.maxAttempts(),
+		backoff:     cfg.backoff(),
+		maxWait:     cfg.maxWait(),
+		budget: &retryBudget{
+			tokens: cfg.budgetMax(),
+			ratio:  cfg.budgetRatio(),
+			max:    cfg.budgetMax(),
+			gauge:  m.tokens,
+		},
+		throttled: m.throttled,
+		retries:   m.retries,
+	}
+}
+
+func (r *Retrier) Init(ctx context.Context) error {
+	return r.client.Init(ctx)
+}
+
+func (r *Retrier) Next(rr Request) error {
+	if rrw, ok := rr.(ResponseWriter); ok && rrw.ResponseWriter() != nil {
+		return r.client.Next(rr)
+	}
+	rres, ok := rr.(Response)
+	if !ok {
+		return r.client.Next(rr)
+	}
+
+	r.budget.deposit()
+	for attempt := 1; ; attempt++ {
+		// every attempt reads its own copy of the buffered body
+		req, err := DupRequest(rr.Request())
+		if err != nil {
+			return err
+		}
+		sent := &RequestResponseWrapper{req: req}
+		if err := r.client.Next(sent); err != nil {
+			return err
+		}
+
+		res := sent.Response()
+		wait, retry := r.retryAfter(res, attempt)
+		if !retry {
+			rres.SetResponse(res)
+			return nil
+		}
+
+		drain(res)
+		if err := r.sleep(rr, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// retryAfter decides whether the response of the attempt is retried and how long to wait first
+func (r *Retrier) retryAfter(res *http.Response, attempt int) (time.Duration, bool) {
+	if res == nil ||
+		(res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	r.throttled.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+
+	wait, ok := parseRetryAfter(res.Header.Get(string(HeaderRetryAfter)), orSystemClock(r.clock).Now())
+	if !ok {
+		backoff := float64(r.backoff) * math.Pow(2, float64(attempt-1))
+		wait = time.Duration(orSystemRand(r.rand).Float64() * backoff)
+	}
+
+	switch {
+	case attempt >= r.maxAttempts:
+		r.retries.WithLabelValues(retryOutcomeAttemptsExhausted).Inc()
+	case wait > r.maxWait:
+		r.retries.WithLabelValues(retryOutcomeWaitExceeded).Inc()
+	case !r.budget.withdraw():
+		r.retries.WithLabelValues(retryOutcomeBudgetExhausted).Inc()
+	default:
+		r.retries.WithLabelValues(retryOutcomeRetried).Inc()
+		return wait, true
+	}
+	return 0, false
+}
+
+// sleep waits before the next attempt unless the client gives up first
+func (r *Retrier) sleep(rr Request, wait time.Duration) error {
+	if wait <= 0 {
+		return nil
+	}
+
+	defer enterStage(rr, RetryProxyType, "waiting to retry")()
+	timer := orSystemClock(r.clock).NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-rr.Request().Context().Done():
+		return rr.Request().Context().Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// parseRetryAfter reads a Retry-After of delay seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// drain reads the rest of a discarded response so its connection is reused
+func drain(res *http.Response) {
+	if res.Body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	_ = res.Body.Close()
+}
@@ -0,0 +1,186 @@
+package proxymw
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  RetryConfig
+		err  error
+	}{
+		{name: "disabled", cfg: RetryConfig{RetryMaxAttempts: -1}},
+		{name: "defaults", cfg: RetryConfig{EnableRetry: true}},
+		{
+			name: "negative attempts",
+			cfg:  RetryConfig{EnableRetry: true, RetryMaxAttempts: -1},
+			err:  ErrRetryMaxAttempts,
+		},
+		{
+			name: "negative budget",
+			cfg:  RetryConfig{EnableRetry: true, RetryBudgetRatio: -0.1},
+			err:  ErrRetryBudget,
+		},
+		{
+			name: "negative wait",
+			cfg:  RetryConfig{EnableRetry: true, RetryMaxWait: -1},
+			err:  ErrNegativeRetryPeriod,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.err)
+		})
+	}
+}
+
+func throttledResponse(status int, retryAfter string) *http.Response {
+	res := &http.Response{StatusCode: status, Header: http.Header{}, Body: http.NoBody}
+	if retryAfter != "" {
+		res.Header.Set(string(HeaderRetryAfter), retryAfter)
+	}
+	return res
+}
+
+func TestRetrier(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name      string
+		cfg       RetryConfig
+		responses []*http.Response
+		status    int
+		attempts  int
+		outcome   string
+	}{
+		{
+			name: "retried after retry-after",
+			responses: []*http.Response{
+				throttledResponse(http.StatusTooManyRequests, "0"),
+				throttledResponse(http.StatusOK, ""),
+			},
+			status:   http.StatusOK,
+			attempts: 2,
+			outcome:  retryOutcomeRetried,
+		},
+		{
+			name: "attempts exhausted",
+			responses: []*http.Response{
+				throttledResponse(http.StatusServiceUnavailable, ""),
+				throttledResponse(http.StatusServiceUnavailable, ""),
+				throttledResponse(http.StatusServiceUnavailable, ""),
+			},
+			status:   http.StatusServiceUnavailable,
+			attempts: DefaultRetryMaxAttempts,
+			outcome:  retryOutcomeAttemptsExhausted,
+		},
+		{
+			name:      "wait exceeded",
+			responses: []*http.Response{throttledResponse(http.StatusTooManyRequests, "60")},
+			status:    http.StatusTooManyRequests,
+			attempts:  1,
+			outcome:   retryOutcomeWaitExceeded,
+		},
+		{
+			name:      "budget exhausted",
+			cfg:       RetryConfig{RetryBudgetMax: 0.5},
+			responses: []*http.Response{throttledResponse(http.StatusTooManyRequests, "0")},
+			status:    http.StatusTooManyRequests,
+			attempts:  1,
+			outcome:   retryOutcomeBudgetExhausted,
+		},
+		{
+			name:      "not throttled",
+			responses: []*http.Response{throttledResponse(http.StatusInternalServerError, "0")},
+			status:    http.StatusInternalServerError,
+			attempts:  1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			m := newRetryMetrics(promauto.With(prometheus.NewRegistry()))
+			attempts := 0
+			next := &Mocker{NextFunc: func(rr Request) error {
+				body, err := io.ReadAll(rr.Request().Body)
+				require.NoError(t, err)
+				require.Equal(t, "query=up", string(body), "every attempt resends the body")
+				rr.(Response).SetResponse(tt.responses[attempts])
+				attempts++
+				return nil
+			}}
+			r := newRetrier(next, tt.cfg, m)
+			r.rand = fixedRand(0)
+
+			req := httptest.NewRequest(http.MethodPost, QueryPath, strings.NewReader("query=up"))
+			rr := &RequestResponseWrapper{req: req}
+			require.NoError(t, r.Next(rr))
+			require.Equal(t, tt.status, rr.Response().StatusCode)
+			require.Equal(t, tt.attempts, attempts)
+			if tt.outcome != "" {
+				require.InDelta(t, 1, testutil.ToFloat64(m.retries.WithLabelValues(tt.outcome)), 0)
+			}
+		})
+	}
+}
+
+func TestRetrierBudget(t *testing.T) {
+	t.Parallel()
+	b := &retryBudget{tokens: 1, ratio: 0.5, max: 2, gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "tokens"})}
+	require.True(t, b.withdraw())
+	require.False(t, b.withdraw())
+	b.deposit()
+	b.deposit()
+	require.True(t, b.withdraw(), "two requests at ratio 0.5 earn a retry")
+	for range 10 {
+		b.deposit()
+	}
+	require.InDelta(t, 2, testutil.ToFloat64(b.gauge), 0, "saved retries are capped")
+}
+
+func TestRetrierServePassthrough(t *testing.T) {
+	t.Parallel()
+	attempts := 0
+	next := &Mocker{NextFunc: func(rr Request) error {
+		attempts++
+		rr.(ResponseWriter).ResponseWriter().WriteHeader(http.StatusTooManyRequests)
+		return nil
+	}}
+	r := NewRetrier(next, RetryConfig{EnableRetry: true})
+	w := httptest.NewRecorder()
+	rr := &RequestResponseWrapper{w: w, req: httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody)}
+	require.NoError(t, r.Next(rr))
+	require.Equal(t, 1, attempts)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "2", wait: 2 * time.Second, ok: true},
+		{value: now.Add(30 * time.Second).Format(http.TimeFormat), wait: 30 * time.Second, ok: true},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), wait: 0, ok: true},
+		{value: "-1", ok: false},
+		{value: "soon", ok: false},
+	} {
+		wait, ok := parseRetryAfter(tt.value, now)
+		require.Equal(t, tt.ok, ok, tt.value)
+		require.Equal(t, tt.wait, wait, tt.value)
+	}
+}
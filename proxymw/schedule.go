@@ -0,0 +1,242 @@
+package proxymw
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidScheduleDay        = errors.New("schedule days must be mon, tue, wed, thu, fri, sat, or sun")
+	ErrInvalidScheduleTime       = errors.New("schedule start and end must be HH:MM")
+	ErrScheduleUnknownQuery      = errors.New("schedule thresholds must name a backpressure query")
+	ErrScheduleDynamicQuery      = errors.New("schedule thresholds cannot override threshold or anomaly queries")
+	ErrScheduleWindowBelowOne    = errors.New("schedule min window < 1")
+	ErrScheduleWindowMaxBelowMin = errors.New("schedule max window < min window")
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ThresholdSchedule swaps in different window bounds and query thresholds during a recurring
+// time of day, e.g. a tighter window during business hours and a relaxed one during nightly
+// batch processing. The first schedule in config order matching the current time applies.
+type ThresholdSchedule struct {
+	Name string `yaml:"name"`
+	// Days are the days of the week the schedule starts on, e.g. [mon, tue, wed, thu, fri].
+	// Every day when empty.
+	Days []string `yaml:"days"`
+	// Start and End are the HH:MM time of day the schedule applies between. An end before the
+	// start runs past midnight into the next day. The whole day when both are empty.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Timezone is the IANA location the days and times are in. Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+	// CongestionWindowMin and CongestionWindowMax replace the window bounds when set
+	CongestionWindowMin int `yaml:"congestion_window_min"`
+	CongestionWindowMax int `yaml:"congestion_window_max"`
+	// Thresholds replace the static thresholds of the named backpressure queries
+	Thresholds map[string]ScheduledThresholds `yaml:"thresholds"`
+}
+
+// ScheduledThresholds are the thresholds of a backpressure query while a schedule applies
+type ScheduledThresholds struct {
+	WarningThreshold   float64 `yaml:"warning_threshold"`
+	EmergencyThreshold float64 `yaml:"emergency_threshold"`
+}
+
+func (s ThresholdSchedule) Validate(cfg BackpressureConfig) error {
+	if _, err := s.compile(); err != nil {
+		return err
+	}
+
+	minWindow, maxWindow := s.window(cfg.CongestionWindowMin, cfg.CongestionWindowMax)
+	if minWindow < 1 {
+		return ErrScheduleWindowBelowOne
+	}
+	if maxWindow < minWindow {
+		return ErrScheduleWindowMaxBelowMin
+	}
+	if cfg.CriticalPlusReserve >= minWindow {
+		return ErrCriticalPlusReserveRange
+	}
+
+	for name, t := range s.Thresholds {
+		i := slices.IndexFunc(cfg.BackpressureQueries, func(q BackpressureQuery) bool {
+			return q.Name == name
+		})
+		if name == "" || i < 0 {
+			return fmt.Errorf("%w: %q", ErrScheduleUnknownQuery, name)
+		}
+
+		q := cfg.BackpressureQueries[i]
+		if q.WarningThresholdQuery != "" || q.EmergencyThresholdQuery != "" || q.AnomalyWindow != 0 {
+			return fmt.Errorf("%w: %q", ErrScheduleDynamicQuery, name)
+		}
+		if err := t.apply(q).validateThresholds(); err != nil {
+			return fmt.Errorf("thresholds of %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// window returns the window bounds while the schedule applies
+func (s ThresholdSchedule) window(minWindow, maxWindow int) (int, int) {
+	if s.CongestionWindowMin != 0 {
+		minWindow = s.CongestionWindowMin
+	}
+	if s.CongestionWindowMax != 0 {
+		maxWindow = s.CongestionWindowMax
+	}
+	return minWindow, maxWindow
+}
+
+func (t ScheduledThresholds) apply(q BackpressureQuery) BackpressureQuery {
+	q.WarningThreshold, q.EmergencyThreshold = t.WarningThreshold, t.EmergencyThreshold
+	return q
+}
+
+// schedule is a ThresholdSchedule with its days, times, and location parsed
+type schedule struct {
+	ThresholdSchedule
+	days       []time.Weekday
+	start, end time.Duration
+	location   *time.Location
+}
+
+func (s ThresholdSchedule) compile() (schedule, error) {
+	compiled := schedule{ThresholdSchedule: s, location: time.UTC}
+	for _, day := range s.Days {
+		weekday, ok := scheduleDays[strings.ToLower(day)]
+		if !ok {
+			return compiled, fmt.Errorf("%w: %q", ErrInvalidScheduleDay, day)
+		}
+		compiled.days = append(compiled.days, weekday)
+	}
+
+	var err error
+	if compiled.start, err = parseTimeOfDay(s.Start); err != nil {
+		return compiled, err
+	}
+	if compiled.end, err = parseTimeOfDay(s.End); err != nil {
+		return compiled, err
+	}
+
+	if s.Timezone != "" {
+		if compiled.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return compiled, fmt.Errorf("schedule timezone: %w", err)
+		}
+	}
+	return compiled, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidScheduleTime, value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether the schedule applies at now. Schedules running past midnight apply
+// after midnight when they started the day before.
+func (s schedule) active(now time.Time) bool {
+	now = now.In(s.location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.location)
+	offset := now.Sub(midnight)
+
+	if s.start == s.end {
+		return s.startsOn(now.Weekday())
+	}
+	if s.start < s.end {
+		return s.startsOn(now.Weekday()) && offset >= s.start && offset < s.end
+	}
+
+	yesterday := (now.Weekday() + 6) % 7
+	return (s.startsOn(now.Weekday()) && offset >= s.start) ||
+		(s.startsOn(yesterday) && offset < s.end)
+}
+
+func (s schedule) startsOn(day time.Weekday) bool {
+	return len(s.days) == 0 || slices.Contains(s.days, day)
+}
+
+func compileSchedules(schedules []ThresholdSchedule) []schedule {
+	compiled := make([]schedule, 0, len(schedules))
+	for _, s := range schedules {
+		// schedules are validated with the config
+		if c, err := s.compile(); err == nil {
+			compiled = append(compiled, c)
+		}
+	}
+	return compiled
+}
+
+// applySchedule swaps in the window bounds and thresholds of the first schedule active at now,
+// restoring the configured ones when none is
+func (bp *Backpressure) applySchedule(now time.Time) {
+	if len(bp.schedules) == 0 {
+		return
+	}
+
+	current := -1
+	for i, s := range bp.schedules {
+		if s.active(now) {
+			current = i
+			break
+		}
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if current == bp.activeSchedule {
+		return
+	}
+	bp.activeSchedule = current
+
+	bp.min, bp.max = bp.configuredMin, bp.configuredMax
+	bp.scheduled = nil
+	if current >= 0 {
+		s := bp.schedules[current]
+		bp.min, bp.max = s.window(bp.min, bp.max)
+		bp.scheduled = s.Thresholds
+		log.Printf("applying backpressure schedule %q", s.Name)
+	} else {
+		log.Println("backpressure schedule ended, applying the configured window and thresholds")
+	}
+
+	bp.minGauge.Set(float64(bp.min))
+	bp.maxGauge.Set(float64(bp.max))
+	for _, q := range bp.queries {
+		if q.Name != "" && q.WarningThresholdQuery == "" && q.EmergencyThresholdQuery == "" &&
+			q.AnomalyWindow == 0 {
+			q = bp.scheduledThresholds(q)
+			bp.warnGauge.WithLabelValues(q.Name).Set(q.WarningThreshold)
+			bp.emergencyGauge.WithLabelValues(q.Name).Set(q.EmergencyThreshold)
+		}
+	}
+	bp.constrainWatermark()
+}
+
+// scheduledThresholds returns a copy of the query with the thresholds of the active schedule.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) scheduledThresholds(q BackpressureQuery) BackpressureQuery {
+	if t, ok := bp.scheduled[q.Name]; ok && q.Name != "" {
+		return t.apply(q)
+	}
+	return q
+}
@@ -0,0 +1,195 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func scheduleTestConfig(schedules ...ThresholdSchedule) BackpressureConfig {
+	return BackpressureConfig{
+		EnableBackpressure:        true,
+		BackpressureMonitoringURL: "http://prometheus",
+		BackpressureQueries: []BackpressureQuery{
+			{Name: "load", Query: "load", WarningThreshold: 80, EmergencyThreshold: 100},
+			{
+				Name:                  "latency",
+				Query:                 "latency",
+				WarningThresholdQuery: "slo * 0.5",
+				EmergencyThreshold:    1,
+			},
+		},
+		CongestionWindowMin: 10,
+		CongestionWindowMax: 100,
+		Schedules:           schedules,
+	}
+}
+
+func TestThresholdScheduleValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name     string
+		schedule ThresholdSchedule
+		want     error
+	}{
+		{
+			name: "business hours",
+			schedule: ThresholdSchedule{
+				Days:                []string{"Mon", "tue", "wed", "thu", "fri"},
+				Start:               "09:00",
+				End:                 "17:00",
+				Timezone:            "America/New_York",
+				CongestionWindowMax: 50,
+				Thresholds:          map[string]ScheduledThresholds{"load": {60, 90}},
+			},
+		},
+		{
+			name:     "unknown day",
+			schedule: ThresholdSchedule{Days: []string{"monday"}},
+			want:     ErrInvalidScheduleDay,
+		},
+		{
+			name:     "invalid time",
+			schedule: ThresholdSchedule{Start: "25:00", End: "01:00"},
+			want:     ErrInvalidScheduleTime,
+		},
+		{
+			name:     "max below the configured min",
+			schedule: ThresholdSchedule{CongestionWindowMax: 5},
+			want:     ErrScheduleWindowMaxBelowMin,
+		},
+		{
+			name:     "negative min",
+			schedule: ThresholdSchedule{CongestionWindowMin: -1},
+			want:     ErrScheduleWindowBelowOne,
+		},
+		{
+			name: "unknown query",
+			schedule: ThresholdSchedule{
+				Thresholds: map[string]ScheduledThresholds{"errors": {1, 2}},
+			},
+			want: ErrScheduleUnknownQuery,
+		},
+		{
+			name: "dynamic thresholds",
+			schedule: ThresholdSchedule{
+				Thresholds: map[string]ScheduledThresholds{"latency": {1, 2}},
+			},
+			want: ErrScheduleDynamicQuery,
+		},
+		{
+			name: "emergency below warning",
+			schedule: ThresholdSchedule{
+				Thresholds: map[string]ScheduledThresholds{"load": {90, 60}},
+			},
+			want: ErrEmergencyBelowWarnThreshold,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, scheduleTestConfig(tt.schedule).Validate(), tt.want)
+		})
+	}
+
+	require.Error(t, scheduleTestConfig(ThresholdSchedule{Timezone: "Mars/Olympus"}).Validate())
+}
+
+func TestScheduleActive(t *testing.T) {
+	t.Parallel()
+	weekdays, err := ThresholdSchedule{
+		Days:  []string{"mon", "tue", "wed", "thu", "fri"},
+		Start: "09:00",
+		End:   "17:00",
+	}.compile()
+	require.NoError(t, err)
+
+	nightly, err := ThresholdSchedule{Days: []string{"fri"}, Start: "22:00", End: "04:00"}.compile()
+	require.NoError(t, err)
+
+	allDay, err := ThresholdSchedule{Days: []string{"sun"}}.compile()
+	require.NoError(t, err)
+
+	// 2024-01-05 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		name     string
+		schedule schedule
+		now      time.Time
+		active   bool
+	}{
+		{name: "within business hours", schedule: weekdays, now: at(5, 9, 0), active: true},
+		{name: "end is exclusive", schedule: weekdays, now: at(5, 17, 0)},
+		{name: "weekend", schedule: weekdays, now: at(6, 12, 0)},
+		{name: "before midnight", schedule: nightly, now: at(5, 23, 0), active: true},
+		{name: "after midnight", schedule: nightly, now: at(6, 3, 59), active: true},
+		{name: "after the end", schedule: nightly, now: at(6, 4, 0)},
+		{name: "started the wrong day", schedule: nightly, now: at(5, 3, 0)},
+		{name: "whole day", schedule: allDay, now: at(7, 23, 59), active: true},
+		{name: "other days", schedule: allDay, now: at(8, 0, 0)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.active, tt.schedule.active(tt.now))
+		})
+	}
+
+	// days and times are in the timezone of the schedule
+	tokyo, err := ThresholdSchedule{Days: []string{"sat"}, Timezone: "Asia/Tokyo"}.compile()
+	require.NoError(t, err)
+	require.True(t, tokyo.active(at(5, 16, 0)))
+}
+
+func TestApplySchedule(t *testing.T) {
+	t.Parallel()
+	cfg := scheduleTestConfig(ThresholdSchedule{
+		Name:                "batch",
+		Start:               "01:00",
+		End:                 "05:00",
+		CongestionWindowMin: 20,
+		CongestionWindowMax: 200,
+		Thresholds:          map[string]ScheduledThresholds{"load": {90, 120}},
+	})
+	cfg.BackpressureQueries = cfg.BackpressureQueries[:1]
+	m := newBackpressureMetrics(promauto.With(prometheus.NewRegistry()))
+	bp := newBackpressure(&Mocker{}, cfg, m)
+
+	load := 95.0
+	fetch := func(context.Context, *http.Client, string, string) (float64, error) {
+		return load, nil
+	}
+	s := &signal{query: cfg.BackpressureQueries[0], fetch: fetch, smoothed: &ewma{}}
+	day := time.Date(2024, time.January, 5, 0, 0, 0, 0, time.UTC)
+
+	bp.applySchedule(day.Add(2 * time.Hour))
+	state := bp.State()
+	require.Equal(t, 20, state.Min)
+	require.Equal(t, 200, state.Max)
+	require.Equal(t, 20, state.Watermark)
+	require.InDelta(t, 90, testutil.ToFloat64(m.warnGauge.WithLabelValues("load")), 0)
+
+	bp.poll(context.Background(), s)
+	require.Greater(t, bp.Allowance(), 0.0)
+	require.Less(t, bp.Allowance(), 1.0, "throttles past the scheduled warning threshold")
+
+	load = 85
+	bp.poll(context.Background(), s)
+	require.Equal(t, 1.0, bp.Allowance())
+
+	// the configured window and thresholds return once the schedule ends
+	bp.applySchedule(day.Add(6 * time.Hour))
+	state = bp.State()
+	require.Equal(t, 10, state.Min)
+	require.Equal(t, 100, state.Max)
+	require.InDelta(t, 80, testutil.ToFloat64(m.warnGauge.WithLabelValues("load")), 0)
+
+	bp.poll(context.Background(), s)
+	require.Less(t, bp.Allowance(), 1.0)
+}
@@ -0,0 +1,108 @@
+package proxymw
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderServerTiming breaks down where the proxy spent the latency of a response
+	HeaderServerTiming = "Server-Timing"
+
+	serverTimingUpstream = "upstream"
+)
+
+type serverTimingKey struct{}
+
+type serverTiming struct {
+	name string
+	dur  time.Duration
+}
+
+// serverTimings collects the time a request spent waiting in each middleware
+type serverTimings struct {
+	mu      sync.Mutex
+	entries []serverTiming
+	// upstreamStart is when the first upstream request was sent, and upstream how long the
+	// upstream took once it answered
+	upstreamStart time.Time
+	upstream      time.Duration
+}
+
+func withServerTimings(ctx context.Context) (context.Context, *serverTimings) {
+	t := &serverTimings{}
+	return context.WithValue(ctx, serverTimingKey{}, t), t
+}
+
+func serverTimingsFrom(rr Request) *serverTimings {
+	t, _ := rr.Request().Context().Value(serverTimingKey{}).(*serverTimings)
+	return t
+}
+
+// addServerTiming adds the wait to the Server-Timing header of the response when enabled
+func addServerTiming(rr Request, name string, d time.Duration) {
+	if t := serverTimingsFrom(rr); t != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for i := range t.entries {
+			if t.entries[i].name == name {
+				t.entries[i].dur += d
+				return
+			}
+		}
+		t.entries = append(t.entries, serverTiming{name: name, dur: d})
+	}
+}
+
+// startUpstream marks the upstream request as sent, returning a function marking its response
+func startUpstream(rr Request) func() {
+	t := serverTimingsFrom(rr)
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	t.mu.Lock()
+	if t.upstreamStart.IsZero() {
+		t.upstreamStart = start
+	}
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.upstream = max(t.upstream, time.Since(t.upstreamStart))
+	}
+}
+
+// header formats the timings in milliseconds, e.g. "jitter;dur=12.5, upstream;dur=250.3". An
+// upstream still writing its response is timed until now.
+func (t *serverTimings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := t.entries
+	upstream := t.upstream
+	if upstream == 0 && !t.upstreamStart.IsZero() {
+		upstream = time.Since(t.upstreamStart)
+	}
+	if !t.upstreamStart.IsZero() {
+		entries = append(entries[:len(entries):len(entries)], serverTiming{name: serverTimingUpstream, dur: upstream})
+	}
+
+	metrics := make([]string, 0, len(entries))
+	for _, e := range entries {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f", e.name, float64(e.dur.Microseconds())/1000))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// add appends the timings to the Server-Timing header, keeping those of the upstream
+func (t *serverTimings) add(header http.Header) {
+	if value := t.header(); value != "" {
+		header.Add(HeaderServerTiming, value)
+	}
+}
@@ -0,0 +1,101 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTimingsHeader(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody)
+	ctx, timings := withServerTimings(req.Context())
+	rr := &RequestResponseWrapper{req: req.WithContext(ctx)}
+	require.Empty(t, timings.header())
+
+	addServerTiming(rr, JitterProxyType, 12*time.Millisecond+340*time.Microsecond)
+	addServerTiming(rr, BackpressureProxyType, 50*time.Microsecond)
+	addServerTiming(rr, JitterProxyType, time.Millisecond)
+	require.Equal(t, "jitter;dur=13.3, backpressure;dur=0.1", timings.header())
+
+	answered := startUpstream(rr)
+	require.Contains(t, timings.header(), ", upstream;dur=", "a pending upstream is timed until now")
+	answered()
+
+	header := http.Header{HeaderServerTiming: {"db;dur=4"}}
+	timings.add(header)
+	require.Len(t, header.Values(HeaderServerTiming), 2, "upstream timings are kept")
+
+	// requests without server timing enabled are left alone
+	untimed := &RequestResponseWrapper{req: req}
+	addServerTiming(untimed, JitterProxyType, time.Second)
+	startUpstream(untimed)()
+}
+
+func TestServerTimingServe(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		EnableServerTiming: true,
+		EnableJitter:       true,
+		JitterDelay:        10 * time.Millisecond,
+		Rand:               fixedRand(0.5),
+	}
+	entry := NewServeFromConfig(cfg, func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, entry.Init(t.Context()))
+
+	w := httptest.NewRecorder()
+	entry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Regexp(
+		t, regexp.MustCompile(`^jitter;dur=\d+\.\d, upstream;dur=\d+\.\d$`), w.Header().Get(HeaderServerTiming),
+	)
+
+	untimed := NewServeFromConfig(Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	require.NoError(t, untimed.Init(t.Context()))
+	w = httptest.NewRecorder()
+	untimed.ServeHTTP(w, httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody))
+	require.Empty(t, w.Header().Values(HeaderServerTiming))
+}
+
+func TestServerTimingRejection(t *testing.T) {
+	t.Parallel()
+	client := &Mocker{
+		InitFunc: func(_ context.Context) error { return nil },
+		NextFunc: func(rr Request) error {
+			addServerTiming(rr, JitterProxyType, 5*time.Millisecond)
+			return BlockErr(RateLimitProxyType, "over the limit")
+		},
+	}
+	entry := newServeEntry(Config{EnableServerTiming: true}, client, &ServeExit{})
+	require.NoError(t, entry.Init(t.Context()))
+
+	w := httptest.NewRecorder()
+	entry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "jitter;dur=5.0", w.Header().Get(HeaderServerTiming))
+}
+
+func TestServerTimingRoundTrip(t *testing.T) {
+	t.Parallel()
+	rt := &Mocker{
+		RoundTripFunc: func(_ *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, nil
+		},
+	}
+	entry := NewRoundTripperFromConfig(Config{EnableServerTiming: true}, rt)
+	require.NoError(t, entry.Init(t.Context()))
+
+	res, err := entry.RoundTrip(httptest.NewRequest(http.MethodGet, QueryPath, http.NoBody))
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`^upstream;dur=\d+\.\d$`), res.Header.Get(HeaderServerTiming))
+}
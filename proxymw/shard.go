@@ -0,0 +1,402 @@
+package proxymw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	ShardProxyType = "shard"
+
+	DefaultShardInterval    = 24 * time.Hour
+	DefaultShardConcurrency = 4
+)
+
+var ErrNegativeShard = errors.New("shard interval and concurrency cannot be negative")
+
+// ShardConfig splits long range queries into shorter sub-range queries so a query over weeks of
+// data doesn't hold one upstream querier for minutes
+type ShardConfig struct {
+	EnableSharding bool `yaml:"enable_sharding"`
+	// ShardInterval is the longest range of each sub-range query, rounded down to a whole number
+	// of query steps. Queries with a shorter range are not split. Defaults to 24h.
+	ShardInterval time.Duration `yaml:"shard_interval"`
+	// ShardConcurrency caps the sub-range queries of one request in flight at once. Defaults to 4.
+	ShardConcurrency int `yaml:"shard_concurrency"`
+}
+
+func (c ShardConfig) Validate() error {
+	if !c.EnableSharding {
+		return nil
+	}
+
+	if c.ShardInterval < 0 || c.ShardConcurrency < 0 {
+		return ErrNegativeShard
+	}
+	return nil
+}
+
+func (c ShardConfig) interval() time.Duration {
+	if c.ShardInterval == 0 {
+		return DefaultShardInterval
+	}
+	return c.ShardInterval
+}
+
+func (c ShardConfig) concurrency() int {
+	if c.ShardConcurrency == 0 {
+		return DefaultShardConcurrency
+	}
+	return c.ShardConcurrency
+}
+
+// Sharder sends range queries spanning more than the shard interval as consecutive sub-range
+// queries through the rest of the chain and merges their matrices into one response. Shards
+// cover disjoint evaluation timestamps of the original query so the merged series equal the
+// unsplit result. The first failed shard response is returned as is.
+type Sharder struct {
+	client      ProxyClient
+	interval    time.Duration
+	concurrency int
+}
+
+var _ ProxyClient = &Sharder{}
+
+func NewSharder(client ProxyClient, cfg ShardConfig) *Sharder {
+	return &Sharder{
+		client:      client,
+		interval:    cfg.interval(),
+		concurrency: cfg.concurrency(),
+	}
+}
+
+func (s *Sharder) Init(ctx context.Context) error {
+	return s.client.Init(ctx)
+}
+
+func (s *Sharder) Next(rr Request) error {
+	req := rr.Request()
+	if req.URL == nil || req.URL.Path != QueryRangePath {
+		return s.client.Next(rr)
+	}
+
+	form, err := parsedForm(req)
+	if err != nil {
+		return s.client.Next(rr)
+	}
+
+	shards := s.split(form)
+	if len(shards) <= 1 {
+		return s.client.Next(rr)
+	}
+
+	results, err := s.run(rr, form, shards)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.status != http.StatusOK {
+			return writeShardResult(rr, result)
+		}
+	}
+
+	merged, err := mergeShards(results)
+	if err != nil {
+		return fmt.Errorf("merging shard responses: %w", err)
+	}
+	return writeShardResult(rr, merged)
+}
+
+// shard is the evaluation range of one sub-range query
+type shard struct {
+	start, end time.Time
+}
+
+// split divides the range of the query into shards holding a whole number of steps, or returns
+// nil when the time parameters cannot be parsed
+func (s *Sharder) split(form url.Values) []shard {
+	start, err := parseTime(form.Get("start"))
+	if err != nil {
+		return nil
+	}
+	end, err := parseTime(form.Get("end"))
+	if err != nil {
+		return nil
+	}
+	step, err := parseDuration(form.Get("step"))
+	if err != nil || step <= 0 || end.Before(start) {
+		return nil
+	}
+
+	width := max(s.interval/step, 1) * step
+	var shards []shard
+	for from := start; !from.After(end); from = from.Add(width) {
+		shards = append(shards, shard{start: from, end: minTime(from.Add(width-step), end)})
+	}
+	return shards
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// shardResult is the buffered response of one sub-range query
+type shardResult struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// run sends the shards through the rest of the chain, at most concurrency at a time. The first
+// error cancels the remaining shards.
+func (s *Sharder) run(rr Request, form url.Values, shards []shard) ([]shardResult, error) {
+	ctx, cancel := context.WithCancel(rr.Request().Context())
+	defer cancel()
+	defer enterStage(rr, ShardProxyType, fmt.Sprintf("waiting on %d sub-range queries", len(shards)))()
+
+	results := make([]shardResult, len(shards))
+	errs := make([]error, len(shards))
+	sem := make(chan struct{}, s.concurrency)
+	var wg sync.WaitGroup
+	for i, sh := range shards {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if results[i], errs[i] = s.next(ctx, rr, form, sh); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+// next sends one shard through the rest of the chain and buffers its response
+func (s *Sharder) next(ctx context.Context, rr Request, form url.Values, sh shard) (shardResult, error) {
+	if err := ctx.Err(); err != nil {
+		return shardResult{}, err
+	}
+
+	req := shardRequest(ctx, rr.Request(), form, sh)
+	sub := &RequestResponseWrapper{req: req}
+	var w *shardWriter
+	if rrw, ok := rr.(ResponseWriter); ok && rrw.ResponseWriter() != nil {
+		w = &shardWriter{header: http.Header{}, status: http.StatusOK}
+		sub.w = w
+	}
+
+	if err := s.client.Next(sub); err != nil {
+		return shardResult{}, err
+	}
+
+	if res := sub.Response(); res != nil {
+		defer res.Body.Close() //nolint:errcheck // read to completion
+		body, err := io.ReadAll(res.Body)
+		return shardResult{status: res.StatusCode, header: res.Header, body: body}, err
+	}
+
+	if w == nil {
+		return shardResult{}, ErrNilResponse
+	}
+	return shardResult{status: w.status, header: w.header, body: w.body.Bytes()}, nil
+}
+
+// shardRequest copies the request with the range of the shard. Parameters of form encoded POST
+// requests are all sent in the body, otherwise in the URL.
+func shardRequest(ctx context.Context, req *http.Request, form url.Values, sh shard) *http.Request {
+	values := url.Values{}
+	for name, vs := range form {
+		values[name] = vs
+	}
+	values.Set("start", formatTime(sh.start))
+	values.Set("end", formatTime(sh.end))
+	encoded := values.Encode()
+
+	// each shard parses its own form rather than the cached form of the original request
+	sub := req.Clone(withFormCache(ctx))
+	// merging needs the uncompressed response and the transport decompresses what it negotiates
+	sub.Header.Del("Accept-Encoding")
+	if req.Method == http.MethodPost && isFormEncoded(req) {
+		sub.URL.RawQuery = ""
+		sub.Body = io.NopCloser(strings.NewReader(encoded))
+		sub.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(encoded)), nil
+		}
+		sub.ContentLength = int64(len(encoded))
+		sub.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+	} else {
+		sub.URL.RawQuery = encoded
+		sub.Body = http.NoBody
+		sub.ContentLength = 0
+		sub.Header.Del("Content-Length")
+	}
+	sub.Form, sub.PostForm = nil, nil
+	return sub
+}
+
+// shardWriter buffers the response the exit handler writes for one shard
+type shardWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *shardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *shardWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *shardWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// shardResponse is the part of a Prometheus range query response merged across shards
+type shardResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string        `json:"resultType"`
+		Result     []shardSeries `json:"result"`
+		Stats      *shardStats   `json:"stats,omitempty"`
+	} `json:"data"`
+	Warnings []string `json:"warnings,omitempty"`
+	Infos    []string `json:"infos,omitempty"`
+}
+
+type shardSeries struct {
+	Metric     model.LabelSet    `json:"metric"`
+	Values     []json.RawMessage `json:"values,omitempty"`
+	Histograms []json.RawMessage `json:"histograms,omitempty"`
+}
+
+// shardStats keeps the sample counts the CostFeedback reads from query stats
+type shardStats struct {
+	Samples struct {
+		TotalQueryableSamples int64 `json:"totalQueryableSamples"`
+		PeakSamples           int64 `json:"peakSamples"`
+	} `json:"samples"`
+}
+
+// mergeShards concatenates the points of each series across the shards in time order
+func mergeShards(results []shardResult) (shardResult, error) {
+	var merged shardResponse
+	index := map[string]int{}
+	for i, result := range results {
+		var res shardResponse
+		if err := json.Unmarshal(result.body, &res); err != nil {
+			return shardResult{}, err
+		}
+		if res.Status != "success" || res.Data.ResultType != model.ValMatrix.String() {
+			return result, nil
+		}
+
+		if i == 0 {
+			merged.Status, merged.Data.ResultType = res.Status, res.Data.ResultType
+			merged.Data.Result = []shardSeries{}
+		}
+
+		for _, series := range res.Data.Result {
+			key := series.Metric.String()
+			j, ok := index[key]
+			if !ok {
+				index[key] = len(merged.Data.Result)
+				merged.Data.Result = append(merged.Data.Result, series)
+				continue
+			}
+			merged.Data.Result[j].Values = append(merged.Data.Result[j].Values, series.Values...)
+			merged.Data.Result[j].Histograms = append(
+				merged.Data.Result[j].Histograms, series.Histograms...,
+			)
+		}
+
+		if stats := res.Data.Stats; stats != nil {
+			if merged.Data.Stats == nil {
+				merged.Data.Stats = &shardStats{}
+			}
+			merged.Data.Stats.Samples.TotalQueryableSamples += stats.Samples.TotalQueryableSamples
+			merged.Data.Stats.Samples.PeakSamples = max(
+				merged.Data.Stats.Samples.PeakSamples, stats.Samples.PeakSamples,
+			)
+		}
+
+		// each shard repeats the annotations of the query
+		merged.Warnings = appendNew(merged.Warnings, res.Warnings)
+		merged.Infos = appendNew(merged.Infos, res.Infos)
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return shardResult{}, err
+	}
+
+	header := results[0].header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	return shardResult{status: http.StatusOK, header: header, body: body}, nil
+}
+
+// appendNew appends the messages missing from msgs
+func appendNew(msgs, add []string) []string {
+	for _, msg := range add {
+		if !slices.Contains(msgs, msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// writeShardResult responds to the original request with the buffered response
+func writeShardResult(rr Request, result shardResult) error {
+	if rrw, ok := rr.(ResponseWriter); ok && rrw.ResponseWriter() != nil {
+		w := rrw.ResponseWriter()
+		for name, values := range result.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(result.body)))
+		w.WriteHeader(result.status)
+		_, err := w.Write(result.body)
+		return err
+	}
+
+	res, ok := rr.(Response)
+	if !ok {
+		return fmt.Errorf("request is of type %T not Response", rr)
+	}
+
+	header := result.header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(result.body)))
+	res.SetResponse(&http.Response{
+		Status:        fmt.Sprintf("%d %s", result.status, http.StatusText(result.status)),
+		StatusCode:    result.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(result.body)),
+		ContentLength: int64(len(result.body)),
+		Request:       rr.Request(),
+	})
+	return nil
+}
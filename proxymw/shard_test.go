@@ -0,0 +1,217 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, ShardConfig{}.Validate())
+	require.NoError(t, ShardConfig{EnableSharding: true}.Validate())
+	require.ErrorIs(t, ShardConfig{
+		EnableSharding: true,
+		ShardInterval:  -time.Hour,
+	}.Validate(), ErrNegativeShard)
+	require.ErrorIs(t, Config{ShardConfig: ShardConfig{
+		EnableSharding:   true,
+		ShardConcurrency: -1,
+	}}.Validate(), ErrNegativeShard)
+}
+
+func TestSharderSplit(t *testing.T) {
+	t.Parallel()
+	s := NewSharder(nil, ShardConfig{ShardInterval: time.Hour})
+	for _, tt := range []struct {
+		name   string
+		form   url.Values
+		shards [][2]string
+	}{
+		{
+			name:   "shorter than the interval",
+			form:   url.Values{"start": {"0"}, "end": {"3000"}, "step": {"60"}},
+			shards: [][2]string{{"0", "3000"}},
+		},
+		{
+			name:   "whole steps per shard",
+			form:   url.Values{"start": {"0"}, "end": {"9000"}, "step": {"7m"}},
+			shards: [][2]string{{"0", "2940"}, {"3360", "6300"}, {"6720", "9000"}},
+		},
+		{
+			name:   "step longer than the interval",
+			form:   url.Values{"start": {"0.5"}, "end": {"14400.5"}, "step": {"2h"}},
+			shards: [][2]string{{"0.5", "0.5"}, {"7200.5", "7200.5"}, {"14400.5", "14400.5"}},
+		},
+		{
+			name: "unparseable",
+			form: url.Values{"start": {"yesterday"}, "end": {"9000"}, "step": {"60"}},
+		},
+		{
+			name: "end before start",
+			form: url.Values{"start": {"9000"}, "end": {"0"}, "step": {"60"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var shards [][2]string
+			for _, sh := range s.split(tt.form) {
+				shards = append(shards, [2]string{formatTime(sh.start), formatTime(sh.end)})
+			}
+			require.Equal(t, tt.shards, shards)
+		})
+	}
+}
+
+// rangeQueryHandler responds like Prometheus with one point per step of the up series and of a
+// series which only exists from 3600 on
+func rangeQueryHandler(calls *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		start, _ := parseTime(r.FormValue("start"))
+		end, _ := parseTime(r.FormValue("end"))
+		step, _ := parseDuration(r.FormValue("step"))
+		if r.FormValue("query") == "invalid" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+			return
+		}
+
+		up := []string{}
+		late := []string{}
+		for ts := start; !ts.After(end); ts = ts.Add(step) {
+			up = append(up, fmt.Sprintf(`[%s,"1"]`, formatTime(ts)))
+			if ts.Unix() >= 3600 {
+				late = append(late, fmt.Sprintf(`[%s,"2"]`, formatTime(ts)))
+			}
+		}
+
+		result := []string{fmt.Sprintf(`{"metric":{"__name__":"up"},"values":[%s]}`, strings.Join(up, ","))}
+		if len(late) > 0 {
+			result = append(result, fmt.Sprintf(
+				`{"metric":{"job":"late"},"values":[%s]}`, strings.Join(late, ","),
+			))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w,
+			`{"status":"success","data":{"resultType":"matrix","result":[%s],`+
+				`"stats":{"samples":{"totalQueryableSamples":%d,"peakSamples":%d}}},"warnings":["slow"]}`,
+			strings.Join(result, ","), len(up)+len(late), len(up),
+		)
+	}
+}
+
+func TestSharderServe(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	cfg := Config{ShardConfig: ShardConfig{EnableSharding: true, ShardInterval: time.Hour}}
+	entry := NewServeFromConfig(cfg, rangeQueryHandler(&calls))
+
+	for _, tt := range []struct {
+		name   string
+		form   url.Values
+		post   bool
+		calls  int32
+		status int
+		want   string
+	}{
+		{
+			name:   "merged across shards",
+			form:   url.Values{"query": {"up"}, "start": {"1800"}, "end": {"9000"}, "step": {"1800"}},
+			calls:  3,
+			status: http.StatusOK,
+			want: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"up"},"values":[[1800,"1"],[3600,"1"],[5400,"1"],[7200,"1"],[9000,"1"]]},` +
+				`{"metric":{"job":"late"},"values":[[3600,"2"],[5400,"2"],[7200,"2"],[9000,"2"]]}],` +
+				`"stats":{"samples":{"totalQueryableSamples":9,"peakSamples":2}}},"warnings":["slow"]}`,
+		},
+		{
+			name:   "merged post",
+			form:   url.Values{"query": {"up"}, "start": {"0"}, "end": {"3600"}, "step": {"3600"}},
+			post:   true,
+			calls:  2,
+			status: http.StatusOK,
+			want: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"up"},"values":[[0,"1"],[3600,"1"]]},` +
+				`{"metric":{"job":"late"},"values":[[3600,"2"]]}],` +
+				`"stats":{"samples":{"totalQueryableSamples":3,"peakSamples":1}}},"warnings":["slow"]}`,
+		},
+		{
+			name:   "not split",
+			form:   url.Values{"query": {"up"}, "start": {"0"}, "end": {"1800"}, "step": {"1800"}},
+			calls:  1,
+			status: http.StatusOK,
+			want: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"up"},"values":[[0,"1"],[1800,"1"]]}],` +
+				`"stats":{"samples":{"totalQueryableSamples":2,"peakSamples":2}}},"warnings":["slow"]}`,
+		},
+		{
+			name:   "failed shard",
+			form:   url.Values{"query": {"invalid"}, "start": {"0"}, "end": {"9000"}, "step": {"60"}},
+			calls:  3,
+			status: http.StatusBadRequest,
+			want:   `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, QueryRangePath+"?"+tt.form.Encode(), http.NoBody)
+			if tt.post {
+				req = httptest.NewRequest(
+					http.MethodPost, QueryRangePath, strings.NewReader(tt.form.Encode()),
+				)
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			calls.Store(0)
+			w := httptest.NewRecorder()
+			entry.ServeHTTP(w, req)
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.calls, calls.Load())
+			require.JSONEq(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func TestSharderRoundTripper(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	upstream := httptest.NewServer(rangeQueryHandler(&calls))
+	t.Cleanup(upstream.Close)
+
+	cfg := Config{ShardConfig: ShardConfig{
+		EnableSharding:   true,
+		ShardInterval:    time.Hour,
+		ShardConcurrency: 1,
+	}}
+	client := &http.Client{Transport: NewRoundTripperFromConfig(cfg, http.DefaultTransport)}
+
+	form := url.Values{"query": {"up"}, "start": {"0"}, "end": {"10800"}, "step": {"3600"}}
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+QueryRangePath+"?"+form.Encode(), http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, int32(4), calls.Load())
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	var merged shardResponse
+	require.NoError(t, json.Unmarshal(body, &merged))
+	require.Len(t, merged.Data.Result, 2)
+	require.Len(t, merged.Data.Result[0].Values, 4)
+	require.Len(t, merged.Data.Result[1].Values, 3)
+	require.Equal(t, []string{"slow"}, merged.Warnings)
+}
@@ -0,0 +1,120 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSharedWindowKey      = "throttle-proxy:bp:active"
+	DefaultSharedWindowInterval = time.Second
+
+	// sharedWindowStaleIntervals is how many sync intervals a replica may miss before its active
+	// count is no longer counted against the fleet
+	sharedWindowStaleIntervals = 3
+)
+
+var ErrSharedWindowRedisRequired = errors.New("shared window requires a redis address")
+
+// SharedWindowConfig makes every replica admit requests against the fleet wide active count so
+// concurrency toward the upstream respects a single CongestionWindowMax. Each replica computes
+// the same watermark from the shared backpressure signals and publishes its active count.
+type SharedWindowConfig struct {
+	EnableSharedWindow bool   `yaml:"enable_shared_window"`
+	RedisAddr          string `yaml:"redis_addr"`
+	// RedisKey is the hash holding each replica's active count
+	RedisKey string `yaml:"redis_key"`
+	// SyncInterval is how often active counts are published and read. Defaults to 1s.
+	SyncInterval time.Duration `yaml:"sync_interval"`
+	// ReplicaID identifies this replica in the shared hash. Defaults to the hostname.
+	ReplicaID string `yaml:"replica_id"`
+}
+
+func (c SharedWindowConfig) Validate() error {
+	if !c.EnableSharedWindow {
+		return nil
+	}
+
+	if c.RedisAddr == "" {
+		return ErrSharedWindowRedisRequired
+	}
+
+	if !redisSupported {
+		return ErrRedisUnsupported
+	}
+
+	if c.SyncInterval < 0 {
+		return fmt.Errorf("shared window sync interval cannot be negative: %s", c.SyncInterval)
+	}
+	return nil
+}
+
+func (c SharedWindowConfig) interval() time.Duration {
+	if c.SyncInterval == 0 {
+		return DefaultSharedWindowInterval
+	}
+	return c.SyncInterval
+}
+
+func (c SharedWindowConfig) peers() WindowPeers {
+	if !c.EnableSharedWindow {
+		return nil
+	}
+
+	key := c.RedisKey
+	if key == "" {
+		key = DefaultSharedWindowKey
+	}
+
+	peers, err := newRedisWindowPeers(
+		c.RedisAddr, key, replicaID(c.ReplicaID), c.interval()*sharedWindowStaleIntervals,
+	)
+	if err != nil {
+		log.Printf("backpressure window not shared: %v", err)
+		return nil
+	}
+	return peers
+}
+
+// replicaID returns the configured replica name or hostname:pid
+func replicaID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + ":" + strconv.Itoa(os.Getpid())
+}
+
+// WindowPeers exchanges active request counts with the other replicas in the fleet
+type WindowPeers interface {
+	// Sync publishes the local active count and returns the sum of every other replica's count
+	Sync(ctx context.Context, active int, now time.Time) (int, error)
+}
+
+func parsePeerActive(value string) (int, time.Time, error) {
+	activeStr, millisStr, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("malformed shared window value %q", value)
+	}
+
+	active, err := strconv.Atoi(activeStr)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	millis, err := strconv.ParseInt(millisStr, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return active, time.UnixMilli(millis), nil
+}
@@ -0,0 +1,55 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedWindowConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, SharedWindowConfig{}.Validate())
+	require.ErrorIs(t, SharedWindowConfig{EnableSharedWindow: true}.Validate(), ErrSharedWindowRedisRequired)
+	require.Error(t, SharedWindowConfig{
+		EnableSharedWindow: true,
+		RedisAddr:          "localhost:6379",
+		SyncInterval:       -time.Second,
+	}.Validate())
+}
+
+type fakePeers struct {
+	peerActive int
+	err        error
+}
+
+func (f fakePeers) Sync(context.Context, int, time.Time) (int, error) {
+	return f.peerActive, f.err
+}
+
+func TestSharedWindowCheck(t *testing.T) {
+	bp := &Backpressure{
+		watermark:       5,
+		min:             1,
+		max:             10,
+		allowance:       1,
+		peers:           fakePeers{peerActive: 4},
+		peerSync:        time.Second,
+		peerActiveGauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "fake_peer_active"}),
+	}
+
+	bp.syncPeers(context.Background())
+	require.NoError(t, bp.check("", 1))
+	require.ErrorIs(t, bp.check("", 1), ErrBackpressureBackoff)
+
+	// unreachable peers fall back to the local window
+	bp.peers = fakePeers{err: errors.New("peers unreachable")}
+	bp.syncPeers(context.Background())
+	for range 4 {
+		require.NoError(t, bp.check("", 1))
+	}
+	require.ErrorIs(t, bp.check("", 1), ErrBackpressureBackoff)
+}
@@ -0,0 +1,299 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	BackendPrometheus      = "prometheus"
+	BackendVictoriaMetrics = "victoriametrics"
+	BackendGraphite        = "graphite"
+	BackendInfluxDB        = "influxdb"
+
+	GraphiteRenderEndpoint = "/render"
+	InfluxDBQueryEndpoint  = "/api/v2/query"
+
+	// GraphiteRenderFrom is how far back the render API is asked for datapoints. Only the most
+	// recent non-null datapoint is used.
+	GraphiteRenderFrom = "-5min"
+)
+
+const (
+	AggregationMax = "max"
+	AggregationMin = "min"
+	AggregationAvg = "avg"
+	AggregationSum = "sum"
+)
+
+// SignalFetcher returns the current value of a backpressure query from a monitoring endpoint
+type SignalFetcher func(ctx context.Context, client *http.Client, endpoint, query string) (float64, error)
+
+// SignalSampler returns the current value of every series a backpressure query matches
+type SignalSampler func(ctx context.Context, client *http.Client, endpoint, query string) ([]float64, error)
+
+// SignalFetchers maps each BackpressureQuery backend to the function fetching its value.
+// VictoriaMetrics serves the Prometheus query API so it shares the PromQL fetcher.
+var SignalFetchers = map[string]SignalFetcher{
+	BackendPrometheus:      ValueFromPromQL,
+	BackendVictoriaMetrics: ValueFromPromQL,
+	BackendGraphite:        ValueFromGraphite,
+	BackendInfluxDB:        ValueFromFlux,
+}
+
+// SignalSamplers maps each BackpressureQuery backend to the function fetching all its series
+// so multi-series results can be aggregated.
+var SignalSamplers = map[string]SignalSampler{
+	BackendPrometheus:      SamplesFromPromQL,
+	BackendVictoriaMetrics: SamplesFromPromQL,
+	BackendGraphite:        SamplesFromGraphite,
+	BackendInfluxDB:        SamplesFromFlux,
+}
+
+// AggregatedFetcher reduces every series returned by the sampler into a single value
+func AggregatedFetcher(sample SignalSampler, aggregation string) SignalFetcher {
+	return func(ctx context.Context, client *http.Client, endpoint, query string) (float64, error) {
+		samples, err := sample(ctx, client, endpoint, query)
+		if err != nil {
+			return 0, err
+		}
+		return Aggregate(aggregation, query, samples)
+	}
+}
+
+// Aggregate reduces query samples with the max, min, avg, or sum aggregation
+func Aggregate(aggregation, query string, samples []float64) (float64, error) {
+	if !validAggregation(aggregation) {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownAggregation, aggregation)
+	}
+
+	if len(samples) == 0 {
+		return 0, fmt.Errorf("backpressure query returned no values: %s", query)
+	}
+
+	res := samples[0]
+	for _, val := range samples[1:] {
+		switch aggregation {
+		case AggregationMax:
+			res = max(res, val)
+		case AggregationMin:
+			res = min(res, val)
+		default:
+			res += val
+		}
+	}
+
+	if aggregation == AggregationAvg {
+		res /= float64(len(samples))
+	}
+	return res, nil
+}
+
+func validAggregation(aggregation string) bool {
+	switch aggregation {
+	case AggregationMax, AggregationMin, AggregationAvg, AggregationSum:
+		return true
+	default:
+		return false
+	}
+}
+
+// singleValue wraps a sampler result, throwing an error unless there is exactly one sample
+func singleValue(query string) func([]float64, error) (float64, error) {
+	return func(samples []float64, err error) (float64, error) {
+		if err != nil {
+			return 0, err
+		}
+		if len(samples) != 1 {
+			return 0, fmt.Errorf("backpressure query must return exactly one value: %s", query)
+		}
+		return samples[0], nil
+	}
+}
+
+type graphiteSeries struct {
+	Target     string        `json:"target"`
+	Datapoints [][2]*float64 `json:"datapoints"`
+}
+
+// ValueFromGraphite queries the Graphite render API for the target and returns the latest
+// non-null datapoint. Throws an error if the target does not resolve to exactly one series.
+func ValueFromGraphite(
+	ctx context.Context, client *http.Client, endpoint, target string,
+) (float64, error) {
+	return singleValue(target)(SamplesFromGraphite(ctx, client, endpoint, target))
+}
+
+// SamplesFromGraphite returns the latest non-null datapoint of every series the target resolves
+// to. Series without datapoints are skipped.
+func SamplesFromGraphite(
+	ctx context.Context, client *http.Client, endpoint, target string,
+) ([]float64, error) {
+	u, err := backendURL(endpoint, GraphiteRenderEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("target", target)
+	q.Set("format", "json")
+	q.Set("from", GraphiteRenderFrom)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	body, err := doMonitorRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close() //nolint:errcheck // ignore body close
+
+	var series []graphiteSeries
+	if err := json.NewDecoder(body).Decode(&series); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	samples := make([]float64, 0, len(series))
+	for _, s := range series {
+		for i := len(s.Datapoints) - 1; i >= 0; i-- {
+			if s.Datapoints[i][0] == nil {
+				continue
+			}
+			val, err := nonNegative(target, *s.Datapoints[i][0])
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, val)
+			break
+		}
+	}
+	return samples, nil
+}
+
+// ValueFromFlux runs a Flux query against the InfluxDB v2 query API. The endpoint may carry the
+// org as a query parameter. Throws an error if the result is not exactly one row.
+func ValueFromFlux(ctx context.Context, client *http.Client, endpoint, query string) (float64, error) {
+	return singleValue(query)(SamplesFromFlux(ctx, client, endpoint, query))
+}
+
+// SamplesFromFlux runs a Flux query and returns the _value of every row
+func SamplesFromFlux(
+	ctx context.Context, client *http.Client, endpoint, query string,
+) ([]float64, error) {
+	u, err := backendURL(endpoint, InfluxDBQueryEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, u.String(), strings.NewReader(query),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.flux")
+	req.Header.Set("Accept", "application/csv")
+
+	body, err := doMonitorRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close() //nolint:errcheck // ignore body close
+
+	values, err := parseFluxValues(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	for _, val := range values {
+		if _, err := nonNegative(query, val); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// parseFluxValues reads the _value column of every table in an annotated CSV response
+func parseFluxValues(r io.Reader) ([]float64, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	values := []float64{}
+	valueCol := -1
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// each table starts with its own header row
+		if idx := indexOf(record, "_value"); idx >= 0 {
+			valueCol = idx
+			continue
+		}
+
+		if valueCol < 0 || valueCol >= len(record) {
+			return nil, errors.New("flux response is missing a _value column")
+		}
+
+		val, err := strconv.ParseFloat(record[valueCol], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse _value %q: %w", record[valueCol], err)
+		}
+		values = append(values, val)
+	}
+}
+
+func indexOf(record []string, field string) int {
+	for i, f := range record {
+		if f == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// backendURL appends the API path to the endpoint while keeping its query parameters
+func backendURL(endpoint, path string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse monitor URL: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u, nil
+}
+
+func doMonitorRequest(client *http.Client, req *http.Request) (io.ReadCloser, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("execute request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() //nolint:errcheck // ignore body close
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func nonNegative(query string, val float64) (float64, error) {
+	if val < 0 {
+		return 0, fmt.Errorf("backpressure query (%s) must have non-negative value: %f", query, val)
+	}
+	return val, nil
+}
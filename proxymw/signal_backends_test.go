@@ -0,0 +1,178 @@
+package proxymw
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueFromGraphite(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name    string
+		body    string
+		want    float64
+		wantErr bool
+	}{
+		{
+			name: "latest non-null datapoint",
+			body: `[{"target": "errors", "datapoints": [[1, 100], [7.5, 160], [null, 220]]}]`,
+			want: 7.5,
+		},
+		{
+			name:    "multiple series",
+			body:    `[{"target": "a", "datapoints": [[1, 100]]}, {"target": "b", "datapoints": [[2, 100]]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "only null datapoints",
+			body:    `[{"target": "errors", "datapoints": [[null, 100]]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "negative value",
+			body:    `[{"target": "errors", "datapoints": [[-1, 100]]}]`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/graphite"+GraphiteRenderEndpoint, r.URL.Path)
+				require.Equal(t, "sumSeries(errors.*)", r.URL.Query().Get("target"))
+				require.Equal(t, "json", r.URL.Query().Get("format"))
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			val, err := ValueFromGraphite(
+				context.Background(), srv.Client(), srv.URL+"/graphite/", "sumSeries(errors.*)",
+			)
+			require.Equal(t, tt.wantErr, err != nil, err)
+			require.Equal(t, tt.want, val)
+		})
+	}
+}
+
+func TestValueFromFlux(t *testing.T) {
+	t.Parallel()
+	query := `from(bucket: "metrics") |> range(start: -1m) |> last()`
+	for _, tt := range []struct {
+		name    string
+		body    string
+		want    float64
+		wantErr bool
+	}{
+		{
+			name: "annotated csv",
+			body: "#datatype,string,long,dateTime:RFC3339,double\n" +
+				"#group,false,false,false,false\n" +
+				"#default,_result,,,\n" +
+				",result,table,_time,_value\n" +
+				",,0,2024-01-01T00:00:00Z,42.5\n",
+			want: 42.5,
+		},
+		{
+			name:    "multiple tables",
+			body:    ",result,table,_value\n,,0,1\n\n,result,table,_value\n,,1,2\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty result",
+			body:    "",
+			wantErr: true,
+		},
+		{
+			name:    "missing value column",
+			body:    ",result,table\n,,0\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodPost, r.Method)
+				require.Equal(t, InfluxDBQueryEndpoint, r.URL.Path)
+				require.Equal(t, "my-org", r.URL.Query().Get("org"))
+				require.Equal(t, "application/vnd.flux", r.Header.Get("Content-Type"))
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				require.Equal(t, query, string(body))
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			val, err := ValueFromFlux(context.Background(), srv.Client(), srv.URL+"?org=my-org", query)
+			require.Equal(t, tt.wantErr, err != nil, err)
+			require.Equal(t, tt.want, val)
+		})
+	}
+}
+
+func TestBackpressureQueryBackend(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{Query: "errors", WarningThreshold: 1, EmergencyThreshold: 2}
+	require.NoError(t, q.Validate())
+	require.Equal(t, BackendPrometheus, q.backend())
+
+	q.Backend = BackendGraphite
+	require.NoError(t, q.Validate())
+
+	q.Backend = "opentsdb"
+	require.ErrorIs(t, q.Validate(), ErrUnknownBackend)
+}
+
+func TestAggregate(t *testing.T) {
+	t.Parallel()
+	samples := []float64{2, 8, 5}
+	for aggregation, want := range map[string]float64{
+		AggregationMax: 8,
+		AggregationMin: 2,
+		AggregationAvg: 5,
+		AggregationSum: 15,
+	} {
+		val, err := Aggregate(aggregation, "errors", samples)
+		require.NoError(t, err)
+		require.Equal(t, want, val, aggregation)
+	}
+
+	_, err := Aggregate(AggregationMax, "errors", nil)
+	require.Error(t, err)
+
+	_, err = Aggregate("p99", "errors", samples)
+	require.ErrorIs(t, err, ErrUnknownAggregation)
+
+	q := BackpressureQuery{Query: "errors", WarningThreshold: 1, EmergencyThreshold: 2}
+	q.Aggregation = "p99"
+	require.ErrorIs(t, q.Validate(), ErrUnknownAggregation)
+}
+
+func TestAggregatedFetcher(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{"metric": {"instance": "a"}, "value": [1731988543.752, "90"]},
+					{"metric": {"instance": "b"}, "value": [1731988543.752, "30"]}
+				]
+			}
+		}`)
+	}))
+	defer srv.Close()
+
+	q := BackpressureQuery{Query: "up_errors"}
+	_, err := q.fetcher()(context.Background(), srv.Client(), srv.URL, q.Query)
+	require.Error(t, err, "multiple series require an aggregation")
+
+	q.Aggregation = AggregationAvg
+	val, err := q.fetcher()(context.Background(), srv.Client(), srv.URL, q.Query)
+	require.NoError(t, err)
+	require.Equal(t, 60.0, val)
+}
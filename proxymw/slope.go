@@ -0,0 +1,76 @@
+package proxymw
+
+import "time"
+
+// validateSlope checks the rate of change thresholds of queries throttling on their slope
+func (q BackpressureQuery) validateSlope() error {
+	if q.SlopeSamples == 0 {
+		return nil
+	}
+	if q.SlopeSamples < 2 {
+		return ErrSlopeSamplesRange
+	}
+	if q.SlopeWarningThreshold < 0 || q.SlopeEmergencyThreshold <= q.SlopeWarningThreshold {
+		return ErrSlopeThresholds
+	}
+	return nil
+}
+
+// slopeThrottlePercent is the share of the window this query closes at the current rate of
+// change. The slope thresholds are how fast the value moves toward its emergency threshold, so
+// below queries throttle as the value falls.
+func (q BackpressureQuery) slopeThrottlePercent(slope float64) float64 {
+	if q.Direction == DirectionBelow {
+		slope = -slope
+	}
+	q.Direction = DirectionAbove
+	q.WarningThreshold, q.EmergencyThreshold = q.SlopeWarningThreshold, q.SlopeEmergencyThreshold
+	return q.throttlePercent(slope)
+}
+
+type slopeSample struct {
+	at    time.Time
+	value float64
+}
+
+// slopeWindow keeps the last samples of a signal to estimate its rate of change
+type slopeWindow struct {
+	samples []slopeSample
+	size    int
+}
+
+func newSlopeWindow(size int) *slopeWindow {
+	if size == 0 {
+		return nil
+	}
+	return &slopeWindow{samples: make([]slopeSample, 0, size), size: size}
+}
+
+// add records the value and returns the least squares slope per second over the window. The
+// slope is only known once the window is full.
+func (w *slopeWindow) add(at time.Time, value float64) (float64, bool) {
+	if len(w.samples) == w.size {
+		w.samples = append(w.samples[:0], w.samples[1:]...)
+	}
+	w.samples = append(w.samples, slopeSample{at: at, value: value})
+	if len(w.samples) < w.size {
+		return 0, false
+	}
+
+	// seconds are relative to the first sample to keep the sums small
+	n := float64(len(w.samples))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range w.samples {
+		x := s.at.Sub(w.samples[0].at).Seconds()
+		sumX += x
+		sumY += s.value
+		sumXY += x * s.value
+		sumXX += x * x
+	}
+
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denom, true
+}
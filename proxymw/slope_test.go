@@ -0,0 +1,112 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSlope(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{Query: "errors", WarningThreshold: 1, EmergencyThreshold: 2}
+	require.NoError(t, q.Validate())
+
+	q.SlopeSamples = 1
+	require.ErrorIs(t, q.Validate(), ErrSlopeSamplesRange)
+
+	q.SlopeSamples = 5
+	require.ErrorIs(t, q.Validate(), ErrSlopeThresholds, "thresholds are required")
+	q.SlopeWarningThreshold, q.SlopeEmergencyThreshold = 2, 1
+	require.ErrorIs(t, q.Validate(), ErrSlopeThresholds)
+	q.SlopeWarningThreshold, q.SlopeEmergencyThreshold = 1, 2
+	require.NoError(t, q.Validate())
+}
+
+func TestSlopeWindow(t *testing.T) {
+	t.Parallel()
+	require.Nil(t, newSlopeWindow(0))
+
+	w := newSlopeWindow(3)
+	start := time.Unix(1_700_000_000, 0)
+	_, ok := w.add(start, 10)
+	require.False(t, ok)
+	_, ok = w.add(start.Add(10*time.Second), 30)
+	require.False(t, ok, "the slope is unknown until the window is full")
+
+	slope, ok := w.add(start.Add(20*time.Second), 50)
+	require.True(t, ok)
+	require.InDelta(t, 2, slope, 1e-9)
+
+	// the oldest sample leaves the window
+	slope, ok = w.add(start.Add(30*time.Second), 20)
+	require.True(t, ok)
+	require.InDelta(t, -0.5, slope, 1e-9)
+	require.Len(t, w.samples, 3)
+
+	// samples taken at the same instant have no slope
+	same := newSlopeWindow(2)
+	same.add(start, 1)
+	_, ok = same.add(start, 2)
+	require.False(t, ok)
+}
+
+func TestSlopeThrottlePercent(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{SlopeWarningThreshold: 1, SlopeEmergencyThreshold: 5}
+	require.Zero(t, q.slopeThrottlePercent(-3))
+	require.Zero(t, q.slopeThrottlePercent(1))
+	require.Greater(t, q.slopeThrottlePercent(3), 0.0)
+	require.Equal(t, 1.0, q.slopeThrottlePercent(5))
+
+	// below queries throttle as they fall
+	q.Direction = DirectionBelow
+	require.Zero(t, q.slopeThrottlePercent(3))
+	require.Equal(t, 1.0, q.slopeThrottlePercent(-5))
+
+	q.Weight = 0.5
+	require.Equal(t, 0.5, q.slopeThrottlePercent(-5))
+}
+
+func TestPollSlope(t *testing.T) {
+	t.Parallel()
+	q := BackpressureQuery{
+		Name:                    "load",
+		Query:                   "load",
+		WarningThreshold:        80,
+		EmergencyThreshold:      100,
+		SlopeSamples:            2,
+		SlopeWarningThreshold:   0,
+		SlopeEmergencyThreshold: 1e-9,
+	}
+	bp := newBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin:       1,
+		CongestionWindowMax:       100,
+		BackpressureMonitoringURL: "http://prometheus",
+		BackpressureQueries:       []BackpressureQuery{q},
+	}, newBackpressureMetrics(promauto.With(prometheus.NewRegistry())))
+
+	value := 10.0
+	fetch := func(context.Context, *http.Client, string, string) (float64, error) {
+		return value, nil
+	}
+	s := &signal{query: q, fetch: fetch, smoothed: &ewma{}, history: newSlopeWindow(2)}
+
+	bp.poll(context.Background(), s)
+	require.Equal(t, 1.0, bp.Allowance())
+
+	// a rising value throttles long before the warning threshold
+	time.Sleep(time.Millisecond)
+	value = 20
+	bp.poll(context.Background(), s)
+	require.Equal(t, 0.0, bp.Allowance())
+
+	// and the window reopens once the value stops rising
+	time.Sleep(time.Millisecond)
+	bp.poll(context.Background(), s)
+	require.Equal(t, 1.0, bp.Allowance())
+}
@@ -0,0 +1,98 @@
+package proxymw
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepAligner(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name    string
+		path    string
+		form    url.Values
+		post    bool
+		want    url.Values
+		aligned float64
+	}{
+		{
+			name:    "rounded down to the step",
+			path:    QueryRangePath,
+			form:    url.Values{"query": {"up"}, "start": {"1000.5"}, "end": {"2030"}, "step": {"1m"}},
+			want:    url.Values{"query": {"up"}, "start": {"960"}, "end": {"1980"}, "step": {"1m"}},
+			aligned: 1,
+		},
+		{
+			name: "rfc3339 post body",
+			path: QueryRangePath,
+			form: url.Values{
+				"query": {"up"},
+				"start": {"2024-01-01T00:00:10Z"},
+				"end":   {"2024-01-01T01:00:10Z"},
+				"step":  {"30"},
+			},
+			post: true,
+			want: url.Values{
+				"query": {"up"},
+				"start": {"1704067200"},
+				"end":   {"1704070800"},
+				"step":  {"30"},
+			},
+			aligned: 1,
+		},
+		{
+			name: "already aligned",
+			path: QueryRangePath,
+			form: url.Values{"query": {"up"}, "start": {"960"}, "end": {"1980"}, "step": {"60"}},
+			want: url.Values{"query": {"up"}, "start": {"960"}, "end": {"1980"}, "step": {"60"}},
+		},
+		{
+			name: "unparseable step",
+			path: QueryRangePath,
+			form: url.Values{"query": {"up"}, "start": {"1000"}, "end": {"2030"}, "step": {"often"}},
+			want: url.Values{"query": {"up"}, "start": {"1000"}, "end": {"2030"}, "step": {"often"}},
+		},
+		{
+			name: "instant query",
+			path: QueryPath,
+			form: url.Values{"query": {"up"}, "time": {"1000.5"}},
+			want: url.Values{"query": {"up"}, "time": {"1000.5"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got url.Values
+			m := newStepAlignMetrics(promauto.With(prometheus.NewRegistry()))
+			sa := newStepAligner(&Mocker{NextFunc: func(rr Request) error {
+				req := rr.Request()
+				body, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+				got = req.URL.Query()
+				if tt.post {
+					got, err = url.ParseQuery(string(body))
+					require.NoError(t, err)
+				}
+				return nil
+			}}, m)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path+"?"+tt.form.Encode(), http.NoBody)
+			if tt.post {
+				req = httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			require.NoError(t, sa.Next(&RequestResponseWrapper{req: req}))
+			require.Equal(t, tt.want, got)
+			require.InDelta(t, tt.aligned, testutil.ToFloat64(m.aligned), 0)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+const TenantConcurrencyProxyType = "tenant_concurrency"
+
+var ErrTenantConcurrencyRequired = errors.New(
+	"tenant concurrency limits must be > 0 when tenant concurrency limiting is enabled",
+)
+
+// TenantConcurrencyConfig caps the requests each tenant may have in flight at once, independent
+// of the congestion window shared by every tenant, so one tenant's slow dashboards cannot hold
+// every upstream querier.
+type TenantConcurrencyConfig struct {
+	EnableTenantConcurrency bool `yaml:"enable_tenant_concurrency"`
+	// TenantConcurrencyHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	TenantConcurrencyHeader string `yaml:"tenant_concurrency_header"`
+	// MaxTenantConcurrency is the in-flight limit of tenants without an entry in
+	// TenantConcurrencyLimits
+	MaxTenantConcurrency int `yaml:"max_tenant_concurrency"`
+	// TenantConcurrencyLimits overrides the limit of the named tenants
+	TenantConcurrencyLimits map[string]int `yaml:"tenant_concurrency_limits"`
+}
+
+func (c TenantConcurrencyConfig) Validate() error {
+	if !c.EnableTenantConcurrency {
+		return nil
+	}
+
+	if c.MaxTenantConcurrency <= 0 {
+		return ErrTenantConcurrencyRequired
+	}
+
+	for _, limit := range c.TenantConcurrencyLimits {
+		if limit <= 0 {
+			return ErrTenantConcurrencyRequired
+		}
+	}
+	return nil
+}
+
+func (c TenantConcurrencyConfig) header() string {
+	if c.TenantConcurrencyHeader == "" {
+		return DefaultTenantHeader
+	}
+	return http.CanonicalHeaderKey(c.TenantConcurrencyHeader)
+}
+
+// TenantConcurrencyLimiter rejects requests of tenants which already have their limit of
+// requests in flight.
+type TenantConcurrencyLimiter struct {
+	client       ProxyClient
+	header       string
+	defaultLimit int
+	limits       map[string]int
+
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+var _ ProxyClient = &TenantConcurrencyLimiter{}
+
+func NewTenantConcurrencyLimiter(
+	client ProxyClient, cfg TenantConcurrencyConfig,
+) *TenantConcurrencyLimiter {
+	return &TenantConcurrencyLimiter{
+		client:       client,
+		header:       cfg.header(),
+		defaultLimit: cfg.MaxTenantConcurrency,
+		limits:       cfg.TenantConcurrencyLimits,
+		inflight:     map[string]int{},
+	}
+}
+
+func (tc *TenantConcurrencyLimiter) Init(ctx context.Context) error {
+	return tc.client.Init(ctx)
+}
+
+func (tc *TenantConcurrencyLimiter) Next(rr Request) error {
+	tenant := rr.Request().Header.Get(tc.header)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	if err := tc.acquire(tenant); err != nil {
+		return err
+	}
+	defer tc.release(tenant)
+	return tc.client.Next(rr)
+}
+
+func (tc *TenantConcurrencyLimiter) acquire(tenant string) error {
+	limit, ok := tc.limits[tenant]
+	if !ok {
+		limit = tc.defaultLimit
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.inflight[tenant] >= limit {
+		return BlockErr(
+			TenantConcurrencyProxyType,
+			"tenant %s reached its limit of %d concurrent requests", tenant, limit,
+		)
+	}
+	tc.inflight[tenant]++
+	return nil
+}
+
+func (tc *TenantConcurrencyLimiter) release(tenant string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	// idle tenants are removed so the map only grows with concurrently active tenants
+	if tc.inflight[tenant]--; tc.inflight[tenant] == 0 {
+		delete(tc.inflight, tenant)
+	}
+}
+
+// Inflight returns the number of requests the tenant has in flight
+func (tc *TenantConcurrencyLimiter) Inflight(tenant string) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.inflight[tenant]
+}
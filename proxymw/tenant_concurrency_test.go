@@ -0,0 +1,84 @@
+package proxymw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantConcurrencyConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, TenantConcurrencyConfig{}.Validate())
+	require.NoError(t, TenantConcurrencyConfig{
+		EnableTenantConcurrency: true,
+		MaxTenantConcurrency:    1,
+	}.Validate())
+	require.ErrorIs(t, TenantConcurrencyConfig{
+		EnableTenantConcurrency: true,
+	}.Validate(), ErrTenantConcurrencyRequired)
+	require.ErrorIs(t, Config{TenantConcurrencyConfig: TenantConcurrencyConfig{
+		EnableTenantConcurrency: true,
+		MaxTenantConcurrency:    1,
+		TenantConcurrencyLimits: map[string]int{"team-a": 0},
+	}}.Validate(), ErrTenantConcurrencyRequired)
+}
+
+func TestTenantConcurrencyLimiter(t *testing.T) {
+	t.Parallel()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	tc := NewTenantConcurrencyLimiter(&Mocker{NextFunc: func(rr Request) error {
+		if rr.Request().Header.Get("X-Hold") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		return nil
+	}}, TenantConcurrencyConfig{
+		EnableTenantConcurrency: true,
+		TenantConcurrencyHeader: "x-tenant",
+		MaxTenantConcurrency:    1,
+		TenantConcurrencyLimits: map[string]int{"team-a": 2},
+	})
+
+	next := func(tenant string, hold bool) error {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		if hold {
+			req.Header.Set("X-Hold", "true")
+		}
+		return tc.Next(&RequestResponseWrapper{req: req})
+	}
+
+	done := make(chan error, 3)
+	for _, tenant := range []string{"team-a", "team-a", "team-b"} {
+		go func() { done <- next(tenant, true) }()
+		<-started
+	}
+	require.Equal(t, 2, tc.Inflight("team-a"))
+	require.Equal(t, 1, tc.Inflight("team-b"))
+
+	var blocked *RequestBlockedError
+	err := next("team-a", false)
+	require.ErrorAs(t, err, &blocked)
+	require.Equal(t, TenantConcurrencyProxyType, blocked.Type)
+	require.EqualError(t, err, "tenant team-a reached its limit of 2 concurrent requests")
+
+	err = next("team-b", false)
+	require.EqualError(t, err, "tenant team-b reached its limit of 1 concurrent requests")
+
+	// tenants are limited independently of each other
+	require.NoError(t, next("team-c", false))
+	require.NoError(t, next("", false))
+
+	close(release)
+	for range 3 {
+		require.NoError(t, <-done)
+	}
+	require.Equal(t, 0, tc.Inflight("team-a"))
+	require.Empty(t, tc.inflight)
+	require.NoError(t, next("team-b", false))
+}
@@ -0,0 +1,106 @@
+package proxymw
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrTenantWeightRange = errors.New("tenant fairness weights must be > 0")
+
+// TenantFairnessConfig shares the congestion window across tenants so one tenant cannot hold
+// every open slot. Each tenant with requests in flight may occupy its weighted share of the
+// current watermark. A tenant alone in the window may use all of it, and as slots free up they
+// go to the tenants under their share, converging on max-min fairness.
+type TenantFairnessConfig struct {
+	EnableTenantFairness bool `yaml:"enable_tenant_fairness"`
+	// TenantHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	TenantHeader string `yaml:"tenant_header"`
+	// TenantWeights scales the share of the named tenants. Unlisted tenants have a weight of 1.
+	TenantWeights map[string]float64 `yaml:"tenant_weights"`
+}
+
+func (c TenantFairnessConfig) Validate() error {
+	for _, weight := range c.TenantWeights {
+		if weight <= 0 {
+			return ErrTenantWeightRange
+		}
+	}
+	return nil
+}
+
+func (c TenantFairnessConfig) header() string {
+	if c.TenantHeader == "" {
+		return DefaultTenantHeader
+	}
+	return c.TenantHeader
+}
+
+func (c TenantFairnessConfig) weight(tenant string) float64 {
+	if weight, ok := c.TenantWeights[tenant]; ok {
+		return weight
+	}
+	return 1
+}
+
+// tenantFor returns the tenant a request is shared under, or "" when fairness is disabled
+func (c TenantFairnessConfig) tenantFor(rr Request) string {
+	if !c.EnableTenantFairness {
+		return ""
+	}
+
+	if tenant := rr.Request().Header.Get(c.header()); tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// checkTenant ensures a tenant stays within its weighted share of the current watermark.
+func (bp *Backpressure) checkTenant(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if bp.tenantActive[tenant] >= bp.tenantWindow(tenant) {
+		return BlockErr(
+			BackpressureProxyType, "tenant %s exceeded its fair share, backoff from backpressure", tenant,
+		)
+	}
+
+	bp.tenantActive[tenant]++
+	return nil
+}
+
+// releaseTenant frees the slot taken by checkTenant.
+func (bp *Backpressure) releaseTenant(tenant string) {
+	if tenant == "" {
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if bp.tenantActive[tenant] <= 1 {
+		delete(bp.tenantActive, tenant)
+		return
+	}
+	bp.tenantActive[tenant]--
+}
+
+// tenantWindow is the weighted share of the watermark for the tenant among the tenants with
+// requests in flight. Every tenant is allowed at least one request.
+// Assumes the callsite already holds the lock.
+func (bp *Backpressure) tenantWindow(tenant string) int {
+	weight := bp.tenantFairness.weight(tenant)
+	total := weight
+	for active := range bp.tenantActive {
+		if active != tenant {
+			total += bp.tenantFairness.weight(active)
+		}
+	}
+
+	share := math.Ceil(float64(bp.watermark) * weight / total)
+	return max(1, int(share))
+}
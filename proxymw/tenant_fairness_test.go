@@ -0,0 +1,69 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantFairness(t *testing.T) {
+	t.Parallel()
+	bp := &Backpressure{
+		watermark: 10,
+		tenantFairness: TenantFairnessConfig{
+			EnableTenantFairness: true,
+			TenantWeights:        map[string]float64{"heavy": 3},
+		},
+		tenantActive: map[string]int{},
+	}
+
+	// a tenant alone in the window may fill it
+	for range 10 {
+		require.NoError(t, bp.checkTenant("a"))
+	}
+	require.Error(t, bp.checkTenant("a"))
+
+	// a second tenant is still admitted, and freed slots go to it until shares are equal
+	require.NoError(t, bp.checkTenant("b"))
+	for range 5 {
+		bp.releaseTenant("a")
+	}
+	require.Error(t, bp.checkTenant("a"), "a is at its share of 5")
+	for range 4 {
+		require.NoError(t, bp.checkTenant("b"))
+	}
+	require.Error(t, bp.checkTenant("b"))
+
+	// weights scale the share among active tenants
+	require.Equal(t, 6, bp.tenantWindow("heavy"))
+	for range 5 {
+		bp.releaseTenant("b")
+	}
+	require.Equal(t, 8, bp.tenantWindow("heavy"))
+	require.NotContains(t, bp.tenantActive, "b")
+
+	require.NoError(t, bp.checkTenant(""), "fairness disabled")
+}
+
+func TestTenantFor(t *testing.T) {
+	t.Parallel()
+	req, err := http.NewRequestWithContext(
+		context.Background(), http.MethodGet, "http://prometheus", http.NoBody,
+	)
+	require.NoError(t, err)
+	rr := &Mocker{RequestFunc: func() *http.Request { return req }}
+
+	require.Empty(t, TenantFairnessConfig{}.tenantFor(rr))
+	cfg := TenantFairnessConfig{EnableTenantFairness: true}
+	require.Equal(t, DefaultTenant, cfg.tenantFor(rr))
+	req.Header.Set(DefaultTenantHeader, "team-a")
+	require.Equal(t, "team-a", cfg.tenantFor(rr))
+
+	require.NoError(t, cfg.Validate())
+	require.ErrorIs(
+		t, TenantFairnessConfig{TenantWeights: map[string]float64{"a": 0}}.Validate(),
+		ErrTenantWeightRange,
+	)
+}
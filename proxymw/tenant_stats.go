@@ -0,0 +1,344 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	TenantStatsProxyType = "tenant_stats"
+
+	// DefaultTenantHeader is the tenant header used by Cortex, Mimir, Thanos, and Loki
+	DefaultTenantHeader = "X-Scope-OrgID"
+	// DefaultTenant is used for requests without a tenant header
+	DefaultTenant            = "anonymous"
+	DefaultTenantStatsWindow = 5 * time.Minute
+	DefaultTopFingerprints   = 10
+
+	// tenantSlots is the number of buckets the sliding window is divided into
+	tenantSlots = 10
+)
+
+var (
+	// tenantLatencyBounds are the upper bounds in milliseconds used to estimate p90 latency
+	tenantLatencyBounds = prometheus.ExponentialBucketsRange(ms, 10*minute, 24)
+
+	// tenantAggregator holds the per-tenant summaries served by TenantSummaryHandler
+	tenantAggregator = NewTenantAggregator(DefaultTenantStatsWindow, DefaultTopFingerprints)
+)
+
+// TenantStatsConfig enables in-memory per-tenant aggregates which can be exported as JSON
+// without querying Prometheus.
+type TenantStatsConfig struct {
+	EnableTenantStats bool `yaml:"enable_tenant_stats"`
+	// TenantHeader identifies the tenant of a request. Defaults to DefaultTenantHeader.
+	TenantHeader string `yaml:"tenant_header"`
+	// TenantStatsWindow is the sliding window summaries are computed over
+	TenantStatsWindow time.Duration `yaml:"tenant_stats_window"`
+	// TopFingerprints is the number of most frequent query fingerprints reported per tenant
+	TopFingerprints int `yaml:"top_fingerprints"`
+}
+
+func (c TenantStatsConfig) Validate() error {
+	if !c.EnableTenantStats {
+		return nil
+	}
+
+	if c.TenantStatsWindow < 0 {
+		return ErrNegativeTenantStatsWindow
+	}
+
+	if c.TopFingerprints < 0 {
+		return ErrNegativeTopFingerprints
+	}
+	return nil
+}
+
+func (c TenantStatsConfig) header() string {
+	if c.TenantHeader == "" {
+		return DefaultTenantHeader
+	}
+	return http.CanonicalHeaderKey(c.TenantHeader)
+}
+
+func (c TenantStatsConfig) window() time.Duration {
+	if c.TenantStatsWindow == 0 {
+		return DefaultTenantStatsWindow
+	}
+	return c.TenantStatsWindow
+}
+
+func (c TenantStatsConfig) topFingerprints() int {
+	if c.TopFingerprints == 0 {
+		return DefaultTopFingerprints
+	}
+	return c.TopFingerprints
+}
+
+// TenantSummary is the exported view of a tenant over the sliding window
+type TenantSummary struct {
+	Tenant          string             `json:"tenant"`
+	Requests        int                `json:"requests"`
+	RequestRate     float64            `json:"request_rate"`
+	RejectionRate   float64            `json:"rejection_rate"`
+	ErrorRate       float64            `json:"error_rate"`
+	P90LatencyMs    float64            `json:"p90_latency_ms"`
+	TopFingerprints []FingerprintCount `json:"top_fingerprints"`
+}
+
+// FingerprintCount is the number of requests for a query fingerprint
+type FingerprintCount struct {
+	Fingerprint string `json:"fingerprint"`
+	Count       int    `json:"count"`
+}
+
+type tenantSlot struct {
+	start        time.Time
+	requests     int
+	rejections   int
+	errors       int
+	latency      []int
+	fingerprints map[string]int
+}
+
+func (s *tenantSlot) reset(start time.Time) {
+	*s = tenantSlot{
+		start:        start,
+		latency:      make([]int, len(tenantLatencyBounds)+1),
+		fingerprints: map[string]int{},
+	}
+}
+
+// TenantAggregator keeps per-tenant request aggregates in a ring of time slots covering the
+// sliding window.
+type TenantAggregator struct {
+	mu        sync.Mutex
+	window    time.Duration
+	slotWidth time.Duration
+	top       int
+	tenants   map[string]*[tenantSlots]tenantSlot
+	now       func() time.Time
+}
+
+func NewTenantAggregator(window time.Duration, top int) *TenantAggregator {
+	return &TenantAggregator{
+		window:    window,
+		slotWidth: window / tenantSlots,
+		top:       top,
+		tenants:   map[string]*[tenantSlots]tenantSlot{},
+		now:       time.Now,
+	}
+}
+
+// Resize changes the window and number of reported fingerprints, discarding existing aggregates.
+func (a *TenantAggregator) Resize(window time.Duration, top int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.window = window
+	a.slotWidth = window / tenantSlots
+	a.top = top
+	a.tenants = map[string]*[tenantSlots]tenantSlot{}
+}
+
+// Record adds a completed request to the tenant's current slot
+func (a *TenantAggregator) Record(
+	tenant, fingerprint string, latency time.Duration, blocked, failed bool,
+) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	slots, ok := a.tenants[tenant]
+	if !ok {
+		slots = &[tenantSlots]tenantSlot{}
+		a.tenants[tenant] = slots
+	}
+
+	start := now.Truncate(a.slotWidth)
+	slot := &slots[(start.UnixNano()/int64(a.slotWidth))%tenantSlots]
+	if !slot.start.Equal(start) {
+		slot.reset(start)
+	}
+
+	slot.requests++
+	if blocked {
+		slot.rejections++
+	}
+	if failed {
+		slot.errors++
+	}
+
+	ms := float64(latency.Milliseconds())
+	bucket, _ := slices.BinarySearch(tenantLatencyBounds, ms)
+	slot.latency[bucket]++
+
+	if fingerprint != "" {
+		slot.fingerprints[fingerprint]++
+	}
+}
+
+// Summaries returns every tenant with requests in the window sorted by tenant. Tenants without
+// recent requests are dropped to keep memory bounded.
+func (a *TenantAggregator) Summaries() []TenantSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cutoff := a.now().Add(-a.window)
+	summaries := []TenantSummary{}
+	for tenant, slots := range a.tenants {
+		summary, ok := a.summarize(tenant, slots, cutoff)
+		if !ok {
+			delete(a.tenants, tenant)
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	slices.SortFunc(summaries, func(x, y TenantSummary) int {
+		if x.Tenant < y.Tenant {
+			return -1
+		}
+		if x.Tenant > y.Tenant {
+			return 1
+		}
+		return 0
+	})
+	return summaries
+}
+
+func (a *TenantAggregator) summarize(
+	tenant string, slots *[tenantSlots]tenantSlot, cutoff time.Time,
+) (TenantSummary, bool) {
+	var rejections, failures int
+	summary := TenantSummary{Tenant: tenant}
+	latency := make([]int, len(tenantLatencyBounds)+1)
+	fingerprints := map[string]int{}
+	for i := range slots {
+		slot := &slots[i]
+		if slot.requests == 0 || !slot.start.After(cutoff) {
+			continue
+		}
+
+		summary.Requests += slot.requests
+		rejections += slot.rejections
+		failures += slot.errors
+		for b, count := range slot.latency {
+			latency[b] += count
+		}
+		for fp, count := range slot.fingerprints {
+			fingerprints[fp] += count
+		}
+	}
+
+	if summary.Requests == 0 {
+		return TenantSummary{}, false
+	}
+
+	requests := float64(summary.Requests)
+	summary.RequestRate = requests / a.window.Seconds()
+	summary.RejectionRate = float64(rejections) / requests
+	summary.ErrorRate = float64(failures) / requests
+	summary.P90LatencyMs = latencyQuantile(latency, summary.Requests, 0.9)
+	summary.TopFingerprints = topFingerprints(fingerprints, a.top)
+	return summary, true
+}
+
+// latencyQuantile returns the upper bound of the bucket containing the quantile
+func latencyQuantile(buckets []int, total int, q float64) float64 {
+	rank := int(math.Ceil(q * float64(total)))
+	seen := 0
+	for i, count := range buckets {
+		seen += count
+		if seen >= rank {
+			if i == len(tenantLatencyBounds) {
+				return math.Inf(1)
+			}
+			return tenantLatencyBounds[i]
+		}
+	}
+	return 0
+}
+
+func topFingerprints(fingerprints map[string]int, top int) []FingerprintCount {
+	counts := make([]FingerprintCount, 0, len(fingerprints))
+	for fp, count := range fingerprints {
+		counts = append(counts, FingerprintCount{Fingerprint: fp, Count: count})
+	}
+
+	slices.SortFunc(counts, func(x, y FingerprintCount) int {
+		if x.Count != y.Count {
+			return y.Count - x.Count
+		}
+		if x.Fingerprint < y.Fingerprint {
+			return -1
+		}
+		return 1
+	})
+	return counts[:min(top, len(counts))]
+}
+
+// ServeHTTP exports the tenant summaries as JSON
+func (a *TenantAggregator) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(a.Summaries()); err != nil {
+		log.Printf("error writing tenant summaries: %v", err)
+	}
+}
+
+// TenantSummaryHandler serves the summaries recorded by TenantStats middlewares built from config
+func TenantSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	tenantAggregator.ServeHTTP(w, r)
+}
+
+// TenantStats records each request outcome into a TenantAggregator keyed by tenant header.
+type TenantStats struct {
+	client     ProxyClient
+	header     string
+	aggregator *TenantAggregator
+}
+
+var _ ProxyClient = &TenantStats{}
+
+func NewTenantStats(
+	client ProxyClient, cfg TenantStatsConfig, aggregator *TenantAggregator,
+) *TenantStats {
+	return &TenantStats{
+		client:     client,
+		header:     cfg.header(),
+		aggregator: aggregator,
+	}
+}
+
+func (ts *TenantStats) Init(ctx context.Context) error {
+	return ts.client.Init(ctx)
+}
+
+func (ts *TenantStats) Next(rr Request) error {
+	req := rr.Request()
+	tenant := req.Header.Get(ts.header)
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	fingerprint := ""
+	if query := requestQuery(req); query != "" {
+		fingerprint = Fingerprint(query)
+	}
+
+	start := time.Now()
+	err := ts.client.Next(rr)
+
+	var blocked *RequestBlockedError
+	isBlocked := errors.As(err, &blocked)
+	ts.aggregator.Record(tenant, fingerprint, time.Since(start), isBlocked, err != nil && !isBlocked)
+	return err
+}
@@ -0,0 +1,97 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantStatsConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, TenantStatsConfig{TenantStatsWindow: -1}.Validate())
+	require.ErrorIs(t, TenantStatsConfig{
+		EnableTenantStats: true,
+		TenantStatsWindow: -time.Second,
+	}.Validate(), ErrNegativeTenantStatsWindow)
+	require.ErrorIs(t, TenantStatsConfig{
+		EnableTenantStats: true,
+		TopFingerprints:   -1,
+	}.Validate(), ErrNegativeTopFingerprints)
+}
+
+func TestTenantAggregator(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	agg := NewTenantAggregator(time.Minute, 1)
+	agg.now = func() time.Time { return now }
+
+	for range 8 {
+		agg.Record("team-a", "up", 10*time.Millisecond, false, false)
+	}
+	agg.Record("team-a", "sum(x)", time.Second, true, false)
+	agg.Record("team-a", "sum(x)", time.Second, false, true)
+	agg.Record("team-b", "", time.Millisecond, false, false)
+
+	summaries := agg.Summaries()
+	require.Len(t, summaries, 2)
+
+	a := summaries[0]
+	require.Equal(t, "team-a", a.Tenant)
+	require.Equal(t, 10, a.Requests)
+	require.InDelta(t, 10.0/60, a.RequestRate, 1e-9)
+	require.InDelta(t, 0.1, a.RejectionRate, 1e-9)
+	require.InDelta(t, 0.1, a.ErrorRate, 1e-9)
+	// the 9th of 10 requests took a second and p90 reports its bucket upper bound
+	require.GreaterOrEqual(t, a.P90LatencyMs, 1000.0)
+	require.Less(t, a.P90LatencyMs, 2000.0)
+	require.Equal(t, []FingerprintCount{{Fingerprint: "up", Count: 8}}, a.TopFingerprints)
+	require.Empty(t, summaries[1].TopFingerprints)
+
+	// requests age out of the sliding window and idle tenants are dropped
+	now = now.Add(2 * time.Minute)
+	agg.Record("team-b", "", time.Millisecond, false, false)
+	summaries = agg.Summaries()
+	require.Len(t, summaries, 1)
+	require.Equal(t, "team-b", summaries[0].Tenant)
+	require.Equal(t, 1, summaries[0].Requests)
+	require.Len(t, agg.tenants, 1)
+}
+
+func TestTenantStatsNext(t *testing.T) {
+	agg := NewTenantAggregator(time.Minute, DefaultTopFingerprints)
+	errBlocked := BlockErr("test", "blocked")
+	for _, tt := range []struct {
+		tenant string
+		err    error
+	}{
+		{tenant: "team-a"},
+		{tenant: "team-a", err: errBlocked},
+		{tenant: "", err: errors.New("upstream failed")},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up%7Bjob%3D%22a%22%7D", http.NoBody)
+		if tt.tenant != "" {
+			req.Header.Set(DefaultTenantHeader, tt.tenant)
+		}
+
+		ts := NewTenantStats(&Mocker{
+			NextFunc: func(Request) error { return tt.err },
+		}, TenantStatsConfig{}, agg)
+		err := ts.Next(&RequestResponseWrapper{req: req})
+		require.ErrorIs(t, err, tt.err)
+	}
+
+	rec := httptest.NewRecorder()
+	agg.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/tenants", http.NoBody))
+	var summaries []TenantSummary
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&summaries))
+	require.Len(t, summaries, 2)
+	require.Equal(t, DefaultTenant, summaries[0].Tenant)
+	require.InDelta(t, 1.0, summaries[0].ErrorRate, 1e-9)
+	require.Equal(t, "team-a", summaries[1].Tenant)
+	require.InDelta(t, 0.5, summaries[1].RejectionRate, 1e-9)
+	require.Equal(t, []FingerprintCount{{Fingerprint: "up{job=?}", Count: 2}}, summaries[1].TopFingerprints)
+}
@@ -0,0 +1,80 @@
+package proxymw
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ThrottleStatePath is where the internal server reports the current backpressure state
+const ThrottleStatePath = "/api/v1/throttle/state"
+
+// ThrottleState is a snapshot of the Backpressure congestion window and its queries
+type ThrottleState struct {
+	Watermark int          `json:"watermark"`
+	Active    int          `json:"active"`
+	Min       int          `json:"min"`
+	Max       int          `json:"max"`
+	Allowance float64      `json:"allowance"`
+	Queries   []QueryState `json:"queries"`
+}
+
+// QueryState is the last poll result of a backpressure query. Value is omitted until the query
+// is polled successfully.
+type QueryState struct {
+	Name            string   `json:"name,omitempty"`
+	Query           string   `json:"query"`
+	Value           *float64 `json:"value,omitempty"`
+	ThrottlePercent float64  `json:"throttle_percent"`
+	Failing         bool     `json:"failing"`
+}
+
+// State returns a snapshot of the congestion window, allowance, and query throttles
+func (bp *Backpressure) State() ThrottleState {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	state := ThrottleState{
+		Watermark: bp.watermark,
+		Active:    bp.active,
+		Min:       bp.min,
+		Max:       bp.max,
+		Allowance: bp.allowance,
+		Queries:   make([]QueryState, 0, len(bp.queries)),
+	}
+
+	for _, q := range bp.queries {
+		qs := QueryState{Name: q.Name, Query: q.Query}
+		if val, ok := bp.values[q]; ok {
+			qs.Value = &val
+		}
+		qs.ThrottlePercent, _ = bp.throttleFlags.Load(q)
+		qs.Failing, _ = bp.failing.Load(q)
+		state.Queries = append(state.Queries, qs)
+	}
+	return state
+}
+
+// Allowance returns the share of the congestion window currently allowed by the queries
+func (bp *Backpressure) Allowance() float64 {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.allowance
+}
+
+// ServeState writes the State as JSON
+func (bp *Backpressure) ServeState(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(bp.State()); err != nil {
+		log.Printf("error writing throttle state: %v", err)
+	}
+}
+
+// ThrottleStateHandler reports the state of the Backpressure middleware built from config
+func ThrottleStateHandler(w http.ResponseWriter, r *http.Request) {
+	bp := activeBackpressure.Load()
+	if bp == nil {
+		http.Error(w, ErrBackpressureOff.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	bp.ServeState(w, r)
+}
@@ -0,0 +1,61 @@
+package proxymw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottleState(t *testing.T) {
+	t.Parallel()
+	load := BackpressureQuery{
+		Name: "load", Query: "load", WarningThreshold: 10, EmergencyThreshold: 20, ThrottlingCurve: 1,
+	}
+	errs := BackpressureQuery{
+		Name: "errors", Query: "errors", WarningThreshold: 10, EmergencyThreshold: 20,
+	}
+	bp := newBackpressure(&Mocker{}, BackpressureConfig{
+		CongestionWindowMin:       1,
+		CongestionWindowMax:       10,
+		BackpressureMonitoringURL: "http://prometheus",
+		BackpressureQueries:       []BackpressureQuery{load, errs},
+	}, newBackpressureMetrics(promauto.With(prometheus.NewRegistry())))
+
+	fetch := func(_ context.Context, _ *http.Client, _, query string) (float64, error) {
+		if query == "errors" {
+			return 0, errors.New("monitor down")
+		}
+		return 20, nil
+	}
+	bp.poll(context.Background(), &signal{query: load, fetch: fetch, smoothed: &ewma{}})
+	bp.poll(context.Background(), &signal{query: errs, fetch: fetch, smoothed: &ewma{}})
+
+	w := httptest.NewRecorder()
+	bp.ServeState(w, httptest.NewRequest(http.MethodGet, ThrottleStatePath, http.NoBody))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var state ThrottleState
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&state))
+	value := 20.0
+	require.Equal(t, ThrottleState{
+		Watermark: 1,
+		Min:       1,
+		Max:       10,
+		Allowance: 0,
+		Queries: []QueryState{
+			{Name: "load", Query: "load", Value: &value, ThrottlePercent: 1},
+			{Name: "errors", Query: "errors", Failing: true},
+		},
+	}, state)
+
+	require.NoError(t, bp.RemoveQuery("load"))
+	require.Len(t, bp.State().Queries, 1)
+	require.Empty(t, bp.values)
+}
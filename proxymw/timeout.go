@@ -0,0 +1,187 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const TimeoutProxyType = "timeout"
+
+var (
+	ErrInvalidCriticalityTimeout = errors.New(
+		"criticality timeouts must be keyed by a known criticality and cannot be negative",
+	)
+	ErrInvalidDeadlineHeader = errors.New("invalid request deadline header")
+)
+
+// TimeoutConfig gives each request criticality its own deadline, e.g. a short one for
+// SHEDDABLE dashboards and a long one for CRITICAL_PLUS alerting queries.
+type TimeoutConfig struct {
+	// EnableTimeouts replaces the ClientTimeout of the ServeEntry with the Timeout middleware.
+	// ClientTimeout still applies to criticalities without a timeout.
+	EnableTimeouts bool `yaml:"enable_timeouts"`
+	// CriticalityTimeouts maps an X-Request-Criticality value to its timeout. Zero disables the
+	// timeout for that criticality.
+	CriticalityTimeouts map[string]time.Duration `yaml:"criticality_timeouts"`
+	// EnableDeadlineHeaders derives the request deadline from the X-Request-Deadline or
+	// X-Timeout-Ms header of the client, whichever is set, when it is earlier than the timeout.
+	// Requests whose deadline already passed are rejected without reaching the upstream.
+	EnableDeadlineHeaders bool `yaml:"enable_deadline_headers"`
+}
+
+func (c TimeoutConfig) Validate() error {
+	if !c.EnableTimeouts {
+		return nil
+	}
+
+	for criticality, timeout := range c.CriticalityTimeouts {
+		if !criticalities[criticality] || timeout < 0 {
+			return fmt.Errorf("%w: %s=%s", ErrInvalidCriticalityTimeout, criticality, timeout)
+		}
+	}
+	return nil
+}
+
+// Timeout bounds how long a request may spend in the rest of the chain and upstream based on
+// its criticality and deadline headers. Requests with an unknown criticality get the fallback
+// timeout.
+type Timeout struct {
+	client          ProxyClient
+	timeouts        map[string]time.Duration
+	fallback        time.Duration
+	deadlineHeaders bool
+	now             func() time.Time
+}
+
+var _ ProxyClient = &Timeout{}
+
+// NewTimeout applies the criticality timeouts, falling back to the given timeout, when
+// EnableTimeouts is set. Otherwise only deadline headers are applied.
+func NewTimeout(client ProxyClient, cfg TimeoutConfig, fallback time.Duration) *Timeout {
+	to := &Timeout{
+		client:          client,
+		deadlineHeaders: cfg.EnableDeadlineHeaders,
+		now:             time.Now,
+	}
+	if cfg.EnableTimeouts {
+		to.timeouts = cfg.CriticalityTimeouts
+		to.fallback = fallback
+	}
+	return to
+}
+
+func (to *Timeout) Init(ctx context.Context) error {
+	return to.client.Init(ctx)
+}
+
+func (to *Timeout) Next(rr Request) error {
+	now := to.now()
+	deadline, err := to.deadline(rr, now)
+	if err != nil {
+		return err
+	}
+
+	if deadline.IsZero() {
+		return to.client.Next(rr)
+	}
+
+	if !deadline.After(now) {
+		return BlockErr(TimeoutProxyType, "request deadline passed %s ago", now.Sub(deadline))
+	}
+
+	req := rr.Request()
+	ctx, cancel := context.WithDeadline(req.Context(), deadline)
+	next := &RequestResponseWrapper{req: req.WithContext(ctx)}
+	if rrw, ok := rr.(ResponseWriter); ok {
+		next.w = rrw.ResponseWriter()
+	}
+
+	err = to.client.Next(next)
+	res, ok := rr.(Response)
+	if !ok || next.Response() == nil {
+		cancel()
+		return err
+	}
+
+	// round tripped responses are read after Next returns so the deadline lasts until close
+	if body := next.Response().Body; body != nil {
+		next.Response().Body = &cancelBody{ReadCloser: body, cancel: cancel}
+	} else {
+		cancel()
+	}
+	res.SetResponse(next.Response())
+	return err
+}
+
+// deadline is the earliest of the criticality timeout and the client deadline, or zero for none
+func (to *Timeout) deadline(rr Request, now time.Time) (time.Time, error) {
+	var deadline time.Time
+	if timeout := to.timeout(rr); timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+
+	if !to.deadlineHeaders {
+		return deadline, nil
+	}
+
+	client, err := clientDeadline(rr, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if deadline.IsZero() || (!client.IsZero() && client.Before(deadline)) {
+		return client, nil
+	}
+	return deadline, nil
+}
+
+// clientDeadline reads the deadline from the X-Request-Deadline or X-Timeout-Ms header
+func clientDeadline(rr Request, now time.Time) (time.Time, error) {
+	if value := ParseHeaderKey(rr, HeaderRequestDeadline); value != "" {
+		if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.UnixMilli(millis), nil
+		}
+
+		deadline, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w %s: %q", ErrInvalidDeadlineHeader, HeaderRequestDeadline, value)
+		}
+		return deadline, nil
+	}
+
+	if value := ParseHeaderKey(rr, HeaderTimeoutMs); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w %s: %q", ErrInvalidDeadlineHeader, HeaderTimeoutMs, value)
+		}
+		return now.Add(time.Duration(millis) * time.Millisecond), nil
+	}
+	return time.Time{}, nil
+}
+
+func (to *Timeout) timeout(rr Request) time.Duration {
+	criticality, err := ParseCriticality(rr)
+	if err != nil {
+		return to.fallback
+	}
+
+	if timeout, ok := to.timeouts[criticality]; ok {
+		return timeout
+	}
+	return to.fallback
+}
+
+// cancelBody releases the request context once the response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,174 @@
+package proxymw
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutConfigValidate(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, TimeoutConfig{}.Validate())
+	require.NoError(t, TimeoutConfig{
+		EnableTimeouts:      true,
+		CriticalityTimeouts: map[string]time.Duration{CriticalitySheddable: time.Second},
+	}.Validate())
+	require.ErrorIs(t, TimeoutConfig{
+		EnableTimeouts:      true,
+		CriticalityTimeouts: map[string]time.Duration{"LOW": time.Second},
+	}.Validate(), ErrInvalidCriticalityTimeout)
+	require.ErrorIs(t, TimeoutConfig{
+		EnableTimeouts:      true,
+		CriticalityTimeouts: map[string]time.Duration{CriticalityCritical: -time.Second},
+	}.Validate(), ErrInvalidCriticalityTimeout)
+}
+
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+	cfg := TimeoutConfig{
+		EnableTimeouts: true,
+		CriticalityTimeouts: map[string]time.Duration{
+			CriticalitySheddable:    10 * time.Second,
+			CriticalityCriticalPlus: 0,
+		},
+	}
+
+	for _, tt := range []struct {
+		name        string
+		criticality string
+		want        time.Duration
+	}{
+		{name: "configured criticality", criticality: CriticalitySheddable, want: 10 * time.Second},
+		{name: "fallback to client timeout", criticality: CriticalityCritical, want: time.Minute},
+		{name: "unknown criticality", criticality: "LOW", want: time.Minute},
+		{name: "disabled timeout", criticality: CriticalityCriticalPlus},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got time.Duration
+			to := NewTimeout(&Mocker{NextFunc: func(rr Request) error {
+				if deadline, ok := rr.Request().Context().Deadline(); ok {
+					got = time.Until(deadline).Round(time.Second)
+				}
+				return nil
+			}}, cfg, time.Minute)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+			req.Header.Set(string(HeaderCriticality), tt.criticality)
+			require.NoError(t, to.Next(&RequestResponseWrapper{req: req}))
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTimeoutRoundTrip(t *testing.T) {
+	t.Parallel()
+	var ctx context.Context
+	to := NewTimeout(&RoundTripperExit{transport: &Mocker{
+		RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			ctx = r.Context()
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("ok")),
+			}, nil
+		},
+	}}, TimeoutConfig{EnableTimeouts: true}, time.Minute)
+
+	rr := &RequestResponseWrapper{
+		req: httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody),
+	}
+	require.NoError(t, to.Next(rr))
+
+	// the deadline stays open while the body is read
+	require.NoError(t, ctx.Err())
+	body, err := io.ReadAll(rr.Response().Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+
+	require.NoError(t, rr.Response().Body.Close())
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestTimeoutDeadlineHeaders(t *testing.T) {
+	t.Parallel()
+	now := time.Now().Truncate(time.Millisecond)
+	for _, tt := range []struct {
+		name    string
+		headers map[HeaderKey]string
+		want    time.Duration
+		blocked bool
+		wantErr error
+	}{
+		{name: "no headers falls back to the timeout", want: time.Minute},
+		{
+			name:    "timeout ms",
+			headers: map[HeaderKey]string{HeaderTimeoutMs: "1500"},
+			want:    1500 * time.Millisecond,
+		},
+		{
+			name: "absolute deadline in unix millis",
+			headers: map[HeaderKey]string{
+				HeaderRequestDeadline: strconv.FormatInt(now.Add(2*time.Second).UnixMilli(), 10),
+			},
+			want: 2 * time.Second,
+		},
+		{
+			name: "absolute deadline in RFC 3339",
+			headers: map[HeaderKey]string{
+				HeaderRequestDeadline: now.Add(3 * time.Second).Format(time.RFC3339Nano),
+			},
+			want: 3 * time.Second,
+		},
+		{
+			name:    "client deadline after the timeout",
+			headers: map[HeaderKey]string{HeaderTimeoutMs: "3600000"},
+			want:    time.Minute,
+		},
+		{
+			name:    "deadline passed",
+			headers: map[HeaderKey]string{HeaderTimeoutMs: "-5"},
+			blocked: true,
+		},
+		{
+			name:    "invalid header",
+			headers: map[HeaderKey]string{HeaderTimeoutMs: "soon"},
+			wantErr: ErrInvalidDeadlineHeader,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got time.Duration
+			to := NewTimeout(&Mocker{NextFunc: func(rr Request) error {
+				deadline, _ := rr.Request().Context().Deadline()
+				got = deadline.Sub(now)
+				return nil
+			}}, TimeoutConfig{EnableTimeouts: true, EnableDeadlineHeaders: true}, time.Minute)
+			to.now = func() time.Time { return now }
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+			for key, value := range tt.headers {
+				req.Header.Set(string(key), value)
+			}
+
+			err := to.Next(&RequestResponseWrapper{req: req})
+			switch {
+			case tt.blocked:
+				var blocked *RequestBlockedError
+				require.ErrorAs(t, err, &blocked)
+				require.Equal(t, TimeoutProxyType, blocked.Type)
+			case tt.wantErr != nil:
+				require.ErrorIs(t, err, tt.wantErr)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
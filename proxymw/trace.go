@@ -0,0 +1,61 @@
+package proxymw
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// HeaderTraceparent is the W3C trace context header
+	HeaderTraceparent = "Traceparent"
+	// HeaderB3TraceID and HeaderB3 are the multi and single header forms of Zipkin B3 propagation
+	HeaderB3TraceID = "X-B3-Traceid"
+	HeaderB3        = "B3"
+	// ExemplarTraceIDLabel is the exemplar label Grafana links to traces
+	ExemplarTraceIDLabel = "trace_id"
+)
+
+// traceID returns the trace ID of the request from an OpenTelemetry span in its context, its
+// W3C traceparent header, or its B3 headers. Returns an empty string for untraced requests.
+// The headers are forwarded upstream untouched so no tracing SDK is needed to correlate requests.
+func traceID(req *http.Request) string {
+	if sc := trace.SpanContextFromContext(req.Context()); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+
+	// traceparent is version-traceid-parentid-flags, e.g. 00-<32 hex>-<16 hex>-01
+	if parts := strings.Split(req.Header.Get(HeaderTraceparent), "-"); len(parts) == 4 {
+		if id := validTraceID(parts[1]); id != "" {
+			return id
+		}
+	}
+
+	if id := validTraceID(req.Header.Get(HeaderB3TraceID)); id != "" {
+		return id
+	}
+
+	// single header B3 is traceid-spanid[-sampled[-parentspanid]], or only the sampling state
+	b3, _, _ := strings.Cut(req.Header.Get(HeaderB3), "-")
+	return validTraceID(b3)
+}
+
+// validTraceID normalizes a 32 or 16 hex character trace ID to 32 lowercase characters, or
+// returns an empty string when it is malformed or all zeros. B3 allows 64-bit trace IDs which are
+// left padded with zeros like OpenTelemetry does.
+func validTraceID(id string) string {
+	if len(id) == 16 {
+		id = strings.Repeat("0", 16) + id
+	}
+	if len(id) != 32 {
+		return ""
+	}
+
+	decoded, err := hex.DecodeString(id)
+	if err != nil || trace.TraceID(decoded) == (trace.TraceID{}) {
+		return ""
+	}
+	return strings.ToLower(id)
+}
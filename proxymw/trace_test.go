@@ -0,0 +1,101 @@
+package proxymw
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceID(t *testing.T) {
+	t.Parallel()
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x0a, 0xf7, 0x65, 0x19},
+		SpanID:  trace.SpanID{0x01},
+	})
+
+	for _, tt := range []struct {
+		name        string
+		ctx         context.Context
+		traceparent string
+		headers     map[string]string
+		want        string
+	}{
+		{
+			name: "untraced",
+			ctx:  context.Background(),
+		},
+		{
+			name:        "traceparent header",
+			ctx:         context.Background(),
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:        "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:        "span context preferred over header",
+			ctx:         trace.ContextWithSpanContext(context.Background(), spanCtx),
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:        "0af76519000000000000000000000000",
+		},
+		{
+			name:        "zero trace id",
+			ctx:         context.Background(),
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "malformed trace id",
+			ctx:         context.Background(),
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "missing fields",
+			ctx:         context.Background(),
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:    "b3 multi header",
+			ctx:     context.Background(),
+			headers: map[string]string{HeaderB3TraceID: "4BF92F3577B34DA6A3CE929D0E0E4736"},
+			want:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:    "b3 64-bit trace id",
+			ctx:     context.Background(),
+			headers: map[string]string{HeaderB3TraceID: "a3ce929d0e0e4736"},
+			want:    "0000000000000000a3ce929d0e0e4736",
+		},
+		{
+			name:    "b3 single header",
+			ctx:     context.Background(),
+			headers: map[string]string{HeaderB3: "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"},
+			want:    "80f198ee56343ba864fe8b2a57d3eff7",
+		},
+		{
+			name:    "b3 sampling state only",
+			ctx:     context.Background(),
+			headers: map[string]string{HeaderB3: "0"},
+		},
+		{
+			name:        "traceparent preferred over b3",
+			ctx:         context.Background(),
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			headers:     map[string]string{HeaderB3TraceID: "a3ce929d0e0e4736"},
+			want:        "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.NewRequestWithContext(tt.ctx, http.MethodGet, "http://prometheus", http.NoBody)
+			require.NoError(t, err)
+			if tt.traceparent != "" {
+				req.Header.Set(HeaderTraceparent, tt.traceparent)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			require.Equal(t, tt.want, traceID(req))
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	WarmupProxyType = "warmup"
+
+	DefaultWarmupMinConcurrency = 1
+	DefaultWarmupMaxConcurrency = 1000
+)
+
+var defaultWarmupMetrics = newWarmupMetrics(defaultMetricsFactory)
+
+// warmupMetrics are the collectors of the WarmupLimiter of one middleware chain
+type warmupMetrics struct {
+	limitGauge prometheus.Gauge
+}
+
+func newWarmupMetrics(factory promauto.Factory) *warmupMetrics {
+	return &warmupMetrics{
+		limitGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "proxymw_warmup_limit",
+			Help: "Concurrency limit of the slow-start ramp, 0 once the upstream is warmed up",
+		}),
+	}
+}
+
+// WarmupConfig ramps the admitted concurrency from a minimum to a maximum after the process
+// starts, so cold caches and connection pools of the upstream are not hit by the full load at
+// once. The ramp is time based and independent of the backpressure signals. It restarts when
+// the upstream recovers from a run of consecutive failures.
+type WarmupConfig struct {
+	EnableWarmup bool `yaml:"enable_warmup"`
+	// WarmupDuration is how long the limit takes to ramp from min to max
+	WarmupDuration time.Duration `yaml:"warmup_duration"`
+	// WarmupMinConcurrency is the limit at the start of the ramp. Defaults to 1.
+	WarmupMinConcurrency int `yaml:"warmup_min_concurrency"`
+	// WarmupMaxConcurrency is the limit at the end of the ramp. Defaults to 1000.
+	WarmupMaxConcurrency int `yaml:"warmup_max_concurrency"`
+	// WarmupAfterFailures restarts the ramp at the first success after this many consecutive
+	// upstream errors or 5xx responses. Zero only ramps after startup.
+	WarmupAfterFailures int `yaml:"warmup_after_failures"`
+}
+
+func (c WarmupConfig) Validate() error {
+	if !c.EnableWarmup {
+		return nil
+	}
+
+	if c.WarmupDuration <= 0 {
+		return ErrWarmupDurationRequired
+	}
+
+	if c.WarmupMinConcurrency < 0 || c.WarmupMaxConcurrency < 0 || c.WarmupAfterFailures < 0 {
+		return ErrNegativeWarmup
+	}
+
+	if c.max() < c.min() {
+		return ErrWarmupMaxBelowMin
+	}
+	return nil
+}
+
+func (c WarmupConfig) min() int {
+	if c.WarmupMinConcurrency == 0 {
+		return DefaultWarmupMinConcurrency
+	}
+	return c.WarmupMinConcurrency
+}
+
+func (c WarmupConfig) max() int {
+	if c.WarmupMaxConcurrency == 0 {
+		return DefaultWarmupMaxConcurrency
+	}
+	return c.WarmupMaxConcurrency
+}
+
+// WarmupLimiter rejects requests once the in-flight count reaches a limit growing linearly from
+// min to max over the warm-up duration. After the ramp it only counts upstream failures, and
+// a success following WarmupAfterFailures consecutive failures starts a new ramp.
+type WarmupLimiter struct {
+	client        ProxyClient
+	min, max      int
+	duration      time.Duration
+	afterFailures int
+	now           func() time.Time
+
+	mu       sync.Mutex
+	start    time.Time
+	inflight int
+	failures int
+
+	limitGauge prometheus.Gauge
+}
+
+var _ ProxyClient = &WarmupLimiter{}
+
+func NewWarmupLimiter(client ProxyClient, cfg WarmupConfig) *WarmupLimiter {
+	return newWarmupLimiter(client, cfg, defaultWarmupMetrics)
+}
+
+func newWarmupLimiter(client ProxyClient, cfg WarmupConfig, m *warmupMetrics) *WarmupLimiter {
+	return &WarmupLimiter{
+		client:        client,
+		min:           cfg.min(),
+		max:           cfg.max(),
+		duration:      cfg.WarmupDuration,
+		afterFailures: cfg.WarmupAfterFailures,
+		now:           time.Now,
+		limitGauge:    m.limitGauge,
+	}
+}
+
+func (wl *WarmupLimiter) Init(ctx context.Context) error {
+	wl.mu.Lock()
+	wl.start = wl.now()
+	wl.limitGauge.Set(float64(wl.min))
+	wl.mu.Unlock()
+	return wl.client.Init(ctx)
+}
+
+func (wl *WarmupLimiter) Next(rr Request) error {
+	if err := wl.acquire(); err != nil {
+		return err
+	}
+
+	next, w := rr, (*statusWriter)(nil)
+	if rrw, ok := rr.(ResponseWriter); ok && rrw.ResponseWriter() != nil {
+		w = &statusWriter{ResponseWriter: rrw.ResponseWriter()}
+		next = &RequestResponseWrapper{req: rr.Request(), w: w}
+	}
+
+	err := wl.client.Next(next)
+	wl.release(upstreamFailed(rr, w, err))
+	return err
+}
+
+// upstreamFailed reports whether the upstream errored or answered with a 5xx. Requests blocked
+// further down the chain never reached the upstream and count as neither.
+func upstreamFailed(rr Request, w *statusWriter, err error) bool {
+	var blocked *RequestBlockedError
+	switch {
+	case errors.As(err, &blocked):
+		return false
+	case err != nil:
+		return true
+	case w != nil:
+		return w.code() >= http.StatusInternalServerError
+	}
+
+	if res, ok := rr.(Response); ok && res.Response() != nil {
+		return res.Response().StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+func (wl *WarmupLimiter) acquire() error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	limit, warming := wl.limit(wl.now())
+	if warming && wl.inflight >= limit {
+		return BlockErr(WarmupProxyType, "warm-up concurrency limit %d reached", limit)
+	}
+
+	wl.inflight++
+	return nil
+}
+
+func (wl *WarmupLimiter) release(failed bool) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	wl.inflight--
+
+	if failed {
+		wl.failures++
+		return
+	}
+
+	if wl.afterFailures > 0 && wl.failures >= wl.afterFailures {
+		wl.start = wl.now()
+		wl.limitGauge.Set(float64(wl.min))
+	}
+	wl.failures = 0
+}
+
+// limit returns the concurrency limit at now and whether the ramp is still in progress.
+// Assumes the callsite already holds the lock.
+func (wl *WarmupLimiter) limit(now time.Time) (int, bool) {
+	elapsed := now.Sub(wl.start)
+	if elapsed >= wl.duration {
+		wl.limitGauge.Set(0)
+		return wl.max, false
+	}
+
+	limit := wl.min + int(int64(wl.max-wl.min)*int64(elapsed)/int64(wl.duration))
+	wl.limitGauge.Set(float64(limit))
+	return limit, true
+}
+
+// Limit returns the current concurrency limit, which is the maximum once warmed up
+func (wl *WarmupLimiter) Limit() int {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	limit, _ := wl.limit(wl.now())
+	return limit
+}
@@ -0,0 +1,148 @@
+package proxymw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmupConfigValidate(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		cfg  WarmupConfig
+		want error
+	}{
+		{
+			name: "defaults",
+			cfg:  WarmupConfig{EnableWarmup: true, WarmupDuration: time.Minute},
+		},
+		{
+			name: "disabled ignores values",
+			cfg:  WarmupConfig{WarmupMinConcurrency: -1},
+		},
+		{
+			name: "missing duration",
+			cfg:  WarmupConfig{EnableWarmup: true},
+			want: ErrWarmupDurationRequired,
+		},
+		{
+			name: "negative failures",
+			cfg:  WarmupConfig{EnableWarmup: true, WarmupDuration: time.Minute, WarmupAfterFailures: -1},
+			want: ErrNegativeWarmup,
+		},
+		{
+			name: "max below min",
+			cfg: WarmupConfig{
+				EnableWarmup: true, WarmupDuration: time.Minute, WarmupMinConcurrency: 10, WarmupMaxConcurrency: 5,
+			},
+			want: ErrWarmupMaxBelowMin,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.want)
+		})
+	}
+}
+
+func TestWarmupLimiter(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1_700_000_000, 0)
+	m := newWarmupMetrics(promauto.With(prometheus.NewRegistry()))
+	wl := newWarmupLimiter(&Mocker{
+		InitFunc: func(context.Context) error { return nil },
+	}, WarmupConfig{
+		WarmupDuration:       10 * time.Second,
+		WarmupMinConcurrency: 2,
+		WarmupMaxConcurrency: 12,
+	}, m)
+	wl.now = func() time.Time { return now }
+	require.NoError(t, wl.Init(context.Background()))
+
+	// holds n requests open and reports how many were admitted
+	admitted := func(n int) int {
+		count := 0
+		for range n {
+			if wl.acquire() == nil {
+				count++
+			}
+		}
+		for range count {
+			wl.release(false)
+		}
+		return count
+	}
+
+	require.Equal(t, 2, admitted(20))
+	require.InDelta(t, 2, testutil.ToFloat64(m.limitGauge), 0)
+
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 7, admitted(20))
+	require.Equal(t, 7, wl.Limit())
+
+	// the limit no longer applies once warmed up
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 20, admitted(20))
+	require.InDelta(t, 0, testutil.ToFloat64(m.limitGauge), 0)
+}
+
+func TestWarmupRestartsAfterFailures(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1_700_000_000, 0)
+	status := http.StatusServiceUnavailable
+	var upstreamErr error
+	wl := newWarmupLimiter(&Mocker{
+		InitFunc: func(context.Context) error { return nil },
+		NextFunc: func(rr Request) error {
+			rr.(ResponseWriter).ResponseWriter().WriteHeader(status)
+			return upstreamErr
+		},
+	}, WarmupConfig{
+		WarmupDuration:       10 * time.Second,
+		WarmupMinConcurrency: 1,
+		WarmupMaxConcurrency: 11,
+		WarmupAfterFailures:  3,
+	}, newWarmupMetrics(promauto.With(prometheus.NewRegistry())))
+	wl.now = func() time.Time { return now }
+	require.NoError(t, wl.Init(context.Background()))
+	now = now.Add(time.Minute)
+
+	next := func() error {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody)
+		return wl.Next(&RequestResponseWrapper{req: req, w: httptest.NewRecorder()})
+	}
+
+	// blocked requests never reached the upstream and do not count as failures
+	upstreamErr = BlockErr(BackpressureProxyType, "blocked")
+	for range 5 {
+		require.Error(t, next())
+	}
+	upstreamErr = nil
+	status = http.StatusOK
+	require.NoError(t, next())
+	require.Equal(t, 11, wl.Limit())
+
+	status = http.StatusBadGateway
+	require.NoError(t, next())
+	upstreamErr = errors.New("connection refused")
+	require.Error(t, next())
+	require.Error(t, next())
+	require.Equal(t, 11, wl.Limit())
+
+	// the first success after the failures restarts the ramp
+	upstreamErr, status = nil, http.StatusOK
+	require.NoError(t, next())
+	require.Equal(t, 1, wl.Limit())
+
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 6, wl.Limit())
+}
@@ -16,14 +16,25 @@ import (
 )
 
 type Config struct {
-	InsecureListenAddress string         `yaml:"insecure_listen_addr"`
-	InternalListenAddress string         `yaml:"internal_listen_addr"`
-	Upstream              string         `yaml:"upstream"`
-	ProxyPaths            []string       `yaml:"proxy_paths"`
-	PassthroughPaths      []string       `yaml:"passthrough_paths"`
-	ProxyConfig           proxymw.Config `yaml:"proxymw_config"`
-	ReadTimeout           time.Duration  `yaml:"proxy_read_timeout"`
-	WriteTimeout          time.Duration  `yaml:"proxy_write_timeout"`
+	InsecureListenAddress string `yaml:"insecure_listen_addr"`
+	InternalListenAddress string `yaml:"internal_listen_addr"`
+	Upstream              string `yaml:"upstream"`
+	// UpstreamWarmConnections is the number of upstream connections opened before serving traffic
+	UpstreamWarmConnections int                     `yaml:"upstream_warm_connections"`
+	UpstreamTransport       UpstreamTransportConfig `yaml:"upstream_transport"`
+	UpstreamRoutes          []UpstreamRoute         `yaml:"upstream_routes"`
+	// ProxyPaths and PassthroughPaths ending in /* match every path under the prefix
+	ProxyPaths       []string       `yaml:"proxy_paths"`
+	PassthroughPaths []string       `yaml:"passthrough_paths"`
+	PathRewrites     []PathRewrite  `yaml:"path_rewrites"`
+	PathConfigs      []PathConfig   `yaml:"path_configs"`
+	ProxyConfig      proxymw.Config `yaml:"proxymw_config"`
+	ReadTimeout      time.Duration  `yaml:"proxy_read_timeout"`
+	WriteTimeout     time.Duration  `yaml:"proxy_write_timeout"`
+	// Server applies to both the insecure and internal servers
+	Server ServerConfig `yaml:"server"`
+	// ProxyProtocol requires a PROXY protocol v1 or v2 header on insecure listener connections
+	ProxyProtocol bool `yaml:"proxy_protocol"`
 }
 
 type StringSlice []string
@@ -56,100 +67,1148 @@ func (f *Float64Slice) Set(value string) error {
 	return nil
 }
 
+// OptionalFloat64 is a float64 flag which stays nil unless it is set
+type OptionalFloat64 struct {
+	Value *float64
+}
+
+func (f *OptionalFloat64) String() string {
+	if f.Value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f.Value, 'g', -1, 64)
+}
+
+func (f *OptionalFloat64) Set(value string) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	f.Value = &v
+	return nil
+}
+
+type IntSlice []int
+
+func (s *IntSlice) String() string {
+	values := make([]string, len(*s))
+	for i, v := range *s {
+		values[i] = strconv.Itoa(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (s *IntSlice) Set(value string) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, v)
+	return nil
+}
+
 func ParseConfigFlags() (Config, error) {
 	cfg := Config{}
 	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
 	var (
 		blockPatterns         StringSlice
+		blockCIDRs            StringSlice
+		allowCIDRs            StringSlice
+		trustedProxies        StringSlice
+		denyQueryPatterns     StringSlice
+		injectLabels          StringSlice
 		bpQueries             StringSlice
 		bpQueryNames          StringSlice
+		bpQueryOpts           queryOptions
+		bpMonitorHeaders      StringSlice
+		bpTenantWeights       StringSlice
+		fingerprintLimits     StringSlice
+		tenantConcurrency     StringSlice
+		upstreamHostRoutes    StringSlice
+		pathRewrites          StringSlice
+		pathMethods           StringSlice
+		pathReadTimeouts      StringSlice
+		pathWriteTimeouts     StringSlice
+		pathClientTimeouts    StringSlice
+		upstreamHeaderRoutes  StringSlice
+		criticalityTimeouts   StringSlice
+		observerPathTemplates StringSlice
+		metricsConstLabels    StringSlice
+		recordHeaders         StringSlice
 		bpWarnThresholds      Float64Slice
 		bpEmergencyThresholds Float64Slice
+		mirrorPercent         OptionalFloat64
 		proxyPaths            string
+		middlewareOrder       string
+		bpMonitoringURLs      string
 		passthroughPaths      string
 		configFile            string
 	)
-
-	// Config file
-	flags.StringVar(&configFile, "config-file", "", "Path to proxy configuration file")
-
-	// Server settings
+
+	// Config file
+	flags.StringVar(&configFile, "config-file", "", "Path to proxy configuration file")
+
+	// Server settings
+	flags.StringVar(
+		&cfg.InsecureListenAddress,
+		"insecure-listen-address",
+		"",
+		"HTTP proxy server listen address, unix:///path/to.sock, or systemd://[name]",
+	)
+	flags.StringVar(
+		&cfg.InternalListenAddress,
+		"internal-listen-address",
+		"",
+		"Internal metrics server listen address, unix:///path/to.sock, or systemd://[name]",
+	)
+	flags.DurationVar(&cfg.ReadTimeout, "proxy-read-timeout", 5*time.Minute, "HTTP read timeout")
+	flags.DurationVar(&cfg.WriteTimeout, "proxy-write-timeout", 5*time.Minute, "HTTP write timeout")
+	flags.IntVar(
+		&cfg.Server.MaxConnections,
+		"server-max-connections",
+		0,
+		"Maximum concurrent connections accepted by each server (0 for no limit)",
+	)
+	flags.DurationVar(
+		&cfg.Server.IdleTimeout,
+		"server-idle-timeout",
+		0,
+		"How long idle keep-alive connections are kept open (0 for the read timeout)",
+	)
+	flags.DurationVar(
+		&cfg.Server.ReadHeaderTimeout,
+		"server-read-header-timeout",
+		0,
+		"Time allowed to read request headers (0 for the read timeout)",
+	)
+	flags.DurationVar(
+		&cfg.Server.KeepAlivePeriod,
+		"server-keep-alive-period",
+		0,
+		"Interval of TCP keep-alive probes on accepted connections (0 for 15s, negative disables)",
+	)
+	flags.BoolVar(
+		&cfg.Server.DisableKeepAlives,
+		"server-disable-keep-alives",
+		false,
+		"Close client connections after each request instead of reusing them",
+	)
+	flags.BoolVar(
+		&cfg.ProxyProtocol,
+		"proxy-protocol",
+		false,
+		"Require a PROXY protocol v1 or v2 header from the load balancer on every proxy connection",
+	)
+	flags.StringVar(
+		&cfg.Upstream,
+		"upstream",
+		"",
+		"Upstream URL to proxy to, or dnssrv+<url> to balance across the targets of an SRV record",
+	)
+	flags.IntVar(
+		&cfg.UpstreamWarmConnections,
+		"upstream-warm-connections",
+		0,
+		"Number of upstream connections to open on startup before serving traffic",
+	)
+	flags.BoolVar(
+		&cfg.UpstreamTransport.DisableHTTP2,
+		"upstream-disable-http2",
+		false,
+		"Only speak HTTP/1.1 to TLS upstreams instead of attempting HTTP/2",
+	)
+	flags.BoolVar(
+		&cfg.UpstreamTransport.H2C,
+		"upstream-h2c",
+		false,
+		"Speak cleartext HTTP/2 (h2c) with prior knowledge to http:// upstreams",
+	)
+	flags.IntVar(
+		&cfg.UpstreamTransport.MaxConnsPerHost,
+		"upstream-max-conns-per-host",
+		0,
+		"Maximum upstream connections including idle ones (0 for no limit)",
+	)
+	flags.IntVar(
+		&cfg.UpstreamTransport.MaxIdleConnsPerHost,
+		"upstream-max-idle-conns-per-host",
+		0,
+		"Maximum idle upstream connections kept open (0 for the default transport's value)",
+	)
+	flags.DurationVar(
+		&cfg.UpstreamTransport.IdleConnTimeout,
+		"upstream-idle-conn-timeout",
+		0,
+		"How long idle upstream connections are kept open (0 for the default transport's value)",
+	)
+	flags.Var(
+		&upstreamHostRoutes,
+		"upstream-host-route",
+		"Upstream URL for requests to a Host as <host>=<upstream> (can be repeated)",
+	)
+	flags.Var(
+		&upstreamHeaderRoutes,
+		"upstream-header-route",
+		"Upstream URL for requests with a header value as <header>:<value>=<upstream> (can be repeated)",
+	)
+
+	// Feature flags
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableCriticality,
+		"enable-criticality",
+		false,
+		"Enable criticality header processing",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableAccessLog,
+		"enable-access-log",
+		false,
+		"Enable the access log of proxied and rejected requests",
+	)
+	flags.StringVar(
+		&cfg.ProxyConfig.AccessLogFormat,
+		"access-log-format",
+		"",
+		"Access log format: json or combined (default json)",
+	)
+	flags.StringVar(
+		&cfg.ProxyConfig.AccessLogFile,
+		"access-log-file",
+		"",
+		"File to write the access log to instead of the standard logger",
+	)
+	flags.IntVar(
+		&cfg.ProxyConfig.AccessLogMaxSizeMB,
+		"access-log-max-size-mb",
+		0,
+		"Size in megabytes at which the access log file is rotated (default 100)",
+	)
+	flags.IntVar(
+		&cfg.ProxyConfig.AccessLogMaxBackups,
+		"access-log-max-backups",
+		0,
+		"Number of rotated access log files to keep (default 5)",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableRecording,
+		"enable-recording",
+		false,
+		"Record a sample of proxied requests to a file for the replay command",
+	)
+	flags.StringVar(&cfg.ProxyConfig.RecordFile, "record-file", "", "File to record requests to as JSON lines")
+	flags.IntVar(
+		&cfg.ProxyConfig.RecordMaxSizeMB,
+		"record-max-size-mb",
+		0,
+		"Size in megabytes at which the record file is rotated (default 100)",
+	)
+	flags.IntVar(
+		&cfg.ProxyConfig.RecordMaxBackups,
+		"record-max-backups",
+		0,
+		"Number of rotated record files to keep (default 5)",
+	)
+	flags.Float64Var(
+		&cfg.ProxyConfig.RecordPercent,
+		"record-percent",
+		0,
+		"Percentage of requests recorded (default 100)",
+	)
+	flags.Var(
+		&recordHeaders,
+		"record-header",
+		"Request header to record (can be repeated, default the criticality and tenant headers)",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableAudit,
+		"enable-audit",
+		false,
+		"Keep recently blocked requests for the internal recent blocks API",
+	)
+	flags.IntVar(
+		&cfg.ProxyConfig.AuditSize,
+		"audit-size",
+		0,
+		"Number of recently blocked requests to keep (default 1000)",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableAuditLog,
+		"enable-audit-log",
+		false,
+		"Also log each blocked request as a JSON line",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableTimeouts,
+		"enable-timeouts",
+		false,
+		"Enable per-criticality request timeouts in place of the single client timeout",
+	)
+	flags.Var(
+		&criticalityTimeouts,
+		"criticality-timeout",
+		"Timeout of a request criticality as <criticality>=<duration> (can be repeated)",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableDeadlineHeaders,
+		"enable-deadline-headers",
+		false,
+		"Derive request deadlines from the X-Request-Deadline or X-Timeout-Ms client headers",
+	)
+	flags.BoolVar(&cfg.ProxyConfig.EnableJitter, "enable-jitter", false, "Enable request jitter")
+	flags.DurationVar(
+		&cfg.ProxyConfig.JitterDelay,
+		"jitter-delay",
+		0,
+		"Random jitter delay duration",
+	)
+	flags.StringVar(
+		(*string)(&cfg.ProxyConfig.JitterStrategy),
+		"jitter-strategy",
+		"",
+		"Jitter distribution: full (default), equal, exponential, or normal",
+	)
+	flags.DurationVar(
+		&cfg.ProxyConfig.JitterStddev,
+		"jitter-stddev",
+		0,
+		"Standard deviation for the normal jitter strategy (default delay/4)",
+	)
+	flags.DurationVar(
+		&cfg.ProxyConfig.RetryAfter,
+		"retry-after",
+		0,
+		"Retry-After header sent on blocked responses",
+	)
+	flags.StringVar(
+		&cfg.ProxyConfig.MaintenanceMode,
+		"maintenance-mode",
+		"",
+		"Maintenance mode: off (default), block to 503 proxied requests, or open to bypass middleware",
+	)
+	flags.StringVar(
+		&cfg.ProxyConfig.MaintenanceMessage,
+		"maintenance-message",
+		"",
+		"Error of requests blocked in maintenance mode",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableObserver,
+		"enable-observer",
+		false,
+		"Enable middleware metrics collection",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableObserverPathLabels,
+		"enable-observer-path-labels",
+		false,
+		"Add path and method labeled request, latency, and error metrics to the observer",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableExemplars,
+		"enable-exemplars",
+		false,
+		"Attach trace IDs of traced requests as exemplars on observer latency histograms",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableServerTiming,
+		"enable-server-timing",
+		false,
+		"Add a Server-Timing header breaking down jitter, backpressure, and upstream time",
+	)
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableDecisionHeaders,
+		"enable-decision-headers",
+		false,
+		"Add the backpressure allowance and watermark and the applied jitter to response headers",
+	)
+	flags.StringVar(
+		&middlewareOrder,
+		"middleware-order",
+		"",
+		"Comma-separated middleware types to reorder, outermost first, e.g. observer,backpressure,jitter",
+	)
+	flags.StringVar(
+		&cfg.ProxyConfig.MetricsNamespace,
+		"metrics-namespace",
+		"",
+		"Prefix for every middleware metric name, e.g. tenant_a registers tenant_a_proxymw_request_count",
+	)
+	flags.Var(
+		&metricsConstLabels,
+		"metrics-const-label",
+		"Label attached to every middleware metric, formatted as name=value (repeatable)",
+	)
+	flags.Var(
+		&observerPathTemplates,
+		"observer-path-template",
+		"Path template labeled by the observer, e.g. /api/v1/label/{name}/values (repeatable). "+
+			"Defaults to the Prometheus and Loki read APIs",
+	)
+
+	// Blocker settings
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableBlocker,
+		"enable-blocker",
+		false,
+		"Enable http header request blocking",
+	)
+	flags.Var(
+		&blockPatterns,
+		"block-pattern",
+		"Header, `param:<name>`, or `:path` with regex matcher to block. "+
+			"Ex. `X-user-agent=service-to-block.*` or `param:query=.*label_replace.*`",
+	)
+	flags.Var(
+		&blockCIDRs,
+		"block-cidr",
+		"Client IP or CIDR to block. Ex. `10.1.0.0/16`",
+	)
+	flags.Var(
+		&allowCIDRs,
+		"allow-cidr",
+		"Client IP or CIDR exempt from every block rule. Ex. `10.2.0.0/16`",
+	)
+	flags.Var(
+		&trustedProxies,
+		"trusted-proxy",
+		"Load balancer IP or CIDR whose X-Forwarded-For header is trusted. Ex. `10.0.0.0/8`",
+	)
+	flags.Var(
+		&denyQueryPatterns,
+		"deny-query-pattern",
+		"Regex matched against the raw PromQL query to block. Ex. `label_replace\\(`",
+	)
+	flags.IntVar(
+		&cfg.ProxyConfig.DecisionCacheSize,
+		"block-decision-cache-size",
+		0,
+		"Number of header values to cache block decisions for",
+	)
+
+	// Guardrail settings
+	gr := &cfg.ProxyConfig.GuardrailConfig
+	flags.BoolVar(
+		&gr.EnableGuardrails,
+		"enable-guardrails",
+		false,
+		"Reject range queries exceeding the range, step, or points per series limits",
+	)
+	flags.DurationVar(
+		&gr.MaxQueryRange,
+		"max-query-range",
+		0,
+		"Maximum time range of a range query, e.g. 744h for 31 days (0 for no limit)",
+	)
+	flags.DurationVar(
+		&gr.MinQueryStep,
+		"min-query-step",
+		0,
+		"Minimum step of a range query (0 for no limit)",
+	)
+	flags.IntVar(
+		&gr.MaxPointsPerSeries,
+		"max-points-per-series",
+		0,
+		"Maximum points per series a range query may return (default 11000)",
+	)
+	flags.BoolVar(
+		&gr.ValidateQuerySyntax,
+		"validate-query-syntax",
+		false,
+		"Reject queries which are not valid PromQL with a 400 before they reach the upstream",
+	)
+
+	// Label injection settings
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableLabelInjection,
+		"enable-label-injection",
+		false,
+		"Inject label matchers into every proxied PromQL selector",
+	)
+	flags.Var(
+		&injectLabels,
+		"inject-label",
+		"Label matcher to inject into PromQL. Ex. `cluster=us-east-1`",
+	)
+
+	// Tenant stats settings
+	ts := &cfg.ProxyConfig.TenantStatsConfig
+	flags.BoolVar(
+		&ts.EnableTenantStats,
+		"enable-tenant-stats",
+		false,
+		"Aggregate per-tenant request summaries served on the internal /api/v1/tenants endpoint",
+	)
+	flags.StringVar(
+		&ts.TenantHeader,
+		"tenant-header",
+		"",
+		"Header identifying the request tenant (default X-Scope-OrgID)",
+	)
+	flags.DurationVar(
+		&ts.TenantStatsWindow,
+		"tenant-stats-window",
+		0,
+		"Sliding window for tenant summaries (default 5m)",
+	)
+	flags.IntVar(
+		&ts.TopFingerprints,
+		"top-fingerprints",
+		0,
+		"Number of top query fingerprints reported per tenant (default 10)",
+	)
+
+	// Rate limit settings
+	rl := &cfg.ProxyConfig.RateLimitConfig
+	flags.BoolVar(&rl.EnableRateLimit, "enable-rate-limit", false, "Enable per-tenant rate limiting")
+	flags.StringVar(
+		&rl.RateLimitHeader,
+		"rate-limit-header",
+		"",
+		"Header identifying the rate limited tenant (default X-Scope-OrgID)",
+	)
+	flags.BoolVar(
+		&rl.RateLimitByClientIP,
+		"rate-limit-by-client-ip",
+		false,
+		"Rate limit each client IP, resolved through trusted proxies, instead of each tenant",
+	)
+	flags.IntVar(&rl.RateLimit, "rate-limit", 0, "Requests each tenant may send per window")
+	flags.DurationVar(
+		&rl.RateLimitWindow,
+		"rate-limit-window",
+		0,
+		"Fixed window for per-tenant rate limits (default 1s)",
+	)
+	flags.StringVar(
+		&rl.RedisAddr,
+		"redis-addr",
+		"",
+		"Redis address to share rate limits across replicas. Falls back to local limits when down",
+	)
+	flags.StringVar(
+		&rl.RedisKeyPrefix,
+		"redis-key-prefix",
+		"",
+		"Prefix for Redis counter keys (default throttle-proxy)",
+	)
+	flags.DurationVar(
+		&rl.RedisTimeout,
+		"redis-timeout",
+		0,
+		"Timeout for Redis calls before falling back to local limits (default 50ms)",
+	)
+
+	// Fingerprint limit settings
+	fl := &cfg.ProxyConfig.FingerprintLimitConfig
+	flags.BoolVar(
+		&fl.EnableFingerprintLimit,
+		"enable-fingerprint-limit",
+		false,
+		"Enable rate limiting of normalized query fingerprints",
+	)
+	flags.Float64Var(
+		&fl.FingerprintQPS,
+		"fingerprint-qps",
+		0,
+		"QPS each query fingerprint may reach (0 to only limit --fingerprint-limit queries)",
+	)
+	flags.Var(
+		&fingerprintLimits,
+		"fingerprint-limit",
+		"QPS limit of the fingerprint of a query as <qps>=<query> (can be repeated)",
+	)
+
+	// Tenant concurrency settings
+	tc := &cfg.ProxyConfig.TenantConcurrencyConfig
+	flags.BoolVar(
+		&tc.EnableTenantConcurrency,
+		"enable-tenant-concurrency",
+		false,
+		"Enable limiting the requests each tenant has in flight",
+	)
+	flags.StringVar(
+		&tc.TenantConcurrencyHeader,
+		"tenant-concurrency-header",
+		"",
+		"Header identifying the tenant of a request (default X-Scope-OrgID)",
+	)
+	flags.IntVar(
+		&tc.MaxTenantConcurrency,
+		"max-tenant-concurrency",
+		0,
+		"Maximum in-flight requests of each tenant",
+	)
+	flags.Var(
+		&tenantConcurrency,
+		"tenant-concurrency-limit",
+		"In-flight limit of a tenant as <tenant>=<limit> (can be repeated)",
+	)
+
+	// Cost feedback settings
+	cf := &cfg.ProxyConfig.CostFeedbackConfig
+	flags.BoolVar(
+		&cf.EnableCostFeedback,
+		"enable-cost-feedback",
+		false,
+		"Calibrate query costs from the samples Prometheus reports reading per query fingerprint",
+	)
+	flags.Int64Var(
+		&cf.SamplesPerCostUnit,
+		"cost-feedback-samples-per-unit",
+		0,
+		"Observed samples per query cost unit (default 100000)",
+	)
+
+	// Mirror settings
+	mc := &cfg.ProxyConfig.MirrorConfig
+	flags.BoolVar(
+		&mc.EnableMirror,
+		"enable-mirror",
+		false,
+		"Mirror a sample of admitted requests to a secondary upstream, discarding the responses",
+	)
+	flags.StringVar(&mc.MirrorUpstream, "mirror-upstream", "", "Upstream URL to mirror requests to")
+	flags.Var(
+		&mirrorPercent,
+		"mirror-percent",
+		"Percentage of requests to mirror, 0 mirrors none (default 100)",
+	)
+	flags.IntVar(
+		&mc.MirrorConcurrency,
+		"mirror-concurrency",
+		0,
+		"Maximum mirrored requests in flight, requests over it are not mirrored (default 10)",
+	)
+
+	flags.BoolVar(
+		&cfg.ProxyConfig.EnableStepAlignment,
+		"enable-step-alignment",
+		false,
+		"Round the start and end of range queries down to a multiple of the step for upstream caching",
+	)
+
+	// Shard settings
+	sc := &cfg.ProxyConfig.ShardConfig
+	flags.BoolVar(
+		&sc.EnableSharding,
+		"enable-sharding",
+		false,
+		"Split long range queries into sub-range queries and merge their results",
+	)
+	flags.DurationVar(
+		&sc.ShardInterval,
+		"shard-interval",
+		0,
+		"Longest range of each sub-range query (default 24h)",
+	)
+	flags.IntVar(
+		&sc.ShardConcurrency,
+		"shard-concurrency",
+		0,
+		"Maximum sub-range queries of one request in flight (default 4)",
+	)
+
+	// Chaos settings
+	chc := &cfg.ProxyConfig.ChaosConfig
+	flags.BoolVar(
+		&chc.EnableChaos,
+		"enable-chaos",
+		false,
+		"Inject latency, errors, or dropped connections into a sample of requests to test clients",
+	)
+	flags.StringVar(
+		&chc.ChaosHeader,
+		"chaos-header",
+		"",
+		"Only inject faults into requests carrying this header (default every request)",
+	)
+	flags.DurationVar(&chc.ChaosLatency, "chaos-latency", 0, "Latency added to delayed requests")
+	flags.Float64Var(
+		&chc.ChaosLatencyPercent,
+		"chaos-latency-percent",
+		0,
+		"Percentage of requests delayed by the chaos latency",
+	)
+	flags.Float64Var(
+		&chc.ChaosErrorPercent,
+		"chaos-error-percent",
+		0,
+		"Percentage of requests answered with the chaos error status",
+	)
+	flags.IntVar(
+		&chc.ChaosErrorStatus,
+		"chaos-error-status",
+		0,
+		"Status code of injected errors (default 503)",
+	)
+	flags.Float64Var(
+		&chc.ChaosDropPercent,
+		"chaos-drop-percent",
+		0,
+		"Percentage of requests whose connection is closed without a response",
+	)
+
+	// Query cost cache settings
+	qcc := &cfg.ProxyConfig.QueryCostCacheConfig
+	flags.BoolVar(
+		&qcc.EnableQueryCostCache,
+		"enable-query-cost-cache",
+		false,
+		"Cache parsed query lookbacks so repeated queries skip PromQL parsing when estimating cost",
+	)
+	flags.IntVar(
+		&qcc.QueryCostCacheSize,
+		"query-cost-cache-size",
+		0,
+		"Number of queries kept in the query cost cache (default 10000)",
+	)
+
+	// Quota settings
+	qc := &cfg.ProxyConfig.QuotaConfig
+	flags.BoolVar(&qc.EnableQuotas, "enable-quotas", false, "Enable per-tenant hourly and daily quotas")
+	flags.StringVar(
+		&qc.QuotaHeader,
+		"quota-header",
+		"",
+		"Header identifying the tenant a quota applies to (default X-Scope-OrgID)",
+	)
+	flags.Int64Var(
+		&qc.DefaultQuota.RequestsPerHour,
+		"quota-requests-per-hour",
+		0,
+		"Requests each tenant may send per hour (0 for unlimited)",
+	)
+	flags.Int64Var(
+		&qc.DefaultQuota.RequestsPerDay,
+		"quota-requests-per-day",
+		0,
+		"Requests each tenant may send per UTC day (0 for unlimited)",
+	)
+	flags.Int64Var(
+		&qc.DefaultQuota.CostPerHour,
+		"quota-cost-per-hour",
+		0,
+		"Query cost each tenant may spend per hour (0 for unlimited)",
+	)
+	flags.Int64Var(
+		&qc.DefaultQuota.CostPerDay,
+		"quota-cost-per-day",
+		0,
+		"Query cost each tenant may spend per UTC day (0 for unlimited)",
+	)
+	flags.StringVar(
+		&qc.QuotaRedisAddr,
+		"quota-redis-addr",
+		"",
+		"Redis address persisting quota usage across restarts and replicas",
+	)
+
+	// Remote-write settings
+	rw := &cfg.ProxyConfig.RemoteWriteConfig
+	flags.BoolVar(
+		&rw.EnableRemoteWriteLimit,
+		"enable-remote-write-limit",
+		false,
+		"Enable limiting the samples per second of remote-write requests",
+	)
+	flags.StringVar(
+		&rw.RemoteWritePath,
+		"remote-write-path",
+		"",
+		"Path of remote-write requests (default /api/v1/write)",
+	)
+	flags.Float64Var(
+		&rw.MaxSamplesPerSecond,
+		"max-samples-per-second",
+		0,
+		"Samples per second admitted on the remote-write path, scaled by the backpressure allowance",
+	)
+
+	// Adaptive concurrency limit settings
+	al := &cfg.ProxyConfig.AdaptiveLimitConfig
+	flags.BoolVar(
+		&al.EnableAdaptiveLimit,
+		"enable-adaptive-limit",
+		false,
+		"Enable the concurrency limit derived from upstream throughput and latency",
+	)
+	flags.IntVar(&al.AdaptiveLimitMin, "adaptive-limit-min", 0, "Minimum concurrency limit (default 1)")
+	flags.IntVar(
+		&al.AdaptiveLimitMax,
+		"adaptive-limit-max",
+		0,
+		"Maximum and starting concurrency limit (default 1000)",
+	)
+	flags.DurationVar(
+		&al.AdaptiveLimitWindow,
+		"adaptive-limit-window",
+		0,
+		"How often throughput and latency are measured to update the limit (default 1s)",
+	)
+	flags.Float64Var(
+		&al.AdaptiveLimitTolerance,
+		"adaptive-limit-tolerance",
+		0,
+		"Multiple of the no-load latency tolerated before the limit shrinks (default 2)",
+	)
+
+	// Warm-up settings
+	wu := &cfg.ProxyConfig.WarmupConfig
+	flags.BoolVar(
+		&wu.EnableWarmup,
+		"enable-warmup",
+		false,
+		"Ramp the admitted concurrency from min to max after startup and upstream recovery",
+	)
+	flags.DurationVar(
+		&wu.WarmupDuration,
+		"warmup-duration",
+		0,
+		"How long the admitted concurrency takes to ramp from min to max",
+	)
+	flags.IntVar(
+		&wu.WarmupMinConcurrency,
+		"warmup-min-concurrency",
+		0,
+		"Concurrency admitted at the start of the warm-up (default 1)",
+	)
+	flags.IntVar(
+		&wu.WarmupMaxConcurrency,
+		"warmup-max-concurrency",
+		0,
+		"Concurrency admitted at the end of the warm-up (default 1000)",
+	)
+	flags.IntVar(
+		&wu.WarmupAfterFailures,
+		"warmup-after-failures",
+		0,
+		"Consecutive upstream failures after which the next success restarts the warm-up",
+	)
+
+	// Backpressure settings
+	bp := &cfg.ProxyConfig.BackpressureConfig
+	flags.BoolVar(
+		&bp.EnableBackpressure,
+		"enable-bp",
+		false,
+		"Enable backpressure-based throttling",
+	)
+	flags.IntVar(&bp.CongestionWindowMin, "bp-min-window", 0, "Minimum concurrent query limit")
+	flags.IntVar(&bp.CongestionWindowMax, "bp-max-window", 0, "Maximum concurrent query limit")
+	flags.StringVar(
+		&bp.BackpressureMonitoringURL,
+		"bp-monitoring-url",
+		"",
+		"Backpressure metrics endpoint, or dnssrv+<url> to spread queries across SRV targets",
+	)
+	flags.StringVar(
+		&bpMonitoringURLs,
+		"bp-fallback-monitoring-urls",
+		"",
+		"Comma-separated backpressure metrics endpoints queried after --bp-monitoring-url",
+	)
+	flags.StringVar(
+		&bp.MonitorStrategy,
+		"bp-monitor-strategy",
+		"",
+		"How multiple metrics endpoints are queried: failover (default) or max",
+	)
+	flags.StringVar(
+		&bp.MonitorFailurePolicy,
+		"bp-monitor-failure-policy",
+		"",
+		"Allowance when every backpressure query errors: keep_last (default), open, or closed",
+	)
+	flags.StringVar(
+		&bp.MonitorClient.BearerToken,
+		"bp-monitor-bearer-token",
+		"",
+		"Bearer token sent when fetching backpressure signals",
+	)
+	flags.StringVar(
+		&bp.MonitorClient.BearerTokenFile,
+		"bp-monitor-bearer-token-file",
+		"",
+		"File holding the bearer token sent when fetching backpressure signals",
+	)
+	flags.StringVar(
+		&bp.MonitorClient.BasicAuthUsername,
+		"bp-monitor-basic-auth-username",
+		"",
+		"Basic auth username for fetching backpressure signals",
+	)
+	flags.StringVar(
+		&bp.MonitorClient.BasicAuthPassword,
+		"bp-monitor-basic-auth-password",
+		"",
+		"Basic auth password for fetching backpressure signals",
+	)
+	flags.Var(
+		&bpMonitorHeaders,
+		"bp-monitor-header",
+		"Header added when fetching backpressure signals, as `<name>: <value>` (repeatable)",
+	)
+	flags.StringVar(
+		&bp.MonitorClient.ProxyURL,
+		"bp-monitor-proxy-url",
+		"",
+		"HTTP proxy for fetching backpressure signals",
+	)
+	flags.Var(&bpQueries, "bp-query", "PromQL query for downstream failures")
+	flags.Var(&bpQueryNames, "bp-query-name", "Human-readable name for backpressure query")
+	flags.Var(
+		&bpQueryOpts.backends,
+		"bp-query-backend",
+		"Backend for each backpressure query: prometheus, victoriametrics, graphite, or influxdb",
+	)
+	flags.Var(
+		&bpQueryOpts.aggregations,
+		"bp-query-aggregation",
+		"Aggregation of multi-series backpressure query results: max, min, avg, or sum",
+	)
+	flags.Var(
+		&bpQueryOpts.directions,
+		"bp-query-direction",
+		"Throttle as each backpressure query rises above (default) or drops below its thresholds",
+	)
+	flags.Var(
+		&bpQueryOpts.weights,
+		"bp-query-weight",
+		"Weight within (0, 1] scaling how much each backpressure query throttles",
+	)
+	flags.Var(
+		&bpQueryOpts.maxThrottles,
+		"bp-max-throttle",
+		"Max share of the window within (0, 1] each backpressure query may close",
+	)
+	flags.Var(
+		&bpQueryOpts.smoothingAlphas,
+		"bp-smoothing-alpha",
+		"EWMA alpha within (0, 1] smoothing each backpressure query value. Lower smooths more",
+	)
+	flags.Var(
+		&bpQueryOpts.slopeSamples,
+		"bp-slope-samples",
+		"Polls over which each backpressure query's rate of change is estimated. 0 disables it",
+	)
+	flags.Var(
+		&bpQueryOpts.slopeWarnThresholds,
+		"bp-slope-warn",
+		"Rate of change per second at which each backpressure query starts throttling",
+	)
+	flags.Var(
+		&bpQueryOpts.slopeEmergencyThresholds,
+		"bp-slope-emergency",
+		"Rate of change per second at which each backpressure query throttles the most",
+	)
+	flags.Var(
+		&bpQueryOpts.anomalyWindows,
+		"bp-anomaly-window",
+		"Trailing polls each backpressure query's thresholds derive from. 0 keeps static thresholds",
+	)
+	flags.Var(
+		&bpQueryOpts.anomalyWarnStddevs,
+		"bp-anomaly-warn-stddevs",
+		"Stddevs from the trailing mean at which each anomaly backpressure query starts throttling",
+	)
+	flags.Var(
+		&bpQueryOpts.anomalyEmergencyStddevs,
+		"bp-anomaly-emergency-stddevs",
+		"Stddevs from the trailing mean at which each anomaly backpressure query throttles the most",
+	)
+	flags.Var(&bpWarnThresholds, "bp-warn", "Warning threshold for throttling")
+	flags.Var(&bpEmergencyThresholds, "bp-emergency", "Emergency threshold for maximum throttling")
+	flags.Var(
+		&bpQueryOpts.warnQueries,
+		"bp-warn-query",
+		"Query evaluated each poll replacing the warning threshold. Empty keeps --bp-warn",
+	)
+	flags.Var(
+		&bpQueryOpts.emergencyQueries,
+		"bp-emergency-query",
+		"Query evaluated each poll replacing the emergency threshold. Empty keeps --bp-emergency",
+	)
+	flags.BoolVar(
+		&bp.EnableLowCostBypass,
+		"enable-low-cost-bypass",
+		false,
+		"Enable low-cost realtime PromQL to bypass backpressure",
+	)
+	flags.BoolVar(
+		&bp.EnableCostWeightedWindow,
+		"enable-bp-cost-weighted-window",
+		false,
+		"Count the query cost of each request against the congestion window instead of one",
+	)
+	flags.BoolVar(
+		&bp.CostTiers.EnableCostTiers,
+		"enable-bp-cost-tiers",
+		false,
+		"Split the congestion window into cheap, moderate, and expensive PromQL tiers",
+	)
+	flags.Float64Var(&bp.CostTiers.CheapShare, "bp-cheap-share", 0, "Window share for cheap queries")
+	flags.Float64Var(
+		&bp.CostTiers.ModerateShare, "bp-moderate-share", 0, "Window share for moderate queries",
+	)
+	flags.Float64Var(
+		&bp.CostTiers.ExpensiveShare, "bp-expensive-share", 0, "Window share for expensive queries",
+	)
+	flags.DurationVar(
+		&bp.CostTiers.ExpensiveLookback,
+		"bp-expensive-lookback",
+		0,
+		"Lookback past which a query is expensive (default 24h)",
+	)
+	flags.BoolVar(
+		&bp.TenantFairness.EnableTenantFairness,
+		"enable-bp-tenant-fairness",
+		false,
+		"Share the congestion window across tenants so one tenant cannot hold every open slot",
+	)
 	flags.StringVar(
-		&cfg.InsecureListenAddress,
-		"insecure-listen-address",
+		&bp.TenantFairness.TenantHeader,
+		"bp-tenant-fairness-header",
 		"",
-		"HTTP proxy server listen address",
+		"Header identifying the tenant for fair sharing (default X-Scope-OrgID)",
+	)
+	flags.Var(
+		&bpTenantWeights,
+		"bp-tenant-weight",
+		"Window share weight of a tenant, formatted as tenant=weight (repeatable, default 1)",
 	)
 	flags.StringVar(
-		&cfg.InternalListenAddress,
-		"internal-listen-address",
+		&bp.AllowanceMode,
+		"bp-allowance-mode",
 		"",
-		"Internal metrics server listen address",
+		"How backpressure allowance is applied: window (default) or probabilistic",
 	)
-	flags.DurationVar(&cfg.ReadTimeout, "proxy-read-timeout", 5*time.Minute, "HTTP read timeout")
-	flags.DurationVar(&cfg.WriteTimeout, "proxy-write-timeout", 5*time.Minute, "HTTP write timeout")
-	flags.StringVar(&cfg.Upstream, "upstream", "", "Upstream URL to proxy to")
-
-	// Feature flags
 	flags.BoolVar(
-		&cfg.ProxyConfig.EnableCriticality,
-		"enable-criticality",
+		&bp.EnableCriticalityShedding,
+		"enable-bp-criticality-shedding",
 		false,
-		"Enable criticality header processing",
+		"Shed SHEDDABLE requests before CRITICAL as the congestion window shrinks",
+	)
+	flags.IntVar(
+		&bp.CriticalPlusReserve,
+		"bp-critical-plus-reserve",
+		0,
+		"Portion of the min window reserved for CRITICAL_PLUS requests",
+	)
+	flags.Float64Var(
+		&bp.AllowanceRecoveryStep,
+		"bp-recovery-step",
+		0,
+		"Max allowance increase per update once backpressure clears, e.g. 0.05. Instant when 0",
 	)
-	flags.BoolVar(&cfg.ProxyConfig.EnableJitter, "enable-jitter", false, "Enable request jitter")
 	flags.DurationVar(
-		&cfg.ProxyConfig.JitterDelay,
-		"jitter-delay",
+		&bp.AllowanceRecoveryCooldown,
+		"bp-recovery-cooldown",
 		0,
-		"Random jitter delay duration",
+		"How long the allowance is held after backpressure clears before it recovers",
 	)
-	flags.BoolVar(
-		&cfg.ProxyConfig.EnableObserver,
-		"enable-observer",
-		false,
-		"Enable middleware metrics collection",
+	flags.DurationVar(
+		&bp.UnreadyAfterEmergency,
+		"bp-unready-after-emergency",
+		0,
+		"Fail /readyz once the allowance has been fully closed this long (0 to always be ready)",
+	)
+	flags.DurationVar(
+		&bp.IdleDecayAfter,
+		"bp-idle-decay-after",
+		0,
+		"Halve the watermark's distance to the min window for every period this long without requests",
 	)
-
-	// Blocker settings
 	flags.BoolVar(
-		&cfg.ProxyConfig.EnableBlocker,
-		"enable-blocker",
+		&bp.SharedWindow.EnableSharedWindow,
+		"enable-bp-shared-window",
 		false,
-		"Enable http header request blocking",
+		"Count the active requests of every replica against the congestion window",
 	)
-	flags.Var(
-		&blockPatterns,
-		"block-pattern",
-		"Header with regex matcher to block. Ex. `X-user-agent=service-to-block.*`",
+	flags.StringVar(
+		&bp.SharedWindow.RedisAddr,
+		"bp-shared-window-redis-addr",
+		"",
+		"Redis address replicas publish their active request counts to",
+	)
+	flags.DurationVar(
+		&bp.SharedWindow.SyncInterval,
+		"bp-shared-window-sync-interval",
+		0,
+		"How often active counts are shared between replicas (default 1s)",
+	)
+	flags.StringVar(
+		&bp.SharedWindow.ReplicaID,
+		"bp-shared-window-replica-id",
+		"",
+		"Unique replica name in the shared window (default hostname:pid)",
 	)
-
-	// Backpressure settings
-	bp := &cfg.ProxyConfig.BackpressureConfig
 	flags.BoolVar(
-		&bp.EnableBackpressure,
-		"enable-bp",
+		&bp.LeaderElection.EnableLeaderElection,
+		"enable-bp-leader-election",
 		false,
-		"Enable backpressure-based throttling",
+		"Only poll backpressure queries on the elected replica and share its allowance",
 	)
-	flags.IntVar(&bp.CongestionWindowMin, "bp-min-window", 0, "Minimum concurrent query limit")
-	flags.IntVar(&bp.CongestionWindowMax, "bp-max-window", 0, "Maximum concurrent query limit")
 	flags.StringVar(
-		&bp.BackpressureMonitoringURL,
-		"bp-monitoring-url",
+		&bp.LeaderElection.Backend,
+		"bp-leader-election-backend",
 		"",
-		"Backpressure metrics endpoint",
+		"Leader election lock: redis (default) or kubernetes",
+	)
+	flags.StringVar(
+		&bp.LeaderElection.RedisAddr,
+		"bp-leader-election-redis-addr",
+		"",
+		"Redis address holding the leader lock and published allowance",
+	)
+	flags.StringVar(
+		&bp.LeaderElection.LeaseName,
+		"bp-leader-election-lease-name",
+		"",
+		"Kubernetes Lease holding the leader lock (default throttle-proxy-bp-leader)",
+	)
+	flags.StringVar(
+		&bp.LeaderElection.LeaseNamespace,
+		"bp-leader-election-lease-namespace",
+		"",
+		"Namespace of the Kubernetes Lease (default the service account namespace)",
+	)
+	flags.DurationVar(
+		&bp.LeaderElection.LeaseDuration,
+		"bp-leader-election-lease-duration",
+		0,
+		"How long leadership and the published allowance last without renewal (default 90s)",
+	)
+	flags.StringVar(
+		&bp.LeaderElection.ReplicaID,
+		"bp-leader-election-replica-id",
+		"",
+		"Unique replica name in the leader election (default hostname:pid)",
 	)
-	flags.Var(&bpQueries, "bp-query", "PromQL query for downstream failures")
-	flags.Var(&bpQueryNames, "bp-query-name", "Human-readable name for backpressure query")
-	flags.Var(&bpWarnThresholds, "bp-warn", "Warning threshold for throttling")
-	flags.Var(&bpEmergencyThresholds, "bp-emergency", "Emergency threshold for maximum throttling")
 	flags.BoolVar(
-		&bp.EnableLowCostBypass,
-		"enable-low-cost-bypass",
+		&bp.Persistence.EnablePersistence,
+		"enable-bp-persistence",
 		false,
-		"Enable low-cost realtime PromQL to bypass backpressure",
+		"Save the watermark and allowance and restore them on startup",
+	)
+	flags.StringVar(
+		&bp.Persistence.StateFile,
+		"bp-state-file",
+		"",
+		"JSON file the backpressure state is saved to",
+	)
+	flags.StringVar(
+		&bp.Persistence.RedisAddr,
+		"bp-state-redis-addr",
+		"",
+		"Redis address the backpressure state is saved to instead of a file",
+	)
+	flags.DurationVar(
+		&bp.Persistence.MaxAge,
+		"bp-state-max-age",
+		0,
+		"Oldest saved backpressure state restored on startup (default 10m)",
 	)
 
 	// Path settings
@@ -160,6 +1219,31 @@ func ParseConfigFlags() (Config, error) {
 		"",
 		"Comma-separated list of paths to pass through",
 	)
+	flags.Var(
+		&pathRewrites,
+		"path-rewrite",
+		"Replace a request path prefix before proxying as <prefix>=<replacement> (can be repeated)",
+	)
+	flags.Var(
+		&pathMethods,
+		"path-methods",
+		"Comma-separated methods allowed on a path as <path>=<methods> (can be repeated)",
+	)
+	flags.Var(
+		&pathReadTimeouts,
+		"path-read-timeout",
+		"Read timeout of a path as <path>=<duration> (can be repeated)",
+	)
+	flags.Var(
+		&pathWriteTimeouts,
+		"path-write-timeout",
+		"Write timeout of a path as <path>=<duration> (can be repeated)",
+	)
+	flags.Var(
+		&pathClientTimeouts,
+		"path-client-timeout",
+		"Client timeout of a path as <path>=<duration> (can be repeated)",
+	)
 
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		return Config{}, err
@@ -170,19 +1254,69 @@ func ParseConfigFlags() (Config, error) {
 	}
 
 	cfg.ProxyConfig.BlockPatterns = blockPatterns
+	cfg.ProxyConfig.BlockCIDRs = blockCIDRs
+	cfg.ProxyConfig.AllowCIDRs = allowCIDRs
+	cfg.ProxyConfig.TrustedProxies = trustedProxies
+	cfg.ProxyConfig.DenyQueryPatterns = denyQueryPatterns
+	cfg.ProxyConfig.RecordHeaders = recordHeaders
+	cfg.ProxyConfig.MirrorPercent = mirrorPercent.Value
+	if middlewareOrder != "" {
+		cfg.ProxyConfig.MiddlewareOrder = strings.Split(middlewareOrder, ",")
+	}
 
 	var err error
+	if cfg.ProxyConfig.InjectLabels, err = parseLabelPairs(injectLabels); err != nil {
+		return Config{}, err
+	}
 	if bp.BackpressureQueries, err = proxymw.ParseBackpressureQueries(
 		bpQueries, bpQueryNames, bpWarnThresholds, bpEmergencyThresholds,
 	); err != nil {
 		return Config{}, err
 	}
+	if err := bpQueryOpts.apply(bp.BackpressureQueries); err != nil {
+		return Config{}, err
+	}
+	cfg.ProxyConfig.ObserverPathTemplates = observerPathTemplates
+	if cfg.ProxyConfig.MetricsConstLabels, err = parseLabelPairs(metricsConstLabels); err != nil {
+		return Config{}, err
+	}
+	if bp.MonitorClient.Headers, err = parseHeaders(bpMonitorHeaders); err != nil {
+		return Config{}, err
+	}
+	if bp.TenantFairness.TenantWeights, err = parseWeights(bpTenantWeights); err != nil {
+		return Config{}, err
+	}
+	if fl.FingerprintLimits, err = parseFingerprintLimits(fingerprintLimits); err != nil {
+		return Config{}, err
+	}
+	if tc.TenantConcurrencyLimits, err = parseLimits(tenantConcurrency); err != nil {
+		return Config{}, err
+	}
+	if cfg.ProxyConfig.CriticalityTimeouts, err = parseDurations(criticalityTimeouts); err != nil {
+		return Config{}, err
+	}
+	if bpMonitoringURLs != "" {
+		bp.BackpressureMonitoringURLs = strings.Split(bpMonitoringURLs, ",")
+	}
 	if cfg.ProxyPaths, err = parsePaths(proxyPaths); err != nil {
 		return Config{}, err
 	}
 	if cfg.PassthroughPaths, err = parsePaths(passthroughPaths); err != nil {
 		return Config{}, err
 	}
+	if cfg.PathRewrites, err = parsePathRewrites(pathRewrites); err != nil {
+		return Config{}, err
+	}
+	if cfg.PathConfigs, err = parsePathConfigs(
+		pathMethods, pathReadTimeouts, pathWriteTimeouts, pathClientTimeouts,
+	); err != nil {
+		return Config{}, err
+	}
+	if cfg.UpstreamRoutes, err = parseUpstreamRoutes(
+		upstreamHostRoutes, upstreamHeaderRoutes,
+	); err != nil {
+		return Config{}, err
+	}
 
 	return cfg, nil
 }
@@ -226,6 +1360,292 @@ func getDurationEnv(key string) (time.Duration, error) {
 	return time.ParseDuration(d)
 }
 
+// queryOptions holds the optional per query flags which must be set for every query or none
+type queryOptions struct {
+	backends         StringSlice
+	aggregations     StringSlice
+	directions       StringSlice
+	warnQueries      StringSlice
+	emergencyQueries StringSlice
+	weights          Float64Slice
+	maxThrottles     Float64Slice
+	smoothingAlphas  Float64Slice
+	slopeSamples     IntSlice
+	// slope thresholds are rates of change per second
+	slopeWarnThresholds      Float64Slice
+	slopeEmergencyThresholds Float64Slice
+	anomalyWindows           IntSlice
+	anomalyWarnStddevs       Float64Slice
+	anomalyEmergencyStddevs  Float64Slice
+}
+
+// apply sets the per query flags on the parsed backpressure queries
+func (o queryOptions) apply(queries []proxymw.BackpressureQuery) error {
+	n := len(queries)
+	for _, opt := range []struct {
+		name  string
+		count int
+	}{
+		{name: "backends", count: len(o.backends)},
+		{name: "aggregations", count: len(o.aggregations)},
+		{name: "directions", count: len(o.directions)},
+		{name: "warn queries", count: len(o.warnQueries)},
+		{name: "emergency queries", count: len(o.emergencyQueries)},
+		{name: "weights", count: len(o.weights)},
+		{name: "max throttles", count: len(o.maxThrottles)},
+		{name: "smoothing alphas", count: len(o.smoothingAlphas)},
+		{name: "slope samples", count: len(o.slopeSamples)},
+		{name: "slope warn thresholds", count: len(o.slopeWarnThresholds)},
+		{name: "slope emergency thresholds", count: len(o.slopeEmergencyThresholds)},
+		{name: "anomaly windows", count: len(o.anomalyWindows)},
+		{name: "anomaly warn stddevs", count: len(o.anomalyWarnStddevs)},
+		{name: "anomaly emergency stddevs", count: len(o.anomalyEmergencyStddevs)},
+	} {
+		if opt.count != 0 && opt.count != n {
+			return fmt.Errorf("number of backpressure query %s should be 0 or %d", opt.name, n)
+		}
+	}
+
+	for i := range queries {
+		if len(o.backends) > 0 {
+			queries[i].Backend = o.backends[i]
+		}
+		if len(o.aggregations) > 0 {
+			queries[i].Aggregation = o.aggregations[i]
+		}
+		if len(o.directions) > 0 {
+			queries[i].Direction = o.directions[i]
+		}
+		if len(o.warnQueries) > 0 {
+			queries[i].WarningThresholdQuery = o.warnQueries[i]
+		}
+		if len(o.emergencyQueries) > 0 {
+			queries[i].EmergencyThresholdQuery = o.emergencyQueries[i]
+		}
+		if len(o.weights) > 0 {
+			queries[i].Weight = o.weights[i]
+		}
+		if len(o.maxThrottles) > 0 {
+			queries[i].MaxThrottle = o.maxThrottles[i]
+		}
+		if len(o.smoothingAlphas) > 0 {
+			queries[i].SmoothingAlpha = o.smoothingAlphas[i]
+		}
+		if len(o.slopeSamples) > 0 {
+			queries[i].SlopeSamples = o.slopeSamples[i]
+		}
+		if len(o.slopeWarnThresholds) > 0 {
+			queries[i].SlopeWarningThreshold = o.slopeWarnThresholds[i]
+		}
+		if len(o.slopeEmergencyThresholds) > 0 {
+			queries[i].SlopeEmergencyThreshold = o.slopeEmergencyThresholds[i]
+		}
+		if len(o.anomalyWindows) > 0 {
+			queries[i].AnomalyWindow = o.anomalyWindows[i]
+		}
+		if len(o.anomalyWarnStddevs) > 0 {
+			queries[i].AnomalyWarningStddevs = o.anomalyWarnStddevs[i]
+		}
+		if len(o.anomalyEmergencyStddevs) > 0 {
+			queries[i].AnomalyEmergencyStddevs = o.anomalyEmergencyStddevs[i]
+		}
+	}
+	return nil
+}
+
+func parseHeaders(headers []string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	parsed := map[string]string{}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header %q did not match `<name>: <value>`", header)
+		}
+		parsed[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
+func parseLabelPairs(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	labels := map[string]string{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("label %q did not match `<name>=<value>`", pair)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+func parseWeights(pairs []string) (map[string]float64, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	weights := map[string]float64{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		weight, err := strconv.ParseFloat(value, 64)
+		if !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("weight %q did not match `<name>=<number>`", pair)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+func parseLimits(pairs []string) (map[string]int, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	limits := map[string]int{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		limit, err := strconv.Atoi(value)
+		if !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("limit %q did not match `<name>=<integer>`", pair)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+func parseDurations(pairs []string) (map[string]time.Duration, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	durations := map[string]time.Duration{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		duration, err := time.ParseDuration(value)
+		if !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("duration %q did not match `<name>=<duration>`", pair)
+		}
+		durations[name] = duration
+	}
+	return durations, nil
+}
+
+// parseFingerprintLimits splits on the first = since PromQL matchers contain = as well
+func parseFingerprintLimits(pairs []string) ([]proxymw.FingerprintLimit, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	limits := []proxymw.FingerprintLimit{}
+	for _, pair := range pairs {
+		value, query, ok := strings.Cut(pair, "=")
+		qps, err := strconv.ParseFloat(value, 64)
+		if !ok || query == "" || err != nil {
+			return nil, fmt.Errorf("fingerprint limit %q did not match `<qps>=<query>`", pair)
+		}
+		limits = append(limits, proxymw.FingerprintLimit{Query: query, QPS: qps})
+	}
+	return limits, nil
+}
+
+// parseUpstreamRoutes splits on the first = so upstream URLs may contain query strings
+func parseUpstreamRoutes(hostRoutes, headerRoutes []string) ([]UpstreamRoute, error) {
+	if len(hostRoutes) == 0 && len(headerRoutes) == 0 {
+		return nil, nil
+	}
+
+	routes := []UpstreamRoute{}
+	for _, route := range hostRoutes {
+		host, upstream, ok := strings.Cut(route, "=")
+		if !ok || host == "" || upstream == "" {
+			return nil, fmt.Errorf("upstream host route %q did not match `<host>=<upstream>`", route)
+		}
+		routes = append(routes, UpstreamRoute{Host: host, Upstream: upstream})
+	}
+
+	for _, route := range headerRoutes {
+		match, upstream, ok := strings.Cut(route, "=")
+		header, value, hasValue := strings.Cut(match, ":")
+		if !ok || !hasValue || header == "" || value == "" || upstream == "" {
+			return nil, fmt.Errorf(
+				"upstream header route %q did not match `<header>:<value>=<upstream>`", route,
+			)
+		}
+		routes = append(routes, UpstreamRoute{Header: header, Value: value, Upstream: upstream})
+	}
+	return routes, nil
+}
+
+// parsePathConfigs merges the per path flags into one PathConfig per path in flag order
+func parsePathConfigs(methods, readTimeouts, writeTimeouts, clientTimeouts []string) (
+	[]PathConfig, error,
+) {
+	configs := []PathConfig{}
+	config := func(path string) *PathConfig {
+		for i := range configs {
+			if configs[i].Path == path {
+				return &configs[i]
+			}
+		}
+		configs = append(configs, PathConfig{Path: path})
+		return &configs[len(configs)-1]
+	}
+
+	for _, pair := range methods {
+		path, value, ok := strings.Cut(pair, "=")
+		if !ok || path == "" || value == "" {
+			return nil, fmt.Errorf("path methods %q did not match `<path>=<methods>`", pair)
+		}
+		config(path).Methods = strings.Split(value, ",")
+	}
+
+	for _, timeouts := range []struct {
+		pairs []string
+		set   func(*PathConfig, time.Duration)
+	}{
+		{readTimeouts, func(c *PathConfig, d time.Duration) { c.ReadTimeout = d }},
+		{writeTimeouts, func(c *PathConfig, d time.Duration) { c.WriteTimeout = d }},
+		{clientTimeouts, func(c *PathConfig, d time.Duration) { c.ClientTimeout = d }},
+	} {
+		for _, pair := range timeouts.pairs {
+			path, value, ok := strings.Cut(pair, "=")
+			d, err := time.ParseDuration(value)
+			if !ok || path == "" || err != nil {
+				return nil, fmt.Errorf("path timeout %q did not match `<path>=<duration>`", pair)
+			}
+			timeouts.set(config(path), d)
+		}
+	}
+
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	return configs, nil
+}
+
+func parsePathRewrites(pairs []string) ([]PathRewrite, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	rewrites := []PathRewrite{}
+	for _, pair := range pairs {
+		prefix, replacement, ok := strings.Cut(pair, "=")
+		rewrite := PathRewrite{Prefix: prefix, Replacement: replacement}
+		if !ok || rewrite.Validate() != nil {
+			return nil, fmt.Errorf("path rewrite %q did not match `<prefix>=<replacement>`", pair)
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
 func parsePaths(paths string) ([]string, error) {
 	if paths == "" {
 		return []string{}, nil
@@ -233,8 +1653,7 @@ func parsePaths(paths string) ([]string, error) {
 
 	pathList := []string{}
 	for _, path := range strings.Split(paths, ",") {
-		u, err := url.Parse("http://example.com" + path)
-		if err != nil || u.Path != path || path == "" || path == "/" {
+		if !ValidPath(path) {
 			return nil, fmt.Errorf("invalid path %q in path list %q", path, paths)
 		}
 		pathList = append(pathList, path)
@@ -242,6 +1661,14 @@ func parsePaths(paths string) ([]string, error) {
 	return pathList, nil
 }
 
+// ValidPath reports whether the path is a proxy or passthrough path other than the root
+func ValidPath(path string) bool {
+	prefix := strings.TrimSuffix(path, "/*")
+	u, err := url.Parse("http://example.com" + prefix)
+	return err == nil && u.Path == prefix && prefix != "" && prefix != "/" &&
+		!strings.Contains(prefix, "*")
+}
+
 func ParseConfigFile(configFile string) (Config, error) {
 	return ParseFile[Config](configFile)
 }
@@ -50,73 +50,464 @@ func TestParseConfig(t *testing.T) {
 				"--upstream", "http://example.com",
 				"--insecure-listen-address", ":8080",
 				"--internal-listen-address", ":9090",
+				"--upstream-warm-connections", "4",
+				"--upstream-h2c",
+				"--upstream-max-conns-per-host", "64",
+				"--upstream-idle-conn-timeout", "30s",
+				"--upstream-host-route", "prom-b.example.com=http://prom-b:9090",
+				"--upstream-header-route", "X-Scope-OrgID:team-c=http://prom-c:9090",
 				"--proxy-paths", "/api/v2",
-				"--passthrough-paths", "/health,/metrics",
+				"--passthrough-paths", "/health,/metrics,/prometheus/*",
+				"--path-rewrite", "/prometheus/=/",
+				"--path-methods", "/api/v2=GET,POST",
+				"--path-write-timeout", "/api/v2=10m",
+				"--path-client-timeout", "/api/v2=8m",
+				"--path-read-timeout", "/metrics=5s",
 				"--proxy-read-timeout", "2m0s",
 				"--proxy-write-timeout", "3m0s",
+				"--server-max-connections", "1024",
+				"--server-idle-timeout", "90s",
+				"--server-read-header-timeout", "10s",
+				"--server-keep-alive-period", "30s",
+				"--proxy-protocol",
 				"--enable-observer=true",
 				"--enable-criticality=true",
+				"--enable-access-log",
+				"--access-log-format", "combined",
+				"--access-log-file", "/var/log/throttle-proxy/access.log",
+				"--access-log-max-backups", "2",
+				"--enable-recording",
+				"--record-file", "/var/lib/throttle-proxy/traffic.jsonl",
+				"--record-max-size-mb", "50",
+				"--record-percent", "10",
+				"--record-header", "X-Scope-OrgID",
+				"--record-header", "X-Dashboard",
+				"--enable-audit",
+				"--audit-size", "200",
+				"--enable-timeouts",
+				"--criticality-timeout", "SHEDDABLE=10s",
+				"--criticality-timeout", "CRITICAL_PLUS=1m",
+				"--enable-deadline-headers",
 				"--enable-jitter",
 				"--jitter-delay", "100ms",
+				"--jitter-strategy", "normal",
+				"--enable-rate-limit",
+				"--rate-limit", "100",
+				"--rate-limit-window", "1m",
+				"--rate-limit-by-client-ip",
+				"--redis-addr", "localhost:6379",
+				"--enable-fingerprint-limit",
+				"--fingerprint-qps", "5",
+				"--fingerprint-limit", `0.5=sum(rate(http_requests_total{job="api"}[5m]))`,
+				"--enable-tenant-concurrency",
+				"--tenant-concurrency-header", "X-Tenant",
+				"--max-tenant-concurrency", "4",
+				"--tenant-concurrency-limit", "team-a=8",
+				"--enable-cost-feedback",
+				"--cost-feedback-samples-per-unit", "50000",
+				"--enable-mirror",
+				"--mirror-upstream", "http://thanos-canary:9090",
+				"--mirror-percent", "10",
+				"--mirror-concurrency", "5",
+				"--enable-step-alignment",
+				"--enable-sharding",
+				"--shard-interval", "12h",
+				"--shard-concurrency", "2",
+				"--enable-chaos",
+				"--chaos-header", "X-Chaos",
+				"--chaos-latency", "2s",
+				"--chaos-latency-percent", "50",
+				"--chaos-error-percent", "10",
+				"--chaos-error-status", "500",
+				"--chaos-drop-percent", "5",
+				"--enable-query-cost-cache",
+				"--query-cost-cache-size", "500",
+				"--enable-quotas",
+				"--quota-requests-per-day", "10000",
+				"--quota-cost-per-hour", "500",
+				"--enable-remote-write-limit",
+				"--remote-write-path", "/api/v1/push",
+				"--max-samples-per-second", "50000",
+				"--enable-adaptive-limit",
+				"--adaptive-limit-max", "200",
+				"--adaptive-limit-tolerance", "1.5",
+				"--enable-warmup",
+				"--warmup-duration", "2m",
+				"--warmup-max-concurrency", "50",
+				"--warmup-after-failures", "5",
+				"--enable-tenant-stats",
+				"--tenant-header", "X-Tenant",
+				"--tenant-stats-window", "10m",
+				"--top-fingerprints", "5",
+				"--jitter-stddev", "10ms",
+				"--retry-after", "1500ms",
+				"--maintenance-mode", "open",
+				"--maintenance-message", "upgrading prometheus",
 				"--enable-blocker",
 				"--block-pattern=X-user-agent=bad-service.*",
 				"--block-pattern=X-custom-header=.*-unsafe",
+				"--block-decision-cache-size", "1000",
+				"--block-cidr", "10.1.0.0/16",
+				"--allow-cidr", "10.1.2.3",
+				"--trusted-proxy", "192.168.0.0/24",
+				"--deny-query-pattern", `count\(\{__name__=~".+"\}\)`,
+				"--enable-guardrails",
+				"--max-query-range", "744h",
+				"--min-query-step", "15s",
+				"--max-points-per-series", "5000",
+				"--validate-query-syntax",
+				"--enable-label-injection",
+				"--inject-label", "cluster=us-east-1",
+				"--inject-label", "env=prod",
 				"--enable-bp",
 				"--bp-monitoring-url", "http://metrics.example.com",
+				"--bp-fallback-monitoring-urls", "http://a.example.com,http://b.example.com",
+				"--bp-monitor-strategy", "max",
+				"--bp-monitor-failure-policy", "open",
+				"--bp-monitor-bearer-token", "secret",
+				"--bp-monitor-header", "X-Scope-OrgID: team-a",
 				"--bp-query=sum(rate(http_request_count))",
 				"--bp-query-name", "http_rps",
+				"--bp-query-backend", "victoriametrics",
+				"--bp-query-weight", "1",
+				"--bp-max-throttle", "1",
+				"--bp-smoothing-alpha", "0.3",
+				"--bp-slope-samples", "5",
+				"--bp-slope-warn", "10",
+				"--bp-slope-emergency", "50",
+				"--bp-anomaly-window", "0",
+				"--bp-anomaly-warn-stddevs", "0",
+				"--bp-anomaly-emergency-stddevs", "0",
+				"--bp-query-aggregation", "max",
 				"--bp-warn", "1000",
 				"--bp-emergency", "5000",
+				"--bp-emergency-query", "100 * count(up{job='api'})",
 				"--bp-query", "up{job='prometheus'} == 0",
 				"--bp-query-name", "up_jobs",
+				"--bp-query-backend", "prometheus",
+				"--bp-query-weight", "0.5",
+				"--bp-max-throttle", "0.3",
+				"--bp-smoothing-alpha", "1",
+				"--bp-slope-samples", "0",
+				"--bp-slope-warn", "0",
+				"--bp-slope-emergency", "0",
+				"--bp-anomaly-window", "20",
+				"--bp-anomaly-warn-stddevs", "2",
+				"--bp-anomaly-emergency-stddevs", "4",
+				"--bp-query-aggregation", "sum",
+				"--bp-query-direction", "above",
+				"--bp-query-direction", "above",
 				"--bp-warn", "0.5",
 				"--bp-emergency", "0.8",
+				"--bp-emergency-query", "",
 				"--bp-min-window", "10",
 				"--bp-max-window", "100",
 				"--enable-low-cost-bypass",
+				"--enable-bp-cost-weighted-window",
+				"--enable-bp-cost-tiers",
+				"--bp-cheap-share", "0.5",
+				"--bp-moderate-share", "0.3",
+				"--bp-expensive-share", "0.2",
+				"--bp-expensive-lookback", "48h",
+				"--enable-bp-tenant-fairness",
+				"--bp-tenant-weight", "team-a=2",
+				"--bp-allowance-mode", "probabilistic",
+				"--enable-bp-criticality-shedding",
+				"--bp-critical-plus-reserve", "2",
+				"--bp-recovery-step", "0.05",
+				"--bp-recovery-cooldown", "1m",
+				"--bp-unready-after-emergency", "5m",
+				"--bp-idle-decay-after", "10m",
+				"--enable-bp-shared-window",
+				"--bp-shared-window-redis-addr", "localhost:6379",
+				"--bp-shared-window-sync-interval", "2s",
+				"--bp-shared-window-replica-id", "proxy-0",
+				"--enable-bp-leader-election",
+				"--bp-leader-election-backend", "kubernetes",
+				"--bp-leader-election-lease-name", "bp-leader",
+				"--bp-leader-election-lease-namespace", "monitoring",
+				"--bp-leader-election-lease-duration", "2m",
+				"--bp-leader-election-replica-id", "proxy-0",
+				"--enable-bp-persistence",
+				"--bp-state-file", "/var/lib/throttle-proxy/state.json",
+				"--bp-state-max-age", "5m",
 				"--enable-observer",
+				"--enable-observer-path-labels",
+				"--enable-exemplars",
+				"--enable-server-timing",
+				"--enable-decision-headers",
+				"--middleware-order", "observer,backpressure,jitter",
+				"--metrics-namespace", "replica",
+				"--metrics-const-label", "shard=a",
+				"--observer-path-template", "/api/v1/query_range",
 			},
 			wantErr: false,
 			cfg: proxyutil.Config{
-				Upstream:              "http://example.com",
-				ProxyPaths:            []string{"/api/v2"},
-				PassthroughPaths:      []string{"/health", "/metrics"},
-				InsecureListenAddress: ":8080",
-				InternalListenAddress: ":9090",
-				ReadTimeout:           2 * time.Minute,
-				WriteTimeout:          3 * time.Minute,
+				Upstream:         "http://example.com",
+				ProxyPaths:       []string{"/api/v2"},
+				PassthroughPaths: []string{"/health", "/metrics", "/prometheus/*"},
+				PathRewrites:     []proxyutil.PathRewrite{{Prefix: "/prometheus/", Replacement: "/"}},
+				PathConfigs: []proxyutil.PathConfig{
+					{
+						Path:          "/api/v2",
+						Methods:       []string{"GET", "POST"},
+						WriteTimeout:  10 * time.Minute,
+						ClientTimeout: 8 * time.Minute,
+					},
+					{Path: "/metrics", ReadTimeout: 5 * time.Second},
+				},
+				InsecureListenAddress:   ":8080",
+				InternalListenAddress:   ":9090",
+				ReadTimeout:             2 * time.Minute,
+				UpstreamWarmConnections: 4,
+				UpstreamTransport: proxyutil.UpstreamTransportConfig{
+					H2C:             true,
+					MaxConnsPerHost: 64,
+					IdleConnTimeout: 30 * time.Second,
+				},
+				UpstreamRoutes: []proxyutil.UpstreamRoute{
+					{Host: "prom-b.example.com", Upstream: "http://prom-b:9090"},
+					{Header: "X-Scope-OrgID", Value: "team-c", Upstream: "http://prom-c:9090"},
+				},
+				WriteTimeout: 3 * time.Minute,
+				Server: proxyutil.ServerConfig{
+					MaxConnections:    1024,
+					IdleTimeout:       90 * time.Second,
+					ReadHeaderTimeout: 10 * time.Second,
+					KeepAlivePeriod:   30 * time.Second,
+				},
+				ProxyProtocol: true,
 				ProxyConfig: proxymw.Config{
 					EnableCriticality: true,
-					EnableJitter:      true,
-					JitterDelay:       time.Millisecond * 100,
-					EnableObserver:    true,
+					AccessLogConfig: proxymw.AccessLogConfig{
+						EnableAccessLog:     true,
+						AccessLogFormat:     proxymw.AccessLogFormatCombined,
+						AccessLogFile:       "/var/log/throttle-proxy/access.log",
+						AccessLogMaxBackups: 2,
+					},
+					RecordConfig: proxymw.RecordConfig{
+						EnableRecording: true,
+						RecordFile:      "/var/lib/throttle-proxy/traffic.jsonl",
+						RecordMaxSizeMB: 50,
+						RecordPercent:   10,
+						RecordHeaders:   []string{"X-Scope-OrgID", "X-Dashboard"},
+					},
+					AuditConfig: proxymw.AuditConfig{EnableAudit: true, AuditSize: 200},
+					TimeoutConfig: proxymw.TimeoutConfig{
+						EnableTimeouts: true,
+						CriticalityTimeouts: map[string]time.Duration{
+							proxymw.CriticalitySheddable:    10 * time.Second,
+							proxymw.CriticalityCriticalPlus: time.Minute,
+						},
+						EnableDeadlineHeaders: true,
+					},
+					EnableJitter:   true,
+					JitterDelay:    time.Millisecond * 100,
+					JitterStrategy: proxymw.JitterStrategyNormal,
+					RateLimitConfig: proxymw.RateLimitConfig{
+						EnableRateLimit:     true,
+						RateLimitByClientIP: true,
+						RateLimit:           100,
+						RateLimitWindow:     time.Minute,
+						RedisAddr:           "localhost:6379",
+					},
+					FingerprintLimitConfig: proxymw.FingerprintLimitConfig{
+						EnableFingerprintLimit: true,
+						FingerprintQPS:         5,
+						FingerprintLimits: []proxymw.FingerprintLimit{
+							{Query: `sum(rate(http_requests_total{job="api"}[5m]))`, QPS: 0.5},
+						},
+					},
+					TenantConcurrencyConfig: proxymw.TenantConcurrencyConfig{
+						EnableTenantConcurrency: true,
+						TenantConcurrencyHeader: "X-Tenant",
+						MaxTenantConcurrency:    4,
+						TenantConcurrencyLimits: map[string]int{"team-a": 8},
+					},
+					CostFeedbackConfig: proxymw.CostFeedbackConfig{
+						EnableCostFeedback: true,
+						SamplesPerCostUnit: 50000,
+					},
+					MirrorConfig: proxymw.MirrorConfig{
+						EnableMirror:      true,
+						MirrorUpstream:    "http://thanos-canary:9090",
+						MirrorPercent:     ptr(10.0),
+						MirrorConcurrency: 5,
+					},
+					StepAlignConfig: proxymw.StepAlignConfig{EnableStepAlignment: true},
+					ShardConfig: proxymw.ShardConfig{
+						EnableSharding:   true,
+						ShardInterval:    12 * time.Hour,
+						ShardConcurrency: 2,
+					},
+					ChaosConfig: proxymw.ChaosConfig{
+						EnableChaos:         true,
+						ChaosHeader:         "X-Chaos",
+						ChaosLatency:        2 * time.Second,
+						ChaosLatencyPercent: 50,
+						ChaosErrorPercent:   10,
+						ChaosErrorStatus:    500,
+						ChaosDropPercent:    5,
+					},
+					QueryCostCacheConfig: proxymw.QueryCostCacheConfig{
+						EnableQueryCostCache: true,
+						QueryCostCacheSize:   500,
+					},
+					QuotaConfig: proxymw.QuotaConfig{
+						EnableQuotas: true,
+						DefaultQuota: proxymw.TenantQuota{RequestsPerDay: 10000, CostPerHour: 500},
+					},
+					RemoteWriteConfig: proxymw.RemoteWriteConfig{
+						EnableRemoteWriteLimit: true,
+						RemoteWritePath:        "/api/v1/push",
+						MaxSamplesPerSecond:    50000,
+					},
+					AdaptiveLimitConfig: proxymw.AdaptiveLimitConfig{
+						EnableAdaptiveLimit:    true,
+						AdaptiveLimitMax:       200,
+						AdaptiveLimitTolerance: 1.5,
+					},
+					WarmupConfig: proxymw.WarmupConfig{
+						EnableWarmup:         true,
+						WarmupDuration:       2 * time.Minute,
+						WarmupMaxConcurrency: 50,
+						WarmupAfterFailures:  5,
+					},
+					TenantStatsConfig: proxymw.TenantStatsConfig{
+						EnableTenantStats: true,
+						TenantHeader:      "X-Tenant",
+						TenantStatsWindow: 10 * time.Minute,
+						TopFingerprints:   5,
+					},
+					JitterStddev: time.Millisecond * 10,
+					RetryAfter:   time.Millisecond * 1500,
+					MaintenanceConfig: proxymw.MaintenanceConfig{
+						MaintenanceMode:    "open",
+						MaintenanceMessage: "upgrading prometheus",
+					},
+					EnableObserver:           true,
+					EnableObserverPathLabels: true,
+					ObserverPathTemplates:    []string{"/api/v1/query_range"},
+					EnableExemplars:          true,
+					EnableServerTiming:       true,
+					EnableDecisionHeaders:    true,
+					MiddlewareOrder:          []string{"observer", "backpressure", "jitter"},
+					MetricsConfig: proxymw.MetricsConfig{
+						MetricsNamespace:   "replica",
+						MetricsConstLabels: map[string]string{"shard": "a"},
+					},
 					BlockerConfig: proxymw.BlockerConfig{
 						EnableBlocker: true,
 						BlockPatterns: []string{
 							"X-user-agent=bad-service.*",
 							"X-custom-header=.*-unsafe",
 						},
+						DecisionCacheSize: 1000,
+						BlockCIDRs:        []string{"10.1.0.0/16"},
+						AllowCIDRs:        []string{"10.1.2.3"},
+						TrustedProxies:    []string{"192.168.0.0/24"},
+						DenyQueryPatterns: []string{`count\(\{__name__=~".+"\}\)`},
+					},
+					GuardrailConfig: proxymw.GuardrailConfig{
+						EnableGuardrails:    true,
+						MaxQueryRange:       744 * time.Hour,
+						MinQueryStep:        15 * time.Second,
+						MaxPointsPerSeries:  5000,
+						ValidateQuerySyntax: true,
+					},
+					LabelInjectorConfig: proxymw.LabelInjectorConfig{
+						EnableLabelInjection: true,
+						InjectLabels: map[string]string{
+							"cluster": "us-east-1",
+							"env":     "prod",
+						},
 					},
 					BackpressureConfig: proxymw.BackpressureConfig{
 						EnableBackpressure:        true,
 						BackpressureMonitoringURL: "http://metrics.example.com",
-						CongestionWindowMin:       10,
-						CongestionWindowMax:       100,
+						BackpressureMonitoringURLs: []string{
+							"http://a.example.com", "http://b.example.com",
+						},
+						MonitorStrategy:      "max",
+						MonitorFailurePolicy: "open",
+						MonitorClient: proxymw.MonitorClientConfig{
+							BearerToken: "secret",
+							Headers:     map[string]string{"X-Scope-OrgID": "team-a"},
+						},
+						CongestionWindowMin: 10,
+						CongestionWindowMax: 100,
 						BackpressureQueries: []proxymw.BackpressureQuery{
 							{
-								Name:               "http_rps",
-								Query:              "sum(rate(http_request_count))",
-								WarningThreshold:   1000,
-								EmergencyThreshold: 5000,
+								Name:                    "http_rps",
+								Query:                   "sum(rate(http_request_count))",
+								Backend:                 "victoriametrics",
+								Weight:                  1,
+								MaxThrottle:             1,
+								SmoothingAlpha:          0.3,
+								SlopeSamples:            5,
+								SlopeWarningThreshold:   10,
+								SlopeEmergencyThreshold: 50,
+								Aggregation:             "max",
+								Direction:               "above",
+								EmergencyThresholdQuery: "100 * count(up{job='api'})",
+								WarningThreshold:        1000,
+								EmergencyThreshold:      5000,
 							},
 							{
-								Name:               "up_jobs",
-								Query:              "up{job='prometheus'} == 0",
-								WarningThreshold:   0.5,
-								EmergencyThreshold: 0.8,
+								Name:                    "up_jobs",
+								Query:                   "up{job='prometheus'} == 0",
+								Backend:                 "prometheus",
+								Weight:                  0.5,
+								MaxThrottle:             0.3,
+								SmoothingAlpha:          1,
+								AnomalyWindow:           20,
+								AnomalyWarningStddevs:   2,
+								AnomalyEmergencyStddevs: 4,
+								Aggregation:             "sum",
+								Direction:               "above",
+								WarningThreshold:        0.5,
+								EmergencyThreshold:      0.8,
 							},
 						},
-						EnableLowCostBypass: true,
+						EnableLowCostBypass:      true,
+						EnableCostWeightedWindow: true,
+						CostTiers: proxymw.CostTierConfig{
+							EnableCostTiers:   true,
+							CheapShare:        0.5,
+							ModerateShare:     0.3,
+							ExpensiveShare:    0.2,
+							ExpensiveLookback: 48 * time.Hour,
+						},
+						TenantFairness: proxymw.TenantFairnessConfig{
+							EnableTenantFairness: true,
+							TenantWeights:        map[string]float64{"team-a": 2},
+						},
+						AllowanceMode:             proxymw.AllowanceModeProbabilistic,
+						EnableCriticalityShedding: true,
+						CriticalPlusReserve:       2,
+						AllowanceRecoveryStep:     0.05,
+						AllowanceRecoveryCooldown: time.Minute,
+						UnreadyAfterEmergency:     5 * time.Minute,
+						IdleDecayAfter:            10 * time.Minute,
+						SharedWindow: proxymw.SharedWindowConfig{
+							EnableSharedWindow: true,
+							RedisAddr:          "localhost:6379",
+							SyncInterval:       2 * time.Second,
+							ReplicaID:          "proxy-0",
+						},
+						LeaderElection: proxymw.LeaderElectionConfig{
+							EnableLeaderElection: true,
+							Backend:              proxymw.LeaderElectionKubernetes,
+							LeaseName:            "bp-leader",
+							LeaseNamespace:       "monitoring",
+							LeaseDuration:        2 * time.Minute,
+							ReplicaID:            "proxy-0",
+						},
+						Persistence: proxymw.PersistenceConfig{
+							EnablePersistence: true,
+							StateFile:         "/var/lib/throttle-proxy/state.json",
+							MaxAge:            5 * time.Minute,
+						},
 					},
 				},
 			},
@@ -151,6 +542,42 @@ func TestParseConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid inject label",
+			args: []string{
+				"test-program",
+				"--upstream", "http://example.com",
+				"--inject-label", "cluster",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid tenant weight",
+			args: []string{
+				"test-program",
+				"--upstream", "http://example.com",
+				"--bp-tenant-weight", "team-a=heavy",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid fingerprint limit",
+			args: []string{
+				"test-program",
+				"--upstream", "http://example.com",
+				"--fingerprint-limit", "sum(up)",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid tenant concurrency limit",
+			args: []string{
+				"test-program",
+				"--upstream", "http://example.com",
+				"--tenant-concurrency-limit", "team-a=1.5",
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid query names",
 			args: []string{
@@ -169,6 +596,24 @@ func TestParseConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "wildcard in the middle of a path",
+			args: []string{
+				"test-program",
+				"--upstream", "http://example.com",
+				"--proxy-paths", "/api/*/query",
+			},
+			wantErr: true,
+		},
+		{
+			name: "upstream header route without value",
+			args: []string{
+				"test-program",
+				"--upstream", "http://example.com",
+				"--upstream-header-route", "X-Scope-OrgID=http://prom-c:9090",
+			},
+			wantErr: true,
+		},
 		{
 			name: "missing emergency threshold",
 			args: []string{
@@ -241,3 +686,7 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,90 @@
+package proxyutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// UnixListenPrefix listens on a unix domain socket, e.g. unix:///var/run/throttle-proxy.sock
+	UnixListenPrefix = "unix://"
+	// SystemdListenPrefix inherits a listener from systemd socket activation. systemd:// takes
+	// the first passed socket while systemd://<name> takes the one with FileDescriptorName=<name>.
+	SystemdListenPrefix = "systemd://"
+
+	// systemdFirstFD is the first file descriptor passed by socket activation, see sd_listen_fds(3)
+	systemdFirstFD = 3
+)
+
+var ErrNoSystemdListener = errors.New("no matching listener was passed by systemd socket activation")
+
+// listen announces on a TCP address, a unix socket, or an inherited systemd socket
+func listen(ctx context.Context, lc net.ListenConfig, addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, UnixListenPrefix); ok {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return lc.Listen(ctx, "unix", path)
+	}
+
+	if name, ok := strings.CutPrefix(addr, SystemdListenPrefix); ok {
+		fd, err := systemdFD(name, os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+		// FileListener duplicates the descriptor so the original can be closed
+		return net.FileListener(f)
+	}
+
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// removeStaleSocket deletes a socket file left behind by a process which did not shut down
+// cleanly, since listening fails while the path exists
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unix socket path %s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdFD finds the descriptor named name, or the first one when name is empty, among the
+// sockets passed through the LISTEN_PID, LISTEN_FDS, and LISTEN_FDNAMES environment variables
+func systemdFD(name string, getenv func(string) string) (int, error) {
+	if pid := getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, fmt.Errorf("%w: sockets were passed to pid %s", ErrNoSystemdListener, pid)
+	}
+
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return 0, ErrNoSystemdListener
+	}
+
+	if name == "" {
+		return systemdFirstFD, nil
+	}
+
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count && i < len(names); i++ {
+		if names[i] == name {
+			return systemdFirstFD + i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrNoSystemdListener, name)
+}
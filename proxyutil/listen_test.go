@@ -0,0 +1,104 @@
+package proxyutil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// a socket left behind by an unclean shutdown is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	l, err := ServerConfig{MaxConnections: 2}.Listen(context.Background(), UnixListenPrefix+path)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://proxy/api/v1/query")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	_, err := ServerConfig{}.Listen(context.Background(), UnixListenPrefix+path)
+	require.ErrorContains(t, err, "is not a socket")
+}
+
+func TestSystemdFD(t *testing.T) {
+	t.Parallel()
+	pid := strconv.Itoa(os.Getpid())
+	for _, tt := range []struct {
+		name    string
+		listen  string
+		env     map[string]string
+		fd      int
+		wantErr bool
+	}{
+		{
+			name: "first socket",
+			env:  map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2"},
+			fd:   3,
+		},
+		{
+			name:   "named socket",
+			listen: "internal",
+			env: map[string]string{
+				"LISTEN_PID": pid, "LISTEN_FDS": "2", "LISTEN_FDNAMES": "proxy:internal",
+			},
+			fd: 4,
+		},
+		{
+			name:    "unknown name",
+			listen:  "admin",
+			env:     map[string]string{"LISTEN_FDS": "1", "LISTEN_FDNAMES": "proxy"},
+			wantErr: true,
+		},
+		{
+			name:    "other process",
+			env:     map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"},
+			wantErr: true,
+		},
+		{
+			name:    "not activated",
+			env:     map[string]string{},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			fd, err := systemdFD(tt.listen, func(key string) string { return tt.env[key] })
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrNoSystemdListener)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.fd, fd)
+		})
+	}
+}
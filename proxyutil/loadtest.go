@@ -0,0 +1,369 @@
+package proxyutil
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+)
+
+// LoadTestCommand is the first argument running the binary as a load generator instead of a proxy
+const LoadTestCommand = "loadtest"
+
+var (
+	ErrLoadTestTarget      = errors.New("load test requires a target URL")
+	ErrLoadTestConcurrency = errors.New("load test concurrency must be positive")
+	ErrLoadTestNegative    = errors.New("load test qps, duration, requests, and range must not be negative")
+	ErrLoadTestRangePct    = errors.New("load test range percent must be between 0 and 100")
+	ErrLoadTestNoQueries   = errors.New("load test queries file has no queries")
+	ErrLoadTestUnbounded   = errors.New("load test requires a duration or a request count")
+)
+
+// syntheticQueries is the PromQL traffic sent when no recorded queries are given, ranging from
+// cheap selectors to aggregations over every series of a metric
+var syntheticQueries = []string{
+	"up",
+	`up{job="prometheus"}`,
+	"sum(rate(prometheus_http_requests_total[5m]))",
+	"sum by (handler) (rate(prometheus_http_requests_total[5m]))",
+	"histogram_quantile(0.99, sum by (le) (rate(prometheus_http_request_duration_seconds_bucket[5m])))",
+	"topk(10, count by (__name__) ({__name__=~\".+\"}))",
+	"avg_over_time(process_resident_memory_bytes[1h])",
+}
+
+// LoadTestConfig replays PromQL traffic against a running proxy to tune window and threshold
+// values before production traffic does
+type LoadTestConfig struct {
+	// Target is the base URL of the proxy, e.g. http://localhost:7777
+	Target string
+	// QPS paces request starts across all workers. Workers send as fast as they can when zero.
+	QPS float64
+	// Concurrency is the number of workers, bounding the requests in flight
+	Concurrency int
+	// Duration and Requests stop the test at whichever comes first. Zero disables either.
+	Duration time.Duration
+	Requests int
+	// QueriesFile holds recorded PromQL queries, one per line. Lines starting with # are
+	// skipped. A built-in synthetic mix is sent when empty.
+	QueriesFile string
+	// RangePercent of requests are range queries over the last Range at Step resolution
+	RangePercent float64
+	Range        time.Duration
+	Step         time.Duration
+	// Headers are sent with every request, e.g. the tenant or criticality header of the proxy
+	Headers map[string]string
+	// Timeout bounds each request
+	Timeout time.Duration
+}
+
+func (c LoadTestConfig) Validate() error {
+	if c.Target == "" {
+		return ErrLoadTestTarget
+	}
+	if _, err := url.Parse(c.Target); err != nil {
+		return fmt.Errorf("load test target: %w", err)
+	}
+	if c.Concurrency < 1 {
+		return ErrLoadTestConcurrency
+	}
+	if c.QPS < 0 || c.Duration < 0 || c.Requests < 0 || c.Range < 0 || c.Step < 0 || c.Timeout < 0 {
+		return ErrLoadTestNegative
+	}
+	if c.RangePercent < 0 || c.RangePercent > 100 {
+		return ErrLoadTestRangePct
+	}
+	if c.Duration == 0 && c.Requests == 0 {
+		return ErrLoadTestUnbounded
+	}
+	return nil
+}
+
+// ParseLoadTestFlags parses the arguments following the loadtest command
+func ParseLoadTestFlags(args []string) (LoadTestConfig, error) {
+	cfg := LoadTestConfig{}
+	flags := flag.NewFlagSet(LoadTestCommand, flag.ContinueOnError)
+
+	var headers StringSlice
+	flags.StringVar(&cfg.Target, "target", "http://localhost:7777", "Base URL of the proxy under test")
+	flags.Float64Var(&cfg.QPS, "qps", 10, "Requests started per second, unpaced when 0")
+	flags.IntVar(&cfg.Concurrency, "concurrency", 4, "Maximum requests in flight")
+	flags.DurationVar(&cfg.Duration, "duration", 30*time.Second, "How long to send traffic, unbounded when 0")
+	flags.IntVar(&cfg.Requests, "requests", 0, "Stop after this many requests, unbounded when 0")
+	flags.StringVar(
+		&cfg.QueriesFile,
+		"queries-file",
+		"",
+		"File of recorded PromQL queries, one per line (default a synthetic query mix)",
+	)
+	flags.Float64Var(&cfg.RangePercent, "range-percent", 20, "Percentage of requests sent as range queries")
+	flags.DurationVar(&cfg.Range, "range", time.Hour, "Time range of range queries, ending now")
+	flags.DurationVar(&cfg.Step, "step", time.Minute, "Resolution of range queries")
+	flags.Var(&headers, "header", "Header sent with every request as <name>: <value> (can be repeated)")
+	flags.DurationVar(&cfg.Timeout, "timeout", 30*time.Second, "Timeout of each request")
+
+	if err := flags.Parse(args); err != nil {
+		return LoadTestConfig{}, err
+	}
+
+	var err error
+	if cfg.Headers, err = parseHeaders(headers); err != nil {
+		return LoadTestConfig{}, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// LoadTestReport is the outcome of a load test
+type LoadTestReport struct {
+	Requests int
+	Elapsed  time.Duration
+	// Allowed counts 2xx responses
+	Allowed int
+	// Rejected counts rejections by the X-Throttle-Reason type of the middleware
+	Rejected map[string]int
+	// Statuses counts every response by status code
+	Statuses map[int]int
+	// Errors counts requests failing without a response, e.g. timeouts
+	Errors int
+	// Latencies of allowed and rejected requests, sorted ascending
+	AllowedLatencies  []time.Duration
+	RejectedLatencies []time.Duration
+}
+
+// percentile returns the latency at or below which p percent of latencies fall
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies))*p/100+0.5) - 1
+	return latencies[min(max(i, 0), len(latencies)-1)]
+}
+
+// Write prints the request rate, outcome counts, and latency distributions as a table
+func (r LoadTestReport) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	qps := 0.0
+	if r.Elapsed > 0 {
+		qps = float64(r.Requests) / r.Elapsed.Seconds()
+	}
+	fmt.Fprintf(tw, "requests\t%d\tin %s (%.1f qps)\n", r.Requests, r.Elapsed.Round(time.Millisecond), qps)
+	fmt.Fprintf(tw, "allowed\t%d\t%s\n", r.Allowed, r.share(r.Allowed))
+	for _, blockedBy := range slices.Sorted(maps.Keys(r.Rejected)) {
+		count := r.Rejected[blockedBy]
+		fmt.Fprintf(tw, "rejected by %s\t%d\t%s\n", blockedBy, count, r.share(count))
+	}
+	for _, status := range slices.Sorted(maps.Keys(r.Statuses)) {
+		count := r.Statuses[status]
+		fmt.Fprintf(tw, "status %d\t%d\t%s\n", status, count, r.share(count))
+	}
+	fmt.Fprintf(tw, "errors\t%d\t%s\n", r.Errors, r.share(r.Errors))
+
+	fmt.Fprintln(tw, "\nlatency\tp50\tp90\tp99\tmax")
+	for _, row := range []struct {
+		name      string
+		latencies []time.Duration
+	}{
+		{name: "allowed", latencies: r.AllowedLatencies},
+		{name: "rejected", latencies: r.RejectedLatencies},
+	} {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.name,
+			percentile(row.latencies, 50).Round(time.Microsecond),
+			percentile(row.latencies, 90).Round(time.Microsecond),
+			percentile(row.latencies, 99).Round(time.Microsecond),
+			percentile(row.latencies, 100).Round(time.Microsecond),
+		)
+	}
+	return tw.Flush()
+}
+
+func (r LoadTestReport) share(count int) string {
+	if r.Requests == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(count)/float64(r.Requests))
+}
+
+// loadTestResult is the outcome of a single request
+type loadTestResult struct {
+	status    int
+	blockedBy string
+	latency   time.Duration
+	err       error
+}
+
+// RunLoadTest sends traffic until the duration or request count is reached or ctx is done
+func RunLoadTest(ctx context.Context, cfg LoadTestConfig) (LoadTestReport, error) {
+	queries := syntheticQueries
+	if cfg.QueriesFile != "" {
+		var err error
+		if queries, err = readQueries(cfg.QueriesFile); err != nil {
+			return LoadTestReport{}, err
+		}
+	}
+
+	// requests in flight when the duration ends still complete, only new ones stop
+	generating := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		generating, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	requests := make(chan *http.Request)
+	results := make(chan loadTestResult)
+
+	var workers sync.WaitGroup
+	for range cfg.Concurrency {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for req := range requests {
+				results <- sendLoadTestRequest(client, req)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(requests)
+		generateLoadTestRequests(generating, ctx, cfg, queries, requests)
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	report := LoadTestReport{Rejected: map[string]int{}, Statuses: map[int]int{}}
+	start := time.Now()
+	for result := range results {
+		report.add(result)
+	}
+	report.Elapsed = time.Since(start)
+	slices.Sort(report.AllowedLatencies)
+	slices.Sort(report.RejectedLatencies)
+	return report, nil
+}
+
+func (r *LoadTestReport) add(result loadTestResult) {
+	r.Requests++
+	switch {
+	case result.err != nil:
+		r.Errors++
+		return
+	case result.blockedBy != "":
+		r.Rejected[result.blockedBy]++
+		r.RejectedLatencies = append(r.RejectedLatencies, result.latency)
+	case result.status >= 200 && result.status < 300:
+		r.Allowed++
+		r.AllowedLatencies = append(r.AllowedLatencies, result.latency)
+	}
+	r.Statuses[result.status]++
+}
+
+// generateLoadTestRequests sends requests to the workers at the configured rate. Requests are
+// not started while every worker is busy, so a slow proxy lowers the achieved rate.
+func generateLoadTestRequests(
+	generating, ctx context.Context, cfg LoadTestConfig, queries []string, requests chan<- *http.Request,
+) {
+	var tick <-chan time.Time
+	if cfg.QPS > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.QPS))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for sent := 0; cfg.Requests == 0 || sent < cfg.Requests; sent++ {
+		if tick != nil {
+			select {
+			case <-generating.Done():
+				return
+			case <-tick:
+			}
+		}
+
+		req := newLoadTestRequest(ctx, cfg, queries[rand.IntN(len(queries))])
+		select {
+		case <-generating.Done():
+			return
+		case requests <- req:
+		}
+	}
+}
+
+func newLoadTestRequest(ctx context.Context, cfg LoadTestConfig, query string) *http.Request {
+	path := proxymw.QueryPath
+	form := url.Values{"query": {query}}
+	now := time.Now()
+	if rand.Float64()*100 < cfg.RangePercent {
+		path = proxymw.QueryRangePath
+		form.Set("start", strconv.FormatInt(now.Add(-cfg.Range).Unix(), 10))
+		form.Set("end", strconv.FormatInt(now.Unix(), 10))
+		form.Set("step", strconv.FormatFloat(cfg.Step.Seconds(), 'f', -1, 64))
+	} else {
+		form.Set("time", strconv.FormatInt(now.Unix(), 10))
+	}
+
+	// the target is validated and the form encoded, so building the request cannot fail
+	req, _ := http.NewRequestWithContext(
+		ctx, http.MethodPost, strings.TrimSuffix(cfg.Target, "/")+path, strings.NewReader(form.Encode()),
+	)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func sendLoadTestRequest(client *http.Client, req *http.Request) loadTestResult {
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return loadTestResult{err: err, latency: time.Since(start)}
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(io.Discard, res.Body)
+	return loadTestResult{
+		status:    res.StatusCode,
+		blockedBy: res.Header.Get(string(proxymw.HeaderThrottleReason)),
+		latency:   time.Since(start),
+		err:       err,
+	}
+}
+
+func readQueries(path string) ([]string, error) {
+	f, err := os.Open(path) // nolint:gosec // configured path
+	if err != nil {
+		return nil, fmt.Errorf("load test queries: %w", err)
+	}
+	defer f.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			queries = append(queries, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("load test queries: %w", err)
+	}
+	if len(queries) == 0 {
+		return nil, ErrLoadTestNoQueries
+	}
+	return queries, nil
+}
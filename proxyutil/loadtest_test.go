@@ -0,0 +1,162 @@
+package proxyutil_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestParseLoadTestFlags(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		args []string
+		want proxyutil.LoadTestConfig
+		err  error
+	}{
+		{
+			name: "defaults",
+			want: proxyutil.LoadTestConfig{
+				Target:       "http://localhost:7777",
+				QPS:          10,
+				Concurrency:  4,
+				Duration:     30 * time.Second,
+				RangePercent: 20,
+				Range:        time.Hour,
+				Step:         time.Minute,
+				Timeout:      30 * time.Second,
+			},
+		},
+		{
+			name: "every flag",
+			args: []string{
+				"--target", "http://proxy:8080",
+				"--qps", "250",
+				"--concurrency", "32",
+				"--duration", "0",
+				"--requests", "1000",
+				"--queries-file", "queries.txt",
+				"--range-percent", "50",
+				"--range", "6h",
+				"--step", "30s",
+				"--header", "X-Tenant: team-a",
+				"--timeout", "5s",
+			},
+			want: proxyutil.LoadTestConfig{
+				Target:       "http://proxy:8080",
+				QPS:          250,
+				Concurrency:  32,
+				Requests:     1000,
+				QueriesFile:  "queries.txt",
+				RangePercent: 50,
+				Range:        6 * time.Hour,
+				Step:         30 * time.Second,
+				Headers:      map[string]string{"X-Tenant": "team-a"},
+				Timeout:      5 * time.Second,
+			},
+		},
+		{
+			name: "unbounded",
+			args: []string{"--duration", "0"},
+			err:  proxyutil.ErrLoadTestUnbounded,
+		},
+		{
+			name: "no workers",
+			args: []string{"--concurrency", "0"},
+			err:  proxyutil.ErrLoadTestConcurrency,
+		},
+		{
+			name: "range percent",
+			args: []string{"--range-percent", "120"},
+			err:  proxyutil.ErrLoadTestRangePct,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg, err := proxyutil.ParseLoadTestFlags(tt.args)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, cfg)
+		})
+	}
+}
+
+func TestRunLoadTest(t *testing.T) {
+	t.Parallel()
+	var (
+		mu    sync.Mutex
+		paths = map[string]int{}
+		seen  = map[string]bool{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		defer mu.Unlock()
+		paths[r.URL.Path]++
+		seen[r.PostForm.Get("query")] = true
+		require.Equal(t, "team-a", r.Header.Get("X-Tenant"))
+
+		if paths[r.URL.Path]%2 == 0 {
+			w.Header().Set(string(proxymw.HeaderThrottleReason), proxymw.BackpressureProxyType)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	queries := filepath.Join(t.TempDir(), "queries.txt")
+	require.NoError(t, os.WriteFile(queries, []byte("# recorded\nup\n\nsum(rate(errors[5m]))\n"), 0o600))
+
+	report, err := proxyutil.RunLoadTest(t.Context(), proxyutil.LoadTestConfig{
+		Target:       srv.URL,
+		Concurrency:  4,
+		Requests:     40,
+		QueriesFile:  queries,
+		RangePercent: 50,
+		Range:        time.Hour,
+		Step:         time.Minute,
+		Headers:      map[string]string{"X-Tenant": "team-a"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 40, report.Requests)
+	require.Equal(t, report.Allowed, report.Statuses[http.StatusOK])
+	require.Equal(t, report.Rejected[proxymw.BackpressureProxyType], report.Statuses[http.StatusTooManyRequests])
+	require.Equal(t, 40, report.Allowed+report.Rejected[proxymw.BackpressureProxyType])
+	require.Len(t, report.AllowedLatencies, report.Allowed)
+	require.Zero(t, report.Errors)
+	require.Equal(t, map[string]bool{"up": true, "sum(rate(errors[5m]))": true}, seen)
+	require.Equal(t, 40, paths[proxymw.QueryPath]+paths[proxymw.QueryRangePath])
+
+	var out bytes.Buffer
+	require.NoError(t, report.Write(&out))
+	require.Contains(t, out.String(), "rejected by backpressure")
+	require.Contains(t, out.String(), "status 429")
+}
+
+func TestRunLoadTestEmptyQueries(t *testing.T) {
+	t.Parallel()
+	queries := filepath.Join(t.TempDir(), "queries.txt")
+	require.NoError(t, os.WriteFile(queries, []byte("# nothing recorded\n"), 0o600))
+
+	_, err := proxyutil.RunLoadTest(t.Context(), proxyutil.LoadTestConfig{
+		Target:      "http://localhost",
+		Concurrency: 1,
+		Requests:    1,
+		QueriesFile: queries,
+	})
+	require.ErrorIs(t, err, proxyutil.ErrLoadTestNoQueries)
+}
@@ -0,0 +1,51 @@
+package proxyutil
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNegativePathTimeout = errors.New("path timeouts cannot be negative")
+	ErrInvalidPathMethod   = errors.New("path methods must be uppercase HTTP methods")
+)
+
+// PathConfig overrides the server settings for a proxy or passthrough path
+type PathConfig struct {
+	// Path is one of the ProxyPaths or PassthroughPaths
+	Path string `yaml:"path"`
+	// ReadTimeout and WriteTimeout replace the server timeouts for reading the request body and
+	// writing the response, e.g. to give long range queries more time than instant queries
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// ClientTimeout cancels requests to the path after the duration. It can only shorten the
+	// proxymw client timeout.
+	ClientTimeout time.Duration `yaml:"client_timeout"`
+	// Methods restricts the path to these methods, other methods are answered with 405
+	Methods []string `yaml:"methods"`
+}
+
+func (c PathConfig) Validate() error {
+	if !ValidPath(c.Path) {
+		return fmt.Errorf("invalid path %q", c.Path)
+	}
+
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.ClientTimeout < 0 {
+		return ErrNegativePathTimeout
+	}
+
+	for _, method := range c.Methods {
+		if method == "" || method != strings.ToUpper(method) || strings.ContainsAny(method, " ,") {
+			return ErrInvalidPathMethod
+		}
+	}
+	return nil
+}
+
+// AllowsMethod reports whether requests with the method may use the path
+func (c PathConfig) AllowsMethod(method string) bool {
+	return len(c.Methods) == 0 || slices.Contains(c.Methods, method)
+}
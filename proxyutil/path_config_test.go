@@ -0,0 +1,59 @@
+package proxyutil_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestPathConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cfg     proxyutil.PathConfig
+		wantErr error
+		invalid bool
+	}{
+		{
+			name: "valid",
+			cfg: proxyutil.PathConfig{
+				Path:          "/api/v1/query_range",
+				WriteTimeout:  5 * time.Minute,
+				ClientTimeout: 2 * time.Minute,
+				Methods:       []string{http.MethodGet, http.MethodPost},
+			},
+		},
+		{name: "invalid path", cfg: proxyutil.PathConfig{Path: "/"}, invalid: true},
+		{
+			name:    "negative timeout",
+			cfg:     proxyutil.PathConfig{Path: "/api/*", ReadTimeout: -time.Second},
+			wantErr: proxyutil.ErrNegativePathTimeout,
+			invalid: true,
+		},
+		{
+			name:    "lowercase method",
+			cfg:     proxyutil.PathConfig{Path: "/api/*", Methods: []string{"get"}},
+			wantErr: proxyutil.ErrInvalidPathMethod,
+			invalid: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			require.Equal(t, tt.invalid, err != nil, err)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPathConfigAllowsMethod(t *testing.T) {
+	require.True(t, proxyutil.PathConfig{}.AllowsMethod(http.MethodDelete))
+
+	cfg := proxyutil.PathConfig{Methods: []string{http.MethodGet, http.MethodPost}}
+	require.True(t, cfg.AllowsMethod(http.MethodPost))
+	require.False(t, cfg.AllowsMethod(http.MethodDelete))
+}
@@ -0,0 +1,36 @@
+package proxyutil
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidPathRewrite = errors.New("path rewrite prefix and replacement must start with /")
+
+// PathRewrite replaces the prefix of matching request paths before they are proxied, e.g. prefix
+// /prometheus/ with replacement / serves /prometheus/api/v1/query from /api/v1/query upstream.
+// Middlewares see the rewritten path.
+type PathRewrite struct {
+	Prefix      string `yaml:"prefix"`
+	Replacement string `yaml:"replacement"`
+}
+
+func (r PathRewrite) Validate() error {
+	if !strings.HasPrefix(r.Prefix, "/") || !strings.HasPrefix(r.Replacement, "/") {
+		return ErrInvalidPathRewrite
+	}
+	return nil
+}
+
+// Rewrite returns the path with the prefix replaced, or false when the path does not match
+func (r PathRewrite) Rewrite(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, r.Prefix)
+	if !ok {
+		return path, false
+	}
+
+	if strings.HasSuffix(r.Replacement, "/") {
+		return r.Replacement + strings.TrimPrefix(rest, "/"), true
+	}
+	return r.Replacement + rest, true
+}
@@ -0,0 +1,65 @@
+package proxyutil_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestPathRewrite(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		rewrite proxyutil.PathRewrite
+		path    string
+		want    string
+		match   bool
+	}{
+		{
+			name:    "strip prefix",
+			rewrite: proxyutil.PathRewrite{Prefix: "/prometheus/", Replacement: "/"},
+			path:    "/prometheus/api/v1/query",
+			want:    "/api/v1/query",
+			match:   true,
+		},
+		{
+			name:    "strip prefix without trailing slash",
+			rewrite: proxyutil.PathRewrite{Prefix: "/prometheus", Replacement: "/"},
+			path:    "/prometheus/api/v1/query",
+			want:    "/api/v1/query",
+			match:   true,
+		},
+		{
+			name:    "replace prefix",
+			rewrite: proxyutil.PathRewrite{Prefix: "/metrics/", Replacement: "/api/v1/"},
+			path:    "/metrics/query_range",
+			want:    "/api/v1/query_range",
+			match:   true,
+		},
+		{
+			name:    "no match",
+			rewrite: proxyutil.PathRewrite{Prefix: "/prometheus/", Replacement: "/"},
+			path:    "/loki/api/v1/query",
+			want:    "/loki/api/v1/query",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.rewrite.Validate())
+			got, match := tt.rewrite.Rewrite(tt.path)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.match, match)
+		})
+	}
+
+	require.ErrorIs(
+		t,
+		proxyutil.PathRewrite{Prefix: "prometheus", Replacement: "/"}.Validate(),
+		proxyutil.ErrInvalidPathRewrite,
+	)
+	require.ErrorIs(
+		t,
+		proxyutil.PathRewrite{Prefix: "/prometheus"}.Validate(),
+		proxyutil.ErrInvalidPathRewrite,
+	)
+}
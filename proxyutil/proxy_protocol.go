@@ -0,0 +1,184 @@
+package proxyutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProxyProtocolHeaderTimeout bounds how long a connection may take to send its PROXY header
+	ProxyProtocolHeaderTimeout = 5 * time.Second
+
+	// proxyProtocolV1MaxLength is the longest v1 header including the CRLF
+	proxyProtocolV1MaxLength = 107
+	proxyProtocolV2HeaderLen = 16
+)
+
+var (
+	ErrInvalidProxyProtocol = errors.New("invalid PROXY protocol header")
+
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtocolListener reads the PROXY protocol v1 or v2 header a load balancer sends ahead of
+// each connection so the address of the real client becomes the remote address of the conn
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener requires a PROXY protocol header on every accepted connection.
+// Connections without a valid header are closed on their first read. Only enable it behind load
+// balancers which send the header, since any client reaching the listener can claim an address.
+func NewProxyProtocolListener(l net.Listener) net.Listener {
+	return &proxyProtocolListener{Listener: l}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn parses the header lazily so a slow client cannot block the accept loop
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(ProxyProtocolHeaderTimeout)); err != nil {
+		c.err = err
+		return
+	}
+
+	c.remote, c.err = readProxyProtocolHeader(c.reader)
+	if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// readProxyProtocolHeader consumes the header and returns the source address it carries, or nil
+// when the sender proxies on its own behalf, e.g. for load balancer health checks
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyProtocol, err)
+	}
+
+	if bytes.Equal(prefix, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1(r)
+	}
+	return readProxyProtocolV2(r)
+}
+
+// readProxyProtocolV1 parses `PROXY <TCP4|TCP6|UNKNOWN> <src> <dst> <srcport> <dstport>\r\n`
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyProtocol)
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidProxyProtocol, err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyProtocol, strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: source %s:%s", ErrInvalidProxyProtocol, fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parses the binary header of version 2
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyProtocolV2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyProtocol, err)
+	}
+
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: missing signature", ErrInvalidProxyProtocol)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyProtocol, err)
+	}
+
+	const commandLocal, commandProxy = 0x0, 0x1
+	switch header[12] & 0x0f {
+	case commandLocal:
+		return nil, nil
+	case commandProxy:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %#x", ErrInvalidProxyProtocol, header[12])
+	}
+
+	// the source address and port lead the payload followed by the destination and TLVs
+	const familyInet, familyInet6 = 0x1, 0x2
+	var ipLen int
+	switch header[13] >> 4 {
+	case familyInet:
+		ipLen = net.IPv4len
+	case familyInet6:
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry no client IP
+		return nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidProxyProtocol)
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package proxyutil_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+// proxyProtocolV2 builds a v2 header with the command and an address block for the source
+func proxyProtocolV2(command byte, src net.IP, port uint16) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x20|command)
+
+	var block []byte
+	switch {
+	case src == nil:
+		header = append(header, 0x00)
+	case src.To4() != nil:
+		header = append(header, 0x11)
+		block = append(block, src.To4()...)
+		block = append(block, net.IPv4(10, 0, 0, 1).To4()...)
+	default:
+		header = append(header, 0x21)
+		block = append(block, src.To16()...)
+		block = append(block, net.ParseIP("fd00::1").To16()...)
+	}
+	if src != nil {
+		block = binary.BigEndian.AppendUint16(block, port)
+		block = binary.BigEndian.AppendUint16(block, 7777)
+	}
+
+	header = binary.BigEndian.AppendUint16(header, uint16(len(block)))
+	return append(header, block...)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	})}
+	go func() { _ = srv.Serve(proxyutil.NewProxyProtocolListener(l)) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	for _, tt := range []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 7777\r\n"),
+			want:   "203.0.113.7:51234",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::7 fd00::1 51234 7777\r\n"),
+			want:   "[2001:db8::7]:51234",
+		},
+		{
+			name:   "v1 unknown keeps the peer address",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			want:   "127.0.0.1",
+		},
+		{
+			name:   "v2 ipv4",
+			header: proxyProtocolV2(0x1, net.ParseIP("198.51.100.4"), 4000),
+			want:   "198.51.100.4:4000",
+		},
+		{
+			name:   "v2 ipv6",
+			header: proxyProtocolV2(0x1, net.ParseIP("2001:db8::4"), 4000),
+			want:   "[2001:db8::4]:4000",
+		},
+		{
+			name:   "v2 local keeps the peer address",
+			header: proxyProtocolV2(0x0, nil, 0),
+			want:   "127.0.0.1",
+		},
+		{
+			name:    "missing header",
+			header:  []byte{},
+			wantErr: true,
+		},
+		{
+			name:    "malformed v1",
+			header:  []byte("PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n"),
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write(append(tt.header, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n"...))
+			require.NoError(t, err)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			if tt.wantErr {
+				// the request is never handed to the handler
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				return
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Contains(t, string(body), tt.want)
+		})
+	}
+}
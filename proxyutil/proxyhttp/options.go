@@ -0,0 +1,62 @@
+package proxyhttp
+
+import (
+	"net/http"
+	"net/http/httputil"
+)
+
+// Option customizes the reverse proxies built by NewRoutes
+type Option func(*options)
+
+type options struct {
+	directors       []func(*http.Request)
+	modifyResponses []func(*http.Response) error
+}
+
+// WithDirector mutates upstream requests after they are pointed at their upstream, e.g. to add
+// authentication headers. Directors run in the order they are passed.
+func WithDirector(director func(*http.Request)) Option {
+	return func(o *options) {
+		o.directors = append(o.directors, director)
+	}
+}
+
+// WithModifyResponse mutates upstream responses before they are copied to the client, e.g. to
+// strip Set-Cookie. An error is answered with 502 Bad Gateway and stops later hooks.
+func WithModifyResponse(modifyResponse func(*http.Response) error) Option {
+	return func(o *options) {
+		o.modifyResponses = append(o.modifyResponses, modifyResponse)
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// apply installs the hooks on a reverse proxy
+func (o options) apply(proxy *httputil.ReverseProxy) {
+	if len(o.directors) > 0 {
+		direct := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			direct(req)
+			for _, director := range o.directors {
+				director(req)
+			}
+		}
+	}
+
+	if len(o.modifyResponses) > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			for _, modifyResponse := range o.modifyResponses {
+				if err := modifyResponse(resp); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxyhttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+	"github.com/kevindweb/throttle-proxy/proxyutil/proxyhttp"
+)
+
+func TestRouteOptions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	order := []string{}
+	routes, err := proxyhttp.NewRoutes(
+		context.Background(),
+		proxyutil.Config{Upstream: upstream.URL},
+		proxyhttp.WithDirector(func(req *http.Request) {
+			order = append(order, "first")
+			req.Header.Set("Authorization", "Bearer token")
+		}),
+		proxyhttp.WithDirector(func(_ *http.Request) {
+			order = append(order, "second")
+		}),
+		proxyhttp.WithModifyResponse(func(resp *http.Response) error {
+			resp.Header.Del("Set-Cookie")
+			return nil
+		}),
+		proxyhttp.WithModifyResponse(func(resp *http.Response) error {
+			if resp.Request.URL.Path == "/fail" {
+				return errors.New("rejected response")
+			}
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/query", http.NoBody))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "Bearer token", w.Header().Get("X-Auth"))
+	require.Empty(t, w.Header().Get("Set-Cookie"))
+	require.Equal(t, []string{"first", "second"}, order)
+
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fail", http.NoBody))
+	require.Equal(t, http.StatusBadGateway, w.Code)
+}
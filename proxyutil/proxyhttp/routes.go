@@ -9,6 +9,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/kevindweb/throttle-proxy/proxymw"
 	"github.com/kevindweb/throttle-proxy/proxyutil"
@@ -18,12 +21,23 @@ import (
 type routes struct {
 	upstream *url.URL
 	handler  http.Handler
+	routed   []upstreamRoute
 	mux      http.Handler
+	chain    *proxymw.ServeEntry
 }
 
-// NewRoutes creates a new HTTP handler for proxying requests based on the provided configuration
-func NewRoutes(ctx context.Context, cfg proxyutil.Config) (http.Handler, error) {
-	upstream, err := parseUpstream(cfg.Upstream)
+// upstreamRoute proxies the requests matching the route to its upstream
+type upstreamRoute struct {
+	proxyutil.UpstreamRoute
+	handler http.Handler
+}
+
+// NewRoutes creates a new HTTP handler for proxying requests based on the provided configuration.
+// Options add hooks to the reverse proxy of every upstream. The handler is an io.Closer, closing
+// it stops the background work of the middleware chain once the server is drained.
+func NewRoutes(ctx context.Context, cfg proxyutil.Config, opts ...Option) (http.Handler, error) {
+	o := newOptions(opts)
+	upstream, discovered, err := parseUpstream(cfg.Upstream)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
 	}
@@ -32,30 +46,125 @@ func NewRoutes(ctx context.Context, cfg proxyutil.Config) (http.Handler, error)
 		return nil, fmt.Errorf("failed to validate middleware config: %w", err)
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(upstream)
-	proxy.ErrorLog = log.Default()
+	if err := cfg.UpstreamTransport.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate upstream transport config: %w", err)
+	}
+
+	transport := newUpstreamTransport(cfg.UpstreamTransport, cfg.UpstreamWarmConnections)
+	if discovered != nil {
+		discoverUpstream(ctx, discovered)
+	} else {
+		warmUpstream(ctx, transport, upstream, cfg.UpstreamWarmConnections)
+	}
+
+	routed, err := newUpstreamRoutes(ctx, cfg.UpstreamRoutes, transport, o)
+	if err != nil {
+		return nil, err
+	}
 
 	r := &routes{
 		upstream: upstream,
-		handler:  proxy,
+		handler:  newReverseProxy(upstream, discovered, transport, o),
+		routed:   routed,
 	}
 
-	mw := proxymw.NewServeFromConfig(cfg.ProxyConfig, r.passthrough)
-	mw.Init(ctx)
+	mw, err := proxymw.NewServeFromChain(
+		cfg.ProxyConfig, proxymw.NewChainBuilder(cfg.ProxyConfig), r.passthrough,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build middleware chain: %w", err)
+	}
+	if err := mw.Init(ctx); err != nil {
+		return nil, fmt.Errorf("failed to initialize middleware chain: %w", err)
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/healthz", http.HandlerFunc(handleHealthCheck))
+	mux.Handle(proxymw.ReadinessPath, http.HandlerFunc(proxymw.ReadinessHandler))
+
+	pathConfigs, err := validatePaths(cfg)
+	if err != nil {
+		return nil, err
+	}
 
+	proxied := rewritePaths(cfg.PathRewrites, mw)
 	for _, path := range cfg.ProxyPaths {
-		mux.Handle(path, mw)
+		mux.Handle(muxPattern(path), withPathConfig(pathConfigs[path], proxied))
 	}
 
-	registerPassthroughPaths(mux, cfg.PassthroughPaths, r.passthrough)
+	registerPassthroughPaths(
+		mux,
+		cfg.PassthroughPaths,
+		pathConfigs,
+		rewritePaths(cfg.PathRewrites, http.HandlerFunc(r.passthrough)),
+	)
 
 	r.mux = mux
+	r.chain = mw
 	return r, nil
 }
 
+// Close stops the pollers and background requests of the middleware chain and waits for them
+func (r *routes) Close() error {
+	return r.chain.Close()
+}
+
+// newReverseProxy proxies to the upstream, or round-robin across the SRV targets of a discovered
+// upstream. Requests sent before the first successful resolution go to the SRV record name and
+// fail with a 502.
+func newReverseProxy(
+	upstream *url.URL, discovered *proxymw.DiscoveredURL, transport http.RoundTripper, o options,
+) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = transport
+	proxy.ErrorLog = log.Default()
+	if discovered != nil {
+		direct := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			direct(req)
+			if target := discovered.Next(); target != nil {
+				req.URL.Host = target.Host
+			}
+		}
+	}
+	o.apply(proxy)
+	return proxy
+}
+
+// discoverUpstream resolves the SRV records of an upstream before serving and keeps them fresh
+// until the context is done. Failures are not fatal, like warming a static upstream.
+func discoverUpstream(ctx context.Context, discovered *proxymw.DiscoveredURL) {
+	if err := discovered.Resolve(ctx); err != nil {
+		log.Printf("failed to resolve upstream %s: %v", discovered, err)
+	}
+	go discovered.Run(ctx, proxymw.DNSRefreshInterval)
+}
+
+// newUpstreamRoutes builds a reverse proxy for each route sharing the default upstream transport
+func newUpstreamRoutes(
+	ctx context.Context, cfgs []proxyutil.UpstreamRoute, transport http.RoundTripper, o options,
+) ([]upstreamRoute, error) {
+	routed := make([]upstreamRoute, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("failed to validate upstream route: %w", err)
+		}
+
+		upstream, discovered, err := parseUpstream(cfg.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse upstream route URL: %w", err)
+		}
+		if discovered != nil {
+			discoverUpstream(ctx, discovered)
+		}
+		routed = append(routed, upstreamRoute{
+			UpstreamRoute: cfg,
+			handler:       newReverseProxy(upstream, discovered, transport, o),
+		})
+	}
+	return routed, nil
+}
+
 // handleHealthCheck responds to health check requests
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	if err := json.NewEncoder(w).Encode(map[string]bool{"ok": true}); err != nil {
@@ -63,33 +172,158 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// validatePaths checks the proxy paths, rewrites, and path configs, returning the configs by path
+func validatePaths(cfg proxyutil.Config) (map[string]proxyutil.PathConfig, error) {
+	paths := append(slices.Clone(cfg.ProxyPaths), cfg.PassthroughPaths...)
+	for _, path := range paths {
+		if !proxyutil.ValidPath(path) {
+			return nil, fmt.Errorf("invalid proxy path %q", path)
+		}
+	}
+
+	for _, rewrite := range cfg.PathRewrites {
+		if err := rewrite.Validate(); err != nil {
+			return nil, fmt.Errorf("failed to validate path rewrite: %w", err)
+		}
+	}
+
+	pathConfigs := make(map[string]proxyutil.PathConfig, len(cfg.PathConfigs))
+	for _, pc := range cfg.PathConfigs {
+		if err := pc.Validate(); err != nil {
+			return nil, fmt.Errorf("failed to validate path config: %w", err)
+		}
+
+		if !slices.Contains(paths, pc.Path) {
+			return nil, fmt.Errorf("path config %q is not a proxy or passthrough path", pc.Path)
+		}
+		pathConfigs[pc.Path] = pc
+	}
+	return pathConfigs, nil
+}
+
 // registerPassthroughPaths configures routes that should bypass the proxy middleware
-func registerPassthroughPaths(mux *http.ServeMux, paths []string, handler http.HandlerFunc) {
+func registerPassthroughPaths(
+	mux *http.ServeMux,
+	paths []string,
+	pathConfigs map[string]proxyutil.PathConfig,
+	handler http.Handler,
+) {
 	if len(paths) == 0 {
 		mux.Handle("/", handler)
 		return
 	}
 
 	for _, path := range paths {
-		mux.Handle(path, handler)
+		mux.Handle(muxPattern(path), withPathConfig(pathConfigs[path], handler))
 	}
 }
 
-// parseUpstream validates and parses the upstream URL
-func parseUpstream(upstream string) (*url.URL, error) {
+// withPathConfig rejects methods the path does not allow and applies its timeouts
+func withPathConfig(cfg proxyutil.PathConfig, next http.Handler) http.Handler {
+	if cfg.Path == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !cfg.AllowsMethod(req.Method) {
+			writeMethodNotAllowed(w, req.Method, cfg.Methods)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		if cfg.ReadTimeout > 0 {
+			if err := rc.SetReadDeadline(time.Now().Add(cfg.ReadTimeout)); err != nil {
+				log.Printf("error setting read deadline of %s: %v", cfg.Path, err)
+			}
+		}
+
+		if cfg.WriteTimeout > 0 {
+			if err := rc.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+				log.Printf("error setting write deadline of %s: %v", cfg.Path, err)
+			}
+		}
+
+		if cfg.ClientTimeout > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), cfg.ClientTimeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, method string, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+
+	if err := json.NewEncoder(w).Encode(proxymw.APIErrorResponse{
+		Status:    "error",
+		ErrorType: "method_not_allowed",
+		Error:     fmt.Sprintf("method %s is not allowed", method),
+	}); err != nil {
+		log.Printf("error writing method not allowed response: %v", err)
+	}
+}
+
+// muxPattern turns a path ending in /* into the ServeMux pattern matching every path below it
+func muxPattern(path string) string {
+	if prefix, ok := strings.CutSuffix(path, "/*"); ok {
+		return prefix + "/"
+	}
+	return path
+}
+
+// rewritePaths applies the first matching rewrite before the request reaches the middlewares
+func rewritePaths(rewrites []proxyutil.PathRewrite, next http.Handler) http.Handler {
+	if len(rewrites) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rewrite := range rewrites {
+			path, ok := rewrite.Rewrite(req.URL.Path)
+			if !ok {
+				continue
+			}
+
+			rewritten := new(http.Request)
+			*rewritten = *req
+			rewritten.URL = new(url.URL)
+			*rewritten.URL = *req.URL
+			rewritten.URL.Path = path
+			rewritten.URL.RawPath = ""
+			req = rewritten
+			break
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// parseUpstream validates and parses the upstream URL. dnssrv+ upstreams are also returned as a
+// DiscoveredURL whose targets replace the SRV record name of the URL.
+func parseUpstream(upstream string) (*url.URL, *proxymw.DiscoveredURL, error) {
+	if proxymw.IsDNSSRV(upstream) {
+		discovered, err := proxymw.NewDiscoveredURL(upstream)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+		}
+		return discovered.URL(), discovered, nil
+	}
+
 	upstreamURL, err := url.Parse(upstream)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse upstream URL: %w", err)
 	}
 
 	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
-		return nil, fmt.Errorf(
+		return nil, nil, fmt.Errorf(
 			"invalid scheme for upstream URL %q, only 'http' and 'https' are supported",
 			upstream,
 		)
 	}
 
-	return upstreamURL, nil
+	return upstreamURL, nil, nil
 }
 
 // ServeHTTP implements the http.Handler interface
@@ -99,5 +333,11 @@ func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 // passthrough forwards requests directly to the upstream server without middleware
 func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
+	for _, route := range r.routed {
+		if route.Matches(req) {
+			route.handler.ServeHTTP(w, req)
+			return
+		}
+	}
 	r.handler.ServeHTTP(w, req)
 }
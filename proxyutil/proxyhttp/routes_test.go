@@ -2,6 +2,7 @@ package proxyhttp_test
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -31,6 +32,21 @@ func TestInvalidJitterConfig(t *testing.T) {
 	require.Nil(t, routes)
 }
 
+func TestRoutesClose(t *testing.T) {
+	cfg := proxyutil.Config{
+		Upstream:         "http://localhost:9090",
+		ProxyPaths:       []string{"/api/v1/query"},
+		PassthroughPaths: []string{},
+	}
+
+	routes, err := proxyhttp.NewRoutes(context.Background(), cfg)
+	require.NoError(t, err)
+	closer, ok := routes.(io.Closer)
+	require.True(t, ok)
+	require.NoError(t, closer.Close())
+	require.ErrorIs(t, closer.Close(), proxymw.ErrChainClosed)
+}
+
 func TestNewRoutes(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -67,6 +83,11 @@ func TestNewRoutes(t *testing.T) {
 			path:           "/healthz",
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "Readiness Check",
+			path:           "/readyz",
+			expectedStatus: http.StatusOK,
+		},
 		{
 			name:           "Passthrough Path",
 			path:           "/test-proxy",
@@ -168,3 +189,193 @@ func TestNewDefaultPassthroughRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestUpstreamRoutes(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	upstreams := map[string]*httptest.Server{}
+	for _, name := range []string{"default", "host", "header"} {
+		upstreams[name] = newUpstream(name)
+		defer upstreams[name].Close()
+	}
+
+	cfg := proxyutil.Config{
+		Upstream:   upstreams["default"].URL,
+		ProxyPaths: []string{"/api/v1/query"},
+		UpstreamRoutes: []proxyutil.UpstreamRoute{
+			{Host: "prom-b.example.com", Upstream: upstreams["host"].URL},
+			{Header: "X-Scope-OrgID", Value: "team-c", Upstream: upstreams["header"].URL},
+		},
+	}
+	routes, err := proxyhttp.NewRoutes(context.Background(), cfg)
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(routes)
+	defer testServer.Close()
+
+	for _, tt := range []struct {
+		name   string
+		host   string
+		orgID  string
+		path   string
+		wanted string
+	}{
+		{name: "default upstream", path: "/api/v1/query", wanted: "default"},
+		{name: "host route", host: "prom-b.example.com", path: "/api/v1/query", wanted: "host"},
+		{name: "header route", orgID: "team-c", path: "/api/v1/labels", wanted: "header"},
+		{name: "unmatched header", orgID: "team-d", path: "/api/v1/query", wanted: "default"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(
+				context.Background(), http.MethodGet, testServer.URL+tt.path, http.NoBody,
+			)
+			require.NoError(t, err)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.orgID != "" {
+				req.Header.Set("X-Scope-OrgID", tt.orgID)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.wanted, string(body))
+		})
+	}
+
+	cfg.UpstreamRoutes = []proxyutil.UpstreamRoute{{Host: "prom-b.example.com"}}
+	_, err = proxyhttp.NewRoutes(context.Background(), cfg)
+	require.ErrorIs(t, err, proxyutil.ErrInvalidUpstreamRoute)
+
+	cfg.UpstreamRoutes = []proxyutil.UpstreamRoute{
+		{Host: "prom-b.example.com", Upstream: "dnssrv+http://_web._tcp.prom-b:9090"},
+	}
+	_, err = proxyhttp.NewRoutes(context.Background(), cfg)
+	require.ErrorIs(t, err, proxymw.ErrInvalidDNSSRVURL)
+}
+
+func TestPathRewrites(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	cfg := proxyutil.Config{
+		Upstream:         upstream.URL,
+		ProxyPaths:       []string{"/prometheus/*"},
+		PassthroughPaths: []string{"/static/*"},
+		PathRewrites: []proxyutil.PathRewrite{
+			{Prefix: "/prometheus/", Replacement: "/"},
+		},
+		ProxyConfig: proxymw.Config{ClientTimeout: time.Second},
+	}
+	routes, err := proxyhttp.NewRoutes(context.Background(), cfg)
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(routes)
+	defer testServer.Close()
+
+	for _, tt := range []struct {
+		path       string
+		wantStatus int
+		wantPath   string
+	}{
+		{path: "/prometheus/api/v1/query", wantStatus: http.StatusOK, wantPath: "/api/v1/query"},
+		{path: "/static/app.js", wantStatus: http.StatusOK, wantPath: "/static/app.js"},
+		{path: "/api/v1/query", wantStatus: http.StatusNotFound},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(
+				context.Background(), http.MethodGet, testServer.URL+tt.path, http.NoBody,
+			)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantPath != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, tt.wantPath, string(body))
+			}
+		})
+	}
+
+	cfg.ProxyPaths = []string{"/prometheus/*/query"}
+	_, err = proxyhttp.NewRoutes(context.Background(), cfg)
+	require.Error(t, err)
+}
+
+func TestPathConfigs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := proxyutil.Config{
+		Upstream:         upstream.URL,
+		ProxyPaths:       []string{"/api/v1/query"},
+		PassthroughPaths: []string{"/api/v1/query_range"},
+		PathConfigs: []proxyutil.PathConfig{
+			{Path: "/api/v1/query", Methods: []string{http.MethodGet, http.MethodPost}},
+			{Path: "/api/v1/query_range", ClientTimeout: 10 * time.Millisecond},
+		},
+		ProxyConfig: proxymw.Config{ClientTimeout: time.Minute},
+	}
+	routes, err := proxyhttp.NewRoutes(context.Background(), cfg)
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(routes)
+	defer testServer.Close()
+
+	for _, tt := range []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "allowed method", method: http.MethodGet, path: "/api/v1/query", wantStatus: http.StatusOK},
+		{
+			name:       "disallowed method",
+			method:     http.MethodDelete,
+			path:       "/api/v1/query",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "path client timeout",
+			method:     http.MethodGet,
+			path:       "/api/v1/query_range",
+			wantStatus: http.StatusBadGateway,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(
+				context.Background(), tt.method, testServer.URL+tt.path, http.NoBody,
+			)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusMethodNotAllowed {
+				require.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+			}
+		})
+	}
+
+	cfg.PathConfigs = []proxyutil.PathConfig{{Path: "/api/v1/labels"}}
+	_, err = proxyhttp.NewRoutes(context.Background(), cfg)
+	require.Error(t, err)
+}
@@ -0,0 +1,115 @@
+package proxyhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+// UpstreamWarmupTimeout bounds how long startup waits on DNS and warm connections
+const UpstreamWarmupTimeout = 5 * time.Second
+
+// newUpstreamTransport clones the default transport with the configured overrides and keeps
+// enough idle connections per host to hold every warmed connection until the first burst of
+// traffic arrives.
+func newUpstreamTransport(cfg proxyutil.UpstreamTransportConfig, warmConns int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+	}
+	if cfg.H2C {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(!cfg.DisableHTTP2)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	transport.MaxIdleConnsPerHost = max(transport.MaxIdleConnsPerHost, warmConns)
+	transport.MaxIdleConns = max(transport.MaxIdleConns, warmConns)
+	return transport
+}
+
+// warmUpstream pre-resolves the upstream host and opens warmConns connections through the
+// transport so TLS handshakes are done before the proxy serves traffic. Failures are not fatal
+// since the upstream may still be starting after a deploy.
+func warmUpstream(
+	ctx context.Context, transport *http.Transport, upstream *url.URL, warmConns int,
+) {
+	ctx, cancel := context.WithTimeout(ctx, UpstreamWarmupTimeout)
+	defer cancel()
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, upstream.Hostname()); err != nil {
+		log.Printf("failed to pre-resolve upstream %s: %v", upstream.Hostname(), err)
+		return
+	}
+
+	if warmConns <= 0 {
+		return
+	}
+
+	// requests are held open until every connection is dialed so none of them reuse each other
+	var (
+		wg    sync.WaitGroup
+		ready sync.WaitGroup
+		errs  = make(chan error, warmConns)
+	)
+	ready.Add(warmConns)
+	for range warmConns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- warmConnection(ctx, transport, upstream, &ready)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	warmed := 0
+	for err := range errs {
+		if err != nil {
+			log.Printf("failed to warm upstream connection: %v", err)
+			continue
+		}
+		warmed++
+	}
+	log.Printf("warmed %d/%d upstream connections to %s", warmed, warmConns, upstream.Host)
+}
+
+func warmConnection(
+	ctx context.Context, transport *http.Transport, upstream *url.URL, ready *sync.WaitGroup,
+) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, upstream.String(), http.NoBody)
+	if err != nil {
+		ready.Done()
+		return err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	ready.Done()
+	if err != nil {
+		return err
+	}
+
+	ready.Wait()
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Errorf("error draining warm-up response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package proxyhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestWarmUpstream(t *testing.T) {
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	transport := newUpstreamTransport(proxyutil.UpstreamTransportConfig{}, 3)
+	warmUpstream(context.Background(), transport, u, 3)
+	require.Equal(t, int32(3), conns.Load())
+
+	// traffic after warm-up reuses an idle connection
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, upstream.URL, http.NoBody))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, int32(3), conns.Load())
+}
+
+func TestWarmUpstreamUnreachable(t *testing.T) {
+	u, err := url.Parse("http://127.0.0.1:1")
+	require.NoError(t, err)
+
+	// an unavailable upstream must not block startup
+	warmUpstream(context.Background(), newUpstreamTransport(proxyutil.UpstreamTransportConfig{}, 2), u, 2)
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	transport := newUpstreamTransport(proxyutil.UpstreamTransportConfig{
+		DisableHTTP2:        true,
+		MaxConnsPerHost:     10,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+	}, 8)
+	require.False(t, transport.ForceAttemptHTTP2)
+	require.Equal(t, 10, transport.MaxConnsPerHost)
+	require.Equal(t, 8, transport.MaxIdleConnsPerHost)
+	require.Equal(t, time.Minute, transport.IdleConnTimeout)
+
+	var proto atomic.Value
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		w.WriteHeader(http.StatusOK)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	transport = newUpstreamTransport(proxyutil.UpstreamTransportConfig{H2C: true}, 0)
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, upstream.URL, http.NoBody))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "HTTP/2.0", proto.Load())
+}
@@ -0,0 +1,225 @@
+package proxyutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+)
+
+// ReplayCommand is the first argument running the binary to replay a record file instead of
+// serving as a proxy
+const ReplayCommand = "replay"
+
+var (
+	ErrReplayTarget      = errors.New("replay requires a target URL")
+	ErrReplayFile        = errors.New("replay requires a record file")
+	ErrReplayConcurrency = errors.New("replay concurrency must be positive")
+	ErrReplaySpeed       = errors.New("replay speed and timeout must not be negative")
+	ErrReplayNoRequests  = errors.New("replay record file has no requests")
+)
+
+// ReplayConfig re-sends requests recorded by the proxy against another environment
+type ReplayConfig struct {
+	// Target is the base URL the recorded paths are sent to
+	Target string
+	// File is the record file written with the record_config of the proxy
+	File string
+	// Speed scales the original time between requests, e.g. 2 replays twice as fast. Requests
+	// are sent back to back when zero.
+	Speed float64
+	// Concurrency bounds the requests in flight. Requests due while the bound is reached are
+	// sent late.
+	Concurrency int
+	// Headers are sent with every request in addition to the recorded ones
+	Headers map[string]string
+	// Timeout bounds each request
+	Timeout time.Duration
+}
+
+func (c ReplayConfig) Validate() error {
+	if c.Target == "" {
+		return ErrReplayTarget
+	}
+	if _, err := url.Parse(c.Target); err != nil {
+		return fmt.Errorf("replay target: %w", err)
+	}
+	if c.File == "" {
+		return ErrReplayFile
+	}
+	if c.Concurrency < 1 {
+		return ErrReplayConcurrency
+	}
+	if c.Speed < 0 || c.Timeout < 0 {
+		return ErrReplaySpeed
+	}
+	return nil
+}
+
+// ParseReplayFlags parses the arguments following the replay command
+func ParseReplayFlags(args []string) (ReplayConfig, error) {
+	cfg := ReplayConfig{}
+	flags := flag.NewFlagSet(ReplayCommand, flag.ContinueOnError)
+
+	var headers StringSlice
+	flags.StringVar(&cfg.Target, "target", "", "Base URL to replay the recorded requests against")
+	flags.StringVar(&cfg.File, "record-file", "", "Record file written by --enable-recording")
+	flags.Float64Var(
+		&cfg.Speed,
+		"speed",
+		1,
+		"Multiplier of the original request rate, back to back when 0",
+	)
+	flags.IntVar(&cfg.Concurrency, "concurrency", 64, "Maximum requests in flight")
+	flags.Var(&headers, "header", "Header sent with every request as <name>: <value> (can be repeated)")
+	flags.DurationVar(&cfg.Timeout, "timeout", 30*time.Second, "Timeout of each request")
+
+	if err := flags.Parse(args); err != nil {
+		return ReplayConfig{}, err
+	}
+
+	var err error
+	if cfg.Headers, err = parseHeaders(headers); err != nil {
+		return ReplayConfig{}, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// RunReplay sends the recorded requests in the order they arrived, preserving the time between
+// them, until every request was sent or ctx is done
+func RunReplay(ctx context.Context, cfg ReplayConfig) (LoadTestReport, error) {
+	records, err := readRecordedRequests(cfg.File)
+	if err != nil {
+		return LoadTestReport{}, err
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	report := LoadTestReport{Rejected: map[string]int{}, Statuses: map[int]int{}}
+	var (
+		mu       sync.Mutex
+		inflight sync.WaitGroup
+	)
+	slots := make(chan struct{}, cfg.Concurrency)
+
+	start := time.Now()
+	first := records[0].Time
+replay:
+	for _, record := range records {
+		if cfg.Speed > 0 {
+			due := start.Add(time.Duration(float64(record.Time.Sub(first)) / cfg.Speed))
+			if !sleepUntil(ctx, due) {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			break replay
+		case slots <- struct{}{}:
+		}
+
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			result := sendLoadTestRequest(client, newReplayRequest(ctx, cfg, record))
+			mu.Lock()
+			report.add(result)
+			mu.Unlock()
+		}()
+	}
+
+	inflight.Wait()
+	report.Elapsed = time.Since(start)
+	slices.Sort(report.AllowedLatencies)
+	slices.Sort(report.RejectedLatencies)
+	return report, nil
+}
+
+// sleepUntil waits for the due time, returning false when ctx is done first
+func sleepUntil(ctx context.Context, due time.Time) bool {
+	wait := time.Until(due)
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func newReplayRequest(ctx context.Context, cfg ReplayConfig, record proxymw.RecordedRequest) *http.Request {
+	target := strings.TrimSuffix(cfg.Target, "/") + record.Path
+	params := record.Params.Encode()
+
+	var req *http.Request
+	if record.Method == http.MethodGet || record.Method == http.MethodHead {
+		if params != "" {
+			target += "?" + params
+		}
+		// the target is validated and the path recorded from a parsed URL
+		req, _ = http.NewRequestWithContext(ctx, record.Method, target, http.NoBody)
+	} else {
+		req, _ = http.NewRequestWithContext(ctx, record.Method, target, strings.NewReader(params))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	for name, values := range record.Header {
+		req.Header[name] = values
+	}
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+// readRecordedRequests reads a record file sorted by arrival time. Requests are written when
+// they complete, so the file is not in arrival order.
+func readRecordedRequests(path string) ([]proxymw.RecordedRequest, error) {
+	f, err := os.Open(path) // nolint:gosec // configured path
+	if err != nil {
+		return nil, fmt.Errorf("replay record file: %w", err)
+	}
+	defer f.Close()
+
+	var records []proxymw.RecordedRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record proxymw.RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("replay record file line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("replay record file: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, ErrReplayNoRequests
+	}
+
+	slices.SortStableFunc(records, func(a, b proxymw.RecordedRequest) int {
+		return a.Time.Compare(b.Time)
+	})
+	return records, nil
+}
@@ -0,0 +1,152 @@
+package proxyutil_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestParseReplayFlags(t *testing.T) {
+	t.Parallel()
+	cfg, err := proxyutil.ParseReplayFlags([]string{
+		"--target", "http://staging:7777",
+		"--record-file", "traffic.jsonl",
+		"--speed", "2",
+		"--concurrency", "8",
+		"--header", "X-Replay: true",
+		"--timeout", "5s",
+	})
+	require.NoError(t, err)
+	require.Equal(t, proxyutil.ReplayConfig{
+		Target:      "http://staging:7777",
+		File:        "traffic.jsonl",
+		Speed:       2,
+		Concurrency: 8,
+		Headers:     map[string]string{"X-Replay": "true"},
+		Timeout:     5 * time.Second,
+	}, cfg)
+
+	_, err = proxyutil.ParseReplayFlags([]string{"--record-file", "traffic.jsonl"})
+	require.ErrorIs(t, err, proxyutil.ErrReplayTarget)
+	_, err = proxyutil.ParseReplayFlags([]string{"--target", "http://staging:7777"})
+	require.ErrorIs(t, err, proxyutil.ErrReplayFile)
+	_, err = proxyutil.ParseReplayFlags([]string{
+		"--target", "http://staging:7777", "--record-file", "traffic.jsonl", "--speed", "-1",
+	})
+	require.ErrorIs(t, err, proxyutil.ErrReplaySpeed)
+}
+
+func writeRecords(t *testing.T, records ...proxymw.RecordedRequest) string {
+	t.Helper()
+	var lines []string
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		require.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+
+	file := filepath.Join(t.TempDir(), "traffic.jsonl")
+	require.NoError(t, os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+	return file
+}
+
+func TestRunReplay(t *testing.T) {
+	t.Parallel()
+	type received struct {
+		method, path, query, tenant, replay string
+		at                                  time.Time
+	}
+	var (
+		mu       sync.Mutex
+		requests []received
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		requests = append(requests, received{
+			method: r.Method,
+			path:   r.URL.Path,
+			query:  r.Form.Get("query"),
+			tenant: r.Header.Get("X-Scope-OrgID"),
+			replay: r.Header.Get("X-Replay"),
+			at:     time.Now(),
+		})
+		mu.Unlock()
+
+		if r.Method == http.MethodGet {
+			w.Header().Set(string(proxymw.HeaderThrottleReason), proxymw.RateLimitProxyType)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	start := time.Date(2024, time.January, 5, 9, 0, 0, 0, time.UTC)
+	// written in completion order, replayed in arrival order
+	file := writeRecords(t,
+		proxymw.RecordedRequest{
+			Time:   start.Add(200 * time.Millisecond),
+			Method: http.MethodGet,
+			Path:   proxymw.QueryRangePath,
+			Params: url.Values{"query": {"rate(errors[5m])"}},
+		},
+		proxymw.RecordedRequest{
+			Time:   start,
+			Method: http.MethodPost,
+			Path:   proxymw.QueryPath,
+			Params: url.Values{"query": {"up"}},
+			Header: http.Header{"X-Scope-Orgid": {"team-a"}},
+		},
+	)
+
+	report, err := proxyutil.RunReplay(t.Context(), proxyutil.ReplayConfig{
+		Target:      srv.URL,
+		File:        file,
+		Speed:       2,
+		Concurrency: 1,
+		Headers:     map[string]string{"X-Replay": "true"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Requests)
+	require.Equal(t, 1, report.Allowed)
+	require.Equal(t, map[string]int{proxymw.RateLimitProxyType: 1}, report.Rejected)
+
+	require.Len(t, requests, 2)
+	require.Equal(t, received{
+		method: http.MethodPost,
+		path:   proxymw.QueryPath,
+		query:  "up",
+		tenant: "team-a",
+		replay: "true",
+		at:     requests[0].at,
+	}, requests[0])
+	require.Equal(t, http.MethodGet, requests[1].method)
+	require.Equal(t, proxymw.QueryRangePath, requests[1].path)
+	require.Equal(t, "rate(errors[5m])", requests[1].query)
+	require.GreaterOrEqual(t, requests[1].at.Sub(requests[0].at), 90*time.Millisecond,
+		"the 200ms gap is halved at twice the speed")
+}
+
+func TestRunReplayEmpty(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "traffic.jsonl")
+	require.NoError(t, os.WriteFile(file, []byte("\n"), 0o600))
+
+	_, err := proxyutil.RunReplay(t.Context(), proxyutil.ReplayConfig{
+		Target:      "http://localhost",
+		File:        file,
+		Concurrency: 1,
+	})
+	require.ErrorIs(t, err, proxyutil.ErrReplayNoRequests)
+}
@@ -0,0 +1,52 @@
+package proxyutil
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/kevindweb/throttle-proxy/proxymw"
+)
+
+// RuntimeReport summarizes the protections a proxy instance is running so fleet inventory
+// tooling can scrape what is enabled where.
+type RuntimeReport struct {
+	Upstream              string                          `json:"upstream"`
+	InsecureListenAddress string                          `json:"insecure_listen_addr"`
+	InternalListenAddress string                          `json:"internal_listen_addr,omitempty"`
+	ProxyPaths            []string                        `json:"proxy_paths"`
+	PassthroughPaths      []string                        `json:"passthrough_paths"`
+	Middlewares           []proxymw.MiddlewareDescription `json:"middlewares"`
+	Signals               []proxymw.SignalDescription     `json:"signals"`
+}
+
+// NewRuntimeReport builds the report for a parsed configuration
+func NewRuntimeReport(cfg Config) RuntimeReport {
+	return RuntimeReport{
+		Upstream:              proxymw.RedactURL(cfg.Upstream),
+		InsecureListenAddress: cfg.InsecureListenAddress,
+		InternalListenAddress: cfg.InternalListenAddress,
+		ProxyPaths:            cfg.ProxyPaths,
+		PassthroughPaths:      cfg.PassthroughPaths,
+		Middlewares:           cfg.ProxyConfig.Describe(),
+		Signals:               cfg.ProxyConfig.Signals(),
+	}
+}
+
+// Log writes the report as a single JSON log line
+func (r RuntimeReport) Log() {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("error encoding runtime report: %v", err)
+		return
+	}
+	log.Printf("runtime report: %s", b)
+}
+
+// ServeHTTP exposes the report as JSON
+func (r RuntimeReport) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		log.Printf("error writing runtime report: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package proxyutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+var ErrNegativeServerConfig = errors.New(
+	"server connection limit, timeouts, and keep-alive period cannot be negative",
+)
+
+// ServerConfig protects the insecure and internal servers of the proxy from connection
+// exhaustion. Unset fields keep the defaults of net/http.
+type ServerConfig struct {
+	// MaxConnections caps the connections each listener accepts at once. Further clients wait in
+	// the kernel accept queue. Zero means no limit.
+	MaxConnections int `yaml:"max_connections"`
+	// IdleTimeout is how long a keep-alive connection waits for the next request. Zero falls back
+	// to the read timeout.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ReadHeaderTimeout bounds reading request headers so slow clients cannot hold connections
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// KeepAlivePeriod is the interval of TCP keep-alive probes. Negative disables them.
+	KeepAlivePeriod time.Duration `yaml:"keep_alive_period"`
+	// DisableKeepAlives closes every connection after one request
+	DisableKeepAlives bool `yaml:"disable_keep_alives"`
+}
+
+func (c ServerConfig) Validate() error {
+	if c.MaxConnections < 0 || c.IdleTimeout < 0 || c.ReadHeaderTimeout < 0 {
+		return ErrNegativeServerConfig
+	}
+	return nil
+}
+
+// Listen announces on the address with the configured keep-alive period and connection limit.
+// Besides TCP addresses, unix:// sockets and systemd:// activated sockets are supported.
+func (c ServerConfig) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	l, err := listen(ctx, net.ListenConfig{KeepAlive: c.KeepAlivePeriod}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.MaxConnections > 0 {
+		l = netutil.LimitListener(l, c.MaxConnections)
+	}
+	return l, nil
+}
+
+// Apply sets the idle, read header, and keep-alive settings on the server
+func (c ServerConfig) Apply(srv *http.Server) {
+	srv.IdleTimeout = c.IdleTimeout
+	srv.ReadHeaderTimeout = c.ReadHeaderTimeout
+	srv.SetKeepAlivesEnabled(!c.DisableKeepAlives)
+}
@@ -0,0 +1,100 @@
+package proxyutil_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestServerConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  proxyutil.ServerConfig
+		err  error
+	}{
+		{name: "defaults"},
+		{
+			name: "disabled tcp keep-alives",
+			cfg:  proxyutil.ServerConfig{MaxConnections: 10, KeepAlivePeriod: -1},
+		},
+		{
+			name: "negative connections",
+			cfg:  proxyutil.ServerConfig{MaxConnections: -1},
+			err:  proxyutil.ErrNegativeServerConfig,
+		},
+		{
+			name: "negative idle timeout",
+			cfg:  proxyutil.ServerConfig{IdleTimeout: -time.Second},
+			err:  proxyutil.ErrNegativeServerConfig,
+		},
+		{
+			name: "negative read header timeout",
+			cfg:  proxyutil.ServerConfig{ReadHeaderTimeout: -time.Second},
+			err:  proxyutil.ErrNegativeServerConfig,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.ErrorIs(t, tt.cfg.Validate(), tt.err)
+		})
+	}
+}
+
+func TestServerConfigListen(t *testing.T) {
+	t.Parallel()
+	cfg := proxyutil.ServerConfig{MaxConnections: 1}
+	l, err := cfg.Listen(context.Background(), "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+
+	conn := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("second connection accepted while the first is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing the first connection frees its slot for the waiting client
+	require.NoError(t, conn.Close())
+	select {
+	case conn := <-accepted:
+		require.NoError(t, conn.Close())
+	case <-time.After(time.Second):
+		t.Fatal("second connection was not accepted after the first closed")
+	}
+}
+
+func TestServerConfigApply(t *testing.T) {
+	t.Parallel()
+	srv := &http.Server{}
+	proxyutil.ServerConfig{
+		IdleTimeout:       time.Minute,
+		ReadHeaderTimeout: 5 * time.Second,
+	}.Apply(srv)
+	require.Equal(t, time.Minute, srv.IdleTimeout)
+	require.Equal(t, 5*time.Second, srv.ReadHeaderTimeout)
+}
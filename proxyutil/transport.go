@@ -0,0 +1,30 @@
+package proxyutil
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNegativeUpstreamTransport = errors.New(
+	"upstream transport connection limits and idle timeout cannot be negative",
+)
+
+// UpstreamTransportConfig tunes the transport of the reverse proxy. Unset fields keep the values
+// of http.DefaultTransport.
+type UpstreamTransportConfig struct {
+	// DisableHTTP2 clears ForceAttemptHTTP2 so TLS upstreams are only spoken to over HTTP/1.1
+	DisableHTTP2 bool `yaml:"disable_http2"`
+	// H2C speaks cleartext HTTP/2 with prior knowledge to http:// upstreams, e.g. gRPC servers
+	H2C bool `yaml:"h2c"`
+	// MaxConnsPerHost caps dialing, active, and idle upstream connections. Zero means no limit.
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+}
+
+func (c UpstreamTransportConfig) Validate() error {
+	if c.MaxConnsPerHost < 0 || c.MaxIdleConnsPerHost < 0 || c.IdleConnTimeout < 0 {
+		return ErrNegativeUpstreamTransport
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package proxyutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestUpstreamTransportConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  proxyutil.UpstreamTransportConfig
+		err  error
+	}{
+		{name: "defaults"},
+		{name: "h2c", cfg: proxyutil.UpstreamTransportConfig{H2C: true, MaxConnsPerHost: 10}},
+		{
+			name: "negative conns",
+			cfg:  proxyutil.UpstreamTransportConfig{MaxConnsPerHost: -1},
+			err:  proxyutil.ErrNegativeUpstreamTransport,
+		},
+		{
+			name: "negative idle timeout",
+			cfg:  proxyutil.UpstreamTransportConfig{IdleConnTimeout: -time.Second},
+			err:  proxyutil.ErrNegativeUpstreamTransport,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorIs(t, tt.cfg.Validate(), tt.err)
+		})
+	}
+}
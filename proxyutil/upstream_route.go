@@ -0,0 +1,44 @@
+package proxyutil
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrInvalidUpstreamRoute = errors.New(
+	"upstream routes need an upstream and either a host or a header with a value",
+)
+
+// UpstreamRoute sends requests for a Host, or with a header value, to another upstream so one
+// proxy can front several Prometheus tenants or clusters. Routes are matched in order and
+// unmatched requests go to the default upstream.
+type UpstreamRoute struct {
+	// Host matches the Host header with or without its port
+	Host string `yaml:"host"`
+	// Header and Value match requests where the header equals the value, e.g. X-Scope-OrgID
+	Header   string `yaml:"header"`
+	Value    string `yaml:"value"`
+	Upstream string `yaml:"upstream"`
+}
+
+func (r UpstreamRoute) Validate() error {
+	if r.Upstream == "" || (r.Host == "") == (r.Header == "") || (r.Header != "" && r.Value == "") {
+		return ErrInvalidUpstreamRoute
+	}
+	return nil
+}
+
+// Matches reports whether the request should be sent to the upstream of the route
+func (r UpstreamRoute) Matches(req *http.Request) bool {
+	if r.Header != "" {
+		return req.Header.Get(r.Header) == r.Value
+	}
+
+	host := req.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return strings.EqualFold(r.Host, host) || strings.EqualFold(r.Host, hostname)
+	}
+	return strings.EqualFold(r.Host, host)
+}
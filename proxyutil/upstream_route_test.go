@@ -0,0 +1,57 @@
+package proxyutil_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kevindweb/throttle-proxy/proxyutil"
+)
+
+func TestUpstreamRouteValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		route proxyutil.UpstreamRoute
+		err   error
+	}{
+		{name: "host", route: proxyutil.UpstreamRoute{Host: "a.example.com", Upstream: "http://a"}},
+		{
+			name: "header",
+			route: proxyutil.UpstreamRoute{
+				Header: "X-Scope-OrgID", Value: "team-a", Upstream: "http://a",
+			},
+		},
+		{
+			name:  "missing upstream",
+			route: proxyutil.UpstreamRoute{Host: "a.example.com"},
+			err:   proxyutil.ErrInvalidUpstreamRoute,
+		},
+		{
+			name:  "host and header",
+			route: proxyutil.UpstreamRoute{Host: "a", Header: "X", Value: "b", Upstream: "http://a"},
+			err:   proxyutil.ErrInvalidUpstreamRoute,
+		},
+		{
+			name:  "header without value",
+			route: proxyutil.UpstreamRoute{Header: "X-Scope-OrgID", Upstream: "http://a"},
+			err:   proxyutil.ErrInvalidUpstreamRoute,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorIs(t, tt.route.Validate(), tt.err)
+		})
+	}
+}
+
+func TestUpstreamRouteMatches(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://Prom-A.example.com:8080/api/v1/query", nil)
+	req.Header.Set("X-Scope-OrgID", "team-a")
+
+	require.True(t, proxyutil.UpstreamRoute{Host: "prom-a.example.com"}.Matches(req))
+	require.True(t, proxyutil.UpstreamRoute{Host: "prom-a.example.com:8080"}.Matches(req))
+	require.False(t, proxyutil.UpstreamRoute{Host: "prom-b.example.com"}.Matches(req))
+	require.True(t, proxyutil.UpstreamRoute{Header: "X-Scope-OrgID", Value: "team-a"}.Matches(req))
+	require.False(t, proxyutil.UpstreamRoute{Header: "X-Scope-OrgID", Value: "team-b"}.Matches(req))
+}